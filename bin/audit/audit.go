@@ -0,0 +1,319 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileName is the file in the data directory holding the audit log
+const fileName = "audit.log"
+
+// Sources of the operations recorded
+const (
+	SourceTUI   = "tui"
+	SourceCLI   = "cli"
+	SourceAPI   = "api"
+	SourceAgent = "agent"
+)
+
+// Operations recorded
+const (
+	OpGet      = "get"
+	OpSet      = "set"
+	OpDelete   = "delete"
+	OpScan     = "scan"     // a read of every key in a range, recorded under its start
+	OpVersions = "versions" // a read of the past values of a key
+	OpExport   = "export"   // keys starting with a prefix written to a file
+	OpImport   = "import"
+	OpWatch    = "watch" // writes to keys starting with a prefix followed as they happen
+)
+
+// ErrTampered is returned when reading an audit log whose chain of hashes is broken
+var ErrTampered = errors.New("audit: log was tampered with")
+
+// Entry is an operation recorded in the audit log. Each entry holds the hash of
+// the one before it, and its own hash covers that, so changing or dropping an
+// entry breaks the chain from there on.
+type Entry struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Op     string    `json:"op"`
+	Key    string    `json:"key,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Prev   string    `json:"prev"`
+	Hash   string    `json:"hash"`
+}
+
+// digest returns the hash of an entry: SHA-256 of its JSON encoding without the hash
+func (e Entry) digest() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Filter selects entries of the audit log. Empty fields match every entry.
+type Filter struct {
+	Key    string // keys starting with this prefix
+	Op     string
+	Source string
+	Since  time.Time
+}
+
+// Matches reports whether an entry is selected by the filter
+func (f Filter) Matches(e Entry) bool {
+	return strings.HasPrefix(e.Key, f.Key) &&
+		(f.Op == "" || e.Op == f.Op) &&
+		(f.Source == "" || e.Source == f.Source) &&
+		!e.Time.Before(f.Since)
+}
+
+// Log appends entries to the audit log of a data directory, one JSON line each
+type Log struct {
+	mutex sync.Mutex
+	file  *os.File
+	seq   uint64 // number of the last entry
+	last  string // hash of the last entry
+}
+
+// Open opens the audit log of a data directory for appending, creating it if
+// needed. An entry torn by a crash while it was written is dropped.
+func Open(dataDir string) (*Log, error) {
+	file, err := os.OpenFile(filepath.Join(dataDir, fileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	line, size, err := lastLine(file)
+	if err == nil && size > 0 && (line == nil || line[len(line)-1] != '\n') {
+		// The torn entry either follows the last whole line or is the whole file
+		end := int64(0)
+		if line != nil {
+			end = size - int64(len(line))
+		}
+		line, err = nil, file.Truncate(end)
+		if end > 0 {
+			line, _, err = lastLine(file)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	l := &Log{file: file}
+	if len(line) > 0 {
+		var last Entry
+		if err := json.Unmarshal(line, &last); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%w: malformed last entry", ErrTampered)
+		}
+		l.seq, l.last = last.Seq, last.Hash
+	}
+	return l, nil
+}
+
+// lastLine returns the last line of a file with its newline, if it has one, and
+// the file's size. A file without a newline has no whole line, and returns nil.
+func lastLine(file *os.File) ([]byte, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := info.Size()
+	var tail []byte
+	for offset := size; offset > 0; {
+		chunk := min(offset, 4096)
+		offset -= chunk
+		buf := make([]byte, chunk)
+		if _, err := file.ReadAt(buf, offset); err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		tail = append(buf, tail...)
+		// The newline ending the line before the last one
+		if i := bytes.LastIndexByte(tail[:len(tail)-1], '\n'); i >= 0 {
+			return tail[i+1:], size, nil
+		}
+	}
+	if len(tail) > 0 && tail[len(tail)-1] == '\n' {
+		return tail, size, nil
+	}
+	// A single torn line makes up the file
+	return nil, size, nil
+}
+
+// Record appends an operation to the log
+func (l *Log) Record(source, op, key, detail string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry := Entry{Seq: l.seq + 1, Time: time.Now().UTC(), Source: source, Op: op, Key: key, Detail: detail, Prev: l.last}
+	entry.Hash = entry.digest()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	l.seq, l.last = entry.Seq, entry.Hash
+	return nil
+}
+
+// Close syncs and closes the log
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := l.file.Sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Read returns the entries of the audit log of a data directory, oldest first,
+// checking the chain of hashes. If it's broken, the entries before the break are
+// returned with ErrTampered.
+func Read(dataDir string) ([]Entry, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, fileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	return parseEntries(data)
+}
+
+// parseEntries decodes the lines of an audit log, checking the chain of hashes
+func parseEntries(data []byte) ([]Entry, error) {
+	var entries []Entry
+	prev := Entry{}
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			break
+		}
+		if line[len(line)-1] != '\n' {
+			break // Torn by a crash, dropped once the log is opened again
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return entries, fmt.Errorf("%w: malformed entry after %d", ErrTampered, prev.Seq)
+		}
+		switch {
+		case entry.Seq != prev.Seq+1:
+			return entries, fmt.Errorf("%w: entry %d follows %d", ErrTampered, entry.Seq, prev.Seq)
+		case entry.Prev != prev.Hash || entry.Hash != entry.digest():
+			return entries, fmt.Errorf("%w: entry %d doesn't match its hash", ErrTampered, entry.Seq)
+		}
+		entries = append(entries, entry)
+		prev = entry
+	}
+	return entries, nil
+}
+
+// Export writes the entries of the audit log of a data directory to w, one JSON
+// line each as in the log, and returns how many it wrote. A log whose chain is
+// broken isn't exported.
+func Export(dataDir string, w io.Writer) (int, error) {
+	entries, err := Read(dataDir)
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return i, fmt.Errorf("failed to encode audit entry: %w", err)
+		}
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return i, fmt.Errorf("failed to write audit entries: %w", err)
+		}
+	}
+	return len(entries), nil
+}
+
+// Import appends the entries of an export read from r to the audit log of a data
+// directory, and returns how many it appended. The chain of the exported entries
+// is checked first. Entries are kept as they are, so their hashes still hold, and
+// the log must be empty or hold the beginning of the same chain: entries it
+// already holds are skipped, and a log with entries of its own is refused.
+func Import(dataDir string, r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read audit entries: %w", err)
+	}
+	// An export is never torn, so a last line without a newline is kept
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	imported, err := parseEntries(data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to import audit entries: %w", err)
+	}
+
+	l, err := Open(dataDir)
+	if err != nil {
+		return 0, err
+	}
+	n, err := l.importEntries(dataDir, imported)
+	if closeErr := l.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// importEntries appends the imported entries the log doesn't hold yet
+func (l *Log) importEntries(dataDir string, imported []Entry) (int, error) {
+	existing, err := Read(dataDir)
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range existing {
+		if i >= len(imported) {
+			break
+		}
+		if entry.Hash != imported[i].Hash {
+			return 0, fmt.Errorf("audit log already holds other entries from %d on; import into a new data directory", entry.Seq)
+		}
+	}
+	if len(existing) >= len(imported) {
+		return 0, nil
+	}
+	if err := l.append(imported[len(existing):]); err != nil {
+		return 0, err
+	}
+	return len(imported) - len(existing), nil
+}
+
+// append writes entries continuing the log's chain as they are
+func (l *Log) append(entries []Entry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var buf []byte
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit entry: %w", err)
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	if _, err := l.file.Write(buf); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	last := entries[len(entries)-1]
+	l.seq, l.last = last.Seq, last.Hash
+	return nil
+}
@@ -0,0 +1,210 @@
+package audit
+
+import (
+	"context"
+	"errors"
+
+	"Lockr/bin/lsmtree"
+)
+
+// versionedStore is a store keeping the past values of its keys, like the vault
+// over a tree with Options.Versions
+type versionedStore interface {
+	Versions(key string) ([]lsmtree.Version, error)
+}
+
+// watchableStore is a store reporting its writes, like the vault
+type watchableStore interface {
+	Watch(prefix string) (<-chan lsmtree.Event, func(), error)
+}
+
+// statsStore is a store reporting the statistics of its engine, like the vault
+type statsStore interface {
+	Stats() (lsmtree.Stats, error)
+}
+
+// reclaimStore is a store that can free the space of its deleted entries, like the vault
+type reclaimStore interface {
+	Reclaim() (lsmtree.ReclaimResult, error)
+}
+
+// Store wraps a store and records its operations in an audit log as coming from
+// one source. Values are never recorded, only the keys they're stored under.
+type Store struct {
+	store  lsmtree.Store
+	log    *Log
+	source string
+}
+
+var _ lsmtree.ContextStore = (*Store)(nil)
+
+// Wrap returns store recording its operations to log under source
+func Wrap(store lsmtree.Store, log *Log, source string) *Store {
+	return &Store{store: store, log: log, source: source}
+}
+
+// Unwrap returns the underlying store, whose operations aren't recorded
+func (s *Store) Unwrap() lsmtree.Store {
+	return s.store
+}
+
+// Rewrap returns another store recording its operations to the same log, under the same source
+func (s *Store) Rewrap(store lsmtree.Store) *Store {
+	return Wrap(store, s.log, s.source)
+}
+
+// Record records an operation made with the store other than its reads and writes,
+// like an export
+func (s *Store) Record(op, key, detail string) error {
+	return s.log.Record(s.source, op, key, detail)
+}
+
+// Get retrieves the value for a key, recording the read
+func (s *Store) Get(key string) (string, error) {
+	return s.GetCtx(context.Background(), key)
+}
+
+// GetCtx is like Get, giving up when ctx is done as the underlying store does.
+// Reads given up on aren't recorded.
+func (s *Store) GetCtx(ctx context.Context, key string) (string, error) {
+	value, err := lsmtree.WithContext(s.store).GetCtx(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Record(OpGet, key, ""); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// Set adds or updates a key-value pair, recording the write
+func (s *Store) Set(key, value string) error {
+	return s.SetCtx(context.Background(), key, value)
+}
+
+// SetCtx is like Set, giving up when ctx is done as the underlying store does
+func (s *Store) SetCtx(ctx context.Context, key, value string) error {
+	if err := lsmtree.WithContext(s.store).SetCtx(ctx, key, value); err != nil {
+		return err
+	}
+	return s.Record(OpSet, key, "")
+}
+
+// Delete removes a key-value pair, recording the deletion
+func (s *Store) Delete(key string) error {
+	return s.DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx is like Delete, giving up when ctx is done as the underlying store does
+func (s *Store) DeleteCtx(ctx context.Context, key string) error {
+	if err := lsmtree.WithContext(s.store).DeleteCtx(ctx, key); err != nil {
+		return err
+	}
+	return s.Record(OpDelete, key, "")
+}
+
+// Scan returns an iterator over live keys in [start, end), recording the read of the range
+func (s *Store) Scan(start, end string) (lsmtree.Iterator, error) {
+	return s.ScanCtx(context.Background(), start, end)
+}
+
+// ScanCtx is like Scan, giving up when ctx is done as the underlying store does
+func (s *Store) ScanCtx(ctx context.Context, start, end string) (lsmtree.Iterator, error) {
+	it, err := lsmtree.WithContext(s.store).ScanCtx(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	detail := ""
+	if end != "" {
+		detail = "to " + end
+	}
+	if err := s.Record(OpScan, start, detail); err != nil {
+		it.Close()
+		return nil, err
+	}
+	return it, nil
+}
+
+// Batch applies all operations of the batch, recording each of them
+func (s *Store) Batch(batch *lsmtree.WriteBatch) error {
+	return s.BatchCtx(context.Background(), batch)
+}
+
+// BatchCtx is like Batch, giving up when ctx is done as the underlying store does
+func (s *Store) BatchCtx(ctx context.Context, batch *lsmtree.WriteBatch) error {
+	if err := lsmtree.WithContext(s.store).BatchCtx(ctx, batch); err != nil {
+		return err
+	}
+	for _, op := range batch.Ops() {
+		name := OpSet
+		if op.Delete {
+			name = OpDelete
+		}
+		if err := s.Record(name, op.Key, "batch"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Versions returns the versions kept of a key, recording the read. Without
+// versions in the store it returns errors.ErrUnsupported.
+func (s *Store) Versions(key string) ([]lsmtree.Version, error) {
+	store, ok := s.store.(versionedStore)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	versions, err := store.Versions(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Record(OpVersions, key, ""); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Stats returns the statistics of the store's engine, which aren't recorded.
+// Without a store reporting them it returns errors.ErrUnsupported.
+func (s *Store) Stats() (lsmtree.Stats, error) {
+	store, ok := s.store.(statsStore)
+	if !ok {
+		return lsmtree.Stats{}, errors.ErrUnsupported
+	}
+	return store.Stats()
+}
+
+// Reclaim frees the space of the deleted and overwritten entries of the store's
+// engine, which isn't recorded as it changes no key. Without a store that can it
+// returns errors.ErrUnsupported.
+func (s *Store) Reclaim() (lsmtree.ReclaimResult, error) {
+	store, ok := s.store.(reclaimStore)
+	if !ok {
+		return lsmtree.ReclaimResult{}, errors.ErrUnsupported
+	}
+	return store.Reclaim()
+}
+
+// Watch returns a channel of the writes to keys starting with prefix and a
+// function that stops watching, recording the watch. Without a watchable store it
+// returns errors.ErrUnsupported.
+func (s *Store) Watch(prefix string) (<-chan lsmtree.Event, func(), error) {
+	store, ok := s.store.(watchableStore)
+	if !ok {
+		return nil, nil, errors.ErrUnsupported
+	}
+	events, stop, err := store.Watch(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.Record(OpWatch, prefix, ""); err != nil {
+		stop()
+		return nil, nil, err
+	}
+	return events, stop, nil
+}
+
+// Close closes the underlying store. The log is closed by its owner.
+func (s *Store) Close() error {
+	return s.store.Close()
+}
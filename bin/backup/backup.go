@@ -0,0 +1,399 @@
+// Package backup uploads encrypted checkpoints of a tree, and the WAL segments it
+// archives, to remote targets such as S3 and SFTP servers, prunes them by a
+// retention policy and downloads them back to restore from.
+//
+// A target holds a key file with the salt of the key its objects are encrypted
+// with, derived from a passphrase; the checkpoints, each a tar of a checkpoint
+// directory under checkpoints/; and the archived WAL segments under wal/.
+// Checkpoints are named by the time they were taken and the first WAL segment with
+// writes they don't hold, so retention and restores need no other index.
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"Lockr/bin/lsmtree"
+)
+
+// Where objects go on a target, and how they're named
+const (
+	checkpointDir = "checkpoints"
+	walDir        = "wal"
+	objectExt     = ".lockrbackup"
+	timeFormat    = "20060102T150405.000Z"
+)
+
+// Options configures Upload
+type Options struct {
+	Passphrase string
+	// KeepLast and KeepWithin are the retention policy: after an upload, the
+	// checkpoints that are neither among the newest KeepLast nor younger than
+	// KeepWithin are deleted, with the WAL segments only they needed. Both zero
+	// keep every checkpoint.
+	KeepLast   int
+	KeepWithin time.Duration
+}
+
+// Checkpoint is a checkpoint uploaded to a target
+type Checkpoint struct {
+	Name       string    `json:"name"`
+	Taken      time.Time `json:"taken"`
+	LogSegment uint64    `json:"log_segment"` // the first WAL segment with writes the checkpoint doesn't hold
+}
+
+// UploadResult describes what Upload uploaded and deleted
+type UploadResult struct {
+	Checkpoint Checkpoint
+	Segments   int      // archived WAL segments uploaded
+	Bytes      int64    // bytes uploaded
+	Deleted    []string // objects deleted by the retention policy
+}
+
+// Upload takes a checkpoint of tree and uploads it to target, with the WAL
+// segments the tree archived (see lsmtree.Options.WALArchiveDir) that target
+// doesn't have yet, then applies the retention policy
+func Upload(ctx context.Context, tree *lsmtree.LSMTree, target Target, options Options) (UploadResult, error) {
+	var result UploadResult
+	key, err := loadKey(ctx, target, options.Passphrase, true)
+	if err != nil {
+		return result, err
+	}
+	tmp, err := os.MkdirTemp("", "lockr-backup-")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(tmp)
+
+	// The segments go first, for the checkpoint to need none that isn't uploaded.
+	// Those older than every checkpoint uploaded are held by them, or were pruned
+	if dir := tree.WALArchiveDir(); dir != "" {
+		segments, err := lsmtree.ArchivedWALSegments(dir)
+		if err != nil {
+			return result, err
+		}
+		checkpoints, err := List(ctx, target)
+		if err != nil {
+			return result, err
+		}
+		oldest := uint64(math.MaxUint64)
+		for _, checkpoint := range checkpoints {
+			oldest = min(oldest, checkpoint.LogSegment)
+		}
+		uploaded, err := target.List(ctx, walDir)
+		if err != nil {
+			return result, fmt.Errorf("failed to list uploaded WAL segments: %w", err)
+		}
+		have := make(map[string]bool, len(uploaded))
+		for _, name := range uploaded {
+			have[name] = true
+		}
+		for _, segment := range segments {
+			name := lsmtree.WALSegmentName(segment)
+			if segment < oldest || have[name+objectExt] {
+				continue
+			}
+			size, err := uploadObject(ctx, target, key, walDir+"/"+name+objectExt, tmp, func(w io.Writer) error {
+				return copyFile(w, filepath.Join(dir, name))
+			})
+			if err != nil {
+				return result, fmt.Errorf("failed to upload WAL segment %d: %w", segment, err)
+			}
+			result.Segments++
+			result.Bytes += size
+		}
+	}
+
+	dir := filepath.Join(tmp, "checkpoint")
+	if err := tree.Checkpoint(dir); err != nil {
+		return result, fmt.Errorf("failed to checkpoint: %w", err)
+	}
+	segment, err := lsmtree.CheckpointLogSegment(dir)
+	if err != nil {
+		return result, err
+	}
+	result.Checkpoint = Checkpoint{Taken: time.Now().UTC(), LogSegment: segment}
+	result.Checkpoint.Name = result.Checkpoint.Taken.Format(timeFormat) + "-" + strconv.FormatUint(segment, 10)
+	size, err := uploadObject(ctx, target, key, checkpointDir+"/"+result.Checkpoint.Name+objectExt, tmp, func(w io.Writer) error {
+		return writeTar(w, dir)
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to upload checkpoint: %w", err)
+	}
+	result.Bytes += size
+
+	if options.KeepLast > 0 || options.KeepWithin > 0 {
+		if result.Deleted, err = prune(ctx, target, options.KeepLast, options.KeepWithin, result.Checkpoint.Taken); err != nil {
+			return result, fmt.Errorf("failed to apply the retention policy: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// uploadObject seals what write writes as the object name in a temporary file of
+// tmp, then uploads it and returns its size
+func uploadObject(ctx context.Context, target Target, key []byte, name, tmp string, write func(io.Writer) error) (int64, error) {
+	file, err := os.CreateTemp(tmp, "object-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	sealed, err := newSealWriter(file, key, name)
+	if err != nil {
+		return 0, err
+	}
+	if err := write(sealed); err != nil {
+		return 0, err
+	}
+	if err := sealed.Close(); err != nil {
+		return 0, err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, target.Put(ctx, name, file, size)
+}
+
+// copyFile writes the content of the file at path to w
+func copyFile(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// writeTar writes the files of a checkpoint directory to w as a tar
+func writeTar(w io.Writer, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{Name: entry.Name(), Mode: 0600, Size: info.Size(), ModTime: info.ModTime()}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyFile(tw, filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// List returns the checkpoints uploaded to target, oldest first
+func List(ctx context.Context, target Target) ([]Checkpoint, error) {
+	names, err := target.List(ctx, checkpointDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+	var checkpoints []Checkpoint
+	for _, name := range names {
+		if checkpoint, ok := parseCheckpoint(name); ok {
+			checkpoints = append(checkpoints, checkpoint)
+		}
+	}
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i].Taken.Before(checkpoints[j].Taken) })
+	return checkpoints, nil
+}
+
+// parseCheckpoint parses the name of a checkpoint object
+func parseCheckpoint(object string) (Checkpoint, bool) {
+	name, ok := strings.CutSuffix(object, objectExt)
+	if !ok {
+		return Checkpoint{}, false
+	}
+	stamp, rawSegment, ok := strings.Cut(name, "-")
+	if !ok {
+		return Checkpoint{}, false
+	}
+	taken, err := time.Parse(timeFormat, stamp)
+	if err != nil {
+		return Checkpoint{}, false
+	}
+	segment, err := strconv.ParseUint(rawSegment, 10, 64)
+	if err != nil {
+		return Checkpoint{}, false
+	}
+	return Checkpoint{Name: name, Taken: taken, LogSegment: segment}, true
+}
+
+// prune deletes the checkpoints the retention policy doesn't keep as of now, and
+// the WAL segments older than every checkpoint kept
+func prune(ctx context.Context, target Target, keepLast int, keepWithin time.Duration, now time.Time) ([]string, error) {
+	checkpoints, err := List(ctx, target)
+	if err != nil || len(checkpoints) == 0 {
+		return nil, err
+	}
+	var deleted []string
+	oldest := checkpoints[len(checkpoints)-1].LogSegment
+	for i, checkpoint := range checkpoints {
+		newest := len(checkpoints) - i
+		if newest <= max(keepLast, 1) || (keepWithin > 0 && now.Sub(checkpoint.Taken) < keepWithin) {
+			oldest = min(oldest, checkpoint.LogSegment)
+			continue
+		}
+		name := checkpointDir + "/" + checkpoint.Name + objectExt
+		if err := target.Delete(ctx, name); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, name)
+	}
+
+	segments, err := target.List(ctx, walDir)
+	if err != nil {
+		return deleted, err
+	}
+	for _, object := range segments {
+		var segment uint64
+		if _, err := fmt.Sscanf(object, "wal-%d.log"+objectExt, &segment); err != nil || segment >= oldest {
+			continue
+		}
+		name := walDir + "/" + object
+		if err := target.Delete(ctx, name); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, name)
+	}
+	return deleted, nil
+}
+
+// DownloadResult describes what Download downloaded
+type DownloadResult struct {
+	Checkpoint Checkpoint
+	Segments   int // WAL segments downloaded
+}
+
+// Download downloads the checkpoint name of target, or the newest one when name
+// is empty, into dir, a new directory that then holds a backup lsmtree.Restore
+// takes. Unless segmentsDir is empty, the uploaded WAL segments with writes the
+// checkpoint doesn't hold are downloaded into it, for the restore to replay.
+func Download(ctx context.Context, target Target, passphrase, name, dir, segmentsDir string) (DownloadResult, error) {
+	var result DownloadResult
+	key, err := loadKey(ctx, target, passphrase, false)
+	if err != nil {
+		return result, err
+	}
+	checkpoints, err := List(ctx, target)
+	if err != nil {
+		return result, err
+	}
+	for _, checkpoint := range checkpoints {
+		if checkpoint.Name == name || (name == "" && checkpoint == checkpoints[len(checkpoints)-1]) {
+			result.Checkpoint = checkpoint
+		}
+	}
+	if result.Checkpoint.Name == "" {
+		if name == "" {
+			return result, ErrNoBackups
+		}
+		return result, fmt.Errorf("no checkpoint %s at the target", name)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return result, err
+	}
+	err = downloadObject(ctx, target, key, checkpointDir+"/"+result.Checkpoint.Name+objectExt, func(r io.Reader) error {
+		return readTar(r, dir)
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to download checkpoint %s: %w", result.Checkpoint.Name, err)
+	}
+	if segmentsDir == "" {
+		return result, nil
+	}
+
+	objects, err := target.List(ctx, walDir)
+	if err != nil {
+		return result, fmt.Errorf("failed to list uploaded WAL segments: %w", err)
+	}
+	if err := os.MkdirAll(segmentsDir, 0700); err != nil {
+		return result, err
+	}
+	for _, object := range objects {
+		var segment uint64
+		if _, err := fmt.Sscanf(object, "wal-%d.log"+objectExt, &segment); err != nil || segment < result.Checkpoint.LogSegment {
+			continue
+		}
+		err := downloadObject(ctx, target, key, walDir+"/"+object, func(r io.Reader) error {
+			return writeFile(filepath.Join(segmentsDir, lsmtree.WALSegmentName(segment)), r)
+		})
+		if err != nil {
+			return result, fmt.Errorf("failed to download WAL segment %d: %w", segment, err)
+		}
+		result.Segments++
+	}
+	return result, nil
+}
+
+// downloadObject passes the opened content of the object name to read
+func downloadObject(ctx context.Context, target Target, key []byte, name string, read func(io.Reader) error) error {
+	body, err := target.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	opened, err := newOpenReader(body, key, name)
+	if err != nil {
+		return err
+	}
+	return read(opened)
+}
+
+// readTar extracts the files of a checkpoint tar into dir
+func readTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || header.Name != filepath.Base(header.Name) || header.Name == ".." {
+			return fmt.Errorf("unexpected entry %q in checkpoint", header.Name)
+		}
+		if err := writeFile(filepath.Join(dir, header.Name), tr); err != nil {
+			return err
+		}
+	}
+}
+
+// writeFile writes r to a new owner-only file at path
+func writeFile(path string, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
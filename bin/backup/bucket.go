@@ -0,0 +1,177 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrPreconditionFailed is returned by a conditional write of a Bucket when the
+// object isn't in the state the write expected, as another writer changed it
+var ErrPreconditionFailed = errors.New("backup: object changed since it was read")
+
+// ObjectInfo describes an object of a Bucket
+type ObjectInfo struct {
+	Name     string // relative to the bucket's root
+	Size     int64
+	ETag     string // changes whenever the object is written
+	Modified time.Time
+}
+
+// Bucket is a bucket of S3, or of a service with its API, used as general object
+// storage with ranged reads and conditional writes, which objectfs keeps the
+// files of a tree in. Objects are named by slash-separated paths relative to the
+// path of its URL, as those of a Target.
+type Bucket struct {
+	target *s3Target
+}
+
+// OpenBucket returns the bucket of an s3://bucket/path or gs://bucket/path URL,
+// with the credentials of a backup target of the same URL
+func OpenBucket(rawURL string) (*Bucket, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bucket %q: %w", rawURL, err)
+	}
+	var target *s3Target
+	switch u.Scheme {
+	case "s3":
+		target, err = newS3Target(u)
+	case "gs":
+		target, err = newGCSTarget(u)
+	default:
+		return nil, fmt.Errorf("unsupported bucket %q, expected s3:// or gs://", rawURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{target: target}, nil
+}
+
+// Get returns length bytes of the object name from offset, or the rest of it if
+// length is negative, or ErrNotFound
+func (b *Bucket) Get(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	header := http.Header{}
+	switch {
+	case length > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := b.target.do(ctx, http.MethodGet, join(b.target.root, name), nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Stat describes the object name, or returns ErrNotFound
+func (b *Bucket) Stat(ctx context.Context, name string) (ObjectInfo, error) {
+	resp, err := b.target.do(ctx, http.MethodHead, join(b.target.root, name), nil, nil, nil, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	info := ObjectInfo{Name: name, Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}
+	info.Modified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+// Put uploads data as the object name, replacing any before, and returns its ETag
+func (b *Bucket) Put(ctx context.Context, name string, data []byte) (string, error) {
+	return b.put(ctx, name, data, nil)
+}
+
+// PutIf uploads data as the object name only if the object still has the given
+// ETag, or doesn't exist for an empty one, and returns its new ETag. Otherwise it
+// returns ErrPreconditionFailed.
+func (b *Bucket) PutIf(ctx context.Context, name string, data []byte, etag string) (string, error) {
+	header := http.Header{}
+	if etag == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", etag)
+	}
+	return b.put(ctx, name, data, header)
+}
+
+// put uploads an object with the given conditional headers
+func (b *Bucket) put(ctx context.Context, name string, data []byte, header http.Header) (string, error) {
+	var body io.ReadCloser = http.NoBody
+	if len(data) > 0 {
+		body = io.NopCloser(bytes.NewReader(data))
+	}
+	resp, err := b.target.do(ctx, http.MethodPut, join(b.target.root, name), nil, header, body, int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// bucketListResult is the part of a ListObjectsV2 response read for a Bucket
+type bucketListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		ETag         string    `xml:"ETag"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List describes the objects whose name starts with prefix, at any depth,
+// sorted by name
+func (b *Bucket) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	root := join(b.target.root, "")
+	query := url.Values{"list-type": {"2"}, "prefix": {root + prefix}}
+	var objects []ObjectInfo
+	for {
+		resp, err := b.target.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result bucketListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the object listing: %w", err)
+		}
+		for _, object := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Name:     strings.TrimPrefix(object.Key, root),
+				Size:     object.Size,
+				ETag:     object.ETag,
+				Modified: object.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Delete removes the object name, if there is one
+func (b *Bucket) Delete(ctx context.Context, name string) error {
+	resp, err := b.target.do(ctx, http.MethodDelete, join(b.target.root, name), nil, nil, nil, 0)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
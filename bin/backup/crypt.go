@@ -0,0 +1,246 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Objects are sealed in chunks with AES-256-GCM under a key of their own, derived
+// from the target's key and a random salt at the start of the object. The nonce of
+// a chunk is its number, with a flag on the last one so a truncated object fails to
+// open, and the name of the object is authenticated with every chunk so objects
+// can't be swapped.
+const (
+	objectMagic = "LKRBKP01"
+	saltSize    = 16
+	chunkSize   = 64 << 10
+
+	keyFileName   = "lockr-backup.json"
+	keyFileFormat = "lockr-backup-1"
+	keyCheck      = "lockr backup key check"
+
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+)
+
+// ErrWrongPassphrase is returned when a target's backups were encrypted with another passphrase
+var ErrWrongPassphrase = errors.New("backup: wrong backup passphrase")
+
+// ErrNoBackups is returned when reading the backups of a target nothing was backed up to
+var ErrNoBackups = errors.New("backup: no backups at the target")
+
+// keyFile is kept at the root of a target, with what's needed to derive the key
+// of its backups from the passphrase and check it
+type keyFile struct {
+	Format string `json:"format"`
+	Salt   []byte `json:"salt"`
+	Check  []byte `json:"check"`
+}
+
+// Initialized reports whether anything was backed up to target, so that its
+// passphrase is already chosen
+func Initialized(ctx context.Context, target Target) (bool, error) {
+	r, err := target.Get(ctx, keyFileName)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	r.Close()
+	return true, nil
+}
+
+// loadKey derives the key of target's backups from passphrase, creating the key
+// file of a target with no backups yet when create is set
+func loadKey(ctx context.Context, target Target, passphrase string, create bool) ([]byte, error) {
+	r, err := target.Get(ctx, keyFileName)
+	switch {
+	case errors.Is(err, ErrNotFound) && create:
+		file := keyFile{Format: keyFileFormat, Salt: make([]byte, saltSize)}
+		if _, err := rand.Read(file.Salt); err != nil {
+			return nil, err
+		}
+		key := deriveKey(passphrase, file.Salt)
+		file.Check = checkOf(key)
+		data, err := json.Marshal(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := target.Put(ctx, keyFileName, bytes.NewReader(data), int64(len(data))); err != nil {
+			return nil, fmt.Errorf("failed to upload %s: %w", keyFileName, err)
+		}
+		return key, nil
+	case errors.Is(err, ErrNotFound):
+		return nil, ErrNoBackups
+	case err != nil:
+		return nil, fmt.Errorf("failed to read %s: %w", keyFileName, err)
+	}
+	defer r.Close()
+	var file keyFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil || file.Format != keyFileFormat {
+		return nil, fmt.Errorf("%s of the target isn't a Lockr backup key file", keyFileName)
+	}
+	key := deriveKey(passphrase, file.Salt)
+	if !hmac.Equal(checkOf(key), file.Check) {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// deriveKey derives the key of a target's backups from passphrase with Argon2id
+func deriveKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, argon2Time, argon2Memory, argon2Threads, 32)
+}
+
+// checkOf returns what the key file holds to check a key with
+func checkOf(key []byte) []byte {
+	return subkey(key, []byte(keyCheck))
+}
+
+// subkey derives a key from key for salt
+func subkey(key, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+// objectAEAD returns the cipher of an object sealed with salt under key
+func objectAEAD(key, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(subkey(key, salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the nth chunk of an object
+func chunkNonce(aead cipher.AEAD, n uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, n)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// sealWriter seals what's written to it as an object named name, which Close completes
+type sealWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	name  []byte
+	buf   []byte
+	chunk uint64
+}
+
+// newSealWriter writes the header of an object named name to w and returns the
+// writer of its content
+func newSealWriter(w io.Writer, key []byte, name string) (*sealWriter, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := objectAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(objectMagic), salt...)); err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, aead: aead, name: []byte(name), buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if len(s.buf) == chunkSize {
+			if err := s.flush(false); err != nil {
+				return 0, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):chunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close seals the last chunk, which may be empty
+func (s *sealWriter) Close() error {
+	return s.flush(true)
+}
+
+func (s *sealWriter) flush(last bool) error {
+	sealed := s.aead.Seal(nil, chunkNonce(s.aead, s.chunk, last), s.buf, s.name)
+	s.chunk++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// openReader reads the content of a sealed object
+type openReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	name    []byte
+	frame   []byte
+	pending []byte
+	chunk   uint64
+	done    bool
+}
+
+// newOpenReader reads the header of an object named name from r and returns the
+// reader of its content
+func newOpenReader(r io.Reader, key []byte, name string) (*openReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(objectMagic)+saltSize)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(objectMagic)]) != objectMagic {
+		return nil, fmt.Errorf("%s isn't a Lockr backup object", name)
+	}
+	aead, err := objectAEAD(key, header[len(objectMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{r: br, aead: aead, name: []byte(name), frame: make([]byte, chunkSize+aead.Overhead())}, nil
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.pending) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(o.r, o.frame)
+		last := errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+		if err != nil && !last {
+			return 0, err
+		}
+		if !last {
+			if _, err := o.r.Peek(1); errors.Is(err, io.EOF) {
+				last = true
+			}
+		}
+		plain, err := o.aead.Open(o.frame[:0], chunkNonce(o.aead, o.chunk, last), o.frame[:n], o.name)
+		if err != nil {
+			return 0, fmt.Errorf("backup object %s is corrupt or truncated", o.name)
+		}
+		o.chunk++
+		o.pending, o.done = plain, last
+	}
+	n := copy(p, o.pending)
+	o.pending = o.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// dirTarget keeps backups in a local directory, such as a mounted network drive
+type dirTarget struct {
+	root string
+}
+
+func newDirTarget(root string) (*dirTarget, error) {
+	if root == "" {
+		return nil, fmt.Errorf("a backup directory must be given")
+	}
+	return &dirTarget{root: root}, nil
+}
+
+func (t *dirTarget) path(name string) string {
+	return filepath.Join(t.root, filepath.FromSlash(name))
+}
+
+// Put writes the object to a temporary file renamed over the previous one, so a
+// failed upload never leaves half an object
+func (t *dirTarget) Put(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
+	path := t.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(file, data, size); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (t *dirTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	file, err := os.Open(t.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (t *dirTarget) List(ctx context.Context, dir string) ([]string, error) {
+	entries, err := os.ReadDir(t.path(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && filepath.Ext(entry.Name()) != ".tmp" {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (t *dirTarget) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(t.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (t *dirTarget) Close() error {
+	return nil
+}
@@ -0,0 +1,312 @@
+package backup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Target keeps backups in a bucket of S3 or a service with its API, such as
+// MinIO or the XML API of Google Cloud Storage. Requests are signed with AWS
+// Signature Version 4; bodies are sent unsigned, which the TLS of the endpoint
+// protects.
+type s3Target struct {
+	client    *http.Client
+	endpoint  *url.URL // scheme and host of the service
+	pathStyle bool     // the bucket is the first segment of the path rather than of the host
+	bucket    string
+	root      string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+}
+
+// newS3Target returns the target of an s3://bucket/path URL, with credentials from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, the region from
+// AWS_REGION and an S3-compatible service's endpoint from AWS_ENDPOINT_URL
+func newS3Target(u *url.URL) (*s3Target, error) {
+	t := &s3Target{
+		client:    http.DefaultClient,
+		bucket:    u.Host,
+		root:      u.Path,
+		region:    firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if t.bucket == "" {
+		return nil, fmt.Errorf("invalid backup target %q, expected s3://bucket/path", u)
+	}
+	if t.accessKey == "" || t.secretKey == "" {
+		return nil, fmt.Errorf("set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to back up to S3")
+	}
+	if t.region == "" {
+		t.region = "us-east-1"
+	}
+	if raw := os.Getenv("AWS_ENDPOINT_URL"); raw != "" {
+		endpoint, err := url.Parse(raw)
+		if err != nil || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid AWS_ENDPOINT_URL %q", raw)
+		}
+		t.endpoint, t.pathStyle = endpoint, true
+	} else {
+		t.endpoint = &url.URL{Scheme: "https", Host: "s3." + t.region + ".amazonaws.com"}
+	}
+	return t, nil
+}
+
+// newGCSTarget returns the target of a gs://bucket/path URL, reached through the
+// XML API of Google Cloud Storage with the HMAC key in LOCKR_GCS_ACCESS_ID and
+// LOCKR_GCS_SECRET
+func newGCSTarget(u *url.URL) (*s3Target, error) {
+	t := &s3Target{
+		client:    http.DefaultClient,
+		endpoint:  &url.URL{Scheme: "https", Host: "storage.googleapis.com"},
+		pathStyle: true,
+		bucket:    u.Host,
+		root:      u.Path,
+		region:    "auto",
+		accessKey: os.Getenv("LOCKR_GCS_ACCESS_ID"),
+		secretKey: os.Getenv("LOCKR_GCS_SECRET"),
+	}
+	if t.bucket == "" {
+		return nil, fmt.Errorf("invalid backup target %q, expected gs://bucket/path", u)
+	}
+	if t.accessKey == "" || t.secretKey == "" {
+		return nil, fmt.Errorf("set LOCKR_GCS_ACCESS_ID and LOCKR_GCS_SECRET to an HMAC key of the bucket's project to back up to Cloud Storage")
+	}
+	return t, nil
+}
+
+// firstEnv returns the first of the environment variables set
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func (t *s3Target) Put(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
+	body := io.NopCloser(data)
+	if size == 0 {
+		body = http.NoBody
+	}
+	resp, err := t.do(ctx, http.MethodPut, join(t.root, name), nil, nil, body, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *s3Target) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := t.do(ctx, http.MethodGet, join(t.root, name), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// listResult is the part of a ListObjectsV2 response read
+type listResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (t *s3Target) List(ctx context.Context, dir string) ([]string, error) {
+	prefix := join(t.root, dir) + "/"
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	for {
+		resp, err := t.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the object listing: %w", err)
+		}
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (t *s3Target) Delete(ctx context.Context, name string) error {
+	resp, err := t.do(ctx, http.MethodDelete, join(t.root, name), nil, nil, nil, 0)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *s3Target) Close() error {
+	return nil
+}
+
+// s3Error is the body of a failed request
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request for the object key, or the bucket when key is empty,
+// with the given extra headers, and returns the response of a successful one
+func (t *s3Target) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.ReadCloser, size int64) (*http.Response, error) {
+	u := *t.endpoint
+	path := "/" + key
+	if t.pathStyle {
+		path = "/" + t.bucket + path
+	} else {
+		u.Host = t.bucket + "." + u.Host
+	}
+	u.Path, u.RawPath = path, uriEncode(path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	t.sign(req, time.Now().UTC())
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, ErrNotFound
+	}
+	// S3 answers 409 to a conditional write racing another on the same object
+	if resp.StatusCode == http.StatusPreconditionFailed || (resp.StatusCode == http.StatusConflict && header.Get("If-Match")+header.Get("If-None-Match") != "") {
+		return nil, ErrPreconditionFailed
+	}
+	var failure s3Error
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&failure); err == nil && failure.Code != "" {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u.Path, failure.Code, failure.Message)
+	}
+	return nil, fmt.Errorf("%s %s: %s", method, u.Path, resp.Status)
+}
+
+// sign adds the headers of an AWS Signature Version 4 to req
+func (t *s3Target) sign(req *http.Request, now time.Time) {
+	date := now.Format("20060102")
+	stamp := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if t.token != "" {
+		req.Header.Set("X-Amz-Security-Token", t.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := date + "/" + t.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+t.secretKey), date)
+	key = hmacSHA256(key, t.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by name, as signed
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes every byte of s but the unreserved characters, and
+// slashes unless encodeSlash is set, as Signature Version 4 requires
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,453 @@
+package backup
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Packet types and flags of version 3 of the SFTP protocol, the subset used
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpProtocol = 3
+
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrTimes       = 0x08
+	sftpAttrExtended    = 0x80000000
+
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+
+	// sftpChunk is the most data read or written by a request, which every server accepts
+	sftpChunk = 32 << 10
+	// sftpMaxPacket is the longest packet accepted, well above what the requests need
+	sftpMaxPacket = 1 << 20
+)
+
+// sftpTarget keeps backups in a directory of an SSH server, through its SFTP subsystem
+type sftpTarget struct {
+	root    string
+	conn    *ssh.Client
+	session *ssh.Session
+	mutex   sync.Mutex // held for each request and its response
+	w       io.WriteCloser
+	r       io.Reader
+	id      uint32
+}
+
+// newSFTPTarget connects to the server of an sftp://user@host[:port]/path URL,
+// whose path starts with /~/ to be relative to the home directory. It signs in
+// with the keys of the SSH agent, those in ~/.ssh without a passphrase, or the
+// password in LOCKR_SFTP_PASSWORD, and checks the server's key in ~/.ssh/known_hosts.
+func newSFTPTarget(u *url.URL) (*sftpTarget, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid backup target %q, expected sftp://user@host/path", u)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ~/.ssh/known_hosts, which must hold the key of %s: %w", u.Hostname(), err)
+	}
+	config := &ssh.ClientConfig{User: user, HostKeyCallback: hostKeys, Timeout: 30 * time.Second}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if agentConn, err := net.Dial("unix", sock); err == nil {
+			defer agentConn.Close()
+			config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		}
+	}
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		data, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(data); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		config.Auth = append(config.Auth, ssh.PublicKeys(signers...))
+	}
+	password, ok := u.User.Password()
+	if !ok {
+		password = os.Getenv("LOCKR_SFTP_PASSWORD")
+	}
+	if password != "" {
+		config.Auth = append(config.Auth, ssh.Password(password))
+	}
+
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	t := &sftpTarget{root: strings.TrimPrefix(u.Path, "/~/"), conn: conn}
+	if err := t.start(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// start opens the SFTP subsystem and agrees on the protocol version
+func (t *sftpTarget) start() error {
+	session, err := t.conn.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open an SSH session: %w", err)
+	}
+	t.session = session
+	if t.w, err = session.StdinPipe(); err != nil {
+		return err
+	}
+	if t.r, err = session.StdoutPipe(); err != nil {
+		return err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return fmt.Errorf("failed to start SFTP: %w", err)
+	}
+	if err := t.send(sftpInit, sftpPacket{}.uint32(sftpProtocol)); err != nil {
+		return err
+	}
+	typ, _, err := t.receive()
+	if err != nil {
+		return err
+	}
+	if typ != sftpVersion {
+		return fmt.Errorf("unexpected SFTP packet %d, expected the version", typ)
+	}
+	return nil
+}
+
+// sftpPacket builds the payload of a packet
+type sftpPacket []byte
+
+func (p sftpPacket) uint32(v uint32) sftpPacket {
+	return binary.BigEndian.AppendUint32(p, v)
+}
+
+func (p sftpPacket) uint64(v uint64) sftpPacket {
+	return binary.BigEndian.AppendUint64(p, v)
+}
+
+func (p sftpPacket) string(s string) sftpPacket {
+	return append(p.uint32(uint32(len(s))), s...)
+}
+
+// sftpReader reads the fields of a packet, failing once one is cut short
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *sftpReader) take(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = fmt.Errorf("short SFTP packet")
+		return make([]byte, min(n, 8))
+	}
+	field := r.data[:n]
+	r.data = r.data[n:]
+	return field
+}
+
+func (r *sftpReader) uint32() uint32 { return binary.BigEndian.Uint32(r.take(4)) }
+func (r *sftpReader) uint64() uint64 { return binary.BigEndian.Uint64(r.take(8)) }
+func (r *sftpReader) string() string { return string(r.take(int(r.uint32()))) }
+
+// attrs reads file attributes and reports whether they're a directory's
+func (r *sftpReader) attrs() bool {
+	flags := r.uint32()
+	var dir bool
+	if flags&sftpAttrSize != 0 {
+		r.uint64()
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		dir = r.uint32()&0170000 == 0040000
+	}
+	if flags&sftpAttrTimes != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+	return dir
+}
+
+// sftpError is a failed request's status
+type sftpError struct {
+	code    uint32
+	message string
+}
+
+func (e *sftpError) Error() string {
+	return fmt.Sprintf("sftp: %s (status %d)", e.message, e.code)
+}
+
+func (t *sftpTarget) send(typ byte, payload sftpPacket) error {
+	packet := sftpPacket{}.uint32(uint32(len(payload) + 1))
+	packet = append(append(packet, typ), payload...)
+	_, err := t.w.Write(packet)
+	return err
+}
+
+func (t *sftpTarget) receive() (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(t.r, header); err != nil {
+		return 0, nil, fmt.Errorf("failed to read SFTP response: %w", err)
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size == 0 || size > sftpMaxPacket {
+		return 0, nil, fmt.Errorf("invalid SFTP packet of %d bytes", size)
+	}
+	data := make([]byte, size-1)
+	if _, err := io.ReadFull(t.r, data); err != nil {
+		return 0, nil, fmt.Errorf("failed to read SFTP response: %w", err)
+	}
+	return header[4], data, nil
+}
+
+// request sends a request and returns its response, past the request ID. A status
+// other than OK is returned as an *sftpError.
+func (t *sftpTarget) request(typ byte, payload sftpPacket) (byte, *sftpReader, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.id++
+	if err := t.send(typ, append(sftpPacket{}.uint32(t.id), payload...)); err != nil {
+		return 0, nil, err
+	}
+	respType, data, err := t.receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	r := &sftpReader{data: data}
+	if id := r.uint32(); id != t.id {
+		return 0, nil, fmt.Errorf("SFTP response %d to request %d", id, t.id)
+	}
+	if respType == sftpStatus {
+		code, message := r.uint32(), r.string()
+		if code != sftpOK {
+			return respType, r, &sftpError{code: code, message: message}
+		}
+	}
+	return respType, r, r.err
+}
+
+// handle sends a request answered with a handle
+func (t *sftpTarget) handle(typ byte, payload sftpPacket) (string, error) {
+	respType, r, err := t.request(typ, payload)
+	if err != nil {
+		return "", err
+	}
+	if respType != sftpHandle {
+		return "", fmt.Errorf("unexpected SFTP packet %d, expected a handle", respType)
+	}
+	handle := r.string()
+	return handle, r.err
+}
+
+func (t *sftpTarget) close(handle string) error {
+	_, _, err := t.request(sftpClose, sftpPacket{}.string(handle))
+	return err
+}
+
+// notFound translates the status of a missing file to ErrNotFound
+func notFound(err error) error {
+	var status *sftpError
+	if errors.As(err, &status) && status.code == sftpNoSuchFile {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Put writes the object next to its name, then renames it over the previous one
+func (t *sftpTarget) Put(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
+	remote := path.Join(t.root, name)
+	// Directories that already exist fail to be created, which the open below reports if it was something else
+	parts := strings.Split(path.Dir(remote), "/")
+	for i := range parts {
+		if dir := strings.Join(parts[:i+1], "/"); dir != "" && dir != "." {
+			t.request(sftpMkdir, sftpPacket{}.string(dir).uint32(sftpAttrPermissions).uint32(0700))
+		}
+	}
+
+	tmp := remote + ".tmp"
+	handle, err := t.handle(sftpOpen, sftpPacket{}.string(tmp).uint32(sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc).
+		uint32(sftpAttrPermissions).uint32(0600))
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	buf := make([]byte, sftpChunk)
+	for offset := int64(0); offset < size; {
+		if err := ctx.Err(); err != nil {
+			t.close(handle)
+			return err
+		}
+		n, err := io.ReadFull(data, buf[:min(int64(len(buf)), size-offset)])
+		if err != nil {
+			t.close(handle)
+			return err
+		}
+		if _, _, err := t.request(sftpWrite, sftpPacket{}.string(handle).uint64(uint64(offset)).string(string(buf[:n]))); err != nil {
+			t.close(handle)
+			return fmt.Errorf("failed to write %s: %w", tmp, err)
+		}
+		offset += int64(n)
+	}
+	if err := t.close(handle); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	// Version 3 renames fail over an existing file
+	if _, _, err := t.request(sftpRemove, sftpPacket{}.string(remote)); err != nil && !errors.Is(notFound(err), ErrNotFound) {
+		return fmt.Errorf("failed to replace %s: %w", remote, err)
+	}
+	if _, _, err := t.request(sftpRename, sftpPacket{}.string(tmp).string(remote)); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", tmp, err)
+	}
+	return nil
+}
+
+func (t *sftpTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	handle, err := t.handle(sftpOpen, sftpPacket{}.string(path.Join(t.root, name)).uint32(sftpFlagRead).uint32(0))
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &sftpFile{t: t, handle: handle}, nil
+}
+
+// sftpFile reads a remote file from the start
+type sftpFile struct {
+	t      *sftpTarget
+	handle string
+	offset uint64
+	eof    bool
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	if f.eof {
+		return 0, io.EOF
+	}
+	respType, r, err := f.t.request(sftpRead, sftpPacket{}.string(f.handle).uint64(f.offset).uint32(uint32(min(len(p), sftpChunk))))
+	var status *sftpError
+	if errors.As(err, &status) && status.code == sftpEOF {
+		f.eof = true
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	if respType != sftpData {
+		return 0, fmt.Errorf("unexpected SFTP packet %d, expected data", respType)
+	}
+	data := r.string()
+	if r.err != nil {
+		return 0, r.err
+	}
+	n := copy(p, data)
+	f.offset += uint64(n)
+	return n, nil
+}
+
+func (f *sftpFile) Close() error {
+	return f.t.close(f.handle)
+}
+
+func (t *sftpTarget) List(ctx context.Context, dir string) ([]string, error) {
+	handle, err := t.handle(sftpOpendir, sftpPacket{}.string(path.Join(t.root, dir)))
+	if errors.Is(notFound(err), ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer t.close(handle)
+	var names []string
+	for {
+		respType, r, err := t.request(sftpReaddir, sftpPacket{}.string(handle))
+		var status *sftpError
+		if errors.As(err, &status) && status.code == sftpEOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if respType != sftpName {
+			return nil, fmt.Errorf("unexpected SFTP packet %d, expected names", respType)
+		}
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			name := r.string()
+			r.string() // the long name
+			if isDir := r.attrs(); !isDir && name != "." && name != ".." && path.Ext(name) != ".tmp" {
+				names = append(names, name)
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+}
+
+func (t *sftpTarget) Delete(ctx context.Context, name string) error {
+	if _, _, err := t.request(sftpRemove, sftpPacket{}.string(path.Join(t.root, name))); err != nil && !errors.Is(notFound(err), ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (t *sftpTarget) Close() error {
+	t.session.Close()
+	return t.conn.Close()
+}
@@ -0,0 +1,64 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// ErrNotFound is returned by a target for an object it doesn't have
+var ErrNotFound = errors.New("backup: object not found")
+
+// Target is a place backups are uploaded to. Objects are named by slash-separated
+// paths relative to the target's root, such as wal/wal-000012.log.lockrbackup.
+type Target interface {
+	// Put uploads size bytes of data as the object name, replacing any before
+	Put(ctx context.Context, name string, data io.ReadSeeker, size int64) error
+	// Get returns the content of the object name, or ErrNotFound
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of the objects directly in dir, relative to dir
+	List(ctx context.Context, dir string) ([]string, error)
+	// Delete removes the object name, if there is one
+	Delete(ctx context.Context, name string) error
+	Close() error
+}
+
+// Open returns the target at a URL: s3://bucket/path, gs://bucket/path,
+// sftp://user@host/path, webdav://host/path or webdavs://host/path (https), or a
+// local directory as file:///path or a plain path. The credentials of each kind
+// of target are read from the environment, see the README.
+func Open(rawURL string) (Target, error) {
+	if !strings.Contains(rawURL, "://") {
+		return newDirTarget(rawURL)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup target %q: %w", rawURL, err)
+	}
+	switch u.Scheme {
+	case "file":
+		return newDirTarget(u.Path)
+	case "s3":
+		return newS3Target(u)
+	case "gs":
+		return newGCSTarget(u)
+	case "sftp":
+		return newSFTPTarget(u)
+	case "webdav", "webdavs":
+		return newWebDAVTarget(u)
+	default:
+		return nil, fmt.Errorf("unsupported backup target %q, expected s3://, gs://, sftp://, webdav://, webdavs:// or file://", rawURL)
+	}
+}
+
+// join joins the root of a target with the name of an object
+func join(root, name string) string {
+	root = strings.Trim(root, "/")
+	if root == "" {
+		return name
+	}
+	return root + "/" + name
+}
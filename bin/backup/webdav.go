@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// webdavTarget keeps backups in a WebDAV collection, such as one of Nextcloud
+type webdavTarget struct {
+	client   *http.Client
+	base     *url.URL // the http or https URL of the root collection
+	user     string
+	password string
+}
+
+// newWebDAVTarget returns the target of a webdav://[user@]host/path URL, served
+// over https for webdavs://, with the password from LOCKR_WEBDAV_PASSWORD
+func newWebDAVTarget(u *url.URL) (*webdavTarget, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid backup target %q, expected webdav://host/path", u)
+	}
+	base := *u
+	base.Scheme = "http"
+	if u.Scheme == "webdavs" {
+		base.Scheme = "https"
+	}
+	base.User = nil
+	base.Path = "/" + strings.Trim(u.Path, "/")
+	t := &webdavTarget{client: http.DefaultClient, base: &base, password: os.Getenv("LOCKR_WEBDAV_PASSWORD")}
+	if u.User != nil {
+		t.user = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			t.password = password
+		}
+	}
+	return t, nil
+}
+
+// url returns the URL of the object or collection name
+func (t *webdavTarget) url(name string) string {
+	u := *t.base
+	u.Path = path.Join(u.Path, name)
+	if strings.HasSuffix(name, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+// do sends a request and returns the response, failing unless its status is one of ok
+func (t *webdavTarget) do(ctx context.Context, method, name string, header http.Header, body io.Reader, size int64, ok ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, t.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if t.user != "" {
+		req.SetBasicAuth(t.user, t.password)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	return nil, fmt.Errorf("%s %s: %s", method, req.URL.Path, resp.Status)
+}
+
+// Put creates the root collection and those above the object first, which WebDAV doesn't
+func (t *webdavTarget) Put(ctx context.Context, name string, data io.ReadSeeker, size int64) error {
+	dirs := strings.Split(name, "/")
+	for i := 0; i < len(dirs); i++ {
+		// A collection that already exists answers 405
+		resp, err := t.do(ctx, "MKCOL", strings.Join(dirs[:i], "/")+"/", nil, nil, 0,
+			http.StatusCreated, http.StatusMethodNotAllowed)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	resp, err := t.do(ctx, http.MethodPut, name, nil, io.LimitReader(data, size), size,
+		http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *webdavTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := t.do(ctx, http.MethodGet, name, nil, nil, 0, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// multistatus is the part of a PROPFIND response read
+type multistatus struct {
+	Responses []struct {
+		Href       string    `xml:"href"`
+		Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+	} `xml:"response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`
+
+func (t *webdavTarget) List(ctx context.Context, dir string) ([]string, error) {
+	header := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml"}}
+	resp, err := t.do(ctx, "PROPFIND", dir+"/", header, strings.NewReader(propfindBody), int64(len(propfindBody)), http.StatusMultiStatus)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse the collection listing: %w", err)
+	}
+	var names []string
+	for _, response := range result.Responses {
+		if response.Collection != nil {
+			continue
+		}
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			continue
+		}
+		names = append(names, path.Base(href.Path))
+	}
+	return names, nil
+}
+
+func (t *webdavTarget) Delete(ctx context.Context, name string) error {
+	resp, err := t.do(ctx, http.MethodDelete, name, nil, nil, 0, http.StatusNoContent, http.StatusOK)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *webdavTarget) Close() error {
+	return nil
+}
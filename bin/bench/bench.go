@@ -0,0 +1,317 @@
+// Package bench drives a tree with a synthetic workload and measures how it
+// performs: the throughput and latency percentiles of its writes and of the reads
+// made alongside them, and the write and space amplification of its storage.
+//
+// One writer writes every key, as the engine serializes writers anyway, while the
+// readers read keys picked by the same distribution, or among the keys written so
+// far for sequential writes. Latency percentiles are taken over a uniform sample
+// of the operations, so long runs take bounded memory.
+//
+// Write amplification is the bytes the engine wrote, to the WAL and to SSTables
+// by flushes and compactions, per byte of keys and values written. Space
+// amplification is the size of the data directory per byte of live keys and values.
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"Lockr/bin/lsmtree"
+)
+
+// Workload is how the keys of writes and reads are picked from the key space
+type Workload string
+
+const (
+	// Uniform picks every key equally often
+	Uniform Workload = "uniform"
+	// Zipfian picks a few hot keys most of the time, as caches and configuration see
+	Zipfian Workload = "zipfian"
+	// Sequential writes the keys in order, wrapping around the key space, and reads
+	// them uniformly
+	Sequential Workload = "sequential"
+)
+
+// ParseWorkload parses the name of a workload
+func ParseWorkload(name string) (Workload, error) {
+	switch workload := Workload(name); workload {
+	case Uniform, Zipfian, Sequential:
+		return workload, nil
+	}
+	return "", fmt.Errorf("unknown workload %q, expected uniform, zipfian or sequential", name)
+}
+
+// zipfSkew is the skew of the Zipfian workload, about the popularity of web pages
+const zipfSkew = 1.1
+
+// keyPrefix is the prefix of the benchmark's keys
+const keyPrefix = "bench/"
+
+// sampleSize is how many latencies each writer and reader keeps for the percentiles
+const sampleSize = 100000
+
+// Options configures a benchmark
+type Options struct {
+	Writes    int // writes to make
+	Readers   int // goroutines reading while the writes are made
+	ValueSize int // bytes of each value
+	Keys      int // size of the key space, Writes if zero
+	Workload  Workload
+	Seed      int64 // seeds the key choices, so runs can be repeated
+}
+
+// OpStats measures one kind of operation
+type OpStats struct {
+	Ops        int           `json:"ops"`
+	Errors     int           `json:"errors"`
+	Duration   time.Duration `json:"duration"`
+	Throughput float64       `json:"throughput"` // operations per second
+	P50        time.Duration `json:"p50"`
+	P90        time.Duration `json:"p90"`
+	P99        time.Duration `json:"p99"`
+	P999       time.Duration `json:"p999"`
+	Max        time.Duration `json:"max"`
+}
+
+// Result is what a benchmark measured
+type Result struct {
+	Workload Workload `json:"workload"`
+	Writes   OpStats  `json:"writes"`
+	Reads    OpStats  `json:"reads"`
+	// ReadHits counts the reads that found their key
+	ReadHits int `json:"read_hits"`
+	// UserBytes is the bytes of the keys and values written, LiveBytes those of
+	// the distinct keys written with their last value
+	UserBytes          int64                `json:"user_bytes"`
+	LiveBytes          int64                `json:"live_bytes"`
+	Written            lsmtree.WrittenStats `json:"written"`
+	DiskBytes          int64                `json:"disk_bytes"`
+	WriteAmplification float64              `json:"write_amplification"`
+	SpaceAmplification float64              `json:"space_amplification"`
+	SSTables           int                  `json:"sstables"`
+	Interrupted        bool                 `json:"interrupted"` // ctx was done before every write was made
+}
+
+// Run runs a benchmark against tree, which should be empty and used by nothing
+// else so the amplification figures are its own. A done ctx stops the writes,
+// and the figures cover those made.
+func Run(ctx context.Context, tree *lsmtree.LSMTree, opts Options) (Result, error) {
+	if opts.Writes < 1 || opts.Readers < 0 || opts.ValueSize < 1 || opts.Keys < 0 {
+		return Result{}, fmt.Errorf("a benchmark needs at least 1 write and a value size of at least 1 byte")
+	}
+	if opts.Keys == 0 {
+		opts.Keys = opts.Writes
+	}
+	if opts.Workload == "" {
+		opts.Workload = Uniform
+	}
+	before := tree.Stats().Written
+
+	// written counts the writes made, so readers start with the first one and read
+	// sequential keys written by then
+	var written atomic.Int64
+	done := make(chan struct{})
+	readers := make([]readerResult, opts.Readers)
+	var wait sync.WaitGroup
+	for i := range readers {
+		wait.Add(1)
+		go func(result *readerResult, seed int64) {
+			defer wait.Done()
+			*result = read(tree, opts, seed, &written, done)
+		}(&readers[i], opts.Seed+int64(i)+1)
+	}
+
+	value := make([]byte, opts.ValueSize)
+	random := rand.New(rand.NewSource(opts.Seed))
+	random.Read(value)
+	for i := range value {
+		value[i] = 'a' + value[i]%26
+	}
+	picker := newPicker(opts.Workload, opts.Keys, random)
+	latencies := newSample(random)
+	seen := make(map[int]bool)
+	result := Result{Workload: opts.Workload}
+	start := time.Now()
+	for i := 0; i < opts.Writes; i++ {
+		if ctx.Err() != nil {
+			result.Interrupted = true
+			break
+		}
+		n := picker.next(i)
+		key := keyName(n)
+		began := time.Now()
+		err := tree.Set(key, string(value))
+		latencies.add(time.Since(began))
+		if err != nil {
+			result.Writes.Errors++
+			continue
+		}
+		result.UserBytes += int64(len(key) + len(value))
+		if !seen[n] {
+			seen[n] = true
+			result.LiveBytes += int64(len(key) + len(value))
+		}
+		written.Store(int64(i + 1))
+	}
+	result.Writes.summarize(latencies, time.Since(start))
+	close(done)
+	wait.Wait()
+
+	readLatencies := newSample(random)
+	for _, reader := range readers {
+		readLatencies.merge(reader.latencies)
+		result.Reads.Errors += reader.errors
+		result.ReadHits += reader.hits
+	}
+	result.Reads.summarize(readLatencies, result.Writes.Duration)
+
+	if err := tree.Sync(); err != nil {
+		return result, fmt.Errorf("failed to sync the WAL: %w", err)
+	}
+	stats := tree.Stats()
+	result.Written = lsmtree.WrittenStats{
+		WAL:         stats.Written.WAL - before.WAL,
+		Flushes:     stats.Written.Flushes - before.Flushes,
+		Compactions: stats.Written.Compactions - before.Compactions,
+	}
+	result.DiskBytes = stats.Disk.Total
+	result.SSTables = len(stats.SSTables)
+	if result.UserBytes > 0 {
+		result.WriteAmplification = float64(result.Written.Total()) / float64(result.UserBytes)
+	}
+	if result.LiveBytes > 0 {
+		result.SpaceAmplification = float64(result.DiskBytes) / float64(result.LiveBytes)
+	}
+	return result, nil
+}
+
+// readerResult is what one reader measured
+type readerResult struct {
+	latencies *sample
+	hits      int
+	errors    int
+}
+
+// read reads keys until done is closed
+func read(tree *lsmtree.LSMTree, opts Options, seed int64, written *atomic.Int64, done <-chan struct{}) readerResult {
+	random := rand.New(rand.NewSource(seed))
+	result := readerResult{latencies: newSample(random)}
+	picker := newPicker(opts.Workload, opts.Keys, random)
+	for {
+		select {
+		case <-done:
+			return result
+		default:
+		}
+		n := written.Load()
+		if n == 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		key := picker.next(0)
+		if opts.Workload == Sequential {
+			key = random.Intn(int(min(n, int64(opts.Keys))))
+		}
+		began := time.Now()
+		value, err := tree.Get(keyName(key))
+		result.latencies.add(time.Since(began))
+		switch {
+		case err != nil:
+			result.errors++
+		case value != "":
+			result.hits++
+		}
+	}
+}
+
+// picker picks the keys of a workload
+type picker struct {
+	workload Workload
+	keys     int
+	random   *rand.Rand
+	zipf     *rand.Zipf
+}
+
+// newPicker returns a picker of keys in [0, keys)
+func newPicker(workload Workload, keys int, random *rand.Rand) *picker {
+	p := &picker{workload: workload, keys: keys, random: random}
+	if workload == Zipfian && keys > 1 {
+		p.zipf = rand.NewZipf(random, zipfSkew, 1, uint64(keys-1))
+	}
+	return p
+}
+
+// next returns the key of operation i
+func (p *picker) next(i int) int {
+	switch {
+	case p.workload == Sequential:
+		return i % p.keys
+	case p.zipf != nil:
+		return int(p.zipf.Uint64())
+	}
+	return p.random.Intn(p.keys)
+}
+
+// keyName returns the name of key n, padded so names sort as numbers
+func keyName(n int) string {
+	return fmt.Sprintf("%s%012d", keyPrefix, n)
+}
+
+// sample keeps a uniform sample of up to sampleSize latencies, by reservoir
+// sampling, with the count and maximum of them all
+type sample struct {
+	random    *rand.Rand
+	latencies []time.Duration
+	count     int
+	max       time.Duration
+}
+
+// newSample returns an empty sample drawing from random
+func newSample(random *rand.Rand) *sample {
+	return &sample{random: random}
+}
+
+// add adds a latency to the sample
+func (s *sample) add(latency time.Duration) {
+	s.count++
+	s.max = max(s.max, latency)
+	if len(s.latencies) < sampleSize {
+		s.latencies = append(s.latencies, latency)
+	} else if i := s.random.Intn(s.count); i < sampleSize {
+		s.latencies[i] = latency
+	}
+}
+
+// merge adds the latencies of other, each sampled latency standing for its
+// share of other's count
+func (s *sample) merge(other *sample) {
+	for _, latency := range other.latencies {
+		s.add(latency)
+	}
+	s.count += other.count - len(other.latencies)
+	s.max = max(s.max, other.max)
+}
+
+// summarize fills the statistics of ops with the given latencies, made over elapsed
+func (s *OpStats) summarize(latencies *sample, elapsed time.Duration) {
+	s.Ops = latencies.count - s.Errors
+	s.Duration = elapsed
+	if latencies.count == 0 {
+		return
+	}
+	if elapsed > 0 {
+		s.Throughput = float64(s.Ops) / elapsed.Seconds()
+	}
+	sorted := latencies.latencies
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) time.Duration {
+		return sorted[min(len(sorted)-1, int(p*float64(len(sorted))))]
+	}
+	s.P50, s.P90, s.P99, s.P999 = percentile(0.5), percentile(0.9), percentile(0.99), percentile(0.999)
+	s.Max = latencies.max
+}
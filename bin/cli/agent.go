@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"Lockr/bin/audit"
+	"Lockr/bin/client"
+	"Lockr/bin/server"
+)
+
+// agentSocketName is the unix socket in the data directory the agent serves on
+const agentSocketName = "agent.sock"
+
+// agentDialTimeout is how long commands wait for the agent to answer before
+// opening the store themselves
+const agentDialTimeout = 500 * time.Millisecond
+
+// runAgent keeps the store open and unlocked, serving the HTTP API on a unix
+// socket only its owner may connect to, until it's stopped or its lifetime is up.
+// Other commands find it and run through it instead of opening the store.
+func runAgent(dataDir string, store *audit.Store, args []string) error {
+	flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+	lifetime := flags.Duration("lifetime", 0, "stop after this long, e.g. 8h; 0 runs until stopped")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: lockr agent [--lifetime duration]")
+	}
+
+	// The tree's lock is held, so a socket left behind is a crashed agent's
+	socket := filepath.Join(dataDir, agentSocketName)
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale agent socket: %w", err)
+	}
+	listener, err := server.New(store).ListenUnix(socket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	fmt.Printf("Agent listening on %s (Ctrl+C to stop)\n", socket)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	var expired <-chan time.Time
+	if *lifetime > 0 {
+		expired = time.After(*lifetime)
+	}
+	select {
+	case <-stop:
+	case <-expired:
+		fmt.Println("Agent lifetime is up, stopping")
+	}
+	return nil
+}
+
+// dialAgent returns a client of the agent serving dataDir, or nil if none answers
+func dialAgent(dataDir string) *client.Client {
+	socket := filepath.Join(dataDir, agentSocketName)
+	if _, err := os.Stat(socket); err != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", socket, agentDialTimeout)
+	if err != nil {
+		return nil
+	}
+	conn.Close()
+	return client.NewUnix(socket)
+}
@@ -0,0 +1,162 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"Lockr/bin/audit"
+	"Lockr/bin/lsmtree"
+)
+
+// runAudit lists the operations recorded in the audit log, checking its chain of
+// hashes, or exports or imports the log
+func runAudit(dataDir string, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			return runAuditExport(dataDir, args[1:])
+		case "import":
+			return runAuditImport(dataDir, args[1:])
+		}
+	}
+
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	key := flags.String("key", "", "only list operations on keys starting with this prefix")
+	op := flags.String("op", "", "only list this operation: get, set, delete, scan, versions, export or import")
+	source := flags.String("source", "", "only list operations from this source: tui, cli or api")
+	since := flags.String("since", "", "only list operations since a time such as 2026-10-14T15:04 or an age such as 2d")
+	limit := flags.Int("limit", 0, "list at most this many of the newest operations, 0 for all")
+	output := outputFlag(flags, outputTable)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: lockr audit [--key <prefix>] [--op <op>] [--source tui|cli|api] [--since <time|age>] [--limit <n>] [--output table|plain|json]\n" +
+			"       lockr audit export|import <file>")
+	}
+	format, err := parseOutput(*output)
+	if err != nil {
+		return err
+	}
+	filter := audit.Filter{Key: *key, Op: *op, Source: *source}
+	if *since != "" {
+		if filter.Since, err = parseAt(*since); err != nil {
+			return err
+		}
+	}
+
+	// A broken chain is reported after the entries before the break
+	entries, readErr := audit.Read(dataDir)
+	if readErr != nil && !errors.Is(readErr, audit.ErrTampered) {
+		return readErr
+	}
+	var matched []audit.Entry
+	for _, entry := range entries {
+		if filter.Matches(entry) {
+			matched = append(matched, entry)
+		}
+	}
+	if *limit > 0 && len(matched) > *limit {
+		matched = matched[len(matched)-*limit:]
+	}
+
+	switch format {
+	case outputJSON:
+		if matched == nil {
+			matched = []audit.Entry{}
+		}
+		if err := printJSON(map[string]interface{}{"intact": readErr == nil, "entries": matched}); err != nil {
+			return err
+		}
+	case outputPlain:
+		for _, entry := range matched {
+			fmt.Printf("%s\t%s\t%s\t%s\n", entry.Time.Local().Format(time.RFC3339), entry.Source, entry.Op, entry.Key)
+		}
+	default:
+		rows := make([][]string, 0, len(matched))
+		for _, entry := range matched {
+			rows = append(rows, []string{strconv.FormatUint(entry.Seq, 10), entry.Time.Local().Format(time.RFC3339),
+				entry.Source, entry.Op, entry.Key, entry.Detail})
+		}
+		if len(rows) > 0 {
+			if err := printTable([]string{"#", "time", "source", "op", "key", "detail"}, rows); err != nil {
+				return err
+			}
+		}
+		if readErr == nil && len(entries) > 0 {
+			fmt.Printf("%d of %d entries; the hash chain is intact up to %s\n", len(matched), len(entries), entries[len(entries)-1].Hash)
+		} else if readErr == nil {
+			fmt.Println("No operations are recorded yet")
+		}
+	}
+	return readErr
+}
+
+// runAuditExport writes the audit log to a file as JSON lines, or to stdout for "-"
+func runAuditExport(dataDir string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: lockr audit export <file>")
+	}
+	path := args[0]
+	if path == "-" {
+		_, err := audit.Export(dataDir, os.Stdout)
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create export file: %w", err)
+	}
+	count, err := audit.Export(dataDir, file)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write export file: %w", closeErr)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	fmt.Printf("Exported %d audit entries to %s\n", count, path)
+	return nil
+}
+
+// runAuditImport appends the entries of an audit log export to the audit log,
+// recording the import after them. The data directory is locked, so no session
+// appends to the log meanwhile.
+func runAuditImport(dataDir string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: lockr audit import <file>")
+	}
+	path := args[0]
+	lock, err := lsmtree.LockDir(dataDir)
+	if err != nil {
+		return lockError(err)
+	}
+	defer lock.Release()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open import file: %w", err)
+	}
+	defer file.Close()
+	count, err := audit.Import(dataDir, file)
+	if err != nil {
+		return err
+	}
+
+	log, err := audit.Open(dataDir)
+	if err != nil {
+		return err
+	}
+	err = log.Record(audit.SourceCLI, audit.OpImport, "", fmt.Sprintf("%d audit entries from %s", count, path))
+	if closeErr := log.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d audit entries from %s\n", count, path)
+	return nil
+}
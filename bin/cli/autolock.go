@@ -0,0 +1,232 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"Lockr/bin/audit"
+	"Lockr/bin/cluster"
+	"Lockr/bin/keyindex"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/replica"
+	"Lockr/bin/vault"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// storeSession is the local store: the tree of the data directory, the vault
+// over it and the audit log of its use. An encrypted store can be locked, closing
+// the tree and dropping the data key with its caches, and unlocked again with the
+// master password.
+type storeSession struct {
+	dataDir string
+	options lsmtree.Options
+	source  string // what the operations are recorded as coming from, e.g. audit.SourceTUI
+	lsm     *lsmtree.LSMTree
+	vault   *vault.Vault
+	store   *audit.Store // the vault, recording to the audit log
+	audit   *audit.Log
+	index   *keyindex.Index // set once watch was called
+	unwatch func()
+	dirLock *lsmtree.DirLock // keeps other processes out of the data directory while locked
+}
+
+// openSession opens the tree of the data directory and the vault over it, recording
+// their use in the audit log as coming from source
+func openSession(dataDir string, options lsmtree.Options, source string) (*storeSession, error) {
+	s := &storeSession{dataDir: dataDir, options: options, source: source}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	log, err := audit.Open(dataDir)
+	if err != nil {
+		s.lsm.Close()
+		return nil, err
+	}
+	s.audit = log
+	s.store = audit.Wrap(s.vault, log, source)
+	return s, nil
+}
+
+// open recovers the tree and opens the vault, and the key index if it was watched
+func (s *storeSession) open() error {
+	lsm := lsmtree.NewLSMTreeWithOptions(s.dataDir, s.options)
+	if err := lsm.Recover(); err != nil {
+		var locked *lsmtree.ErrLocked
+		if errors.As(err, &locked) {
+			return lockError(err)
+		}
+		return fmt.Errorf("failed to recover LSM tree: %w", err)
+	}
+	// Only the writes copied from its leader change a follower, and only those
+	// committed by its cluster a cluster node
+	leader, err := replica.Leader(lsm)
+	if err != nil {
+		lsm.Close()
+		return err
+	}
+	node, err := cluster.Member(lsm)
+	if err != nil {
+		lsm.Close()
+		return err
+	}
+	lsm.SetReadOnly(leader != "" || node != "")
+	v, err := vault.Open(s.dataDir, lsm)
+	if err != nil {
+		lsm.Close()
+		return fmt.Errorf("failed to open vault: %w", err)
+	}
+	s.lsm, s.vault = lsm, v
+	if s.audit != nil {
+		s.store = audit.Wrap(v, s.audit, s.source)
+	}
+	if s.unwatch != nil {
+		return s.watch()
+	}
+	return nil
+}
+
+// watch builds the key index and keeps it up to date with the tree's change feed
+func (s *storeSession) watch() error {
+	idx, unwatch, err := keyindex.Watch(s.lsm)
+	if err != nil {
+		return fmt.Errorf("failed to index keys: %w", err)
+	}
+	s.index, s.unwatch = idx, unwatch
+	return nil
+}
+
+// lockable reports whether the store is encrypted, so locking it means something
+func (s *storeSession) lockable() bool {
+	return s.options.EncryptionKey != nil
+}
+
+// lock closes the store and overwrites the data key. The data directory stays
+// locked against other processes until unlock.
+func (s *storeSession) lock() error {
+	if s.unwatch != nil {
+		s.unwatch()
+	}
+	err := s.lsm.Close()
+	clear(s.options.EncryptionKey)
+	s.options.EncryptionKey = nil
+	s.lsm, s.vault, s.store, s.index = nil, nil, nil, nil
+	lock, lockErr := lsmtree.LockDir(s.dataDir)
+	if lockErr != nil {
+		return lockError(lockErr)
+	}
+	s.dirLock = lock
+	return err
+}
+
+// unlock reopens a locked store with its master password
+func (s *storeSession) unlock(password string) error {
+	key, err := lsmtree.UnlockEncryption(s.dataDir, password)
+	if err != nil {
+		return err
+	}
+	s.options.EncryptionKey = key
+	if s.dirLock != nil {
+		s.dirLock.Release()
+		s.dirLock = nil
+	}
+	return s.open()
+}
+
+// close closes the store and the audit log, or releases the data directory while it's locked
+func (s *storeSession) close() error {
+	defer s.audit.Close()
+	if s.dirLock != nil {
+		return s.dirLock.Release()
+	}
+	if s.lsm == nil {
+		return nil
+	}
+	if s.unwatch != nil {
+		s.unwatch()
+	}
+	return s.lsm.Close()
+}
+
+// autoLockMsg checks whether the UI has been idle for settings.autoLock
+type autoLockMsg struct {
+	id int
+}
+
+// autoLockTick schedules the next idle check of a lockable store
+func (m *model) autoLockTick() tea.Cmd {
+	if m.session == nil || m.settings.autoLock <= 0 || m.locked {
+		return nil
+	}
+	id, wait := m.autoLockID, m.settings.autoLock-time.Since(m.lastActive)
+	return tea.Tick(wait, func(time.Time) tea.Msg { return autoLockMsg{id: id} })
+}
+
+// autoLock locks the store once no key has been pressed for settings.autoLock
+func (m *model) autoLock(msg autoLockMsg) tea.Cmd {
+	if msg.id != m.autoLockID || m.locked {
+		return nil // Ticks of before the last unlock
+	}
+	if time.Since(m.lastActive) < m.settings.autoLock {
+		return m.autoLockTick()
+	}
+	m.lockStore(fmt.Sprintf("Locked after %s without a keypress.", m.settings.autoLock))
+	return nil
+}
+
+// lockStore closes the store, dropping whatever the UI shows of it, and asks for
+// the master password
+func (m *model) lockStore(reason string) {
+	m.clearClipboard()
+	m.closePager()
+	m.stopWatch()
+	if m.editing != nil {
+		m.endEdit()
+	}
+	if m.adding != nil {
+		m.endForm()
+	}
+	m.detail, m.editing, m.renaming, m.confirming = nil, nil, nil, nil
+	m.finder, m.search, m.completion = nil, nil, nil
+	m.unlocking, m.setting = "", ""
+	m.rowItems, m.revealed, m.showTable = nil, "", false
+	m.table.SetRows(nil)
+	m.focusInput()
+
+	m.store, m.vault, m.index = nil, nil, nil
+	m.locked = true
+	m.input.SetValue("")
+	m.input.EchoMode = textinput.EchoPassword
+	m.statusMessage = reason + " Enter the master password to unlock."
+	m.errorMessage = ""
+	if err := m.session.lock(); err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+	}
+}
+
+// updateLocked handles a key on the lock screen, where Enter unlocks the store
+// with the master password typed
+func (m *model) updateLocked(msg tea.KeyMsg) tea.Cmd {
+	switch msg.Type {
+	case tea.KeyEsc:
+		return m.quit()
+	case tea.KeyEnter:
+		password := m.input.Value()
+		m.input.SetValue("")
+		if err := m.session.unlock(password); err != nil {
+			m.errorMessage = fmt.Sprintf("Error: %v", err)
+			return nil
+		}
+		m.store, m.vault, m.index = m.session.store, m.session.vault, m.session.index
+		m.locked = false
+		m.input.EchoMode = textinput.EchoNormal
+		m.statusMessage, m.errorMessage = "Unlocked", ""
+		m.autoLockID++
+		return m.autoLockTick()
+	}
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return cmd
+}
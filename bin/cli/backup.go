@@ -0,0 +1,165 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"Lockr/bin/backup"
+	"Lockr/bin/lsmtree"
+)
+
+// backupPassphraseEnv names the environment variable holding the passphrase the
+// backups of a remote target are encrypted with
+const backupPassphraseEnv = "LOCKR_BACKUP_PASSPHRASE"
+
+// runBackup takes a backup into a local directory, or uploads one to a remote target
+func runBackup(lsm *lsmtree.LSMTree, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	to := flags.String("to", "", "upload an encrypted backup to this target: s3://, gs://, sftp://, webdav(s):// or file:// URL")
+	keepLast := flags.Int("keep-last", 0, "with --to, keep only this many of the newest backups, beyond those of --keep-within")
+	keepWithin := flags.Duration("keep-within", 0, "with --to, keep the backups younger than this, e.g. 720h")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	usage := fmt.Errorf("usage: lockr backup <dir> | --to <url> [--keep-last n] [--keep-within duration]")
+	if *to == "" {
+		if flags.NArg() != 1 || *keepLast != 0 || *keepWithin != 0 {
+			return usage
+		}
+		if err := lsm.Checkpoint(flags.Arg(0)); err != nil {
+			return fmt.Errorf("failed to back up: %w", err)
+		}
+		fmt.Printf("Backed up to %s\n", flags.Arg(0))
+		return nil
+	}
+	if flags.NArg() != 0 || *keepLast < 0 || *keepWithin < 0 {
+		return usage
+	}
+
+	target, err := backup.Open(*to)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	initialized, err := backup.Initialized(ctx, target)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %w", *to, err)
+	}
+	passphrase, err := backupPassphrase(!initialized)
+	if err != nil {
+		return err
+	}
+	result, err := backup.Upload(ctx, lsm, target, backup.Options{Passphrase: passphrase, KeepLast: *keepLast, KeepWithin: *keepWithin})
+	if err != nil {
+		return fmt.Errorf("failed to back up to %s: %w", *to, err)
+	}
+	fmt.Printf("Uploaded backup %s and %d archived WAL segments to %s, %d bytes\n", result.Checkpoint.Name, result.Segments, *to, result.Bytes)
+	if len(result.Deleted) > 0 {
+		fmt.Printf("Deleted %d objects past the retention policy\n", len(result.Deleted))
+	}
+	if lsm.WALArchiveDir() == "" {
+		fmt.Println("Run lockr with -wal-archive to also upload the writes made between backups, for point-in-time restores")
+	}
+	return nil
+}
+
+// backupPassphrase returns the passphrase of a target's backups, asking for it
+// twice when it's being chosen
+func backupPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv(backupPassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	prompt := "Backup passphrase: "
+	if confirm {
+		prompt = "Choose a backup passphrase: "
+	}
+	passphrase, err := readPassphrase(prompt)
+	if err != nil || !confirm {
+		return passphrase, err
+	}
+	confirmation, err := readPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if confirmation != passphrase {
+		return "", fmt.Errorf("passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+// restoreFrom lists the backups of a remote target, or downloads one and restores
+// it with the uploaded writes made since replayed, up to until unless it's zero
+func restoreFrom(dataDir, rawURL, name string, list, merge bool, until time.Time, output string) error {
+	target, err := backup.Open(rawURL)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if list {
+		format, err := parseOutput(output)
+		if err != nil {
+			return err
+		}
+		checkpoints, err := backup.List(ctx, target)
+		if err != nil {
+			return err
+		}
+		switch format {
+		case outputJSON:
+			if checkpoints == nil {
+				checkpoints = []backup.Checkpoint{}
+			}
+			return printJSON(checkpoints)
+		case outputPlain:
+			for _, checkpoint := range checkpoints {
+				fmt.Println(checkpoint.Name)
+			}
+			return nil
+		}
+		if len(checkpoints) == 0 {
+			fmt.Printf("No backups at %s\n", rawURL)
+			return nil
+		}
+		rows := make([][]string, 0, len(checkpoints))
+		for _, checkpoint := range checkpoints {
+			rows = append(rows, []string{checkpoint.Name, checkpoint.Taken.Local().Format(time.RFC3339), strconv.FormatUint(checkpoint.LogSegment, 10)})
+		}
+		return printTable([]string{"name", "taken", "first wal segment"}, rows)
+	}
+
+	passphrase, err := backupPassphrase(false)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp("", "lockr-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	backupDir, walDir := filepath.Join(tmp, "checkpoint"), filepath.Join(tmp, "wal")
+	if merge {
+		// Merging writes the backup's entries alone, without replaying later writes
+		walDir = ""
+	}
+	result, err := backup.Download(ctx, target, passphrase, name, backupDir, walDir)
+	if err != nil {
+		return fmt.Errorf("failed to download from %s: %w", rawURL, err)
+	}
+	fmt.Printf("Downloaded backup %s and %d WAL segments\n", result.Checkpoint.Name, result.Segments)
+	options := lsmtree.RestoreOptions{Merge: merge, Until: until}
+	if result.Segments > 0 {
+		options.WALArchive = walDir
+	}
+	return restoreBackup(dataDir, backupDir, options)
+}
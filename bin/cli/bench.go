@@ -0,0 +1,155 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"Lockr/bin/bench"
+	"Lockr/bin/lsmtree"
+)
+
+// runBench benchmarks a throwaway tree opened with the engine flags, so their
+// effect can be measured without touching the store
+func runBench(options lsmtree.Options, logLevel string, args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	writes := flags.String("writes", "100k", "writes to make, with an optional k or M suffix")
+	readers := flags.Int("readers", 4, "goroutines reading while the writes are made")
+	valueSize := flags.Int("value-size", 256, "bytes of each value")
+	keys := flags.String("keys", "", "size of the key space, the number of writes by default")
+	workload := flags.String("workload", string(bench.Uniform), "how keys are picked: uniform, zipfian or sequential")
+	dir := flags.String("dir", "", "benchmark in this empty directory, on the disk to measure, instead of a temporary one")
+	seed := flags.Int64("seed", 1, "seed of the key choices")
+	output := outputFlag(flags, outputTable)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: lockr bench [--writes n] [--readers n] [--value-size bytes] [--keys n] [--workload uniform|zipfian|sequential] [--dir path] [--output table|plain|json]")
+	}
+	format, err := parseOutput(*output)
+	if err != nil {
+		return err
+	}
+	opts := bench.Options{Readers: *readers, ValueSize: *valueSize, Seed: *seed}
+	if opts.Writes, err = parseCount(*writes); err != nil {
+		return fmt.Errorf("invalid --writes: %w", err)
+	}
+	if *keys != "" {
+		if opts.Keys, err = parseCount(*keys); err != nil {
+			return fmt.Errorf("invalid --keys: %w", err)
+		}
+	}
+	if opts.Workload, err = bench.ParseWorkload(*workload); err != nil {
+		return err
+	}
+	level, err := parseLogLevel(logLevel, slog.LevelWarn)
+	if err != nil {
+		return err
+	}
+	options.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	dataDir := *dir
+	if dataDir == "" {
+		if dataDir, err = os.MkdirTemp("", "lockr-bench-"); err != nil {
+			return fmt.Errorf("failed to create benchmark directory: %w", err)
+		}
+		defer os.RemoveAll(dataDir)
+	} else if entries, err := os.ReadDir(dataDir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s isn't empty, and the benchmark measures the space it uses", dataDir)
+	}
+	tree := lsmtree.NewLSMTreeWithOptions(dataDir, options)
+	if err := tree.Recover(); err != nil {
+		return fmt.Errorf("failed to open benchmark tree: %w", err)
+	}
+	defer tree.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if format == outputTable {
+		fmt.Fprintf(os.Stderr, "Writing %d %d-byte values, %s, with %d readers and -sync %s (Ctrl+C to stop early)\n",
+			opts.Writes, opts.ValueSize, opts.Workload, opts.Readers, options.WALSync)
+	}
+	result, err := bench.Run(ctx, tree, opts)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case outputJSON:
+		return printJSON(result)
+	case outputPlain:
+		for _, op := range []struct {
+			name  string
+			stats bench.OpStats
+		}{{"write", result.Writes}, {"read", result.Reads}} {
+			fmt.Printf("%s_ops %d\n", op.name, op.stats.Ops)
+			fmt.Printf("%s_ops_per_sec %.0f\n", op.name, op.stats.Throughput)
+			fmt.Printf("%s_p50_us %d\n", op.name, op.stats.P50.Microseconds())
+			fmt.Printf("%s_p99_us %d\n", op.name, op.stats.P99.Microseconds())
+		}
+		fmt.Printf("write_amplification %.2f\n", result.WriteAmplification)
+		fmt.Printf("space_amplification %.2f\n", result.SpaceAmplification)
+		return nil
+	}
+
+	rows := [][]string{benchRow("write", result.Writes), benchRow("read", result.Reads)}
+	if err := printTable([]string{"op", "ops", "ops/s", "errors", "p50", "p90", "p99", "p99.9", "max"}, rows); err != nil {
+		return err
+	}
+	if result.Interrupted {
+		fmt.Println("\nInterrupted: the figures cover the writes made so far")
+	}
+	fmt.Println()
+	if result.Reads.Ops > 0 {
+		fmt.Printf("Read hits            %.1f%%\n", 100*float64(result.ReadHits)/float64(result.Reads.Ops))
+	}
+	fmt.Printf("Write amplification  %.2fx: %s written for %s of keys and values (WAL %s, flushes %s, compactions %s)\n",
+		result.WriteAmplification, formatBytes(result.Written.Total()), formatBytes(result.UserBytes),
+		formatBytes(result.Written.WAL), formatBytes(result.Written.Flushes), formatBytes(result.Written.Compactions))
+	fmt.Printf("Space amplification  %.2fx: %s on disk for %s live, in %d SSTables\n",
+		result.SpaceAmplification, formatBytes(result.DiskBytes), formatBytes(result.LiveBytes), result.SSTables)
+	return nil
+}
+
+// benchRow returns the table row of an operation's statistics
+func benchRow(name string, stats bench.OpStats) []string {
+	if stats.Ops == 0 && stats.Errors == 0 {
+		return []string{name, "0", "-", "0", "-", "-", "-", "-", "-"}
+	}
+	return []string{name, strconv.Itoa(stats.Ops), strconv.FormatFloat(stats.Throughput, 'f', 0, 64), strconv.Itoa(stats.Errors),
+		formatLatency(stats.P50), formatLatency(stats.P90), formatLatency(stats.P99), formatLatency(stats.P999), formatLatency(stats.Max)}
+}
+
+// formatLatency rounds a latency to about three significant digits
+func formatLatency(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond).String()
+	}
+	return d.Round(100 * time.Nanosecond).String()
+}
+
+// parseCount parses a count with an optional k (thousand) or M (million) suffix, like 1M
+func parseCount(s string) (int, error) {
+	digits, multiplier := s, 1
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		digits, multiplier = s[:len(s)-1], 1000
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		digits, multiplier = s[:len(s)-1], 1000000
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("expected a positive count like 500, 100k or 1M, got %q", s)
+	}
+	return n * multiplier, nil
+}
@@ -2,33 +2,226 @@ package cli
 
 import (
 	// "bufio"
+	"cmp"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	// "strings"
+	"time"
 
+	"Lockr/bin/audit"
+	"Lockr/bin/config"
 	"Lockr/bin/lsmtree"
+	"Lockr/bin/templates"
 )
 
-// Run starts the CLI interface for the Lockr application
+// Run starts the CLI interface for the Lockr application, opening the store
+// switched to with `vault switch` when the UI quits for it
 func Run() error {
-	// Get the user's home directory
-	homeDir, err := os.UserHomeDir()
+	vaultName := ""
+	for {
+		var switched *vaultSwitch
+		if err := run(vaultName); !errors.As(err, &switched) {
+			return err
+		}
+		vaultName = switched.name
+	}
+}
+
+// run parses the flags and runs a command or the UI on the store of -store, or
+// on the named vault instead when it isn't empty
+func run(vaultName string) error {
+	// Settings of config.toml and the environment are the defaults of the flags
+	configPath, err := config.Path()
 	if err != nil {
-		return fmt.Errorf("failed to get user home directory: %w", err)
+		return err
 	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	options := lsmtree.DefaultOptions()
 
-	// Create the data directory in the user's home folder
-	dataDir := fmt.Sprintf("%s/.Lockr", homeDir)
-	if err := os.MkdirAll(dataDir, 0700); err != nil {
+	// Engine flags come before the subcommand
+	flags := flag.NewFlagSet("lockr", flag.ContinueOnError)
+	dataDirFlag := flags.String("data-dir", "", "the directory of the default store, instead of data_dir of config.toml, $LOCKR_DATA_DIR or ~/.Lockr")
+	storeName := flags.String("store", "", "open this named store, from [stores] of config.toml or beside the default one, e.g. ~/.Lockr-work")
+	flags.StringVar(storeName, "vault", "", "the same as -store")
+	cacheSize := flags.Int("cache-size", cmp.Or(cfg.CacheSize, options.CacheSize), "entries held in the engine's cache")
+	blockCacheSize := flags.Int64("block-cache-size", cmp.Or(cfg.BlockCacheSize, options.BlockCacheSize), "bytes of decompressed SSTable blocks held in the engine's cache")
+	syncPolicy := flags.String("sync", cmp.Or(cfg.Sync, "always"), "when WAL writes are flushed to disk: always, interval or never")
+	syncInterval := flags.Duration("sync-interval", cmp.Or(cfg.SyncInterval, 10*time.Millisecond), "how often buffered WAL writes are written out with -sync interval or never")
+	syncMaxBytes := flags.Int64("sync-max-bytes", cmp.Or(cfg.SyncMaxBytes, options.WALMaxUnsyncedBytes), "unsynced WAL bytes that trigger an early fsync with -sync interval")
+	walArchive := flags.String("wal-archive", cmp.Or(cfg.WALArchive, options.WALArchiveDir), "move WAL segments here instead of deleting them, for point-in-time restores")
+	trackAccess := flags.Bool("track-access", false, "record how often and when each key is read, for `lockr stale`")
+	snapshots := flags.String("snapshots", "", "take snapshots while running and keep the newest, e.g. hourly=24,daily=7")
+	statsHistory := flags.String("stats-history", "", "record the engine statistics while running and keep the newest, e.g. 15m=672 for a week")
+	keepVersions := flags.Int("keep-versions", defaultKeepVersions, "versions of each key kept for `history` and `get --at`, the current one included; 0 keeps none unless -version-max-age is set")
+	versionMaxAge := flags.String("version-max-age", "", "drop versions older than this, e.g. 90d, except each key's newest")
+	ephemeral := flags.Bool("ephemeral", false, "use a scratch store kept in memory, gone on exit, instead of the data directory")
+	remote := flags.String("remote", "", "use the HTTP API at this URL instead of the local data directory")
+	remoteCA := flags.String("remote-ca", "", "trust this PEM certificate for an https -remote, e.g. the server's self-signed one")
+	copyFormat := flags.String("copy-format", defaultUISettings.copyFormat, "what Shift copies from the UI's table, with {key} and {value} replaced")
+	mask := flags.String("mask", defaultUISettings.mask, "which values the UI masks until revealed: secret (set with --secret), all or none")
+	noKeychain := flags.Bool("no-keychain", false, "always ask for the master password instead of keeping the unlock key in the OS keychain")
+	autoLock := flags.Duration("auto-lock", defaultUISettings.autoLock, "lock the UI of an encrypted store after this long without a keypress, 0 to never")
+	clipboardClear := flags.Duration("clipboard-clear", defaultUISettings.clipboardClear, "how long values copied from the UI stay in the clipboard, 0 to keep them")
+	themeName := flags.String("theme", cmp.Or(cfg.Theme, defaultTheme), "the colors of the UI: purple, blue, green or mono")
+	logLevel := flags.String("log-level", "", "the least severe engine events logged: debug, info, warn or error; warn for commands on stderr, info for the UI's logs pane")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+
+	if vaultName != "" {
+		*storeName = vaultName
+	}
+	dataDir, err := cfg.StoreDir(*dataDirFlag, *storeName)
+	if err != nil {
+		return err
+	}
+	if *ephemeral {
+		// The tree stays in memory, and the files kept beside it, like the audit
+		// log and the history, go to a directory removed on exit
+		if *remote != "" {
+			return fmt.Errorf("-ephemeral and -remote can't be combined")
+		}
+		if dataDir, err = os.MkdirTemp("", "lockr-ephemeral-"); err != nil {
+			return fmt.Errorf("failed to create ephemeral directory: %w", err)
+		}
+		defer os.RemoveAll(dataDir)
+		options.InMemory = true
+		*storeName = "ephemeral"
+	} else if err := os.MkdirAll(dataDir, 0700); err != nil {
 		return fmt.Errorf("failed to create data directory: %w", err)
 	}
+	if err := applyTheme(*themeName); err != nil {
+		return err
+	}
+
+	options.CacheSize = *cacheSize
+	options.BlockCacheSize = *blockCacheSize
+	if options.WALSync, err = lsmtree.ParseSyncPolicy(*syncPolicy); err != nil {
+		return err
+	}
+	options.WALSyncInterval = *syncInterval
+	options.WALMaxUnsyncedBytes = *syncMaxBytes
+	options.WALArchiveDir = *walArchive
+	options.TrackAccess = *trackAccess
+	if options.Snapshots, err = lsmtree.ParseSnapshotSchedules(*snapshots); err != nil {
+		return err
+	}
+	if options.StatsHistory, err = lsmtree.ParseStatsHistory(*statsHistory); err != nil {
+		return err
+	}
+	options.Versions.Keep = max(*keepVersions, 0)
+	if *versionMaxAge != "" {
+		if options.Versions.MaxAge, err = parseAge(*versionMaxAge); err != nil {
+			return err
+		}
+	}
+	args := flags.Args()
+
+	// The benchmark runs a throwaway tree with the engine flags, whatever the store
+	if len(args) > 0 && args[0] == "bench" {
+		return runBench(options, *logLevel, args[1:])
+	}
+
+	settings := uiSettings{copyFormat: *copyFormat, clipboardClear: *clipboardClear, autoLock: *autoLock}
+	if settings.mask, err = parseMask(*mask); err != nil {
+		return err
+	}
+	if settings.templates, err = templates.Load(dataDir); err != nil {
+		return err
+	}
 
-	// Initialize the LSM tree
-	lsm := lsmtree.NewLSMTree(dataDir)
-	if err := lsm.Recover(); err != nil {
-		return fmt.Errorf("failed to recover LSM tree: %w", err)
+	if *remote != "" {
+		return runRemote(dataDir, *remote, *remoteCA, settings, args)
 	}
+	settings.vaultName = cmp.Or(*storeName, config.DefaultStore)
 
-	// Run the UI
-	return RunUI(lsm)
+	if len(args) > 0 {
+		if handled, err := runUnlockedCommand(dataDir, args); handled {
+			return err
+		}
+	}
+
+	// A running agent holds the store open and unlocked, so commands go through it
+	if c := dialAgent(dataDir); c != nil {
+		if len(args) > 0 && args[0] == "agent" {
+			c.Close()
+			return fmt.Errorf("an agent is already running for %s", dataDir)
+		}
+		return runClient(dataDir, c, "the agent", settings, args)
+	}
+
+	// Commands that work on the data directory itself run before the tree is opened
+	if len(args) > 0 {
+		if handled, err := runOfflineCommand(dataDir, args); handled {
+			return err
+		}
+	}
+
+	// Engine events go to stderr for commands, and to the logs pane for the UI
+	// since writing them to the terminal would garble its screen
+	if len(args) == 0 {
+		level, err := parseLogLevel(*logLevel, slog.LevelInfo)
+		if err != nil {
+			return err
+		}
+		settings.logs = newLogBuffer(level)
+		options.Logger = settings.logs
+	} else {
+		level, err := parseLogLevel(*logLevel, slog.LevelWarn)
+		if err != nil {
+			return err
+		}
+		options.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	}
+
+	// An encrypted data directory is unlocked with its master password, or the key kept in the keychain
+	if options.EncryptionKey, err = unlockWithKeychain(dataDir, !*noKeychain); err != nil {
+		return err
+	}
+
+	// Initialize the LSM tree, which holds the data directory lock until it's closed.
+	// Values under encryption context prefixes are encrypted by the vault over it.
+	source := audit.SourceTUI
+	if len(args) > 0 {
+		switch args[0] {
+		case "serve", "cluster":
+			source = audit.SourceAPI
+		case "agent":
+			source = audit.SourceAgent
+		default:
+			source = audit.SourceCLI
+		}
+	}
+	s, err := openSession(dataDir, options, source)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	// Run a subcommand if one was given, otherwise start the UI
+	if len(args) > 0 {
+		return runCommand(dataDir, s.lsm, s.vault, s.store, args)
+	}
+
+	// The key index follows the change feed so listing and completion don't rescan the store
+	if err := s.watch(); err != nil {
+		return err
+	}
+	hist, err := loadHistory(dataDir)
+	if err != nil {
+		return err
+	}
+	// Only a store opened here from its data directory can be closed for another one
+	if !*ephemeral {
+		if settings.vaults, err = cfg.StoreNames(*dataDirFlag); err != nil {
+			return err
+		}
+	}
+	return runUI(s.store, s.vault, s.index, s, hist, settings, "")
 }
@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"Lockr/bin/content"
+
+	"github.com/atotto/clipboard"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Formats of copySelected for the value and the key alone
+const (
+	copyValue = "{value}"
+	copyKey   = "{key}"
+)
+
+// copiedValue is a value copied to the clipboard, cleared when its time is up
+type copiedValue struct {
+	text     string    // what was copied
+	previous string    // clipboard contents before the first copy, restored when clearing
+	deadline time.Time // when the clipboard is cleared
+	id       int       // tells ticks of this copy from those of earlier ones
+}
+
+// clipboardTickMsg updates the countdown of a copied value every second
+type clipboardTickMsg struct {
+	id int
+}
+
+// countdown returns the status line shown while a copied value is in the clipboard
+func (c *copiedValue) countdown() string {
+	return fmt.Sprintf("Clipboard clears in %ds", int(time.Until(c.deadline).Round(time.Second)/time.Second))
+}
+
+// copySelected copies the selected entry to the clipboard in a format where
+// {key} and {value} stand for the entry's key and value. Formats with the value
+// are cleared from the clipboard after settings.clipboardClear.
+func (m *model) copySelected(format string) tea.Cmd {
+	if !m.caps.clipboard {
+		m.errorMessage = "Copying is unavailable without a clipboard utility"
+		return nil
+	}
+	entry, ok := m.selectedItem()
+	if m.detail != nil {
+		entry, ok = *m.detail, true
+	}
+	if !ok {
+		return nil
+	}
+	value, _ := content.Unwrap(entry.value)
+
+	text := strings.NewReplacer("{key}", entry.key, "{value}", value).Replace(format)
+	var status string
+	switch format {
+	case copyValue:
+		status = fmt.Sprintf("Copied the value of %s to the clipboard", entry.key)
+	case copyKey:
+		status = fmt.Sprintf("Copied the key %s to the clipboard", entry.key)
+	default:
+		status = fmt.Sprintf("Copied %s to the clipboard as %q", entry.key, format)
+	}
+	return m.copyText(text, status, strings.Contains(format, "{value}"))
+}
+
+// copyText copies text to the clipboard and reports status. Secret text is cleared
+// from the clipboard after settings.clipboardClear.
+func (m *model) copyText(text, status string, secret bool) tea.Cmd {
+	previous, _ := clipboard.ReadAll()
+	if m.copied != nil {
+		// Copies in a row restore what was there before the first
+		previous = m.copied.previous
+	}
+	if err := clipboard.WriteAll(text); err != nil {
+		// E.g. xclip without a display: stop offering copying rather than failing every time
+		m.caps.clipboard = false
+		m.notice = m.caps.notice()
+		m.errorMessage = fmt.Sprintf("Failed to copy: %v", err)
+		return nil
+	}
+	m.statusMessage = status
+
+	if m.settings.clipboardClear <= 0 || !secret {
+		return nil
+	}
+	id := 1
+	if m.copied != nil {
+		id = m.copied.id + 1
+	}
+	m.copied = &copiedValue{text: text, previous: previous, deadline: time.Now().Add(m.settings.clipboardClear), id: id}
+	return clipboardTick(id)
+}
+
+// clipboardTick schedules the next countdown update of a copied value
+func clipboardTick(id int) tea.Cmd {
+	return tea.Tick(time.Second, func(time.Time) tea.Msg { return clipboardTickMsg{id: id} })
+}
+
+// clipboardTick counts down the copied value and clears it when its time is up
+func (m *model) clipboardTick(msg clipboardTickMsg) tea.Cmd {
+	if m.copied == nil || msg.id != m.copied.id {
+		return nil // A later copy has its own ticks
+	}
+	if time.Until(m.copied.deadline) > time.Second/2 {
+		return clipboardTick(msg.id)
+	}
+	m.clearClipboard()
+	m.statusMessage = "Cleared the clipboard"
+	return nil
+}
+
+// clearClipboard restores what the clipboard held before the copied value,
+// unless something else has been copied since
+func (m *model) clearClipboard() {
+	if m.copied == nil {
+		return
+	}
+	if current, err := clipboard.ReadAll(); err == nil && current == m.copied.text {
+		clipboard.WriteAll(m.copied.previous)
+	}
+	m.copied = nil
+}
+
+// quit clears a copied value from the clipboard, stops watching and ends the program
+func (m *model) quit() tea.Cmd {
+	m.clearClipboard()
+	m.stopWatch()
+	m.quitting = true
+	return tea.Quit
+}
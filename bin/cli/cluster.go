@@ -0,0 +1,304 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"Lockr/bin/audit"
+	"Lockr/bin/cluster"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/raft"
+	"Lockr/bin/replica"
+	"Lockr/bin/vault"
+)
+
+// clusterSecretEnv names the environment variable holding the secret the nodes of
+// a cluster share, which authenticates their Raft requests
+const clusterSecretEnv = "LOCKR_CLUSTER_SECRET"
+
+// clusterTimeout bounds the requests of the cluster admin commands
+const clusterTimeout = 30 * time.Second
+
+// runCluster runs the store as a node of a Raft cluster serving the HTTP API until
+// interrupted, or with detach makes a stopped node's store standalone again
+func runCluster(dataDir string, lsm *lsmtree.LSMTree, store *audit.Store, args []string) error {
+	if len(args) > 0 && args[0] == "detach" {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: lockr cluster detach")
+		}
+		id, err := cluster.Member(lsm)
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			return fmt.Errorf("this store isn't a cluster node")
+		}
+		if err := cluster.Detach(lsm); err != nil {
+			return err
+		}
+		fmt.Printf("Detached node %s from its cluster, the store is writable\n", id)
+		return nil
+	}
+
+	flags := flag.NewFlagSet("cluster", flag.ContinueOnError)
+	id := flags.String("id", "", "ID of this node in the cluster, e.g. n1")
+	raftURL := flags.String("raft", "", "URL the other nodes reach this node at, e.g. http://10.0.0.1:8701, served on its host and port")
+	peers := flags.String("peers", "", "start a new cluster of these nodes, e.g. n1=http://10.0.0.1:8701,n2=...; a new node without it waits to be added")
+	caFile := flags.String("ca", "", "trust this PEM certificate for the other nodes' https URLs")
+	serve := addServeFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *id == "" || *raftURL == "" || flags.NArg() > 0 {
+		return fmt.Errorf("usage: lockr cluster --id <id> --raft <url> [--peers id=url,...] [--ca file] [serve flags] | detach")
+	}
+	secret := os.Getenv(clusterSecretEnv)
+	if secret == "" {
+		return fmt.Errorf("set %s to a secret shared by the nodes of the cluster", clusterSecretEnv)
+	}
+	addr, err := url.Parse(*raftURL)
+	if err != nil || (addr.Scheme != "http" && addr.Scheme != "https") || addr.Host == "" {
+		return fmt.Errorf("invalid --raft URL %q, expected e.g. http://10.0.0.1:8701", *raftURL)
+	}
+	var members map[string]string
+	if *peers != "" {
+		if members, err = parseMembers(*peers); err != nil {
+			return err
+		}
+		if members[*id] != *raftURL {
+			return fmt.Errorf("--peers must give this node, %s=%s", *id, *raftURL)
+		}
+	}
+	config, err := serve.tlsConfig(dataDir)
+	if err != nil {
+		return err
+	}
+	if addr.Scheme == "https" && config == nil {
+		return fmt.Errorf("an https --raft URL needs --tls-cert or --tls-self-signed")
+	}
+	httpClient, err := remoteHTTPClient(*caFile)
+	if err != nil {
+		return err
+	}
+
+	if leader, err := replica.Leader(lsm); err != nil || leader != "" {
+		if err == nil {
+			err = fmt.Errorf("this store follows %s; promote it first with `lockr follow --promote`", leader)
+		}
+		return err
+	}
+	joined, err := cluster.Member(lsm)
+	if err != nil {
+		return err
+	}
+	node, err := cluster.Start(lsm, cluster.Options{
+		ID:        *id,
+		Transport: &raft.HTTPTransport{Client: httpClient, Secret: secret},
+		Peers:     members,
+	})
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	listener, err := net.Listen("tcp", addr.Host)
+	if err != nil {
+		return fmt.Errorf("failed to listen for raft requests: %w", err)
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	raftServer := &http.Server{Handler: raft.Handler(node.Node(), secret), ReadHeaderTimeout: 10 * time.Second}
+	go raftServer.Serve(listener)
+	defer raftServer.Close()
+	fmt.Printf("Node %s serving raft requests on %s\n", *id, *raftURL)
+	if joined == "" && members == nil {
+		fmt.Printf("Waiting to be added with `lockr cluster add %s %s --via <url of a node>`\n", *id, *raftURL)
+	}
+
+	// Reads and writes of the API go through the cluster
+	v, err := vault.Open(dataDir, node)
+	if err != nil {
+		return fmt.Errorf("failed to open vault: %w", err)
+	}
+	clustered := store.Rewrap(v)
+	srv, err := serve.server(lsm, clustered)
+	if err != nil {
+		return err
+	}
+	stop, err := serve.start(srv, clustered, config)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	return nil
+}
+
+// parseMembers parses a list of nodes such as n1=http://10.0.0.1:8701,n2=...
+func parseMembers(list string) (map[string]string, error) {
+	members := make(map[string]string)
+	for _, member := range strings.Split(list, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid node %q, expected id=url", member)
+		}
+		if _, ok := members[id]; ok {
+			return nil, fmt.Errorf("node %s is given twice", id)
+		}
+		members[id] = addr
+	}
+	return members, nil
+}
+
+// runClusterAdmin reports on the nodes of a running cluster and changes its
+// members, through the Raft URL of one of its nodes
+func runClusterAdmin(args []string) error {
+	usage := fmt.Errorf("usage: lockr cluster status <url> [--output table|plain|json] | add <id> <url> --via <url> | remove <id> --via <url>")
+	if len(args) == 0 {
+		return usage
+	}
+	flags := flag.NewFlagSet("cluster "+args[0], flag.ContinueOnError)
+	via := flags.String("via", "", "Raft URL of a node of the cluster")
+	caFile := flags.String("ca", "", "trust this PEM certificate for https nodes")
+	output := outputFlag(flags, outputTable)
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	// Flags may also follow the arguments, as in cluster remove n3 --via http://10.0.0.1:8701
+	var positional []string
+	for flags.NArg() > 0 {
+		positional = append(positional, flags.Arg(0))
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return err
+		}
+	}
+	secret := os.Getenv(clusterSecretEnv)
+	if secret == "" {
+		return fmt.Errorf("set %s to the secret shared by the nodes of the cluster", clusterSecretEnv)
+	}
+	httpClient, err := remoteHTTPClient(*caFile)
+	if err != nil {
+		return err
+	}
+	transport := &raft.HTTPTransport{Client: httpClient, Secret: secret}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+	defer cancel()
+
+	switch {
+	case args[0] == "status" && len(positional) == 1 && *via == "":
+		format, err := parseOutput(*output)
+		if err != nil {
+			return err
+		}
+		return printClusterStatus(ctx, transport, positional[0], format)
+	case args[0] == "add" && len(positional) == 2 && *via != "":
+		return changeMembers(ctx, transport, *via, func(members map[string]string) error {
+			if _, ok := members[positional[0]]; ok {
+				return fmt.Errorf("node %s is already a member", positional[0])
+			}
+			members[positional[0]] = positional[1]
+			return nil
+		})
+	case args[0] == "remove" && len(positional) == 1 && *via != "":
+		return changeMembers(ctx, transport, *via, func(members map[string]string) error {
+			if _, ok := members[positional[0]]; !ok {
+				return fmt.Errorf("node %s isn't a member", positional[0])
+			}
+			delete(members, positional[0])
+			return nil
+		})
+	default:
+		return usage
+	}
+}
+
+// changeMembers changes the members of the cluster of the node at via by edit
+func changeMembers(ctx context.Context, transport *raft.HTTPTransport, via string, edit func(members map[string]string) error) error {
+	status, err := transport.Status(ctx, via)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %w", via, err)
+	}
+	if status.Config.Joint() {
+		return raft.ErrChangeInProgress
+	}
+	members := make(map[string]string, len(status.Config.Members))
+	for id, addr := range status.Config.Members {
+		members[id] = addr
+	}
+	if err := edit(members); err != nil {
+		return err
+	}
+	if err := transport.ChangeMembers(ctx, via, members); err != nil {
+		if errors.Is(err, raft.ErrChangeInProgress) {
+			return fmt.Errorf("%w, try again once it's done", err)
+		}
+		return fmt.Errorf("failed to change members: %w", err)
+	}
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	fmt.Printf("The cluster's members are %s\n", strings.Join(ids, ", "))
+	return nil
+}
+
+// printClusterStatus prints the status of every member of the cluster of the node at addr
+func printClusterStatus(ctx context.Context, transport *raft.HTTPTransport, addr string, format outputFormat) error {
+	status, err := transport.Status(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %w", addr, err)
+	}
+	addrs := make(map[string]string)
+	for id, memberAddr := range status.Config.Old {
+		addrs[id] = memberAddr
+	}
+	for id, memberAddr := range status.Config.Members {
+		addrs[id] = memberAddr
+	}
+	ids := make([]string, 0, len(addrs))
+	for id := range addrs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	statuses := make([]raft.Status, 0, len(ids))
+	rows := make([][]string, 0, len(ids))
+	for _, id := range ids {
+		member, err := transport.Status(ctx, addrs[id])
+		if err != nil {
+			member = raft.Status{ID: id, Role: "unreachable", Err: err.Error()}
+		}
+		statuses = append(statuses, member)
+		role := member.Role
+		if _, ok := status.Config.Members[id]; !ok {
+			role += " (leaving)"
+		}
+		rows = append(rows, []string{id, addrs[id], role, strconv.FormatUint(member.Term, 10), strconv.FormatUint(member.Applied, 10)})
+	}
+	switch format {
+	case outputJSON:
+		return printJSON(statuses)
+	case outputPlain:
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return nil
+	}
+	return printTable([]string{"id", "url", "role", "term", "applied"}, rows)
+}
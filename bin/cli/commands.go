@@ -0,0 +1,1183 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"Lockr/bin/audit"
+	"Lockr/bin/content"
+	"Lockr/bin/interop"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/release"
+	"Lockr/bin/server"
+	"Lockr/bin/share"
+	"Lockr/bin/templates"
+	"Lockr/bin/vault"
+
+	"golang.org/x/term"
+)
+
+// runUnlockedCommand executes subcommands that don't take the data directory lock.
+// It reports whether args named such a command.
+func runUnlockedCommand(dataDir string, args []string) (bool, error) {
+	switch args[0] {
+	case "unlock-dir":
+		return true, runUnlockDir(dataDir, args[1:])
+	case "demo":
+		return true, runDemo(args[1:])
+	case "verify-binary":
+		return true, runVerifyBinary(args[1:])
+	case "restore":
+		// Restore locks the data directory itself, and opens the tree when merging
+		return true, runRestore(dataDir, args[1:])
+	case "snapshots":
+		return true, runSnapshots(dataDir, args[1:])
+	case "keychain":
+		return true, runKeychain(dataDir, args[1:])
+	case "audit":
+		// The audit log is only appended to, so it's read while others use the data
+		// directory; an import locks the directory itself
+		return true, runAudit(dataDir, args[1:])
+	case "rekey":
+		// Rekey opens the tree itself
+		return true, runRekey(dataDir, args[1:])
+	case "cluster":
+		// The admin commands reach a running cluster over the network
+		if len(args) > 1 && (args[1] == "status" || args[1] == "add" || args[1] == "remove") {
+			return true, runClusterAdmin(args[1:])
+		}
+		return false, nil
+	default:
+		return false, nil
+	}
+}
+
+// runOfflineCommand executes subcommands that must run while the tree is closed.
+// It reports whether args named such a command.
+func runOfflineCommand(dataDir string, args []string) (bool, error) {
+	var run func() error
+	switch args[0] {
+	case "migrate":
+		run = func() error { return runMigrate(dataDir, args[1:]) }
+	case "verify":
+		run = func() error { return runVerify(dataDir) }
+	case "doctor":
+		run = func() error { return runDoctor(dataDir, args[1:]) }
+	case "encrypt":
+		run = func() error { return runEncrypt(dataDir, args[1:]) }
+	default:
+		return false, nil
+	}
+
+	// Only one process may use the data directory at a time
+	lock, err := lsmtree.LockDir(dataDir)
+	if err != nil {
+		return true, lockError(err)
+	}
+	defer lock.Release()
+	return true, run()
+}
+
+// lockError explains a failure to lock the data directory
+func lockError(err error) error {
+	var locked *lsmtree.ErrLocked
+	if errors.As(err, &locked) {
+		return fmt.Errorf("%w; if that process crashed, run `lockr unlock-dir`", err)
+	}
+	return fmt.Errorf("failed to lock data directory: %w", err)
+}
+
+// runUnlockDir removes a data directory lock left behind by a crashed process
+func runUnlockDir(dataDir string, args []string) error {
+	flags := flag.NewFlagSet("unlock-dir", flag.ContinueOnError)
+	force := flags.Bool("force", false, "remove the lock even if its owner appears to be running")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	owner, err := lsmtree.UnlockDir(dataDir, *force)
+	var locked *lsmtree.ErrLocked
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		fmt.Println("Data directory isn't locked")
+		return nil
+	case errors.As(err, &locked):
+		return fmt.Errorf("%w; it still appears to be running. Stop it, or run `lockr unlock-dir --force` "+
+			"if you're sure it's gone: two processes writing the same directory will corrupt it", err)
+	case err != nil:
+		return err
+	}
+
+	if *force && !owner.Stale() {
+		fmt.Printf("WARNING: removed the lock of %s, which appears to be running. "+
+			"If it is, stop it now: two processes writing the same directory will corrupt it.\n", owner)
+		return nil
+	}
+	fmt.Printf("Removed stale lock of %s\n", owner)
+	return nil
+}
+
+// runVerify checks every SSTable and the WAL for corruption
+func runVerify(dataDir string) error {
+	key, err := unlockDataDir(dataDir)
+	if err != nil {
+		return err
+	}
+	report, err := lsmtree.VerifyDirWithKey(dataDir, key)
+	if err != nil {
+		return err
+	}
+
+	for _, corruption := range report.Corruptions {
+		fmt.Println(corruption)
+	}
+	if len(report.Corruptions) > 0 {
+		return fmt.Errorf("found %d corruptions in %d SSTables and the WAL", len(report.Corruptions), report.TablesChecked)
+	}
+	fmt.Printf("Verified %d SSTables and the WAL: no corruption found\n", report.TablesChecked)
+	return nil
+}
+
+// runRestore installs a backup taken with `lockr backup`
+func runRestore(dataDir string, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	merge := flags.Bool("merge", false, "write the backup's entries over the existing data instead of replacing it")
+	archive := flags.String("wal-archive", "", "replay the writes archived here since the backup")
+	until := flags.String("until", "", "with --wal-archive or --from, replay writes up to this RFC 3339 time only")
+	from := flags.String("from", "", "download the backup from this target uploaded to by backup --to, the newest unless named")
+	list := flags.Bool("list", false, "with --from, list the backups of the target")
+	output := outputFlag(flags, outputTable)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Flags may also follow the backup, as in restore --from s3://bucket/lockr <name> --until <time>
+	name := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[min(1, flags.NArg()):]); err != nil {
+		return err
+	}
+	usage := fmt.Errorf("usage: lockr restore [--merge] [--wal-archive <dir> [--until <time>]] <backup-dir> | --from <url> [--merge | --until <time>] [name] | --from <url> --list")
+	switch {
+	case flags.NArg() != 0, *from == "" && (name == "" || *list), *from != "" && *archive != "", *list && (name != "" || *merge || *until != ""):
+		return usage
+	}
+
+	options := lsmtree.RestoreOptions{Merge: *merge, WALArchive: *archive}
+	if *until != "" {
+		if *archive == "" && *from == "" {
+			return fmt.Errorf("--until needs --wal-archive or --from")
+		}
+		if *merge {
+			return fmt.Errorf("--until can't be combined with --merge")
+		}
+		var err error
+		if options.Until, err = time.Parse(time.RFC3339, *until); err != nil {
+			return fmt.Errorf("invalid --until time, expected e.g. 2026-10-14T15:04:05Z: %w", err)
+		}
+	}
+	if *from != "" {
+		return restoreFrom(dataDir, *from, name, *list, *merge, options.Until, *output)
+	}
+	return restoreBackup(dataDir, name, options)
+}
+
+// runSnapshots lists the automatic snapshots or restores one of them
+func runSnapshots(dataDir string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: lockr snapshots list [--output table|plain|json] | restore [--merge] <name>")
+	}
+
+	switch args[0] {
+	case "list":
+		flags := flag.NewFlagSet("snapshots list", flag.ContinueOnError)
+		output := outputFlag(flags, outputTable)
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		format, err := parseOutput(*output)
+		if err != nil {
+			return err
+		}
+		snapshots, err := lsmtree.ListSnapshots(dataDir)
+		if err != nil {
+			return err
+		}
+		switch format {
+		case outputJSON:
+			if snapshots == nil {
+				snapshots = []lsmtree.SnapshotInfo{}
+			}
+			return printJSON(snapshots)
+		case outputPlain:
+			for _, snapshot := range snapshots {
+				fmt.Println(snapshot.Name)
+			}
+			return nil
+		}
+		if len(snapshots) == 0 {
+			fmt.Println("No snapshots; start lockr with e.g. -snapshots hourly=24,daily=7 to take them")
+			return nil
+		}
+		rows := make([][]string, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			rows = append(rows, []string{snapshot.Name, snapshot.Schedule, snapshot.Taken.Local().Format(time.RFC3339)})
+		}
+		return printTable([]string{"name", "schedule", "taken"}, rows)
+	case "restore":
+		flags := flag.NewFlagSet("snapshots restore", flag.ContinueOnError)
+		merge := flags.Bool("merge", false, "write the snapshot's entries over the existing data instead of replacing it")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: lockr snapshots restore [--merge] <name>")
+		}
+		snapshots, err := lsmtree.ListSnapshots(dataDir)
+		if err != nil {
+			return err
+		}
+		for _, snapshot := range snapshots {
+			if snapshot.Name == flags.Arg(0) {
+				return restoreBackup(dataDir, snapshot.Dir, lsmtree.RestoreOptions{Merge: *merge})
+			}
+		}
+		return fmt.Errorf("no snapshot named %q; see `lockr snapshots list`", flags.Arg(0))
+	default:
+		return fmt.Errorf("unknown snapshots command %q", args[0])
+	}
+}
+
+// restoreBackup restores a backup or snapshot directory and reports how to undo it
+func restoreBackup(dataDir, backupDir string, options lsmtree.RestoreOptions) error {
+	// Backups share the master password of their store unless it was changed since
+	var password string
+	var err error
+	if options.EncryptionKey, password, err = unlockDir(dataDir, "Master password: ", ""); err != nil {
+		return err
+	}
+	if options.BackupEncryptionKey, _, err = unlockDir(backupDir, "Master password of the backup: ", password); err != nil {
+		return err
+	}
+	result, err := lsmtree.Restore(dataDir, backupDir, options)
+	if err != nil {
+		var locked *lsmtree.ErrLocked
+		if errors.As(err, &locked) {
+			return lockError(err)
+		}
+		return fmt.Errorf("failed to restore: %w", err)
+	}
+	if options.Merge {
+		fmt.Printf("Merged %d entries from %s (%d SSTables verified)\n", result.EntriesMerged, backupDir, result.TablesVerified)
+	} else {
+		fmt.Printf("Restored %s from %s (%d SSTables verified)\n", dataDir, backupDir, result.TablesVerified)
+	}
+	if options.WALArchive != "" {
+		fmt.Printf("Replayed %d writes from %d archived WAL segments", result.WAL.Replayed, result.WAL.Segments)
+		if !result.WAL.Last.IsZero() {
+			fmt.Printf(", up to %s", result.WAL.Last.Local().Format(time.RFC3339))
+		}
+		fmt.Println()
+	}
+	fmt.Printf("The previous data was saved to %s; undo with `lockr migrate --rollback %s`\n", result.PreviousDir, result.PreviousDir)
+	return nil
+}
+
+// runVerifyBinary checks the running executable against its signed release manifest
+func runVerifyBinary(args []string) error {
+	flags := flag.NewFlagSet("verify-binary", flag.ContinueOnError)
+	manifestPath := flags.String("manifest", "", "release manifest (default: <executable>.manifest.json)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *manifestPath == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to locate executable: %w", err)
+		}
+		*manifestPath = executable + ".manifest.json"
+	}
+
+	result, err := release.VerifyExecutable(*manifestPath)
+	if err != nil {
+		if errors.Is(err, release.ErrTampered) {
+			return fmt.Errorf("%w: this binary may have been tampered with, reinstall it from a trusted release", err)
+		}
+		return err
+	}
+	fmt.Printf("Verified %s (release %s, sha256 %s)\n", result.Asset, result.Version, result.Digest)
+	return nil
+}
+
+// runMigrate upgrades the data directory to the current format, or rolls a migration back
+func runMigrate(dataDir string, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	status := flags.Bool("status", false, "print the format version without migrating")
+	rollback := flags.String("rollback", "", "restore the data directory from a migration backup")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *rollback != "" {
+		if err := lsmtree.Rollback(dataDir, *rollback); err != nil {
+			return fmt.Errorf("failed to roll back: %w", err)
+		}
+		fmt.Printf("Restored %s from %s\n", dataDir, *rollback)
+		return nil
+	}
+
+	version, err := lsmtree.DetectFormatVersion(dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to detect format version: %w", err)
+	}
+	if *status {
+		fmt.Printf("Format version %d (current %d)\n", version, lsmtree.CurrentFormatVersion)
+		return nil
+	}
+
+	steps, err := lsmtree.Migrate(dataDir)
+	for _, step := range steps {
+		fmt.Printf("Migrated v%d -> v%d: %s (backup in %s)\n", step.From, step.To, step.Description, step.BackupDir)
+	}
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		fmt.Printf("Already at format version %d\n", version)
+	}
+	return nil
+}
+
+// runCommand executes a non-interactive subcommand against the LSM tree. Commands
+// reading or writing entries go through store, which records them in the audit log.
+func runCommand(dataDir string, lsm *lsmtree.LSMTree, v *vault.Vault, store *audit.Store, args []string) error {
+	switch args[0] {
+	case "debug":
+		return runDebug(lsm, args[1:])
+	case "new":
+		return runNew(dataDir, store, args[1:])
+	case "context":
+		return runContext(v, args[1:])
+	case "cache":
+		return runCache(lsm, args[1:])
+	case "get":
+		return runGet(store, args[1:])
+	case "history":
+		return runHistory(store, args[1:])
+	case "stale":
+		return runStale(lsm, args[1:])
+	case "export":
+		return runExport(lsm, store, args[1:])
+	case "import":
+		return runImport(lsm, store, args[1:])
+	case "changefeed":
+		return runChangefeed(lsm, store, args[1:])
+	case "follow":
+		return runFollow(lsm, args[1:])
+	case "sync":
+		return runSync(lsm, args[1:])
+	case "serve":
+		return runServe(dataDir, lsm, store, args[1:])
+	case "cluster":
+		return runCluster(dataDir, lsm, store, args[1:])
+	case "agent":
+		return runAgent(dataDir, store, args[1:])
+	case "token":
+		tokens, err := server.LoadTokens(lsm)
+		if err != nil {
+			return err
+		}
+		return runToken(localTokens{tokens}, args[1:])
+	case "share":
+		return runShare(store, args[1:])
+	case "receive":
+		return runReceive(store, args[1:])
+	case "backup":
+		return runBackup(lsm, args[1:])
+	case "stats":
+		if len(args) > 1 && (args[1] == "history" || args[1] == "export" || args[1] == "import") {
+			return runStatsHistory(lsm, store, args[1:])
+		}
+		return runStats(store, args[1:])
+	case "gc":
+		return runGC(store, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// runGet prints the value of a key, formatted by its content type with --pretty
+func runGet(store lsmtree.Store, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	pretty := flags.Bool("pretty", false, "format the value by its content type: indented JSON, a hex dump for binary values")
+	at := flags.String("at", "", "get a past value: a version number from `lockr history`, a time such as 2026-10-14T15:04 or an age such as 2d")
+	output := outputFlag(flags, outputPlain)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Flags may also follow the key, as in get db/password --at 2d
+	key := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[min(1, flags.NArg()):]); err != nil {
+		return err
+	}
+	if key == "" || flags.NArg() != 0 {
+		return fmt.Errorf("usage: lockr get [--pretty] [--at <version|time>] [--output plain|table|json] <key>")
+	}
+	format, err := parseOutput(*output)
+	if err != nil {
+		return err
+	}
+
+	stored, err := store.Get(key)
+	if *at != "" {
+		var version lsmtree.Version
+		versions, ok := store.(versioned)
+		if !ok {
+			err = fmt.Errorf("get --at: versions are %w here", errors.ErrUnsupported)
+		} else if version, err = versionAt(versions, key, *at); err == nil && version.Deleted {
+			err = fmt.Errorf("version %d of %s is its deletion", version.Number, key)
+		}
+		stored = version.Value
+	}
+	if err != nil {
+		return err
+	}
+	if stored == "" {
+		return fmt.Errorf("key %s not found", key)
+	}
+	value, contentType := content.Unwrap(stored)
+	if format == outputJSON {
+		return printJSON(map[string]string{"key": key, "value": value, "content_type": contentType})
+	}
+
+	if *pretty {
+		if entry, ok := templates.Decode(value); ok {
+			value = entry.Render()
+		} else {
+			value = renderValue(value, contentType)
+		}
+	}
+	if format == outputTable {
+		// Multi-line values continue under the value column
+		return printTable([]string{"key", "type", "value"}, [][]string{{key, contentType, strings.ReplaceAll(value, "\n", "\n\t\t")}})
+	}
+	fmt.Println(value)
+	return nil
+}
+
+// runStale lists the keys that haven't been read for a while
+func runStale(lsm *lsmtree.LSMTree, args []string) error {
+	flags := flag.NewFlagSet("stale", flag.ContinueOnError)
+	unusedFor := flags.String("unused-for", "90d", "list keys not read for this long, e.g. 90d or 12h")
+	output := outputFlag(flags, outputTable)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: lockr stale [--unused-for <age>] [--output table|plain|json]")
+	}
+	age, err := parseAge(*unusedFor)
+	if err != nil {
+		return err
+	}
+	format, err := parseOutput(*output)
+	if err != nil {
+		return err
+	}
+
+	stale, since, err := lsm.StaleKeys(age)
+	if err != nil {
+		return err
+	}
+	if since.IsZero() {
+		return fmt.Errorf("no access statistics; start lockr with -track-access to record reads")
+	}
+	if time.Since(since) < age {
+		fmt.Printf("Reads are recorded since %s, less than %s ago; no key can be stale yet\n", since.Local().Format(time.RFC3339), *unusedFor)
+		return nil
+	}
+	switch format {
+	case outputJSON:
+		type staleKey struct {
+			Key      string     `json:"key"`
+			Reads    uint64     `json:"reads"`
+			LastRead *time.Time `json:"last_read"`
+		}
+		keys := make([]staleKey, 0, len(stale))
+		for _, key := range stale {
+			k := staleKey{Key: key.Key, Reads: key.Reads}
+			if !key.LastRead.IsZero() {
+				k.LastRead = &key.LastRead
+			}
+			keys = append(keys, k)
+		}
+		return printJSON(map[string]interface{}{"since": since, "keys": keys})
+	case outputPlain:
+		for _, key := range stale {
+			fmt.Println(key.Key)
+		}
+		return nil
+	}
+
+	rows := make([][]string, 0, len(stale))
+	for _, key := range stale {
+		lastRead := "never"
+		if !key.LastRead.IsZero() {
+			lastRead = key.LastRead.Local().Format(time.RFC3339)
+		}
+		rows = append(rows, []string{key.Key, strconv.FormatUint(key.Reads, 10), lastRead})
+	}
+	if err := printTable([]string{"key", "reads", "last read"}, rows); err != nil {
+		return err
+	}
+	fmt.Printf("%d keys not read for %s (reads recorded since %s)\n", len(stale), *unusedFor, since.Local().Format(time.RFC3339))
+	return nil
+}
+
+// parseAge parses a duration that may also be given in days, e.g. "90d"
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(s)
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("invalid age %q, expected e.g. 90d or 12h", s)
+	}
+	return age, nil
+}
+
+// runExport writes the store's entries to a file, or to stdout for "-"
+func runExport(lsm *lsmtree.LSMTree, store *audit.Store, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	formatName := flags.String("format", "json", "output format: json, csv or ndjson")
+	prefix := flags.String("prefix", "", "only export keys starting with this prefix")
+	to := flags.String("to", "", "write a database of another password manager instead: kdbx or pass")
+	recipients := flags.String("recipient", "", "GPG keys a pass store is encrypted for, separated by commas")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: lockr export [--format json|csv|ndjson] [--prefix <prefix>] <file>\n" +
+			"       lockr export --to kdbx|pass [--recipient <gpg-key>] [--prefix <prefix>] <path>")
+	}
+	path := flags.Arg(0)
+	if *to != "" {
+		return runExportTo(store, *to, path, *prefix, *recipients)
+	}
+	format, err := lsmtree.ParseExportFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Record(audit.OpExport, *prefix, fmt.Sprintf("%s to %s", *formatName, path)); err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err := lsmtree.ExportStore(lsm, os.Stdout, format, *prefix)
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create export file: %w", err)
+	}
+	count, err := lsmtree.ExportStore(lsm, file, format, *prefix)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write export file: %w", closeErr)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	fmt.Printf("Exported %d entries to %s\n", count, path)
+	return nil
+}
+
+// runExportTo writes the entries under prefix, decrypted, as a KeePass database
+// or a pass store for other password managers
+func runExportTo(store *audit.Store, to, path, prefix, recipients string) error {
+	if to != "kdbx" && to != "pass" {
+		return fmt.Errorf("unknown password manager format %q, expected kdbx or pass", to)
+	}
+	var keys []string
+	if to == "pass" {
+		for _, key := range strings.Split(recipients, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("a pass store needs --recipient, the GPG key to encrypt it for")
+		}
+		if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+			return fmt.Errorf("%s isn't empty", path)
+		}
+	}
+
+	it, err := lsmtree.PrefixScan(store, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to scan store: %w", err)
+	}
+	var items []interop.Item
+	skipped := 0
+	for it.Next() {
+		if item, ok := interop.FromStored(it.Key(), it.Value()); ok {
+			items = append(items, item)
+		} else {
+			skipped++
+		}
+	}
+	err = it.Err()
+	it.Close()
+	if err != nil {
+		return fmt.Errorf("failed to scan store: %w", err)
+	}
+	if err := store.Record(audit.OpExport, prefix, fmt.Sprintf("%s to %s", to, path)); err != nil {
+		return err
+	}
+
+	if to == "pass" {
+		if err := interop.WritePass(path, keys, items, interop.GPGEncrypt); err != nil {
+			return err
+		}
+	} else {
+		password := os.Getenv(kdbxPasswordEnv)
+		if password == "" {
+			if password, err = readPassphrase("Password for the KeePass database: "); err != nil {
+				return err
+			}
+			confirmation, err := readPassphrase("Repeat the password: ")
+			if err != nil {
+				return err
+			}
+			if password != confirmation {
+				return fmt.Errorf("passwords don't match")
+			}
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create database: %w", err)
+		}
+		err = interop.WriteKDBX(file, items, password)
+		if closeErr := file.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to write database: %w", closeErr)
+		}
+		if err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+	fmt.Printf("Exported %d entries to %s", len(items), path)
+	if skipped > 0 {
+		fmt.Printf(", skipped %d binary values", skipped)
+	}
+	fmt.Println()
+	return nil
+}
+
+// runImport writes the entries of an export file to the store
+func runImport(lsm *lsmtree.LSMTree, store *audit.Store, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	formatName := flags.String("format", "", "input format: json, csv or ndjson (default: from the file extension)")
+	onConflict := flags.String("on-conflict", "overwrite", "what to do with keys that already exist: skip, overwrite or fail")
+	resumeFrom := flags.Int("resume-from", 0, "skip this many entries already imported by an earlier run")
+	from := flags.String("from", "", "import the export of another password manager: bitwarden, 1password, keepass-csv or pass")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: lockr import [--format json|csv|ndjson] [--on-conflict skip|overwrite|fail] [--resume-from <n>] <file>\n" +
+			"       lockr import --from bitwarden|1password|keepass-csv|pass [--on-conflict skip|overwrite|fail] <path>")
+	}
+
+	path := flags.Arg(0)
+	if *from != "" {
+		return runImportFrom(store, *from, path, *onConflict)
+	}
+	options := lsmtree.ImportOptions{ResumeFrom: *resumeFrom}
+	var err error
+	if *formatName != "" {
+		options.Format, err = lsmtree.ParseExportFormat(*formatName)
+	} else {
+		options.Format, err = lsmtree.ImportFormatFor(path)
+	}
+	if err != nil {
+		return err
+	}
+	if options.OnConflict, err = lsmtree.ParseConflictPolicy(*onConflict); err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open import file: %w", err)
+	}
+	defer file.Close()
+
+	result, err := lsmtree.Import(lsm, file, options)
+	if recordErr := store.Record(audit.OpImport, "", fmt.Sprintf("%d entries from %s", result.Written, path)); err == nil {
+		err = recordErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w; the first %d entries are imported, continue with --resume-from %d", err, result.Committed, result.Committed)
+	}
+	fmt.Printf("Imported %d entries from %s", result.Written, path)
+	if result.Skipped > 0 {
+		fmt.Printf(", skipped %d existing keys", result.Skipped)
+	}
+	fmt.Println()
+	return nil
+}
+
+// runImportFrom imports the export of another password manager as structured
+// entries, in one batch
+func runImportFrom(store lsmtree.Store, from, path, onConflict string) error {
+	format, err := interop.ParseFormat(from)
+	if err != nil {
+		return err
+	}
+	policy, err := lsmtree.ParseConflictPolicy(onConflict)
+	if err != nil {
+		return err
+	}
+	items, err := interop.Read(format, path)
+	if err != nil {
+		return err
+	}
+
+	batch := lsmtree.NewWriteBatch()
+	skipped := 0
+	for i, key := range interop.Keys(items) {
+		if policy != lsmtree.ConflictOverwrite {
+			existing, err := store.Get(key)
+			if err != nil {
+				return err
+			}
+			if existing != "" && policy == lsmtree.ConflictFail {
+				return fmt.Errorf("%w: %s; nothing was imported", lsmtree.ErrImportConflict, key)
+			}
+			if existing != "" {
+				skipped++
+				continue
+			}
+		}
+		value, err := items[i].Value()
+		if err != nil {
+			return err
+		}
+		batch.Set(key, value)
+	}
+	if err := store.Batch(batch); err != nil {
+		return fmt.Errorf("failed to import: %w", err)
+	}
+	fmt.Printf("Imported %d entries from %s", len(items)-skipped, path)
+	if skipped > 0 {
+		fmt.Printf(", skipped %d existing keys", skipped)
+	}
+	fmt.Println()
+	return nil
+}
+
+// runShare prints a key's entry encrypted for a single recipient
+func runShare(store lsmtree.Store, args []string) error {
+	flags := flag.NewFlagSet("share", flag.ContinueOnError)
+	to := flags.String("to", "", "recipient: an age1... or ssh-ed25519 public key, or a file holding one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Accept flags after the key too, as in `lockr share db/password --to age1...`
+	if flags.NArg() > 0 {
+		key := flags.Arg(0)
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return err
+		}
+		args = append([]string{key}, flags.Args()...)
+	}
+	if len(args) != 1 || *to == "" {
+		return fmt.Errorf("usage: lockr share <key> --to <recipient>")
+	}
+
+	recipient, err := parseRecipient(*to)
+	if err != nil {
+		return err
+	}
+	value, err := store.Get(args[0])
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		return fmt.Errorf("key %s not found", args[0])
+	}
+	blob, err := share.Seal(recipient, args[0], value)
+	if err != nil {
+		return err
+	}
+	fmt.Println(blob)
+	return nil
+}
+
+// parseRecipient parses a recipient given on the command line or, failing that,
+// the first key in the file it names
+func parseRecipient(s string) (*share.Recipient, error) {
+	if strings.HasPrefix(s, "age1") || strings.HasPrefix(s, "ssh-") {
+		return share.ParseRecipient(s)
+	}
+	data, err := os.ReadFile(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recipient: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			return share.ParseRecipient(line)
+		}
+	}
+	return nil, fmt.Errorf("no recipient found in %s", s)
+}
+
+// runReceive decrypts an entry made by `lockr share` and stores it
+func runReceive(store lsmtree.Store, args []string) error {
+	defaultIdentity := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		defaultIdentity = filepath.Join(home, ".ssh", "id_ed25519")
+	}
+	flags := flag.NewFlagSet("receive", flag.ContinueOnError)
+	identityFile := flags.String("identity", defaultIdentity, "age identity file or ed25519 SSH private key to decrypt with")
+	as := flags.String("as", "", "store the entry under this key instead of the one it was shared as")
+	force := flags.Bool("force", false, "overwrite an existing key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: lockr receive [--identity <file>] [--as <key>] [--force] <blob|file|->")
+	}
+
+	blob, err := readBlob(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(*identityFile)
+	if err != nil {
+		return fmt.Errorf("failed to read identity: %w", err)
+	}
+	identity, err := share.ParseIdentity(data, func() ([]byte, error) {
+		passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", *identityFile))
+		return []byte(passphrase), err
+	})
+	if err != nil {
+		return err
+	}
+	key, value, err := share.Open(identity, blob)
+	if err != nil {
+		return err
+	}
+	if *as != "" {
+		key = *as
+	}
+
+	if !*force {
+		existing, err := store.Get(key)
+		if err != nil {
+			return err
+		}
+		if existing != "" {
+			return fmt.Errorf("%s already exists; use --force to overwrite it or --as to store it under another key", key)
+		}
+	}
+	if err := store.Set(key, value); err != nil {
+		return err
+	}
+	fmt.Printf("Received %s\n", key)
+	return nil
+}
+
+// readBlob returns a shared entry given inline, in a file or on stdin for "-"
+func readBlob(arg string) (string, error) {
+	if arg == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read stdin: %w", err)
+		}
+		return string(data), nil
+	}
+	if _, err := os.Stat(arg); err != nil {
+		return arg, nil
+	}
+	data, err := os.ReadFile(arg)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", arg, err)
+	}
+	return string(data), nil
+}
+
+// runCache handles the cache subcommands
+func runCache(lsm *lsmtree.LSMTree, args []string) error {
+	usage := fmt.Errorf("usage: lockr cache pin <key> | unpin <key> | stats")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch {
+	case args[0] == "pin" && len(args) == 2:
+		if err := lsm.Pin(args[1]); err != nil {
+			return err
+		}
+		stats := lsm.Stats().Cache
+		fmt.Printf("Pinned %s (%d of %d pinned)\n", args[1], stats.Pinned, stats.MaxPinned)
+		return nil
+	case args[0] == "unpin" && len(args) == 2:
+		if err := lsm.Unpin(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Unpinned %s\n", args[1])
+		return nil
+	case args[0] == "stats" && len(args) == 1:
+		stats := lsm.Stats().Cache
+		fmt.Printf("policy: %s, entries: %d of %d, bytes: %d", stats.Policy, stats.Entries, stats.MaxSize, stats.Bytes)
+		if stats.MaxBytes > 0 {
+			fmt.Printf(" of %d", stats.MaxBytes)
+		}
+		fmt.Printf("\nhits: %d, misses: %d (%.2f%% hit rate), rejected: %d\n",
+			stats.Hits, stats.Misses, 100*stats.HitRate(), stats.Rejected)
+		fmt.Printf("pinned: %d of %d\n", stats.Pinned, stats.MaxPinned)
+		for _, key := range lsm.Pinned() {
+			fmt.Printf("  %s\n", key)
+		}
+		return nil
+	default:
+		return usage
+	}
+}
+
+// runContext handles the encryption context subcommands
+func runContext(v *vault.Vault, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: lockr context add <name> <prefix> | list")
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: lockr context add <name> <prefix>")
+		}
+		passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", args[1]))
+		if err != nil {
+			return err
+		}
+		confirmation, err := readPassphrase("Repeat passphrase: ")
+		if err != nil {
+			return err
+		}
+		if passphrase != confirmation {
+			return fmt.Errorf("passphrases don't match")
+		}
+		if err := v.AddContext(args[1], args[2], passphrase); err != nil {
+			return fmt.Errorf("failed to add context: %w", err)
+		}
+		fmt.Printf("Values under %q are now encrypted by context %s\n", args[2], args[1])
+		return nil
+	case "list":
+		for _, c := range v.Contexts() {
+			fmt.Printf("%s\t%s\n", c.Name, c.Prefix)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown context command %q", args[0])
+	}
+}
+
+// runNew creates a structured entry by prompting for the fields of a template
+func runNew(dataDir string, store lsmtree.Store, args []string) error {
+	all, err := templates.Load(dataDir)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("usage: lockr new <template> <name> (templates: %s)", strings.Join(templates.Names(all), ", "))
+	}
+	template, ok := all[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown template %q (templates: %s)", args[0], strings.Join(templates.Names(all), ", "))
+	}
+
+	key := template.Key(args[1])
+	existing, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		return fmt.Errorf("%s already exists", key)
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	values := make(map[string]string)
+	for _, field := range template.Fields {
+		prompt := fmt.Sprintf("%s: ", field.Label)
+		if field.Secret {
+			values[field.Name], err = readSecret(reader, prompt)
+		} else {
+			values[field.Name], err = readLine(reader, prompt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	value, err := template.NewEntry(values).Encode()
+	if err != nil {
+		return err
+	}
+	if err := store.Set(key, value); err != nil {
+		return fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	fmt.Printf("Stored %s\n", key)
+	return nil
+}
+
+// readLine prompts for a line of input
+func readLine(reader *bufio.Reader, prompt string) (string, error) {
+	fmt.Print(prompt)
+	line, err := reader.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("failed to read input: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readSecret prompts for a value without echoing it, reading a plain line when
+// stdin isn't a terminal
+func readSecret(reader *bufio.Reader, prompt string) (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return readLine(reader, prompt)
+	}
+	fmt.Print(prompt)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("failed to read input: %w", err)
+	}
+	return string(secret), nil
+}
+
+// readPassphrase prompts for a passphrase without echoing it
+func readPassphrase(prompt string) (string, error) {
+	fmt.Print(prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("passphrase must not be empty")
+	}
+	return string(passphrase), nil
+}
+
+// runDebug handles the debug subcommands
+func runDebug(lsm *lsmtree.LSMTree, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: lockr debug snapshot-state <file> | sstable | wal")
+	}
+
+	switch args[0] {
+	case "snapshot-state":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: lockr debug snapshot-state <file>")
+		}
+		return writeDebugState(lsm.DebugState(), args[1])
+	case "sstable":
+		printSSTableStats(lsm.Stats())
+		return nil
+	case "wal":
+		stats := lsm.Stats()
+		printWALStats(stats.WAL)
+		printRecoveryReport(stats.Recovery)
+		return nil
+	default:
+		return fmt.Errorf("unknown debug command %q", args[0])
+	}
+}
+
+// writeDebugState writes the debug state to a file, using gob for .gob files and JSON otherwise
+func writeDebugState(state lsmtree.DebugState, path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer file.Close()
+
+	if filepath.Ext(path) == ".gob" {
+		err = gob.NewEncoder(file).Encode(state)
+	} else {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(state)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode debug state: %w", err)
+	}
+
+	fmt.Printf("Wrote debug state to %s\n", path)
+	return nil
+}
+
+// printSSTableStats prints per-table and aggregate bloom filter statistics
+func printSSTableStats(stats lsmtree.Stats) {
+	for _, table := range stats.SSTables {
+		props := table.Properties
+		fmt.Printf("%s\n", table.FilePath)
+		fmt.Printf("  keys: %q..%q, entries: %d (%d tombstones), created %s\n",
+			props.SmallestKey, props.LargestKey, props.Entries, props.Tombstones, props.CreatedAt.Format(time.RFC3339))
+		fmt.Printf("  bloom: %d bits, %d hashes, seeks left before compaction: %d\n",
+			table.BloomBits, table.BloomHashes, table.AllowedSeeks)
+		printBloomStats("  ", table.Bloom)
+	}
+	fmt.Printf("total (%d sstables)\n", len(stats.SSTables))
+	printBloomStats("  ", stats.Bloom)
+}
+
+// printWALStats prints the sync policy and how much logged data isn't on stable storage yet
+func printWALStats(wal lsmtree.WALStats) {
+	fmt.Printf("sync policy: %s", wal.Policy)
+	if wal.SyncInterval > 0 {
+		fmt.Printf(", every %s", wal.SyncInterval)
+	}
+	if wal.MaxUnsyncedBytes > 0 {
+		fmt.Printf(" or %d unsynced bytes", wal.MaxUnsyncedBytes)
+	}
+	fmt.Printf("\nsegment: %d, fsyncs: %d\n", wal.Segment, wal.Syncs)
+	if wal.UnsyncedBytes > 0 {
+		fmt.Printf("unsynced: %d bytes, oldest from %s ago\n", wal.UnsyncedBytes, time.Since(wal.OldestUnsynced).Round(time.Millisecond))
+	} else {
+		fmt.Println("unsynced: none")
+	}
+}
+
+// printRecoveryReport prints what recovery read from the WAL when the store was opened
+func printRecoveryReport(recovery lsmtree.RecoveryReport) {
+	fmt.Printf("recovery: %d operations replayed from %d segments, %d records discarded\n",
+		recovery.Replayed, recovery.Segments, recovery.Discarded)
+	if recovery.Truncated != "" {
+		fmt.Printf("  truncated %d torn bytes from %s\n", recovery.TruncatedBytes, recovery.Truncated)
+	}
+}
+
+// printBloomStats prints bloom filter counters with the given indentation
+func printBloomStats(indent string, bloom lsmtree.BloomStats) {
+	fmt.Printf("%schecks: %d, negatives avoided: %d, false positives: %d (%.2f%%)\n",
+		indent, bloom.Checks, bloom.Negatives, bloom.FalsePositives, bloom.FalsePositiveRate()*100)
+	if bloom.PrefixChecks > 0 {
+		fmt.Printf("%sprefix scans: %d checked, %d skipped\n", indent, bloom.PrefixChecks, bloom.PrefixNegatives)
+	}
+}
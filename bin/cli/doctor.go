@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"Lockr/bin/lsmtree"
+)
+
+// runDoctor checks the data directory for corruption, layout problems and
+// leftover files, and salvages what's readable into a new store with --repair
+func runDoctor(dataDir string, args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "replace the store by one salvaged from its readable records, keeping a copy of the damaged files")
+	output := outputFlag(flags, outputTable)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: lockr doctor [--repair] [--output table|plain|json]")
+	}
+	format, err := parseOutput(*output)
+	if err != nil {
+		return err
+	}
+	key, err := unlockDataDir(dataDir)
+	if err != nil {
+		return err
+	}
+	report, err := lsmtree.Diagnose(dataDir, key)
+	if err != nil {
+		return fmt.Errorf("failed to diagnose data directory: %w", err)
+	}
+
+	var repaired *lsmtree.RepairResult
+	if *repair {
+		options := lsmtree.Options{
+			EncryptionKey: key,
+			Logger:        slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})),
+		}
+		result, err := lsmtree.Repair(dataDir, options)
+		if err != nil {
+			return fmt.Errorf("failed to repair data directory: %w", err)
+		}
+		repaired = &result
+	}
+
+	switch format {
+	case outputJSON:
+		return printJSON(struct {
+			Diagnosis lsmtree.DoctorReport  `json:"diagnosis"`
+			Repair    *lsmtree.RepairResult `json:"repair,omitempty"`
+		}{report, repaired})
+	case outputPlain:
+		fmt.Printf("healthy %t\n", report.Healthy())
+		fmt.Printf("problems %d\n", len(report.Problems))
+		fmt.Printf("corruptions %d\n", len(report.Corruptions))
+		fmt.Printf("orphaned_tables %d\n", len(report.OrphanedTables))
+		fmt.Printf("stale_segments %d\n", len(report.StaleSegments))
+		fmt.Printf("temp_files %d\n", len(report.TempFiles))
+		fmt.Printf("tombstones %d\n", report.Garbage.Tombstones)
+		fmt.Printf("shadowed %d\n", report.Garbage.Shadowed)
+		fmt.Printf("garbage_bytes %d\n", report.Garbage.Bytes)
+		if repaired != nil {
+			fmt.Printf("salvaged_keys %d\n", repaired.Keys)
+			fmt.Printf("lost_tables %d\n", len(repaired.LostTables))
+			fmt.Printf("lost_blocks %d\n", repaired.LostBlocks)
+			fmt.Printf("previous_dir %s\n", repaired.PreviousDir)
+		}
+	default:
+		printDiagnosis(report)
+		if repaired != nil {
+			printRepair(*repaired)
+		}
+	}
+
+	if repaired == nil && !report.Healthy() {
+		return fmt.Errorf("found %d problems or corruptions; `lockr doctor --repair` salvages the readable records",
+			len(report.Problems)+len(report.Corruptions))
+	}
+	return nil
+}
+
+// printDiagnosis prints what Diagnose found, the faults first
+func printDiagnosis(report lsmtree.DoctorReport) {
+	for _, problem := range report.Problems {
+		fmt.Println("Problem:", problem)
+	}
+	for _, corruption := range report.Corruptions {
+		fmt.Println("Corrupt:", corruption)
+	}
+	fmt.Printf("Checked %d SSTables and %d WAL segments with %d records, format version %d\n",
+		report.TablesChecked, report.WALSegments, report.WALRecords, report.FormatVersion)
+	for _, files := range []struct {
+		kind  string
+		names []string
+	}{
+		{"SSTables missing from the manifest", report.OrphanedTables},
+		{"WAL segments already flushed", report.StaleSegments},
+		{"temporary files", report.TempFiles},
+	} {
+		if len(files.names) > 0 {
+			fmt.Printf("%d %s: %s\n", len(files.names), files.kind, strings.Join(files.names, ", "))
+		}
+	}
+	if garbage := report.Garbage; garbage.Tombstones+garbage.Shadowed > 0 {
+		fmt.Printf("%d tombstones and %d overwritten entries of %d, %s a full compaction would reclaim\n",
+			garbage.Tombstones, garbage.Shadowed, garbage.Entries, formatBytes(garbage.Bytes))
+	}
+	if report.Healthy() {
+		fmt.Println("No problems found")
+	}
+}
+
+// printRepair prints what Repair salvaged
+func printRepair(result lsmtree.RepairResult) {
+	fmt.Printf("\nSalvaged %d keys from %d SSTables and %d WAL records\n", result.Keys, result.TablesRead, result.WALRecords)
+	if len(result.LostTables) > 0 {
+		fmt.Printf("Lost %d unreadable SSTables: %s\n", len(result.LostTables), strings.Join(result.LostTables, ", "))
+	}
+	if result.LostBlocks > 0 {
+		fmt.Printf("Lost %d corrupt blocks\n", result.LostBlocks)
+	}
+	if len(result.CutSegments) > 0 {
+		fmt.Printf("Lost the records after the corruption in %s\n", strings.Join(result.CutSegments, ", "))
+	}
+	fmt.Printf("The damaged data was saved to %s; undo with `lockr migrate --rollback %s`\n", result.PreviousDir, result.PreviousDir)
+}
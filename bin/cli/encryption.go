@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"Lockr/bin/keychain"
+	"Lockr/bin/lsmtree"
+)
+
+// passwordEnv names the environment variable that gives the master password to
+// scripts, which have no terminal to prompt on
+const passwordEnv = "LOCKR_PASSWORD"
+
+// kdbxPasswordEnv names the environment variable that gives scripts the password
+// of a KeePass database written by `export --to kdbx`
+const kdbxPasswordEnv = "LOCKR_KDBX_PASSWORD"
+
+// keychainService names the unlock keys of data directories in the OS keychain
+const keychainService = "lockr"
+
+// runEncrypt encrypts the data directory with a master password, or changes it
+func runEncrypt(dataDir string, args []string) error {
+	flags := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	change := flags.Bool("change-password", false, "change the master password of an encrypted data directory")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	encrypted, err := lsmtree.IsEncrypted(dataDir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case *change && !encrypted:
+		return fmt.Errorf("data directory isn't encrypted; run `lockr encrypt` first")
+	case !*change && encrypted:
+		return fmt.Errorf("data directory is already encrypted; change the password with `lockr encrypt --change-password`")
+	}
+
+	var old string
+	if *change {
+		if old, err = masterPassword("Current master password: "); err != nil {
+			return err
+		}
+		if _, err := lsmtree.UnlockEncryption(dataDir, old); err != nil {
+			return err
+		}
+	}
+	password, err := newMasterPassword(*change)
+	if err != nil {
+		return err
+	}
+
+	if *change {
+		if err := lsmtree.ChangeEncryptionPassword(dataDir, old, password); err != nil {
+			return fmt.Errorf("failed to change master password: %w", err)
+		}
+		forgetKeychain(dataDir)
+		fmt.Println("Changed the master password")
+		return nil
+	}
+	if err := lsmtree.EnableEncryption(dataDir, password); err != nil {
+		return fmt.Errorf("failed to encrypt data directory: %w", err)
+	}
+	fmt.Printf("Encrypted %s; the master password is asked for every time it's opened\n", dataDir)
+	return nil
+}
+
+// runRekey replaces the data key of an encrypted data directory, rewriting its
+// files, and optionally its master password
+func runRekey(dataDir string, args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	keepPassword := flags.Bool("keep-password", false, "keep the current master password")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if encrypted, err := lsmtree.IsEncrypted(dataDir); err != nil {
+		return err
+	} else if !encrypted {
+		return fmt.Errorf("data directory isn't encrypted; run `lockr encrypt` first")
+	}
+
+	key, old, err := unlockDir(dataDir, "Current master password: ", "")
+	if err != nil {
+		return err
+	}
+	password := old
+	if !*keepPassword {
+		if password, err = newMasterPassword(true); err != nil {
+			return err
+		}
+	}
+
+	lsm := lsmtree.NewLSMTreeWithOptions(dataDir, lsmtree.Options{EncryptionKey: key})
+	if err := lsm.Recover(); err != nil {
+		var locked *lsmtree.ErrLocked
+		if errors.As(err, &locked) {
+			return lockError(err)
+		}
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	defer lsm.Close()
+	if err := lsm.Rekey(old, password); err != nil {
+		return fmt.Errorf("failed to rekey: %w", err)
+	}
+	forgetKeychain(dataDir)
+	fmt.Println("Re-encrypted the store with a new data key")
+	return nil
+}
+
+// runKeychain manages the unlock key kept in the OS keychain
+func runKeychain(dataDir string, args []string) error {
+	if len(args) != 1 || args[0] != "forget" {
+		return fmt.Errorf("usage: lockr keychain forget")
+	}
+	if err := keychain.Delete(keychainService, keychainAccount(dataDir)); err != nil {
+		return err
+	}
+	fmt.Println("Removed the unlock key from the keychain")
+	return nil
+}
+
+// unlockWithKeychain returns the data key of an encrypted data directory from the
+// OS keychain, or unlocks it with the master password and keeps the key there for
+// next time. A key replaced by a rekey is asked for again.
+func unlockWithKeychain(dataDir string, useKeychain bool) ([]byte, error) {
+	if encrypted, err := lsmtree.IsEncrypted(dataDir); err != nil || !encrypted || !useKeychain {
+		return unlockDataDir(dataDir)
+	}
+	account := keychainAccount(dataDir)
+	if stored, err := keychain.Get(keychainService, account); err == nil {
+		key, err := base64.StdEncoding.DecodeString(stored)
+		if err == nil && lsmtree.CheckEncryptionKey(dataDir, key) == nil {
+			return key, nil
+		}
+	} else if errors.Is(err, keychain.ErrUnsupported) {
+		return unlockDataDir(dataDir)
+	}
+
+	key, err := unlockDataDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := keychain.Set(keychainService, account, base64.StdEncoding.EncodeToString(key)); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	return key, nil
+}
+
+// forgetKeychain removes the data directory's unlock key from the keychain after
+// its password or key changed, so the new password is asked for once
+func forgetKeychain(dataDir string) {
+	if err := keychain.Delete(keychainService, keychainAccount(dataDir)); err != nil && !errors.Is(err, keychain.ErrUnsupported) {
+		fmt.Fprintf(os.Stderr, "warning: failed to remove the unlock key from the keychain: %v\n", err)
+	}
+}
+
+// keychainAccount names a data directory in the keychain by its absolute path
+func keychainAccount(dataDir string) string {
+	if abs, err := filepath.Abs(dataDir); err == nil {
+		return abs
+	}
+	return dataDir
+}
+
+// unlockDataDir returns the data key of an encrypted data directory, asking for
+// its master password, and nil for a plaintext one
+func unlockDataDir(dataDir string) ([]byte, error) {
+	key, _, err := unlockDir(dataDir, "Master password: ", "")
+	return key, err
+}
+
+// unlockDir returns the data key of an encrypted directory and its master
+// password, trying known before prompting, and nil for a plaintext one
+func unlockDir(dir, prompt, known string) ([]byte, string, error) {
+	encrypted, err := lsmtree.IsEncrypted(dir)
+	if err != nil || !encrypted {
+		return nil, "", err
+	}
+	if known != "" {
+		if key, err := lsmtree.UnlockEncryption(dir, known); !errors.Is(err, lsmtree.ErrWrongPassword) {
+			return key, known, err
+		}
+	}
+	password, err := masterPassword(prompt)
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := lsmtree.UnlockEncryption(dir, password)
+	return key, password, err
+}
+
+// newMasterPassword prompts for a new master password twice. Encrypting takes it
+// from the environment when set; a changed password is always typed.
+func newMasterPassword(change bool) (string, error) {
+	if password := os.Getenv(passwordEnv); password != "" && !change {
+		return password, nil
+	}
+	password, err := readPassphrase("New master password: ")
+	if err != nil {
+		return "", err
+	}
+	confirmation, err := readPassphrase("Repeat master password: ")
+	if err != nil {
+		return "", err
+	}
+	if password != confirmation {
+		return "", fmt.Errorf("passwords don't match")
+	}
+	return password, nil
+}
+
+// masterPassword returns the master password from the environment, or prompts for it
+func masterPassword(prompt string) (string, error) {
+	if password := os.Getenv(passwordEnv); password != "" {
+		return password, nil
+	}
+	return readPassphrase(prompt)
+}
@@ -0,0 +1,198 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"Lockr/bin/content"
+	"Lockr/bin/templates"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// entryForm is the state of `add` and of editing a structured entry, which prompt
+// for the fields of a template one at a time
+type entryForm struct {
+	template templates.Template
+	key      string
+	values   map[string]string // entered so far, or the entry's current ones when editing
+	field    int               // index of the field being entered
+	editing  bool
+}
+
+// startAdd starts the form for a new entry of a template, stored under <template>/<name>
+func (m *model) startAdd(templateName, name string) {
+	template, ok := m.settings.templates[templateName]
+	if !ok {
+		m.errorMessage = fmt.Sprintf("Error: Unknown template %q (templates: %s)", templateName,
+			strings.Join(templates.Names(m.settings.templates), ", "))
+		return
+	}
+	key := template.Key(name)
+	existing, err := m.store.Get(key)
+	if err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
+	if existing != "" {
+		m.errorMessage = fmt.Sprintf("Error: %s already exists", key)
+		return
+	}
+	m.adding = &entryForm{template: template, key: key, values: make(map[string]string)}
+	m.promptField()
+}
+
+// startFieldEdit starts the form on the fields of a structured entry, each
+// prefilled with its current value
+func (m *model) startFieldEdit(key string, entry templates.Entry) {
+	form := &entryForm{template: templates.Template{Name: entry.Template}, key: key, values: make(map[string]string), editing: true}
+	for _, f := range entry.Fields {
+		form.template.Fields = append(form.template.Fields, templates.Field{Name: f.Name, Label: f.Title(), Secret: f.Secret})
+		form.values[f.Name] = f.Value
+	}
+	m.adding = form
+	m.focusInput()
+	m.promptField()
+}
+
+// promptField asks for the form's current field
+func (m *model) promptField() {
+	form := m.adding
+	field := form.template.Fields[form.field]
+	m.input.EchoMode = textinput.EchoNormal
+	if field.Secret {
+		m.input.EchoMode = textinput.EchoPassword
+	}
+	m.setInput(form.values[field.Name])
+	m.statusMessage = fmt.Sprintf("%s, field %d of %d: %s. Enter goes to the next field, Esc cancels",
+		form.key, form.field+1, len(form.template.Fields), field.Label)
+}
+
+// updateForm handles Enter, which takes the value of the current field and stores
+// the entry after the last one, and Esc, which drops the entry
+func (m *model) updateForm(msg tea.KeyMsg) {
+	form := m.adding
+	m.errorMessage = ""
+	if msg.Type == tea.KeyEsc {
+		m.endForm()
+		m.statusMessage = fmt.Sprintf("Cancelled %s", form.key)
+		return
+	}
+	form.values[form.template.Fields[form.field].Name] = m.input.Value()
+	if form.field++; form.field < len(form.template.Fields) {
+		m.promptField()
+		return
+	}
+
+	m.endForm()
+	value, err := form.template.NewEntry(form.values).Encode()
+	if err == nil {
+		err = m.store.Set(form.key, value)
+	}
+	if err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
+	if form.editing {
+		m.recordUndo("edit "+form.key, form.key)
+	} else {
+		m.recordUndo("add "+form.key, form.key)
+	}
+	if form.editing {
+		for i := range m.rowItems {
+			if m.rowItems[i].key == form.key {
+				m.rowItems[i].value = value
+			}
+		}
+		m.setRows(m.rowItems)
+		m.statusMessage = fmt.Sprintf("Saved %s", form.key)
+		return
+	}
+	m.statusMessage = fmt.Sprintf("Stored %s", form.key)
+}
+
+// endForm leaves the form, returning to the table after editing
+func (m *model) endForm() {
+	editing := m.adding.editing
+	m.adding = nil
+	m.input.EchoMode = textinput.EchoNormal
+	m.input.SetValue("")
+	if editing && m.showTable {
+		m.focusTable()
+	}
+}
+
+// detailEntry returns the structured entry shown in the detail pane, if it is one
+func (m *model) detailEntry() (templates.Entry, []templates.FieldValue, bool) {
+	entry, ok := templates.Decode(m.detailValue())
+	if !ok {
+		return entry, nil, false
+	}
+	var fields []templates.FieldValue
+	for _, f := range entry.Fields {
+		if f.Value != "" {
+			fields = append(fields, f)
+		}
+	}
+	return entry, fields, true
+}
+
+// hasSecretFields reports whether an entry is structured with secret fields to reveal
+func (m *model) hasSecretFields(entry item) bool {
+	value, _ := content.Unwrap(entry.value)
+	structured, ok := templates.Decode(value)
+	if !ok || m.settings.mask == maskNone {
+		return false
+	}
+	for _, f := range structured.Fields {
+		if f.Secret && f.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldMasked reports whether a field of the structured entry in the detail pane is hidden
+func (m *model) fieldMasked(f templates.FieldValue) bool {
+	if m.detail.key == m.revealed || m.settings.mask == maskNone {
+		return false
+	}
+	return f.Secret || m.masked(*m.detail)
+}
+
+// fieldsView renders the filled-in fields of a structured entry one per line,
+// marking the selected one
+func (m *model) fieldsView(entry templates.Entry, fields []templates.FieldValue) string {
+	width := 0
+	for _, f := range fields {
+		width = max(width, len(f.Title()))
+	}
+	lines := []string{fmt.Sprintf("[%s]", entry.Template)}
+	for i, f := range fields {
+		marker := "  "
+		if i == m.detailField {
+			marker = "> "
+		}
+		value := f.Value
+		if m.fieldMasked(f) {
+			value = maskedValue
+		}
+		value = strings.ReplaceAll(value, "\n", "\n"+strings.Repeat(" ", width+5))
+		lines = append(lines, fmt.Sprintf("%s%-*s  %s", marker, width+1, f.Title()+":", value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// copyField copies the selected field of the structured entry in the detail pane
+func (m *model) copyField(fields []templates.FieldValue) tea.Cmd {
+	if !m.caps.clipboard {
+		m.errorMessage = "Copying is unavailable without a clipboard utility"
+		return nil
+	}
+	if m.detailField >= len(fields) {
+		return nil
+	}
+	f := fields[m.detailField]
+	return m.copyText(f.Value, fmt.Sprintf("Copied the %s of %s to the clipboard", f.Title(), m.detail.key), true)
+}
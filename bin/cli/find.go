@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"Lockr/bin/content"
+)
+
+// finder is the state of the live find mode, which filters the table as the
+// pattern is typed
+type finder struct {
+	items   []item // every entry, loaded when find starts
+	values  bool   // also match the pattern as a substring of values
+	pattern string // pattern the table was last filtered by
+}
+
+// match is an item matched by the find pattern
+type match struct {
+	item
+	score int
+}
+
+// filter returns the items matching pattern, best matches first: keys matching
+// fuzzily, ranked by fuzzyScore, then with values on, those whose value contains it
+func (f *finder) filter(pattern string) []item {
+	var matches []match
+	lowered := strings.ToLower(pattern)
+	for _, it := range f.items {
+		if score, ok := fuzzyScore(pattern, it.key); ok {
+			matches = append(matches, match{item: it, score: score + 1})
+		} else if f.values && pattern != "" {
+			value, contentType := content.Unwrap(it.value)
+			if contentType != content.Binary && strings.Contains(strings.ToLower(value), lowered) {
+				matches = append(matches, match{item: it})
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+
+	items := make([]item, len(matches))
+	for i, m := range matches {
+		items[i] = m.item
+	}
+	return items
+}
+
+// prompt returns the status line shown while finding
+func (f *finder) prompt(found int) string {
+	toggle := "Ctrl+F: search values"
+	if f.values {
+		toggle = "Ctrl+F: keys only"
+	}
+	return fmt.Sprintf("Found %d of %d (%s, Enter: keep, Esc: leave)", found, len(f.items), toggle)
+}
+
+// fuzzyScore reports whether the characters of pattern appear in s in order,
+// ignoring case, and scores the match: each character counts, more so when it
+// follows the previous one or starts a segment of the key, e.g. after a slash
+func fuzzyScore(pattern, s string) (int, bool) {
+	p := []rune(strings.ToLower(pattern))
+	r := []rune(strings.ToLower(s))
+	score, j, prev := 0, 0, -2
+	for i := 0; i < len(r) && j < len(p); i++ {
+		if r[i] != p[j] {
+			continue
+		}
+		score++
+		if i == prev+1 {
+			score += 3
+		}
+		if i == 0 || strings.ContainsRune("/.-_ :", r[i-1]) {
+			score += 2
+		}
+		prev = i
+		j++
+	}
+	if j < len(p) {
+		return 0, false
+	}
+	return score, true
+}
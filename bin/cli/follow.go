@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"Lockr/bin/client"
+	"Lockr/bin/cluster"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/replica"
+)
+
+// runFollow keeps the data directory a read-only copy of the leader at a URL,
+// pulling its writes every interval until interrupted, or with --promote makes a
+// follower writable again to take over from its leader
+func runFollow(lsm *lsmtree.LSMTree, args []string) error {
+	flags := flag.NewFlagSet("follow", flag.ContinueOnError)
+	interval := flags.Duration("interval", time.Second, "how often to pull the leader's writes")
+	caFile := flags.String("ca", "", "trust this PEM certificate for an https leader, e.g. its self-signed one")
+	promote := flags.Bool("promote", false, "stop following the leader and make the store writable")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Flags may also follow the URL, as in follow https://leader:8700 --interval 5s
+	url := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[min(1, flags.NArg()):]); err != nil {
+		return err
+	}
+	if node, err := cluster.Member(lsm); err != nil || node != "" {
+		if err == nil {
+			err = fmt.Errorf("this store is node %s of a cluster; detach it first with `lockr cluster detach`", node)
+		}
+		return err
+	}
+	if *promote {
+		if url != "" || flags.NArg() != 0 {
+			return fmt.Errorf("usage: lockr follow --promote")
+		}
+		leader, err := replica.Leader(lsm)
+		if err != nil {
+			return err
+		}
+		if leader == "" {
+			return fmt.Errorf("this store doesn't follow a leader")
+		}
+		if err := replica.Promote(lsm); err != nil {
+			return err
+		}
+		fmt.Printf("Stopped following %s, the store is writable\n", leader)
+		return nil
+	}
+	if url == "" || flags.NArg() != 0 || *interval <= 0 {
+		return fmt.Errorf("usage: lockr follow <leader-url> [--interval 1s] [--ca file]")
+	}
+
+	httpClient, err := remoteHTTPClient(*caFile)
+	if err != nil {
+		return err
+	}
+	c := client.NewWithHTTPClient(url, httpClient)
+	c.SetToken(os.Getenv(tokenEnv))
+	defer c.Close()
+	follower, err := replica.Follow(lsm, url, c)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Following %s (Ctrl+C to stop)\n", url)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		result, err := follower.Sync(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Failed to sync, retrying: %v\n", err)
+		case result.Restored:
+			fmt.Printf("Copied a snapshot of %d keys and %d later writes, at %d\n", result.Keys, result.Changes, result.Seq)
+		case result.Changes > 0:
+			fmt.Printf("Applied %d writes, at %d\n", result.Changes, result.Seq)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
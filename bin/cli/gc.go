@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"Lockr/bin/lsmtree"
+)
+
+// reclaimer is a store that can free the space of its deleted entries, like the
+// vault or a client of the API
+type reclaimer interface {
+	Reclaim() (lsmtree.ReclaimResult, error)
+}
+
+// runGC rewrites the store's SSTables to free the space of deleted and
+// overwritten entries
+func runGC(store lsmtree.Store, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	output := outputFlag(flags, outputTable)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: lockr gc [--output table|plain|json]")
+	}
+	format, err := parseOutput(*output)
+	if err != nil {
+		return err
+	}
+	source, ok := store.(reclaimer)
+	if !ok {
+		return fmt.Errorf("this store can't reclaim space")
+	}
+	result, err := source.Reclaim()
+	if errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("this store can't reclaim space")
+	} else if err != nil {
+		return fmt.Errorf("failed to reclaim space: %w", err)
+	}
+
+	switch format {
+	case outputJSON:
+		return printJSON(result)
+	case outputPlain:
+		fmt.Printf("reclaimed_bytes %d\n", result.Reclaimed())
+		fmt.Printf("dropped_entries %d\n", result.EntriesBefore-result.EntriesAfter)
+		fmt.Printf("sstables %d\n", result.TablesAfter)
+		return nil
+	}
+	fmt.Printf("Reclaimed %s: rewrote %d SSTables (%s) into %d (%s), dropping %d of %d entries in %s\n",
+		formatBytes(result.Reclaimed()), result.TablesBefore, formatBytes(result.BytesBefore),
+		result.TablesAfter, formatBytes(result.BytesAfter), result.EntriesBefore-result.EntriesAfter,
+		result.EntriesBefore, result.Duration.Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"strings"
+
+	"Lockr/bin/content"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	jsonKeyStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("#8A2BE2")).Bold(true)
+	jsonStringStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("#2E8B57"))
+	jsonLiteralStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#D2691E"))
+	pemBoundaryStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#708090"))
+	hexOffsetStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("#708090"))
+)
+
+// renderValue formats a value for display by its content type and highlights the
+// result. Colors are left out when the output isn't a terminal.
+func renderValue(value, contentType string) string {
+	rendered := content.Render(value, contentType)
+	switch contentType {
+	case content.JSON:
+		return highlightJSON(rendered)
+	case content.PEM:
+		return highlightLines(rendered, func(line string) bool { return strings.HasPrefix(line, "-----") }, pemBoundaryStyle)
+	case content.Binary:
+		// hex.Dump lines start with an 8-digit offset
+		lines := strings.Split(rendered, "\n")
+		for i, line := range lines {
+			if len(line) > 8 {
+				lines[i] = hexOffsetStyle.Render(line[:8]) + line[8:]
+			}
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return rendered
+	}
+}
+
+// highlightLines styles the lines that match
+func highlightLines(text string, match func(line string) bool, style lipgloss.Style) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if match(line) {
+			lines[i] = style.Render(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// highlightJSON colors the object keys, strings and literals of a JSON document
+func highlightJSON(doc string) string {
+	var b strings.Builder
+	for i := 0; i < len(doc); {
+		c := doc[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for end < len(doc) && doc[end] != '"' {
+				if doc[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(doc))
+			// A string followed by a colon is an object key
+			style := jsonStringStyle
+			if strings.HasPrefix(strings.TrimLeft(doc[end:], " \t\r\n"), ":") {
+				style = jsonKeyStyle
+			}
+			b.WriteString(style.Render(doc[i:end]))
+			i = end
+		case c == '-' || (c >= '0' && c <= '9') || c == 't' || c == 'f' || c == 'n':
+			end := i + 1
+			for end < len(doc) && strings.IndexByte(",]} \t\r\n", doc[end]) < 0 {
+				end++
+			}
+			b.WriteString(jsonLiteralStyle.Render(doc[i:end]))
+			i = end
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// historyFileName is the file in the data directory holding the UI's command history
+const historyFileName = "history"
+
+// maxHistory is the number of commands kept in the history
+const maxHistory = 1000
+
+// redacted replaces secret values in recorded commands. It's the value that makes
+// set prompt for one, so rerunning a recorded set asks for the value again.
+const redacted = "-"
+
+// history is the command history of the UI, persisted one command per line with
+// secret values redacted
+type history struct {
+	path     string
+	commands []string // oldest first
+	pos      int      // command shown by Up/Down, len(commands) for the line being typed
+	draft    string   // line being typed before Up was pressed
+}
+
+// loadHistory reads the history of the data directory, trimming it to maxHistory
+func loadHistory(dataDir string) (*history, error) {
+	h := &history{path: filepath.Join(dataDir, historyFileName)}
+	data, err := os.ReadFile(h.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			h.commands = append(h.commands, line)
+		}
+	}
+	if len(h.commands) > maxHistory {
+		h.commands = h.commands[len(h.commands)-maxHistory:]
+		if err := h.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+	h.pos = len(h.commands)
+	return h, nil
+}
+
+// add records a command, redacted, and resets navigation to the line being typed
+func (h *history) add(command string) error {
+	h.pos, h.draft = len(h.commands), ""
+	command, ok := redactCommand(command)
+	if !ok || (len(h.commands) > 0 && h.commands[len(h.commands)-1] == command) {
+		return nil
+	}
+	h.commands = append(h.commands, command)
+	if len(h.commands) > maxHistory {
+		h.commands = h.commands[1:]
+	}
+	h.pos = len(h.commands)
+
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open history: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(command + "\n"); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return nil
+}
+
+// rewrite replaces the history file with the commands in memory
+func (h *history) rewrite() error {
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(h.commands, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		return fmt.Errorf("failed to replace history: %w", err)
+	}
+	return nil
+}
+
+// previous returns the command before the one shown, remembering line as the
+// draft when leaving it. It reports false at the oldest command.
+func (h *history) previous(line string) (string, bool) {
+	if h.pos == 0 {
+		return "", false
+	}
+	if h.pos == len(h.commands) {
+		h.draft = line
+	}
+	h.pos--
+	return h.commands[h.pos], true
+}
+
+// next returns the command after the one shown, or the draft after the newest.
+// It reports false when the draft is already shown.
+func (h *history) next() (string, bool) {
+	if h.pos >= len(h.commands) {
+		return "", false
+	}
+	h.pos++
+	if h.pos == len(h.commands) {
+		return h.draft, true
+	}
+	return h.commands[h.pos], true
+}
+
+// search returns the newest command older than before containing query and its
+// position, or -1 if none does
+func (h *history) search(query string, before int) (string, int) {
+	for i := min(before, len(h.commands)) - 1; i >= 0; i-- {
+		if strings.Contains(h.commands[i], query) {
+			return h.commands[i], i
+		}
+	}
+	return "", -1
+}
+
+// redactCommand returns a command as recorded in the history, with the value of
+// set replaced. It reports false for commands that can't be recorded safely.
+func redactCommand(command string) (string, bool) {
+	words, err := splitCommand(command)
+	if err != nil {
+		// An unterminated quote may hide a value anywhere in the line
+		return "", false
+	}
+	if len(words) == 0 {
+		return "", false
+	}
+	if words[0] == "set" && len(words) >= 3 {
+		words[len(words)-1] = redacted
+	}
+	for i, word := range words {
+		words[i] = quoteWord(word)
+	}
+	return strings.Join(words, " "), true
+}
+
+// quoteWord quotes a word so splitCommand reads it back unchanged
+func quoteWord(word string) string {
+	if word != "" && !strings.ContainsAny(word, " \t\n'\"\\") {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
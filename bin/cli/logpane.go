@@ -0,0 +1,164 @@
+package cli
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Engine log entries: how many are kept while the UI runs and how many the pane shows
+const (
+	logEntries = 500
+	logLines   = 10
+)
+
+// logEntry is an engine event captured while the UI runs
+type logEntry struct {
+	seq   uint64
+	time  time.Time
+	level slog.Level
+	text  string // the message followed by its attributes as key=value
+}
+
+// logBuffer is an lsmtree.Logger keeping the latest engine events for the UI's
+// log pane, since writing them to the terminal would garble the screen
+type logBuffer struct {
+	level   slog.Level
+	mutex   sync.Mutex
+	entries []logEntry    // oldest first
+	seq     uint64        // of the latest entry
+	notify  chan struct{} // signalled when an entry is added
+}
+
+// logMsg tells the UI that entries were added to its log buffer
+type logMsg struct{}
+
+// newLogBuffer returns a buffer keeping the events at or above level
+func newLogBuffer(level slog.Level) *logBuffer {
+	return &logBuffer{level: level, notify: make(chan struct{}, 1)}
+}
+
+func (b *logBuffer) Debug(msg string, args ...any) { b.add(slog.LevelDebug, msg, args) }
+func (b *logBuffer) Info(msg string, args ...any)  { b.add(slog.LevelInfo, msg, args) }
+func (b *logBuffer) Warn(msg string, args ...any)  { b.add(slog.LevelWarn, msg, args) }
+func (b *logBuffer) Error(msg string, args ...any) { b.add(slog.LevelError, msg, args) }
+
+// add keeps an entry, dropping the oldest past logEntries
+func (b *logBuffer) add(level slog.Level, msg string, args []any) {
+	if level < b.level {
+		return
+	}
+	b.mutex.Lock()
+	b.seq++
+	b.entries = append(b.entries, logEntry{seq: b.seq, time: time.Now(), level: level, text: msg + formatLogArgs(args)})
+	if len(b.entries) > logEntries {
+		b.entries = b.entries[len(b.entries)-logEntries:]
+	}
+	b.mutex.Unlock()
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// since returns the entries after seq, oldest first
+func (b *logBuffer) since(seq uint64) []logEntry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, entry := range b.entries {
+		if entry.seq > seq {
+			return append([]logEntry(nil), b.entries[i:]...)
+		}
+	}
+	return nil
+}
+
+// latest returns the last n entries, oldest first
+func (b *logBuffer) latest(n int) []logEntry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]logEntry(nil), b.entries[max(0, len(b.entries)-n):]...)
+}
+
+// formatLogArgs formats alternating keys and values as key=value pairs, quoting
+// values with spaces
+func formatLogArgs(args []any) string {
+	var b strings.Builder
+	for i := 0; i < len(args); i += 2 {
+		key, value := fmt.Sprint(args[i]), "!MISSING"
+		if i+1 < len(args) {
+			value = fmt.Sprint(args[i+1])
+		}
+		if value == "" || strings.ContainsAny(value, " =\"") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, value)
+	}
+	return b.String()
+}
+
+// parseLogLevel parses the value of -log-level, or returns byDefault for ""
+func parseLogLevel(name string, byDefault slog.Level) (slog.Level, error) {
+	if name == "" {
+		return byDefault, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("invalid -log-level %q, expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// waitLog waits for entries to be added to the log buffer
+func (m *model) waitLog() tea.Cmd {
+	logs := m.settings.logs
+	if logs == nil {
+		return nil
+	}
+	return func() tea.Msg {
+		<-logs.notify
+		return logMsg{}
+	}
+}
+
+// logged shows the warnings and errors logged while the pane is hidden, and
+// waits for the next entries
+func (m *model) logged() tea.Cmd {
+	entries := m.settings.logs.since(m.logSeen)
+	if len(entries) == 0 {
+		return m.waitLog()
+	}
+	m.logSeen = entries[len(entries)-1].seq
+	if !m.showLogs {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].level >= slog.LevelWarn {
+				m.errorMessage = fmt.Sprintf("Engine %s: %s (logs shows the engine log)", strings.ToLower(entries[i].level.String()), entries[i].text)
+				break
+			}
+		}
+	}
+	return m.waitLog()
+}
+
+// logView renders the log pane
+func (m *model) logView() string {
+	entries := m.settings.logs.latest(logLines)
+	lines := []string{statusMessageStyle.Render("Engine log, logs hides it:")}
+	if len(entries) == 0 {
+		lines = append(lines, statusMessageStyle.Render("Nothing logged yet"))
+	}
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s %-5s %s", entry.time.Format("15:04:05"), entry.level, entry.text)
+		if entry.level >= slog.LevelWarn {
+			lines = append(lines, errorMessageStyle.Render(line))
+		} else {
+			lines = append(lines, statusMessageStyle.Render(line))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// outputFormat is how a non-interactive command prints its results
+type outputFormat string
+
+const (
+	// outputTable prints aligned columns with a header, for people
+	outputTable outputFormat = "table"
+	// outputPlain prints bare values, one per line, for pipes
+	outputPlain outputFormat = "plain"
+	// outputJSON prints a JSON document with every field, for scripts
+	outputJSON outputFormat = "json"
+)
+
+// outputFlag adds the --output flag to a command's flags
+func outputFlag(flags *flag.FlagSet, byDefault outputFormat) *string {
+	return flags.String("output", string(byDefault), "output format: table, plain or json")
+}
+
+// parseOutput parses the value of an --output flag
+func parseOutput(name string) (outputFormat, error) {
+	switch format := outputFormat(name); format {
+	case outputTable, outputPlain, outputJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown output format %q, expected table, plain or json", name)
+	}
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// printTable prints rows in aligned columns under an upper-case header
+func printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(header, "\t")))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,227 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"Lockr/bin/content"
+	"Lockr/bin/keyindex"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/vault"
+)
+
+// listPageSize is the number of entries loaded into the table at a time
+const listPageSize = 50
+
+// listPager loads the entries of a listing a page at a time as the table is
+// paged through. With a key index the matching keys are known up front and only
+// the values of the pages shown are read; otherwise a scan is read as far as
+// the pages shown need.
+type listPager struct {
+	store lsmtree.Store
+	query listQuery
+	keys  []string         // matching keys from the key index, nil when reading a scan
+	it    lsmtree.Iterator // scan being read, nil once exhausted or with a key index
+	pages [][]item         // pages loaded so far
+	page  int              // page shown
+}
+
+// listQuery selects the entries of a listing: those whose key contains filter,
+// with tag if it's set and filed under folder if it's set
+type listQuery struct {
+	filter, tag, folder string
+}
+
+// matches reports whether an entry is selected, reading its tags and folder from
+// its stored value
+func (q listQuery) matches(key, stored string) bool {
+	if !strings.Contains(key, q.filter) {
+		return false
+	}
+	if q.tag != "" && !slices.Contains(content.Tags(stored), q.tag) {
+		return false
+	}
+	return q.folder == "" || content.InFolder(content.Folder(stored), q.folder)
+}
+
+// indexed returns the selected keys from the key index in order
+func (q listQuery) indexed(idx *keyindex.Index) []string {
+	keys := idx.Filter(q.filter)
+	if q.tag != "" {
+		keys = intersect(keys, idx.Tagged(q.tag))
+	}
+	if q.folder != "" {
+		keys = intersect(keys, idx.InFolder(q.folder))
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	return keys
+}
+
+// intersect returns the keys in both sorted lists
+func intersect(a, b []string) []string {
+	var both []string
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			a = a[1:]
+		case a[0] > b[0]:
+			b = b[1:]
+		default:
+			both = append(both, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	return both
+}
+
+// newListPager starts a listing of the entries selected by query and loads its
+// first page
+func newListPager(store lsmtree.Store, idx *keyindex.Index, query listQuery) (*listPager, error) {
+	p := &listPager{store: store, query: query}
+	if idx != nil {
+		p.keys = query.indexed(idx)
+	} else {
+		it, err := store.Scan("", "")
+		if err != nil {
+			return nil, err
+		}
+		p.it = it
+	}
+	if _, err := p.load(0); err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// load loads the pages up to page n, reporting false if the listing has no page n
+func (p *listPager) load(n int) (bool, error) {
+	for len(p.pages) <= n {
+		var page []item
+		var err error
+		if p.keys != nil {
+			page, err = p.readKeys(len(p.pages))
+		} else {
+			page, err = p.readScan()
+		}
+		if err != nil {
+			return false, err
+		}
+		// The first page exists even when empty, so an empty listing shows a table
+		if len(page) == 0 && len(p.pages) > 0 {
+			return false, nil
+		}
+		p.pages = append(p.pages, page)
+	}
+	return true, nil
+}
+
+// readKeys reads the values of the i-th page of indexed keys
+func (p *listPager) readKeys(i int) ([]item, error) {
+	start := i * listPageSize
+	if start >= len(p.keys) {
+		return nil, nil
+	}
+	var page []item
+	for _, key := range p.keys[start:min(start+listPageSize, len(p.keys))] {
+		value, err := p.store.Get(key)
+		if errors.Is(err, vault.ErrLocked) {
+			continue // Like scans, listings hide keys of locked contexts
+		}
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			page = append(page, item{key: key, value: value})
+		}
+	}
+	return page, nil
+}
+
+// readScan reads the next page of matching entries from the scan
+func (p *listPager) readScan() ([]item, error) {
+	var page []item
+	for p.it != nil && len(page) < listPageSize {
+		if !p.it.Next() {
+			err := p.it.Err()
+			p.close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan store: %w", err)
+			}
+			break
+		}
+		if p.query.matches(p.it.Key(), p.it.Value()) {
+			page = append(page, item{key: p.it.Key(), value: p.it.Value()})
+		}
+	}
+	return page, nil
+}
+
+// goTo shows page n if it exists, reporting whether it does
+func (p *listPager) goTo(n int) (bool, error) {
+	if n < 0 {
+		return false, nil
+	}
+	ok, err := p.load(n)
+	if ok {
+		p.page = n
+	}
+	return ok, err
+}
+
+// last shows the last page, reading the rest of a scan
+func (p *listPager) last() error {
+	for {
+		ok, err := p.goTo(p.page + 1)
+		if err != nil || !ok {
+			return err
+		}
+	}
+}
+
+// items returns the entries of the page shown
+func (p *listPager) items() []item {
+	return p.pages[p.page]
+}
+
+// total returns the number of pages, and false while a scan hasn't been read to
+// its end so there may be more
+func (p *listPager) total() (int, bool) {
+	if p.keys != nil {
+		return max(1, (len(p.keys)+listPageSize-1)/listPageSize), true
+	}
+	return len(p.pages), p.it == nil
+}
+
+// count returns the number of matching entries, and false when not all are known yet
+func (p *listPager) count() (int, bool) {
+	if p.keys != nil {
+		return len(p.keys), true
+	}
+	n := 0
+	for _, page := range p.pages {
+		n += len(page)
+	}
+	return n, p.it == nil
+}
+
+// position describes the page shown, e.g. "Page 2 of 7" or "Page 2 of 3+"
+func (p *listPager) position() string {
+	total, known := p.total()
+	if known {
+		return fmt.Sprintf("Page %d of %d", p.page+1, total)
+	}
+	return fmt.Sprintf("Page %d of %d+", p.page+1, total)
+}
+
+// close releases the scan being read, if any
+func (p *listPager) close() {
+	if p.it != nil {
+		p.it.Close()
+		p.it = nil
+	}
+}
@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"Lockr/bin/client"
+)
+
+// tokenEnv names the environment variable holding the API token sent to a -remote server
+const tokenEnv = "LOCKR_TOKEN"
+
+// runRemote runs the UI or a store subcommand against the HTTP API of a remote
+// server instead of the local data directory. Requests carry the token in
+// LOCKR_TOKEN, and an https server may be trusted by its certificate in caFile.
+func runRemote(dataDir, baseURL, caFile string, settings uiSettings, args []string) error {
+	httpClient, err := remoteHTTPClient(caFile)
+	if err != nil {
+		return err
+	}
+	c := client.NewWithHTTPClient(baseURL, httpClient)
+	c.SetToken(os.Getenv(tokenEnv))
+	return runClient(dataDir, c, baseURL, settings, args)
+}
+
+// remoteHTTPClient returns the HTTP client for a server, trusting the PEM
+// certificate in caFile if set, e.g. the server's self-signed one
+func remoteHTTPClient(caFile string) (*http.Client, error) {
+	if caFile == "" {
+		return http.DefaultClient, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return &http.Client{Transport: transport}, nil
+}
+
+// runClient runs the UI or a store subcommand through a client of the HTTP API
+// of via, a remote server or the agent
+func runClient(dataDir string, c *client.Client, via string, settings uiSettings, args []string) error {
+	defer c.Close()
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "new":
+			return runNew(dataDir, c, args[1:])
+		case "get":
+			return runGet(c, args[1:])
+		case "share":
+			return runShare(c, args[1:])
+		case "receive":
+			return runReceive(c, args[1:])
+		case "token":
+			return runToken(remoteTokens{c}, args[1:])
+		case "stats":
+			return runStats(c, args[1:])
+		case "gc":
+			return runGC(c, args[1:])
+		default:
+			return fmt.Errorf("command %q isn't available through %s", args[0], via)
+		}
+	}
+	hist, err := loadHistory(dataDir)
+	if err != nil {
+		return err
+	}
+	return runUI(c, nil, nil, nil, hist, settings, fmt.Sprintf("Connected to %s", via))
+}
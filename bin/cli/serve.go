@@ -0,0 +1,204 @@
+package cli
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"Lockr/bin/audit"
+	"Lockr/bin/devicesync"
+	"Lockr/bin/grpcserver"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/memcache"
+	"Lockr/bin/server"
+)
+
+// runServe serves the store over the HTTP API until interrupted. The server holds
+// the data directory lock, so other programs reach the store through it. Requests
+// need one of the tokens kept in the tree unless auth is turned off.
+func runServe(dataDir string, lsm *lsmtree.LSMTree, store *audit.Store, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	serve := addServeFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: lockr serve [--listen addr] [--tls-cert file --tls-key file | --tls-self-signed] [--no-auth] [--docs] [--memcached addr] [--grpc addr] [--request-timeout d]")
+	}
+	config, err := serve.tlsConfig(dataDir)
+	if err != nil {
+		return err
+	}
+
+	srv, err := serve.server(lsm, store)
+	if err != nil {
+		return err
+	}
+	srv.EnableReplication(lsm)
+	syncer, err := devicesync.Open(lsm)
+	if err != nil {
+		return err
+	}
+	srv.EnableSync(syncer)
+	stop, err := serve.start(srv, store, config)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	return nil
+}
+
+// serveFlags are the flags of the HTTP API server, shared by serve and cluster
+type serveFlags struct {
+	listen          *string
+	docs            *bool
+	certFile        *string
+	keyFile         *string
+	selfSigned      *bool
+	noAuth          *bool
+	memcached       *string
+	memcachedPrefix *string
+	grpc            *string
+	requestTimeout  *time.Duration
+}
+
+// addServeFlags defines the flags of the HTTP API server
+func addServeFlags(flags *flag.FlagSet) *serveFlags {
+	return &serveFlags{
+		listen:          flags.String("listen", "127.0.0.1:8700", "address for the HTTP server, e.g. :8700 for every interface"),
+		docs:            flags.Bool("docs", false, "serve a Swagger UI for the HTTP API at /v1/docs"),
+		certFile:        flags.String("tls-cert", "", "serve HTTPS with this PEM certificate, with --tls-key"),
+		keyFile:         flags.String("tls-key", "", "PEM private key of --tls-cert"),
+		selfSigned:      flags.Bool("tls-self-signed", false, "serve HTTPS with a self-signed certificate kept in the data directory"),
+		noAuth:          flags.Bool("no-auth", false, "serve requests without a token"),
+		memcached:       flags.String("memcached", "", "also serve the memcached text protocol on this address, e.g. 127.0.0.1:11211"),
+		memcachedPrefix: flags.String("memcached-prefix", "memcache/", "key prefix of the items stored over memcached"),
+		grpc:            flags.String("grpc", "", "also serve the gRPC API on this address, e.g. 127.0.0.1:8701"),
+		requestTimeout:  flags.Duration("request-timeout", 30*time.Second, "fail key requests with 503 after waiting this long for the store, 0 to wait as long as the client does"),
+	}
+}
+
+// tlsConfig returns the TLS configuration the flags ask for, nil for plain HTTP
+func (f *serveFlags) tlsConfig(dataDir string) (*tls.Config, error) {
+	if (*f.certFile == "") != (*f.keyFile == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key go together")
+	}
+	if *f.certFile != "" && *f.selfSigned {
+		return nil, fmt.Errorf("--tls-self-signed can't be used with --tls-cert")
+	}
+	switch {
+	case *f.certFile != "":
+		cert, err := tls.LoadX509KeyPair(*f.certFile, *f.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+	case *f.selfSigned:
+		cert, path, err := server.SelfSignedCert(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Self-signed certificate %s, SHA-256 fingerprint %s\n", path, server.Fingerprint(cert))
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+	}
+	return nil, nil
+}
+
+// server returns the HTTP API server of store, requiring the tokens kept in the
+// tree unless auth is turned off
+func (f *serveFlags) server(lsm *lsmtree.LSMTree, store lsmtree.Store) (*server.Server, error) {
+	srv := server.New(store)
+	srv.SetRequestTimeout(*f.requestTimeout)
+	if *f.docs {
+		srv.EnableDocs()
+	}
+	if !*f.noAuth {
+		tokens, err := server.LoadTokens(lsm)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens.List()) == 0 {
+			return nil, fmt.Errorf("no API tokens: add one with `lockr token add <name> --scope read|write|admin`, or serve with --no-auth")
+		}
+		srv.RequireTokens(tokens)
+	}
+	return srv, nil
+}
+
+// start starts serving the HTTP API, and memcached and gRPC if asked, returning
+// a function that stops them
+func (f *serveFlags) start(srv *server.Server, store lsmtree.Store, config *tls.Config) (func(), error) {
+	listener, err := srv.ListenTLS(*f.listen, config)
+	if err != nil {
+		return nil, err
+	}
+	listeners := []net.Listener{listener}
+	stop := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+
+	scheme := "http"
+	if config != nil {
+		scheme = "https"
+	} else if !isLoopback(listener.Addr()) {
+		fmt.Fprintln(os.Stderr, "warning: serving plain HTTP beyond this machine; tokens and values travel unencrypted, use --tls-cert or --tls-self-signed")
+	}
+	if *f.noAuth && !isLoopback(listener.Addr()) {
+		fmt.Fprintln(os.Stderr, "warning: serving without tokens beyond this machine; anyone who can reach it can read and write the store")
+	}
+	fmt.Printf("HTTP API listening on %s://%s (Ctrl+C to stop)\n", scheme, listener.Addr())
+
+	if *f.grpc != "" {
+		// gRPC takes the same TLS configuration and tokens as the HTTP API
+		rpc := grpcserver.New(store)
+		rpc.SetRequestTimeout(*f.requestTimeout)
+		rpc.SetLogger(srv.Logger())
+		if tokens := srv.Tokens(); tokens != nil {
+			rpc.RequireTokens(tokens)
+		}
+		listener, err := rpc.ListenTLS(*f.grpc, config)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+		fmt.Printf("gRPC API listening on %s\n", listener.Addr())
+	}
+
+	if *f.memcached == "" {
+		return stop, nil
+	}
+	// The memcached protocol has neither encryption nor authentication
+	if *f.memcachedPrefix == "" {
+		stop()
+		return nil, fmt.Errorf("--memcached-prefix can't be empty, or memcached clients would reach every key")
+	}
+	memcached := memcache.New(store, *f.memcachedPrefix)
+	memcached.SetLogger(srv.Logger())
+	mc, err := memcached.Listen(*f.memcached)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	listeners = append(listeners, mc)
+	if !isLoopback(mc.Addr()) {
+		fmt.Fprintln(os.Stderr, "warning: serving memcached beyond this machine; anyone who can reach it can read and write the keys under", *f.memcachedPrefix)
+	}
+	fmt.Printf("memcached listening on %s, keeping items under %s\n", mc.Addr(), *f.memcachedPrefix)
+	return stop, nil
+}
+
+// isLoopback reports whether a listener only accepts connections from this machine
+func isLoopback(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && tcp.IP.IsLoopback()
+}
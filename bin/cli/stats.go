@@ -0,0 +1,250 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"Lockr/bin/audit"
+	"Lockr/bin/lsmtree"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// statsTables is how many of the newest SSTables the dashboard lists
+const statsTables = 10
+
+// statsSource is a store reporting the statistics of its engine, like the vault
+// or a client of the API
+type statsSource interface {
+	Stats() (lsmtree.Stats, error)
+}
+
+// panelStyle frames a panel of the stats dashboard
+var panelStyle = lipgloss.NewStyle().
+	BorderStyle(lipgloss.RoundedBorder()).
+	BorderForeground(lipgloss.Color("#8A2BE2")).
+	Padding(0, 1)
+
+// panelTitleStyle is the style of the title of a panel
+var panelTitleStyle = lipgloss.NewStyle().
+	Foreground(lipgloss.Color("#8A2BE2")).
+	Bold(true)
+
+// runStats prints the statistics of the store's engine
+func runStats(store lsmtree.Store, args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	output := outputFlag(flags, outputTable)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: lockr stats [--output table|plain|json]\n" +
+			"       lockr stats history [--output table|plain|json] | export|import <file>")
+	}
+	format, err := parseOutput(*output)
+	if err != nil {
+		return err
+	}
+	source, ok := store.(statsSource)
+	if !ok {
+		return fmt.Errorf("this store doesn't report statistics")
+	}
+	stats, err := source.Stats()
+	if err != nil {
+		return fmt.Errorf("failed to get statistics: %w", err)
+	}
+	switch format {
+	case outputJSON:
+		return printJSON(stats)
+	case outputPlain:
+		fmt.Printf("keys_estimate %d\n", stats.KeysEstimate)
+		fmt.Printf("disk_bytes %d\n", stats.Disk.Total)
+		fmt.Printf("sstables %d\n", len(stats.SSTables))
+		fmt.Printf("pending_compactions %d\n", stats.Compaction.Pending)
+		fmt.Printf("cache_hit_rate %.3f\n", stats.Cache.HitRate())
+		return nil
+	}
+	fmt.Println(statsDashboard(stats))
+	return nil
+}
+
+// runStatsHistory lists the stats snapshots recorded with -stats-history, or
+// exports or imports them, recording an import in the audit log
+func runStatsHistory(lsm *lsmtree.LSMTree, store *audit.Store, args []string) error {
+	switch args[0] {
+	case "export":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: lockr stats export <file>")
+		}
+		path := args[1]
+		if path == "-" {
+			_, err := lsm.ExportStatsHistory(os.Stdout)
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create export file: %w", err)
+		}
+		count, err := lsm.ExportStatsHistory(file)
+		if closeErr := file.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to write export file: %w", closeErr)
+		}
+		if err != nil {
+			os.Remove(path)
+			return err
+		}
+		fmt.Printf("Exported %d stats snapshots to %s\n", count, path)
+		return nil
+	case "import":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: lockr stats import <file>")
+		}
+		path := args[1]
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open import file: %w", err)
+		}
+		defer file.Close()
+		count, err := lsm.ImportStatsHistory(file)
+		if err != nil {
+			return err
+		}
+		if err := store.Record(audit.OpImport, "", fmt.Sprintf("%d stats snapshots from %s", count, path)); err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d stats snapshots from %s\n", count, path)
+		return nil
+	}
+
+	flags := flag.NewFlagSet("stats history", flag.ContinueOnError)
+	output := outputFlag(flags, outputTable)
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: lockr stats history [--output table|plain|json]")
+	}
+	format, err := parseOutput(*output)
+	if err != nil {
+		return err
+	}
+	snapshots, err := lsm.StatsHistory()
+	if err != nil {
+		return err
+	}
+	switch format {
+	case outputJSON:
+		return printJSON(snapshots)
+	case outputPlain:
+		for _, snapshot := range snapshots {
+			fmt.Printf("%s\tkeys_estimate %d\tdisk_bytes %d\tpending_compactions %d\tcache_hit_rate %.3f\n",
+				snapshot.Time.Local().Format(time.RFC3339), snapshot.Stats.KeysEstimate, snapshot.Stats.Disk.Total,
+				snapshot.Stats.Compaction.Pending, snapshot.Stats.Cache.HitRate())
+		}
+		return nil
+	}
+	if len(snapshots) == 0 {
+		fmt.Println("No stats snapshots; start lockr with e.g. -stats-history 15m=672 to record them")
+		return nil
+	}
+	rows := make([][]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		stats := snapshot.Stats
+		rows = append(rows, []string{snapshot.Time.Local().Format(time.RFC3339), strconv.Itoa(stats.KeysEstimate),
+			formatBytes(stats.Disk.Total), formatBytes(stats.Written.Total()), strconv.Itoa(stats.Compaction.Pending),
+			fmt.Sprintf("%.1f%%", 100*stats.Cache.HitRate())})
+	}
+	return printTable([]string{"time", "keys", "disk", "written", "pending compactions", "cache hits"}, rows)
+}
+
+// statsView renders the statistics of the store's engine
+func (m *model) statsView() (string, error) {
+	source, ok := m.store.(statsSource)
+	if !ok {
+		return "", fmt.Errorf("this store doesn't report statistics")
+	}
+	stats, err := source.Stats()
+	if err != nil {
+		return "", err
+	}
+	return statsDashboard(stats) + "\nRun stats again to refresh", nil
+}
+
+// statsDashboard lays the statistics out as panels, the overview above the SSTables
+func statsDashboard(stats lsmtree.Stats) string {
+	state := "running"
+	if stats.Paused {
+		state = "paused"
+	}
+	storage := panel("Storage",
+		fmt.Sprintf("keys       ~%d", stats.KeysEstimate),
+		"           (with versions)",
+		fmt.Sprintf("disk       %s", formatBytes(stats.Disk.Total)),
+		fmt.Sprintf("  sstables %s", formatBytes(stats.Disk.SSTables)),
+		fmt.Sprintf("  wal      %s", formatBytes(stats.Disk.WAL)),
+		fmt.Sprintf("background %s", state))
+	seek := ""
+	if stats.Compaction.SeekScheduled {
+		seek = ", 1 seek"
+	}
+	memTable := panel("MemTable",
+		fmt.Sprintf("entries    %d", stats.MemTable.Entries),
+		fmt.Sprintf("size       %s of %s", formatBytes(int64(stats.MemTable.Bytes)), formatBytes(int64(stats.MemTable.MaxBytes))),
+		fmt.Sprintf("unflushed  %d", stats.MemTable.Immutable),
+		fmt.Sprintf("compaction %d pending%s", stats.Compaction.Pending, seek))
+	caches := panel("Caches",
+		fmt.Sprintf("entries %d of %d, %.1f%% hits", stats.Cache.Entries, stats.Cache.MaxSize, 100*stats.Cache.HitRate()),
+		fmt.Sprintf("blocks  %s of %s, %.1f%% hits", formatBytes(stats.BlockCache.Bytes), formatBytes(stats.BlockCache.Capacity), 100*stats.BlockCache.HitRate()),
+		fmt.Sprintf("bloom   %.2f%% false positives", 100*stats.Bloom.FalsePositiveRate()),
+		fmt.Sprintf("files   %d open", stats.OpenFiles))
+	wal := panel("WAL",
+		fmt.Sprintf("segment  %d", stats.WAL.Segment),
+		fmt.Sprintf("sync     %s", stats.WAL.Policy),
+		fmt.Sprintf("unsynced %s", formatBytes(stats.WAL.UnsyncedBytes)))
+
+	// SSTables are listed newest first, the order reads look them up in
+	lines := []string{fmt.Sprintf("%-24s %8s %8s %9s  %s", "file", "entries", "deleted", "size", "keys")}
+	for i := len(stats.SSTables) - 1; i >= 0 && i >= len(stats.SSTables)-statsTables; i-- {
+		table := stats.SSTables[i]
+		keys := fmt.Sprintf("%s .. %s", truncate(table.Properties.SmallestKey, 20), truncate(table.Properties.LargestKey, 20))
+		if table.Properties.Entries == 0 {
+			keys = "-"
+		}
+		lines = append(lines, fmt.Sprintf("%-24s %8d %8d %9s  %s", truncate(filepath.Base(table.FilePath), 24),
+			table.Properties.Entries, table.Properties.Tombstones, formatBytes(table.Size), keys))
+	}
+	if older := len(stats.SSTables) - statsTables; older > 0 {
+		lines = append(lines, fmt.Sprintf("and %d older", older))
+	}
+	if len(stats.SSTables) == 0 {
+		lines = []string{"No SSTables yet, every write is in the MemTable"}
+	}
+	ssTables := panel(fmt.Sprintf("SSTables (%d, newest first)", len(stats.SSTables)), lines...)
+
+	overview := lipgloss.JoinHorizontal(lipgloss.Top, storage, memTable, caches, wal)
+	return lipgloss.JoinVertical(lipgloss.Left, overview, ssTables)
+}
+
+// panel renders lines in a frame under a title
+func panel(title string, lines ...string) string {
+	return panelStyle.Render(panelTitleStyle.Render(title) + "\n" + strings.Join(lines, "\n"))
+}
+
+// formatBytes formats a size with a binary unit, like 1.5 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
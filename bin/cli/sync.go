@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"Lockr/bin/client"
+	"Lockr/bin/cluster"
+	"Lockr/bin/devicesync"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/replica"
+)
+
+// syncPassphraseEnv names the environment variable holding the passphrase the
+// files of a sync folder are encrypted with
+const syncPassphraseEnv = "LOCKR_SYNC_PASSPHRASE"
+
+// syncTimeout bounds a sync with a server
+const syncTimeout = 5 * time.Minute
+
+// runSync syncs the store with another device's, served at a URL by `lockr serve`
+// or through a folder synced between the devices, printing what was exchanged
+func runSync(lsm *lsmtree.LSMTree, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	folder := flags.String("folder", "", "sync through this folder shared by the devices, e.g. one synced by Dropbox")
+	caFile := flags.String("ca", "", "trust this PEM certificate for an https server, e.g. its self-signed one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Flags may also follow the URL, as in sync https://desktop:8700 --ca desktop.pem
+	url := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[min(1, flags.NArg()):]); err != nil {
+		return err
+	}
+	if (url == "") == (*folder == "") || flags.NArg() != 0 {
+		return fmt.Errorf("usage: lockr sync <url> [--ca file] | --folder <dir>")
+	}
+	if leader, err := replica.Leader(lsm); err != nil || leader != "" {
+		if err == nil {
+			err = fmt.Errorf("this store follows %s, sync the leader instead", leader)
+		}
+		return err
+	}
+	if node, err := cluster.Member(lsm); err != nil || node != "" {
+		if err == nil {
+			err = fmt.Errorf("this store is node %s of a cluster; detach it first with `lockr cluster detach`", node)
+		}
+		return err
+	}
+	syncer, err := devicesync.Open(lsm)
+	if err != nil {
+		return err
+	}
+
+	var result devicesync.Result
+	if *folder != "" {
+		passphrase := os.Getenv(syncPassphraseEnv)
+		if passphrase == "" {
+			if passphrase, err = readPassphrase("Passphrase of the sync folder: "); err != nil {
+				return err
+			}
+		}
+		if result, err = syncer.SyncFolder(*folder, passphrase); err != nil {
+			return err
+		}
+		fmt.Printf("Synced with %d devices through %s, whose file of this device holds %d changes\n", result.Devices, *folder, result.Sent)
+	} else {
+		httpClient, err := remoteHTTPClient(*caFile)
+		if err != nil {
+			return err
+		}
+		c := client.NewWithHTTPClient(url, httpClient)
+		c.SetToken(os.Getenv(tokenEnv))
+		defer c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+		defer cancel()
+		if result, err = syncer.Sync(url, func(in devicesync.Changeset) (devicesync.Changeset, error) {
+			return c.Sync(ctx, in)
+		}); err != nil {
+			return fmt.Errorf("failed to sync with %s: %w", url, err)
+		}
+		fmt.Printf("Synced with %s, sent %d changes\n", url, result.Sent)
+	}
+	fmt.Printf("Merged %d changes\n", result.Received)
+	for _, key := range result.Conflicts {
+		fmt.Printf("Conflict: kept the losing value under %s\n", key)
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"Lockr/bin/content"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/templates"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// focusTable moves the keyboard focus from the command line to the table shown
+func (m *model) focusTable() {
+	m.tableFocused = true
+	m.input.Blur()
+}
+
+// focusInput moves the keyboard focus back to the command line
+func (m *model) focusInput() {
+	m.hideRevealed()
+	m.tableFocused = false
+	m.input.Focus()
+}
+
+// updateTable handles a key while the table has the focus, reporting false for
+// keys it doesn't bind, which go to the command line instead
+func (m *model) updateTable(msg tea.KeyMsg) (bool, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyUp, tea.KeyDown:
+		m.hideRevealed()
+		m.moveCursor(msg.Type == tea.KeyUp)
+	case tea.KeyPgUp, tea.KeyPgDown, tea.KeyHome, tea.KeyEnd:
+		if m.pager == nil {
+			return true, nil
+		}
+		m.hideRevealed()
+		switch msg.Type {
+		case tea.KeyPgUp:
+			m.turnPage(m.pager.page-1, false)
+		case tea.KeyPgDown:
+			m.turnPage(m.pager.page+1, false)
+		case tea.KeyHome:
+			m.turnPage(0, false)
+		case tea.KeyEnd:
+			if err := m.pager.last(); err != nil {
+				m.errorMessage = fmt.Sprintf("Error listing entries: %v", err)
+			}
+			m.turnPage(m.pager.page, true)
+		}
+	case tea.KeyShiftLeft, tea.KeyShiftRight:
+		return true, m.copySelected(m.settings.copyFormat)
+	case tea.KeyEnter:
+		m.openDetail()
+	case tea.KeyEsc:
+		m.focusInput()
+	case tea.KeyRunes:
+		entry, ok := m.selectedItem()
+		switch string(msg.Runes) {
+		case "e":
+			if ok {
+				m.startEdit(entry)
+			}
+		case "d":
+			if ok {
+				m.confirming = &entry
+				m.statusMessage = fmt.Sprintf("Delete %s? (y/n)", entry.key)
+			}
+		case "r":
+			if ok {
+				m.startRename(entry)
+			}
+		case "v":
+			if ok {
+				m.toggleReveal(entry)
+			}
+		case "c":
+			return true, m.copySelected(copyValue)
+		case "k":
+			return true, m.copySelected(copyKey)
+		default:
+			return false, nil
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// moveCursor moves the table cursor a row up or down. Moving past either end of
+// a page of a listing turns to the previous or next one.
+func (m *model) moveCursor(up bool) {
+	switch {
+	case up && m.pager != nil && m.table.Cursor() == 0:
+		m.turnPage(m.pager.page-1, true)
+	case up:
+		m.table.MoveUp(1)
+	case m.pager != nil && m.table.Cursor() >= len(m.table.Rows())-1:
+		m.turnPage(m.pager.page+1, false)
+	default:
+		m.table.MoveDown(1)
+	}
+}
+
+// selectedItem returns the entry of the selected row, with its key and value in full
+func (m *model) selectedItem() (item, bool) {
+	i := m.table.Cursor()
+	if i < 0 || i >= len(m.rowItems) {
+		return item{}, false
+	}
+	return m.rowItems[i], true
+}
+
+// openDetail shows the selected entry in full
+func (m *model) openDetail() {
+	if entry, ok := m.selectedItem(); ok {
+		m.detail, m.detailField = &entry, 0
+		m.statusMessage = ""
+	}
+}
+
+// toggleReveal shows a masked entry's value, or masks it again
+func (m *model) toggleReveal(entry item) {
+	if m.revealed == entry.key {
+		m.hideRevealed()
+		return
+	}
+	m.revealed = ""
+	if !m.masked(entry) && !m.hasSecretFields(entry) {
+		return
+	}
+	m.revealed = entry.key
+	m.setRows(m.rowItems)
+}
+
+// hideRevealed masks the revealed entry again
+func (m *model) hideRevealed() {
+	if m.revealed != "" {
+		m.revealed = ""
+		m.setRows(m.rowItems)
+	}
+}
+
+// updateDetail handles a key while the detail pane is shown: Esc goes back to
+// the table, e edits the entry, v reveals a masked value and c and k copy its
+// value and key. Up and Down select a field of a structured entry, which c copies.
+func (m *model) updateDetail(msg tea.KeyMsg) tea.Cmd {
+	_, fields, structured := m.detailEntry()
+	switch {
+	case msg.Type == tea.KeyEsc:
+		m.detail = nil
+	case msg.Type == tea.KeyUp && structured:
+		m.detailField = max(m.detailField-1, 0)
+	case msg.Type == tea.KeyDown && structured:
+		m.detailField = min(m.detailField+1, len(fields)-1)
+	case msg.Type == tea.KeyRunes && string(msg.Runes) == "v":
+		m.toggleReveal(*m.detail)
+	case msg.Type == tea.KeyRunes && string(msg.Runes) == "c" && structured:
+		return m.copyField(fields)
+	case msg.Type == tea.KeyRunes && string(msg.Runes) == "c":
+		return m.copySelected(copyValue)
+	case msg.Type == tea.KeyRunes && string(msg.Runes) == "k":
+		return m.copySelected(copyKey)
+	case msg.Type == tea.KeyRunes && string(msg.Runes) == "e":
+		entry := *m.detail
+		m.detail = nil
+		m.startEdit(entry)
+	}
+	return nil
+}
+
+// detailValue returns the value of the entry in the detail pane without its content header
+func (m *model) detailValue() string {
+	value, _ := content.Unwrap(m.detail.value)
+	return value
+}
+
+// detailView renders the entry of the detail pane
+func (m *model) detailView() string {
+	value, contentType := content.Unwrap(m.detail.value)
+	size := len(value)
+	hint := "Press e to edit, v to reveal or hide a secret, c to copy the value, k the key, Esc to go back to the table."
+	if entry, fields, ok := m.detailEntry(); ok {
+		value = m.fieldsView(entry, fields)
+		hint = "Up/Down select a field, c copies it, k the key, v reveals or hides secrets, e edits the fields, Esc goes back to the table."
+	} else if m.masked(*m.detail) {
+		value = maskedValue
+	} else {
+		value = renderValue(value, contentType)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Key:  %s\n", m.detail.key)
+	fmt.Fprintf(&b, "Type: %s, %d bytes\n", contentType, size)
+	if tags := content.Tags(m.detail.value); len(tags) > 0 {
+		fmt.Fprintf(&b, "Tags: %s\n", strings.Join(tags, ", "))
+	}
+	if folder := content.Folder(m.detail.value); folder != "" {
+		fmt.Fprintf(&b, "In:   %s\n", folder)
+	}
+	b.WriteString("\n")
+	b.WriteString(value)
+	return tableStyle.Width(m.width-4).Render(b.String()) + "\n" + statusMessageStyle.Render(hint)
+}
+
+// startEdit puts the value of an entry in the command line for editing
+func (m *model) startEdit(entry item) {
+	value, contentType := content.Unwrap(entry.value)
+	if structured, ok := templates.Decode(value); ok {
+		m.startFieldEdit(entry.key, structured)
+		return
+	}
+	if contentType == content.Binary || strings.Contains(value, "\n") {
+		m.errorMessage = fmt.Sprintf("Error: %s can't be edited on one line; use set %s -", entry.key, entry.key)
+		return
+	}
+	m.editing = &entry
+	if m.masked(entry) {
+		m.input.EchoMode = textinput.EchoPassword
+	}
+	m.focusInput()
+	m.input.CharLimit = 0
+	m.setInput(value)
+	m.statusMessage = fmt.Sprintf("Editing %s: Enter saves, Esc cancels", entry.key)
+}
+
+// saveEdit writes the edited value back, keeping an explicit content type and flags
+func (m *model) saveEdit(value string) {
+	entry := *m.editing
+	m.endEdit()
+	if value == "" {
+		m.errorMessage = fmt.Sprintf("Error: Empty value, %s was not changed", entry.key)
+		return
+	}
+	stored := content.Replace(entry.value, value)
+	if err := m.store.Set(entry.key, stored); err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
+	m.recordUndo("edit "+entry.key, entry.key)
+	for i := range m.rowItems {
+		if m.rowItems[i].key == entry.key {
+			m.rowItems[i].value = stored
+		}
+	}
+	m.setRows(m.rowItems)
+	m.statusMessage = fmt.Sprintf("Saved %s", entry.key)
+}
+
+// endEdit leaves edit mode, returning to the table
+func (m *model) endEdit() {
+	m.editing = nil
+	m.input.CharLimit = inputCharLimit
+	m.input.EchoMode = textinput.EchoNormal
+	m.input.SetValue("")
+	if m.showTable {
+		m.focusTable()
+	}
+}
+
+// updateConfirm handles the answer to the delete confirmation: y deletes the
+// entry, any other key keeps it
+func (m *model) updateConfirm(msg tea.KeyMsg) {
+	entry := *m.confirming
+	m.confirming = nil
+	if msg.Type != tea.KeyRunes || (string(msg.Runes) != "y" && string(msg.Runes) != "Y") {
+		m.statusMessage = fmt.Sprintf("Kept %s", entry.key)
+		return
+	}
+	if err := m.store.Delete(entry.key); err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
+	m.recordUndo("delete "+entry.key, entry.key)
+	rows := m.rowItems[:0:0]
+	for _, it := range m.rowItems {
+		if it.key != entry.key {
+			rows = append(rows, it)
+		}
+	}
+	m.replaceRows(rows)
+	m.statusMessage = fmt.Sprintf("Deleted %s", entry.key)
+}
+
+// startRename puts the key of an entry in the command line to type its new name
+func (m *model) startRename(entry item) {
+	m.renaming = &entry
+	m.focusInput()
+	m.setInput(entry.key)
+	m.statusMessage = fmt.Sprintf("Rename %s to: Enter renames, Esc cancels", entry.key)
+}
+
+// finishRename moves the entry being renamed to key, writing the new key and
+// deleting the old one in one batch
+func (m *model) finishRename(key string) {
+	entry := *m.renaming
+	m.renaming = nil
+	m.input.SetValue("")
+	if m.showTable {
+		m.focusTable()
+	}
+	if key == "" || key == entry.key {
+		m.statusMessage = fmt.Sprintf("Kept %s", entry.key)
+		return
+	}
+	if err := m.rename(entry, key); err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
+	m.recordUndo(fmt.Sprintf("rename %s to %s", entry.key, key), key, entry.key)
+	rows := append([]item(nil), m.rowItems...)
+	for i := range rows {
+		if rows[i].key == entry.key {
+			rows[i].key = key
+		}
+	}
+	m.replaceRows(rows)
+	m.statusMessage = fmt.Sprintf("Renamed %s to %s", entry.key, key)
+}
+
+// rename copies the value of an entry to key and deletes the entry. Stores
+// without batches get the two writes in turn.
+func (m *model) rename(entry item, key string) error {
+	existing, err := m.store.Get(key)
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		return fmt.Errorf("%s already exists", key)
+	}
+	batch := lsmtree.NewWriteBatch()
+	batch.Set(key, entry.value)
+	batch.Delete(entry.key)
+	err = m.store.Batch(batch)
+	if !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+	if err := m.store.Set(key, entry.value); err != nil {
+		return err
+	}
+	return m.store.Delete(entry.key)
+}
+
+// replaceRows shows changed entries in place of the table's rows, keeping the
+// page of a listing in step
+func (m *model) replaceRows(rows []item) {
+	if m.pager != nil {
+		m.pager.pages[m.pager.page] = rows
+	}
+	m.setRows(rows)
+	if n := len(rows); m.table.Cursor() >= n && n > 0 {
+		m.table.SetCursor(n - 1)
+	}
+}
@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"Lockr/bin/content"
+)
+
+// parseListQuery reads the --tag and --folder options of list and filter,
+// returning the arguments left
+func parseListQuery(args []string) (listQuery, []string, error) {
+	var query listQuery
+	for len(args) > 1 && strings.HasPrefix(args[0], "--") {
+		switch args[0] {
+		case "--tag":
+			if err := content.ValidateTag(args[1]); err != nil {
+				return query, nil, err
+			}
+			query.tag = args[1]
+		case "--folder":
+			folder, err := content.CleanFolder(args[1])
+			if err != nil {
+				return query, nil, err
+			}
+			query.folder = folder
+		default:
+			return query, args, nil
+		}
+		args = args[2:]
+	}
+	return query, args, nil
+}
+
+// retag adds tag to the entry of key, or removes it
+func (m *model) retag(key, tag string, remove bool) {
+	if err := content.ValidateTag(tag); err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
+	change, command := content.AddTag, "tag"
+	if remove {
+		change, command = content.RemoveTag, "untag"
+	}
+	if !m.updateStored(fmt.Sprintf("%s %s %s", command, key, tag), key, func(stored string) string { return change(stored, tag) }) {
+		return
+	}
+	if remove {
+		m.statusMessage = fmt.Sprintf("Removed the tag %s from %s", tag, key)
+	} else {
+		m.statusMessage = fmt.Sprintf("Tagged %s with %s", key, tag)
+	}
+}
+
+// refile files the entry of key in folder, or at the top level if folder is ""
+func (m *model) refile(key, folder string) {
+	folder, err := content.CleanFolder(folder)
+	if err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
+	if !m.updateStored("folder "+key, key, func(stored string) string { return content.SetFolder(stored, folder) }) {
+		return
+	}
+	if folder == "" {
+		m.statusMessage = fmt.Sprintf("Moved %s out of its folder", key)
+	} else {
+		m.statusMessage = fmt.Sprintf("Filed %s in %s", key, folder)
+	}
+}
+
+// updateStored rewrites the stored value of key for a command, keeping the table
+// in step, and reports whether it did
+func (m *model) updateStored(command, key string, change func(string) string) bool {
+	stored, err := m.store.Get(key)
+	if err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return false
+	}
+	if stored == "" {
+		m.errorMessage = fmt.Sprintf("Error: Key %s not found", key)
+		return false
+	}
+	updated := change(stored)
+	if updated != stored {
+		if err := m.store.Set(key, updated); err != nil {
+			m.errorMessage = fmt.Sprintf("Error: %v", err)
+			return false
+		}
+		m.recordUndo(command, key)
+	}
+	for i := range m.rowItems {
+		if m.rowItems[i].key == key {
+			m.rowItems[i].value = updated
+		}
+	}
+	if m.detail != nil && m.detail.key == key {
+		m.detail.value = updated
+	}
+	m.setRows(m.rowItems)
+	return true
+}
+
+// tagsView lists the tags and folders in use with their number of entries, from
+// the key index or else a scan of the store
+func (m *model) tagsView() (string, error) {
+	tags, folders := map[string]int{}, map[string]int{}
+	if m.index != nil {
+		tags, folders = m.index.Tags(), m.index.Folders()
+	} else {
+		it, err := m.store.Scan("", "")
+		if err != nil {
+			return "", err
+		}
+		defer it.Close()
+		for it.Next() {
+			for _, tag := range content.Tags(it.Value()) {
+				tags[tag]++
+			}
+			if folder := content.Folder(it.Value()); folder != "" {
+				folders[folder]++
+			}
+		}
+		if err := it.Err(); err != nil {
+			return "", err
+		}
+	}
+	if len(tags) == 0 && len(folders) == 0 {
+		return "No tags or folders", nil
+	}
+	var lines []string
+	for _, group := range []struct {
+		title  string
+		counts map[string]int
+	}{{"Tags:", tags}, {"Folders:", folders}} {
+		if len(group.counts) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(group.counts))
+		for name := range group.counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		lines = append(lines, group.title)
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("- %s (%d)", name, group.counts[name]))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
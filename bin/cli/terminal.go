@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"os"
+	"strings"
+
+	"github.com/atotto/clipboard"
+	"golang.org/x/term"
+)
+
+// defaultWidth is the UI width assumed until the terminal reports its size, or
+// when it never does because output isn't a terminal
+const defaultWidth = 80
+
+// capabilities records which optional terminal features the UI can use. Missing
+// ones are left out so the rest of the UI keeps working in plain mode.
+type capabilities struct {
+	clipboard bool // a clipboard utility is available for copying rows
+	altScreen bool // output is a terminal that can switch to the alternate screen
+	ttyInput  bool // input is a terminal; otherwise keys are read from stdin as piped
+}
+
+// detectCapabilities probes the clipboard and terminal
+func detectCapabilities() capabilities {
+	termName := os.Getenv("TERM")
+	return capabilities{
+		clipboard: !clipboard.Unsupported,
+		altScreen: term.IsTerminal(int(os.Stdout.Fd())) && termName != "" && termName != "dumb",
+		ttyInput:  term.IsTerminal(int(os.Stdin.Fd())),
+	}
+}
+
+// notice returns a one-line notice naming the disabled features, or "" if none are
+func (c capabilities) notice() string {
+	var disabled []string
+	if !c.clipboard {
+		if clipboard.Unsupported {
+			disabled = append(disabled, "clipboard (install xclip, xsel or wl-clipboard to copy rows)")
+		} else {
+			disabled = append(disabled, "clipboard")
+		}
+	}
+	if !c.altScreen {
+		disabled = append(disabled, "full-screen mode")
+	}
+	if len(disabled) == 0 {
+		return ""
+	}
+	return "Plain mode, unavailable: " + strings.Join(disabled, ", ")
+}
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// theme is the palette of the UI and of the dashboards
+type theme struct {
+	accent   lipgloss.TerminalColor // borders, titles and the selected row
+	status   lipgloss.TerminalColor // status messages and hints
+	subtle   lipgloss.TerminalColor // placeholders
+	selected lipgloss.TerminalColor // text of the selected row
+	header   lipgloss.TerminalColor // text of table headers
+	err      lipgloss.TerminalColor // error messages
+	reverse  bool                   // whether the selected row is shown in reverse video, for palettes without colors
+}
+
+// defaultTheme is the theme of a UI started without -theme or a configured one
+const defaultTheme = "purple"
+
+// themes are the palettes selectable with -theme or config.toml
+var themes = map[string]theme{
+	"purple": {
+		accent: lipgloss.Color("#8A2BE2"), status: lipgloss.Color("#9370DB"), subtle: lipgloss.Color("#708090"),
+		selected: lipgloss.Color("#FFFFFF"), header: lipgloss.Color("#2F4F4F"), err: lipgloss.Color("#FF0000"),
+	},
+	"blue": {
+		accent: lipgloss.Color("#1E90FF"), status: lipgloss.Color("#6CA6CD"), subtle: lipgloss.Color("#708090"),
+		selected: lipgloss.Color("#FFFFFF"), header: lipgloss.Color("#102A43"), err: lipgloss.Color("#FF4500"),
+	},
+	"green": {
+		accent: lipgloss.Color("#2E8B57"), status: lipgloss.Color("#66CDAA"), subtle: lipgloss.Color("#708090"),
+		selected: lipgloss.Color("#FFFFFF"), header: lipgloss.Color("#0B3D20"), err: lipgloss.Color("#FF0000"),
+	},
+	"mono": {
+		accent: lipgloss.NoColor{}, status: lipgloss.NoColor{}, subtle: lipgloss.NoColor{},
+		selected: lipgloss.NoColor{}, header: lipgloss.NoColor{}, err: lipgloss.NoColor{}, reverse: true,
+	},
+}
+
+// currentTheme is the theme the styles were last set to by applyTheme
+var currentTheme = themes[defaultTheme]
+
+// applyTheme sets the styles of the UI to the named theme
+func applyTheme(name string) error {
+	t, ok := themes[name]
+	if !ok {
+		names := make([]string, 0, len(themes))
+		for name := range themes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown theme %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	currentTheme = t
+	titleStyle = titleStyle.Foreground(t.accent)
+	statusMessageStyle = statusMessageStyle.Foreground(t.status)
+	errorMessageStyle = errorMessageStyle.Foreground(t.err)
+	tableStyle = tableStyle.BorderForeground(t.accent)
+	headerStyle = headerStyle.Foreground(t.header).Background(t.accent)
+	panelStyle = panelStyle.BorderForeground(t.accent)
+	panelTitleStyle = panelTitleStyle.Foreground(t.accent)
+	jsonKeyStyle = jsonKeyStyle.Foreground(t.accent)
+	pemBoundaryStyle = pemBoundaryStyle.Foreground(t.subtle)
+	hexOffsetStyle = hexOffsetStyle.Foreground(t.subtle)
+	return nil
+}
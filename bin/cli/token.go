@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"Lockr/bin/client"
+	"Lockr/bin/server"
+)
+
+// tokenAdmin manages the API tokens, in the local tree or through a server
+type tokenAdmin interface {
+	add(name, scope string) (string, error)
+	list() ([]client.Token, error)
+	revoke(name string) error
+}
+
+// localTokens manages the tokens kept in the local tree
+type localTokens struct {
+	tokens *server.Tokens
+}
+
+func (l localTokens) add(name, scope string) (string, error) {
+	s, err := server.ParseScope(scope)
+	if err != nil {
+		return "", err
+	}
+	return l.tokens.Add(name, s)
+}
+
+func (l localTokens) list() ([]client.Token, error) {
+	var tokens []client.Token
+	for _, t := range l.tokens.List() {
+		tokens = append(tokens, client.Token{Name: t.Name, Scope: t.Scope.String(), Created: t.Created})
+	}
+	return tokens, nil
+}
+
+func (l localTokens) revoke(name string) error {
+	return l.tokens.Revoke(name)
+}
+
+// remoteTokens manages the tokens of a server with an admin token
+type remoteTokens struct {
+	client *client.Client
+}
+
+func (r remoteTokens) add(name, scope string) (string, error) {
+	token, err := r.client.AddToken(context.Background(), name, scope)
+	return token.Secret, err
+}
+
+func (r remoteTokens) list() ([]client.Token, error) {
+	return r.client.ListTokens(context.Background())
+}
+
+func (r remoteTokens) revoke(name string) error {
+	return r.client.RevokeToken(context.Background(), name)
+}
+
+// runToken adds, lists and revokes the tokens of the HTTP API
+func runToken(admin tokenAdmin, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: lockr token add|list|revoke")
+	}
+	switch args[0] {
+	case "add":
+		flags := flag.NewFlagSet("token add", flag.ContinueOnError)
+		scope := flags.String("scope", "read", "what the token may do: read, write (and read) or admin (and manage tokens)")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: lockr token add [--scope read|write|admin] <name>")
+		}
+		secret, err := admin.add(flags.Arg(0), *scope)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Added %s token %s; it isn't shown again:\n", *scope, flags.Arg(0))
+		fmt.Println(secret)
+		return nil
+	case "list":
+		flags := flag.NewFlagSet("token list", flag.ContinueOnError)
+		output := outputFlag(flags, outputTable)
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		format, err := parseOutput(*output)
+		if err != nil {
+			return err
+		}
+		tokens, err := admin.list()
+		if err != nil {
+			return err
+		}
+		switch format {
+		case outputJSON:
+			if tokens == nil {
+				tokens = []client.Token{}
+			}
+			return printJSON(tokens)
+		case outputPlain:
+			for _, t := range tokens {
+				fmt.Println(t.Name)
+			}
+			return nil
+		}
+		if len(tokens) == 0 {
+			fmt.Println("No tokens; add one with `lockr token add <name>`")
+			return nil
+		}
+		rows := make([][]string, 0, len(tokens))
+		for _, t := range tokens {
+			rows = append(rows, []string{t.Name, t.Scope, t.Created.Local().Format(time.DateTime)})
+		}
+		return printTable([]string{"name", "scope", "created"}, rows)
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: lockr token revoke <name>")
+		}
+		if err := admin.revoke(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked token %s\n", args[1])
+		return nil
+	default:
+		return fmt.Errorf("unknown token command %q: want add, list or revoke", args[0])
+	}
+}
@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+)
+
+// splitCommand splits a command line into words the way a POSIX shell does:
+// whitespace separates words, single quotes keep everything literally, double
+// quotes keep everything but backslash escapes of " and \, and a backslash
+// outside quotes escapes the next character
+func splitCommand(input string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune // the open quote, or 0
+	escaped := false
+
+	for _, r := range input {
+		switch {
+		case escaped:
+			// Inside double quotes, a backslash only escapes " and \
+			if quote == '"' && r != '"' && r != '\\' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
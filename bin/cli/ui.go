@@ -1,18 +1,23 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
-	"strings"
-	"golang.org/x/term"
+	"sort"
 	"os"
+	"strings"
+	"time"
 
+	"Lockr/bin/content"
+	"Lockr/bin/keyindex"
 	"Lockr/bin/lsmtree"
+	"Lockr/bin/templates"
+	"Lockr/bin/vault"
 
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/charmbracelet/bubbles/table"
-	"github.com/atotto/clipboard"
 )
 
 var (
@@ -36,6 +41,50 @@ var (
 		Bold(true)
 )
 
+// uiSettings are the preferences of the UI, given as global flags, and the
+// templates of the data directory
+type uiSettings struct {
+	copyFormat     string                        // what Shift copies from the table, see copySelected
+	clipboardClear time.Duration                 // how long copied values stay in the clipboard, 0 for ever
+	mask           string                        // which values are masked until revealed, see parseMask
+	autoLock       time.Duration                 // idle time after which an encrypted store is locked, 0 for never
+	templates      map[string]templates.Template // templates of add, from the data directory
+	logs           *logBuffer                    // engine events captured while the UI runs, nil for a remote store
+	vaultName      string                        // the store opened, shown in the title; empty for a remote store
+	vaults         []string                      // stores `vault switch` can open, nil when it can't switch
+}
+
+// defaultUISettings are the settings of a UI started without flags
+var defaultUISettings = uiSettings{copyFormat: "{key}: {value}", clipboardClear: 30 * time.Second, mask: maskSecret, autoLock: 5 * time.Minute}
+
+// Values the UI masks until revealed: those set with --secret, all or none
+const (
+	maskSecret = "secret"
+	maskAll    = "all"
+	maskNone   = "none"
+)
+
+// maskedValue is shown in place of masked values, whatever their length
+const maskedValue = "•••••"
+
+// parseMask validates the -mask flag
+func parseMask(mask string) (string, error) {
+	switch mask {
+	case maskSecret, maskAll, maskNone:
+		return mask, nil
+	}
+	return "", fmt.Errorf("invalid -mask %q, expected %s, %s or %s", mask, maskSecret, maskAll, maskNone)
+}
+
+// inputCharLimit is the longest command that can be typed, lifted while editing a value
+const inputCharLimit = 256
+
+// pausable is a store whose flushes and compactions can be held, like *lsmtree.LSMTree
+type pausable interface {
+	PauseBackground(timeout time.Duration) error
+	ResumeBackground()
+}
+
 type item struct {
 	key, value string
 }
@@ -45,22 +94,56 @@ func (i item) Description() string { return i.value }
 func (i item) FilterValue() string { return i.key }
 
 type model struct {
-	lsm           *lsmtree.LSMTree
+	store         lsmtree.Store
+	vault         *vault.Vault    // nil when encryption contexts aren't available
+	index         *keyindex.Index // nil when keys must be listed by scanning the store
+	unlocking     string       // context whose passphrase is being entered
+	setting       string       // key whose value is being entered after `set <key> -`
+	settingType   string       // content type given to that set
+	settingSecret bool         // whether that set flags the value as secret
+	history       *history     // nil when commands aren't recorded
+	search        *historySearch // set during Ctrl+R reverse search
+	completion    *completion    // set while Tab cycles through matches
+	finder        *finder        // set in find mode, while the input filters the table
+	pager         *listPager     // set while the table shows a listing
+	watch         *watchPane     // set while the writes to a prefix are shown
+	showLogs      bool           // the engine log pane is shown
+	logSeen       uint64         // sequence number of the last engine log entry handled
+	rowItems      []item         // entries of the table's rows, untruncated
+	tableFocused  bool           // keys go to the table rather than the command line
+	detail        *item          // entry shown in full in the detail pane
+	detailField   int            // field of a structured entry selected in the detail pane
+	adding        *entryForm     // set while the fields of a structured entry are entered
+	editing       *item          // entry whose value is being edited in the command line
+	renaming      *item          // entry whose new key is being typed in the command line
+	confirming    *item          // entry awaiting the confirmation of its deletion
+	undo          []undoEntry    // commands of the session that undo reverts, oldest first
+	revealed      string         // key of the masked entry shown unmasked, until the selection moves
+	settings      uiSettings
+	copied        *copiedValue   // value in the clipboard until it's cleared
+	session       *storeSession  // set when the store is encrypted and can be locked
+	locked        bool           // the store is locked until the master password is typed
+	lastActive    time.Time      // when the last key was pressed
+	autoLockID    int            // tells idle checks of this unlock from those of earlier ones
+	caps          capabilities
+	notice        string       // disabled features, shown under the title
+	width         int          // terminal width, defaultWidth until reported
 	input         textinput.Model
 	table         table.Model
 	statusMessage string
 	errorMessage  string
 	showTable     bool
 	quitting      bool
+	switchTo      string       // vault opened once the UI quits, see vaultSwitch
 }
 
-func initialModel(lsm *lsmtree.LSMTree) model {
+func initialModel(store lsmtree.Store, v *vault.Vault, idx *keyindex.Index) model {
 	ti := textinput.New()
 	ti.Placeholder = "Enter command (e.g., set foo bar, get foo, delete foo, list, help)"
 	ti.Focus()
-	ti.CharLimit = 256
+	ti.CharLimit = inputCharLimit
 	ti.Width = 80
-	ti.PlaceholderStyle = ti.PlaceholderStyle.Foreground(lipgloss.Color("#708090"))
+	ti.PlaceholderStyle = ti.PlaceholderStyle.Foreground(currentTheme.subtle)
 
 	t := table.New(
 		table.WithColumns([]table.Column{
@@ -74,56 +157,180 @@ func initialModel(lsm *lsmtree.LSMTree) model {
 	s := table.DefaultStyles()
 	s.Header = s.Header.
 		BorderStyle(lipgloss.NormalBorder()).
-		BorderForeground(lipgloss.Color("#8A2BE2")).
+		BorderForeground(currentTheme.accent).
 		BorderBottom(true).
 		Bold(true)
 	s.Selected = s.Selected.
-		Foreground(lipgloss.Color("#FFFFFF")).
-		Background(lipgloss.Color("#8A2BE2")).
+		Foreground(currentTheme.selected).
+		Background(currentTheme.accent).
+		Reverse(currentTheme.reverse).
 		Bold(true)
 	t.SetStyles(s)
 
 	return model{
-		lsm:       lsm,
+		store:     store,
+		vault:     v,
+		index:     idx,
 		input:     ti,
 		table:     t,
+		width:     defaultWidth,
 		showTable: false,
 	}
 }
 
 func (m model) Init() tea.Cmd {
-	return textinput.Blink
+	return tea.Batch(textinput.Blink, m.autoLockTick(), m.waitLog())
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		if msg.Type == tea.KeyCtrlC {
+			return m, m.quit()
+		}
+		m.lastActive = time.Now()
+		if m.locked {
+			return m, m.updateLocked(msg)
+		}
+		if m.detail != nil {
+			return m, m.updateDetail(msg)
+		}
+		if m.confirming != nil {
+			m.updateConfirm(msg)
+			return m, nil
+		}
+		if m.renaming != nil && (msg.Type == tea.KeyEsc || msg.Type == tea.KeyEnter) {
+			if msg.Type == tea.KeyEsc {
+				m.input.SetValue("")
+			}
+			m.errorMessage = ""
+			m.finishRename(m.input.Value())
+			return m, nil
+		}
+		if m.adding != nil && (msg.Type == tea.KeyEsc || msg.Type == tea.KeyEnter) {
+			m.updateForm(msg)
+			return m, nil
+		}
+		if m.editing != nil && (msg.Type == tea.KeyEsc || msg.Type == tea.KeyEnter) {
+			m.errorMessage = ""
+			if msg.Type == tea.KeyEnter {
+				m.saveEdit(m.input.Value())
+			} else {
+				m.endEdit()
+				m.statusMessage = "Edit cancelled"
+			}
+			return m, nil
+		}
+		if m.tableFocused {
+			if handled, cmd := m.updateTable(msg); handled {
+				return m, cmd
+			}
+			// Typing goes back to the command line
+			m.focusInput()
+		}
+		if m.finder != nil {
+			switch msg.Type {
+			case tea.KeyEsc:
+				m.finder, m.showTable, m.statusMessage = nil, false, ""
+				m.input.SetValue("")
+				return m, nil
+			case tea.KeyEnter:
+				m.finder = nil
+				m.input.SetValue("")
+				m.statusMessage = fmt.Sprintf("Found %d items", len(m.table.Rows()))
+				m.focusTable()
+				return m, nil
+			case tea.KeyUp, tea.KeyDown:
+				m.moveCursor(msg.Type == tea.KeyUp)
+				return m, nil
+			case tea.KeyCtrlF:
+				m.finder.values = !m.finder.values
+				m.refilter()
+				return m, nil
+			case tea.KeyTab:
+				return m, nil
+			}
+		} else if msg.String() == "/" && m.input.Value() == "" && !m.prompting() && m.search == nil {
+			m.startFind("", false)
+			return m, nil
+		}
+		if m.search != nil {
+			if !m.updateSearch(msg) {
+				return m, nil
+			}
+		}
 		switch msg.Type {
-		case tea.KeyCtrlC, tea.KeyEsc:
-			m.quitting = true
-			return m, tea.Quit
+		case tea.KeyEsc:
+			return m, m.quit()
 		case tea.KeyEnter:
 			m.statusMessage = ""
 			m.errorMessage = ""
 			m.showTable = false
-			m.executeCommand(m.input.Value())
-			m.input.SetValue("")
-			return m, nil
+			m.closePager()
+			switch {
+			case m.unlocking != "":
+				m.unlockContext(m.input.Value())
+			case m.setting != "":
+				m.setPromptedValue(m.input.Value())
+			default:
+				input := m.input.Value()
+				m.executeCommand(input)
+				if m.history != nil {
+					if err := m.history.add(input); err != nil && m.errorMessage == "" {
+						m.errorMessage = fmt.Sprintf("Error: %v", err)
+					}
+				}
+				if m.switchTo != "" {
+					return m, m.quit()
+				}
+			}
+			if m.finder == nil {
+				m.input.SetValue("") // find keeps its pattern in the input
+			}
+			return m, m.waitWatch()
 		case tea.KeyUp, tea.KeyDown:
-			if m.showTable {
+			if m.history != nil && !m.prompting() {
+				var command string
+				var ok bool
 				if msg.Type == tea.KeyUp {
-					m.table.MoveUp(1)
+					command, ok = m.history.previous(m.input.Value())
 				} else {
-					m.table.MoveDown(1)
+					command, ok = m.history.next()
+				}
+				if ok {
+					m.input.SetValue(command)
+					m.input.CursorEnd()
 				}
 				return m, nil
 			}
+		case tea.KeyCtrlR:
+			if m.history != nil && !m.prompting() {
+				m.search = &historySearch{draft: m.input.Value(), pos: len(m.history.commands)}
+				m.statusMessage = m.search.prompt()
+			}
+			return m, nil
 		case tea.KeyShiftLeft, tea.KeyShiftRight:
 			if m.showTable {
-				return m, m.copySelectedRow()
+				return m, m.copySelected(m.settings.copyFormat)
+			}
+		case tea.KeyTab:
+			if !m.prompting() {
+				m.completeInput()
 			}
+			return m, nil
 		}
+	case clipboardTickMsg:
+		return m, m.clipboardTick(msg)
+	case autoLockMsg:
+		return m, m.autoLock(msg)
+	case watchEventMsg:
+		return m, m.watchEvent(msg)
+	case logMsg:
+		return m, m.logged()
 	case tea.WindowSizeMsg:
+		if msg.Width > 0 {
+			m.width = msg.Width
+		}
 		newHeight := msg.Height / 4
 		if newHeight < 3 {
 			newHeight = 3
@@ -134,32 +341,58 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	}
 	var cmd tea.Cmd
 	m.input, cmd = m.input.Update(msg)
+	if m.finder != nil && m.input.Value() != m.finder.pattern {
+		m.refilter()
+	}
 	return m, cmd
 }
 
 func (m model) View() string {
 	var b strings.Builder
 
-	b.WriteString(titleStyle.Render("Lockr - Simple Key-Value Store"))
+	title := "Lockr - Simple Key-Value Store"
+	if m.settings.vaultName != "" {
+		title += " [" + m.settings.vaultName + "]"
+	}
+	b.WriteString(titleStyle.Render(title))
 	b.WriteString("\n\n")
 
+	if m.notice != "" {
+		b.WriteString(statusMessageStyle.Render(m.notice))
+		b.WriteString("\n\n")
+	}
+
 	b.WriteString(m.input.View())
 	b.WriteString("\n\n")
 
+	if m.locked {
+		b.WriteString(statusMessageStyle.Render(m.statusMessage))
+		b.WriteString("\n\n")
+		if m.errorMessage != "" {
+			b.WriteString(errorMessageStyle.Render(m.errorMessage))
+		}
+		return b.String()
+	}
+
 	if m.statusMessage != "" {
 		b.WriteString(statusMessageStyle.Render(m.statusMessage))
 		b.WriteString("\n\n")
 	}
 
+	if m.copied != nil {
+		b.WriteString(statusMessageStyle.Render(m.copied.countdown()))
+		b.WriteString("\n\n")
+	}
+
 	if m.errorMessage != "" {
 		b.WriteString(errorMessageStyle.Render(m.errorMessage))
 		b.WriteString("\n\n")
 	}
 
-	if m.showTable {
-		width, _, _ := term.GetSize(int(os.Stdout.Fd()))
-		
-		tableWidth := width - 4
+	if m.detail != nil {
+		b.WriteString(m.detailView())
+	} else if m.showTable {
+		tableWidth := m.width - 4
 		keyWidth := tableWidth / 3
 		valueWidth := tableWidth - keyWidth - 3
 		
@@ -170,14 +403,42 @@ func (m model) View() string {
 		
 		b.WriteString(tableStyle.Render(m.table.View()))
 		b.WriteString("\n")
-		b.WriteString(statusMessageStyle.Render("Use arrow keys to navigate. Press Shift to copy selected row."))
+		hint := "Use arrow keys to navigate."
+		if m.pager != nil {
+			hint = m.pager.position() + ". Use arrow keys, PgUp/PgDn and Home/End to navigate."
+		}
+		if m.caps.clipboard {
+			hint += " Shift copies the selected row, c its value, k its key."
+		}
+		if m.tableFocused {
+			hint += "\nEnter shows the entry, e edits it, d deletes it, r renames it, v reveals it, Esc returns to the command line."
+		}
+		b.WriteString(statusMessageStyle.Render(hint))
+	}
+
+	if m.watch != nil {
+		if m.detail != nil || m.showTable {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(m.watchView())
+	}
+
+	if m.showLogs {
+		if m.detail != nil || m.showTable || m.watch != nil {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(m.logView())
 	}
 
 	return b.String()
 }
 
 func (m *model) executeCommand(input string) {
-	parts := strings.Fields(input)
+	parts, err := splitCommand(input)
+	if err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
 	if len(parts) == 0 {
 		m.errorMessage = "Error: Empty command"
 		return
@@ -186,33 +447,71 @@ func (m *model) executeCommand(input string) {
 	command := parts[0]
 	switch command {
 	case "set":
+		const usage = "Error: Invalid set command. Usage: set [--type <content type>] [--secret] <key> <value|->"
+		contentType, secret := "", false
+		for len(parts) > 3 && strings.HasPrefix(parts[1], "--") {
+			switch parts[1] {
+			case "--type":
+				contentType = parts[2]
+				parts = append(parts[:1], parts[3:]...)
+				if err := content.Validate(contentType); err != nil {
+					m.errorMessage = fmt.Sprintf("Error: %v", err)
+					return
+				}
+			case "--secret":
+				secret = true
+				parts = append(parts[:1], parts[2:]...)
+			default:
+				m.errorMessage = usage
+				return
+			}
+		}
 		if len(parts) != 3 {
-			m.errorMessage = "Error: Invalid set command. Usage: set <key> <value>"
+			m.errorMessage = usage
 			return
 		}
 		key, value := parts[1], parts[2]
-		err := m.lsm.Set(key, value)
-		if err != nil {
+		if value == "-" {
+			m.setting, m.settingType, m.settingSecret = key, contentType, secret
+			m.input.EchoMode = textinput.EchoPassword
+			m.statusMessage = fmt.Sprintf("Enter the value for %s", key)
+			return
+		}
+		if err := m.store.Set(key, wrapValue(value, contentType, secret)); err != nil {
 			m.errorMessage = fmt.Sprintf("Error: %v", err)
 			return
 		}
-		m.statusMessage = fmt.Sprintf("Set %s to %s", key, value)
+		m.recordUndo("set "+key, key)
+		if secret {
+			m.statusMessage = fmt.Sprintf("Set %s", key)
+		} else {
+			m.statusMessage = fmt.Sprintf("Set %s to %s", key, value)
+		}
 
 	case "get":
+		at := ""
+		if len(parts) == 4 && parts[2] == "--at" {
+			at, parts = parts[3], parts[:2]
+		}
 		if len(parts) != 2 {
-			m.errorMessage = "Error: Invalid get command. Usage: get <key>"
+			m.errorMessage = "Error: Invalid get command. Usage: get <key> [--at <version|time>]"
 			return
 		}
 		key := parts[1]
-		value, err := m.lsm.Get(key)
+		value, err := m.getAt(key, at)
 		if err != nil {
 			m.errorMessage = fmt.Sprintf("Error: %v", err)
 			return
 		}
+		value, contentType := content.Unwrap(value)
 		if value == "" {
 			m.statusMessage = fmt.Sprintf("Key %s not found", key)
-		} else {
+		} else if entry, ok := templates.Decode(value); ok {
+			m.statusMessage = fmt.Sprintf("%s %s", key, entry.Render())
+		} else if contentType == content.TextPlain {
 			m.statusMessage = fmt.Sprintf("%s: %s", key, value)
+		} else {
+			m.statusMessage = fmt.Sprintf("%s [%s]\n%s", key, contentType, renderValue(value, contentType))
 		}
 
 	case "delete":
@@ -221,75 +520,707 @@ func (m *model) executeCommand(input string) {
 			return
 		}
 		key := parts[1]
-		err := m.lsm.Delete(key)
+		err := m.store.Delete(key)
 		if err != nil {
 			m.errorMessage = fmt.Sprintf("Error: %v", err)
 			return
 		}
+		m.recordUndo("delete "+key, key)
 		m.statusMessage = fmt.Sprintf("Deleted %s", key)
 
-	case "list":
-		entries, err := m.lsm.List()
+	case "list", "filter":
+		query, args, err := parseListQuery(parts[1:])
 		if err != nil {
-			m.errorMessage = fmt.Sprintf("Error listing entries: %v", err)
+			m.errorMessage = fmt.Sprintf("Error: %v", err)
 			return
 		}
-		rows := []table.Row{}
-		for k, v := range entries {
-			// Truncate long values and add ellipsis
-			if len(k) > 27 {
-				k = k[:27] + "..."
-			}
-			if len(v) > 47 {
-				v = v[:47] + "..."
-			}
-			rows = append(rows, table.Row{k, v})
+		if command == "filter" && len(args) != 1 {
+			m.errorMessage = "Error: Invalid filter command. Usage: filter [--tag <tag>] [--folder <path>] <text>"
+			return
+		}
+		if command == "list" && len(args) != 0 {
+			m.errorMessage = "Error: Invalid list command. Usage: list [--tag <tag>] [--folder <path>]"
+			return
+		}
+		if command == "filter" {
+			query.filter = args[0]
 		}
-		m.table.SetRows(rows)
+		pager, err := newListPager(m.store, m.index, query)
+		if err != nil {
+			m.errorMessage = fmt.Sprintf("Error listing entries: %v", err)
+			return
+		}
+		m.pager = pager
+		m.setRows(pager.items())
 		m.showTable = true
-		if len(rows) == 0 {
+		m.focusTable()
+		switch count, known := pager.count(); {
+		case count == 0 && known:
 			m.statusMessage = "No items found"
-		} else {
-			m.statusMessage = fmt.Sprintf("Listed %d items. Use arrow keys to navigate.", len(rows))
+		case known:
+			m.statusMessage = fmt.Sprintf("Listed %d items", count)
+		default:
+			m.statusMessage = fmt.Sprintf("Listed the first %d items, more load as you page down", count)
+		}
+
+	case "find":
+		values := len(parts) > 1 && parts[1] == "--values"
+		if values {
+			parts = append(parts[:1], parts[2:]...)
+		}
+		if len(parts) > 2 {
+			m.errorMessage = "Error: Invalid find command. Usage: find [--values] [pattern], or type / to start"
+			return
+		}
+		pattern := ""
+		if len(parts) == 2 {
+			pattern = parts[1]
+		}
+		m.startFind(pattern, values)
+
+	case "add":
+		if len(parts) != 3 {
+			m.errorMessage = fmt.Sprintf("Error: Invalid add command. Usage: add <template> <name> (templates: %s)",
+				strings.Join(templates.Names(m.settings.templates), ", "))
+			return
+		}
+		m.startAdd(parts[1], parts[2])
+
+	case "tag", "untag":
+		if len(parts) != 3 {
+			m.errorMessage = fmt.Sprintf("Error: Invalid %s command. Usage: %s <key> <tag>", command, command)
+			return
+		}
+		m.retag(parts[1], parts[2], command == "untag")
+
+	case "folder":
+		if len(parts) != 2 && len(parts) != 3 {
+			m.errorMessage = "Error: Invalid folder command. Usage: folder <key> [path]"
+			return
+		}
+		folder := ""
+		if len(parts) == 3 {
+			folder = parts[2]
+		}
+		m.refile(parts[1], folder)
+
+	case "undo":
+		if len(parts) != 1 {
+			m.errorMessage = "Error: Invalid undo command. Usage: undo"
+			return
+		}
+		m.undoLast()
+
+	case "restore":
+		if len(parts) != 2 {
+			m.errorMessage = "Error: Invalid restore command. Usage: restore <key>"
+			return
+		}
+		m.restoreDeleted(parts[1])
+
+	case "history":
+		if len(parts) != 2 {
+			m.errorMessage = "Error: Invalid history command. Usage: history <key>"
+			return
+		}
+		view, err := m.historyView(parts[1])
+		if err != nil {
+			m.errorMessage = fmt.Sprintf("Error: %v", err)
+			return
+		}
+		m.statusMessage = view
+
+	case "tags":
+		view, err := m.tagsView()
+		if err != nil {
+			m.errorMessage = fmt.Sprintf("Error: %v", err)
+			return
+		}
+		m.statusMessage = view
+
+	case "watch":
+		if len(parts) > 2 {
+			m.errorMessage = "Error: Invalid watch command. Usage: watch [prefix]"
+			return
+		}
+		prefix := ""
+		if len(parts) == 2 {
+			prefix = parts[1]
+		}
+		m.startWatch(prefix)
+
+	case "logs":
+		if len(parts) != 1 {
+			m.errorMessage = "Error: Invalid logs command. Usage: logs"
+			return
+		}
+		if m.settings.logs == nil {
+			m.errorMessage = "Error: The engine of a remote store logs on its server"
+			return
+		}
+		m.showLogs = !m.showLogs
+		if !m.showLogs {
+			m.statusMessage = "Hid the engine log"
+		}
+
+	case "stats":
+		if len(parts) != 1 {
+			m.errorMessage = "Error: Invalid stats command. Usage: stats"
+			return
 		}
+		view, err := m.statsView()
+		if err != nil {
+			m.errorMessage = fmt.Sprintf("Error: %v", err)
+			return
+		}
+		m.showTable = false
+		m.statusMessage = view
+
+	case "unwatch":
+		if m.watch == nil {
+			m.errorMessage = "Error: Nothing is being watched"
+			return
+		}
+		m.statusMessage = fmt.Sprintf("Stopped watching %s", describePrefix(m.watch.prefix))
+		m.stopWatch()
 
 	case "help":
 		m.showTable = false
 		m.statusMessage = `Available commands:
-- set <key> <value>: Set a key-value pair
-- get <key>: Retrieve the value for a given key
+- set [--type <content type>] [--secret] <key> <value>: Set a key-value pair, e.g. with --type application/json
+  or with --secret to mask it in the table; quote values with spaces ("my secret phrase"), or give - to
+  enter the value hidden
+- get <key> [--at <version|time>]: Retrieve the value for a given key, or a past one by its number
+  in the history, a time such as 2026-10-14T15:04 or an age such as 2d
+- history <key>: Show the versions kept of a key with the time of each
+- undo: Revert the last command of this session that changed the store, e.g. a set or delete
+- restore <key>: Bring back a deleted key with its last value
+- add <template> <name>: Enter the fields of a structured entry, e.g. add login github for
+  login/github; the detail pane shows and copies its fields one by one
 - delete <key>: Delete a key-value pair
-- list: Show all key-value pairs
-- help: Display this help message`
+- list: Show all key-value pairs; in the table Enter shows the selected entry, e edits it,
+  d deletes it, r renames it and v reveals a masked value
+- filter <text>: Show the key-value pairs whose key contains text
+  list and filter take --tag <tag> and --folder <path> to show only the entries with a tag or
+  filed in a folder or its subfolders
+- tag <key> <tag>, untag <key> <tag>: Add a tag to an entry or remove it
+- folder <key> [path]: File an entry in a folder like work/aws, or without one at the top level
+- tags: Show the tags and folders in use
+- find [--values] [pattern] or /: Filter the table live as you type, matching keys fuzzily
+  and with --values or Ctrl+F values by substring
+- contexts: Show the encryption contexts
+- unlock <context>: Unlock an encryption context with its passphrase
+- lock [context]: Lock an encryption context, or without one the encrypted store until the master
+  password is typed again
+- watch [prefix]: Show the writes to the keys starting with prefix, or to all keys, as they
+  happen, until unwatch
+- logs: Show the engine's log of flushes, compactions, recovery and errors as it grows, or hide it
+- stats: Show the engine's dashboard: estimated keys, disk usage, MemTables, SSTables, pending
+  compactions and caches
+- pause [duration]: Hold flushes and compactions, for up to 10m by default
+- resume: Resume flushes and compactions
+- vault [list], vault switch <name>: Show the vaults, or close this one and open another, each with
+  its own data directory and master password
+- help: Display this help message
+Tab completes commands and keys, pressed again it cycles through the matches
+Up/Down browse the command history when no table is shown, Ctrl+R searches it`
+
+	case "contexts":
+		if m.vault == nil || len(m.vault.Contexts()) == 0 {
+			m.statusMessage = "No encryption contexts"
+			return
+		}
+		lines := []string{"Encryption contexts:"}
+		for _, c := range m.vault.Contexts() {
+			state := "locked"
+			if c.Unlocked {
+				state = "unlocked"
+			}
+			lines = append(lines, fmt.Sprintf("- %s (%s*): %s", c.Name, c.Prefix, state))
+		}
+		m.statusMessage = strings.Join(lines, "\n")
+
+	case "unlock":
+		if len(parts) != 2 {
+			m.errorMessage = "Error: Invalid unlock command. Usage: unlock <context>"
+			return
+		}
+		if m.vault == nil {
+			m.errorMessage = "Error: Encryption contexts aren't available"
+			return
+		}
+		m.unlocking = parts[1]
+		m.input.EchoMode = textinput.EchoPassword
+		m.statusMessage = fmt.Sprintf("Enter the passphrase for %s", parts[1])
+
+	case "lock":
+		if len(parts) == 1 && m.session != nil {
+			m.lockStore("Locked the store.")
+			return
+		}
+		if len(parts) != 2 {
+			m.errorMessage = "Error: Invalid lock command. Usage: lock <context>"
+			return
+		}
+		if m.vault == nil {
+			m.errorMessage = "Error: Encryption contexts aren't available"
+			return
+		}
+		if err := m.vault.Lock(parts[1]); err != nil {
+			m.errorMessage = fmt.Sprintf("Error: %v", err)
+			return
+		}
+		m.statusMessage = fmt.Sprintf("Locked %s", parts[1])
+
+	case "pause":
+		if len(parts) > 2 {
+			m.errorMessage = "Error: Invalid pause command. Usage: pause [duration]"
+			return
+		}
+		store, ok := m.store.(pausable)
+		if !ok {
+			m.errorMessage = "Error: This store has no background work to pause"
+			return
+		}
+		var timeout time.Duration
+		if len(parts) == 2 {
+			var err error
+			if timeout, err = time.ParseDuration(parts[1]); err != nil || timeout <= 0 {
+				m.errorMessage = fmt.Sprintf("Error: Invalid duration %q", parts[1])
+				return
+			}
+		}
+		if err := store.PauseBackground(timeout); err != nil {
+			m.errorMessage = fmt.Sprintf("Error: %v", err)
+			return
+		}
+		if timeout <= 0 {
+			timeout = lsmtree.DefaultPauseTimeout
+		}
+		m.statusMessage = fmt.Sprintf("Paused flushes and compactions, resuming in %s at the latest", timeout)
+
+	case "vault":
+		m.vaultCommand(parts[1:])
+
+	case "resume":
+		store, ok := m.store.(pausable)
+		if !ok {
+			m.errorMessage = "Error: This store has no background work to resume"
+			return
+		}
+		store.ResumeBackground()
+		m.statusMessage = "Resumed flushes and compactions"
 
 	default:
-		m.errorMessage = "Error: Invalid command. Use set, get, delete, list, or help"
+		m.errorMessage = "Error: Invalid command. Use set, get, add, delete, list, filter, find, history, undo, restore, tag, untag, folder, tags, contexts, unlock, lock, watch, unwatch, logs, stats, pause, resume, vault, or help"
 	}
 }
 
-func RunUI(lsm *lsmtree.LSMTree) error {
-	p := tea.NewProgram(initialModel(lsm), tea.WithAltScreen())
-	_, err := p.Run()
-	return err
+// prompting reports whether the command line is taking something other than a
+// command: a passphrase, a value or a new key
+func (m *model) prompting() bool {
+	return m.unlocking != "" || m.setting != "" || m.editing != nil || m.renaming != nil || m.adding != nil
+}
+
+// unlockContext unlocks the context awaiting its passphrase and restores normal input
+func (m *model) unlockContext(passphrase string) {
+	name := m.unlocking
+	m.unlocking = ""
+	m.input.EchoMode = textinput.EchoNormal
+	if err := m.vault.Unlock(name, passphrase); err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
+	m.statusMessage = fmt.Sprintf("Unlocked %s", name)
+}
+
+// historySearch is the state of a Ctrl+R reverse search of the history
+type historySearch struct {
+	query  string
+	draft  string // input before the search, restored when it's cancelled
+	pos    int    // position of the match shown, len(commands) before the first
+	failed bool   // no older command matches the query
+}
+
+// prompt returns the status line shown while searching
+func (s *historySearch) prompt() string {
+	if s.failed {
+		return fmt.Sprintf("(failed reverse-i-search)`%s'", s.query)
+	}
+	return fmt.Sprintf("(reverse-i-search)`%s'", s.query)
 }
 
-func (m model) copySelectedRow() tea.Cmd {
-	if len(m.table.Rows()) == 0 {
-		return nil
+// updateSearch handles a key during a reverse search. Typing edits the query,
+// Ctrl+R finds an older match and Esc or Ctrl+G restores the input. Any other key
+// ends the search with the match in the input; it reports true for Enter, which
+// then runs the match.
+func (m *model) updateSearch(msg tea.KeyMsg) bool {
+	s := m.search
+	switch msg.Type {
+	case tea.KeyEsc, tea.KeyCtrlG:
+		m.input.SetValue(s.draft)
+		m.search, m.statusMessage = nil, ""
+		return false
+	case tea.KeyCtrlR:
+		m.findMatch(s.pos)
+		return false
+	case tea.KeyBackspace:
+		if runes := []rune(s.query); len(runes) > 0 {
+			s.query = string(runes[:len(runes)-1])
+		}
+		m.findMatch(len(m.history.commands))
+		return false
+	case tea.KeyRunes, tea.KeySpace:
+		s.query += string(msg.Runes)
+		m.findMatch(len(m.history.commands))
+		return false
 	}
+	m.search, m.statusMessage = nil, ""
+	m.input.CursorEnd()
+	return msg.Type == tea.KeyEnter
+}
+
+// findMatch shows the newest command before position before matching the query
+func (m *model) findMatch(before int) {
+	s := m.search
+	command, pos := m.history.search(s.query, before)
+	s.failed = pos < 0
+	if !s.failed {
+		s.pos = pos
+		m.input.SetValue(command)
+		m.input.CursorEnd()
+	}
+	m.statusMessage = s.prompt()
+}
 
-	selectedRow := m.table.SelectedRow()
-	if len(selectedRow) < 2 {
-		return nil
+// startFind enters find mode with the entries loaded and the table filtered by pattern
+func (m *model) startFind(pattern string, values bool) {
+	items, err := m.listItems("")
+	if err != nil {
+		m.errorMessage = fmt.Sprintf("Error listing entries: %v", err)
+		return
 	}
+	m.closePager()
+	m.finder = &finder{items: items, values: values}
+	m.showTable = true
+	m.setInput(pattern)
+	m.refilter()
+}
 
-	content := fmt.Sprintf("%s: %s", selectedRow[0], selectedRow[1])
-	err := clipboard.WriteAll(content)
+// turnPage shows page n of the listing, if it exists, with the cursor on its
+// first or last row
+func (m *model) turnPage(n int, bottom bool) {
+	ok, err := m.pager.goTo(n)
 	if err != nil {
-		m.errorMessage = fmt.Sprintf("Failed to copy: %v", err)
+		m.errorMessage = fmt.Sprintf("Error listing entries: %v", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	m.setRows(m.pager.items())
+	if bottom {
+		m.table.GotoBottom()
 	} else {
-		m.statusMessage = "Copied selected key-value pair to clipboard"
+		m.table.GotoTop()
+	}
+}
+
+// closePager ends the listing shown, if any
+func (m *model) closePager() {
+	if m.pager != nil {
+		m.pager.close()
+		m.pager = nil
+	}
+}
+
+// refilter shows the entries matching the find pattern being typed
+func (m *model) refilter() {
+	m.finder.pattern = m.input.Value()
+	found := m.finder.filter(m.finder.pattern)
+	m.setRows(found)
+	m.table.GotoTop()
+	m.statusMessage = m.finder.prompt(len(found))
+}
+
+// setRows shows entries in the table, truncating long keys and values
+func (m *model) setRows(entries []item) {
+	rows := []table.Row{}
+	for _, entry := range entries {
+		k, v := entry.key, m.shownValue(entry)
+		// Truncate long values and add ellipsis
+		if len(k) > 27 {
+			k = k[:27] + "..."
+		}
+		if len(v) > 47 {
+			v = v[:47] + "..."
+		}
+		rows = append(rows, table.Row{k, v})
+	}
+	m.table.SetRows(rows)
+	m.rowItems = entries
+}
+
+// setPromptedValue stores the value entered for the key awaiting it and restores normal input
+func (m *model) setPromptedValue(value string) {
+	key, contentType, secret := m.setting, m.settingType, m.settingSecret
+	m.setting, m.settingType, m.settingSecret = "", "", false
+	m.input.EchoMode = textinput.EchoNormal
+	if value == "" {
+		m.errorMessage = fmt.Sprintf("Error: Empty value, %s was not set", key)
+		return
+	}
+	if err := m.store.Set(key, wrapValue(value, contentType, secret)); err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
 	}
+	m.recordUndo("set "+key, key)
+	m.statusMessage = fmt.Sprintf("Set %s", key)
+}
 
+// wrapValue returns the stored form of a value given to set
+func wrapValue(value, contentType string, secret bool) string {
+	if secret {
+		return content.WrapSecret(value, contentType)
+	}
+	return content.Wrap(value, contentType)
+}
+
+// shownValue returns the value of an entry as the table shows it: masked, as its
+// size for binary data, or as a summary for a structured entry
+func (m *model) shownValue(entry item) string {
+	value, contentType := content.Unwrap(entry.value)
+	switch {
+	case m.masked(entry):
+		return maskedValue
+	case contentType == content.Binary:
+		return fmt.Sprintf("(%d bytes of binary data)", len(value))
+	}
+	if structured, ok := templates.Decode(value); ok {
+		return structured.Summary()
+	}
+	return value
+}
+
+// masked reports whether an entry's value is hidden in the table and detail pane
+func (m *model) masked(entry item) bool {
+	if entry.key == m.revealed {
+		return false
+	}
+	switch m.settings.mask {
+	case maskAll:
+		return true
+	case maskSecret:
+		return content.IsSecret(entry.value)
+	}
+	return false
+}
+
+// listItems returns the entries whose key contains filter in key order, reading
+// keys from the key index when there is one instead of scanning the store
+func (m *model) listItems(filter string) ([]item, error) {
+	if m.index == nil {
+		entries, err := listEntries(m.store)
+		if err != nil {
+			return nil, err
+		}
+		var items []item
+		for key, value := range entries {
+			if strings.Contains(key, filter) {
+				items = append(items, item{key: key, value: value})
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+		return items, nil
+	}
+
+	var items []item
+	for _, key := range m.index.Filter(filter) {
+		value, err := m.store.Get(key)
+		if errors.Is(err, vault.ErrLocked) {
+			continue // Like scans, listings hide keys of locked contexts
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item{key: key, value: value})
+	}
+	return items, nil
+}
+
+// commandNames are the commands of the UI, completed by Tab
+var commandNames = []string{"add", "contexts", "delete", "filter", "find", "folder", "get", "help", "history", "list", "lock", "logs", "pause", "restore", "resume", "set", "stats", "tag", "tags", "undo", "unlock", "untag", "unwatch", "vault", "watch"}
+
+// completion is the state of cycling through the matches of a completion with
+// repeated Tab presses
+type completion struct {
+	head    string   // input before the completed word
+	matches []string // completed words
+	next    int      // match shown by the next Tab
+	shown   string   // input after the last Tab; editing it ends the cycling
+}
+
+// completeInput completes the command name or key being typed. The first Tab
+// extends the word to the longest prefix its matches share; once it can't be
+// extended, further presses cycle through the matches.
+func (m *model) completeInput() {
+	value := m.input.Value()
+	if c := m.completion; c != nil && value == c.shown {
+		m.showCompletion(c)
+		return
+	}
+	m.completion = nil
+
+	parts := strings.Fields(value)
+	var head, word string
+	var matches []string
+	switch {
+	case len(parts) == 1 && !strings.HasSuffix(value, " "):
+		word = parts[0]
+		for _, name := range commandNames {
+			if strings.HasPrefix(name, word) {
+				matches = append(matches, name)
+			}
+		}
+	case len(parts) == 1 || (len(parts) == 2 && !strings.HasSuffix(value, " ")):
+		switch parts[0] {
+		case "get", "set", "delete", "filter", "history", "restore", "tag", "untag", "folder":
+		default:
+			return
+		}
+		head = parts[0] + " "
+		if len(parts) == 2 {
+			word = parts[1]
+		}
+		var err error
+		if matches, err = m.completeKeys(word); err != nil {
+			m.errorMessage = fmt.Sprintf("Error: %v", err)
+			return
+		}
+	default:
+		return
+	}
+
+	switch common := commonPrefix(matches); {
+	case len(matches) == 0:
+		return
+	case len(matches) == 1:
+		m.setInput(head + matches[0] + " ")
+	case common != word:
+		m.setInput(head + common)
+		m.statusMessage = summarizeMatches(matches)
+	default:
+		m.completion = &completion{head: head, matches: matches}
+		m.showCompletion(m.completion)
+	}
+}
+
+// completeKeys returns the keys starting with prefix, from the key index when
+// there is one and otherwise by scanning the store
+func (m *model) completeKeys(prefix string) ([]string, error) {
+	if m.index != nil {
+		return m.index.Keys(prefix), nil
+	}
+	it, err := lsmtree.PrefixScan(m.store, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys, it.Err()
+}
+
+// showCompletion puts the next match of a completion in the input
+func (m *model) showCompletion(c *completion) {
+	c.shown = c.head + c.matches[c.next]
+	m.setInput(c.shown)
+	m.statusMessage = fmt.Sprintf("%d/%d: %s", c.next+1, len(c.matches), summarizeMatches(c.matches[c.next:]))
+	c.next = (c.next + 1) % len(c.matches)
+}
+
+// setInput replaces the input with the cursor at its end
+func (m *model) setInput(value string) {
+	m.input.SetValue(value)
+	m.input.CursorEnd()
+}
+
+// summarizeMatches lists the first few matches of a completion
+func summarizeMatches(matches []string) string {
+	if len(matches) > 5 {
+		matches = append(matches[:5:5], "...")
+	}
+	return strings.Join(matches, "  ")
+}
+
+// commonPrefix returns the longest prefix shared by sorted words
+func commonPrefix(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
+	// The common prefix of sorted words is that of the first and last
+	first, last := words[0], words[len(words)-1]
+	n := 0
+	for n < len(first) && n < len(last) && first[n] == last[n] {
+		n++
+	}
+	return first[:n]
+}
+
+// listEntries returns every live entry of the store
+func listEntries(store lsmtree.Store) (map[string]string, error) {
+	it, err := store.Scan("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	entries := make(map[string]string)
+	for it.Next() {
+		entries[it.Key()] = it.Value()
+	}
+	return entries, it.Err()
+}
+
+func RunUI(lsm *lsmtree.LSMTree) error {
+	return runUI(lsm, nil, nil, nil, nil, defaultUISettings, "")
+}
+
+// runUI starts the TUI on a store with an initial status message, enabling the
+// context commands when v is set, instant listing and completion when idx is set,
+// the command history when hist is set and locking when session is an encrypted store
+func runUI(store lsmtree.Store, v *vault.Vault, idx *keyindex.Index, session *storeSession, hist *history, settings uiSettings, status string) error {
+	m := initialModel(store, v, idx)
+	if session != nil && session.lockable() {
+		m.session = session
+	}
+	m.lastActive = time.Now()
+	m.statusMessage = status
+	m.history = hist
+	m.settings = settings
+	if m.settings.templates == nil {
+		m.settings.templates = templates.Builtin()
+	}
+	m.caps = detectCapabilities()
+	m.notice = m.caps.notice()
+
+	var options []tea.ProgramOption
+	if m.caps.altScreen {
+		options = append(options, tea.WithAltScreen())
+	}
+	if !m.caps.ttyInput {
+		// Without this the program insists on opening /dev/tty, which containers and CI lack
+		options = append(options, tea.WithInput(os.Stdin))
+	}
+	p := tea.NewProgram(m, options...)
+	final, err := p.Run()
+	if err != nil {
+		return err
+	}
+	if m, ok := final.(model); ok && m.switchTo != "" {
+		return &vaultSwitch{name: m.switchTo}
+	}
 	return nil
 }
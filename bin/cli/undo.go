@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"fmt"
+
+	"Lockr/bin/audit"
+	"Lockr/bin/lsmtree"
+)
+
+// undoEntry is a command of the session that undo reverts, with the writes it made
+type undoEntry struct {
+	command string // what is reported as undone, e.g. "set db/password"
+	steps   []undoStep
+}
+
+// undoStep is a write of a key, known by the version it gave the key, the one
+// before it being what undo puts back
+type undoStep struct {
+	key      string
+	version  uint64 // the key's newest version after the write
+	previous uint64 // the version before, 0 if the key didn't exist
+}
+
+// recordUndo remembers the writes of a command to the given keys for undo.
+// Stores keeping no versions have nothing to undo them with. Only version numbers
+// are read, so the audit log isn't told of it.
+func (m *model) recordUndo(command string, keys ...string) {
+	store, ok := unaudited(m.store).(versioned)
+	if !ok {
+		return
+	}
+	entry := undoEntry{command: command}
+	for _, key := range keys {
+		versions, err := store.Versions(key)
+		if err != nil || len(versions) == 0 {
+			return
+		}
+		newest := versions[len(versions)-1].Number
+		entry.steps = append(entry.steps, undoStep{key: key, version: newest, previous: newest - 1})
+	}
+	m.undo = append(m.undo, entry)
+}
+
+// undoLast reverts the last command of the session that wrote to the store,
+// putting back the versions before its writes
+func (m *model) undoLast() {
+	store, ok := m.store.(versioned)
+	if !ok {
+		m.errorMessage = "Error: This store keeps no versions to undo with"
+		return
+	}
+	if len(m.undo) == 0 {
+		m.statusMessage = "Nothing to undo"
+		return
+	}
+	entry := m.undo[len(m.undo)-1]
+	m.undo = m.undo[:len(m.undo)-1]
+
+	for i := len(entry.steps) - 1; i >= 0; i-- {
+		step := entry.steps[i]
+		if err := m.revert(store, step); err != nil {
+			m.errorMessage = fmt.Sprintf("Error: Can't undo %s: %v", entry.command, err)
+			return
+		}
+	}
+	m.statusMessage = fmt.Sprintf("Undid %s", entry.command)
+}
+
+// revert puts back the version of a key before a write, provided nothing wrote
+// the key since
+func (m *model) revert(store versioned, step undoStep) error {
+	versions, err := store.Versions(step.key)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 || versions[len(versions)-1].Number != step.version {
+		return fmt.Errorf("%s was changed since", step.key)
+	}
+	previous := lsmtree.Version{Deleted: true}
+	if step.previous > 0 {
+		found := false
+		for _, version := range versions {
+			if version.Number == step.previous {
+				previous, found = version, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("version %d of %s isn't kept", step.previous, step.key)
+		}
+	}
+
+	if previous.Deleted {
+		err = m.store.Delete(step.key)
+	} else {
+		err = m.store.Set(step.key, previous.Value)
+	}
+	if err != nil {
+		return err
+	}
+	m.showReverted(step.key, previous.Value)
+
+	// The write undoing this one stands for the previous version in earlier steps
+	if versions, err = store.Versions(step.key); err == nil && len(versions) > 0 {
+		for i := range m.undo {
+			for j := range m.undo[i].steps {
+				if s := &m.undo[i].steps[j]; s.key == step.key && s.version == step.previous {
+					s.version = versions[len(versions)-1].Number
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// showReverted updates the row of a key in the table to its reverted value,
+// dropping it if the key was deleted
+func (m *model) showReverted(key, stored string) {
+	rows := m.rowItems[:0:0]
+	for _, it := range m.rowItems {
+		if it.key == key {
+			if stored == "" {
+				continue
+			}
+			it.value = stored
+		}
+		rows = append(rows, it)
+	}
+	m.replaceRows(rows)
+	if m.detail != nil && m.detail.key == key {
+		m.detail = nil
+	}
+}
+
+// restoreDeleted brings back a deleted key with its newest value before the deletion
+func (m *model) restoreDeleted(key string) {
+	store, ok := m.store.(versioned)
+	if !ok {
+		m.errorMessage = "Error: This store keeps no versions to restore from"
+		return
+	}
+	stored, err := m.store.Get(key)
+	if err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
+	if stored != "" {
+		m.errorMessage = fmt.Sprintf("Error: %s exists; get %s --at <version> shows an older value", key, key)
+		return
+	}
+	versions, err := store.Versions(key)
+	if err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Deleted {
+			continue
+		}
+		if err := m.store.Set(key, versions[i].Value); err != nil {
+			m.errorMessage = fmt.Sprintf("Error: %v", err)
+			return
+		}
+		m.recordUndo("restore "+key, key)
+		m.statusMessage = fmt.Sprintf("Restored %s from version %d of %s", key, versions[i].Number,
+			versions[i].Time.Local().Format("2006-01-02 15:04:05"))
+		return
+	}
+	m.errorMessage = fmt.Sprintf("Error: No value of %s is kept to restore", key)
+}
+
+// unaudited returns the store under an audited one, for reads of the UI's own
+// bookkeeping rather than of the user
+func unaudited(store lsmtree.Store) lsmtree.Store {
+	if audited, ok := store.(*audit.Store); ok {
+		return audited.Unwrap()
+	}
+	return store
+}
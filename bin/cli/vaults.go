@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// vaultSwitch is returned by runUI when `vault switch` quit it to open another
+// vault, which Run then does
+type vaultSwitch struct {
+	name string
+}
+
+func (v *vaultSwitch) Error() string {
+	return fmt.Sprintf("switching to vault %s", v.name)
+}
+
+// vaultCommand lists the vaults, or with switch quits the UI to open another one
+func (m *model) vaultCommand(args []string) {
+	switch {
+	case len(args) == 0 || (len(args) == 1 && args[0] == "list"):
+		if m.settings.vaults == nil {
+			m.statusMessage = "No other vaults can be opened from here"
+			return
+		}
+		lines := []string{"Vaults:"}
+		for _, name := range m.settings.vaults {
+			marker := " "
+			if name == m.settings.vaultName {
+				marker = "*"
+			}
+			lines = append(lines, fmt.Sprintf("%s %s", marker, name))
+		}
+		if !slices.Contains(m.settings.vaults, m.settings.vaultName) {
+			lines = append(lines, "* "+m.settings.vaultName)
+		}
+		m.statusMessage = strings.Join(lines, "\n")
+
+	case len(args) == 2 && args[0] == "switch":
+		if m.settings.vaults == nil {
+			m.errorMessage = "Error: Switching vaults needs a store opened from its data directory"
+			return
+		}
+		if args[1] == m.settings.vaultName {
+			m.statusMessage = fmt.Sprintf("Already in vault %s", args[1])
+			return
+		}
+		if !slices.Contains(m.settings.vaults, args[1]) {
+			m.errorMessage = fmt.Sprintf("Error: No vault %s; `lockr -vault %s` creates it", args[1], args[1])
+			return
+		}
+		m.switchTo = args[1]
+
+	default:
+		m.errorMessage = "Error: Invalid vault command. Usage: vault [list] or vault switch <name>"
+	}
+}
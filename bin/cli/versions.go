@@ -0,0 +1,160 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"Lockr/bin/audit"
+	"Lockr/bin/lsmtree"
+)
+
+// defaultKeepVersions is the number of versions of every key kept by default
+const defaultKeepVersions = 10
+
+// versioned is a store keeping the past values of its keys, like the vault over a local tree
+type versioned interface {
+	Versions(key string) ([]lsmtree.Version, error)
+}
+
+// runHistory lists the versions kept of a key
+func runHistory(store *audit.Store, args []string) error {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	output := outputFlag(flags, outputTable)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: lockr history [--output table|plain|json] <key>")
+	}
+	format, err := parseOutput(*output)
+	if err != nil {
+		return err
+	}
+
+	key := flags.Arg(0)
+	versions, err := store.Versions(key)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case outputJSON:
+		type version struct {
+			Version uint64    `json:"version"`
+			Time    time.Time `json:"time"`
+			Deleted bool      `json:"deleted"`
+			Size    int       `json:"size"`
+		}
+		list := make([]version, 0, len(versions))
+		for _, ver := range versions {
+			list = append(list, version{Version: ver.Number, Time: ver.Time, Deleted: ver.Deleted, Size: len(ver.Value)})
+		}
+		return printJSON(map[string]interface{}{"key": key, "versions": list})
+	case outputPlain:
+		for _, version := range versions {
+			fmt.Printf("%d\t%s\n", version.Number, version.Time.Local().Format(time.RFC3339))
+		}
+		return nil
+	}
+
+	if len(versions) == 0 {
+		fmt.Printf("No versions of %s are kept\n", key)
+		return nil
+	}
+	rows := make([][]string, 0, len(versions))
+	for _, version := range versions {
+		rows = append(rows, []string{strconv.FormatUint(version.Number, 10), version.Time.Local().Format(time.RFC3339), describeVersion(version)})
+	}
+	return printTable([]string{"version", "time", "change"}, rows)
+}
+
+// versionAt returns the version of a key selected by --at: a version number, or
+// the version current at a time
+func versionAt(store versioned, key, at string) (lsmtree.Version, error) {
+	versions, err := store.Versions(key)
+	if err != nil {
+		return lsmtree.Version{}, err
+	}
+	if number, err := strconv.ParseUint(at, 10, 64); err == nil {
+		for _, version := range versions {
+			if version.Number == number {
+				return version, nil
+			}
+		}
+		return lsmtree.Version{}, fmt.Errorf("version %d of %s isn't kept", number, key)
+	}
+	t, err := parseAt(at)
+	if err != nil {
+		return lsmtree.Version{}, err
+	}
+	version, ok := lsmtree.VersionAt(versions, t)
+	if !ok {
+		return lsmtree.Version{}, fmt.Errorf("no version of %s is kept from %s", key, t.Format(time.RFC3339))
+	}
+	return version, nil
+}
+
+// parseAt parses the time of --at: a date or time in local time such as 2026-10-14
+// or 2026-10-14T15:04, an RFC 3339 time, or an age such as 2h or 3d for that long ago
+func parseAt(at string) (time.Time, error) {
+	if age, err := parseAge(at); err == nil {
+		return time.Now().Add(-age), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, at, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --at %q, expected a version number, a time such as 2026-10-14T15:04 or an age such as 2d", at)
+}
+
+// describeVersion summarizes the write of a version without showing its value
+func describeVersion(version lsmtree.Version) string {
+	if version.Deleted {
+		return "deleted"
+	}
+	return fmt.Sprintf("set, %d bytes", len(version.Value))
+}
+
+// getAt returns the stored value of a key, or with at the value of the version it selects
+func (m *model) getAt(key, at string) (string, error) {
+	if at == "" {
+		return m.store.Get(key)
+	}
+	store, ok := m.store.(versioned)
+	if !ok {
+		return "", fmt.Errorf("this store keeps no versions")
+	}
+	version, err := versionAt(store, key, at)
+	if err == nil && version.Deleted {
+		err = fmt.Errorf("version %d of %s is its deletion", version.Number, key)
+	}
+	return version.Value, err
+}
+
+// historyView lists the versions kept of a key for the UI, newest first
+func (m *model) historyView(key string) (string, error) {
+	store, ok := m.store.(versioned)
+	if !ok {
+		return "", fmt.Errorf("this store keeps no versions")
+	}
+	versions, err := store.Versions(key)
+	if err != nil {
+		return "", err
+	}
+	if len(versions) == 0 {
+		return fmt.Sprintf("No versions of %s are kept", key), nil
+	}
+	lines := []string{fmt.Sprintf("Versions of %s, get %s --at <version> shows one:", key, key)}
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+		line := fmt.Sprintf("- %d  %s  %s", version.Number, version.Time.Local().Format("2006-01-02 15:04:05"), describeVersion(version))
+		if i == len(versions)-1 && !version.Deleted {
+			line += " (current)"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,142 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"Lockr/bin/lsmtree"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// watchLines is how many of the latest events the watch pane shows
+const watchLines = 10
+
+// watchable is a store reporting its writes, like the vault or a client of the API
+type watchable interface {
+	Watch(prefix string) (<-chan lsmtree.Event, func(), error)
+}
+
+// watchPane shows the writes to the keys of a prefix as they happen
+type watchPane struct {
+	id      int // tells events of this watch from those of earlier ones
+	prefix  string
+	events  <-chan lsmtree.Event
+	stop    func()
+	waiting bool     // an event is being waited for
+	lines   []string // the latest events, oldest first
+}
+
+// watchEventMsg is an event of a watch, or its end when ok is false
+type watchEventMsg struct {
+	id    int
+	event lsmtree.Event
+	ok    bool
+}
+
+// startWatch shows the writes to keys starting with prefix, in place of those of
+// an earlier watch
+func (m *model) startWatch(prefix string) {
+	store, ok := m.store.(watchable)
+	if !ok {
+		m.errorMessage = "Error: This store can't be watched"
+		return
+	}
+	events, stop, err := store.Watch(prefix)
+	if err != nil {
+		m.errorMessage = fmt.Sprintf("Error: %v", err)
+		return
+	}
+	id := 1
+	if m.watch != nil {
+		id = m.watch.id + 1
+		m.watch.stop()
+	}
+	m.watch = &watchPane{id: id, prefix: prefix, events: events, stop: stop}
+	m.statusMessage = fmt.Sprintf("Watching %s, unwatch stops", describePrefix(prefix))
+}
+
+// stopWatch stops the watch, if any
+func (m *model) stopWatch() {
+	if m.watch != nil {
+		m.watch.stop()
+		m.watch = nil
+	}
+}
+
+// waitWatch waits for the next event of the watch, unless that's already done
+func (m *model) waitWatch() tea.Cmd {
+	w := m.watch
+	if w == nil || w.waiting {
+		return nil
+	}
+	w.waiting = true
+	return func() tea.Msg {
+		event, ok := <-w.events
+		return watchEventMsg{id: w.id, event: event, ok: ok}
+	}
+}
+
+// watchEvent adds an event to the watch pane and waits for the next one
+func (m *model) watchEvent(msg watchEventMsg) tea.Cmd {
+	if m.watch == nil || msg.id != m.watch.id {
+		return nil // Events of a stopped watch
+	}
+	m.watch.waiting = false
+	if !msg.ok {
+		prefix := m.watch.prefix
+		m.stopWatch()
+		m.errorMessage = fmt.Sprintf("Error: Stopped watching %s, the store ended the watch", describePrefix(prefix))
+		return nil
+	}
+	m.watch.lines = append(m.watch.lines, m.eventLine(msg.event))
+	if len(m.watch.lines) > watchLines {
+		m.watch.lines = m.watch.lines[len(m.watch.lines)-watchLines:]
+	}
+	return m.waitWatch()
+}
+
+// eventLine describes an event, with its values shown as the table shows them
+func (m *model) eventLine(event lsmtree.Event) string {
+	line := fmt.Sprintf("%s %-6s %s", time.Now().Format("15:04:05"), event.Type, event.Key)
+	old := ""
+	if event.OldValue != "" {
+		old = truncate(m.shownValue(item{key: event.Key, value: event.OldValue}), 30)
+	}
+	switch {
+	case event.Type == lsmtree.EventDelete && old != "":
+		line += fmt.Sprintf(" (was %s)", old)
+	case event.Type == lsmtree.EventSet && old != "":
+		line += fmt.Sprintf(": %s -> %s", old, truncate(m.shownValue(item{key: event.Key, value: event.NewValue}), 30))
+	case event.Type == lsmtree.EventSet:
+		line += ": " + truncate(m.shownValue(item{key: event.Key, value: event.NewValue}), 30)
+	}
+	return line
+}
+
+// watchView renders the watch pane
+func (m *model) watchView() string {
+	lines := m.watch.lines
+	if len(lines) == 0 {
+		lines = []string{"No writes yet"}
+	}
+	title := fmt.Sprintf("Watching %s:", describePrefix(m.watch.prefix))
+	return statusMessageStyle.Render(title + "\n" + strings.Join(lines, "\n"))
+}
+
+// describePrefix names the keys of a prefix in messages
+func describePrefix(prefix string) string {
+	if prefix == "" {
+		return "all keys"
+	}
+	return prefix + "*"
+}
+
+// truncate shortens s to n characters, ending it with an ellipsis
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-3]) + "..."
+	}
+	return s
+}
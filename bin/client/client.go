@@ -0,0 +1,516 @@
+// Package client is a typed Go client for the Lockr HTTP API described by the
+// OpenAPI document served at /v1/openapi.json. Keep it in step with
+// bin/server/openapi.json: every operation there has a method here.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"Lockr/bin/devicesync"
+	"Lockr/bin/lsmtree"
+)
+
+// maxPageLimit is the largest page the API returns
+const maxPageLimit = 10000
+
+// maxEventSize is the longest line of an event stream read, enough for an event
+// holding two large values
+const maxEventSize = 64 << 20
+
+// Entry is a key-value pair, the Entry schema of the API
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ListOptions selects the entries returned by ListKeys. Empty fields don't restrict the listing.
+type ListOptions struct {
+	Prefix     string
+	Start      string
+	End        string
+	StartAfter string // only keys after this one, e.g. the NextToken of a Page
+	Limit      int    // at most this many entries; for ListPage, the page size
+	KeysOnly   bool   // leave the values out
+}
+
+// Page is one page of a listing, the EntryList schema of the API
+type Page struct {
+	Keys []Entry `json:"keys"`
+	// NextToken is set when more entries match: pass it as ListOptions.StartAfter
+	NextToken string `json:"next_token"`
+}
+
+// BatchOp is an operation of ApplyBatch, the BatchOp schema of the API: a set,
+// or a delete of the key when Delete is true
+type BatchOp struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// Token describes an API token, the Token schema of the API
+type Token struct {
+	Name    string    `json:"name"`
+	Scope   string    `json:"scope"` // read, write or admin
+	Created time.Time `json:"created"`
+}
+
+// NewToken is an added token with its secret, the NewToken schema of the API
+type NewToken struct {
+	Token
+	Secret string `json:"secret"`
+}
+
+// ChangePage is a page of the changes read by GetChanges, the ChangePage schema of the API
+type ChangePage struct {
+	Changes []lsmtree.WALChange `json:"changes"`
+	// Next is the sequence number to pass as since for the next page
+	Next uint64 `json:"next"`
+}
+
+// Health is the Health schema of the API
+type Health struct {
+	Status string `json:"status"`
+}
+
+// Snapshot holds every key-value pair of a leader, the Snapshot schema of the API
+type Snapshot struct {
+	// Seq is the sequence number to read the changes after, to catch up with the
+	// writes made since the snapshot
+	Seq     uint64  `json:"seq"`
+	Entries []Entry `json:"entries"`
+}
+
+// Error is a failed API request, the Error schema of the API
+type Error struct {
+	StatusCode int
+	Message    string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("lockr API: %s (HTTP %d)", e.Message, e.StatusCode)
+}
+
+// Client calls the Lockr HTTP API of a server
+type Client struct {
+	baseURL string
+	http    *http.Client
+	token   string
+}
+
+var _ lsmtree.ContextStore = (*Client)(nil)
+
+// New creates a Client for the server at baseURL, e.g. "http://127.0.0.1:8080"
+func New(baseURL string) *Client {
+	return NewWithHTTPClient(baseURL, http.DefaultClient)
+}
+
+// NewWithHTTPClient creates a Client that sends requests with the given HTTP client
+func NewWithHTTPClient(baseURL string, httpClient *http.Client) *Client {
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), http: httpClient}
+}
+
+// NewUnix creates a Client for a server listening on the unix socket at path,
+// like the agent
+func NewUnix(path string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}
+	return NewWithHTTPClient("http://lockr-agent", &http.Client{Transport: transport})
+}
+
+// SetToken sets the bearer token sent with every request, for servers that require tokens
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// ListKeys calls listKeys and returns the matching entries in key order, up to
+// opts.Limit if set, fetching as many pages as needed
+func (c *Client) ListKeys(ctx context.Context, opts ListOptions) ([]Entry, error) {
+	limit := opts.Limit
+	var entries []Entry
+	for {
+		if limit > 0 {
+			opts.Limit = min(limit-len(entries), maxPageLimit)
+		}
+		page, err := c.ListPage(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, page.Keys...)
+		if page.NextToken == "" || (limit > 0 && len(entries) >= limit) {
+			return entries, nil
+		}
+		opts.StartAfter = page.NextToken
+	}
+}
+
+// ListPage calls listKeys once and returns a page of the matching entries in
+// key order. The server picks the page size unless opts.Limit is set.
+func (c *Client) ListPage(ctx context.Context, opts ListOptions) (Page, error) {
+	query := url.Values{}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Start != "" {
+		query.Set("start", opts.Start)
+	}
+	if opts.End != "" {
+		query.Set("end", opts.End)
+	}
+	if opts.StartAfter != "" {
+		query.Set("start-after", opts.StartAfter)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.KeysOnly {
+		query.Set("values", "false")
+	}
+	path := "/v1/keys"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var page Page
+	err := c.do(ctx, http.MethodGet, path, nil, &page)
+	return page, err
+}
+
+// GetKey calls getKey. A missing key is returned as an *Error with status 404.
+func (c *Client) GetKey(ctx context.Context, key string) (Entry, error) {
+	var e Entry
+	err := c.do(ctx, http.MethodGet, keyPath(key), nil, &e)
+	return e, err
+}
+
+// PutKey calls putKey and returns the stored entry
+func (c *Client) PutKey(ctx context.Context, key, value string) (Entry, error) {
+	var e Entry
+	err := c.do(ctx, http.MethodPut, keyPath(key), map[string]string{"value": value}, &e)
+	return e, err
+}
+
+// DeleteKey calls deleteKey
+func (c *Client) DeleteKey(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, keyPath(key), nil, nil)
+}
+
+// ApplyBatch calls applyBatch, which applies all of ops in order or none of them
+func (c *Client) ApplyBatch(ctx context.Context, ops []BatchOp) error {
+	return c.do(ctx, http.MethodPost, "/v1/batch", map[string][]BatchOp{"ops": ops}, nil)
+}
+
+// WatchChanges calls watchChanges and returns a channel of the writes to keys
+// starting with prefix, the Event schema of the API. The channel is closed when
+// ctx is done or the server ends the stream, e.g. because the client fell behind.
+func (c *Client) WatchChanges(ctx context.Context, prefix string) (<-chan lsmtree.Event, error) {
+	path := "/v1/watch?" + url.Values{"prefix": {prefix}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call GET %s: %w", path, err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+
+	events := make(chan lsmtree.Event)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(nil, maxEventSize)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue // the id and event lines repeat the data, and comments keep the stream alive
+			}
+			var event lsmtree.Event
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// ListTokens calls listTokens
+func (c *Client) ListTokens(ctx context.Context) ([]Token, error) {
+	var list struct {
+		Tokens []Token `json:"tokens"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/tokens", nil, &list)
+	return list.Tokens, err
+}
+
+// AddToken calls addToken and returns the token with its secret, which the
+// server doesn't show again
+func (c *Client) AddToken(ctx context.Context, name, scope string) (NewToken, error) {
+	var token NewToken
+	err := c.do(ctx, http.MethodPost, "/v1/tokens", map[string]string{"name": name, "scope": scope}, &token)
+	return token, err
+}
+
+// RevokeToken calls revokeToken
+func (c *Client) RevokeToken(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/tokens/"+url.PathEscape(name), nil, nil)
+}
+
+// GetChanges calls getChanges, returning at most limit changes after since, or
+// the server's default page size when limit is 0
+func (c *Client) GetChanges(ctx context.Context, since uint64, limit int) (ChangePage, error) {
+	query := url.Values{"since": {strconv.FormatUint(since, 10)}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var page ChangePage
+	err := c.do(ctx, http.MethodGet, "/v1/replication/changes?"+query.Encode(), nil, &page)
+	return page, err
+}
+
+// GetSnapshot calls getSnapshot
+func (c *Client) GetSnapshot(ctx context.Context) (Snapshot, error) {
+	var snap Snapshot
+	err := c.do(ctx, http.MethodGet, "/v1/replication/snapshot", nil, &snap)
+	return snap, err
+}
+
+// Sync calls sync, sending the server a changeset and returning its answer
+func (c *Client) Sync(ctx context.Context, in devicesync.Changeset) (devicesync.Changeset, error) {
+	var out devicesync.Changeset
+	err := c.do(ctx, http.MethodPost, "/v1/sync", in, &out)
+	return out, err
+}
+
+// GetStats calls getStats and returns the statistics of the server's storage engine
+func (c *Client) GetStats(ctx context.Context) (lsmtree.Stats, error) {
+	var stats lsmtree.Stats
+	err := c.do(ctx, http.MethodGet, "/v1/stats", nil, &stats)
+	return stats, err
+}
+
+// ReclaimSpace calls reclaimSpace and returns the space the server's storage engine freed
+func (c *Client) ReclaimSpace(ctx context.Context) (lsmtree.ReclaimResult, error) {
+	var result lsmtree.ReclaimResult
+	err := c.do(ctx, http.MethodPost, "/v1/gc", nil, &result)
+	return result, err
+}
+
+// GetHealth calls getHealth and returns the result of the server's health check
+func (c *Client) GetHealth(ctx context.Context) (Health, error) {
+	var health Health
+	err := c.do(ctx, http.MethodGet, "/v1/health", nil, &health)
+	return health, err
+}
+
+// GetOpenAPI calls getOpenAPI and returns the server's OpenAPI document
+func (c *Client) GetOpenAPI(ctx context.Context) (json.RawMessage, error) {
+	var doc json.RawMessage
+	err := c.do(ctx, http.MethodGet, "/v1/openapi.json", nil, &doc)
+	return doc, err
+}
+
+// keyPath returns the request path of a key, escaping each slash-separated segment
+func keyPath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return "/v1/keys/" + strings.Join(segments, "/")
+}
+
+// do sends a request with an optional JSON body and decodes a JSON response into out
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// responseError returns the Error of a failed response
+func responseError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
+
+// Get retrieves the value for a key, returning an empty string if it doesn't exist
+func (c *Client) Get(key string) (string, error) {
+	return c.GetCtx(context.Background(), key)
+}
+
+// GetCtx is like Get, with the request cancelled when ctx is done
+func (c *Client) GetCtx(ctx context.Context, key string) (string, error) {
+	e, err := c.GetKey(ctx, key)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	return e.Value, err
+}
+
+// Set adds or updates a key-value pair
+func (c *Client) Set(key, value string) error {
+	return c.SetCtx(context.Background(), key, value)
+}
+
+// SetCtx is like Set, with the request cancelled when ctx is done
+func (c *Client) SetCtx(ctx context.Context, key, value string) error {
+	_, err := c.PutKey(ctx, key, value)
+	return err
+}
+
+// Delete removes a key-value pair
+func (c *Client) Delete(key string) error {
+	return c.DeleteKey(context.Background(), key)
+}
+
+// DeleteCtx is like Delete, with the request cancelled when ctx is done
+func (c *Client) DeleteCtx(ctx context.Context, key string) error {
+	return c.DeleteKey(ctx, key)
+}
+
+// Scan returns an iterator over the entries in [start, end), fetched up front
+func (c *Client) Scan(start, end string) (lsmtree.Iterator, error) {
+	return c.ScanCtx(context.Background(), start, end)
+}
+
+// ScanCtx is like Scan, with the requests cancelled when ctx is done
+func (c *Client) ScanCtx(ctx context.Context, start, end string) (lsmtree.Iterator, error) {
+	entries, err := c.ListKeys(ctx, ListOptions{Start: start, End: end})
+	if err != nil {
+		return nil, err
+	}
+	return &entryIterator{entries: entries, pos: -1}, nil
+}
+
+// Batch applies all operations in the batch atomically
+func (c *Client) Batch(batch *lsmtree.WriteBatch) error {
+	return c.BatchCtx(context.Background(), batch)
+}
+
+// BatchCtx is like Batch, with the request cancelled when ctx is done
+func (c *Client) BatchCtx(ctx context.Context, batch *lsmtree.WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	ops := make([]BatchOp, 0, batch.Len())
+	for _, op := range batch.Ops() {
+		ops = append(ops, BatchOp{Key: op.Key, Value: op.Value, Delete: op.Delete})
+	}
+	return c.ApplyBatch(ctx, ops)
+}
+
+// Watch returns a channel of the writes to keys starting with prefix and a
+// function that stops watching, like lsmtree.LSMTree.Watch
+func (c *Client) Watch(prefix string) (<-chan lsmtree.Event, func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := c.WatchChanges(ctx, prefix)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return events, cancel, nil
+}
+
+// Stats returns the statistics of the server's storage engine, like
+// lsmtree.LSMTree.Stats
+func (c *Client) Stats() (lsmtree.Stats, error) {
+	return c.GetStats(context.Background())
+}
+
+// Reclaim frees the space of the deleted entries of the server's storage engine,
+// like lsmtree.LSMTree.Reclaim
+func (c *Client) Reclaim() (lsmtree.ReclaimResult, error) {
+	return c.ReclaimSpace(context.Background())
+}
+
+// Close releases idle connections
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+// entryIterator iterates over entries returned by the API
+type entryIterator struct {
+	entries []Entry
+	pos     int
+}
+
+func (it *entryIterator) Next() bool {
+	if it.pos+1 >= len(it.entries) {
+		it.pos = len(it.entries)
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *entryIterator) Key() string   { return it.entries[it.pos].Key }
+func (it *entryIterator) Value() string { return it.entries[it.pos].Value }
+func (it *entryIterator) Err() error    { return nil }
+func (it *entryIterator) Close() error  { return nil }
@@ -0,0 +1,270 @@
+// Package cluster runs a tree as a node of a Raft cluster: writes are committed to
+// the replicated log by a majority of the nodes before every node applies them to
+// its tree, and reads wait until the node has applied every write committed before
+// them, so the cluster serves linearizable reads and writes while a majority of its
+// nodes are up. The log is kept in records of each node's tree.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/raft"
+)
+
+// Records of a node's tree: its ID, the entry its tree applied, and the Raft state
+// and log
+const (
+	idRecord        = "cluster/id"
+	appliedRecord   = "cluster/applied"
+	stateRecord     = "cluster/state"
+	snapshotRecord  = "cluster/snapshot"
+	logRecordPrefix = "cluster/log/"
+)
+
+const (
+	// requestTimeout bounds how long a read or write waits for the cluster
+	requestTimeout = 10 * time.Second
+	// retryInterval is how long a request waits for a leader to be elected before trying again
+	retryInterval = 50 * time.Millisecond
+)
+
+// Options configures a node started with Start
+type Options struct {
+	ID        string
+	Transport raft.Transport
+	// Peers gives the founding members by ID with their Raft addresses when
+	// starting a new cluster. A new node without them waits to be added.
+	Peers             map[string]string
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+	SnapshotThreshold uint64
+}
+
+// Store is the store of a cluster node. Writes go to the cluster's leader and
+// return once committed and applied by this node.
+type Store struct {
+	tree *lsmtree.LSMTree
+	node *raft.Node
+}
+
+var _ lsmtree.ContextStore = (*Store)(nil)
+
+// Start makes tree a node of a cluster, read-only but for the committed writes. A
+// tree joining a cluster for the first time must be empty.
+func Start(tree *lsmtree.LSMTree, opts Options) (*Store, error) {
+	id, err := Member(tree)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case id == "":
+		entries, err := tree.List()
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			return nil, fmt.Errorf("a store joining a cluster must be empty, this one has %d keys", len(entries))
+		}
+		if err := tree.SetRecord(idRecord, opts.ID); err != nil {
+			return nil, fmt.Errorf("failed to record the node ID: %w", err)
+		}
+	case id != opts.ID:
+		return nil, fmt.Errorf("this store is node %s of its cluster, not %s", id, opts.ID)
+	}
+	tree.SetReadOnly(true)
+
+	node, err := raft.Start(raft.Options{
+		ID:                opts.ID,
+		Storage:           &treeStorage{tree: tree},
+		StateMachine:      &machine{tree: tree},
+		Transport:         opts.Transport,
+		Bootstrap:         opts.Peers,
+		HeartbeatInterval: opts.HeartbeatInterval,
+		ElectionTimeout:   opts.ElectionTimeout,
+		SnapshotThreshold: opts.SnapshotThreshold,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start raft node: %w", err)
+	}
+	return &Store{tree: tree, node: node}, nil
+}
+
+// Member returns the ID of the node tree is in its cluster, or "" if it isn't one
+func Member(tree *lsmtree.LSMTree) (string, error) {
+	id, err := tree.Record(idRecord)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the cluster node ID: %w", err)
+	}
+	return id, nil
+}
+
+// Detach makes the tree of a stopped node a standalone, writable store again with
+// the keys it had applied, forgetting its cluster
+func Detach(tree *lsmtree.LSMTree) error {
+	records, err := tree.Records("cluster/")
+	if err != nil {
+		return fmt.Errorf("failed to read the cluster records: %w", err)
+	}
+	for name := range records {
+		records[name] = ""
+	}
+	if err := tree.SetRecords(records); err != nil {
+		return fmt.Errorf("failed to remove the cluster records: %w", err)
+	}
+	tree.SetReadOnly(false)
+	return nil
+}
+
+// Node returns the Raft node, to serve its peers' requests and report its status
+func (s *Store) Node() *raft.Node {
+	return s.node
+}
+
+// Get retrieves the value for a key once every earlier write is applied
+func (s *Store) Get(key string) (string, error) {
+	return s.GetCtx(context.Background(), key)
+}
+
+// GetCtx is like Get, giving up when ctx is done before the node caught up
+func (s *Store) GetCtx(ctx context.Context, key string) (string, error) {
+	if err := s.barrier(ctx); err != nil {
+		return "", err
+	}
+	return s.tree.GetCtx(ctx, key)
+}
+
+// Set adds or updates a key-value pair across the cluster
+func (s *Store) Set(key, value string) error {
+	return s.SetCtx(context.Background(), key, value)
+}
+
+// SetCtx is like Set, giving up when ctx is done before the write is committed.
+// A write given up on may still be committed later.
+func (s *Store) SetCtx(ctx context.Context, key, value string) error {
+	return s.propose(ctx, []lsmtree.BatchOp{{Key: key, Value: value}})
+}
+
+// Delete removes a key-value pair across the cluster
+func (s *Store) Delete(key string) error {
+	return s.DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx is like Delete, giving up when ctx is done as SetCtx does
+func (s *Store) DeleteCtx(ctx context.Context, key string) error {
+	return s.propose(ctx, []lsmtree.BatchOp{{Key: key, Delete: true}})
+}
+
+// Batch applies all operations of the batch across the cluster, together
+func (s *Store) Batch(batch *lsmtree.WriteBatch) error {
+	return s.BatchCtx(context.Background(), batch)
+}
+
+// BatchCtx is like Batch, giving up when ctx is done as SetCtx does
+func (s *Store) BatchCtx(ctx context.Context, batch *lsmtree.WriteBatch) error {
+	return s.propose(ctx, batch.Ops())
+}
+
+// Scan returns an iterator over the live keys in [start, end) once every earlier
+// write is applied
+func (s *Store) Scan(start, end string) (lsmtree.Iterator, error) {
+	return s.ScanCtx(context.Background(), start, end)
+}
+
+// ScanCtx is like Scan, giving up when ctx is done before the node caught up or
+// its tree is read
+func (s *Store) ScanCtx(ctx context.Context, start, end string) (lsmtree.Iterator, error) {
+	if err := s.barrier(ctx); err != nil {
+		return nil, err
+	}
+	return s.tree.ScanCtx(ctx, start, end)
+}
+
+// Versions returns the past values of a key this node recorded, once every earlier
+// write is applied
+func (s *Store) Versions(key string) ([]lsmtree.Version, error) {
+	if err := s.barrier(context.Background()); err != nil {
+		return nil, err
+	}
+	return s.tree.Versions(key)
+}
+
+// Watch reports the writes this node applies to keys under prefix
+func (s *Store) Watch(prefix string) (<-chan lsmtree.Event, func(), error) {
+	return s.tree.Watch(prefix)
+}
+
+// Stats returns the statistics of this node's tree
+func (s *Store) Stats() lsmtree.Stats {
+	return s.tree.Stats()
+}
+
+// Reclaim rewrites the SSTables of this node's tree to free the space of deleted
+// entries. Each node reclaims its own.
+func (s *Store) Reclaim() (lsmtree.ReclaimResult, error) {
+	return s.tree.Reclaim()
+}
+
+// Close stops the node, leaving the tree open
+func (s *Store) Close() error {
+	s.node.Stop()
+	return nil
+}
+
+// propose commits writes to the cluster's log and waits for this node to apply them
+func (s *Store) propose(ctx context.Context, ops []lsmtree.BatchOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if err := lsmtree.CheckReserved(ops); err != nil {
+		return err
+	}
+	changes := make([]lsmtree.WALChange, 0, len(ops))
+	for _, op := range ops {
+		change := lsmtree.WALChange{Type: lsmtree.EventSet, Key: op.Key, Value: op.Value}
+		if op.Delete {
+			change = lsmtree.WALChange{Type: lsmtree.EventDelete, Key: op.Key}
+		}
+		changes = append(changes, change)
+	}
+	command, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	err = untilLeader(ctx, func(ctx context.Context) error { return s.node.Propose(ctx, command) })
+	if err != nil {
+		return fmt.Errorf("failed to commit write: %w", err)
+	}
+	return nil
+}
+
+// barrier waits until this node applied every write committed so far
+func (s *Store) barrier(ctx context.Context) error {
+	if err := untilLeader(ctx, s.node.Barrier); err != nil {
+		return fmt.Errorf("failed to reach the cluster: %w", err)
+	}
+	return nil
+}
+
+// untilLeader calls fn again while the cluster is electing a leader, up to
+// requestTimeout or until ctx is done. The errors retried are returned before
+// anything is appended.
+func untilLeader(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	for {
+		err := fn(ctx)
+		if !errors.Is(err, raft.ErrNoLeader) && !errors.Is(err, raft.ErrNotLeader) {
+			return err
+		}
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
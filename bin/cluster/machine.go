@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/raft"
+)
+
+// machine applies the committed writes of the cluster to a node's tree. A command
+// is the JSON of the writes of a Set, Delete or Batch as WAL changes.
+type machine struct {
+	tree *lsmtree.LSMTree
+}
+
+var _ raft.StateMachine = (*machine)(nil)
+
+// Apply applies the writes of a command. Commands every node rejects alike, such as
+// writes to reserved keys, are skipped.
+func (m *machine) Apply(index uint64, command []byte) error {
+	var changes []lsmtree.WALChange
+	if err := json.Unmarshal(command, &changes); err == nil {
+		if err := m.tree.ApplyChanges(changes); err != nil && !errors.Is(err, lsmtree.ErrReservedKey) {
+			return err
+		}
+	}
+	// A write applied again after a crash before this record leaves the same state
+	return m.setApplied(index)
+}
+
+// Applied returns the last entry applied, once the writes up to it are synced
+func (m *machine) Applied() (uint64, error) {
+	if err := m.tree.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync: %w", err)
+	}
+	value, err := m.tree.Record(appliedRecord)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	index, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse the applied entry %q: %w", value, err)
+	}
+	return index, nil
+}
+
+// Snapshot returns the JSON of every key of the tree
+func (m *machine) Snapshot() ([]byte, error) {
+	entries, err := m.tree.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %w", err)
+	}
+	return json.Marshal(entries)
+}
+
+// Restore replaces every key of the tree with a snapshot's
+func (m *machine) Restore(index uint64, snapshot []byte) error {
+	var entries map[string]string
+	if err := json.Unmarshal(snapshot, &entries); err != nil {
+		return fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	if err := m.tree.ApplySnapshot(entries); err != nil {
+		return fmt.Errorf("failed to apply snapshot: %w", err)
+	}
+	return m.setApplied(index)
+}
+
+func (m *machine) setApplied(index uint64) error {
+	if err := m.tree.SetRecord(appliedRecord, strconv.FormatUint(index, 10)); err != nil {
+		return fmt.Errorf("failed to record the applied entry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/raft"
+)
+
+// treeStorage keeps a node's Raft log and state in records of its tree, one per
+// entry, synced to disk whatever the WAL sync policy
+type treeStorage struct {
+	tree  *lsmtree.LSMTree
+	mutex sync.Mutex
+	first uint64 // the first stored entry, once loaded
+	last  uint64 // the last stored entry, or the snapshot's
+}
+
+var _ raft.Storage = (*treeStorage)(nil)
+
+// logRecord returns the name of the record of the entry at index, ordered by index
+func logRecord(index uint64) string {
+	return fmt.Sprintf("%s%020d", logRecordPrefix, index)
+}
+
+// Load returns the state, snapshot and entries kept in the tree
+func (s *treeStorage) Load() (raft.HardState, raft.SnapshotMeta, []raft.Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var state raft.HardState
+	var snap raft.SnapshotMeta
+	if err := s.load(stateRecord, &state); err != nil {
+		return state, snap, nil, err
+	}
+	if err := s.load(snapshotRecord, &snap); err != nil {
+		return state, snap, nil, err
+	}
+	records, err := s.tree.Records(logRecordPrefix)
+	if err != nil {
+		return state, snap, nil, fmt.Errorf("failed to read raft log: %w", err)
+	}
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]raft.Entry, 0, len(names))
+	for _, name := range names {
+		index, err := strconv.ParseUint(strings.TrimPrefix(name, logRecordPrefix), 10, 64)
+		if err != nil {
+			return state, snap, nil, fmt.Errorf("failed to parse raft log record %q: %w", name, err)
+		}
+		if index <= snap.Index {
+			continue
+		}
+		var entry raft.Entry
+		if err := json.Unmarshal([]byte(records[name]), &entry); err != nil {
+			return state, snap, nil, fmt.Errorf("failed to parse raft log entry %d: %w", index, err)
+		}
+		if entry.Index != snap.Index+uint64(len(entries))+1 {
+			return state, snap, nil, fmt.Errorf("raft log is missing entry %d", snap.Index+uint64(len(entries))+1)
+		}
+		entries = append(entries, entry)
+	}
+	s.first, s.last = snap.Index+1, snap.Index+uint64(len(entries))
+	return state, snap, entries, nil
+}
+
+// load decodes the JSON of a record into v, leaving it alone if there's none
+func (s *treeStorage) load(name string, v interface{}) error {
+	value, err := s.tree.Record(name)
+	if err != nil || value == "" {
+		return err
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// SetState replaces the state
+func (s *treeStorage) SetState(state raft.HardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.write(map[string]string{stateRecord: string(data)})
+}
+
+// Append stores entries following the last stored one
+func (s *treeStorage) Append(entries []raft.Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	records := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		records[logRecord(entry.Index)] = string(data)
+	}
+	if err := s.write(records); err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		s.last = entries[len(entries)-1].Index
+	}
+	return nil
+}
+
+// Truncate removes the entries from index on
+func (s *treeStorage) Truncate(index uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	index = max(index, s.first)
+	records := make(map[string]string)
+	for i := index; i <= s.last; i++ {
+		records[logRecord(i)] = ""
+	}
+	if err := s.write(records); err != nil {
+		return err
+	}
+	s.last = min(s.last, index-1)
+	return nil
+}
+
+// Compact removes the entries up to meta.Index and records meta
+func (s *treeStorage) Compact(meta raft.SnapshotMeta) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	records := map[string]string{snapshotRecord: string(data)}
+	for i := s.first; i <= min(meta.Index, s.last); i++ {
+		records[logRecord(i)] = ""
+	}
+	if err := s.write(records); err != nil {
+		return err
+	}
+	s.first, s.last = meta.Index+1, max(s.last, meta.Index)
+	return nil
+}
+
+// write sets records in one write and syncs it
+func (s *treeStorage) write(records map[string]string) error {
+	if err := s.tree.SetRecords(records); err != nil {
+		return fmt.Errorf("failed to write raft log: %w", err)
+	}
+	if err := s.tree.Sync(); err != nil {
+		return fmt.Errorf("failed to sync raft log: %w", err)
+	}
+	return nil
+}
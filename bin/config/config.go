@@ -0,0 +1,352 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables read by Path and Load
+const (
+	// PathEnv names the config file instead of the default location
+	PathEnv = "LOCKR_CONFIG"
+	// envPrefix prefixes the variables overriding top-level settings, e.g.
+	// LOCKR_DATA_DIR for data_dir
+	envPrefix = "LOCKR_"
+)
+
+// defaultDataDirName is the data directory in the home folder when none is configured
+const defaultDataDirName = ".Lockr"
+
+// DefaultStore is the name of the store in the data directory itself
+const DefaultStore = "default"
+
+// storeNamePattern is what the name of a store may look like
+var storeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Config holds the settings of config.toml. Zero fields weren't set, so the
+// defaults of the command line flags apply.
+type Config struct {
+	DataDir        string            // data_dir, where the default store lives
+	CacheSize      int               // cache_size, entries held in the engine's cache
+	BlockCacheSize int64             // block_cache_size, bytes of decompressed blocks cached
+	Sync           string            // sync, the WAL sync policy: always, interval or never
+	SyncInterval   time.Duration     // sync_interval, e.g. "10ms"
+	SyncMaxBytes   int64             // sync_max_bytes, unsynced WAL bytes that trigger an early fsync
+	WALArchive     string            // wal_archive, where WAL segments are moved instead of deleted
+	Theme          string            // theme, the colors of the UI
+	Stores         map[string]string // [stores] table, the directories of named stores
+}
+
+// setting is a top-level key of config.toml
+type setting struct {
+	quoted bool // whether the value is a string, rather than a number
+	set    func(c *Config, value string) error
+}
+
+// settings are the top-level keys of config.toml, also overridable with
+// LOCKR_<KEY> environment variables
+var settings = map[string]setting{
+	"data_dir": {true, func(c *Config, value string) error {
+		dir, err := expandHome(value)
+		c.DataDir = dir
+		return err
+	}},
+	"cache_size": {false, func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("cache_size must be a positive number of entries")
+		}
+		c.CacheSize = n
+		return nil
+	}},
+	"block_cache_size": {false, func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("block_cache_size must be a positive number of bytes")
+		}
+		c.BlockCacheSize = n
+		return nil
+	}},
+	"sync": {true, func(c *Config, value string) error {
+		c.Sync = value
+		return nil
+	}},
+	"sync_interval": {true, func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("sync_interval must be a positive duration, e.g. \"10ms\"")
+		}
+		c.SyncInterval = d
+		return nil
+	}},
+	"sync_max_bytes": {false, func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("sync_max_bytes must be a positive number of bytes")
+		}
+		c.SyncMaxBytes = n
+		return nil
+	}},
+	"wal_archive": {true, func(c *Config, value string) error {
+		dir, err := expandHome(value)
+		c.WALArchive = dir
+		return err
+	}},
+	"theme": {true, func(c *Config, value string) error {
+		c.Theme = value
+		return nil
+	}},
+}
+
+// Path returns the config file: $LOCKR_CONFIG if it's set, otherwise
+// lockr/config.toml under $XDG_CONFIG_HOME or ~/.config
+func Path() (string, error) {
+	if path := os.Getenv(PathEnv); path != "" {
+		return path, nil
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "lockr", "config.toml"), nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".config", "lockr", "config.toml"), nil
+}
+
+// Load reads the config file at path, which may not exist, then applies the
+// LOCKR_<KEY> environment variables over its top-level settings
+func Load(path string) (Config, error) {
+	var c Config
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// No file, only the environment
+	} else if err != nil {
+		return c, fmt.Errorf("failed to open config file: %w", err)
+	} else {
+		defer f.Close()
+		if err := c.parse(f, path); err != nil {
+			return c, err
+		}
+	}
+
+	for _, key := range sortedSettings() {
+		value := os.Getenv(envPrefix + strings.ToUpper(key))
+		if value == "" {
+			continue
+		}
+		if err := settings[key].set(&c, value); err != nil {
+			return c, fmt.Errorf("invalid %s%s: %w", envPrefix, strings.ToUpper(key), err)
+		}
+	}
+	return c, nil
+}
+
+// parse reads the subset of TOML config.toml is written in: comments, key =
+// value pairs of strings and integers, and the [stores] table
+func (c *Config) parse(f *os.File, path string) error {
+	scanner := bufio.NewScanner(f)
+	table := ""
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			end := strings.Index(text, "]")
+			if end < 0 || !isComment(text[end+1:]) {
+				return fmt.Errorf("%s:%d: malformed table header", path, line)
+			}
+			table = strings.TrimSpace(text[1:end])
+			if table != "stores" {
+				return fmt.Errorf("%s:%d: unknown table [%s]", path, line, table)
+			}
+			continue
+		}
+
+		key, rest, ok := strings.Cut(text, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected key = value", path, line)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		value, quoted, err := parseValue(strings.TrimSpace(rest))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		if table == "stores" {
+			if !storeNamePattern.MatchString(key) || key == DefaultStore {
+				return fmt.Errorf("%s:%d: invalid store name %q", path, line, key)
+			}
+			if !quoted {
+				return fmt.Errorf("%s:%d: the directory of store %s must be a string", path, line, key)
+			}
+			dir, err := expandHome(value)
+			if err != nil {
+				return err
+			}
+			if c.Stores == nil {
+				c.Stores = make(map[string]string)
+			}
+			c.Stores[key] = dir
+			continue
+		}
+		s, ok := settings[key]
+		if !ok {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, line, key)
+		}
+		if quoted != s.quoted {
+			kind := "a number"
+			if s.quoted {
+				kind = "a string"
+			}
+			return fmt.Errorf("%s:%d: %s must be %s", path, line, key, kind)
+		}
+		if err := s.set(c, value); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	return nil
+}
+
+// parseValue parses a TOML string or integer followed by an optional comment,
+// and reports whether it was a string
+func parseValue(text string) (string, bool, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		// A basic string, with escapes
+		for end := 1; end < len(text); end++ {
+			if text[end] == '\\' {
+				end++
+				continue
+			}
+			if text[end] == '"' {
+				value, err := strconv.Unquote(text[:end+1])
+				if err != nil || !isComment(text[end+1:]) {
+					return "", false, fmt.Errorf("malformed string %s", text)
+				}
+				return value, true, nil
+			}
+		}
+		return "", false, fmt.Errorf("unterminated string %s", text)
+	case strings.HasPrefix(text, "'"):
+		// A literal string, taken as is
+		end := strings.Index(text[1:], "'")
+		if end < 0 || !isComment(text[end+2:]) {
+			return "", false, fmt.Errorf("malformed string %s", text)
+		}
+		return text[1 : end+1], true, nil
+	}
+	value, _, _ := strings.Cut(text, "#")
+	value = strings.ReplaceAll(strings.TrimSpace(value), "_", "")
+	if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+		return "", false, fmt.Errorf("expected a string or an integer, got %s", text)
+	}
+	return value, false, nil
+}
+
+// isComment reports whether what follows a value is blank or a comment
+func isComment(text string) bool {
+	text = strings.TrimSpace(text)
+	return text == "" || strings.HasPrefix(text, "#")
+}
+
+// sortedSettings returns the top-level keys in a stable order
+func sortedSettings() []string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expandHome replaces a leading ~ of a path by the user's home directory
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
+	}
+	return filepath.Join(homeDir, path[1:]), nil
+}
+
+// StoreDir returns the data directory of a store: the default one for an empty
+// name or DefaultStore, otherwise the named store's directory from [stores], or
+// a sibling of the default one suffixed with the name, e.g. ~/.Lockr-work.
+// dataDir, set with a flag, overrides data_dir and LOCKR_DATA_DIR.
+func (c Config) StoreDir(dataDir, name string) (string, error) {
+	dataDir, err := c.defaultDir(dataDir)
+	if err != nil {
+		return "", err
+	}
+	if name == "" || name == DefaultStore {
+		return dataDir, nil
+	}
+	if !storeNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid store name %q", name)
+	}
+	if dir, ok := c.Stores[name]; ok {
+		return dir, nil
+	}
+	return filepath.Clean(dataDir) + "-" + name, nil
+}
+
+// StoreNames returns the names of the stores StoreDir finds: DefaultStore, those
+// of [stores] and the siblings of the default one, sorted with DefaultStore first
+func (c Config) StoreNames(dataDir string) ([]string, error) {
+	dataDir, err := c.defaultDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for name := range c.Stores {
+		found[name] = true
+	}
+	prefix := filepath.Clean(dataDir) + "-"
+	siblings, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stores: %w", err)
+	}
+	for _, dir := range siblings {
+		name := strings.TrimPrefix(dir, prefix)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() && storeNamePattern.MatchString(name) && name != DefaultStore {
+			found[name] = true
+		}
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{DefaultStore}, names...), nil
+}
+
+// defaultDir returns the directory of the default store: dataDir if it's set,
+// otherwise data_dir or ~/.Lockr
+func (c Config) defaultDir(dataDir string) (string, error) {
+	if dataDir == "" {
+		dataDir = c.DataDir
+	}
+	if dataDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get user home directory: %w", err)
+		}
+		dataDir = filepath.Join(homeDir, defaultDataDirName)
+	}
+	return dataDir, nil
+}
@@ -0,0 +1,260 @@
+// Package content records the content type of stored values and formats values
+// for display according to it
+package content
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Content types that are sniffed and rendered specially. Any other type/subtype
+// can be set explicitly and is shown as is.
+const (
+	TextPlain = "text/plain"
+	JSON      = "application/json"
+	PEM       = "application/x-pem-file"
+	Binary    = "application/octet-stream"
+)
+
+// header starts a stored value with an explicit content type or flags:
+//
+//	header [type] *(";" flag) "\n" value
+//
+// Without a type the value's type is sniffed. The NUL byte keeps it from
+// clashing with text values, which never contain one.
+const header = "\x00ct:"
+
+// secretFlag marks a value as secret in its header
+const secretFlag = "secret"
+
+// Flags of the header holding a tag of the value, one flag per tag, and the
+// folder it's filed in
+const (
+	tagFlag    = "tag="
+	folderFlag = "folder="
+)
+
+// Wrap returns the stored form of a value with an explicit content type. Without
+// a type the value is stored as is and its type is sniffed when it's read.
+func Wrap(value, contentType string) string {
+	if contentType == "" {
+		return value
+	}
+	return header + contentType + "\n" + value
+}
+
+// WrapSecret is Wrap for a value flagged as secret, which UIs mask until revealed
+func WrapSecret(value, contentType string) string {
+	return header + contentType + ";" + secretFlag + "\n" + value
+}
+
+// Unwrap returns a stored value and its content type: the one given to Wrap, or
+// the sniffed one for values stored without a type
+func Unwrap(stored string) (value, contentType string) {
+	value, contentType, _ = parse(stored)
+	if contentType == "" {
+		contentType = Sniff(value)
+	}
+	return value, contentType
+}
+
+// IsSecret reports whether a stored value is flagged as secret
+func IsSecret(stored string) bool {
+	_, _, flags := parse(stored)
+	for _, flag := range flags {
+		if flag == secretFlag {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace returns the stored form of value with the explicit content type and
+// flags of stored
+func Replace(stored, value string) string {
+	_, contentType, flags := parse(stored)
+	return build(value, contentType, flags)
+}
+
+// Tags returns the tags of a stored value in the order they were added
+func Tags(stored string) []string {
+	_, _, flags := parse(stored)
+	var tags []string
+	for _, flag := range flags {
+		if tag, ok := strings.CutPrefix(flag, tagFlag); ok {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Folder returns the folder a stored value is filed in, "" if none
+func Folder(stored string) string {
+	_, _, flags := parse(stored)
+	for _, flag := range flags {
+		if folder, ok := strings.CutPrefix(flag, folderFlag); ok {
+			return folder
+		}
+	}
+	return ""
+}
+
+// AddTag returns stored with tag added, unchanged if it already has the tag
+func AddTag(stored, tag string) string {
+	value, contentType, flags := parse(stored)
+	for _, flag := range flags {
+		if flag == tagFlag+tag {
+			return stored
+		}
+	}
+	return build(value, contentType, append(flags, tagFlag+tag))
+}
+
+// RemoveTag returns stored without tag
+func RemoveTag(stored, tag string) string {
+	value, contentType, flags := parse(stored)
+	return build(value, contentType, without(flags, func(flag string) bool { return flag == tagFlag+tag }))
+}
+
+// SetFolder returns stored filed in folder, or in none if folder is ""
+func SetFolder(stored, folder string) string {
+	value, contentType, flags := parse(stored)
+	flags = without(flags, func(flag string) bool { return strings.HasPrefix(flag, folderFlag) })
+	if folder != "" {
+		flags = append(flags, folderFlag+folder)
+	}
+	return build(value, contentType, flags)
+}
+
+// Flag returns the value of a "name=value" flag of a stored value, reporting
+// false if it has none. Packages storing values of their own keep metadata in
+// such flags, which don't change how the value is shown.
+func Flag(stored, name string) (string, bool) {
+	_, _, flags := parse(stored)
+	for _, flag := range flags {
+		if value, ok := strings.CutPrefix(flag, name+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// SetFlag returns stored with the flag name set to value, which must not hold
+// semicolons or newlines
+func SetFlag(stored, name, value string) string {
+	v, contentType, flags := parse(stored)
+	flags = without(flags, func(flag string) bool { return strings.HasPrefix(flag, name+"=") })
+	return build(v, contentType, append(flags, name+"="+value))
+}
+
+// ValidateTag checks that a tag can be stored in a header: non-empty, without
+// spaces, semicolons or commas
+func ValidateTag(tag string) error {
+	if tag == "" || strings.ContainsAny(tag, ";,") || strings.ContainsFunc(tag, unicode.IsSpace) {
+		return fmt.Errorf("invalid tag %q: tags can't be empty or contain spaces, semicolons or commas", tag)
+	}
+	return nil
+}
+
+// CleanFolder validates a folder path like "work/aws", dropping leading and
+// trailing slashes; "" and "/" are the top level, no folder
+func CleanFolder(folder string) (string, error) {
+	folder = strings.Trim(folder, "/")
+	if folder == "" {
+		return "", nil
+	}
+	for _, part := range strings.Split(folder, "/") {
+		if part == "" || strings.ContainsAny(part, ";") || strings.ContainsFunc(part, unicode.IsControl) {
+			return "", fmt.Errorf("invalid folder %q: folders are names separated by single slashes, without semicolons", folder)
+		}
+	}
+	return folder, nil
+}
+
+// InFolder reports whether folder is parent or one of its subfolders
+func InFolder(folder, parent string) bool {
+	return folder == parent || strings.HasPrefix(folder, parent+"/")
+}
+
+// build returns the stored form of a value with an explicit content type and flags
+func build(value, contentType string, flags []string) string {
+	if len(flags) == 0 {
+		return Wrap(value, contentType)
+	}
+	return header + contentType + ";" + strings.Join(flags, ";") + "\n" + value
+}
+
+// without returns the flags drop doesn't match
+func without(flags []string, drop func(string) bool) []string {
+	var kept []string
+	for _, flag := range flags {
+		if !drop(flag) {
+			kept = append(kept, flag)
+		}
+	}
+	return kept
+}
+
+// parse splits a stored value into its value, explicit content type and flags
+func parse(stored string) (value, contentType string, flags []string) {
+	if rest, ok := strings.CutPrefix(stored, header); ok {
+		if meta, value, ok := strings.Cut(rest, "\n"); ok {
+			contentType, rest, _ := strings.Cut(meta, ";")
+			if rest != "" {
+				flags = strings.Split(rest, ";")
+			}
+			return value, contentType, flags
+		}
+	}
+	return stored, "", nil
+}
+
+// Sniff guesses the content type of a value from its contents
+func Sniff(value string) string {
+	if !utf8.ValidString(value) || strings.ContainsFunc(value, isBinary) {
+		return Binary
+	}
+	trimmed := strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(trimmed, "-----BEGIN "):
+		return PEM
+	case (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)):
+		return JSON
+	default:
+		return TextPlain
+	}
+}
+
+// isBinary reports whether a character doesn't occur in text
+func isBinary(r rune) bool {
+	return unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t'
+}
+
+// Validate checks that a content type has the type/subtype form
+func Validate(contentType string) error {
+	kind, subtype, ok := strings.Cut(contentType, "/")
+	if !ok || kind == "" || subtype == "" || strings.ContainsFunc(contentType, unicode.IsSpace) {
+		return fmt.Errorf("invalid content type %q, expected e.g. %s", contentType, JSON)
+	}
+	return nil
+}
+
+// Render formats a value for display by its content type: JSON indented, binary
+// values as a hex dump and everything else as is
+func Render(value, contentType string) string {
+	switch contentType {
+	case JSON:
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, []byte(value), "", "  "); err == nil {
+			return indented.String()
+		}
+	case Binary:
+		return strings.TrimSuffix(hex.Dump([]byte(value)), "\n")
+	}
+	return value
+}
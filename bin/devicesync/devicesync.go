@@ -0,0 +1,519 @@
+// Package devicesync keeps the stores of several devices, such as a laptop and a
+// desktop, in step by exchanging the changes each made since they last synced,
+// directly over the HTTP API or through a folder synced between them.
+//
+// Every key carries a clock: when and on which device it was last written. A
+// device's changes are numbered by a sequence number of its own, and each device
+// remembers how far it got with every other, so a sync only carries what the
+// other side hasn't merged yet. When both sides changed a key since they last
+// synced, the last write wins on both and the losing value is kept next to it
+// under a conflict copy key, the same on both devices.
+package devicesync
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"Lockr/bin/lsmtree"
+)
+
+// Records of a device's tree: its ID, its latest sequence number, how far its
+// clocks follow the WAL, the clocks of its keys and what it synced with each peer
+const (
+	deviceRecord = "sync/device"
+	seqRecord    = "sync/seq"
+	feedRecord   = "sync/feed"
+	clockPrefix  = "sync/clock/"
+	peerPrefix   = "sync/peer/"
+	namePrefix   = "sync/name/"
+)
+
+// conflictInfix separates a key from the device and time of the value kept in its conflict copy
+const conflictInfix = ".conflict-"
+
+// ErrSameDevice is returned when syncing a store with itself
+var ErrSameDevice = errors.New("devicesync: can't sync a device with itself")
+
+// Change is the write of a key that a device sends another
+type Change struct {
+	Key     string    `json:"key"`
+	Value   string    `json:"value,omitempty"` // as stored, encrypted for encryption contexts
+	Deleted bool      `json:"deleted,omitempty"`
+	Time    time.Time `json:"time"`
+	Device  string    `json:"device"` // the device the write was made on
+	Seq     uint64    `json:"seq"`    // the sender's sequence number of the change
+}
+
+// Changeset is what a device sends another when they sync
+type Changeset struct {
+	Device string `json:"device"`
+	// From and Seq are the sender's sequence numbers Changes follow on from and go up to
+	From uint64 `json:"from"`
+	Seq  uint64 `json:"seq"`
+	// Received is the recipient's sequence number up to which the sender merged its changes
+	Received uint64   `json:"received"`
+	Changes  []Change `json:"changes"`
+	// Hello asks the recipient for its device ID alone, merging nothing
+	Hello bool `json:"hello,omitempty"`
+}
+
+// Result describes what a sync exchanged
+type Result struct {
+	Devices   int // the devices synced with
+	Sent      int
+	Received  int      // changes merged, not counting those already known
+	Conflicts []string // the conflict copies written
+}
+
+// clock is what a device knows of the last write of a key
+type clock struct {
+	Time    time.Time `json:"time"`
+	Device  string    `json:"device"`
+	Seq     uint64    `json:"seq"`  // the local sequence number it was recorded at
+	Hash    string    `json:"hash"` // of the value, to tell unrelated writes to the key from it
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// before reports whether the write the clock records loses to one at t on device
+func (c clock) before(t time.Time, device string) bool {
+	return c.Time.Before(t) || (c.Time.Equal(t) && c.Device < device)
+}
+
+// peer is what a device synced with another
+type peer struct {
+	Sent     uint64 `json:"sent"`     // this device's sequence number the peer merged up to
+	Received uint64 `json:"received"` // the peer's sequence number merged up to
+}
+
+// Syncer syncs a device's tree with other devices
+type Syncer struct {
+	tree   *lsmtree.LSMTree
+	mutex  sync.Mutex
+	device string
+}
+
+// Open returns the syncer of a tree, giving the device a random ID on first use
+func Open(tree *lsmtree.LSMTree) (*Syncer, error) {
+	device, err := tree.Record(deviceRecord)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the device ID: %w", err)
+	}
+	if device == "" {
+		id := make([]byte, 6)
+		if _, err := rand.Read(id); err != nil {
+			return nil, fmt.Errorf("failed to generate a device ID: %w", err)
+		}
+		device = hex.EncodeToString(id)
+		if err := tree.SetRecord(deviceRecord, device); err != nil {
+			return nil, fmt.Errorf("failed to record the device ID: %w", err)
+		}
+	}
+	s := &Syncer{tree: tree, device: device}
+	// Clocks follow the WAL from now on, so later writes keep the time they were made
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Device returns the ID of this device
+func (s *Syncer) Device() string {
+	return s.device
+}
+
+// Sync syncs with the peer reached through exchange, which sends a changeset to
+// the peer's Exchange and returns its answer. name tells the peers apart before
+// their device ID is known, e.g. the URL of the peer's server.
+func (s *Syncer) Sync(name string, exchange func(Changeset) (Changeset, error)) (Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.refresh(); err != nil {
+		return Result{}, err
+	}
+	known, err := s.tree.Record(namePrefix + name)
+	if err != nil {
+		return Result{}, err
+	}
+	if known == "" {
+		// What this device synced with the peer is only known by its ID
+		hello, err := exchange(Changeset{Device: s.device, Changes: []Change{}, Hello: true})
+		if err != nil {
+			return Result{}, err
+		}
+		if hello.Device == s.device {
+			return Result{}, ErrSameDevice
+		}
+		known = hello.Device
+		if err := s.tree.SetRecord(namePrefix+name, known); err != nil {
+			return Result{}, fmt.Errorf("failed to record peer: %w", err)
+		}
+	}
+	state, err := s.peer(known)
+	if err != nil {
+		return Result{}, err
+	}
+	out, in, err := s.send(known, state, exchange)
+	if err != nil {
+		return Result{}, err
+	}
+	if in.Device != known {
+		if err := s.tree.SetRecord(namePrefix+name, in.Device); err != nil {
+			return Result{}, fmt.Errorf("failed to record peer: %w", err)
+		}
+		// Another device answers at that name now: send again what it's missing
+		sent := state
+		if state, err = s.peer(in.Device); err != nil {
+			return Result{}, err
+		}
+		if state != sent {
+			if out, in, err = s.send(in.Device, state, exchange); err != nil {
+				return Result{}, err
+			}
+		}
+	}
+	result, err := s.merge(in.Changes, state.Sent)
+	if err != nil {
+		return Result{}, err
+	}
+	result.Devices, result.Sent = 1, len(out.Changes)
+	return result, s.setPeer(in.Device, peer{Sent: in.Received, Received: in.Seq})
+}
+
+// send sends a peer the changes it hasn't merged and returns them with its answer
+func (s *Syncer) send(device string, state peer, exchange func(Changeset) (Changeset, error)) (Changeset, Changeset, error) {
+	out, err := s.changeset(state.Sent, state.Received, device)
+	if err != nil {
+		return out, Changeset{}, err
+	}
+	in, err := exchange(out)
+	if err != nil {
+		return out, in, err
+	}
+	if in.Device == s.device {
+		return out, in, ErrSameDevice
+	}
+	return out, in, nil
+}
+
+// Exchange merges the changeset a peer sent and answers with the changes of this
+// device the peer hasn't merged yet
+func (s *Syncer) Exchange(in Changeset) (Changeset, Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if in.Device == s.device {
+		return Changeset{}, Result{}, ErrSameDevice
+	}
+	if in.Hello {
+		return Changeset{Device: s.device, Changes: []Change{}}, Result{}, nil
+	}
+	if err := s.refresh(); err != nil {
+		return Changeset{}, Result{}, err
+	}
+	state, err := s.peer(in.Device)
+	if err != nil {
+		return Changeset{}, Result{}, err
+	}
+	// Changes following on from further than this device merged leave a gap, so the
+	// peer is told to send them again from where this device is
+	received := in.Seq
+	if in.From > state.Received {
+		received = state.Received
+	}
+	out, err := s.changeset(in.Received, received, in.Device)
+	if err != nil {
+		return Changeset{}, Result{}, err
+	}
+	result, err := s.merge(in.Changes, in.Received)
+	if err != nil {
+		return Changeset{}, Result{}, err
+	}
+	result.Devices, result.Sent = 1, len(out.Changes)
+	// The peer already has what this device merged from it, and the conflict copies it writes too
+	if out.Seq, err = s.seq(); err != nil {
+		return Changeset{}, Result{}, err
+	}
+	state.Sent, state.Received = out.Seq, received
+	if err := s.setPeer(in.Device, state); err != nil {
+		return Changeset{}, Result{}, err
+	}
+	return out, result, nil
+}
+
+// changeset returns the changes recorded after since, for a peer that merged this
+// device's changes up to since and whose changes this device merged up to received,
+// leaving out the writes made on the peer when it's known
+func (s *Syncer) changeset(since, received uint64, to string) (Changeset, error) {
+	seq, err := s.seq()
+	if err != nil {
+		return Changeset{}, err
+	}
+	clocks, err := s.clocks()
+	if err != nil {
+		return Changeset{}, err
+	}
+	entries, err := s.tree.List()
+	if err != nil {
+		return Changeset{}, fmt.Errorf("failed to list keys: %w", err)
+	}
+	out := Changeset{Device: s.device, From: since, Seq: seq, Received: received, Changes: []Change{}}
+	for key, c := range clocks {
+		if c.Seq <= since || (to != "" && c.Device == to) {
+			continue
+		}
+		out.Changes = append(out.Changes, Change{Key: key, Value: entries[key], Deleted: c.Deleted, Time: c.Time, Device: c.Device, Seq: c.Seq})
+	}
+	sort.Slice(out.Changes, func(i, j int) bool { return out.Changes[i].Seq < out.Changes[j].Seq })
+	return out, nil
+}
+
+// merge merges a peer's changes. unseen is this device's sequence number the
+// peer had merged up to before the changes, so the keys this device changed
+// after it were changed on both sides.
+func (s *Syncer) merge(changes []Change, unseen uint64) (Result, error) {
+	clocks, err := s.clocks()
+	if err != nil {
+		return Result{}, err
+	}
+	seq, err := s.seq()
+	if err != nil {
+		return Result{}, err
+	}
+	var result Result
+	batch := lsmtree.NewWriteBatch()
+	records := make(map[string]string)
+	record := func(key string, c clock) error {
+		seq++
+		c.Seq = seq
+		clocks[key] = c
+		data, err := json.Marshal(c)
+		records[clockPrefix+key] = string(data)
+		return err
+	}
+	keep := func(key, value string, t time.Time, device string) error {
+		copyKey := conflictKey(key, t, device)
+		batch.Set(copyKey, value)
+		result.Conflicts = append(result.Conflicts, copyKey)
+		return record(copyKey, clock{Time: t, Device: device, Hash: hash(value, false)})
+	}
+
+	for _, change := range changes {
+		if lsmtree.CheckReserved([]lsmtree.BatchOp{{Key: change.Key}}) != nil {
+			continue
+		}
+		local, ok := clocks[change.Key]
+		if ok && local.Time.Equal(change.Time) && local.Device == change.Device {
+			continue
+		}
+		// Writes made one after the other on a device, or echoed back to it, aren't concurrent
+		changedHere := ok && local.Seq > unseen && local.Hash != hash(change.Value, change.Deleted) &&
+			local.Device != change.Device && change.Device != s.device
+		if ok && !local.before(change.Time, change.Device) {
+			// This device's write wins, keeping the peer's value if it was concurrent
+			if changedHere && !change.Deleted {
+				if err := keep(change.Key, change.Value, change.Time, change.Device); err != nil {
+					return Result{}, err
+				}
+			}
+			continue
+		}
+		if changedHere && !local.Deleted {
+			value, err := s.tree.Get(change.Key)
+			if err != nil {
+				return Result{}, err
+			}
+			if err := keep(change.Key, value, local.Time, local.Device); err != nil {
+				return Result{}, err
+			}
+		}
+		if change.Deleted {
+			batch.Delete(change.Key)
+		} else {
+			batch.Set(change.Key, change.Value)
+		}
+		if err := record(change.Key, clock{Time: change.Time, Device: change.Device, Hash: hash(change.Value, change.Deleted), Deleted: change.Deleted}); err != nil {
+			return Result{}, err
+		}
+		result.Received++
+	}
+	if batch.Len() == 0 {
+		return result, nil
+	}
+	if err := s.tree.Batch(batch); err != nil {
+		return Result{}, fmt.Errorf("failed to apply changes: %w", err)
+	}
+	records[seqRecord] = strconv.FormatUint(seq, 10)
+	if err := s.tree.SetRecords(records); err != nil {
+		return Result{}, fmt.Errorf("failed to record clocks: %w", err)
+	}
+	return result, nil
+}
+
+// refresh gives a clock to the keys written on this device since the last sync,
+// from the WAL or, when its writes are gone, by comparing every key with its clock.
+// The keys written before the device first synced get the zero time, losing to any
+// write made since on another device.
+func (s *Syncer) refresh() error {
+	clocks, err := s.clocks()
+	if err != nil {
+		return err
+	}
+	seq, err := s.seq()
+	if err != nil {
+		return err
+	}
+	records := make(map[string]string)
+	update := func(key, value string, deleted bool, t time.Time) error {
+		c, ok := clocks[key]
+		h := hash(value, deleted)
+		if (ok && c.Hash == h) || (!ok && deleted) {
+			return nil
+		}
+		if ok && !t.After(c.Time) {
+			// The WAL dates writes to the millisecond, but this write replaced the
+			// one of the key's clock and must win over it everywhere
+			t = c.Time.Add(time.Nanosecond)
+		}
+		seq++
+		c = clock{Time: t.UTC(), Device: s.device, Seq: seq, Hash: h, Deleted: deleted}
+		clocks[key] = c
+		data, err := json.Marshal(c)
+		records[clockPrefix+key] = string(data)
+		return err
+	}
+
+	feed, err := s.tree.Record(feedRecord)
+	if err != nil {
+		return err
+	}
+	var next uint64
+	var scanned time.Time // when the writes found by comparing were made, for all that's known
+	if feed != "" {
+		since, err := strconv.ParseUint(feed, 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse the WAL position %q: %w", feed, err)
+		}
+		latest := make(map[string]lsmtree.WALChange)
+		next, err = s.tree.ReadChanges(since, func(change lsmtree.WALChange) error {
+			latest[change.Key] = change
+			return nil
+		})
+		if errors.Is(err, lsmtree.ErrChangesGone) {
+			feed, scanned = "", time.Now()
+		} else if err != nil {
+			return fmt.Errorf("failed to read changes: %w", err)
+		}
+		for key, change := range latest {
+			if err := update(key, change.Value, change.Type == lsmtree.EventDelete, change.Time); err != nil {
+				return err
+			}
+		}
+	}
+	if feed == "" {
+		next = s.tree.ChangesHead()
+		entries, err := s.tree.List()
+		if err != nil {
+			return fmt.Errorf("failed to list keys: %w", err)
+		}
+		for key, value := range entries {
+			if err := update(key, value, false, scanned); err != nil {
+				return err
+			}
+		}
+		for key, c := range clocks {
+			if _, ok := entries[key]; !ok && !c.Deleted {
+				if err := update(key, "", true, scanned); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	records[seqRecord] = strconv.FormatUint(seq, 10)
+	records[feedRecord] = strconv.FormatUint(next, 10)
+	if err := s.tree.SetRecords(records); err != nil {
+		return fmt.Errorf("failed to record clocks: %w", err)
+	}
+	return nil
+}
+
+// clocks returns the clocks of the keys by key
+func (s *Syncer) clocks() (map[string]clock, error) {
+	records, err := s.tree.Records(clockPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read clocks: %w", err)
+	}
+	clocks := make(map[string]clock, len(records))
+	for name, value := range records {
+		var c clock
+		if err := json.Unmarshal([]byte(value), &c); err != nil {
+			return nil, fmt.Errorf("failed to parse clock of %q: %w", name, err)
+		}
+		clocks[strings.TrimPrefix(name, clockPrefix)] = c
+	}
+	return clocks, nil
+}
+
+// seq returns this device's latest sequence number
+func (s *Syncer) seq() (uint64, error) {
+	value, err := s.tree.Record(seqRecord)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	seq, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse the sequence number %q: %w", value, err)
+	}
+	return seq, nil
+}
+
+// peer returns what this device synced with another, nothing for an unknown one
+func (s *Syncer) peer(device string) (peer, error) {
+	var state peer
+	if device == "" {
+		return state, nil
+	}
+	value, err := s.tree.Record(peerPrefix + device)
+	if err != nil || value == "" {
+		return state, err
+	}
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return state, fmt.Errorf("failed to parse the sync state of %s: %w", device, err)
+	}
+	return state, nil
+}
+
+func (s *Syncer) setPeer(device string, state peer) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := s.tree.SetRecord(peerPrefix+device, string(data)); err != nil {
+		return fmt.Errorf("failed to record the sync state of %s: %w", device, err)
+	}
+	return nil
+}
+
+// conflictKey returns the key a value written at t on device is kept under when
+// it lost a conflict on key
+func conflictKey(key string, t time.Time, device string) string {
+	return key + conflictInfix + device + "-" + t.UTC().Format("20060102T150405")
+}
+
+// hash identifies a value, or a deletion
+func hash(value string, deleted bool) string {
+	if deleted {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,187 @@
+package devicesync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// A device syncing through a folder keeps every change it knows of in a file of
+// its own there, encrypted with a passphrase shared by the devices
+const (
+	folderExt    = ".lockrsync"
+	folderFormat = "lockr-sync-1"
+
+	folderArgon2Time    = 3
+	folderArgon2Memory  = 64 * 1024 // KiB
+	folderArgon2Threads = 4
+)
+
+// ErrWrongPassphrase is returned when a device's file in a sync folder was
+// written with another passphrase
+var ErrWrongPassphrase = errors.New("devicesync: wrong sync passphrase")
+
+// folderFile is a device's file in a sync folder
+type folderFile struct {
+	Format string `json:"format"`
+	Salt   []byte `json:"salt"`
+	// Data is the nonce followed by the AES-256-GCM sealed JSON of the folderState
+	Data []byte `json:"data"`
+}
+
+// folderState is what a device's file in a sync folder holds: every change of the
+// device, and how far it merged the files of the others
+type folderState struct {
+	Changeset
+	Merged map[string]uint64 `json:"merged"`
+}
+
+// SyncFolder syncs with the devices whose files are in dir, a folder synced
+// between them such as a Dropbox one: it merges their changes this device hasn't
+// merged yet, then writes its own file for them to read
+func (s *Syncer) SyncFolder(dir, passphrase string) (Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.refresh(); err != nil {
+		return Result{}, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+folderExt))
+	if err != nil {
+		return Result{}, err
+	}
+	var result Result
+	for _, path := range paths {
+		if filepath.Base(path) == s.device+folderExt {
+			continue
+		}
+		other, err := readFolderFile(path, passphrase)
+		if err != nil {
+			return result, err
+		}
+		if other.Device == s.device {
+			continue
+		}
+		state, err := s.peer(other.Device)
+		if err != nil {
+			return result, err
+		}
+		var changes []Change
+		for _, change := range other.Changes {
+			if change.Seq > state.Received {
+				changes = append(changes, change)
+			}
+		}
+		merged, err := s.merge(changes, other.Merged[s.device])
+		if err != nil {
+			return result, err
+		}
+		result.Received += merged.Received
+		result.Conflicts = append(result.Conflicts, merged.Conflicts...)
+		if err := s.setPeer(other.Device, peer{Sent: other.Merged[s.device], Received: other.Seq}); err != nil {
+			return result, err
+		}
+		result.Devices++
+	}
+
+	own := folderState{Merged: make(map[string]uint64)}
+	if own.Changeset, err = s.changeset(0, 0, ""); err != nil {
+		return result, err
+	}
+	peers, err := s.tree.Records(peerPrefix)
+	if err != nil {
+		return result, fmt.Errorf("failed to read the sync state: %w", err)
+	}
+	for name := range peers {
+		device := strings.TrimPrefix(name, peerPrefix)
+		state, err := s.peer(device)
+		if err != nil {
+			return result, err
+		}
+		own.Merged[device] = state.Received
+	}
+	result.Sent = len(own.Changes)
+	return result, writeFolderFile(filepath.Join(dir, s.device+folderExt), passphrase, own)
+}
+
+// readFolderFile reads and decrypts a device's file in a sync folder
+func readFolderFile(path, passphrase string) (folderState, error) {
+	var state folderState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, fmt.Errorf("failed to read sync file: %w", err)
+	}
+	var file folderFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Format != folderFormat {
+		return state, fmt.Errorf("%s isn't a Lockr sync file", path)
+	}
+	aead, err := folderAEAD(passphrase, file.Salt)
+	if err != nil {
+		return state, err
+	}
+	if len(file.Data) < aead.NonceSize() {
+		return state, fmt.Errorf("%s is truncated", path)
+	}
+	plain, err := aead.Open(nil, file.Data[:aead.NonceSize()], file.Data[aead.NonceSize():], []byte(folderFormat))
+	if err != nil {
+		return state, fmt.Errorf("%w for %s", ErrWrongPassphrase, path)
+	}
+	if err := json.Unmarshal(plain, &state); err != nil {
+		return state, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// writeFolderFile encrypts and writes a device's file in a sync folder, replacing
+// the previous one at once so the other devices never read half of it
+func writeFolderFile(path, passphrase string, state folderState) error {
+	plain, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	file := folderFile{Format: folderFormat, Salt: make([]byte, 16)}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	aead, err := folderAEAD(passphrase, file.Salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	file.Data = aead.Seal(nonce, nonce, plain, []byte(folderFormat))
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write sync file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write sync file: %w", err)
+	}
+	return nil
+}
+
+// folderAEAD returns the AES-256-GCM cipher of the key derived from passphrase and salt
+func folderAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), salt, folderArgon2Time, folderArgon2Memory, folderArgon2Threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
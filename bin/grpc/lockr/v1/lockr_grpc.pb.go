@@ -0,0 +1,409 @@
+// The Lockr gRPC service: the operations of the HTTP API, with listings, the
+// change feed and batches streamed.
+//
+// The Go package bin/grpc/lockr/v1 is generated from it with protoc-gen-go and
+// protoc-gen-go-grpc; regenerate it after changing this file.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: lockr/v1/lockr.proto
+
+package lockrv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Lockr_Get_FullMethodName          = "/lockr.v1.Lockr/Get"
+	Lockr_Set_FullMethodName          = "/lockr.v1.Lockr/Set"
+	Lockr_Delete_FullMethodName       = "/lockr.v1.Lockr/Delete"
+	Lockr_Scan_FullMethodName         = "/lockr.v1.Lockr/Scan"
+	Lockr_WatchChanges_FullMethodName = "/lockr.v1.Lockr/WatchChanges"
+	Lockr_BatchWrite_FullMethodName   = "/lockr.v1.Lockr/BatchWrite"
+)
+
+// LockrClient is the client API for Lockr service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type LockrClient interface {
+	// Get returns the value of a key, NOT_FOUND if it doesn't exist
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Entry, error)
+	// Set sets the value of a key, which must not be empty
+	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*Entry, error)
+	// Delete removes a key; deleting a missing key succeeds
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Scan streams the entries in [start, end) in key order
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (Lockr_ScanClient, error)
+	// WatchChanges streams the writes of keys starting with prefix as they're applied
+	WatchChanges(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Lockr_WatchChangesClient, error)
+	// BatchWrite applies the streamed operations together once the stream is
+	// closed: all of them in order or, on failure, none
+	BatchWrite(ctx context.Context, opts ...grpc.CallOption) (Lockr_BatchWriteClient, error)
+}
+
+type lockrClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLockrClient(cc grpc.ClientConnInterface) LockrClient {
+	return &lockrClient{cc}
+}
+
+func (c *lockrClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Entry, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Entry)
+	err := c.cc.Invoke(ctx, Lockr_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *lockrClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*Entry, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Entry)
+	err := c.cc.Invoke(ctx, Lockr_Set_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *lockrClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, Lockr_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *lockrClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (Lockr_ScanClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Lockr_ServiceDesc.Streams[0], Lockr_Scan_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &lockrScanClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Lockr_ScanClient interface {
+	Recv() (*Entry, error)
+	grpc.ClientStream
+}
+
+type lockrScanClient struct {
+	grpc.ClientStream
+}
+
+func (x *lockrScanClient) Recv() (*Entry, error) {
+	m := new(Entry)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *lockrClient) WatchChanges(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Lockr_WatchChangesClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Lockr_ServiceDesc.Streams[1], Lockr_WatchChanges_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &lockrWatchChangesClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Lockr_WatchChangesClient interface {
+	Recv() (*Change, error)
+	grpc.ClientStream
+}
+
+type lockrWatchChangesClient struct {
+	grpc.ClientStream
+}
+
+func (x *lockrWatchChangesClient) Recv() (*Change, error) {
+	m := new(Change)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *lockrClient) BatchWrite(ctx context.Context, opts ...grpc.CallOption) (Lockr_BatchWriteClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Lockr_ServiceDesc.Streams[2], Lockr_BatchWrite_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &lockrBatchWriteClient{ClientStream: stream}
+	return x, nil
+}
+
+type Lockr_BatchWriteClient interface {
+	Send(*BatchOp) error
+	CloseAndRecv() (*BatchWriteResponse, error)
+	grpc.ClientStream
+}
+
+type lockrBatchWriteClient struct {
+	grpc.ClientStream
+}
+
+func (x *lockrBatchWriteClient) Send(m *BatchOp) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *lockrBatchWriteClient) CloseAndRecv() (*BatchWriteResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(BatchWriteResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LockrServer is the server API for Lockr service.
+// All implementations must embed UnimplementedLockrServer
+// for forward compatibility
+type LockrServer interface {
+	// Get returns the value of a key, NOT_FOUND if it doesn't exist
+	Get(context.Context, *GetRequest) (*Entry, error)
+	// Set sets the value of a key, which must not be empty
+	Set(context.Context, *SetRequest) (*Entry, error)
+	// Delete removes a key; deleting a missing key succeeds
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Scan streams the entries in [start, end) in key order
+	Scan(*ScanRequest, Lockr_ScanServer) error
+	// WatchChanges streams the writes of keys starting with prefix as they're applied
+	WatchChanges(*WatchRequest, Lockr_WatchChangesServer) error
+	// BatchWrite applies the streamed operations together once the stream is
+	// closed: all of them in order or, on failure, none
+	BatchWrite(Lockr_BatchWriteServer) error
+	mustEmbedUnimplementedLockrServer()
+}
+
+// UnimplementedLockrServer must be embedded to have forward compatible implementations.
+type UnimplementedLockrServer struct {
+}
+
+func (UnimplementedLockrServer) Get(context.Context, *GetRequest) (*Entry, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedLockrServer) Set(context.Context, *SetRequest) (*Entry, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Set not implemented")
+}
+func (UnimplementedLockrServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedLockrServer) Scan(*ScanRequest, Lockr_ScanServer) error {
+	return status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (UnimplementedLockrServer) WatchChanges(*WatchRequest, Lockr_WatchChangesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchChanges not implemented")
+}
+func (UnimplementedLockrServer) BatchWrite(Lockr_BatchWriteServer) error {
+	return status.Errorf(codes.Unimplemented, "method BatchWrite not implemented")
+}
+func (UnimplementedLockrServer) mustEmbedUnimplementedLockrServer() {}
+
+// UnsafeLockrServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LockrServer will
+// result in compilation errors.
+type UnsafeLockrServer interface {
+	mustEmbedUnimplementedLockrServer()
+}
+
+func RegisterLockrServer(s grpc.ServiceRegistrar, srv LockrServer) {
+	s.RegisterService(&Lockr_ServiceDesc, srv)
+}
+
+func _Lockr_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LockrServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Lockr_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LockrServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Lockr_Set_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LockrServer).Set(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Lockr_Set_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LockrServer).Set(ctx, req.(*SetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Lockr_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LockrServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Lockr_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LockrServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Lockr_Scan_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ScanRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LockrServer).Scan(m, &lockrScanServer{ServerStream: stream})
+}
+
+type Lockr_ScanServer interface {
+	Send(*Entry) error
+	grpc.ServerStream
+}
+
+type lockrScanServer struct {
+	grpc.ServerStream
+}
+
+func (x *lockrScanServer) Send(m *Entry) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Lockr_WatchChanges_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LockrServer).WatchChanges(m, &lockrWatchChangesServer{ServerStream: stream})
+}
+
+type Lockr_WatchChangesServer interface {
+	Send(*Change) error
+	grpc.ServerStream
+}
+
+type lockrWatchChangesServer struct {
+	grpc.ServerStream
+}
+
+func (x *lockrWatchChangesServer) Send(m *Change) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Lockr_BatchWrite_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LockrServer).BatchWrite(&lockrBatchWriteServer{ServerStream: stream})
+}
+
+type Lockr_BatchWriteServer interface {
+	SendAndClose(*BatchWriteResponse) error
+	Recv() (*BatchOp, error)
+	grpc.ServerStream
+}
+
+type lockrBatchWriteServer struct {
+	grpc.ServerStream
+}
+
+func (x *lockrBatchWriteServer) SendAndClose(m *BatchWriteResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *lockrBatchWriteServer) Recv() (*BatchOp, error) {
+	m := new(BatchOp)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Lockr_ServiceDesc is the grpc.ServiceDesc for Lockr service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Lockr_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "lockr.v1.Lockr",
+	HandlerType: (*LockrServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _Lockr_Get_Handler,
+		},
+		{
+			MethodName: "Set",
+			Handler:    _Lockr_Set_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Lockr_Delete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Scan",
+			Handler:       _Lockr_Scan_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchChanges",
+			Handler:       _Lockr_WatchChanges_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "BatchWrite",
+			Handler:       _Lockr_BatchWrite_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "lockr/v1/lockr.proto",
+}
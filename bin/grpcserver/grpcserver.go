@@ -0,0 +1,335 @@
+// Package grpcserver serves a Lockr store over the gRPC service defined in
+// proto/lockr/v1/lockr.proto, whose generated client is in bin/grpc/lockr/v1.
+package grpcserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	lockrv1 "Lockr/bin/grpc/lockr/v1"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/server"
+)
+
+// maxBatchOps is the most operations a BatchWrite may stream, as for a batch
+// request of the HTTP API
+const maxBatchOps = 10000
+
+// methodScopes are the token scopes each method needs once tokens are required
+var methodScopes = map[string]server.Scope{
+	lockrv1.Lockr_Get_FullMethodName:          server.ScopeRead,
+	lockrv1.Lockr_Scan_FullMethodName:         server.ScopeRead,
+	lockrv1.Lockr_WatchChanges_FullMethodName: server.ScopeRead,
+	lockrv1.Lockr_Set_FullMethodName:          server.ScopeWrite,
+	lockrv1.Lockr_Delete_FullMethodName:       server.ScopeWrite,
+	lockrv1.Lockr_BatchWrite_FullMethodName:   server.ScopeWrite,
+}
+
+// watchable is a store reporting its writes, like an *lsmtree.LSMTree
+type watchable interface {
+	Watch(prefix string) (<-chan lsmtree.Event, func(), error)
+}
+
+// Server serves the Lockr gRPC service for a store
+type Server struct {
+	lockrv1.UnimplementedLockrServer
+
+	store  lsmtree.Store
+	keys   lsmtree.ContextStore // store, giving up when a call's context is done
+	tokens *server.Tokens       // nil unless RequireTokens was called
+
+	requestTimeout time.Duration // bounds the unary calls, set by SetRequestTimeout
+
+	logger lsmtree.Logger // receives the errors of serving, set by SetLogger
+}
+
+// New creates a Server for the given store
+func New(store lsmtree.Store) *Server {
+	return &Server{store: store, keys: lsmtree.WithContext(store), logger: slog.Default()}
+}
+
+// RequireTokens makes calls authenticate with one of tokens whose scope allows
+// them, sent as "authorization: Bearer <token>" metadata as with the HTTP API
+func (s *Server) RequireTokens(tokens *server.Tokens) {
+	s.tokens = tokens
+}
+
+// SetRequestTimeout bounds how long Get, Set, Delete and BatchWrite may wait for
+// the store. Calls past it fail with UNAVAILABLE. Zero, the default, only gives
+// up when the client does.
+func (s *Server) SetRequestTimeout(timeout time.Duration) {
+	s.requestTimeout = timeout
+}
+
+// SetLogger sets the logger receiving the errors that stop serving, slog.Default()
+// by default
+func (s *Server) SetLogger(logger lsmtree.Logger) {
+	s.logger = logger
+}
+
+// GRPCServer returns a gRPC server serving the service, checking tokens once
+// they're required
+func (s *Server) GRPCServer(options ...grpc.ServerOption) *grpc.Server {
+	options = append(options,
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := s.authorize(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := s.authorize(stream.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	)
+	grpcServer := grpc.NewServer(options...)
+	lockrv1.RegisterLockrServer(grpcServer, s)
+	return grpcServer
+}
+
+// ListenTLS starts serving on addr in the background, over TLS with config unless
+// it's nil, and returns the bound listener
+func (s *Server) ListenTLS(addr string, config *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	var options []grpc.ServerOption
+	if config != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(config)))
+	}
+	grpcServer := s.GRPCServer(options...)
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logger.Error("gRPC server stopped", "addr", listener.Addr().String(), "error", err)
+		}
+	}()
+	return listener, nil
+}
+
+// authorize checks the token of a call to method once tokens are required
+func (s *Server) authorize(ctx context.Context, method string) error {
+	if s.tokens == nil {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var secret string
+	var ok bool
+	if values := md.Get("authorization"); len(values) > 0 {
+		secret, ok = strings.CutPrefix(values[0], "Bearer ")
+	}
+	token, known := s.tokens.Authenticate(strings.TrimSpace(secret))
+	if !ok || !known {
+		return status.Error(codes.Unauthenticated, "a valid bearer token is required")
+	}
+	if scope, found := methodScopes[method]; !found || token.Scope < scope {
+		return status.Errorf(codes.PermissionDenied, "token %s has scope %s, this needs %s", token.Name, token.Scope, scope)
+	}
+	return nil
+}
+
+// storeContext returns the context of a call's store operations, done when the
+// client gives up or the request timeout passes
+func (s *Server) storeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.requestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.requestTimeout)
+}
+
+// Get returns the value of a key, NOT_FOUND if it doesn't exist
+func (s *Server) Get(ctx context.Context, req *lockrv1.GetRequest) (*lockrv1.Entry, error) {
+	ctx, cancel := s.storeContext(ctx)
+	defer cancel()
+	value, err := s.keys.GetCtx(ctx, req.GetKey())
+	if err != nil {
+		return nil, storeError(err)
+	}
+	if value == "" {
+		return nil, status.Errorf(codes.NotFound, "key %q not found", req.GetKey())
+	}
+	return &lockrv1.Entry{Key: req.GetKey(), Value: value}, nil
+}
+
+// Set sets the value of a key, which must not be empty
+func (s *Server) Set(ctx context.Context, req *lockrv1.SetRequest) (*lockrv1.Entry, error) {
+	if req.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "key must not be empty")
+	}
+	if req.GetValue() == "" {
+		return nil, status.Error(codes.InvalidArgument, "value must not be empty")
+	}
+	ctx, cancel := s.storeContext(ctx)
+	defer cancel()
+	if err := s.keys.SetCtx(ctx, req.GetKey(), req.GetValue()); err != nil {
+		return nil, storeError(err)
+	}
+	return &lockrv1.Entry{Key: req.GetKey(), Value: req.GetValue()}, nil
+}
+
+// Delete removes a key; deleting a missing key succeeds
+func (s *Server) Delete(ctx context.Context, req *lockrv1.DeleteRequest) (*lockrv1.DeleteResponse, error) {
+	if req.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "key must not be empty")
+	}
+	ctx, cancel := s.storeContext(ctx)
+	defer cancel()
+	if err := s.keys.DeleteCtx(ctx, req.GetKey()); err != nil {
+		return nil, storeError(err)
+	}
+	return &lockrv1.DeleteResponse{}, nil
+}
+
+// Scan streams the entries of the prefix in [start, end) in key order, until the
+// client goes away. It isn't bound by the request timeout, as a stream of a
+// large range may rightly last long.
+func (s *Server) Scan(req *lockrv1.ScanRequest, stream lockrv1.Lockr_ScanServer) error {
+	start, end := req.GetPrefix(), prefixEnd(req.GetPrefix())
+	// An explicit range narrows the prefix range
+	if req.GetStart() > start {
+		start = req.GetStart()
+	}
+	if to := req.GetEnd(); to != "" && (end == "" || to < end) {
+		end = to
+	}
+
+	it, err := s.keys.ScanCtx(stream.Context(), start, end)
+	if err != nil {
+		return storeError(err)
+	}
+	defer it.Close()
+	for it.Next() {
+		entry := &lockrv1.Entry{Key: it.Key()}
+		if !req.GetKeysOnly() {
+			entry.Value = it.Value()
+		}
+		if err := stream.Send(entry); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return storeError(err)
+	}
+	return nil
+}
+
+// WatchChanges streams the writes to keys starting with the prefix, until the
+// client goes away. The headers are sent once watching, so a client that got
+// them sees every write made after. It fails with ABORTED when the store stops the watch,
+// because the client fell behind or the store was closed, so the client should
+// read the keys again before watching anew.
+func (s *Server) WatchChanges(req *lockrv1.WatchRequest, stream lockrv1.Lockr_WatchChangesServer) error {
+	store, ok := s.store.(watchable)
+	if !ok {
+		return status.Error(codes.Unimplemented, "this store can't be watched")
+	}
+	events, stop, err := store.Watch(req.GetPrefix())
+	if err != nil {
+		return storeError(err)
+	}
+	defer stop()
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(codes.Aborted, "the store stopped the watch")
+			}
+			change := &lockrv1.Change{
+				Key:      event.Key,
+				Value:    event.NewValue,
+				Deleted:  event.Type == lsmtree.EventDelete,
+				OldValue: event.OldValue,
+				Seq:      event.Seq,
+			}
+			if err := stream.Send(change); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// BatchWrite applies the streamed operations in order once the stream is closed,
+// all or none of them
+func (s *Server) BatchWrite(stream lockrv1.Lockr_BatchWriteServer) error {
+	batch := lsmtree.NewWriteBatch()
+	for i := 0; ; i++ {
+		op, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case i == maxBatchOps:
+			return status.Errorf(codes.InvalidArgument, "a batch must hold between 1 and %d operations", maxBatchOps)
+		case op.GetKey() == "":
+			return status.Errorf(codes.InvalidArgument, "operation %d: key must not be empty", i)
+		case op.GetDelete() && op.GetValue() != "":
+			return status.Errorf(codes.InvalidArgument, "operation %d: a delete has no value", i)
+		case op.GetDelete():
+			batch.Delete(op.GetKey())
+		case op.GetValue() == "":
+			return status.Errorf(codes.InvalidArgument, "operation %d: value must not be empty", i)
+		default:
+			batch.Set(op.GetKey(), op.GetValue())
+		}
+	}
+	if batch.Len() == 0 {
+		return status.Errorf(codes.InvalidArgument, "a batch must hold between 1 and %d operations", maxBatchOps)
+	}
+
+	ctx, cancel := s.storeContext(stream.Context())
+	defer cancel()
+	if err := s.keys.BatchCtx(ctx, batch); err != nil {
+		return storeError(err)
+	}
+	return stream.SendAndClose(&lockrv1.BatchWriteResponse{Applied: uint32(batch.Len())})
+}
+
+// storeError returns the status of a failed store operation: unavailable when it
+// gave up waiting for the store, a failed precondition when the store is a
+// read-only follower
+func storeError(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, lsmtree.ErrReadOnly):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// prefixEnd returns the smallest key greater than every key with the given prefix,
+// or "" when the prefix is empty or has no upper bound
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
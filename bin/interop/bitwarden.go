@@ -0,0 +1,181 @@
+package interop
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"Lockr/bin/templates"
+)
+
+// Types of Bitwarden items
+const (
+	bitwardenLogin    = 1
+	bitwardenNote     = 2
+	bitwardenCard     = 3
+	bitwardenIdentity = 4
+)
+
+// bitwardenHidden is the type of a custom field of Bitwarden whose value is hidden
+const bitwardenHidden = 1
+
+// bitwardenExport is the layout of an unencrypted Bitwarden JSON export
+type bitwardenExport struct {
+	Encrypted bool `json:"encrypted"`
+	Folders   []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"folders"`
+	Items []struct {
+		Type     int    `json:"type"`
+		Name     string `json:"name"`
+		Notes    string `json:"notes"`
+		FolderID string `json:"folderId"`
+		Favorite bool   `json:"favorite"`
+		Fields   []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+			Type  int    `json:"type"`
+		} `json:"fields"`
+		Login *struct {
+			URIs []struct {
+				URI string `json:"uri"`
+			} `json:"uris"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+			TOTP     string `json:"totp"`
+		} `json:"login"`
+		Card *struct {
+			CardholderName string `json:"cardholderName"`
+			Brand          string `json:"brand"`
+			Number         string `json:"number"`
+			ExpMonth       string `json:"expMonth"`
+			ExpYear        string `json:"expYear"`
+			Code           string `json:"code"`
+		} `json:"card"`
+		Identity map[string]interface{} `json:"identity"`
+	} `json:"items"`
+}
+
+// ReadBitwarden reads an unencrypted Bitwarden export, JSON or, for a .csv file, CSV.
+// Folders are kept, and favorites are tagged favorite.
+func ReadBitwarden(path string) ([]Item, error) {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return readBitwardenCSV(path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read export: %w", err)
+	}
+	var export bitwardenExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("failed to parse Bitwarden export: %w", err)
+	}
+	if export.Encrypted {
+		return nil, fmt.Errorf("the Bitwarden export is encrypted; export it again as unencrypted JSON")
+	}
+	folders := make(map[string]string)
+	for _, folder := range export.Folders {
+		folders[folder.ID] = folder.Name
+	}
+
+	items := make([]Item, 0, len(export.Items))
+	for _, bw := range export.Items {
+		var tags []string
+		if bw.Favorite {
+			tags = append(tags, "favorite")
+		}
+		var extra []templates.FieldValue
+		for _, f := range bw.Fields {
+			extra = append(extra, field(f.Name, f.Value, f.Type == bitwardenHidden))
+		}
+
+		template, values := "note", map[string]string{"notes": bw.Notes}
+		switch {
+		case bw.Type == bitwardenLogin && bw.Login != nil:
+			template = "login"
+			values["username"], values["password"] = bw.Login.Username, bw.Login.Password
+			for i, uri := range bw.Login.URIs {
+				if i == 0 {
+					values["url"] = uri.URI
+				} else {
+					extra = append(extra, field(fmt.Sprintf("URL %d", i+1), uri.URI, false))
+				}
+			}
+			extra = append(extra, field("TOTP", bw.Login.TOTP, true))
+		case bw.Type == bitwardenCard && bw.Card != nil:
+			template = "card"
+			values["cardholder"], values["number"], values["cvv"] = bw.Card.CardholderName, bw.Card.Number, bw.Card.Code
+			values["expiry"] = expiry(bw.Card.ExpMonth, bw.Card.ExpYear)
+			extra = append(extra, field("Brand", bw.Card.Brand, false))
+		case bw.Type == bitwardenIdentity:
+			extra = append(identityFields(bw.Identity), extra...)
+		}
+		items = append(items, newItem(bw.Name, folders[bw.FolderID], tags, template, values, extra))
+	}
+	return items, nil
+}
+
+// readBitwardenCSV reads a Bitwarden CSV export, which holds logins and notes
+func readBitwardenCSV(path string) ([]Item, error) {
+	rows, err := readCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, 0, len(rows))
+	for _, row := range rows {
+		var tags []string
+		if row["favorite"] == "1" {
+			tags = append(tags, "favorite")
+		}
+		var extra []templates.FieldValue
+		for _, line := range strings.Split(row["fields"], "\n") {
+			if name, value, ok := strings.Cut(line, ": "); ok {
+				extra = append(extra, field(name, value, false))
+			}
+		}
+		template, values := "note", map[string]string{"notes": row["notes"]}
+		if row["type"] == "login" {
+			template = "login"
+			values["username"], values["password"], values["url"] = row["login_username"], row["login_password"], row["login_uri"]
+			extra = append(extra, field("TOTP", row["login_totp"], true))
+		}
+		items = append(items, newItem(row["name"], row["folder"], tags, template, values, extra))
+	}
+	return items, nil
+}
+
+// identityFields returns the filled-in details of a Bitwarden identity as fields, in a fixed order
+func identityFields(identity map[string]interface{}) []templates.FieldValue {
+	names := []struct{ key, label string }{
+		{"title", "Title"}, {"firstName", "First name"}, {"middleName", "Middle name"}, {"lastName", "Last name"},
+		{"username", "Username"}, {"email", "Email"}, {"phone", "Phone"}, {"company", "Company"},
+		{"address1", "Address"}, {"address2", "Address 2"}, {"address3", "Address 3"}, {"city", "City"},
+		{"state", "State"}, {"postalCode", "Postal code"}, {"country", "Country"},
+		{"ssn", "SSN"}, {"passportNumber", "Passport number"}, {"licenseNumber", "License number"},
+	}
+	var fields []templates.FieldValue
+	for _, name := range names {
+		if value, ok := identity[name.key].(string); ok {
+			secret := name.key == "ssn" || name.key == "passportNumber" || name.key == "licenseNumber"
+			fields = append(fields, field(name.label, value, secret))
+		}
+	}
+	return fields
+}
+
+// expiry formats the expiry date of a card as MM/YYYY, or as much of it as is known
+func expiry(month, year string) string {
+	if len(month) == 1 {
+		month = "0" + month
+	}
+	switch {
+	case month != "" && year != "":
+		return month + "/" + year
+	case year != "":
+		return year
+	}
+	return month
+}
@@ -0,0 +1,260 @@
+// Package interop reads the exports of other password managers into structured
+// Lockr entries, keeping their folders and tags, and writes entries in their formats
+package interop
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"Lockr/bin/content"
+	"Lockr/bin/templates"
+)
+
+// Format is the export format of another password manager
+type Format string
+
+const (
+	// Bitwarden reads an unencrypted Bitwarden export, JSON or CSV
+	Bitwarden Format = "bitwarden"
+	// OnePassword reads a 1Password export, a .1pux file or CSV
+	OnePassword Format = "1password"
+	// KeePassCSV reads a CSV export of KeePass or KeePassXC
+	KeePassCSV Format = "keepass-csv"
+	// Pass reads a pass password store, a directory of GPG-encrypted files
+	Pass Format = "pass"
+)
+
+// labels are the labels of the fields values are read into
+var labels = map[string]string{"username": "Username", "password": "Password", "url": "URL", "notes": "Notes"}
+
+// ParseFormat parses a format name as accepted on the command line
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case Bitwarden, OnePassword, KeePassCSV, Pass:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown password manager %q, expected bitwarden, 1password, keepass-csv or pass", name)
+	}
+}
+
+// Item is an entry read from another password manager
+type Item struct {
+	Name   string
+	Folder string
+	Tags   []string
+	Entry  templates.Entry
+}
+
+// Read reads the items of an export in format at path. pass stores are decrypted
+// with gpg.
+func Read(format Format, path string) ([]Item, error) {
+	switch format {
+	case Bitwarden:
+		return ReadBitwarden(path)
+	case OnePassword:
+		return ReadOnePassword(path)
+	case KeePassCSV:
+		return ReadKeePassCSV(path)
+	case Pass:
+		return ReadPass(path, GPGDecrypt)
+	default:
+		return nil, fmt.Errorf("unknown password manager %q", format)
+	}
+}
+
+// Value returns the stored form of the item: its entry, filed in its folder with its tags
+func (it Item) Value() (string, error) {
+	value, err := it.Entry.Encode()
+	if err != nil {
+		return "", err
+	}
+	if it.Folder != "" {
+		value = content.SetFolder(value, it.Folder)
+	}
+	for _, tag := range it.Tags {
+		value = content.AddTag(value, tag)
+	}
+	return value, nil
+}
+
+// FromStored returns the item of a stored value: a structured entry named by its
+// key less the template, or a plain value as the password of an entry named by its
+// key. Binary values, which other password managers don't hold, report false.
+func FromStored(key, stored string) (Item, bool) {
+	value, contentType := content.Unwrap(stored)
+	if contentType == content.Binary {
+		return Item{}, false
+	}
+	it := Item{Name: key, Folder: content.Folder(stored), Tags: content.Tags(stored)}
+	if entry, ok := templates.Decode(value); ok {
+		it.Entry = entry
+		if name, ok := strings.CutPrefix(key, entry.Template+"/"); ok && name != "" {
+			it.Name = name
+		}
+		return it, true
+	}
+	it.Entry = templates.Entry{Fields: []templates.FieldValue{{Name: "password", Label: "Password", Value: value, Secret: true}}}
+	return it, true
+}
+
+// Keys returns the conventional keys of items, <template>/<name>, in order.
+// Names used more than once, e.g. in two folders, are numbered from the second.
+func Keys(items []Item) []string {
+	keys := make([]string, len(items))
+	used := make(map[string]bool)
+	for i, it := range items {
+		base := it.Entry.Template + "/" + it.Name
+		key := base
+		for n := 2; used[key]; n++ {
+			key = base + "-" + strconv.Itoa(n)
+		}
+		used[key] = true
+		keys[i] = key
+	}
+	return keys
+}
+
+// newItem makes an item of a built-in template with values by field name, followed
+// by values the template has no field for and extra fields. Names, folders and
+// tags are cleaned up to what keys and headers accept.
+func newItem(name, folder string, tags []string, template string, values map[string]string, extra []templates.FieldValue) Item {
+	entry := templates.Builtin()[template].NewEntry(values)
+	var left []string
+	for name, value := range values {
+		if value != "" && !hasField(template, name) {
+			left = append(left, name)
+		}
+	}
+	sort.Strings(left)
+	for _, name := range left {
+		entry.Fields = append(entry.Fields, templates.FieldValue{Name: name, Label: labels[name], Value: values[name], Secret: name == "password"})
+	}
+	for _, f := range extra {
+		if f.Value != "" {
+			entry.Fields = append(entry.Fields, f)
+		}
+	}
+	it := Item{Name: cleanName(name), Folder: cleanFolder(folder), Entry: entry}
+	for _, tag := range tags {
+		if tag = cleanTag(tag); tag != "" && !slices.Contains(it.Tags, tag) {
+			it.Tags = append(it.Tags, tag)
+		}
+	}
+	return it
+}
+
+// hasField reports whether a built-in template has a field
+func hasField(template, name string) bool {
+	return slices.ContainsFunc(templates.Builtin()[template].Fields, func(f templates.Field) bool { return f.Name == name })
+}
+
+// cleanName makes a name usable in a key: slashes and runs of spaces become dashes
+func cleanName(name string) string {
+	name = strings.Join(strings.FieldsFunc(name, func(r rune) bool { return unicode.IsSpace(r) || r == '/' }), "-")
+	if name == "" {
+		return "untitled"
+	}
+	return name
+}
+
+// cleanFolder makes a folder path valid, dropping empty parts and semicolons
+func cleanFolder(folder string) string {
+	var parts []string
+	for _, part := range strings.Split(strings.ReplaceAll(folder, "\\", "/"), "/") {
+		part = strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r == ';' || unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, part))
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	cleaned, err := content.CleanFolder(strings.Join(parts, "/"))
+	if err != nil {
+		return ""
+	}
+	return cleaned
+}
+
+// cleanTag makes a tag valid: spaces become dashes, semicolons and commas are
+// dropped. It returns "" for a tag with nothing left.
+func cleanTag(tag string) string {
+	tag = strings.Join(strings.Fields(strings.Map(func(r rune) rune {
+		if r == ';' || r == ',' {
+			return -1
+		}
+		return r
+	}, tag)), "-")
+	if content.ValidateTag(tag) != nil {
+		return ""
+	}
+	return tag
+}
+
+// splitTags splits a list of tags separated by commas or semicolons
+func splitTags(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ';' })
+}
+
+// field returns an extra field, secret if it holds a password or the like
+func field(label, value string, secret bool) templates.FieldValue {
+	name := strings.ToLower(cleanName(label))
+	return templates.FieldValue{Name: name, Label: label, Value: value, Secret: secret}
+}
+
+// readCSV reads the rows of a CSV file with a header, each by lowercased column name
+func readCSV(path string) ([]map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open export: %w", err)
+	}
+	defer file.Close()
+
+	records := csv.NewReader(file)
+	records.FieldsPerRecord = -1
+	records.LazyQuotes = true
+	header, err := records.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	for i, column := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+	}
+	var rows []map[string]string
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV: %w", err)
+		}
+		row := make(map[string]string, len(header))
+		for i, value := range record {
+			if i < len(header) {
+				row[header[i]] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// first returns the first of the columns a row has a value in, for exports that
+// name a column differently between versions
+func first(row map[string]string, columns ...string) string {
+	for _, column := range columns {
+		if value := row[column]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,349 @@
+package interop
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20"
+)
+
+// KDBX 4 files start with two signature words and the format version
+const (
+	kdbxSignature1 = 0x9AA2D903
+	kdbxSignature2 = 0xB54BFB67
+	kdbxVersion    = 0x00040000
+)
+
+// Identifiers of the cipher and key derivation written: AES-256 and Argon2id
+var (
+	kdbxAES256   = []byte{0x31, 0xc1, 0xf2, 0xe6, 0xbf, 0x71, 0x43, 0x50, 0xbe, 0x58, 0x05, 0x21, 0x6a, 0xfc, 0x5a, 0xff}
+	kdbxArgon2id = []byte{0x9e, 0x29, 0x8b, 0x19, 0x56, 0xdb, 0x47, 0x73, 0xb2, 0x3d, 0xfc, 0x3e, 0xc6, 0xf0, 0xa1, 0xe6}
+)
+
+// Fields of the outer header
+const (
+	kdbxEndOfHeader   = 0
+	kdbxCipherID      = 2
+	kdbxCompression   = 3
+	kdbxMasterSeed    = 4
+	kdbxEncryptionIV  = 7
+	kdbxKDFParameters = 11
+)
+
+// Fields of the inner header, and the stream cipher of protected values
+const (
+	kdbxInnerEnd       = 0
+	kdbxInnerStreamID  = 1
+	kdbxInnerStreamKey = 2
+	kdbxChaCha20       = 3
+)
+
+// Types of the values of a KDBX variant dictionary
+const (
+	kdbxUInt32    = 0x04
+	kdbxUInt64    = 0x05
+	kdbxByteArray = 0x42
+)
+
+// Argon2id costs of the key derivation, as KeePassXC picks by default
+const (
+	kdbxArgon2Iterations  = 10
+	kdbxArgon2Memory      = 64 << 20 // bytes
+	kdbxArgon2Parallelism = 2
+)
+
+// kdbxBlockSize is the size of the HMAC-checked blocks the encrypted payload is split into
+const kdbxBlockSize = 1 << 20
+
+// WriteKDBX writes items as a KeePass database in the KDBX 4 format, protected by
+// password. Folders become groups below the root group, and the standard fields
+// of logins those of KeePass; other fields are kept as custom ones.
+func WriteKDBX(w io.Writer, items []Item, password string) error {
+	seeds := make([]byte, 32+16+32+64)
+	if _, err := rand.Read(seeds); err != nil {
+		return fmt.Errorf("failed to generate keys: %w", err)
+	}
+	masterSeed, iv, salt, innerKey := seeds[:32], seeds[32:48], seeds[48:80], seeds[80:]
+
+	// The outer header, in the clear and authenticated by its hash and HMAC
+	var kdf bytes.Buffer
+	binary.Write(&kdf, binary.LittleEndian, uint16(0x0100))
+	writeVariant(&kdf, kdbxByteArray, "$UUID", kdbxArgon2id)
+	writeVariant(&kdf, kdbxByteArray, "S", salt)
+	writeVariant(&kdf, kdbxUInt32, "P", binary.LittleEndian.AppendUint32(nil, kdbxArgon2Parallelism))
+	writeVariant(&kdf, kdbxUInt64, "M", binary.LittleEndian.AppendUint64(nil, kdbxArgon2Memory))
+	writeVariant(&kdf, kdbxUInt64, "I", binary.LittleEndian.AppendUint64(nil, kdbxArgon2Iterations))
+	writeVariant(&kdf, kdbxUInt32, "V", binary.LittleEndian.AppendUint32(nil, 0x13))
+	kdf.WriteByte(0)
+
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, []uint32{kdbxSignature1, kdbxSignature2, kdbxVersion})
+	for _, f := range []struct {
+		id   byte
+		data []byte
+	}{
+		{kdbxCipherID, kdbxAES256},
+		{kdbxCompression, binary.LittleEndian.AppendUint32(nil, 1)}, // gzip
+		{kdbxMasterSeed, masterSeed},
+		{kdbxEncryptionIV, iv},
+		{kdbxKDFParameters, kdf.Bytes()},
+		{kdbxEndOfHeader, []byte("\r\n\r\n")},
+	} {
+		header.WriteByte(f.id)
+		binary.Write(&header, binary.LittleEndian, uint32(len(f.data)))
+		header.Write(f.data)
+	}
+
+	// Keys derived from the password
+	component := sha256.Sum256([]byte(password))
+	composite := sha256.Sum256(component[:])
+	transformed := argon2.IDKey(composite[:], salt, kdbxArgon2Iterations, kdbxArgon2Memory/1024, kdbxArgon2Parallelism, 32)
+	encryptionKey := sha256.Sum256(append(append([]byte{}, masterSeed...), transformed...))
+	hmacKey := sha512.Sum512(append(append(append([]byte{}, masterSeed...), transformed...), 1))
+
+	// The payload: the inner header and the XML document, compressed and encrypted
+	document, err := kdbxDocument(items, innerKey)
+	if err != nil {
+		return err
+	}
+	var plain bytes.Buffer
+	compressed := gzip.NewWriter(&plain)
+	var inner bytes.Buffer
+	for _, f := range []struct {
+		id   byte
+		data []byte
+	}{
+		{kdbxInnerStreamID, binary.LittleEndian.AppendUint32(nil, kdbxChaCha20)},
+		{kdbxInnerStreamKey, innerKey},
+		{kdbxInnerEnd, nil},
+	} {
+		inner.WriteByte(f.id)
+		binary.Write(&inner, binary.LittleEndian, int32(len(f.data)))
+		inner.Write(f.data)
+	}
+	compressed.Write(inner.Bytes())
+	compressed.Write(document)
+	if err := compressed.Close(); err != nil {
+		return fmt.Errorf("failed to compress database: %w", err)
+	}
+	block, err := aes.NewCipher(encryptionKey[:])
+	if err != nil {
+		return err
+	}
+	padding := aes.BlockSize - plain.Len()%aes.BlockSize
+	payload := append(plain.Bytes(), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(payload, payload)
+
+	out := bytes.NewBuffer(header.Bytes())
+	headerHash := sha256.Sum256(header.Bytes())
+	out.Write(headerHash[:])
+	out.Write(kdbxHMAC(hmacKey[:], 1<<64-1, header.Bytes()))
+	for index := uint64(0); ; index++ {
+		chunk := payload[:min(len(payload), kdbxBlockSize)]
+		payload = payload[len(chunk):]
+		sized := binary.LittleEndian.AppendUint32(nil, uint32(len(chunk)))
+		out.Write(kdbxHMAC(hmacKey[:], index, append(sized, chunk...)))
+		out.Write(sized)
+		out.Write(chunk)
+		if len(chunk) == 0 {
+			break // The empty block ends the payload
+		}
+	}
+	if _, err := w.Write(out.Bytes()); err != nil {
+		return fmt.Errorf("failed to write database: %w", err)
+	}
+	return nil
+}
+
+// writeVariant writes an entry of a KDBX variant dictionary
+func writeVariant(b *bytes.Buffer, kind byte, name string, value []byte) {
+	b.WriteByte(kind)
+	binary.Write(b, binary.LittleEndian, int32(len(name)))
+	b.WriteString(name)
+	binary.Write(b, binary.LittleEndian, int32(len(value)))
+	b.Write(value)
+}
+
+// kdbxHMAC returns the HMAC of a block of a KDBX file, or of its header as block 2^64-1,
+// keyed for that block
+func kdbxHMAC(hmacKey []byte, index uint64, data []byte) []byte {
+	indexBytes := binary.LittleEndian.AppendUint64(nil, index)
+	key := sha512.Sum512(append(indexBytes, hmacKey...))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(indexBytes)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// The XML document of a KDBX file, as far as it's written
+type (
+	kdbxFile struct {
+		XMLName xml.Name `xml:"KeePassFile"`
+		Meta    kdbxMeta `xml:"Meta"`
+		Root    struct {
+			Group *kdbxGroup `xml:"Group"`
+		} `xml:"Root"`
+	}
+	kdbxMeta struct {
+		Generator        string `xml:"Generator"`
+		DatabaseName     string `xml:"DatabaseName"`
+		MemoryProtection struct {
+			ProtectTitle    string `xml:"ProtectTitle"`
+			ProtectUserName string `xml:"ProtectUserName"`
+			ProtectPassword string `xml:"ProtectPassword"`
+			ProtectURL      string `xml:"ProtectURL"`
+			ProtectNotes    string `xml:"ProtectNotes"`
+		} `xml:"MemoryProtection"`
+	}
+	kdbxGroup struct {
+		UUID    string       `xml:"UUID"`
+		Name    string       `xml:"Name"`
+		Times   kdbxTimes    `xml:"Times"`
+		Entries []kdbxEntry  `xml:"Entry"`
+		Groups  []*kdbxGroup `xml:"Group"`
+	}
+	kdbxEntry struct {
+		UUID    string       `xml:"UUID"`
+		Tags    string       `xml:"Tags,omitempty"`
+		Times   kdbxTimes    `xml:"Times"`
+		Strings []kdbxString `xml:"String"`
+	}
+	kdbxString struct {
+		Key   string `xml:"Key"`
+		Value struct {
+			Protected string `xml:"Protected,attr,omitempty"`
+			Text      string `xml:",chardata"`
+		} `xml:"Value"`
+	}
+	kdbxTimes struct {
+		CreationTime         string `xml:"CreationTime"`
+		LastModificationTime string `xml:"LastModificationTime"`
+		LastAccessTime       string `xml:"LastAccessTime"`
+		ExpiryTime           string `xml:"ExpiryTime"`
+		Expires              string `xml:"Expires"`
+		UsageCount           int    `xml:"UsageCount"`
+		LocationChanged      string `xml:"LocationChanged"`
+	}
+)
+
+// kdbxStandard maps the fields of templates to the standard fields of KeePass entries
+var kdbxStandard = map[string]string{"username": "UserName", "password": "Password", "url": "URL", "notes": "Notes"}
+
+// kdbxDocument returns the XML document of a KDBX file holding items, with the
+// values of secret fields protected by the inner stream keyed by innerKey
+func kdbxDocument(items []Item, innerKey []byte) ([]byte, error) {
+	now := kdbxTime(time.Now())
+	times := kdbxTimes{now, now, now, now, "False", 0, now}
+	root := &kdbxGroup{UUID: kdbxUUID(), Name: "Root", Times: times}
+	groups := map[string]*kdbxGroup{"": root}
+	var group func(folder string) *kdbxGroup
+	group = func(folder string) *kdbxGroup {
+		if g, ok := groups[folder]; ok {
+			return g
+		}
+		parentFolder, name := "", folder
+		if i := strings.LastIndexByte(folder, '/'); i >= 0 {
+			parentFolder, name = folder[:i], folder[i+1:]
+		}
+		parent := group(parentFolder)
+		g := &kdbxGroup{UUID: kdbxUUID(), Name: name, Times: times}
+		parent.Groups = append(parent.Groups, g)
+		groups[folder] = g
+		return g
+	}
+
+	for _, it := range items {
+		entry := kdbxEntry{UUID: kdbxUUID(), Tags: strings.Join(it.Tags, ";"), Times: times}
+		values := map[string]string{"Title": it.Name}
+		secret := map[string]bool{"Password": true}
+		var custom []string
+		for _, f := range it.Entry.Fields {
+			key, ok := kdbxStandard[f.Name]
+			if !ok {
+				if f.Value == "" {
+					continue
+				}
+				key = f.Title()
+				for n := 2; values[key] != "" || key == "Title" || key == "UserName" || key == "Password" || key == "URL" || key == "Notes"; n++ {
+					key = fmt.Sprintf("%s %d", f.Title(), n)
+				}
+				custom = append(custom, key)
+			}
+			values[key] = f.Value
+			secret[key] = secret[key] || f.Secret
+		}
+		for _, key := range append([]string{"Title", "UserName", "Password", "URL", "Notes"}, custom...) {
+			s := kdbxString{Key: key}
+			s.Value.Text = values[key]
+			if secret[key] {
+				s.Value.Protected = "True"
+			}
+			entry.Strings = append(entry.Strings, s)
+		}
+		g := group(it.Folder)
+		g.Entries = append(g.Entries, entry)
+	}
+
+	// Protected values are XORed with the inner stream in document order
+	hash := sha512.Sum512(innerKey)
+	stream, err := chacha20.NewUnauthenticatedCipher(hash[:32], hash[32:44])
+	if err != nil {
+		return nil, err
+	}
+	var protect func(g *kdbxGroup)
+	protect = func(g *kdbxGroup) {
+		for i := range g.Entries {
+			for j := range g.Entries[i].Strings {
+				if value := &g.Entries[i].Strings[j].Value; value.Protected != "" {
+					data := []byte(value.Text)
+					stream.XORKeyStream(data, data)
+					value.Text = base64.StdEncoding.EncodeToString(data)
+				}
+			}
+		}
+		for _, sub := range g.Groups {
+			protect(sub)
+		}
+	}
+	protect(root)
+
+	file := kdbxFile{Meta: kdbxMeta{Generator: "Lockr", DatabaseName: "Lockr"}}
+	file.Meta.MemoryProtection.ProtectTitle = "False"
+	file.Meta.MemoryProtection.ProtectUserName = "False"
+	file.Meta.MemoryProtection.ProtectPassword = "True"
+	file.Meta.MemoryProtection.ProtectURL = "False"
+	file.Meta.MemoryProtection.ProtectNotes = "False"
+	file.Root.Group = root
+	document, err := xml.MarshalIndent(file, "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode database: %w", err)
+	}
+	return append([]byte(`<?xml version="1.0" encoding="utf-8" standalone="yes"?>`+"\n"), document...), nil
+}
+
+// kdbxUUID returns a random UUID in the base64 form of KDBX documents
+func kdbxUUID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return base64.StdEncoding.EncodeToString(id)
+}
+
+// kdbxTime formats a time as KDBX 4 does: seconds since 0001-01-01 UTC in base64
+func kdbxTime(t time.Time) string {
+	const unixFromYear1 = 62135596800
+	return base64.StdEncoding.EncodeToString(binary.LittleEndian.AppendUint64(nil, uint64(t.Unix()+unixFromYear1)))
+}
@@ -0,0 +1,38 @@
+package interop
+
+import (
+	"strings"
+
+	"Lockr/bin/templates"
+)
+
+// ReadKeePassCSV reads a CSV export of KeePassXC or KeePass 2. Groups become
+// folders, below the root group every KeePassXC path starts with.
+func ReadKeePassCSV(path string) ([]Item, error) {
+	rows, err := readCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, 0, len(rows))
+	for _, row := range rows {
+		folder := row["group"]
+		if _, below, ok := strings.Cut(folder, "/"); ok {
+			folder = below
+		} else {
+			folder = ""
+		}
+		values := map[string]string{
+			"username": first(row, "username", "login name", "user name"),
+			"password": row["password"],
+			"url":      first(row, "url", "web site"),
+			"notes":    first(row, "notes", "comments"),
+		}
+		template := "login"
+		if values["username"] == "" && values["password"] == "" && values["url"] == "" {
+			template = "note"
+		}
+		extra := []templates.FieldValue{field("TOTP", row["totp"], true)}
+		items = append(items, newItem(first(row, "title", "account"), folder, splitTags(row["tags"]), template, values, extra))
+	}
+	return items, nil
+}
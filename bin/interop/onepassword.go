@@ -0,0 +1,196 @@
+package interop
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"Lockr/bin/templates"
+)
+
+// Categories of 1Password items mapped to templates other than note
+const (
+	onePasswordLogin    = "001"
+	onePasswordCard     = "002"
+	onePasswordPassword = "005"
+	onePasswordRouter   = "109"
+)
+
+// onePasswordExport is the layout of the export.data file of a .1pux export
+type onePasswordExport struct {
+	Accounts []struct {
+		Vaults []struct {
+			Attrs struct {
+				Name string `json:"name"`
+			} `json:"attrs"`
+			Items []onePasswordItem `json:"items"`
+		} `json:"vaults"`
+	} `json:"accounts"`
+}
+
+// onePasswordItem is an item of a .1pux export
+type onePasswordItem struct {
+	CategoryUUID string `json:"categoryUuid"`
+	FavIndex     int    `json:"favIndex"`
+	State        string `json:"state"`
+	Overview     struct {
+		Title string   `json:"title"`
+		URL   string   `json:"url"`
+		Tags  []string `json:"tags"`
+	} `json:"overview"`
+	Details struct {
+		LoginFields []struct {
+			Value       string `json:"value"`
+			Name        string `json:"name"`
+			Designation string `json:"designation"`
+		} `json:"loginFields"`
+		NotesPlain string `json:"notesPlain"`
+		Password   string `json:"password"`
+		Sections   []struct {
+			Fields []struct {
+				Title string                     `json:"title"`
+				ID    string                     `json:"id"`
+				Value map[string]json.RawMessage `json:"value"`
+			} `json:"fields"`
+		} `json:"sections"`
+	} `json:"details"`
+}
+
+// ReadOnePassword reads a 1Password export: a .1pux file, where each vault becomes
+// a folder, or a CSV export. Tags are kept, and favorites are tagged favorite.
+func ReadOnePassword(path string) ([]Item, error) {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return readOnePasswordCSV(path)
+	}
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open 1Password export: %w", err)
+	}
+	defer archive.Close()
+	file, err := archive.Open("export.data")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open 1Password export: %w", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read 1Password export: %w", err)
+	}
+	var export onePasswordExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("failed to parse 1Password export: %w", err)
+	}
+
+	var items []Item
+	for _, account := range export.Accounts {
+		for _, vault := range account.Vaults {
+			for _, op := range vault.Items {
+				items = append(items, op.item(vault.Attrs.Name))
+			}
+		}
+	}
+	return items, nil
+}
+
+// item maps a 1Password item to an entry filed in folder
+func (op onePasswordItem) item(folder string) Item {
+	tags := op.Overview.Tags
+	if op.FavIndex > 0 {
+		tags = append(tags, "favorite")
+	}
+	if op.State == "archived" {
+		tags = append(tags, "archived")
+	}
+	values := map[string]string{"notes": op.Details.NotesPlain, "url": op.Overview.URL}
+	for _, f := range op.Details.LoginFields {
+		switch f.Designation {
+		case "username":
+			values["username"] = f.Value
+		case "password":
+			values["password"] = f.Value
+		}
+	}
+	if op.Details.Password != "" {
+		values["password"] = op.Details.Password
+	}
+
+	template := "note"
+	switch op.CategoryUUID {
+	case onePasswordLogin, onePasswordPassword:
+		template = "login"
+	case onePasswordCard:
+		template = "card"
+	case onePasswordRouter:
+		template = "wifi"
+	}
+	// Fields of the template's own held in sections, by their 1Password ids
+	known := map[string]string{
+		"cardholder": "cardholder", "ccnum": "number", "cvv": "cvv", "expiry": "expiry",
+		"network_name": "ssid", "wireless_password": "password",
+	}
+	var extra []templates.FieldValue
+	for _, section := range op.Details.Sections {
+		for _, f := range section.Fields {
+			value, secret := onePasswordValue(f.Value)
+			if name, ok := known[f.ID]; ok && hasField(template, name) {
+				values[name] = value
+				continue
+			}
+			extra = append(extra, field(f.Title, value, secret))
+		}
+	}
+	return newItem(op.Overview.Title, folder, tags, template, values, extra)
+}
+
+// onePasswordValue returns the value of a field of a .1pux export, which is an
+// object keyed by its kind, and whether it's secret
+func onePasswordValue(value map[string]json.RawMessage) (string, bool) {
+	for kind, raw := range value {
+		secret := kind == "concealed" || kind == "totp" || kind == "creditCardNumber"
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			return s, secret
+		}
+		var n int64
+		if json.Unmarshal(raw, &n) == nil {
+			if kind == "monthYear" {
+				// YYYYMM
+				return fmt.Sprintf("%02d/%d", n%100, n/100), false
+			}
+			return strconv.FormatInt(n, 10), secret
+		}
+	}
+	return "", false
+}
+
+// readOnePasswordCSV reads a CSV export of 1Password, which holds logins
+func readOnePasswordCSV(path string) ([]Item, error) {
+	rows, err := readCSV(path)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, 0, len(rows))
+	for _, row := range rows {
+		tags := splitTags(row["tags"])
+		if favorite := strings.ToLower(row["favorite"]); favorite == "true" || favorite == "1" {
+			tags = append(tags, "favorite")
+		}
+		values := map[string]string{
+			"username": row["username"],
+			"password": row["password"],
+			"url":      first(row, "url", "website"),
+			"notes":    first(row, "notes", "notesplain"),
+		}
+		template := "login"
+		if values["username"] == "" && values["password"] == "" && values["url"] == "" {
+			template = "note"
+		}
+		extra := []templates.FieldValue{field("TOTP", first(row, "otpauth", "one-time password"), true)}
+		items = append(items, newItem(row["title"], row["vault"], tags, template, values, extra))
+	}
+	return items, nil
+}
@@ -0,0 +1,180 @@
+package interop
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"Lockr/bin/templates"
+)
+
+// GPGDecrypt decrypts a file with gpg, which asks for the passphrase of its key
+// through the gpg agent
+func GPGDecrypt(file string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("gpg", "--quiet", "--decrypt", file)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w: %s", file, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// ReadPass reads a pass password store, decrypting each .gpg file with decrypt.
+// Its directories become folders. The first line of a file is the password, and
+// lines like "login: bob" or "url: ..." after it fill in the other fields; lines
+// of other keys become fields of their own, and the rest notes.
+func ReadPass(dir string, decrypt func(file string) ([]byte, error)) ([]Item, error) {
+	var items []Item
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && strings.HasPrefix(d.Name(), ".") && file != dir {
+			return filepath.SkipDir // .git and the like
+		}
+		if d.IsDir() || filepath.Ext(file) != ".gpg" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		data, err := decrypt(file)
+		if err != nil {
+			return err
+		}
+		folder, name := path.Split(strings.TrimSuffix(filepath.ToSlash(rel), ".gpg"))
+		items = append(items, passItem(name, folder, string(data)))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pass store: %w", err)
+	}
+	return items, nil
+}
+
+// passItem maps a decrypted pass file to a login
+func passItem(name, folder, data string) Item {
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(data, "\r\n", "\n"), "\n"), "\n")
+	values := map[string]string{"password": lines[0]}
+	var extra []templates.FieldValue
+	var notes []string
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, "otpauth://") {
+			extra = append(extra, field("TOTP", line, true))
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || key == "" || strings.ContainsAny(key, " \t") || strings.HasPrefix(value, "//") {
+			notes = append(notes, line)
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(key) {
+		case "login", "username", "user", "email":
+			if values["username"] == "" {
+				values["username"] = value
+				continue
+			}
+		case "url", "website", "site":
+			if values["url"] == "" {
+				values["url"] = value
+				continue
+			}
+		}
+		extra = append(extra, field(key, value, false))
+	}
+	values["notes"] = strings.TrimSpace(strings.Join(notes, "\n"))
+	return newItem(name, folder, nil, "login", values, extra)
+}
+
+// GPGEncrypt encrypts data with gpg for recipients, writing it to file
+func GPGEncrypt(file string, data []byte, recipients []string) error {
+	args := []string{"--quiet", "--batch", "--yes", "--encrypt", "--output", file}
+	for _, recipient := range recipients {
+		args = append(args, "--recipient", recipient)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("gpg", args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to encrypt %s: %w: %s", file, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// WritePass writes items as a pass password store in dir, for recipients: a .gpg
+// file per item under its folder, in the layout ReadPass reads, encrypted with
+// encrypt. Paths used more than once are numbered from the second.
+func WritePass(dir string, recipients []string, items []Item, encrypt func(file string, data []byte, recipients []string) error) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create pass store: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".gpg-id"), []byte(strings.Join(recipients, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write .gpg-id: %w", err)
+	}
+	used := make(map[string]bool)
+	for _, it := range items {
+		base := passPath(it)
+		name := base
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s-%d", base, n)
+		}
+		used[name] = true
+
+		file := filepath.Join(dir, filepath.FromSlash(name)+".gpg")
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return fmt.Errorf("failed to create pass store: %w", err)
+		}
+		if err := encrypt(file, []byte(passFile(it)), recipients); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// passPath returns the path of an item in a pass store, without the extension,
+// keeping out parts that would leave the store
+func passPath(it Item) string {
+	var parts []string
+	for _, part := range strings.Split(it.Folder+"/"+it.Name, "/") {
+		if part != "" && part != "." && part != ".." && !strings.HasPrefix(part, ".") {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "untitled"
+	}
+	return strings.Join(parts, "/")
+}
+
+// passFile returns the contents of the pass file of an item: the password, then
+// a "label: value" line per other field and the notes
+func passFile(it Item) string {
+	lines := []string{it.Entry.Get("password")}
+	for _, f := range it.Entry.Fields {
+		switch {
+		case f.Value == "" || f.Name == "password" || f.Name == "notes":
+		case strings.HasPrefix(f.Value, "otpauth://"):
+			lines = append(lines, f.Value)
+		default:
+			label := f.Name
+			if f.Name == "username" {
+				label = "login"
+			}
+			lines = append(lines, label+": "+strings.ReplaceAll(f.Value, "\n", " "))
+		}
+	}
+	if notes := it.Entry.Get("notes"); notes != "" {
+		lines = append(lines, notes)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
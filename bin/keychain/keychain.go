@@ -0,0 +1,34 @@
+// Package keychain stores secrets in the keychain of the operating system: the
+// macOS Keychain, the Windows Credential Manager, or the Secret Service of
+// libsecret on other Unix systems
+package keychain
+
+import "errors"
+
+var (
+	// ErrNotFound is returned when the keychain holds no secret for the account
+	ErrNotFound = errors.New("secret not found in the keychain")
+	// ErrUnsupported is returned when no keychain is available, for instance
+	// without secret-tool or on a platform with no keychain
+	ErrUnsupported = errors.New("no OS keychain available")
+)
+
+// Get returns the secret stored for account of service
+func Get(service, account string) (string, error) {
+	return get(service, account)
+}
+
+// Set stores the secret of account of service, replacing any stored before
+func Set(service, account, secret string) error {
+	return set(service, account, secret)
+}
+
+// Delete removes the secret of account of service. Deleting a secret that isn't
+// stored is not an error.
+func Delete(service, account string) error {
+	err := remove(service, account)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package keychain
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// notFoundStatus is the exit status of security when no item matches
+const notFoundStatus = 44
+
+// get reads a generic password item with the security tool
+func get(service, account string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w").Output()
+	if err != nil {
+		return "", securityError(err)
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// set adds or updates a generic password item. The command is written to the
+// interactive mode of security on stdin, keeping the secret out of its arguments.
+func set(service, account, secret string) error {
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+		quote(service), quote(account), quote(secret)))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to store secret in the keychain: %w", securityError(err))
+	}
+	// The interactive mode reports a failed command but still exits with success
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return fmt.Errorf("failed to store secret in the keychain: %s", msg)
+	}
+	return nil
+}
+
+// remove deletes a generic password item
+func remove(service, account string) error {
+	if err := exec.Command("security", "delete-generic-password", "-s", service, "-a", account).Run(); err != nil {
+		return securityError(err)
+	}
+	return nil
+}
+
+// securityError translates a failure of the security tool
+func securityError(err error) error {
+	var exit *exec.ExitError
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return ErrUnsupported
+	case errors.As(err, &exit) && exit.ExitCode() == notFoundStatus:
+		return ErrNotFound
+	}
+	return fmt.Errorf("keychain: %w", err)
+}
+
+// quote quotes a word for the command line of security's interactive mode
+func quote(word string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(word) + `"`
+}
@@ -0,0 +1,18 @@
+//go:build !unix && !windows
+
+package keychain
+
+// get fails, as the platform has no keychain
+func get(service, account string) (string, error) {
+	return "", ErrUnsupported
+}
+
+// set fails, as the platform has no keychain
+func set(service, account, secret string) error {
+	return ErrUnsupported
+}
+
+// remove fails, as the platform has no keychain
+func remove(service, account string) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,55 @@
+//go:build unix && !darwin
+
+package keychain
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// get looks the secret up in the Secret Service with secret-tool, which exits
+// with status 1 and no output when there's none
+func get(service, account string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", service, "account", account).Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() == 1 && len(exit.Stderr) == 0 {
+			return "", ErrNotFound
+		}
+		return "", secretToolError(err)
+	}
+	return string(out), nil
+}
+
+// set stores the secret, which secret-tool reads from stdin so it stays out of
+// its arguments
+func set(service, account, secret string) error {
+	cmd := exec.Command("secret-tool", "store", "--label", service+" "+account, "service", service, "account", account)
+	cmd.Stdin = strings.NewReader(secret)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to store secret in the keychain: %w", secretToolError(err))
+	}
+	return nil
+}
+
+// remove clears the secret from the Secret Service
+func remove(service, account string) error {
+	if err := exec.Command("secret-tool", "clear", "service", service, "account", account).Run(); err != nil {
+		return secretToolError(err)
+	}
+	return nil
+}
+
+// secretToolError translates a failure of secret-tool
+func secretToolError(err error) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return ErrUnsupported
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && len(exit.Stderr) > 0 {
+		return fmt.Errorf("keychain: %s", strings.TrimSpace(string(exit.Stderr)))
+	}
+	return fmt.Errorf("keychain: %w", err)
+}
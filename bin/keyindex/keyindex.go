@@ -0,0 +1,239 @@
+package keyindex
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"Lockr/bin/content"
+	"Lockr/bin/lsmtree"
+)
+
+// Index is an in-memory sorted set of the live keys of a store, kept up to date
+// from the tree's change feed so listing, filtering and completion don't rescan
+// the store. It also maps the tags and folders in the values' content headers to
+// their keys, so listing by tag or folder doesn't read every value.
+type Index struct {
+	mutex    sync.RWMutex
+	keys     []string
+	tags     map[string]map[string]bool // keys by tag
+	folders  map[string]map[string]bool // keys by folder
+	building bool                       // set while Watch scans the tree
+	pending  []lsmtree.Change           // changes received while building
+}
+
+// New builds an index of the keys in store
+func New(store lsmtree.Store) (*Index, error) {
+	it, err := store.Scan("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	idx := &Index{}
+	for it.Next() {
+		// Scans return keys in order, so appending keeps the index sorted
+		idx.keys = append(idx.keys, it.Key())
+		idx.indexMeta(it.Key(), it.Value())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Watch builds an index of the tree's keys and subscribes it to the change feed.
+// The returned function stops the updates.
+func Watch(tree *lsmtree.LSMTree) (*Index, func(), error) {
+	idx := &Index{building: true}
+	// Subscribe before scanning so no write is missed. Changes arriving while the
+	// index is built are replayed on top of the scan in order, which is correct
+	// whether or not the scan already saw them.
+	unsubscribe := tree.Subscribe(idx.Apply)
+	built, err := New(tree)
+	if err != nil {
+		unsubscribe()
+		return nil, nil, err
+	}
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.keys, idx.tags, idx.folders = built.keys, built.tags, built.folders
+	for _, change := range idx.pending {
+		idx.apply(change)
+	}
+	idx.pending, idx.building = nil, false
+	return idx, unsubscribe, nil
+}
+
+// Apply updates the index with a change from the change feed
+func (idx *Index) Apply(change lsmtree.Change) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if idx.building {
+		idx.pending = append(idx.pending, change)
+		return
+	}
+	idx.apply(change)
+}
+
+// apply inserts or removes the changed key. The mutex must be held.
+func (idx *Index) apply(change lsmtree.Change) {
+	i := sort.SearchStrings(idx.keys, change.Key)
+	present := i < len(idx.keys) && idx.keys[i] == change.Key
+	switch {
+	case change.Deleted && present:
+		idx.keys = append(idx.keys[:i], idx.keys[i+1:]...)
+	case !change.Deleted && !present:
+		idx.keys = append(idx.keys, "")
+		copy(idx.keys[i+1:], idx.keys[i:])
+		idx.keys[i] = change.Key
+	}
+	if present {
+		unindex(idx.tags, change.Key)
+		unindex(idx.folders, change.Key)
+	}
+	if !change.Deleted {
+		idx.indexMeta(change.Key, change.Value)
+	}
+}
+
+// indexMeta records the tags and folder of a key's stored value
+func (idx *Index) indexMeta(key, stored string) {
+	for _, tag := range content.Tags(stored) {
+		idx.tags = add(idx.tags, tag, key)
+	}
+	if folder := content.Folder(stored); folder != "" {
+		idx.folders = add(idx.folders, folder, key)
+	}
+}
+
+// add puts key in the set of name, creating the map and set as needed
+func add(sets map[string]map[string]bool, name, key string) map[string]map[string]bool {
+	if sets == nil {
+		sets = make(map[string]map[string]bool)
+	}
+	if sets[name] == nil {
+		sets[name] = make(map[string]bool)
+	}
+	sets[name][key] = true
+	return sets
+}
+
+// unindex removes key from every set, dropping the sets left empty
+func unindex(sets map[string]map[string]bool, key string) {
+	for name, keys := range sets {
+		if keys[key] {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(sets, name)
+			}
+		}
+	}
+}
+
+// Tagged returns the keys with tag in order
+func (idx *Index) Tagged(tag string) []string {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	return sorted(idx.tags[tag])
+}
+
+// InFolder returns the keys filed in folder or its subfolders in order
+func (idx *Index) InFolder(folder string) []string {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	keys := make(map[string]bool)
+	for name, inFolder := range idx.folders {
+		if content.InFolder(name, folder) {
+			for key := range inFolder {
+				keys[key] = true
+			}
+		}
+	}
+	return sorted(keys)
+}
+
+// Tags returns the tags in use and the number of keys with each
+func (idx *Index) Tags() map[string]int {
+	return idx.counts(idx.tags)
+}
+
+// Folders returns the folders in use and the number of keys filed directly in each
+func (idx *Index) Folders() map[string]int {
+	return idx.counts(idx.folders)
+}
+
+// counts returns the size of every set
+func (idx *Index) counts(sets map[string]map[string]bool) map[string]int {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	counts := make(map[string]int, len(sets))
+	for name, keys := range sets {
+		counts[name] = len(keys)
+	}
+	return counts
+}
+
+// sorted returns the keys of a set in order
+func sorted(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Len returns the number of indexed keys
+func (idx *Index) Len() int {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	return len(idx.keys)
+}
+
+// Keys returns the keys starting with prefix in order
+func (idx *Index) Keys(prefix string) []string {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	start := sort.SearchStrings(idx.keys, prefix)
+	end := start
+	for end < len(idx.keys) && strings.HasPrefix(idx.keys[end], prefix) {
+		end++
+	}
+	return append([]string(nil), idx.keys[start:end]...)
+}
+
+// Filter returns the keys containing substr in order
+func (idx *Index) Filter(substr string) []string {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	var matches []string
+	for _, key := range idx.keys {
+		if strings.Contains(key, substr) {
+			matches = append(matches, key)
+		}
+	}
+	return matches
+}
+
+// Complete returns the longest common prefix of the keys starting with prefix,
+// or prefix itself if no key matches
+func (idx *Index) Complete(prefix string) string {
+	keys := idx.Keys(prefix)
+	if len(keys) == 0 {
+		return prefix
+	}
+	// Keys are sorted, so the common prefix of all of them is that of the first and last
+	first, last := keys[0], keys[len(keys)-1]
+	n := 0
+	for n < len(first) && n < len(last) && first[n] == last[n] {
+		n++
+	}
+	return first[:n]
+}
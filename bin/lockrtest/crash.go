@@ -0,0 +1,527 @@
+package lockrtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"Lockr/bin/lsmtree"
+)
+
+// ErrCrashed is returned by every call on a CrashFS once it has crashed
+var ErrCrashed = errors.New("lockrtest: simulated crash")
+
+// CrashFS is an lsmtree.FS that simulates a power loss. It keeps its files in a
+// MemFS and remembers how much of each one was synced. Creating, renaming,
+// truncating and removing files are durable once they return, while written data
+// only is once its file is synced. After the crash, set with CrashAfter or Crash,
+// every call fails with ErrCrashed, and Restart returns what was left on disk.
+type CrashFS struct {
+	mutex   sync.Mutex
+	fs      *lsmtree.MemFS
+	nodes   map[string]*crashNode // by path
+	dirs    map[string]bool
+	ops     int // mutating calls made
+	crashAt int // mutating call that crashes, 0 for none
+	crashed bool
+}
+
+// crashNode is a file of a CrashFS, shared by its handles
+type crashNode struct {
+	path   string // current path, empty once the file is removed
+	synced []byte // contents as of the last sync
+}
+
+var _ lsmtree.FS = (*CrashFS)(nil)
+
+// NewCrashFS creates an empty CrashFS
+func NewCrashFS() *CrashFS {
+	return &CrashFS{fs: lsmtree.NewMemFS(), nodes: make(map[string]*crashNode), dirs: make(map[string]bool)}
+}
+
+// CrashAfter makes the nth mutating call from now on crash, failing without
+// effect. Files are mutated by Create, Append, Rename, Remove, RemoveAll,
+// MkdirAll, Truncate, and the Write and Sync of open files.
+func (c *CrashFS) CrashAfter(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.crashAt = c.ops + n
+}
+
+// Crash crashes the file system now unless it already has
+func (c *CrashFS) Crash() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.crashed = true
+}
+
+// Crashed reports whether the file system has crashed
+func (c *CrashFS) Crashed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.crashed
+}
+
+// Ops returns the number of mutating calls made so far, including the one that crashed
+func (c *CrashFS) Ops() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ops
+}
+
+// Restart returns a MemFS holding what a power loss leaves: the synced contents of
+// every file, followed by a prefix of random length of what was written after the
+// last sync, as the disk may have written part of the page cache back
+func (c *CrashFS) Restart(rng *rand.Rand) (*lsmtree.MemFS, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	image := lsmtree.NewMemFS()
+	dirs := sortedKeys(c.dirs)
+	for _, dir := range dirs {
+		if err := image.MkdirAll(dir); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range sortedKeys(c.nodes) {
+		node := c.nodes[path]
+		current, err := c.contents(path)
+		if err != nil {
+			return nil, err
+		}
+		data := node.synced
+		if bytes.HasPrefix(current, node.synced) {
+			data = current[:len(node.synced)+rng.Intn(len(current)-len(node.synced)+1)]
+		}
+		file, err := image.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := file.Write(data); err != nil {
+			return nil, err
+		}
+		if err := file.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return image, nil
+}
+
+// step accounts for a mutating call, failing it if the file system crashes now
+// or already has. The mutex must be held.
+func (c *CrashFS) step() error {
+	if c.crashed {
+		return ErrCrashed
+	}
+	c.ops++
+	if c.crashAt > 0 && c.ops >= c.crashAt {
+		c.crashed = true
+		return ErrCrashed
+	}
+	return nil
+}
+
+// check fails a call that doesn't mutate files once the file system has crashed.
+// The mutex must be held.
+func (c *CrashFS) check() error {
+	if c.crashed {
+		return ErrCrashed
+	}
+	return nil
+}
+
+// contents returns the current contents of a file. The mutex must be held.
+func (c *CrashFS) contents(path string) ([]byte, error) {
+	file, err := c.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// Open opens a file for reading
+func (c *CrashFS) Open(name string) (lsmtree.File, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	file, err := c.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &crashFile{fs: c, file: file, node: c.nodes[filepath.Clean(name)]}, nil
+}
+
+// Create creates a file for writing, truncating it if it exists
+func (c *CrashFS) Create(name string) (lsmtree.File, error) {
+	return c.openWriter(name, true)
+}
+
+// Append opens a file for writing at its end, creating it if needed
+func (c *CrashFS) Append(name string) (lsmtree.File, error) {
+	return c.openWriter(name, false)
+}
+
+// openWriter opens a file for writing, emptying it if truncate is set
+func (c *CrashFS) openWriter(name string, truncate bool) (lsmtree.File, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.step(); err != nil {
+		return nil, err
+	}
+	var file lsmtree.File
+	var err error
+	if truncate {
+		file, err = c.fs.Create(name)
+	} else {
+		file, err = c.fs.Append(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	name = filepath.Clean(name)
+	node, ok := c.nodes[name]
+	if !ok {
+		node = &crashNode{path: name}
+		c.nodes[name] = node
+	}
+	if truncate {
+		node.synced = nil
+	}
+	return &crashFile{fs: c, file: file, node: node}, nil
+}
+
+// Rename replaces newname by oldname
+func (c *CrashFS) Rename(oldname, newname string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.step(); err != nil {
+		return err
+	}
+	if err := c.fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	moved := make(map[string]*crashNode)
+	for path, node := range c.nodes {
+		if rel, ok := under(oldname, path); ok {
+			delete(c.nodes, path)
+			node.path = filepath.Join(newname, rel)
+			moved[node.path] = node
+		}
+	}
+	for path, node := range moved {
+		if replaced, ok := c.nodes[path]; ok {
+			replaced.path = ""
+		}
+		c.nodes[path] = node
+	}
+	for dir := range c.dirs {
+		if rel, ok := under(oldname, dir); ok {
+			delete(c.dirs, dir)
+			c.dirs[filepath.Join(newname, rel)] = true
+		}
+	}
+	return nil
+}
+
+// Remove removes a file or an empty directory
+func (c *CrashFS) Remove(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.step(); err != nil {
+		return err
+	}
+	if err := c.fs.Remove(name); err != nil {
+		return err
+	}
+	c.forget(filepath.Clean(name))
+	return nil
+}
+
+// RemoveAll removes a path and everything under it
+func (c *CrashFS) RemoveAll(name string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.step(); err != nil {
+		return err
+	}
+	if err := c.fs.RemoveAll(name); err != nil {
+		return err
+	}
+	c.forget(filepath.Clean(name))
+	return nil
+}
+
+// forget drops the files and directories at or under a removed path. The mutex must be held.
+func (c *CrashFS) forget(name string) {
+	for path, node := range c.nodes {
+		if _, ok := under(name, path); ok {
+			node.path = ""
+			delete(c.nodes, path)
+		}
+	}
+	for dir := range c.dirs {
+		if _, ok := under(name, dir); ok {
+			delete(c.dirs, dir)
+		}
+	}
+}
+
+// List returns the entries of a directory sorted by name
+func (c *CrashFS) List(dir string) ([]fs.FileInfo, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.fs.List(dir)
+}
+
+// Stat describes a file or directory
+func (c *CrashFS) Stat(name string) (fs.FileInfo, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c.fs.Stat(name)
+}
+
+// MkdirAll creates a directory and any missing parents
+func (c *CrashFS) MkdirAll(dir string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.step(); err != nil {
+		return err
+	}
+	if err := c.fs.MkdirAll(dir); err != nil {
+		return err
+	}
+	c.dirs[filepath.Clean(dir)] = true
+	return nil
+}
+
+// Truncate changes the size of a file, dropping what it cuts off from the synced contents
+func (c *CrashFS) Truncate(name string, size int64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.step(); err != nil {
+		return err
+	}
+	if err := c.fs.Truncate(name, size); err != nil {
+		return err
+	}
+	if node, ok := c.nodes[filepath.Clean(name)]; ok && int64(len(node.synced)) > size {
+		node.synced = node.synced[:size]
+	}
+	return nil
+}
+
+// under reports whether name is dir or beneath it, returning its relative path
+func under(dir, name string) (string, bool) {
+	if name == dir {
+		return "", true
+	}
+	rel, ok := strings.CutPrefix(name, dir+string(filepath.Separator))
+	return rel, ok
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// crashFile is an open file of a CrashFS
+type crashFile struct {
+	fs   *CrashFS
+	file lsmtree.File
+	node *crashNode // nil for files that existed before the CrashFS tracked them
+}
+
+// Read reads from the current offset
+func (f *crashFile) Read(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.fs.check(); err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+// ReadAt reads from an offset
+func (f *crashFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.fs.check(); err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, offset)
+}
+
+// Write appends to the file, which is lost in a crash until it's synced
+func (f *crashFile) Write(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.fs.step(); err != nil {
+		return 0, err
+	}
+	return f.file.Write(p)
+}
+
+// Close closes the handle, even after a crash
+func (f *crashFile) Close() error {
+	return f.file.Close()
+}
+
+// Stat describes the file
+func (f *crashFile) Stat() (fs.FileInfo, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.fs.check(); err != nil {
+		return nil, err
+	}
+	return f.file.Stat()
+}
+
+// Sync makes what was written to the file survive a crash
+func (f *crashFile) Sync() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if err := f.fs.step(); err != nil {
+		return err
+	}
+	if f.node == nil || f.node.path == "" {
+		return nil
+	}
+	data, err := f.fs.contents(f.node.path)
+	if err != nil {
+		return fmt.Errorf("failed to sync %s: %w", f.node.path, err)
+	}
+	f.node.synced = data
+	return nil
+}
+
+// CheckCrashConsistency crashes a tree writing the batches of writes, one at a
+// time, after a random number of mutating file system calls, runs times over,
+// then reopens it from what the crash left on disk. The tree must recover and
+// hold the writes of a prefix of the batches, each applied whole or not at all,
+// including every batch acknowledged before the crash when options use
+// SyncAlways. The FS and Logger of options are replaced, and failures report
+// the seed and run to reproduce them with.
+func CheckCrashConsistency(t testing.TB, options lsmtree.Options, writes []*lsmtree.WriteBatch, runs int, seed int64) {
+	t.Helper()
+
+	// states[i] is what the tree holds after the first i batches
+	states := make([]map[string]string, len(writes)+1)
+	states[0] = map[string]string{}
+	for i, batch := range writes {
+		states[i+1] = maps.Clone(states[i])
+		for _, op := range batch.Ops() {
+			if op.Delete || op.Value == "" {
+				delete(states[i+1], op.Key)
+			} else {
+				states[i+1][op.Key] = op.Value
+			}
+		}
+	}
+
+	options.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	const dataDir = "/lockr"
+	run := func(crash *CrashFS) int {
+		options.FS = crash
+		tree := lsmtree.NewLSMTreeWithOptions(dataDir, options)
+		acked := 0
+		if err := tree.Recover(); err == nil {
+			for _, batch := range writes {
+				if err := tree.Batch(batch); err != nil {
+					if !crash.Crashed() {
+						t.Errorf("lockrtest: write failed before the crash: %v", err)
+					}
+					break
+				}
+				acked++
+			}
+		} else if !crash.Crashed() {
+			t.Errorf("lockrtest: failed to open the tree before the crash: %v", err)
+		}
+		tree.Close()
+		crash.Crash()
+		return acked
+	}
+
+	// A run without a crash point counts the calls a crash can hit
+	dry := NewCrashFS()
+	run(dry)
+	calls := dry.Ops()
+
+	rng := rand.New(rand.NewSource(seed))
+	for i := 0; i < runs; i++ {
+		crash := NewCrashFS()
+		crashAt := 1 + rng.Intn(calls)
+		crash.CrashAfter(crashAt)
+		acked := run(crash)
+
+		image, err := crash.Restart(rng)
+		if err != nil {
+			t.Fatalf("lockrtest: failed to restart after the crash: %v", err)
+		}
+		options.FS = image
+		tree := lsmtree.NewLSMTreeWithOptions(dataDir, options)
+		if err := tree.Recover(); err != nil {
+			t.Errorf("lockrtest: seed %d run %d, crash at call %d of %d: failed to recover: %v", seed, i, crashAt, calls, err)
+			continue
+		}
+		entries, err := tree.List()
+		tree.Close()
+		if err != nil {
+			t.Errorf("lockrtest: seed %d run %d, crash at call %d of %d: failed to list: %v", seed, i, crashAt, calls, err)
+			continue
+		}
+
+		first := 0
+		if options.WALSync == lsmtree.SyncAlways {
+			first = acked
+		}
+		last := min(acked+1, len(writes))
+		found := false
+		for k := first; k <= last && !found; k++ {
+			found = maps.Equal(entries, states[k])
+		}
+		if !found {
+			t.Errorf("lockrtest: seed %d run %d, crash at call %d of %d after %d acknowledged batches: recovered %d entries, not the state after %d to %d batches",
+				seed, i, crashAt, calls, acked, len(entries), first, last)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Package lockrtest provides an in-memory fake of lsmtree.Store and fixture
+// helpers for testing applications that embed Lockr.
+package lockrtest
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"Lockr/bin/lsmtree"
+)
+
+// Fake is an in-memory lsmtree.Store. It is safe for concurrent use.
+type Fake struct {
+	mutex  sync.RWMutex
+	data   map[string]string
+	closed bool
+}
+
+var _ lsmtree.Store = (*Fake)(nil)
+
+// NewFake creates an empty Fake store
+func NewFake() *Fake {
+	return &Fake{
+		data: make(map[string]string),
+	}
+}
+
+// Get retrieves the value for a key, returning an empty string if it doesn't exist
+func (f *Fake) Get(key string) (string, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.data[key], nil
+}
+
+// Set adds or updates a key-value pair
+func (f *Fake) Set(key, value string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return lsmtree.ErrClosed
+	}
+	f.set(key, value)
+	return nil
+}
+
+// Delete removes a key-value pair
+func (f *Fake) Delete(key string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return lsmtree.ErrClosed
+	}
+	delete(f.data, key)
+	return nil
+}
+
+// Scan returns an iterator over a copy of the entries in [start, end)
+func (f *Fake) Scan(start, end string) (lsmtree.Iterator, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	it := &iterator{pos: -1}
+	for key, value := range f.data {
+		if key >= start && (end == "" || key < end) {
+			it.entries = append(it.entries, [2]string{key, value})
+		}
+	}
+	sort.Slice(it.entries, func(i, j int) bool {
+		return it.entries[i][0] < it.entries[j][0]
+	})
+	return it, nil
+}
+
+// Batch applies all operations of the batch atomically
+func (f *Fake) Batch(batch *lsmtree.WriteBatch) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.closed {
+		return lsmtree.ErrClosed
+	}
+	for _, op := range batch.Ops() {
+		if op.Delete {
+			delete(f.data, op.Key)
+		} else {
+			f.set(op.Key, op.Value)
+		}
+	}
+	return nil
+}
+
+// Close rejects further writes
+func (f *Fake) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	return nil
+}
+
+// set stores a value, treating an empty value as a deletion like the real engine
+func (f *Fake) set(key, value string) {
+	if value == "" {
+		delete(f.data, key)
+		return
+	}
+	f.data[key] = value
+}
+
+// iterator walks a sorted copy of the Fake's entries
+type iterator struct {
+	entries [][2]string
+	pos     int
+}
+
+func (it *iterator) Next() bool {
+	if it.pos+1 >= len(it.entries) {
+		it.pos = len(it.entries)
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *iterator) Key() string   { return it.entries[it.pos][0] }
+func (it *iterator) Value() string { return it.entries[it.pos][1] }
+func (it *iterator) Err() error    { return nil }
+func (it *iterator) Close() error  { return nil }
+
+// Populate writes the fixtures into the store as a single batch, failing the test on error
+func Populate(t testing.TB, store lsmtree.Store, fixtures map[string]string) {
+	t.Helper()
+
+	batch := lsmtree.NewWriteBatch()
+	for key, value := range fixtures {
+		batch.Set(key, value)
+	}
+	if err := store.Batch(batch); err != nil {
+		t.Fatalf("lockrtest: failed to populate fixtures: %v", err)
+	}
+}
+
+// Dump returns all entries in [start, end) of the store, failing the test on error
+func Dump(t testing.TB, store lsmtree.Store, start, end string) map[string]string {
+	t.Helper()
+
+	it, err := store.Scan(start, end)
+	if err != nil {
+		t.Fatalf("lockrtest: failed to scan store: %v", err)
+	}
+	defer it.Close()
+
+	result := make(map[string]string)
+	for it.Next() {
+		result[it.Key()] = it.Value()
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("lockrtest: failed to iterate store: %v", err)
+	}
+	return result
+}
+
+// AssertValue fails the test if the key doesn't hold the expected value
+func AssertValue(t testing.TB, store lsmtree.Store, key, expected string) {
+	t.Helper()
+
+	value, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("lockrtest: failed to get %q: %v", key, err)
+	}
+	if value != expected {
+		t.Errorf("lockrtest: expected %q to be %q, got %q", key, expected, value)
+	}
+}
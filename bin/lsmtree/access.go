@@ -0,0 +1,203 @@
+package lsmtree
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// accessFileName is the file in the data directory holding per-key read statistics
+const accessFileName = "access.json"
+
+// accessSaveInterval is how often recorded reads are written to the access file
+const accessSaveInterval = 30 * time.Second
+
+// AccessStats counts the reads of a key recorded with Options.TrackAccess
+type AccessStats struct {
+	Reads    uint64    `json:"reads"`
+	LastRead time.Time `json:"last_read"`
+}
+
+// StaleKey is a live key that hasn't been read recently
+type StaleKey struct {
+	Key string
+	AccessStats
+}
+
+// accessLog records the reads of every key in memory. Reads only update the map;
+// it's written to the access file in the background and on Close, so tracking
+// doesn't turn reads into writes.
+type accessLog struct {
+	enabled bool // record reads; statistics already on disk are loaded either way
+
+	mutex sync.Mutex
+	since time.Time // when tracking started, the earliest a key can have been unused since
+	keys  map[string]*AccessStats
+	dirty bool // recorded since the last save
+}
+
+// accessFile is the layout of the access file
+type accessFile struct {
+	Since time.Time               `json:"since"`
+	Keys  map[string]*AccessStats `json:"keys"`
+}
+
+// newAccessLog creates an empty access log, recording reads if enabled
+func newAccessLog(enabled bool) *accessLog {
+	return &accessLog{enabled: enabled, keys: make(map[string]*AccessStats)}
+}
+
+// record counts a read of key
+func (a *accessLog) record(key string) {
+	if !a.enabled {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	stats, ok := a.keys[key]
+	if !ok {
+		stats = &AccessStats{}
+		a.keys[key] = stats
+	}
+	stats.Reads++
+	stats.LastRead = time.Now()
+	a.dirty = true
+}
+
+// forget drops the statistics of a deleted key
+func (a *accessLog) forget(key string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, ok := a.keys[key]; ok {
+		delete(a.keys, key)
+		a.dirty = true
+	}
+}
+
+// load reads the access file of the data directory, starting tracking now if
+// there is none and it's enabled
+func (a *accessLog) load(fsys FS, dataDir string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	data, err := readFile(fsys, filepath.Join(dataDir, accessFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		if a.enabled && a.since.IsZero() {
+			a.since, a.dirty = time.Now(), true
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read access statistics: %w", err)
+	}
+	var file accessFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse access statistics: %w", err)
+	}
+	a.since, a.keys = file.Since, file.Keys
+	if a.keys == nil {
+		a.keys = make(map[string]*AccessStats)
+	}
+	return nil
+}
+
+// save writes the access file if reads were recorded since the last save
+func (a *accessLog) save(fsys FS, dataDir string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if !a.dirty {
+		return nil
+	}
+	data, err := json.Marshal(accessFile{Since: a.since, Keys: a.keys})
+	if err != nil {
+		return fmt.Errorf("failed to encode access statistics: %w", err)
+	}
+	path := filepath.Join(dataDir, accessFileName)
+	tmpPath := path + ".tmp"
+	if err := writeFile(fsys, tmpPath, data); err != nil {
+		return fmt.Errorf("failed to write access statistics: %w", err)
+	}
+	if err := fsys.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace access statistics: %w", err)
+	}
+	a.dirty = false
+	return nil
+}
+
+// saveAccessEvery writes recorded reads to the access file every accessSaveInterval until stop is closed
+func (l *LSMTree) saveAccessEvery(stop <-chan struct{}) {
+	ticker := time.NewTicker(accessSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := l.access.save(l.fs, l.dataDir); err != nil {
+				l.options.Logger.Error("failed to save access statistics", "err", err)
+			}
+		}
+	}
+}
+
+// AccessStats returns the recorded reads of a key, reporting false if it was never read
+// while tracking
+func (l *LSMTree) AccessStats(key string) (AccessStats, bool) {
+	l.access.mutex.Lock()
+	defer l.access.mutex.Unlock()
+
+	stats, ok := l.access.keys[key]
+	if !ok {
+		return AccessStats{}, false
+	}
+	return *stats, true
+}
+
+// StaleKeys returns the live keys that haven't been read for at least unusedFor,
+// in key order, together with the time access tracking started. Keys never read
+// count as unused since then, so nothing is stale until tracking has run for
+// unusedFor. Without statistics, recorded with Options.TrackAccess, the time is zero.
+func (l *LSMTree) StaleKeys(unusedFor time.Duration) ([]StaleKey, time.Time, error) {
+	l.access.mutex.Lock()
+	since := l.access.since
+	reads := make(map[string]AccessStats, len(l.access.keys))
+	for key, stats := range l.access.keys {
+		reads[key] = *stats
+	}
+	l.access.mutex.Unlock()
+
+	if since.IsZero() {
+		return nil, since, nil
+	}
+	cutoff := time.Now().Add(-unusedFor)
+	if since.After(cutoff) {
+		return nil, since, nil
+	}
+
+	it, err := l.Scan("", "")
+	if err != nil {
+		return nil, since, err
+	}
+	defer it.Close()
+
+	var stale []StaleKey
+	for it.Next() {
+		stats := reads[it.Key()]
+		if stats.LastRead.Before(cutoff) {
+			stale = append(stale, StaleKey{Key: it.Key(), AccessStats: stats})
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, since, err
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Key < stale[j].Key })
+	return stale, since, nil
+}
@@ -0,0 +1,43 @@
+package lsmtree
+
+// BatchOp is a single operation recorded in a WriteBatch
+type BatchOp struct {
+	Key    string
+	Value  string
+	Delete bool
+}
+
+// WriteBatch collects Set and Delete operations that are applied together
+type WriteBatch struct {
+	ops []BatchOp
+}
+
+// NewWriteBatch creates an empty WriteBatch
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Set records a key-value pair to be added or updated
+func (b *WriteBatch) Set(key, value string) {
+	b.ops = append(b.ops, BatchOp{Key: key, Value: value})
+}
+
+// Delete records a key to be removed
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, BatchOp{Key: key, Delete: true})
+}
+
+// Len returns the number of operations in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Ops returns the operations in the order they were recorded
+func (b *WriteBatch) Ops() []BatchOp {
+	return b.ops
+}
+
+// Reset removes all operations from the batch so it can be reused
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
@@ -0,0 +1,273 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// errBlockTruncated is returned when a block ends in the middle of an entry
+var errBlockTruncated = errors.New("block truncated")
+
+// restartInterval is the number of entries between restart points of a data block
+const restartInterval = 16
+
+// blockBuilder accumulates prefix-compressed entries into a data block. Each entry
+// is encoded as
+//
+//	uvarint(shared) uvarint(unshared) uvarint(len(value)) key[shared:] value
+//
+// where shared is the length of the prefix it has in common with the previous key.
+// Every restartInterval entries the full key is stored (shared is 0), and the block
+// ends with the uint32 offsets of these restart points and their count, so a
+// lookup can binary search them instead of decoding every entry.
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	lastKey  string
+	firstKey string
+	entries  int
+}
+
+// add appends an entry to the block. Keys must be added in ascending order.
+func (b *blockBuilder) add(key, value string) {
+	shared := 0
+	if b.entries%restartInterval == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+	} else {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	}
+	if b.entries == 0 {
+		b.firstKey = key
+	}
+
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+	b.lastKey = key
+	b.entries++
+}
+
+// size returns the encoded size of the block so far, including the restart points
+func (b *blockBuilder) size() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// finish appends the restart points and returns the encoded block
+func (b *blockBuilder) finish() []byte {
+	for _, restart := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, restart)
+	}
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+	return b.buf
+}
+
+// reset clears the builder for the next block
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = b.restarts[:0]
+	b.lastKey = ""
+	b.firstKey = ""
+	b.entries = 0
+}
+
+// blockIterator walks the entries of an encoded data block
+type blockIterator struct {
+	data     []byte // the entries, without the restart points
+	restarts []byte // uint32 restart offsets of a prefix-compressed block
+	prefixed bool
+	pos      int
+	key      string
+	value    string
+	err      error
+}
+
+// newBlockIterator creates an iterator over a block of entries encoded as
+// uvarint(len(key)) key uvarint(len(value)) value, as written before keys were
+// prefix-compressed
+func newBlockIterator(data []byte) *blockIterator {
+	return &blockIterator{data: data}
+}
+
+// newPrefixBlockIterator creates an iterator over a block written by blockBuilder
+func newPrefixBlockIterator(data []byte) *blockIterator {
+	it := &blockIterator{prefixed: true}
+	if len(data) < 4 {
+		it.err = fmt.Errorf("%w: missing restart count", errBlockTruncated)
+		return it
+	}
+	count := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if uint64(len(data)-4)/4 < uint64(count) {
+		it.err = fmt.Errorf("%w: %d restart points don't fit the block", errBlockTruncated, count)
+		return it
+	}
+	end := len(data) - 4 - 4*int(count)
+	it.data, it.restarts = data[:end], data[end:len(data)-4]
+	return it
+}
+
+// Next decodes the next entry and reports whether one was available
+func (it *blockIterator) Next() bool {
+	if it.err != nil || it.pos >= len(it.data) {
+		return false
+	}
+	if it.prefixed {
+		return it.nextPrefixed()
+	}
+
+	key, err := it.readString()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	value, err := it.readString()
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.key, it.value = key, value
+	return true
+}
+
+// nextPrefixed decodes the next prefix-compressed entry
+func (it *blockIterator) nextPrefixed() bool {
+	start := it.pos
+	var lengths [3]uint64 // shared, unshared and value lengths
+	for i := range lengths {
+		length, n := binary.Uvarint(it.data[it.pos:])
+		if n <= 0 {
+			it.err = fmt.Errorf("%w at offset %d", errBlockTruncated, start)
+			return false
+		}
+		lengths[i] = length
+		it.pos += n
+	}
+	shared, unshared, valueLen := lengths[0], lengths[1], lengths[2]
+	if shared > uint64(len(it.key)) {
+		it.err = fmt.Errorf("entry at offset %d shares %d bytes with a %d byte key", start, shared, len(it.key))
+		return false
+	}
+	if uint64(len(it.data)-it.pos) < unshared || uint64(len(it.data)-it.pos)-unshared < valueLen {
+		it.err = fmt.Errorf("%w at offset %d", errBlockTruncated, start)
+		return false
+	}
+
+	keyEnd := it.pos + int(unshared)
+	it.key = it.key[:shared] + string(it.data[it.pos:keyEnd])
+	it.value = string(it.data[keyEnd : keyEnd+int(valueLen)])
+	it.pos = keyEnd + int(valueLen)
+	return true
+}
+
+// Seek positions the iterator at the first entry with a key >= target and reports
+// whether there is one. Prefix-compressed blocks binary search their restart points.
+func (it *blockIterator) Seek(target string) bool {
+	if it.prefixed && it.err == nil {
+		// Find the last restart point whose key is <= target
+		count := len(it.restarts) / 4
+		i := sort.Search(count, func(i int) bool {
+			it.pos, it.key = it.restart(i), ""
+			return !it.nextPrefixed() || it.key > target
+		}) - 1
+		it.err = nil
+		it.pos, it.key = 0, ""
+		if i > 0 {
+			it.pos = it.restart(i)
+		}
+	}
+	for it.Next() {
+		if it.key >= target {
+			return true
+		}
+	}
+	return false
+}
+
+// restart returns the offset of the i-th restart point
+func (it *blockIterator) restart(i int) int {
+	offset := int(binary.LittleEndian.Uint32(it.restarts[4*i:]))
+	if offset > len(it.data) {
+		return len(it.data)
+	}
+	return offset
+}
+
+// readString reads a uvarint length-prefixed string
+func (it *blockIterator) readString() (string, error) {
+	length, n := binary.Uvarint(it.data[it.pos:])
+	if n <= 0 || uint64(len(it.data)-it.pos-n) < length {
+		return "", fmt.Errorf("%w at offset %d", errBlockTruncated, it.pos)
+	}
+	it.pos += n
+	s := string(it.data[it.pos : it.pos+int(length)])
+	it.pos += int(length)
+	return s, nil
+}
+
+// Key returns the current key
+func (it *blockIterator) Key() string {
+	return it.key
+}
+
+// Value returns the current value
+func (it *blockIterator) Value() string {
+	return it.value
+}
+
+// Err returns the decoding error, if any
+func (it *blockIterator) Err() error {
+	return it.err
+}
+
+// blockHandle locates a data block within an SSTable file
+type blockHandle struct {
+	firstKey string
+	offset   uint64
+	length   uint64
+}
+
+// encodeIndex serializes the sparse block index
+func encodeIndex(handles []blockHandle) []byte {
+	var buf []byte
+	for _, h := range handles {
+		buf = binary.AppendUvarint(buf, uint64(len(h.firstKey)))
+		buf = append(buf, h.firstKey...)
+		buf = binary.AppendUvarint(buf, h.offset)
+		buf = binary.AppendUvarint(buf, h.length)
+	}
+	return buf
+}
+
+// decodeIndex parses a sparse block index
+func decodeIndex(data []byte) ([]blockHandle, error) {
+	var handles []blockHandle
+	for pos := 0; pos < len(data); {
+		keyLen, n := binary.Uvarint(data[pos:])
+		if n <= 0 || uint64(len(data)-pos-n) < keyLen {
+			return nil, fmt.Errorf("invalid index entry at offset %d", pos)
+		}
+		pos += n
+		firstKey := string(data[pos : pos+int(keyLen)])
+		pos += int(keyLen)
+
+		offset, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid index entry at offset %d", pos)
+		}
+		pos += n
+		length, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid index entry at offset %d", pos)
+		}
+		pos += n
+
+		handles = append(handles, blockHandle{firstKey: firstKey, offset: offset, length: length})
+	}
+	return handles, nil
+}
@@ -0,0 +1,113 @@
+package lsmtree
+
+import (
+	"container/list"
+	"sync"
+)
+
+// defaultBlockCacheSize is the default capacity in bytes of the block cache
+const defaultBlockCacheSize = 8 * 1024 * 1024 // 8MB
+
+// nextTableID hands out the SSTable ids that key the block cache
+var nextTableID uint64
+
+// blockCacheKey identifies a data block by SSTable id and block offset. Ids are
+// never reused, so blocks of deleted SSTables are never hit and simply age out.
+type blockCacheKey struct {
+	table  uint64
+	offset uint64
+}
+
+// blockCacheEntry is a decompressed data block held by the cache
+type blockCacheEntry struct {
+	key  blockCacheKey
+	data []byte
+}
+
+// blockCache is an LRU cache of decompressed data blocks shared by all SSTables,
+// bounded by the total size of the cached blocks
+type blockCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // of *blockCacheEntry, most recently used first
+	blocks   map[blockCacheKey]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+// BlockCacheStats reports block cache occupancy and effectiveness
+type BlockCacheStats struct {
+	Blocks   int    `json:"blocks"`
+	Bytes    int64  `json:"bytes"`
+	Capacity int64  `json:"capacity"`
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+}
+
+// HitRate returns the fraction of block reads served from the cache
+func (s BlockCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// newBlockCache creates a block cache holding up to capacity bytes of blocks
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   make(map[blockCacheKey]*list.Element),
+	}
+}
+
+// get returns a cached block. The returned slice must not be modified.
+func (c *blockCache) get(key blockCacheKey) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.blocks[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.hits++
+		return elem.Value.(*blockCacheEntry).data, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// add caches a block, evicting the least recently used blocks to stay within capacity
+func (c *blockCache) add(key blockCacheKey, data []byte) {
+	size := int64(len(data))
+	if size > c.capacity {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.blocks[key]; ok {
+		return
+	}
+	c.blocks[key] = c.lru.PushFront(&blockCacheEntry{key: key, data: data})
+	c.size += size
+	for c.size > c.capacity {
+		entry := c.lru.Remove(c.lru.Back()).(*blockCacheEntry)
+		delete(c.blocks, entry.key)
+		c.size -= int64(len(entry.data))
+	}
+}
+
+// stats returns a snapshot of the block cache counters
+func (c *blockCache) stats() BlockCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return BlockCacheStats{
+		Blocks:   c.lru.Len(),
+		Bytes:    c.size,
+		Capacity: c.capacity,
+		Hits:     c.hits,
+		Misses:   c.misses,
+	}
+}
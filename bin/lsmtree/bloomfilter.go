@@ -1,50 +1,333 @@
 package lsmtree
 
 import (
+	"encoding/binary"
+	"fmt"
 	"hash/fnv"
+	"math"
 )
 
+// defaultBloomBitsPerKey gives bloom filters a false positive rate of about 1%
+const defaultBloomBitsPerKey = 10
+
+// minBloomBits is the size of the bloom filter of an empty or tiny SSTable
+const minBloomBits = 64
+
+// maxBloomHashes caps the hash functions, which cost a probe each on lookups
+const maxBloomHashes = 30
+
+// FilterPolicy selects the kind of filter SSTables use to skip lookups of keys they don't hold
+type FilterPolicy byte
+
+const (
+	// BloomFilterPolicy builds bloom filters, the default
+	BloomFilterPolicy FilterPolicy = 0
+	// RibbonFilterPolicy builds ribbon filters, with the false positive rate of a
+	// bloom filter of Options.BloomBitsPerKey in about a quarter less memory. They
+	// take about 12 bytes per key while they're built.
+	RibbonFilterPolicy FilterPolicy = 1
+)
+
+// String returns the policy name
+func (p FilterPolicy) String() string {
+	switch p {
+	case BloomFilterPolicy:
+		return "bloom"
+	case RibbonFilterPolicy:
+		return "ribbon"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(p))
+	}
+}
+
+// ParseFilterPolicy parses a policy name as accepted on the command line
+func ParseFilterPolicy(name string) (FilterPolicy, error) {
+	switch name {
+	case "bloom", "":
+		return BloomFilterPolicy, nil
+	case "ribbon":
+		return RibbonFilterPolicy, nil
+	default:
+		return BloomFilterPolicy, fmt.Errorf("unknown filter policy %q", name)
+	}
+}
+
+// Filter is a probabilistic set of keys, which never misses one of its keys and
+// reports other keys with a small false positive probability
+type Filter interface {
+	// MightContain reports whether key might be in the set
+	MightContain(key string) bool
+	// Bits returns the size of the filter in bits
+	Bits() uint
+}
+
+// keyFilter is a Filter SSTables can store
+type keyFilter interface {
+	Filter
+	// probes returns the hash functions of a bloom filter or the fingerprint bits
+	// of a ribbon filter, recorded in the SSTable footer along with Bits
+	probes() uint
+	// bitsSet returns the number of bits set, for debugging
+	bitsSet() uint
+	// encode serializes the filter for decodeFilter
+	encode() []byte
+	// setHasher sets the hasher a decoded filter was built with, nil if it's a
+	// hasher named name the tree isn't opened with
+	setHasher(name string, hasher KeyHasher)
+}
+
+var (
+	_ keyFilter = (*BloomFilter)(nil)
+	_ keyFilter = (*RibbonFilter)(nil)
+)
+
+// NewFilter builds the filter of a policy for distinct keys, with bitsPerKey
+// bits per key for a bloom filter and its false positive rate for the others.
+// A nil hasher is FNVHasher.
+func NewFilter(policy FilterPolicy, keys []string, bitsPerKey int, hasher KeyHasher) Filter {
+	return newFilter(policy, keys, bitsPerKey, hasher)
+}
+
+// newFilter is NewFilter returning a filter SSTables can store
+func newFilter(policy FilterPolicy, keys []string, bitsPerKey int, hasher KeyHasher) keyFilter {
+	if hasher == nil {
+		hasher = FNVHasher()
+	}
+	if policy == RibbonFilterPolicy {
+		return newRibbonFilter(keys, bitsPerKey, hasher)
+	}
+	bf := NewBloomFilter(len(keys), bitsPerKey)
+	bf.setHasher(hasher.Name(), hasher)
+	for _, key := range keys {
+		bf.Add(key)
+	}
+	return bf
+}
+
+// ribbonFilterTag follows a zero size, which no bloom filter has, at the start
+// of an encoded ribbon filter
+const ribbonFilterTag = 1
+
+// hasherFilterTag follows a zero size at the start of a filter built with a
+// KeyHasher (format version 14+), and is followed by the hasher's name and the
+// filter. Filters without it hash keys as before.
+const hasherFilterTag = 2
+
+// encodeHasher prefixes an encoded filter with the name of the hasher that built it
+func encodeHasher(name string, filter []byte) []byte {
+	buf := []byte{0, hasherFilterTag}
+	buf = binary.AppendUvarint(buf, uint64(len(name)))
+	buf = append(buf, name...)
+	return append(buf, filter...)
+}
+
+// decodeFilter parses a filter serialized by encode at the start of data,
+// returning the bytes that follow it. Bloom filters start with their size, and
+// other filters with a zero and a tag naming their kind. The filters built with
+// a KeyHasher other than hasher and the built-in ones can't rule keys out.
+func decodeFilter(data []byte, hasher KeyHasher) (keyFilter, []byte, error) {
+	if size, n := binary.Uvarint(data); n <= 0 || size != 0 {
+		return decodeBloomFilter(data)
+	}
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("unknown filter kind")
+	}
+	switch data[1] {
+	case ribbonFilterTag:
+		return decodeRibbonFilter(data[2:])
+	case hasherFilterTag:
+		length, n := binary.Uvarint(data[2:])
+		if n <= 0 || uint64(len(data)-2-n) < length {
+			return nil, nil, fmt.Errorf("invalid key hasher name")
+		}
+		name := string(data[2+n : 2+n+int(length)])
+		filter, rest, err := decodeFilter(data[2+n+int(length):], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		filter.setHasher(name, resolveHasher(name, hasher))
+		return filter, rest, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown filter kind")
+	}
+}
+
 // BloomFilter represents a probabilistic data structure for set membership testing
 type BloomFilter struct {
-	bitArray  []bool
-	size      uint
+	bits      []uint64 // bit i is bit i%64 of word i/64
+	size      uint     // number of bits
 	hashFuncs uint
+	hasher    KeyHasher // combined by double hashing, nil for seeded hashes before format version 14
+	hashName  string    // name of the hasher, set even if the tree isn't opened with it
+	legacy    bool      // built before filters were sized per SSTable, with unmixed hashes
 }
 
-// NewBloomFilter creates a new BloomFilter with default size and number of hash functions
-func NewBloomFilter() *BloomFilter {
-	size := uint(2097152) // 2MB
-	hashFuncs := uint(7)
+// NewBloomFilter creates a BloomFilter for the given number of keys with
+// bitsPerKey bits per key, using the number of hash functions that minimizes
+// false positives and hashing keys with FNVHasher
+func NewBloomFilter(keys, bitsPerKey int) *BloomFilter {
+	if bitsPerKey <= 0 {
+		bitsPerKey = defaultBloomBitsPerKey
+	}
+	size := uint(keys) * uint(bitsPerKey)
+	if size < minBloomBits {
+		size = minBloomBits
+	}
+	size = (size + 63) / 64 * 64
 	return &BloomFilter{
-		bitArray:  make([]bool, size),
+		bits:      make([]uint64, size/64),
 		size:      size,
-		hashFuncs: hashFuncs,
+		hashFuncs: bloomHashCount(bitsPerKey),
+		hasher:    FNVHasher(),
+		hashName:  FNVHasher().Name(),
+	}
+}
+
+// bloomHashCount returns the number of hash functions minimizing the false
+// positives of a bloom filter with bitsPerKey bits per key
+func bloomHashCount(bitsPerKey int) uint {
+	hashFuncs := uint(math.Round(float64(bitsPerKey) * math.Ln2))
+	if hashFuncs < 1 {
+		return 1
 	}
+	return min(hashFuncs, maxBloomHashes)
+}
+
+// Bits returns the size of the BloomFilter in bits
+func (bf *BloomFilter) Bits() uint {
+	return bf.size
+}
+
+// probes returns the number of hash functions
+func (bf *BloomFilter) probes() uint {
+	return bf.hashFuncs
+}
+
+// setHasher sets the hasher of the BloomFilter
+func (bf *BloomFilter) setHasher(name string, hasher KeyHasher) {
+	bf.hashName, bf.hasher = name, hasher
 }
 
 // Add adds a key to the BloomFilter
 func (bf *BloomFilter) Add(key string) {
+	h1, h2 := bf.hashes(key)
 	for i := uint(0); i < bf.hashFuncs; i++ {
-		index := bf.hash(key, i)
-		bf.bitArray[index] = true
+		index := bf.index(key, i, h1, h2)
+		bf.bits[index/64] |= 1 << (index % 64)
 	}
 }
 
 // MightContain checks if a key might be in the BloomFilter
 func (bf *BloomFilter) MightContain(key string) bool {
+	if bf.hasher == nil && bf.hashName != "" {
+		return true // built with a hasher the tree isn't opened with
+	}
+	h1, h2 := bf.hashes(key)
 	for i := uint(0); i < bf.hashFuncs; i++ {
-		index := bf.hash(key, i)
-		if !bf.bitArray[index] {
+		index := bf.index(key, i, h1, h2)
+		if bf.bits[index/64]&(1<<(index%64)) == 0 {
 			return false
 		}
 	}
 	return true
 }
 
-// hash generates a hash for a given key and seed
-func (bf *BloomFilter) hash(key string, seed uint) uint {
+// hashes returns the two hashes of key that double hashing combines, reduced to
+// the filter size
+func (bf *BloomFilter) hashes(key string) (uint64, uint64) {
+	if bf.hasher == nil {
+		return 0, 0
+	}
+	size := uint64(bf.size)
+	h1, h2 := bf.hasher.Hash(key, 0)%size, bf.hasher.Hash(key, 1)%size
+	if h2 == 0 {
+		h2 = 1 // or every probe would test the same bit
+	}
+	return h1, h2
+}
+
+// index returns the bit tested by probe i of key, h1 + i*h2 following Kirsch
+// and Mitzenmacher, which is as good as independent hash functions
+func (bf *BloomFilter) index(key string, i uint, h1, h2 uint64) uint {
+	if bf.hasher == nil {
+		return bf.seededHash(key, i)
+	}
+	return uint((h1 + uint64(i)*h2) % uint64(bf.size))
+}
+
+// seededHash is the hash of probe seed of filters written before format version
+// 14, FNV-1a of the key and the seed byte. FNV-1a hashes of keys that only differ
+// in the seed byte are correlated, which only the sparse fixed-size filters of
+// older SSTables could afford, so they're mixed like in MurmurHash3.
+func (bf *BloomFilter) seededHash(key string, seed uint) uint {
 	h := fnv.New64a()
 	h.Write([]byte(key))
 	h.Write([]byte{byte(seed)})
-	return uint(h.Sum64() % uint64(bf.size))
+	sum := h.Sum64()
+	if !bf.legacy {
+		sum = mix64(sum)
+	}
+	return uint(sum % uint64(bf.size))
+}
+
+// mix64 is the 64-bit finalizer of MurmurHash3, spreading every input bit over the output
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// encode serializes the BloomFilter as uvarint(size) uvarint(hashFuncs) followed by
+// the packed bits, after the name of its hasher
+func (bf *BloomFilter) encode() []byte {
+	buf := binary.AppendUvarint(nil, uint64(bf.size))
+	buf = binary.AppendUvarint(buf, uint64(bf.hashFuncs))
+
+	bits := make([]byte, len(bf.bits)*8)
+	for i, word := range bf.bits {
+		binary.LittleEndian.PutUint64(bits[i*8:], word)
+	}
+	buf = append(buf, bits[:(bf.size+7)/8]...)
+	if bf.hashName == "" {
+		return buf
+	}
+	return encodeHasher(bf.hashName, buf)
+}
+
+// decodeBloomFilter parses a BloomFilter serialized by encode at the start of
+// data, returning the bytes that follow it
+func decodeBloomFilter(data []byte) (keyFilter, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("invalid bloom filter size")
+	}
+	data = data[n:]
+	hashFuncs, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("invalid bloom filter hash count")
+	}
+	data = data[n:]
+	if uint64(len(data)) < (size+7)/8 {
+		return nil, nil, fmt.Errorf("bloom filter has %d bytes of bits, expected %d", len(data), (size+7)/8)
+	}
+	if size == 0 {
+		return nil, nil, fmt.Errorf("bloom filter has no bits")
+	}
+	data, rest := data[:(size+7)/8], data[(size+7)/8:]
+
+	bf := &BloomFilter{
+		bits:      make([]uint64, (size+63)/64),
+		size:      uint(size),
+		hashFuncs: uint(hashFuncs),
+	}
+	word := make([]byte, 8)
+	for i := range bf.bits {
+		clear(word)
+		copy(word, data[i*8:])
+		bf.bits[i] = binary.LittleEndian.Uint64(word)
+	}
+	return bf, rest, nil
 }
@@ -1,65 +1,341 @@
 package lsmtree
 
 import (
+	"container/list"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
 
+// CachePolicy decides which values enter the cache
+type CachePolicy int
+
+const (
+	// WriteThrough caches every written value as well as every value read
+	WriteThrough CachePolicy = iota
+	// WriteAround invalidates cached values on write and only caches values read
+	WriteAround
+	// TinyLFU behaves like WriteAround, and when the cache is full only admits a
+	// read value if it is accessed more often than the entry it would evict
+	TinyLFU
+)
+
+// String returns the policy name
+func (p CachePolicy) String() string {
+	switch p {
+	case WriteThrough:
+		return "write-through"
+	case WriteAround:
+		return "write-around"
+	case TinyLFU:
+		return "tinylfu"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(p))
+	}
+}
+
+// ParseCachePolicy parses a policy name as accepted on the command line
+func ParseCachePolicy(name string) (CachePolicy, error) {
+	switch name {
+	case "write-through", "":
+		return WriteThrough, nil
+	case "write-around":
+		return WriteAround, nil
+	case "tinylfu":
+		return TinyLFU, nil
+	default:
+		return WriteThrough, fmt.Errorf("unknown cache policy %q", name)
+	}
+}
+
+// CacheEntry is a value held by the cache
 type CacheEntry struct {
+	key       string
 	value     string
 	timestamp time.Time
+	elem      *list.Element // position in the LRU list, nil while the key is pinned
 }
 
+// cacheEntryOverhead approximates the per-entry memory used beyond the key and value bytes
+const cacheEntryOverhead = 64
+
+// Cache holds recently used values, evicting the least recently used unpinned
+// entry once it holds maxSize entries or its entries use more than maxBytes
 type Cache struct {
-	entries     map[string]CacheEntry
-	mutex       sync.RWMutex
-	maxSize     int
-	accessCount map[string]int
+	entries   map[string]*CacheEntry
+	lru       *list.List // of the unpinned *CacheEntry, most recently used first
+	mutex     sync.RWMutex
+	maxSize   int
+	bytes     int64            // approximate memory used by the entries
+	maxBytes  int64            // memory budget, or 0 for none
+	admission *frequencySketch // only set for TinyLFU admission
+	pinned    map[string]bool  // keys never evicted
+	maxPinned int
+	hits      uint64
+	misses    uint64
+	rejected  uint64
+}
+
+// CacheStats reports cache occupancy and effectiveness
+type CacheStats struct {
+	Policy    string `json:"policy"`
+	Entries   int    `json:"entries"`
+	MaxSize   int    `json:"max_size"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"` // 0 when only MaxSize bounds the cache
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Rejected  uint64 `json:"rejected"` // reads not admitted by TinyLFU
+	Pinned    int    `json:"pinned"`   // keys exempt from eviction
+	MaxPinned int    `json:"max_pinned"`
 }
 
+// HitRate returns the fraction of lookups served from the cache
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// NewCache creates a cache holding up to maxSize entries
 func NewCache(maxSize int) *Cache {
 	return &Cache{
-		entries:     make(map[string]CacheEntry),
-		maxSize:     maxSize,
-		accessCount: make(map[string]int),
+		entries:   make(map[string]*CacheEntry),
+		lru:       list.New(),
+		maxSize:   maxSize,
+		pinned:    make(map[string]bool),
+		maxPinned: maxSize / 2,
+	}
+}
+
+// newCacheWithPolicy creates a cache bounded by entries and bytes that pins up to
+// maxPinned keys, enabling frequency-based admission for TinyLFU
+func newCacheWithPolicy(maxSize int, maxBytes int64, policy CachePolicy, maxPinned int) *Cache {
+	c := NewCache(maxSize)
+	c.maxBytes = maxBytes
+	if policy == TinyLFU {
+		c.admission = newFrequencySketch(maxSize)
 	}
+	c.maxPinned = maxPinned
+	return c
 }
 
+// Set caches the value of a key, evicting the least recently used entry if the cache is full
 func (c *Cache) Set(key, value string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	if len(c.entries) >= c.maxSize {
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxSize {
 		c.evict()
 	}
 
-	c.entries[key] = CacheEntry{value: value, timestamp: time.Now()}
-	c.accessCount[key] = 1
+	c.put(key, value)
+	c.shrink()
 }
 
+// Get returns the cached value of a key, marking it as the most recently used
 func (c *Cache) Get(key string) (string, bool) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.admission != nil {
+		c.admission.increment(key)
+	}
 
 	if entry, ok := c.entries[key]; ok {
-		c.accessCount[key]++
+		c.touch(entry)
+		c.hits++
 		return entry.value, true
 	}
+	c.misses++
 	return "", false
 }
 
-func (c *Cache) evict() {
-	var leastAccessed string
-	minCount := int(^uint(0) >> 1) // Max int value
+// fill adds a value read from the tree, unless valid reports that a write raced with the read
+func (c *Cache) fill(key, value string, valid func() bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !valid() {
+		return
+	}
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxSize {
+		// With TinyLFU, only replace the victim if the new key is more popular
+		if victim, ok := c.victim(); ok && c.admission != nil && c.admission.estimate(key) <= c.admission.estimate(victim) {
+			c.rejected++
+			return
+		}
+		c.evict()
+	}
+
+	c.put(key, value)
+	c.shrink()
+}
 
-	for key, count := range c.accessCount {
-		if count < minCount {
-			minCount = count
-			leastAccessed = key
+// put stores an entry as the most recently used one, keeping the byte count up to date
+func (c *Cache) put(key, value string) {
+	entry, ok := c.entries[key]
+	if ok {
+		c.bytes -= entrySize(key, entry.value)
+		entry.value, entry.timestamp = value, time.Now()
+		c.touch(entry)
+	} else {
+		entry = &CacheEntry{key: key, value: value, timestamp: time.Now()}
+		if !c.pinned[key] {
+			entry.elem = c.lru.PushFront(entry)
 		}
+		c.entries[key] = entry
+	}
+	c.bytes += entrySize(key, value)
+}
+
+// touch marks an entry as the most recently used one
+func (c *Cache) touch(entry *CacheEntry) {
+	if entry.elem != nil {
+		c.lru.MoveToFront(entry.elem)
+	}
+}
+
+// entrySize returns the approximate memory used by a cache entry
+func entrySize(key, value string) int64 {
+	return int64(len(key) + len(value) + cacheEntryOverhead)
+}
+
+// shrink evicts entries until the cache fits its memory budget. Pinned entries
+// stay even if they alone exceed it.
+func (c *Cache) shrink() {
+	for c.maxBytes > 0 && c.bytes > c.maxBytes {
+		if !c.evict() {
+			return
+		}
+	}
+}
+
+// resize changes the memory budget, evicting entries that no longer fit
+func (c *Cache) resize(maxBytes int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.maxBytes = maxBytes
+	c.shrink()
+}
+
+// byteBudget returns the current memory budget
+func (c *Cache) byteBudget() int64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.maxBytes
+}
+
+// Delete removes a key from the cache, so the next Get misses and the value is
+// read again from wherever it's now stored
+func (c *Cache) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.remove(key)
+}
+
+// remove deletes an entry
+func (c *Cache) remove(key string) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.bytes -= entrySize(key, entry.value)
+	if entry.elem != nil {
+		c.lru.Remove(entry.elem)
 	}
+	delete(c.entries, key)
+}
+
+// stats returns a snapshot of the cache counters
+func (c *Cache) stats(policy CachePolicy) CacheStats {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 
-	delete(c.entries, leastAccessed)
-	delete(c.accessCount, leastAccessed)
+	return CacheStats{
+		Policy:    policy.String(),
+		Entries:   len(c.entries),
+		MaxSize:   c.maxSize,
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Rejected:  c.rejected,
+		Pinned:    len(c.pinned),
+		MaxPinned: c.maxPinned,
+	}
 }
 
+// pin exempts a key from eviction and caches its value
+func (c *Cache) pin(key, value string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.pinned[key] && len(c.pinned) >= c.maxPinned {
+		return fmt.Errorf("failed to pin %q: %w", key, ErrPinLimit)
+	}
+	c.pinned[key] = true
+	c.put(key, value)
+	// Pinned entries are kept off the LRU list, so eviction never reaches them
+	if entry := c.entries[key]; entry.elem != nil {
+		c.lru.Remove(entry.elem)
+		entry.elem = nil
+	}
+	c.shrink()
+	return nil
+}
+
+// unpin makes a key evictable again, as the most recently used entry
+func (c *Cache) unpin(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pinned, key)
+	if entry, ok := c.entries[key]; ok && entry.elem == nil {
+		entry.elem = c.lru.PushFront(entry)
+	}
+}
+
+// isPinned reports whether a key is exempt from eviction
+func (c *Cache) isPinned(key string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pinned[key]
+}
+
+// pinnedKeys returns the pinned keys in order
+func (c *Cache) pinnedKeys() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	keys := make([]string, 0, len(c.pinned))
+	for key := range c.pinned {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// victim returns the least recently used unpinned key, which is the next one to
+// be evicted, reporting false if every entry is pinned
+func (c *Cache) victim() (string, bool) {
+	back := c.lru.Back()
+	if back == nil {
+		return "", false
+	}
+	return back.Value.(*CacheEntry).key, true
+}
+
+// evict removes the victim, reporting false if there is none
+func (c *Cache) evict() bool {
+	victim, ok := c.victim()
+	if ok {
+		c.remove(victim)
+	}
+	return ok
+}
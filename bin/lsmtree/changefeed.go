@@ -0,0 +1,139 @@
+package lsmtree
+
+import "strings"
+
+// Change describes a write applied to the tree
+type Change struct {
+	Key     string
+	Value   string
+	Deleted bool
+}
+
+// Subscribe registers fn to be called with every write applied to the tree, in
+// commit order, and returns a function that unregisters it. fn runs with the writer
+// lock held, so it must be fast and must not call back into the tree.
+func (l *LSMTree) Subscribe(fn func(Change)) (unsubscribe func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.subscribers == nil {
+		l.subscribers = make(map[int]func(Change))
+	}
+	id := l.nextSubscriber
+	l.nextSubscriber++
+	l.subscribers[id] = fn
+
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		delete(l.subscribers, id)
+	}
+}
+
+// publish sends a change to the subscribers. It must be called with the writer mutex held.
+func (l *LSMTree) publish(key, value string) {
+	for _, fn := range l.subscribers {
+		fn(Change{Key: key, Value: value, Deleted: value == ""})
+	}
+}
+
+// EventType is the kind of write an Event reports
+type EventType string
+
+const (
+	// EventSet reports a key set to a new value
+	EventSet EventType = "set"
+	// EventDelete reports a deleted key
+	EventDelete EventType = "delete"
+)
+
+// Event reports a write to a watched key. Seq numbers the writes applied since
+// the tree was opened, so events of different watchers can be ordered; it isn't
+// kept across restarts.
+type Event struct {
+	Seq      uint64    `json:"seq"`
+	Type     EventType `json:"type"`
+	Key      string    `json:"key"`
+	OldValue string    `json:"old_value,omitempty"`
+	NewValue string    `json:"new_value,omitempty"`
+}
+
+// watchBuffer is how many events a watcher may fall behind before it's dropped
+const watchBuffer = 256
+
+// watcher is a channel of the events of keys starting with a prefix
+type watcher struct {
+	prefix string
+	events chan Event
+}
+
+// Watch returns a channel of the writes to keys starting with prefix, "" for all
+// keys, in commit order, and a function that stops watching and closes it. The
+// channel is also closed when the tree is closed, or when the watcher falls more
+// than watchBuffer events behind, as it would otherwise hold up writers; a
+// closed channel means the watcher should read the keys again before watching
+// anew.
+func (l *LSMTree) Watch(prefix string) (<-chan Event, func(), error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil, nil, ErrClosed
+	}
+
+	if l.watchers == nil {
+		l.watchers = make(map[int]*watcher)
+	}
+	id := l.nextSubscriber
+	l.nextSubscriber++
+	w := &watcher{prefix: prefix, events: make(chan Event, watchBuffer)}
+	l.watchers[id] = w
+
+	return w.events, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.dropWatcher(id)
+	}, nil
+}
+
+// watchedValue returns the current value of key if a watcher needs it as the old
+// value of a write. It must be called with the writer mutex held.
+func (l *LSMTree) watchedValue(key string) string {
+	for _, w := range l.watchers {
+		if strings.HasPrefix(key, w.prefix) {
+			value, _ := l.currentValue(key) // a failed read only leaves the old value out
+			return value
+		}
+	}
+	return ""
+}
+
+// notify sends the event of a write to the watchers of its key, dropping those
+// whose buffer is full. It must be called with the writer mutex held.
+func (l *LSMTree) notify(seq uint64, key, old, value string) {
+	if len(l.watchers) == 0 {
+		return
+	}
+	event := Event{Seq: seq, Type: EventSet, Key: key, OldValue: old, NewValue: value}
+	if value == "" {
+		event.Type = EventDelete
+	}
+	for id, w := range l.watchers {
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			l.dropWatcher(id)
+		}
+	}
+}
+
+// dropWatcher closes the channel of a watcher and forgets it. It must be called
+// with the writer mutex held.
+func (l *LSMTree) dropWatcher(id int) {
+	if w, ok := l.watchers[id]; ok {
+		close(w.events)
+		delete(l.watchers, id)
+	}
+}
@@ -0,0 +1,115 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Checkpoint writes a consistent point-in-time copy of the tree to dir, which must
+// not exist or be empty. The MemTable is flushed first, so the copy needs no WAL:
+// it's the live SSTables, hard-linked where possible and copied otherwise, a
+// manifest listing them and the other files of the data directory, such as the
+// pinned keys. Writes are only held up while the MemTable is flushed. The copy is
+// a data directory of its own that can be opened, or restored by copying it back.
+func (l *LSMTree) Checkpoint(dir string) error {
+	if l.options.InMemory {
+		return ErrInMemory
+	}
+	if err := prepareCheckpointDir(l.fs, dir); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return ErrClosed
+	}
+	if l.current.memTable.Len() > 0 || len(l.current.immutable) > 0 {
+		if err := l.flushMemTable(); err != nil {
+			l.mutex.Unlock()
+			return fmt.Errorf("failed to flush memtable: %w", err)
+		}
+	}
+	// Holding the view keeps its SSTable files from being removed by a compaction
+	// while they're linked
+	v := l.acquireView()
+	logSegment := l.logSegment
+	l.mutex.Unlock()
+	defer v.release()
+
+	for _, ssTable := range v.ssTables {
+		name := filepath.Base(ssTable.FilePath())
+		if err := linkOrCopy(l.fs, ssTable.FilePath(), filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to checkpoint SSTable %s: %w", name, err)
+		}
+	}
+	if err := copyAuxiliaryFiles(l.fs, l.dataDir, dir); err != nil {
+		return err
+	}
+	return writeManifest(l.fs, dir, CurrentFormatVersion, v.ssTables, logSegment)
+}
+
+// prepareCheckpointDir creates the checkpoint directory, refusing to write into one
+// that already has files
+func prepareCheckpointDir(fsys FS, dir string) error {
+	entries, err := fsys.List(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read checkpoint directory: %w", err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("checkpoint directory %s is not empty", dir)
+	}
+	if err := fsys.MkdirAll(dir); err != nil {
+		return fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+	return nil
+}
+
+// linkOrCopy hard-links src to dst, copying it instead when the file system can't
+// link them, e.g. across devices. SSTables are never modified, so the link shares
+// nothing that can change.
+func linkOrCopy(fsys FS, src, dst string) error {
+	if linker, ok := fsys.(linker); ok && linker.Link(src, dst) == nil {
+		return nil
+	}
+	return copyFile(fsys, src, dst)
+}
+
+// copyAuxiliaryFiles copies the regular files of the data directory that aren't
+// SSTables, WAL segments, the manifest, the lock or temporary files
+func copyAuxiliaryFiles(fsys FS, dataDir, dir string) error {
+	entries, err := fsys.List(dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || isEngineFile(name) {
+			continue
+		}
+		if err := copyFile(fsys, filepath.Join(dataDir, name), filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to checkpoint %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// isEngineFile reports whether a file in the data directory is managed by the
+// engine's own checkpointing rather than copied as is
+func isEngineFile(name string) bool {
+	switch {
+	case name == manifestFileName, name == lockFileName, name == legacyWALFileName:
+		return true
+	case strings.HasSuffix(name, ".tmp"):
+		return true
+	case strings.HasPrefix(name, "wal-") && strings.HasSuffix(name, ".log"):
+		return true
+	case strings.HasPrefix(name, "sstable_") && strings.HasSuffix(name, ".dat"):
+		return true
+	default:
+		return false
+	}
+}
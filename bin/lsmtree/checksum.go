@@ -0,0 +1,47 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// castagnoli is the CRC32C table used for all block and record checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumSize is the size of an encoded CRC32C checksum
+const checksumSize = 4
+
+// ErrCorruption reports data that failed checksum or structural validation
+type ErrCorruption struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (e *ErrCorruption) Error() string {
+	return fmt.Sprintf("corruption in %s at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+// appendChecksum appends the CRC32C of data to data
+func appendChecksum(data []byte) []byte {
+	return binary.LittleEndian.AppendUint32(data, crc32.Checksum(data, castagnoli))
+}
+
+// verifyChecksum checks and strips the CRC32C trailer written by appendChecksum
+func verifyChecksum(data []byte, file string, offset int64) ([]byte, error) {
+	if len(data) < checksumSize {
+		return nil, &ErrCorruption{File: file, Offset: offset, Reason: "block too short for checksum"}
+	}
+
+	payload := data[:len(data)-checksumSize]
+	expected := binary.LittleEndian.Uint32(data[len(data)-checksumSize:])
+	if actual := crc32.Checksum(payload, castagnoli); actual != expected {
+		return nil, &ErrCorruption{
+			File:   file,
+			Offset: offset,
+			Reason: fmt.Sprintf("checksum mismatch: expected %08x, got %08x", expected, actual),
+		}
+	}
+	return payload, nil
+}
@@ -0,0 +1,102 @@
+package lsmtree
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects the codec used for SSTable data blocks
+type Compression byte
+
+const (
+	// NoCompression stores blocks as is
+	NoCompression Compression = 0
+	// SnappyCompression compresses blocks with Snappy, favouring speed
+	SnappyCompression Compression = 1
+	// ZstdCompression compresses blocks with Zstandard, favouring ratio
+	ZstdCompression Compression = 2
+)
+
+// String returns the codec name
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	case ZstdCompression:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+// ParseCompression parses a codec name as accepted on the command line
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "none", "":
+		return NoCompression, nil
+	case "snappy":
+		return SnappyCompression, nil
+	case "zstd":
+		return ZstdCompression, nil
+	default:
+		return NoCompression, fmt.Errorf("unknown compression %q", name)
+	}
+}
+
+// Shared zstd encoder and decoder; EncodeAll and DecodeAll are safe for concurrent use
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// initZstd creates the shared zstd encoder and decoder
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+}
+
+// compressBlock encodes a block as a one-byte compression header followed by the
+// payload. The block is stored uncompressed unless compression saves at least 1/8.
+func compressBlock(data []byte, compression Compression) []byte {
+	var compressed []byte
+	switch compression {
+	case SnappyCompression:
+		compressed = s2.EncodeSnappy(nil, data)
+	case ZstdCompression:
+		initZstd()
+		compressed = zstdEncoder.EncodeAll(data, nil)
+	}
+
+	if compressed == nil || len(compressed) >= len(data)-len(data)/8 {
+		return append([]byte{byte(NoCompression)}, data...)
+	}
+	return append([]byte{byte(compression)}, compressed...)
+}
+
+// decompressBlock decodes a block written by compressBlock
+func decompressBlock(block []byte) ([]byte, error) {
+	if len(block) == 0 {
+		return nil, fmt.Errorf("empty block")
+	}
+
+	payload := block[1:]
+	switch Compression(block[0]) {
+	case NoCompression:
+		return payload, nil
+	case SnappyCompression:
+		return s2.Decode(nil, payload)
+	case ZstdCompression:
+		initZstd()
+		return zstdDecoder.DecodeAll(payload, nil)
+	default:
+		return nil, fmt.Errorf("unknown block compression %d", block[0])
+	}
+}
@@ -0,0 +1,99 @@
+package lsmtree
+
+import "context"
+
+// ContextStore is a Store whose operations give up when their context is done,
+// like LSMTree, whose writes otherwise wait for a flush or compaction holding the
+// writer lock. Writes that got the lock are applied in full.
+type ContextStore interface {
+	Store
+	GetCtx(ctx context.Context, key string) (string, error)
+	SetCtx(ctx context.Context, key, value string) error
+	DeleteCtx(ctx context.Context, key string) error
+	ScanCtx(ctx context.Context, start, end string) (Iterator, error)
+	BatchCtx(ctx context.Context, batch *WriteBatch) error
+}
+
+var (
+	_ ContextStore = (*LSMTree)(nil)
+	_ ContextStore = (*ShardedStore)(nil)
+)
+
+// WithContext returns store as a ContextStore. The operations of a store without
+// context support only check the context before they start.
+func WithContext(store Store) ContextStore {
+	if s, ok := store.(ContextStore); ok {
+		return s
+	}
+	return contextStore{store}
+}
+
+// contextStore checks the context before each operation of a store that doesn't take one
+type contextStore struct {
+	Store
+}
+
+func (s contextStore) GetCtx(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return s.Get(key)
+}
+
+func (s contextStore) SetCtx(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Set(key, value)
+}
+
+func (s contextStore) DeleteCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Delete(key)
+}
+
+func (s contextStore) ScanCtx(ctx context.Context, start, end string) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Scan(start, end)
+}
+
+func (s contextStore) BatchCtx(ctx context.Context, batch *WriteBatch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Batch(batch)
+}
+
+// lockContext takes the writer lock, or returns the context's error if it's done
+// first. A lock taken after giving up is released right away.
+func (l *LSMTree) lockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		l.mutex.Lock()
+		return nil
+	}
+	if l.mutex.TryLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		l.mutex.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			l.mutex.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
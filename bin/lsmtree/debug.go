@@ -0,0 +1,121 @@
+package lsmtree
+
+import (
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// DebugState is a structural snapshot of the LSMTree used for bug reports.
+// It never contains values, only keys, counts and filter parameters.
+type DebugState struct {
+	CapturedAt time.Time        `json:"captured_at"`
+	DataDir    string           `json:"data_dir"`
+	Manifest   []string         `json:"manifest"`
+	MemTable   MemTableSummary  `json:"memtable"`
+	SSTables   []SSTableSummary `json:"sstables"`
+	Cache      CacheSummary     `json:"cache"`
+}
+
+// MemTableSummary describes the current MemTable
+type MemTableSummary struct {
+	Entries    int `json:"entries"`
+	Tombstones int `json:"tombstones"`
+}
+
+// SSTableSummary describes the index and bloom filter of a single SSTable.
+// Tables opened from disk report only their path until first read.
+type SSTableSummary struct {
+	FilePath     string `json:"file_path"`
+	Loaded       bool   `json:"loaded"` // whether the filter and index have been read from disk
+	Entries      int    `json:"entries"`
+	IndexEntries int    `json:"index_entries"`
+	SmallestKey  string `json:"smallest_key"`
+	LargestKey   string `json:"largest_key"`
+	BloomBits    uint   `json:"bloom_bits"`
+	BloomHashes  uint   `json:"bloom_hashes"`
+	BloomBitsSet uint   `json:"bloom_bits_set"`
+}
+
+// CacheSummary describes the cache without exposing cached values
+type CacheSummary struct {
+	MaxSize int      `json:"max_size"`
+	Keys    []string `json:"keys"`
+}
+
+// DebugState captures the current structural state of the LSMTree
+func (l *LSMTree) DebugState() DebugState {
+	v := l.acquireView()
+	defer v.release()
+
+	state := DebugState{
+		CapturedAt: time.Now(),
+		DataDir:    l.dataDir,
+		Manifest:   make([]string, 0, len(v.ssTables)),
+		SSTables:   make([]SSTableSummary, 0, len(v.ssTables)),
+	}
+
+	for _, memTable := range append([]*MemTable{v.memTable}, v.immutable...) {
+		for _, value := range memTable.Entries() {
+			state.MemTable.Entries++
+			if value == "" {
+				state.MemTable.Tombstones++
+			}
+		}
+	}
+
+	for _, ssTable := range v.ssTables {
+		state.Manifest = append(state.Manifest, ssTable.FilePath())
+		state.SSTables = append(state.SSTables, ssTable.summary())
+	}
+
+	state.Cache = l.cache.summary()
+
+	return state
+}
+
+// summary returns the index and bloom filter summary of the SSTable
+func (s *SSTable) summary() SSTableSummary {
+	summary := SSTableSummary{
+		FilePath: s.filePath,
+		Loaded:   s.isLoaded(),
+	}
+	if !summary.Loaded {
+		return summary
+	}
+
+	summary.Entries = s.properties.Entries
+	summary.IndexEntries = len(s.index)
+	summary.SmallestKey = s.properties.SmallestKey
+	summary.LargestKey = s.properties.LargestKey
+	summary.BloomBits = s.bloomFilter.Bits()
+	summary.BloomHashes = s.bloomFilter.probes()
+	summary.BloomBitsSet = s.bloomFilter.bitsSet()
+	return summary
+}
+
+// summary returns the cache capacity and the keys it currently holds
+func (c *Cache) summary() CacheSummary {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return CacheSummary{
+		MaxSize: c.maxSize,
+		Keys:    keys,
+	}
+}
+
+// bitsSet returns the number of bits set in the BloomFilter
+func (bf *BloomFilter) bitsSet() uint {
+	var count uint
+	for _, word := range bf.bits {
+		count += uint(bits.OnesCount64(word))
+	}
+	return count
+}
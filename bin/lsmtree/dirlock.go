@@ -0,0 +1,305 @@
+package lsmtree
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// lockFileName is the file in the data directory held by the process using it
+const lockFileName = "LOCK"
+
+// lockHeartbeatInterval is how often the lock owner refreshes its heartbeat
+const lockHeartbeatInterval = 10 * time.Second
+
+// lockStaleAfter is how long a heartbeat may go without refresh before the lock is
+// considered abandoned by an owner whose process can't be checked
+const lockStaleAfter = 6 * lockHeartbeatInterval
+
+// LockInfo records the owner of a data directory lock
+type LockInfo struct {
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	Acquired  time.Time `json:"acquired"`
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+// String describes the lock owner
+func (i LockInfo) String() string {
+	return fmt.Sprintf("pid %d on %s (acquired %s, last heartbeat %s)",
+		i.PID, i.Hostname, i.Acquired.Format(time.RFC3339), i.Heartbeat.Format(time.RFC3339))
+}
+
+// ErrLocked is returned when the data directory is held by a live process
+type ErrLocked struct {
+	Owner LockInfo
+}
+
+func (e *ErrLocked) Error() string {
+	return fmt.Sprintf("data directory is in use by %s", e.Owner)
+}
+
+// DirLock is an exclusive lock on a data directory, kept alive by a heartbeat
+type DirLock struct {
+	path string
+	file *os.File // the lock file, held open with an advisory lock where supported
+	info LockInfo
+	stop chan struct{}
+	done sync.WaitGroup
+
+	logger Logger // receives the errors of the heartbeat
+}
+
+// LockDir acquires the lock on a data directory. A lock left behind by a dead
+// process is taken over; a lock held by a live process returns ErrLocked.
+//
+// Where the platform supports it, the lock file also carries an advisory file
+// lock (flock) held for as long as the lock, which the kernel drops when the
+// owner exits. An owner on the same host is then known to be gone exactly when
+// the file lock is free, even if its PID has been reused.
+func LockDir(dataDir string) (*DirLock, error) {
+	return lockDir(dataDir, slog.Default())
+}
+
+// lockDir locks dataDir as LockDir does, logging failed heartbeats to logger
+func lockDir(dataDir string, logger Logger) (*DirLock, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+	now := time.Now()
+	lock := &DirLock{
+		path:   filepath.Join(dataDir, lockFileName),
+		info:   LockInfo{PID: os.Getpid(), Hostname: hostname, Acquired: now, Heartbeat: now},
+		stop:   make(chan struct{}),
+		logger: logger,
+	}
+
+	acquire := lock.acquireExclusive
+	if fileLocking {
+		acquire = lock.acquireFileLock
+	}
+	if err := acquire(dataDir); err != nil {
+		return nil, err
+	}
+	lock.done.Add(1)
+	go lock.heartbeat()
+	return lock, nil
+}
+
+// noLock returns a DirLock holding nothing, for a data directory on a file system
+// other than OSFS, which the lock file can't guard
+func noLock() *DirLock {
+	return &DirLock{stop: make(chan struct{})}
+}
+
+// acquireFileLock takes the advisory lock on the lock file, creating the file if
+// needed, and records this process as its owner
+func (l *DirLock) acquireFileLock(dataDir string) error {
+	// Retry if the file is replaced between opening and locking it, e.g. removed by
+	// the previous owner's Release
+	for attempt := 0; attempt < 3; attempt++ {
+		file, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open lock file: %w", err)
+		}
+		held, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if !held {
+			file.Close()
+			owner, err := ReadLock(dataDir)
+			if err != nil {
+				return err
+			}
+			return &ErrLocked{Owner: owner}
+		}
+		if current, err := os.Stat(l.path); err != nil || !sameFile(file, current) {
+			file.Close()
+			continue
+		}
+
+		// The file lock doesn't reach other hosts sharing the directory, so their
+		// locks still expire by heartbeat
+		if owner, err := readLockFile(l.path); err == nil && owner.PID != 0 && owner.Hostname != l.info.Hostname && !owner.Stale() {
+			file.Close()
+			return &ErrLocked{Owner: owner}
+		}
+		l.file = file
+		if err := l.write(); err != nil {
+			l.file = nil
+			file.Close()
+			return fmt.Errorf("failed to write lock file: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to acquire lock on %s: the lock file keeps changing", dataDir)
+}
+
+// sameFile reports whether the open file is the one described by info
+func sameFile(file *os.File, info os.FileInfo) bool {
+	opened, err := file.Stat()
+	return err == nil && os.SameFile(opened, info)
+}
+
+// acquireExclusive creates the lock file exclusively, taking over a stale one, on
+// platforms without file locking
+func (l *DirLock) acquireExclusive(dataDir string) error {
+	// Try once more after removing a stale lock
+	for attempt := 0; attempt < 2; attempt++ {
+		err := l.create()
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+
+		owner, err := ReadLock(dataDir)
+		if err != nil {
+			return err
+		}
+		if !owner.Stale() {
+			return &ErrLocked{Owner: owner}
+		}
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale lock: %w", err)
+		}
+	}
+	return fmt.Errorf("failed to acquire lock on %s: another process took it over", dataDir)
+}
+
+// create writes the lock file, failing with os.ErrExist if it's already held
+func (l *DirLock) create() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return err
+		}
+		return fmt.Errorf("failed to create lock file: %w", err)
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(l.info); err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+	return nil
+}
+
+// heartbeat refreshes the lock file until the lock is released
+func (l *DirLock) heartbeat() {
+	defer l.done.Done()
+
+	ticker := time.NewTicker(lockHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			l.info.Heartbeat = now
+			if err := l.write(); err != nil {
+				l.logger.Error("failed to refresh data directory lock", "err", err)
+			}
+		}
+	}
+}
+
+// write replaces the lock file contents. A file-locked lock file is rewritten in
+// place, since renaming a new file over it would leave the file lock behind on
+// the old one; otherwise the contents are replaced atomically.
+func (l *DirLock) write() error {
+	data, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		if _, err := l.file.WriteAt(data, 0); err != nil {
+			return err
+		}
+		return l.file.Truncate(int64(len(data)))
+	}
+	tmpPath := l.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, l.path)
+}
+
+// Release stops the heartbeat, removes the lock file and drops the file lock
+func (l *DirLock) Release() error {
+	close(l.stop)
+	l.done.Wait()
+
+	// Only remove the lock if it's still ours, e.g. not forcibly taken over. The
+	// file is removed before the file lock is dropped, so a process waiting on it
+	// finds the file gone and starts over with a new one.
+	var err error
+	if owner, readErr := readLockFile(l.path); readErr == nil && owner.PID == l.info.PID && owner.Hostname == l.info.Hostname {
+		if removeErr := os.Remove(l.path); removeErr != nil {
+			err = fmt.Errorf("failed to remove lock file: %w", removeErr)
+		}
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	return err
+}
+
+// ReadLock returns the owner of the data directory lock, or an error wrapping
+// os.ErrNotExist if the directory isn't locked
+func ReadLock(dataDir string) (LockInfo, error) {
+	return readLockFile(filepath.Join(dataDir, lockFileName))
+}
+
+// readLockFile parses a lock file
+func readLockFile(path string) (LockInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return LockInfo{}, fmt.Errorf("failed to read lock file: %w", err)
+	}
+	var info LockInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		// A lock that was being written when its owner crashed has no owner to protect
+		return LockInfo{}, nil
+	}
+	return info, nil
+}
+
+// Stale reports whether the lock owner is known to be gone. On the same host the
+// owner's process is checked directly; a lock from another host is stale once its
+// heartbeat stops.
+func (i LockInfo) Stale() bool {
+	if i.PID == 0 {
+		return true
+	}
+	hostname, err := os.Hostname()
+	if err == nil && hostname == i.Hostname {
+		return !processAlive(i.PID)
+	}
+	return time.Since(i.Heartbeat) > lockStaleAfter
+}
+
+// UnlockDir removes the data directory lock. Unless force is set, only a stale
+// lock is removed. Forcing removal of a live owner's lock lets two processes write
+// the same directory and can corrupt it.
+func UnlockDir(dataDir string, force bool) (LockInfo, error) {
+	owner, err := ReadLock(dataDir)
+	if err != nil {
+		return LockInfo{}, err
+	}
+	if !force && !owner.Stale() {
+		return owner, &ErrLocked{Owner: owner}
+	}
+	if err := os.Remove(filepath.Join(dataDir, lockFileName)); err != nil {
+		return owner, fmt.Errorf("failed to remove lock file: %w", err)
+	}
+	return owner, nil
+}
@@ -0,0 +1,370 @@
+package lsmtree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DoctorReport is what Diagnose found in a data directory
+type DoctorReport struct {
+	FormatVersion int `json:"format_version"`
+	// Problems are faults of the directory's layout that checksums can't catch,
+	// like a manifest listing an SSTable that doesn't exist
+	Problems      []string         `json:"problems"`
+	Corruptions   []*ErrCorruption `json:"corruptions"`
+	TablesChecked int              `json:"tables_checked"`
+	WALSegments   int              `json:"wal_segments"`
+	WALRecords    int              `json:"wal_records"`
+	// OrphanedTables are SSTables missing from the manifest, left behind by a crash
+	// during a flush or compaction
+	OrphanedTables []string `json:"orphaned_tables"`
+	// StaleSegments are WAL segments already in SSTables, which recovery removes
+	StaleSegments []string `json:"stale_segments"`
+	// TempFiles are left behind by a crash while a file was being replaced
+	TempFiles []string     `json:"temp_files"`
+	Garbage   GarbageStats `json:"garbage"`
+}
+
+// GarbageStats counts the SSTable entries a full compaction would drop
+type GarbageStats struct {
+	Entries    int   `json:"entries"`    // every entry of the SSTables
+	Tombstones int   `json:"tombstones"` // the newest entries of deleted keys
+	Shadowed   int   `json:"shadowed"`   // entries overwritten by a newer SSTable
+	Bytes      int64 `json:"bytes"`      // of the keys and values of tombstones and shadowed entries
+}
+
+// Healthy reports whether the data directory has no problems or corruptions.
+// Orphaned, stale and temporary files only waste space.
+func (r DoctorReport) Healthy() bool {
+	return len(r.Problems) == 0 && len(r.Corruptions) == 0
+}
+
+// Diagnose checks a data directory more thoroughly than VerifyDir: the manifest
+// is validated against the files present, every SSTable and WAL segment is
+// read and its checksums verified, files nothing refers to are listed, and the
+// garbage left by overwrites and deletes is counted. The tree must not be open.
+// An encrypted directory needs its data key.
+func Diagnose(dataDir string, key []byte) (DoctorReport, error) {
+	var report DoctorReport
+
+	version, err := DetectFormatVersion(dataDir)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+	}
+	report.FormatVersion = version
+	if err == nil && version != CurrentFormatVersion {
+		report.Problems = append(report.Problems, (&ErrFormatVersion{Version: version}).Error())
+		return report, nil
+	}
+	m, _, _ := loadManifest(OSFS{}, dataDir)
+	listed, unlisted := map[string]bool{}, []string{}
+	tables, err := dataFiles(dataDir, "sstable_*.dat")
+	if err != nil {
+		return report, err
+	}
+	if version == CurrentFormatVersion {
+		for _, name := range m.Tables {
+			switch {
+			case listed[name]:
+				report.Problems = append(report.Problems, fmt.Sprintf("the manifest lists %s twice", name))
+			case filepath.Base(name) != name:
+				report.Problems = append(report.Problems, fmt.Sprintf("the manifest lists %s outside the data directory", name))
+			}
+			listed[name] = true
+		}
+		for _, name := range tables {
+			if !listed[name] {
+				unlisted = append(unlisted, name)
+			}
+		}
+		report.OrphanedTables = unlisted
+	} else {
+		// Without a readable manifest every SSTable is checked, in the order of their names
+		m.Tables = tables
+	}
+
+	enc, err := loadEncryptor(OSFS{}, dataDir, key)
+	if err != nil {
+		return report, err
+	}
+
+	// Tables are read newest first, so an entry is garbage if its key was seen in a newer one
+	seen := make(map[string]bool)
+	for i := len(m.Tables) - 1; i >= 0; i-- {
+		name := m.Tables[i]
+		path := filepath.Join(dataDir, name)
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			report.Problems = append(report.Problems, fmt.Sprintf("the manifest lists %s, which doesn't exist", name))
+			continue
+		}
+		report.TablesChecked++
+		ssTable, err := openSSTable(OSFS{}, path, CurrentFormatVersion, enc)
+		if err == nil {
+			err = ssTable.verify()
+		}
+		if err := report.record(err); err != nil {
+			return report, fmt.Errorf("failed to check SSTable %s: %w", name, err)
+		}
+		if err != nil {
+			continue
+		}
+		entries, err := ssTable.scan(false)
+		if err != nil {
+			return report, fmt.Errorf("failed to read SSTable %s: %w", name, err)
+		}
+		for key, value := range entries {
+			report.Garbage.Entries++
+			switch {
+			case seen[key]:
+				report.Garbage.Shadowed++
+			case value == "":
+				report.Garbage.Tombstones++
+			default:
+				seen[key] = true
+				continue
+			}
+			seen[key] = true
+			report.Garbage.Bytes += int64(len(key) + len(value))
+		}
+	}
+
+	segments, err := listWALSegments(OSFS{}, dataDir)
+	if err != nil {
+		return report, fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+	for i, segment := range segments {
+		path := walSegmentPath(dataDir, segment)
+		if segment < m.LogSegment {
+			report.StaleSegments = append(report.StaleSegments, filepath.Base(path))
+			continue
+		}
+		report.WALSegments++
+		// A torn tail of the last segment is a write cut short by a crash, which recovery drops
+		_, err := replayWALSegment(OSFS{}, path, i == len(segments)-1, time.Time{}, enc, func(key, value string) {
+			report.WALRecords++
+		})
+		if err := report.record(err); err != nil {
+			return report, fmt.Errorf("failed to check WAL segment %s: %w", filepath.Base(path), err)
+		}
+	}
+
+	if report.TempFiles, err = dataFiles(dataDir, "*.tmp"); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// record adds a corruption to the report, returning any other error as is
+func (r *DoctorReport) record(err error) error {
+	var corruption *ErrCorruption
+	if errors.As(err, &corruption) {
+		r.Corruptions = append(r.Corruptions, corruption)
+		return nil
+	}
+	return err
+}
+
+// dataFiles returns the names of the regular files of the data directory
+// matching pattern, in order
+func dataFiles(dataDir, pattern string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dataDir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// SalvageReport is what Salvage recovered from a data directory
+type SalvageReport struct {
+	TablesRead int `json:"tables_read"` // SSTables read at least in part
+	// LostTables are SSTables whose footer, index or filter can't be read, so
+	// none of their blocks can be found
+	LostTables []string `json:"lost_tables"`
+	LostBlocks int      `json:"lost_blocks"` // data blocks that failed their checksum, at least in part
+	WALRecords int      `json:"wal_records"` // operations replayed from the WAL
+	// CutSegments are WAL segments replayed only up to a corrupt record
+	CutSegments []string `json:"cut_segments"`
+	Keys        int      `json:"keys"` // live keys and records written to the new store
+}
+
+// Salvage writes every entry of dataDir that can still be read into a new store
+// in dir, which must not exist or be empty. The SSTables of the manifest are
+// read oldest first, skipping the blocks that fail their checksums, then the WAL
+// segments up to any corrupt record. Without a readable manifest every SSTable
+// is read in the order of its name, which may let an older value win. Deleted
+// keys are dropped, and the files that aren't the engine's, like the encryption
+// contexts, are copied as is. options configure the new store, and their
+// EncryptionKey also unlocks dataDir. The tree of dataDir must not be open.
+func Salvage(dataDir, dir string, options Options) (SalvageReport, error) {
+	var report SalvageReport
+
+	m, _, err := loadManifest(OSFS{}, dataDir)
+	if err != nil {
+		// The SSTables of a manifest that can't be parsed are read in the order of their names
+		if m.Tables, err = dataFiles(dataDir, "sstable_*.dat"); err != nil {
+			return report, err
+		}
+		m.LogSegment = 0
+	} else if version, err := DetectFormatVersion(dataDir); err != nil {
+		return report, err
+	} else if version != CurrentFormatVersion {
+		return report, &ErrFormatVersion{Version: version}
+	}
+	if options.EncryptionKey, err = keyIfEncrypted(dataDir, options.EncryptionKey); err != nil {
+		return report, err
+	}
+	enc, err := loadEncryptor(OSFS{}, dataDir, options.EncryptionKey)
+	if err != nil {
+		return report, err
+	}
+
+	entries := make(map[string]string)
+	for _, name := range m.Tables {
+		ssTable, err := openSSTable(OSFS{}, filepath.Join(dataDir, name), CurrentFormatVersion, enc)
+		if err == nil {
+			var lost int
+			lost, err = ssTable.salvage(func(key, value string) { entries[key] = value })
+			report.LostBlocks += lost
+		}
+		if err != nil {
+			report.LostTables = append(report.LostTables, name)
+			continue
+		}
+		report.TablesRead++
+	}
+
+	segments, err := listWALSegments(OSFS{}, dataDir)
+	if err != nil {
+		return report, fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+	for i, segment := range segments {
+		if segment < m.LogSegment {
+			continue
+		}
+		// Replay passes on the records before a corrupt one, which are kept
+		path := walSegmentPath(dataDir, segment)
+		_, err := replayWALSegment(OSFS{}, path, i == len(segments)-1, time.Time{}, enc, func(key, value string) {
+			entries[key] = value
+			report.WALRecords++
+		})
+		var corruption *ErrCorruption
+		if errors.As(err, &corruption) {
+			report.CutSegments = append(report.CutSegments, filepath.Base(path))
+		} else if err != nil {
+			return report, fmt.Errorf("failed to read WAL segment %s: %w", filepath.Base(path), err)
+		}
+	}
+
+	if err := prepareCheckpointDir(OSFS{}, dir); err != nil {
+		return report, err
+	}
+	if err := copyAuxiliaryFiles(OSFS{}, dataDir, dir); err != nil {
+		return report, err
+	}
+	options.FS = OSFS{}
+	tree := NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		return report, fmt.Errorf("failed to open the new store: %w", err)
+	}
+	defer tree.Close()
+
+	keys := make([]string, 0, len(entries))
+	for key, value := range entries {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for start := 0; start < len(keys); start += defaultImportBatchSize {
+		ops := make([]BatchOp, 0, defaultImportBatchSize)
+		for _, key := range keys[start:min(start+defaultImportBatchSize, len(keys))] {
+			ops = append(ops, BatchOp{Key: key, Value: entries[key]})
+		}
+		// As replayed writes, records and versions are copied as they are
+		if err := tree.writeBatch(context.Background(), ops, true); err != nil {
+			return report, fmt.Errorf("failed to write the new store: %w", err)
+		}
+		report.Keys += len(ops)
+	}
+	if len(keys) > 0 {
+		tree.mutex.Lock()
+		err = tree.flushMemTable()
+		tree.mutex.Unlock()
+		if err != nil {
+			return report, fmt.Errorf("failed to flush the new store: %w", err)
+		}
+	}
+	return report, tree.Close()
+}
+
+// RepairResult describes a completed Repair
+type RepairResult struct {
+	SalvageReport
+	PreviousDir string `json:"previous_dir"` // copy of the data directory taken before the repair
+}
+
+// Repair replaces the store of a data directory by one salvaged from it with
+// Salvage. The damaged files are first copied to the backups subdirectory, so
+// the repair can be undone with Rollback. The tree must not be open.
+func Repair(dataDir string, options Options) (RepairResult, error) {
+	var result RepairResult
+
+	salvageDir := filepath.Join(dataDir, backupsDirName, fmt.Sprintf("salvage-%d", time.Now().UnixNano()))
+	defer os.RemoveAll(salvageDir)
+	report, err := Salvage(dataDir, salvageDir, options)
+	result.SalvageReport = report
+	if err != nil {
+		return result, fmt.Errorf("failed to salvage the store: %w", err)
+	}
+	if result.PreviousDir, err = savePreviousData(dataDir, "repair"); err != nil {
+		return result, err
+	}
+	if err := replaceDataFiles(dataDir, salvageDir); err != nil {
+		return result, fmt.Errorf("failed to install the salvaged store: %w", err)
+	}
+	return result, nil
+}
+
+// salvage calls fn for every entry of the data blocks that can still be read,
+// returning how many blocks failed their checksum or decoding. It fails only if
+// the filter or index can't be read.
+func (s *SSTable) salvage(fn func(key, value string)) (int, error) {
+	if err := s.load(); err != nil {
+		return 0, err
+	}
+	file, release, err := s.openFile()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	lost := 0
+	for _, handle := range s.index {
+		data, err := s.readDataBlock(file, handle)
+		if err != nil {
+			lost++
+			continue
+		}
+		// The entries before an undecodable one are still good
+		it := s.blockIterator(data)
+		for it.Next() {
+			fn(it.Key(), it.Value())
+		}
+		if it.Err() != nil {
+			lost++
+		}
+	}
+	return lost, nil
+}
@@ -0,0 +1,554 @@
+package lsmtree
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// An encrypted data directory has a random data key that encrypts the payload of
+// every WAL record and every SSTable block with AES-256-GCM. The data key is stored
+// in the encryption file sealed with a key derived from the master password with
+// Argon2id, so changing the password only rewrites that file. Checksums cover the
+// ciphertext, so verification and torn-write detection work as before; SSTable
+// footers, which only locate blocks, stay in the clear.
+//
+// Rekey replaces the data key itself. Until every file is rewritten, the replaced
+// key is kept in the encryption file sealed with the new one, so a rekey cut short
+// by a crash leaves the data readable with the new password.
+
+// encryptionFileName is the file in the data directory holding the sealed data key
+const encryptionFileName = "encryption.json"
+
+// EncryptionKeySize is the size of the data key of an encrypted data directory
+const EncryptionKeySize = 32
+
+// Argon2id parameters for new master passwords, the second recommended option of RFC 9106
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+)
+
+// keyCheckInfo separates the key check from any other use of the data key
+const keyCheckInfo = "lockr data key check"
+
+var (
+	// ErrEncrypted is returned when opening an encrypted data directory without its key
+	ErrEncrypted = errors.New("data directory is encrypted: the master password is required")
+	// ErrWrongPassword is returned when unlocking a data directory with the wrong master password
+	ErrWrongPassword = errors.New("wrong master password")
+)
+
+// encryptionFile is the persisted sealed data key and how to derive the key sealing it
+type encryptionFile struct {
+	KDF       string `json:"kdf"`
+	Salt      string `json:"salt"` // base64
+	Time      uint32 `json:"time"`
+	Memory    uint32 `json:"memory"` // KiB
+	Threads   uint8  `json:"threads"`
+	SealedKey string `json:"sealed_key"` // base64 nonce and data key sealed with the password key
+	KeyCheck  string `json:"key_check"`  // base64 digest identifying the data key
+	// RetiredKeys are data keys replaced by a rekey that hasn't finished, base64
+	// and sealed with the data key
+	RetiredKeys string `json:"retired_keys,omitempty"`
+}
+
+// IsEncrypted reports whether a data directory is encrypted
+func IsEncrypted(dataDir string) (bool, error) {
+	return isEncrypted(OSFS{}, dataDir)
+}
+
+// isEncrypted reports whether a data directory of fsys is encrypted
+func isEncrypted(fsys FS, dataDir string) (bool, error) {
+	_, err := fsys.Stat(filepath.Join(dataDir, encryptionFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat encryption file: %w", err)
+	}
+	return true, nil
+}
+
+// UnlockEncryption returns the data key of an encrypted data directory, to be
+// passed as Options.EncryptionKey
+func UnlockEncryption(dataDir, password string) ([]byte, error) {
+	f, err := loadEncryptionFile(OSFS{}, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return f.unseal(password)
+}
+
+// CheckEncryptionKey reports an error unless key is the data key of the encrypted
+// data directory, for keys remembered elsewhere that may have been replaced by Rekey
+func CheckEncryptionKey(dataDir string, key []byte) error {
+	if key == nil {
+		return ErrEncrypted
+	}
+	_, err := loadEncryptor(OSFS{}, dataDir, key)
+	return err
+}
+
+// EnableEncryption encrypts a data directory with a master password. Every SSTable
+// is rewritten encrypted, and the writes in the WAL go to an encrypted SSTable of
+// their own, so no plaintext engine file is left behind. Snapshots, backups and WAL
+// archives taken before keep their plaintext copies. The tree must not be open.
+func EnableEncryption(dataDir, password string) error {
+	if encrypted, err := IsEncrypted(dataDir); err != nil {
+		return err
+	} else if encrypted {
+		return fmt.Errorf("data directory is already encrypted")
+	}
+	m, err := readManifest(OSFS{}, dataDir)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, EncryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+	f, err := sealEncryptionFile(key, password)
+	if err != nil {
+		return err
+	}
+	enc, err := newEncryptor(key)
+	if err != nil {
+		return err
+	}
+
+	// Write the encrypted copies first, so a failure leaves the directory as it was
+	var oldPaths []string
+	var ssTables []*SSTable
+	abort := func(err error) error {
+		for _, ssTable := range ssTables {
+			os.Remove(ssTable.FilePath())
+		}
+		os.Remove(filepath.Join(dataDir, encryptionFileName))
+		return err
+	}
+	for _, name := range m.Tables {
+		path := filepath.Join(dataDir, name)
+		old, err := openSSTable(OSFS{}, path, CurrentFormatVersion, nil)
+		if err != nil {
+			return abort(err)
+		}
+		entries, err := old.scan(false)
+		if err != nil {
+			return abort(err)
+		}
+		ssTable, err := newSSTable(dataDir, memTableOf(entries), DefaultOptions(), enc)
+		if err != nil {
+			return abort(err)
+		}
+		oldPaths = append(oldPaths, path)
+		ssTables = append(ssTables, ssTable)
+	}
+
+	// Deletes stay in the WAL's SSTable as tombstones shadowing the older ones
+	wal := newWAL(dataDir, DefaultOptions())
+	entries, err := wal.recover(m.LogSegment)
+	if err != nil {
+		return abort(err)
+	}
+	if len(entries) > 0 {
+		ssTable, err := newSSTable(dataDir, memTableOf(entries), DefaultOptions(), enc)
+		if err != nil {
+			return abort(err)
+		}
+		ssTables = append(ssTables, ssTable)
+	}
+
+	if err := f.save(OSFS{}, dataDir); err != nil {
+		return abort(err)
+	}
+	if err := writeManifest(OSFS{}, dataDir, CurrentFormatVersion, ssTables, wal.segment); err != nil {
+		return abort(err)
+	}
+	for _, path := range oldPaths {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove plaintext SSTable: %w", err)
+		}
+	}
+	return wal.removeBefore(wal.segment)
+}
+
+// ChangeEncryptionPassword seals the data key of an encrypted data directory with
+// a new master password. The data itself isn't rewritten.
+func ChangeEncryptionPassword(dataDir, oldPassword, newPassword string) error {
+	key, err := UnlockEncryption(dataDir, oldPassword)
+	if err != nil {
+		return err
+	}
+	old, err := loadEncryptionFile(OSFS{}, dataDir)
+	if err != nil {
+		return err
+	}
+	f, err := sealEncryptionFile(key, newPassword)
+	if err != nil {
+		return err
+	}
+	f.RetiredKeys = old.RetiredKeys
+	return f.save(OSFS{}, dataDir)
+}
+
+// Rekey replaces the data key of an open encrypted tree with a new random one and
+// seals it with newPassword, which may be the same as oldPassword. The MemTable is
+// flushed and every SSTable rewritten with the new key, so no file needs the old
+// one any more. Reads go on as usual meanwhile; writes wait until it's done.
+// Backups, snapshots and WAL archives taken before keep the old key and password.
+func (l *LSMTree) Rekey(oldPassword, newPassword string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if l.options.InMemory {
+		return ErrInMemory
+	}
+	if l.enc == nil {
+		return fmt.Errorf("data directory isn't encrypted")
+	}
+	current, err := loadEncryptionFile(l.fs, l.dataDir)
+	if err != nil {
+		return err
+	}
+	oldKey, err := current.unseal(oldPassword)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, EncryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+	f, err := sealEncryptionFile(key, newPassword)
+	if err != nil {
+		return err
+	}
+	if err := f.retire(key, [][]byte{oldKey}); err != nil {
+		return err
+	}
+	enc, err := newEncryptor(key, oldKey)
+	if err != nil {
+		return err
+	}
+	// From here on the new password opens files under either key
+	if err := f.save(l.fs, l.dataDir); err != nil {
+		return err
+	}
+	l.options.EncryptionKey = key
+	l.enc, l.wal.enc = enc, enc
+
+	if l.current.memTable.Len() > 0 || len(l.current.immutable) > 0 {
+		if err := l.flushMemTable(); err != nil {
+			return fmt.Errorf("failed to flush memtable: %w", err)
+		}
+	}
+	v := l.current
+	ssTables := make([]*SSTable, 0, len(v.ssTables))
+	for _, old := range v.ssTables {
+		entries, err := old.scan(false)
+		if err != nil {
+			return fmt.Errorf("failed to read SSTable: %w", err)
+		}
+		ssTable, err := newSSTable(l.dataDir, memTableOf(entries), l.options, enc)
+		if err != nil {
+			return fmt.Errorf("failed to rewrite SSTable: %w", err)
+		}
+		l.attach(ssTable)
+		ssTables = append(ssTables, ssTable)
+	}
+	if err := writeManifest(l.fs, l.dataDir, CurrentFormatVersion, ssTables, l.logSegment); err != nil {
+		for _, ssTable := range ssTables {
+			l.fs.Remove(ssTable.FilePath())
+		}
+		return err
+	}
+	l.replaceSSTables(v, ssTables, nil)
+
+	// Nothing is left under the old key, so it's dropped
+	f.RetiredKeys = ""
+	if err := f.save(l.fs, l.dataDir); err != nil {
+		return err
+	}
+	if l.enc, err = newEncryptor(key); err != nil {
+		return err
+	}
+	l.wal.enc = l.enc
+	return nil
+}
+
+// memTableOf returns a MemTable holding entries, tombstones included
+func memTableOf(entries map[string]string) *MemTable {
+	memTable := NewMemTable()
+	for key, value := range entries {
+		memTable.Set(key, value)
+	}
+	return memTable
+}
+
+// loadEncryptor returns the encryptor of a data directory for the key given in
+// the options: nil for a plaintext directory, ErrEncrypted if an encrypted one
+// is opened without its key
+func loadEncryptor(fsys FS, dataDir string, key []byte) (*encryptor, error) {
+	encrypted, err := isEncrypted(fsys, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !encrypted && key == nil:
+		return nil, nil
+	case !encrypted:
+		return nil, fmt.Errorf("data directory isn't encrypted, but an encryption key was given")
+	case key == nil:
+		return nil, ErrEncrypted
+	}
+
+	f, err := loadEncryptionFile(fsys, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(keyCheck(key)), []byte(f.KeyCheck)) != 1 {
+		return nil, fmt.Errorf("encryption key doesn't match the data directory")
+	}
+	retired, err := f.retiredKeys(key)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptor(key, retired...)
+}
+
+// keyIfEncrypted returns key for an encrypted data directory and nil for a
+// plaintext one, for operations on directories that may be of either kind
+func keyIfEncrypted(dataDir string, key []byte) ([]byte, error) {
+	encrypted, err := IsEncrypted(dataDir)
+	if err != nil || !encrypted {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadEncryptionFile reads the encryption file of a data directory
+func loadEncryptionFile(fsys FS, dataDir string) (encryptionFile, error) {
+	var f encryptionFile
+	data, err := readFile(fsys, filepath.Join(dataDir, encryptionFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return f, fmt.Errorf("data directory isn't encrypted")
+	}
+	if err != nil {
+		return f, fmt.Errorf("failed to read encryption file: %w", err)
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, fmt.Errorf("failed to parse encryption file: %w", err)
+	}
+	if f.KDF != "argon2id" {
+		return f, fmt.Errorf("unsupported key derivation %q", f.KDF)
+	}
+	return f, nil
+}
+
+// sealEncryptionFile seals a data key with a key derived from password and a fresh salt
+func sealEncryptionFile(key []byte, password string) (encryptionFile, error) {
+	f := encryptionFile{
+		KDF:      "argon2id",
+		Time:     argon2Time,
+		Memory:   argon2Memory,
+		Threads:  argon2Threads,
+		KeyCheck: keyCheck(key),
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return f, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	f.Salt = base64.StdEncoding.EncodeToString(salt)
+
+	enc, err := f.passwordEncryptor(password)
+	if err != nil {
+		return f, err
+	}
+	f.SealedKey = base64.StdEncoding.EncodeToString(enc.seal(key, nil))
+	return f, nil
+}
+
+// unseal returns the data key if password is the master password
+func (f encryptionFile) unseal(password string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(f.SealedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealed key: %w", err)
+	}
+	enc, err := f.passwordEncryptor(password)
+	if err != nil {
+		return nil, err
+	}
+	key, err := enc.open(sealed, nil)
+	if err != nil {
+		return nil, ErrWrongPassword
+	}
+	return key, nil
+}
+
+// retire records the data keys replaced by key, sealed with it
+func (f *encryptionFile) retire(key []byte, retired [][]byte) error {
+	enc, err := newEncryptor(key)
+	if err != nil {
+		return err
+	}
+	f.RetiredKeys = base64.StdEncoding.EncodeToString(enc.seal(bytes.Join(retired, nil), nil))
+	return nil
+}
+
+// retiredKeys returns the data keys replaced by a rekey that hasn't finished
+func (f encryptionFile) retiredKeys(key []byte) ([][]byte, error) {
+	if f.RetiredKeys == "" {
+		return nil, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(f.RetiredKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retired keys: %w", err)
+	}
+	enc, err := newEncryptor(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := enc.open(sealed, nil)
+	if err != nil || len(data)%EncryptionKeySize != 0 {
+		return nil, fmt.Errorf("invalid retired keys")
+	}
+	var keys [][]byte
+	for len(data) > 0 {
+		keys, data = append(keys, data[:EncryptionKeySize]), data[EncryptionKeySize:]
+	}
+	return keys, nil
+}
+
+// passwordEncryptor derives the key sealing the data key from password
+func (f encryptionFile) passwordEncryptor(password string) (*encryptor, error) {
+	salt, err := base64.StdEncoding.DecodeString(f.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	return newEncryptor(argon2.IDKey([]byte(password), salt, f.Time, f.Memory, f.Threads, EncryptionKeySize))
+}
+
+// save atomically replaces the encryption file of a data directory
+func (f encryptionFile) save(fsys FS, dataDir string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode encryption file: %w", err)
+	}
+	path := filepath.Join(dataDir, encryptionFileName)
+	tmpPath := path + ".tmp"
+	if err := writeFile(fsys, tmpPath, data); err != nil {
+		return fmt.Errorf("failed to write encryption file: %w", err)
+	}
+	if err := fsys.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace encryption file: %w", err)
+	}
+	return nil
+}
+
+// keyCheck returns a digest identifying a data key without revealing it
+func keyCheck(key []byte) string {
+	sum := sha256.Sum256(append([]byte(keyCheckInfo), key...))
+	return base64.StdEncoding.EncodeToString(sum[:16])
+}
+
+// encryptor encrypts and authenticates WAL record payloads and SSTable blocks.
+// A nil encryptor leaves data as is, for plaintext data directories.
+type encryptor struct {
+	aead    cipher.AEAD
+	retired []cipher.AEAD // replaced keys, still tried when opening
+}
+
+// newEncryptor returns an AES-256-GCM encryptor sealing with key and opening with
+// key or any of the retired ones
+func newEncryptor(key []byte, retired ...[]byte) (*encryptor, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	e := &encryptor{aead: aead}
+	for _, key := range retired {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		e.retired = append(e.retired, aead)
+	}
+	return e, nil
+}
+
+// newAEAD returns the AES-256-GCM cipher of key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", EncryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// seal returns a random nonce followed by data encrypted and bound to ad
+func (e *encryptor) seal(data, ad []byte) []byte {
+	if e == nil {
+		return data
+	}
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(data)+e.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		// crypto/rand only fails if the OS can't provide randomness at all
+		panic(fmt.Sprintf("failed to generate nonce: %v", err))
+	}
+	return e.aead.Seal(nonce, nonce, data, ad)
+}
+
+// open decrypts data sealed with the same ad
+func (e *encryptor) open(sealed, ad []byte) ([]byte, error) {
+	if e == nil {
+		return sealed, nil
+	}
+	if len(sealed) < e.aead.NonceSize()+e.aead.Overhead() {
+		return nil, fmt.Errorf("encrypted data too short")
+	}
+	nonce, ciphertext := sealed[:e.aead.NonceSize()], sealed[e.aead.NonceSize():]
+	data, err := e.aead.Open(nil, nonce, ciphertext, ad)
+	for _, aead := range e.retired {
+		if err == nil {
+			break
+		}
+		data, err = aead.Open(nil, nonce, ciphertext, ad)
+	}
+	return data, err
+}
+
+// blockAD binds an SSTable block to its table and offset, so blocks can't be moved
+// around in the file or copied from one table into another
+func blockAD(table string, offset uint64) []byte {
+	return append(binary.LittleEndian.AppendUint64(nil, offset), table...)
+}
+
+// walRecordAD binds a WAL record to its segment and offset, so records can't be
+// reordered, dropped from the middle of a segment or replayed from another one
+func walRecordAD(segment uint64, offset int64) []byte {
+	return binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64(nil, segment), uint64(offset))
+}
@@ -0,0 +1,114 @@
+package lsmtree
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ExportFormat is a portable encoding of key-value pairs written by Export
+type ExportFormat string
+
+const (
+	// ExportJSON writes a JSON array of {"key": ..., "value": ...} objects
+	ExportJSON ExportFormat = "json"
+	// ExportCSV writes a "key,value" header followed by one row per entry
+	ExportCSV ExportFormat = "csv"
+	// ExportNDJSON writes one {"key": ..., "value": ...} object per line
+	ExportNDJSON ExportFormat = "ndjson"
+)
+
+// exportEntry is an exported key-value pair in the JSON formats
+type exportEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ParseExportFormat parses a format name as accepted on the command line
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch format := ExportFormat(name); format {
+	case ExportJSON, ExportCSV, ExportNDJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown export format %q, expected json, csv or ndjson", name)
+	}
+}
+
+// Export streams all live key-value pairs of the tree to w in key order
+func (l *LSMTree) Export(w io.Writer, format ExportFormat) error {
+	_, err := ExportStore(l, w, format, "")
+	return err
+}
+
+// ExportStore streams the live key-value pairs of a store whose keys start with
+// prefix to w in key order, returning how many were written. Entries are written
+// as they're scanned, so exports of any size run in constant memory.
+func ExportStore(store Store, w io.Writer, format ExportFormat, prefix string) (int, error) {
+	if _, err := ParseExportFormat(string(format)); err != nil {
+		return 0, err
+	}
+	it, err := PrefixScan(store, prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan store: %w", err)
+	}
+	defer it.Close()
+
+	out := bufio.NewWriter(w)
+	var records *csv.Writer
+	switch format {
+	case ExportJSON:
+		out.WriteString("[")
+	case ExportCSV:
+		records = csv.NewWriter(out)
+		records.Write([]string{"key", "value"})
+	}
+
+	count := 0
+	for it.Next() {
+		if format == ExportCSV {
+			if err := records.Write([]string{it.Key(), it.Value()}); err != nil {
+				return count, fmt.Errorf("failed to write export: %w", err)
+			}
+			count++
+			continue
+		}
+
+		line, err := json.Marshal(exportEntry{Key: it.Key(), Value: it.Value()})
+		if err != nil {
+			return count, fmt.Errorf("failed to encode entry: %w", err)
+		}
+		if format == ExportJSON {
+			if count > 0 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n  ")
+		}
+		out.Write(line)
+		if format == ExportNDJSON {
+			out.WriteByte('\n')
+		}
+		count++
+	}
+	if err := it.Err(); err != nil {
+		return count, fmt.Errorf("failed to scan store: %w", err)
+	}
+
+	switch format {
+	case ExportJSON:
+		if count > 0 {
+			out.WriteString("\n")
+		}
+		out.WriteString("]\n")
+	case ExportCSV:
+		records.Flush()
+		if err := records.Error(); err != nil {
+			return count, fmt.Errorf("failed to write export: %w", err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return count, fmt.Errorf("failed to write export: %w", err)
+	}
+	return count, nil
+}
@@ -0,0 +1,14 @@
+//go:build !unix || aix || solaris
+
+package lsmtree
+
+import "os"
+
+// fileLocking reports whether lock files are protected by an advisory lock
+const fileLocking = false
+
+// tryLockFile can't lock files on this platform, so lock files rely on their
+// contents alone
+func tryLockFile(file *os.File) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,27 @@
+//go:build unix && !aix && !solaris
+
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileLocking reports whether lock files are protected by an advisory lock
+const fileLocking = true
+
+// tryLockFile takes an exclusive advisory lock on file without blocking, reporting
+// false if another open file already holds it. The kernel drops the lock when the
+// file is closed or its process exits.
+func tryLockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to lock %s: %w", file.Name(), err)
+	}
+	return true, nil
+}
@@ -0,0 +1,92 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPaused is returned by Reclaim while PauseBackground holds the SSTables
+var ErrPaused = errors.New("lsmtree: background work is paused")
+
+// ReclaimResult describes a completed Reclaim
+type ReclaimResult struct {
+	TablesBefore  int           `json:"tables_before"`
+	TablesAfter   int           `json:"tables_after"`
+	EntriesBefore int           `json:"entries_before"` // of the SSTables, once the MemTable is flushed
+	EntriesAfter  int           `json:"entries_after"`
+	BytesBefore   int64         `json:"bytes_before"` // of the SSTable files
+	BytesAfter    int64         `json:"bytes_after"`
+	Duration      time.Duration `json:"duration"`
+}
+
+// Reclaimed returns the bytes of SSTable files the rewrite freed
+func (r ReclaimResult) Reclaimed() int64 {
+	return r.BytesBefore - r.BytesAfter
+}
+
+// Reclaim flushes the MemTable and rewrites every SSTable into one, dropping
+// tombstones, the values they and later writes shadow, and the versions past
+// Options.Versions, so disk usage shrinks after mass deletes. Compaction only
+// drops tombstones when it reaches the oldest SSTable, so they can otherwise
+// linger. Reads go on from their views meanwhile, and the old files are removed
+// once no view holds them; writes wait as they do for a compaction.
+func (l *LSMTree) Reclaim() (ReclaimResult, error) {
+	var result ReclaimResult
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return result, ErrClosed
+	}
+	if l.options.InMemory {
+		return result, ErrInMemory
+	}
+	if l.pause.paused.Load() {
+		return result, ErrPaused
+	}
+	began := time.Now()
+	if l.current.memTable.Len() > 0 || len(l.current.immutable) > 0 {
+		if err := l.flushMemTable(); err != nil {
+			return result, fmt.Errorf("failed to flush memtable: %w", err)
+		}
+	}
+
+	v := l.current
+	for _, ssTable := range v.ssTables {
+		result.EntriesBefore += ssTable.properties.Entries
+		result.BytesBefore += ssTable.size
+	}
+	result.TablesBefore = len(v.ssTables)
+	if len(v.ssTables) == 0 {
+		result.Duration = time.Since(began)
+		return result, nil
+	}
+
+	compacted, dropped, err := l.compactSSTables(v.ssTables, true)
+	if err != nil {
+		return result, err
+	}
+	l.compactedBytes.Add(compacted.size)
+	ssTables := []*SSTable{compacted}
+	if compacted.properties.Entries == 0 {
+		// Everything was deleted
+		l.fs.Remove(compacted.FilePath())
+		ssTables = nil
+	}
+	if err := writeManifest(l.fs, l.dataDir, CurrentFormatVersion, ssTables, l.logSegment); err != nil {
+		l.fs.Remove(compacted.FilePath())
+		return result, err
+	}
+	l.replaceSSTables(v, ssTables, dropped)
+
+	for _, ssTable := range ssTables {
+		result.EntriesAfter += ssTable.properties.Entries
+		result.BytesAfter += ssTable.size
+	}
+	result.TablesAfter = len(ssTables)
+	result.Duration = time.Since(began)
+	l.options.Logger.Info("reclaimed space", "sstables", result.TablesBefore, "dropped", result.EntriesBefore-result.EntriesAfter,
+		"reclaimed_bytes", result.Reclaimed(), "duration", result.Duration)
+	return result, nil
+}
@@ -0,0 +1,210 @@
+package lsmtree
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// defaultImportBatchSize is how many entries Import writes per batch
+const defaultImportBatchSize = 1000
+
+// ConflictPolicy decides what Import does with keys that already exist
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite replaces the existing value
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictSkip keeps the existing value
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictFail stops the import before writing the batch with the conflict
+	ConflictFail ConflictPolicy = "fail"
+)
+
+// ErrImportConflict is returned by Import with ConflictFail for a key that already exists
+var ErrImportConflict = errors.New("lsmtree: key already exists")
+
+// ParseConflictPolicy parses a policy name as accepted on the command line
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(name); policy {
+	case ConflictOverwrite, ConflictSkip, ConflictFail:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q, expected skip, overwrite or fail", name)
+	}
+}
+
+// ImportFormatFor returns the format of an export file from its extension
+func ImportFormatFor(path string) (ExportFormat, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ExportJSON, nil
+	case ".csv":
+		return ExportCSV, nil
+	case ".ndjson", ".jsonl":
+		return ExportNDJSON, nil
+	default:
+		return "", fmt.Errorf("can't tell the format of %s from its extension; give one of json, csv or ndjson", path)
+	}
+}
+
+// ImportOptions configures Import
+type ImportOptions struct {
+	Format     ExportFormat
+	OnConflict ConflictPolicy // ConflictOverwrite if empty
+	// BatchSize is how many entries are written per batch, defaultImportBatchSize if 0
+	BatchSize int
+	// ResumeFrom skips the first entries of the input, e.g. the ImportResult.Committed
+	// of an import that failed part way
+	ResumeFrom int
+}
+
+// ImportResult describes what Import did
+type ImportResult struct {
+	Read      int // entries read from the input, including those skipped by ResumeFrom
+	Written   int // entries written to the store
+	Skipped   int // entries not written because the key existed, with ConflictSkip
+	Committed int // entries of the input that are fully dealt with, for ResumeFrom
+}
+
+// Import reads entries in a format written by Export and writes them to the store
+// in batches, so large imports cost one WAL write per batch instead of one per
+// entry. Each batch is applied atomically. If an import fails, the entries before
+// ImportResult.Committed are in the store and the import can be resumed by
+// passing it as ImportOptions.ResumeFrom.
+func Import(store Store, r io.Reader, options ImportOptions) (ImportResult, error) {
+	var result ImportResult
+	if _, err := ParseExportFormat(string(options.Format)); err != nil {
+		return result, err
+	}
+	if options.OnConflict == "" {
+		options.OnConflict = ConflictOverwrite
+	}
+	if _, err := ParseConflictPolicy(string(options.OnConflict)); err != nil {
+		return result, err
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultImportBatchSize
+	}
+
+	next, err := newEntryReader(r, options.Format)
+	if err != nil {
+		return result, err
+	}
+	batch := NewWriteBatch()
+	pending := make(map[string]bool) // keys in batch, which Get doesn't see yet
+	flush := func() error {
+		if batch.Len() > 0 {
+			if err := store.Batch(batch); err != nil {
+				return fmt.Errorf("failed to write batch: %w", err)
+			}
+			result.Written += batch.Len()
+		}
+		result.Committed = result.Read
+		batch, pending = NewWriteBatch(), make(map[string]bool)
+		return nil
+	}
+
+	for {
+		entry, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to read entry %d: %w", result.Read+1, err)
+		}
+		result.Read++
+		if result.Read <= options.ResumeFrom {
+			result.Committed = result.Read
+			continue
+		}
+		if entry.Key == "" {
+			return result, fmt.Errorf("entry %d has an empty key", result.Read)
+		}
+
+		if options.OnConflict != ConflictOverwrite {
+			exists := pending[entry.Key]
+			if !exists {
+				existing, err := store.Get(entry.Key)
+				if err != nil {
+					return result, fmt.Errorf("failed to check for %s: %w", entry.Key, err)
+				}
+				exists = existing != ""
+			}
+			if exists && options.OnConflict == ConflictFail {
+				return result, fmt.Errorf("entry %d: %w: %s", result.Read, ErrImportConflict, entry.Key)
+			}
+			if exists {
+				result.Skipped++
+				continue
+			}
+		}
+		batch.Set(entry.Key, entry.Value)
+		pending[entry.Key] = true
+
+		if batch.Len() >= options.BatchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, flush()
+}
+
+// newEntryReader returns a function reading the entries of an export one at a
+// time, or io.EOF after the last one
+func newEntryReader(r io.Reader, format ExportFormat) (func() (exportEntry, error), error) {
+	switch format {
+	case ExportCSV:
+		records := csv.NewReader(r)
+		header, err := records.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV header: %w", err)
+		}
+		keyColumn, valueColumn := -1, -1
+		for i, name := range header {
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "key":
+				keyColumn = i
+			case "value":
+				valueColumn = i
+			}
+		}
+		if keyColumn < 0 || valueColumn < 0 {
+			return nil, fmt.Errorf("CSV header must name a key and a value column, got %v", header)
+		}
+		return func() (exportEntry, error) {
+			row, err := records.Read()
+			if err != nil {
+				return exportEntry{}, err
+			}
+			return exportEntry{Key: row[keyColumn], Value: row[valueColumn]}, nil
+		}, nil
+
+	case ExportJSON:
+		decoder := json.NewDecoder(r)
+		if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+			return nil, fmt.Errorf("JSON import must be an array of entries")
+		}
+		return func() (exportEntry, error) {
+			var entry exportEntry
+			if !decoder.More() {
+				return entry, io.EOF
+			}
+			err := decoder.Decode(&entry)
+			return entry, err
+		}, nil
+
+	default:
+		decoder := json.NewDecoder(r)
+		return func() (exportEntry, error) {
+			var entry exportEntry
+			err := decoder.Decode(&entry)
+			return entry, err
+		}, nil
+	}
+}
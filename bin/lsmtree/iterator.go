@@ -0,0 +1,347 @@
+package lsmtree
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Iterator walks live key-value pairs in ascending key order
+type Iterator interface {
+	// Next advances the iterator and reports whether an entry is available
+	Next() bool
+	// Key returns the key of the current entry
+	Key() string
+	// Value returns the value of the current entry
+	Value() string
+	// Err returns the first error encountered while iterating
+	Err() error
+	// Close releases resources held by the iterator
+	Close() error
+}
+
+// sliceIterator iterates over a sorted, materialized set of entries
+type sliceIterator struct {
+	keys    []string
+	entries map[string]string
+	pos     int
+}
+
+// newSliceIterator creates an iterator over the given entries in key order
+func newSliceIterator(entries map[string]string) *sliceIterator {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return &sliceIterator{
+		keys:    keys,
+		entries: entries,
+		pos:     -1,
+	}
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.pos+1 >= len(it.keys) {
+		it.pos = len(it.keys)
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *sliceIterator) Key() string {
+	return it.keys[it.pos]
+}
+
+func (it *sliceIterator) Value() string {
+	return it.entries[it.keys[it.pos]]
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// NewIterator returns an iterator over a point-in-time view of all live entries
+func (l *LSMTree) NewIterator() (Iterator, error) {
+	return l.Scan("", "")
+}
+
+// scanIterator returns the live entries merged from the MemTables and SSTables of
+// a view, which it holds so the SSTables aren't deleted while they're read
+type scanIterator struct {
+	tree   *LSMTree
+	view   *view
+	merged *mergeIterator
+	closed bool
+}
+
+func (it *scanIterator) Next() bool {
+	for it.merged.Next() {
+		// Tombstones only shadow older entries, and records aren't keys
+		if it.merged.Value() != "" && !isReservedKey(it.merged.Key()) {
+			return true
+		}
+	}
+	if err := it.merged.Err(); err != nil {
+		it.tree.logCorruption(err)
+	}
+	return false
+}
+
+func (it *scanIterator) Key() string {
+	return it.merged.Key()
+}
+
+func (it *scanIterator) Value() string {
+	return it.merged.Value()
+}
+
+func (it *scanIterator) Err() error {
+	return it.merged.Err()
+}
+
+func (it *scanIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	err := it.merged.Close()
+	it.view.release()
+	return err
+}
+
+// memTableIterator walks the entries of a MemTable in [start, end), including tombstones
+type memTableIterator struct {
+	it   *skipListIterator
+	end  string
+	done bool
+}
+
+// newMemTableIterator creates an iterator over the entries of a MemTable in [start, end)
+func newMemTableIterator(m *MemTable, start, end string) *memTableIterator {
+	it := m.list.newIterator()
+	it.Seek(start)
+	return &memTableIterator{it: it, end: end}
+}
+
+func (it *memTableIterator) Next() bool {
+	if it.done || !it.it.Next() || (it.end != "" && it.it.Key() >= it.end) {
+		it.done = true
+		return false
+	}
+	return true
+}
+
+func (it *memTableIterator) Key() string {
+	return it.it.Key()
+}
+
+func (it *memTableIterator) Value() string {
+	return it.it.Value()
+}
+
+func (it *memTableIterator) Err() error {
+	return nil
+}
+
+func (it *memTableIterator) Close() error {
+	return nil
+}
+
+// tableIterator walks the entries of an SSTable in [start, end), including
+// tombstones, reading a data block only once the previous one is used up
+type tableIterator struct {
+	ctx        context.Context
+	table      *SSTable
+	start, end string
+	next       int // index of the next data block to read
+	block      *blockIterator
+	seek       bool // whether the block must still be positioned at start
+	done       bool
+	err        error
+}
+
+// newTableIterator creates an iterator over the entries of an SSTable in
+// [start, end), loading the SSTable's index to find the block holding start
+func newTableIterator(ctx context.Context, table *SSTable, start, end string) (*tableIterator, error) {
+	if err := table.load(); err != nil {
+		return nil, err
+	}
+	// Start at the last block whose first key is <= start
+	next := sort.Search(len(table.index), func(i int) bool {
+		return table.index[i].firstKey > start
+	}) - 1
+	if next < 0 {
+		next = 0
+	}
+	return &tableIterator{ctx: ctx, table: table, start: start, end: end, next: next, seek: true}, nil
+}
+
+func (it *tableIterator) Next() bool {
+	for !it.done && it.err == nil {
+		if it.block == nil {
+			if it.next >= len(it.table.index) {
+				it.done = true
+				return false
+			}
+			if err := it.ctx.Err(); err != nil {
+				it.err = err
+				return false
+			}
+			data, err := it.table.fetchBlock(it.table.index[it.next])
+			if err != nil {
+				it.err = fmt.Errorf("failed to read SSTable block: %w", err)
+				return false
+			}
+			it.block = it.table.blockIterator(data)
+			it.next++
+		}
+
+		var ok bool
+		if it.seek {
+			ok, it.seek = it.block.Seek(it.start), false
+		} else {
+			ok = it.block.Next()
+		}
+		if ok {
+			if it.end != "" && it.block.Key() >= it.end {
+				it.done = true
+				return false
+			}
+			return true
+		}
+		if err := it.block.Err(); err != nil {
+			it.err = it.table.corruption(it.table.index[it.next-1], err.Error())
+			return false
+		}
+		it.block = nil
+	}
+	return false
+}
+
+func (it *tableIterator) Key() string {
+	return it.block.Key()
+}
+
+func (it *tableIterator) Value() string {
+	return it.block.Value()
+}
+
+func (it *tableIterator) Err() error {
+	return it.err
+}
+
+func (it *tableIterator) Close() error {
+	return nil
+}
+
+// mergeIterator performs a k-way merge of iterators with disjoint or overlapping keys.
+// When several iterators hold the same key, the one listed first wins.
+type mergeIterator struct {
+	iters   []Iterator
+	heap    iteratorHeap
+	started bool
+	key     string
+	value   string
+	err     error
+}
+
+// newMergeIterator creates an iterator that merges the given iterators in key order
+func newMergeIterator(iters []Iterator) *mergeIterator {
+	return &mergeIterator{iters: iters}
+}
+
+func (m *mergeIterator) Next() bool {
+	if m.err != nil {
+		return false
+	}
+
+	if !m.started {
+		m.started = true
+		for i := range m.iters {
+			m.push(i)
+		}
+	}
+
+	if m.err != nil || m.heap.Len() == 0 {
+		return false
+	}
+
+	// Take the smallest key and skip the same key in all other iterators
+	top := heap.Pop(&m.heap).(heapItem)
+	m.key, m.value = top.key, top.value
+	m.push(top.source)
+	for m.heap.Len() > 0 && m.heap[0].key == m.key {
+		dup := heap.Pop(&m.heap).(heapItem)
+		m.push(dup.source)
+	}
+
+	return m.err == nil
+}
+
+// push moves an iterator forward and pushes its next entry onto the heap
+func (m *mergeIterator) push(source int) {
+	it := m.iters[source]
+	if it.Next() {
+		heap.Push(&m.heap, heapItem{key: it.Key(), value: it.Value(), source: source})
+		return
+	}
+	if err := it.Err(); err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+func (m *mergeIterator) Key() string {
+	return m.key
+}
+
+func (m *mergeIterator) Value() string {
+	return m.value
+}
+
+func (m *mergeIterator) Err() error {
+	return m.err
+}
+
+func (m *mergeIterator) Close() error {
+	var firstErr error
+	for _, it := range m.iters {
+		if err := it.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// heapItem is the current entry of one of the merged iterators
+type heapItem struct {
+	key    string
+	value  string
+	source int
+}
+
+// iteratorHeap orders heap items by key, then by source position
+type iteratorHeap []heapItem
+
+func (h iteratorHeap) Len() int { return len(h) }
+func (h iteratorHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	return h[i].source < h[j].source
+}
+func (h iteratorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *iteratorHeap) Push(x interface{}) { *h = append(*h, x.(heapItem)) }
+func (h *iteratorHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,59 @@
+package lsmtree
+
+// KeyHasher hashes keys for the filters of SSTables, set with Options.KeyHasher.
+// Hashes of the same key with different seeds must look independent, as bloom
+// filters combine two of them into all their probes.
+type KeyHasher interface {
+	// Name identifies the hasher. It's recorded with every filter, which is only
+	// used while the tree is opened with the same hasher or a built-in one.
+	Name() string
+	// Hash returns the 64-bit hash of key for seed
+	Hash(key string, seed uint64) uint64
+}
+
+// FNVHasher returns the default KeyHasher, FNV-1a from an offset basis varied by
+// the seed and finalized like MurmurHash3
+func FNVHasher() KeyHasher {
+	return fnvHasher{}
+}
+
+// fnvHasher is the KeyHasher returned by FNVHasher
+type fnvHasher struct{}
+
+// FNV-1a 64-bit parameters
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// Name returns "fnv1a"
+func (fnvHasher) Name() string {
+	return "fnv1a"
+}
+
+// Hash returns the FNV-1a hash of key from an offset basis mixed with seed
+func (fnvHasher) Hash(key string, seed uint64) uint64 {
+	h := uint64(fnvOffset64) ^ mix64(seed+1)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= fnvPrime64
+	}
+	return mix64(h)
+}
+
+// builtinHashers are the hashers filters can be read with whatever Options.KeyHasher is
+var builtinHashers = []KeyHasher{fnvHasher{}}
+
+// resolveHasher returns the hasher named name, which is hasher or a built-in
+// one, or nil if the filters it built can't be checked
+func resolveHasher(name string, hasher KeyHasher) KeyHasher {
+	if hasher != nil && hasher.Name() == name {
+		return hasher
+	}
+	for _, builtin := range builtinHashers {
+		if builtin.Name() == name {
+			return builtin
+		}
+	}
+	return nil
+}
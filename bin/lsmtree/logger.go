@@ -0,0 +1,11 @@
+package lsmtree
+
+// Logger receives the engine's internal events: flushes, compactions, recovery,
+// corruption and the errors of background work. Arguments after the message are
+// alternating keys and values, as for *slog.Logger, which implements it.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
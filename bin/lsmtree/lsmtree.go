@@ -1,55 +1,130 @@
 package lsmtree
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// memTableSizeThreshold is the size limit for the MemTable before it's flushed to disk
-const memTableSizeThreshold = 1024 * 1024 // 1MB
-
 // LSMTree represents a Log-Structured Merge Tree
 type LSMTree struct {
-	dataDir  string
-	memTable *MemTable
-	ssTables []*SSTable
-	wal      *WAL
-	mutex    sync.RWMutex
-	cache    *Cache
+	dataDir   string
+	options   Options
+	fs        FS // options.FS, holding the data directory
+	wal       *WAL
+	mutex     sync.Mutex // serializes writers, flushes and compactions
+	viewMutex sync.Mutex // guards swapping the current view
+	current   *view
+	writeSeq  uint64 // incremented on every write and SSTable replacement, used to validate cache fills
+	cache     *Cache
+	tables    *tableCache
+	blocks    *blockCache
+	access    *accessLog
+	enc       *encryptor // encrypts the WAL and SSTables of an encrypted data directory, set by recover
+
+	lock *DirLock // the data directory lock, taken by Recover
+
+	// logSegment is the oldest WAL segment holding writes that aren't in an SSTable yet
+	logSegment uint64
+
+	// seekCandidate is an SSTable that served too many useless probes and should be compacted next
+	seekCandidate atomic.Pointer[SSTable]
+
+	pause pauseState // background work held by PauseBackground
+
+	flushedBytes   atomic.Int64 // bytes of the SSTables written by flushes since the tree was created
+	compactedBytes atomic.Int64 // bytes of the SSTables written by compactions
+
+	readOnly atomic.Bool // set by SetReadOnly, rejecting Set, Delete and Batch
+
+	subscribers    map[int]func(Change) // change feed callbacks, guarded by mutex
+	watchers       map[int]*watcher     // channels of Watch, guarded by mutex
+	nextSubscriber int
+
+	background sync.WaitGroup // tracks running compactions, the memory pressure watcher and WAL syncing
+	stop       chan struct{}  // closed by Close to stop background watchers
+	closed     bool
 }
 
-// NewLSMTree creates a new LSMTree with the given data directory
+// NewLSMTree creates a new LSMTree with the given data directory and default options
 func NewLSMTree(dataDir string) *LSMTree {
-	return &LSMTree{
-		dataDir:  dataDir,
-		memTable: NewMemTable(),
-		ssTables: make([]*SSTable, 0),
-		wal:      NewWAL(dataDir),
-		cache:    NewCache(1000), // Cache with 1000 entries
+	return NewLSMTreeWithOptions(dataDir, DefaultOptions())
+}
+
+// NewLSMTreeWithOptions creates a new LSMTree with the given data directory and options
+func NewLSMTreeWithOptions(dataDir string, options Options) *LSMTree {
+	options = options.withDefaults()
+	limit := detectMemoryLimit()
+	if options.CacheBytes <= 0 && limit > 0 {
+		options.CacheBytes = int64(float64(limit) * options.CacheMemoryFraction)
+	}
+
+	l := &LSMTree{
+		dataDir: dataDir,
+		options: options,
+		fs:      options.FS,
+		wal:     newWAL(dataDir, options),
+		current: newView(NewMemTable(), nil, nil),
+		cache:   newCacheWithPolicy(options.CacheSize, options.CacheBytes, options.CachePolicy, options.MaxPinnedKeys),
+		tables:  newTableCache(options.FS, options.MaxOpenFiles, options.MmapReads && isOSFS(options.FS)),
+		blocks:  newBlockCache(options.BlockCacheSize),
+		access:  newAccessLog(options.TrackAccess),
+		stop:    make(chan struct{}),
+	}
+	if limit > 0 && options.CacheBytes > 0 {
+		l.runInBackground(func() { l.watchMemoryPressure(limit, l.stop) })
+	}
+	l.wal.memory = options.InMemory
+	if options.WALSync != SyncAlways && !options.InMemory {
+		l.runInBackground(func() { l.wal.syncEvery(l.stop) })
 	}
+	return l
 }
 
 // Set adds or updates a key-value pair in the LSMTree
 func (l *LSMTree) Set(key, value string) error {
-	l.mutex.Lock()
+	return l.SetCtx(context.Background(), key, value)
+}
+
+// SetCtx is like Set, giving up with the context's error if it's done before the
+// writer lock is taken, as while a flush or compaction holds it
+func (l *LSMTree) SetCtx(ctx context.Context, key, value string) error {
+	if err := l.lockContext(ctx); err != nil {
+		return err
+	}
 	defer l.mutex.Unlock()
 
-	// Log the operation to the WAL
-	if err := l.wal.Log(key, value); err != nil {
-		return fmt.Errorf("failed to log to WAL: %w", err)
+	if l.closed {
+		return ErrClosed
+	}
+	if l.readOnly.Load() {
+		return ErrReadOnly
 	}
 
-	// Add the key-value pair to the MemTable
-	l.memTable.Set(key, value)
+	ops, err := l.withVersions([]BatchOp{{Key: key, Value: value}})
+	if err != nil {
+		return err
+	}
+
+	// Log the operation to the WAL, in one batch with its version record if one is kept
+	if len(ops) > 1 {
+		err = l.wal.LogBatch(ops)
+	} else {
+		err = l.wal.Log(key, value)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to log to WAL: %w", err)
+	}
 
-	// Update the cache
-	l.cache.Set(key, value)
+	// Add the key-value pair to the MemTable and update the cache
+	l.applyOps(ops)
 
 	// If the MemTable size exceeds the threshold, flush it to disk
-	if l.memTable.Size() >= memTableSizeThreshold {
+	if l.flushDue() {
 		if err := l.flushMemTable(); err != nil {
 			return fmt.Errorf("failed to flush memtable: %w", err)
 		}
@@ -58,32 +133,54 @@ func (l *LSMTree) Set(key, value string) error {
 	return nil
 }
 
+// Sync writes out and fsyncs every write logged so far, regardless of the WAL sync policy
+func (l *LSMTree) Sync() error {
+	return l.wal.Sync()
+}
+
 // Get retrieves the value for a given key from the LSMTree
 func (l *LSMTree) Get(key string) (string, error) {
-	l.mutex.RLock()
-	defer l.mutex.RUnlock()
+	return l.GetCtx(context.Background(), key)
+}
+
+// GetCtx is like Get, returning the context's error if it's already done. Reads
+// don't take the writer lock, so they never wait for writes.
+func (l *LSMTree) GetCtx(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if isReservedKey(key) {
+		return "", nil
+	}
 
 	// First, check the cache
 	if value, ok := l.cache.Get(key); ok {
+		l.access.record(key)
 		return value, nil
 	}
 
-	// Then, check the MemTable
-	if value, ok := l.memTable.Get(key); ok {
-		l.cache.Set(key, value)
-		return value, nil
-	}
+	// Remember the write sequence so a concurrent write isn't overwritten by a stale cache fill
+	seq := atomic.LoadUint64(&l.writeSeq)
 
-	// If not found in MemTable, search through SSTables from newest to oldest
-	for i := len(l.ssTables) - 1; i >= 0; i-- {
-		value, err := l.ssTables[i].Get(key)
-		if err != nil {
-			return "", fmt.Errorf("failed to get value from SSTable: %w", err)
-		}
-		if value != "" {
-			l.cache.Set(key, value)
-			return value, nil
-		}
+	v := l.acquireView()
+	defer v.release()
+
+	// Then, check the MemTables and SSTables from newest to oldest
+	value, ok, stats, err := v.get(key)
+	if err != nil {
+		l.logCorruption(err)
+		return "", err
+	}
+	if stats.seekCompaction != nil {
+		l.scheduleSeekCompaction(stats.seekCompaction)
+	}
+	// A tombstone reads as a missing key, so it's neither cached nor recorded
+	if ok && value != "" {
+		l.cache.fill(key, value, func() bool {
+			return atomic.LoadUint64(&l.writeSeq) == seq
+		})
+		l.access.record(key)
+		return value, nil
 	}
 
 	// Key not found
@@ -92,22 +189,101 @@ func (l *LSMTree) Get(key string) (string, error) {
 
 // Delete removes a key-value pair from the LSMTree
 func (l *LSMTree) Delete(key string) error {
-	l.mutex.Lock()
+	return l.DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx is like Delete, giving up with the context's error if it's done
+// before the writer lock is taken
+func (l *LSMTree) DeleteCtx(ctx context.Context, key string) error {
+	if err := l.lockContext(ctx); err != nil {
+		return err
+	}
 	defer l.mutex.Unlock()
 
-	// Log the deletion operation to the WAL
-	if err := l.wal.Log(key, ""); err != nil {
+	if l.closed {
+		return ErrClosed
+	}
+	if l.readOnly.Load() {
+		return ErrReadOnly
+	}
+
+	ops, err := l.withVersions([]BatchOp{{Key: key, Delete: true}})
+	if err != nil {
+		return err
+	}
+
+	// Log the deletion operation to the WAL, in one batch with its version record if one is kept
+	if len(ops) > 1 {
+		err = l.wal.LogBatch(ops)
+	} else {
+		err = l.wal.LogDelete(key)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to log deletion to WAL: %w", err)
 	}
 
-	// Mark the key as deleted in the MemTable
-	l.memTable.Set(key, "")
+	// Mark the key as deleted in the MemTable and update the cache
+	l.applyOps(ops)
 
-	// Update the cache
-	l.cache.Set(key, "")
+	// If the MemTable size exceeds the threshold, flush it to disk
+	if l.flushDue() {
+		if err := l.flushMemTable(); err != nil {
+			return fmt.Errorf("failed to flush memtable: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Batch applies all operations of the batch while holding the writer lock,
+// so no other write is interleaved with them
+func (l *LSMTree) Batch(batch *WriteBatch) error {
+	return l.BatchCtx(context.Background(), batch)
+}
+
+// BatchCtx is like Batch, giving up with the context's error if it's done before
+// the writer lock is taken. Once taken, every operation is applied.
+func (l *LSMTree) BatchCtx(ctx context.Context, batch *WriteBatch) error {
+	if l.readOnly.Load() {
+		return ErrReadOnly
+	}
+	return l.writeBatch(ctx, batch.Ops(), false)
+}
+
+// SetReadOnly makes Set, Delete and Batch fail with ErrReadOnly, or lets them
+// write again. Internal records, ApplyChanges and background work still write.
+func (l *LSMTree) SetReadOnly(readOnly bool) {
+	l.readOnly.Store(readOnly)
+}
+
+// writeBatch applies a batch of operations. Replayed operations come from a WAL
+// and are applied as logged, version records included, without versions of their own.
+func (l *LSMTree) writeBatch(ctx context.Context, ops []BatchOp, replayed bool) error {
+	if err := l.lockContext(ctx); err != nil {
+		return err
+	}
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+	if !replayed {
+		var err error
+		if ops, err = l.withVersions(ops); err != nil {
+			return err
+		}
+	}
+	if err := l.wal.LogBatch(ops); err != nil {
+		return fmt.Errorf("failed to log batch to WAL: %w", err)
+	}
+	l.applyOps(ops)
 
 	// If the MemTable size exceeds the threshold, flush it to disk
-	if l.memTable.Size() >= memTableSizeThreshold {
+	if l.flushDue() {
 		if err := l.flushMemTable(); err != nil {
 			return fmt.Errorf("failed to flush memtable: %w", err)
 		}
@@ -116,69 +292,351 @@ func (l *LSMTree) Delete(key string) error {
 	return nil
 }
 
-// Recover rebuilds the MemTable from the WAL
+// Scan returns an iterator over a point-in-time view of the live entries in [start, end)
+func (l *LSMTree) Scan(start, end string) (Iterator, error) {
+	return l.ScanCtx(context.Background(), start, end)
+}
+
+// ScanCtx is like Scan, giving up with the context's error if it's done before
+// the iterator reads the next SSTable block. The iterator reads only the blocks
+// from start on, as far as it's advanced, and holds on to the SSTables until
+// it's closed.
+func (l *LSMTree) ScanCtx(ctx context.Context, start, end string) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	v := l.acquireView()
+
+	// The active MemTable keeps taking writes, so its part of the range is copied
+	// for a point-in-time view; the other MemTables and SSTables don't change
+	active := NewMemTable()
+	v.memTable.Ascend(start, func(key, value string) bool {
+		if end != "" && key >= end {
+			return false
+		}
+		active.Set(key, value)
+		return true
+	})
+	iters := []Iterator{newMemTableIterator(active, start, end)}
+	for i := len(v.immutable) - 1; i >= 0; i-- {
+		iters = append(iters, newMemTableIterator(v.immutable[i], start, end))
+	}
+
+	// The range of a PrefixScan holds exactly the keys with its prefix
+	var prefix string
+	if end != "" && end == prefixEnd(start) {
+		prefix = start
+	}
+	for i := len(v.ssTables) - 1; i >= 0; i-- {
+		ssTable := v.ssTables[i]
+		if prefix != "" {
+			if ok, err := ssTable.mayContainPrefix(prefix, l.options.PrefixExtractor); err != nil {
+				v.release()
+				l.logCorruption(err)
+				return nil, fmt.Errorf("failed to check SSTable prefix filter: %w", err)
+			} else if !ok {
+				continue
+			}
+		}
+		if ssTable.formatVersion >= formatVersionProperties && !ssTable.properties.overlapsRange(start, end) {
+			continue
+		}
+		it, err := newTableIterator(ctx, ssTable, start, end)
+		if err != nil {
+			v.release()
+			l.logCorruption(err)
+			return nil, fmt.Errorf("failed to scan SSTable: %w", err)
+		}
+		iters = append(iters, it)
+	}
+
+	return &scanIterator{tree: l, view: v, merged: newMergeIterator(iters)}, nil
+}
+
+// Close waits for background compactions to finish, syncs the WAL and rejects further writes
+func (l *LSMTree) Close() error {
+	l.mutex.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.stop)
+		for id := range l.watchers {
+			l.dropWatcher(id)
+		}
+	}
+	if l.pause.timer != nil {
+		l.pause.timer.Stop()
+	}
+	l.mutex.Unlock()
+
+	l.background.Wait()
+	l.tables.close()
+	err := l.wal.Close()
+	if l.lock != nil {
+		if saveErr := l.access.save(l.fs, l.dataDir); err == nil {
+			err = saveErr
+		}
+	}
+	if l.lock != nil {
+		if releaseErr := l.lock.Release(); err == nil {
+			err = releaseErr
+		}
+		l.lock = nil
+	}
+	return err
+}
+
+// applyOps applies the operations of a write in order. It must be called with
+// the writer mutex held.
+func (l *LSMTree) applyOps(ops []BatchOp) {
+	for _, op := range ops {
+		value := op.Value
+		if op.Delete {
+			value = ""
+		}
+		l.apply(op.Key, value)
+	}
+}
+
+// apply writes a key-value pair to the active MemTable and updates the cache
+// according to the cache policy. It must be called with the writer mutex held.
+func (l *LSMTree) apply(key, value string) {
+	if isReservedKey(key) {
+		// Version and internal records have readers of their own, so they're neither cached nor published
+		l.current.memTable.Set(key, value)
+		return
+	}
+	old := l.watchedValue(key)
+	l.current.memTable.Set(key, value)
+	seq := atomic.AddUint64(&l.writeSeq, 1)
+	// Pinned keys stay cached, so they're updated in place whatever the policy.
+	// Deletes drop the key rather than cache the tombstone.
+	if value != "" && (l.options.CachePolicy == WriteThrough || l.cache.isPinned(key)) {
+		l.cache.Set(key, value)
+	} else {
+		l.cache.Delete(key)
+	}
+	if value == "" {
+		l.access.forget(key)
+	}
+	l.publish(key, value)
+	l.notify(seq, key, old, value)
+}
+
+// Recover locks the data directory, opens the SSTables listed in the manifest,
+// rebuilds the MemTable from the WAL, restores the keys pinned in the cache and
+// starts taking the scheduled snapshots. The lock is held until Close; if another
+// process holds it, Recover returns ErrLocked. An in-memory tree has nothing to
+// recover.
 func (l *LSMTree) Recover() error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	entries, err := l.wal.Recover()
+	if l.options.InMemory {
+		return nil
+	}
+	if l.lock != nil {
+		return l.recover()
+	}
+	lock := noLock()
+	if isOSFS(l.fs) {
+		var err error
+		if lock, err = lockDir(l.dataDir, l.options.Logger); err != nil {
+			return err
+		}
+	}
+	l.lock = lock
+
+	if err := l.recover(); err != nil {
+		l.lock.Release()
+		l.lock = nil
+		return err
+	}
+	if len(l.options.Snapshots) > 0 {
+		l.runInBackground(func() { l.snapshotEvery(l.stop) })
+	}
+	if l.options.StatsHistory.Every > 0 {
+		l.runInBackground(func() { l.recordStatsEvery(l.stop) })
+	}
+	if l.options.TrackAccess {
+		l.runInBackground(func() { l.saveAccessEvery(l.stop) })
+	}
+	return nil
+}
+
+// recover loads the SSTables and replays the WAL. It must be called with the writer mutex held.
+func (l *LSMTree) recover() error {
+	enc, err := loadEncryptor(l.fs, l.dataDir, l.options.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	l.enc, l.wal.enc = enc, enc
+
+	if err := l.loadSSTables(); err != nil {
+		return err
+	}
+
+	entries, err := l.wal.recover(l.logSegment)
 	if err != nil {
 		return fmt.Errorf("failed to recover from WAL: %w", err)
 	}
 
-	// Replay the entries from the WAL into the MemTable
+	// Replay the entries from the WAL into the MemTable. They stay in the WAL
+	// until the MemTable is flushed.
 	for key, value := range entries {
-		l.memTable.Set(key, value)
+		l.apply(key, value)
+	}
+	report := l.wal.lastRecovery()
+	if report.Discarded > 0 {
+		l.options.Logger.Warn("discarded WAL records torn by a crash", "records", report.Discarded,
+			"segment", report.Truncated, "truncated_bytes", report.TruncatedBytes)
+	}
+	l.options.Logger.Info("recovered", "sstables", len(l.current.ssTables), "wal_segments", report.Segments, "replayed", report.Replayed)
+
+	if err := l.access.load(l.fs, l.dataDir); err != nil {
+		return err
+	}
+	return l.loadPins()
+}
+
+// loadSSTables opens the SSTables recorded in the manifest
+func (l *LSMTree) loadSSTables() error {
+	m, err := readManifest(l.fs, l.dataDir)
+	if err != nil {
+		return err
 	}
 
-	// Clear the WAL if it exists and we successfully recovered entries
-	if len(entries) > 0 {
-		if err := l.wal.Clear(); err != nil {
-			return fmt.Errorf("failed to clear WAL: %w", err)
+	// Stamp a fresh data directory with the current format version right away,
+	// so its SSTables are never mistaken for a legacy layout
+	if _, exists, err := loadManifest(l.fs, l.dataDir); err != nil {
+		return err
+	} else if !exists {
+		if err := writeManifest(l.fs, l.dataDir, CurrentFormatVersion, nil, 0); err != nil {
+			return err
 		}
 	}
+	l.logSegment = m.LogSegment
 
+	ssTables := make([]*SSTable, 0, len(m.Tables))
+	for _, name := range m.Tables {
+		ssTable, err := openSSTable(l.fs, filepath.Join(l.dataDir, name), CurrentFormatVersion, l.enc)
+		if err != nil {
+			return fmt.Errorf("failed to open SSTable %s: %w", name, err)
+		}
+		l.attach(ssTable)
+		ssTables = append(ssTables, ssTable)
+	}
+
+	v := l.current
+	l.installView(newView(v.memTable, v.immutable, ssTables))
 	return nil
 }
 
-// flushMemTable writes the current MemTable to disk as an SSTable
+// flushMemTable writes the current MemTable to disk as an SSTable.
+// The MemTable is first moved to the immutable list so readers keep seeing
+// its entries while the SSTable is being written.
 func (l *LSMTree) flushMemTable() error {
-	ssTable, err := NewSSTable(l.dataDir, l.memTable)
+	// Later writes go to a new WAL segment, so the frozen MemTable's writes are
+	// all in segments before it
+	segment, err := l.wal.rotate()
 	if err != nil {
-		return fmt.Errorf("failed to create SSTable: %w", err)
+		return fmt.Errorf("failed to rotate WAL: %w", err)
+	}
+	v := l.current
+	v.memTable.walSegment = segment
+	immutable := append(append([]*MemTable{}, v.immutable...), v.memTable)
+	l.installView(newView(NewMemTable(), immutable, v.ssTables))
+
+	// Flush every pending MemTable, oldest first, so a previously failed flush is retried
+	for len(l.current.immutable) > 0 {
+		v = l.current
+		start := time.Now()
+		ssTable, err := newSSTable(l.dataDir, v.immutable[0], l.options, l.enc)
+		if err != nil {
+			return fmt.Errorf("failed to create SSTable: %w", err)
+		}
+		l.attach(ssTable)
+		l.flushedBytes.Add(ssTable.size)
+
+		ssTables := append(append([]*SSTable{}, v.ssTables...), ssTable)
+		if err := writeManifest(l.fs, l.dataDir, CurrentFormatVersion, ssTables, v.immutable[0].walSegment); err != nil {
+			l.fs.Remove(ssTable.FilePath())
+			return err
+		}
+		l.logSegment = v.immutable[0].walSegment
+		l.installView(newView(v.memTable, v.immutable[1:], ssTables))
+		l.options.Logger.Info("flushed memtable", "sstable", filepath.Base(ssTable.FilePath()),
+			"entries", ssTable.properties.Entries, "bytes", ssTable.size, "duration", time.Since(start))
 	}
 
-	l.ssTables = append(l.ssTables, ssTable)
-	l.memTable = NewMemTable()
+	// The flushed writes are in SSTables now. Segments that fail to be removed
+	// here are removed on the next recovery.
+	if err := l.wal.removeBefore(l.logSegment); err != nil {
+		l.options.Logger.Error("failed to remove flushed WAL segments", "err", err)
+	}
 
 	// Trigger compaction after flushing
-	go l.triggerCompaction()
+	l.runInBackground(l.triggerCompaction)
 
 	return nil
 }
 
 // List returns all non-deleted key-value pairs in the LSMTree
 func (l *LSMTree) List() (map[string]string, error) {
-	l.mutex.RLock()
-	defer l.mutex.RUnlock()
+	return l.collect(context.Background(), "", func(key string) bool { return !isReservedKey(key) })
+}
 
-	result := make(map[string]string)
+// collect returns the non-deleted key-value pairs whose key matches, including
+// version and internal records. Matching keys all start with prefix, so the
+// SSTables whose prefix filter or key range rules it out are skipped. It gives up
+// if ctx is done before it starts or before an SSTable is read.
+func (l *LSMTree) collect(ctx context.Context, prefix string, match func(key string) bool) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	v := l.acquireView()
+	defer v.release()
 
-	// First, add all entries from the MemTable
-	for key, value := range l.memTable.Entries() {
-		if value != "" {
-			result[key] = value
+	result := make(map[string]string)
+	seen := make(map[string]bool)
+
+	// First, add all entries from the MemTables, newest first
+	memTables := append([]*MemTable{v.memTable}, reversed(v.immutable)...)
+	for _, memTable := range memTables {
+		for key, value := range memTable.Entries() {
+			if seen[key] || !match(key) {
+				continue
+			}
+			seen[key] = true
+			if value != "" {
+				result[key] = value
+			}
 		}
 	}
 
 	// Then, iterate through SSTables from newest to oldest
-	for i := len(l.ssTables) - 1; i >= 0; i-- {
-		entries, err := l.ssTables[i].List()
+	for i := len(v.ssTables) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if prefix != "" {
+			if ok, err := v.ssTables[i].mayContainPrefix(prefix, l.options.PrefixExtractor); err != nil {
+				l.logCorruption(err)
+				return nil, fmt.Errorf("failed to check SSTable prefix filter: %w", err)
+			} else if !ok {
+				continue
+			}
+		}
+		if v.ssTables[i].formatVersion >= formatVersionProperties && !v.ssTables[i].properties.overlapsRange(prefix, prefixEnd(prefix)) {
+			continue
+		}
+		entries, err := v.ssTables[i].scan(true)
 		if err != nil {
+			l.logCorruption(err)
 			return nil, fmt.Errorf("failed to list entries from SSTable: %w", err)
 		}
 		for key, value := range entries {
-			if _, exists := result[key]; !exists {
+			if !seen[key] && match(key) {
+				seen[key] = true
 				if value != "" {
 					result[key] = value
 				}
@@ -189,65 +647,188 @@ func (l *LSMTree) List() (map[string]string, error) {
 	return result, nil
 }
 
+// reversed returns a copy of the MemTables in reverse order
+func reversed(memTables []*MemTable) []*MemTable {
+	result := make([]*MemTable, 0, len(memTables))
+	for i := len(memTables) - 1; i >= 0; i-- {
+		result = append(result, memTables[i])
+	}
+	return result
+}
+
+// scheduleSeekCompaction marks an SSTable for compaction after it served too many useless probes
+func (l *LSMTree) scheduleSeekCompaction(ssTable *SSTable) {
+	if l.seekCandidate.CompareAndSwap(nil, ssTable) {
+		l.runInBackground(l.triggerCompaction)
+	}
+}
+
+// attach connects an SSTable to the tree's shared table and block caches
+func (l *LSMTree) attach(ssTable *SSTable) {
+	ssTable.files = l.tables
+	ssTable.blocks = l.blocks
+	ssTable.logger = l.options.Logger
+	ssTable.hasher = l.options.KeyHasher
+}
+
+// runInBackground runs fn in a goroutine that Close waits for
+func (l *LSMTree) runInBackground(fn func()) {
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		fn()
+	}()
+}
+
+// pickCompaction returns the index of the first of two adjacent SSTables to merge,
+// or -1 if there is nothing to compact. A seek compaction candidate is merged with
+// its older neighbour; otherwise the oldest adjacent pair with overlapping key
+// ranges is merged, falling back to the two oldest SSTables if none overlap.
+func (l *LSMTree) pickCompaction(v *view) int {
+	if len(v.ssTables) < 2 {
+		return -1
+	}
+
+	if candidate := l.seekCandidate.Swap(nil); candidate != nil {
+		for i, ssTable := range v.ssTables {
+			if ssTable == candidate {
+				if i == 0 {
+					return 0
+				}
+				return i - 1
+			}
+		}
+	}
+
+	// Merging SSTables with disjoint key ranges neither drops shadowed entries nor
+	// saves lookups, which already skip SSTables by key range
+	for i := 0; i+1 < len(v.ssTables); i++ {
+		if v.ssTables[i].properties.overlaps(v.ssTables[i+1].properties) {
+			return i
+		}
+	}
+	return 0
+}
+
 // triggerCompaction initiates the compaction process
 func (l *LSMTree) triggerCompaction() {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	if len(l.ssTables) < 2 {
+	if l.closed {
+		return
+	}
+	if l.pause.paused.Load() {
+		l.pause.compaction = true
+		return
+	}
+
+	v := l.current
+	start := l.pickCompaction(v)
+	if start < 0 {
 		return // Not enough SSTables to compact
 	}
 
-	// Compact the two oldest SSTables
-	oldestSSTable := l.ssTables[0]
-	secondOldestSSTable := l.ssTables[1]
+	// Compact the picked pair of adjacent SSTables. Tombstones can only be
+	// dropped when no older SSTable could still hold a value they shadow.
+	olderSSTable := v.ssTables[start]
+	newerSSTable := v.ssTables[start+1]
+	began := time.Now()
+	l.options.Logger.Debug("compaction started", "older", filepath.Base(olderSSTable.FilePath()),
+		"newer", filepath.Base(newerSSTable.FilePath()))
 
-	compactedSSTable, err := l.compactSSTables(oldestSSTable, secondOldestSSTable)
+	compactedSSTable, dropped, err := l.compactSSTables([]*SSTable{olderSSTable, newerSSTable}, start == 0)
 	if err != nil {
-		fmt.Printf("Error during compaction: %v\n", err)
+		l.options.Logger.Error("compaction failed", "err", err)
 		return
 	}
-
-	// Remove the two old SSTables and add the new compacted one
-	l.ssTables = append([]*SSTable{compactedSSTable}, l.ssTables[2:]...)
-
-	// Clean up old SSTable files
-	if err := os.Remove(oldestSSTable.FilePath()); err != nil {
-		fmt.Printf("Error removing old SSTable file: %v\n", err)
+	l.compactedBytes.Add(compactedSSTable.size)
+
+	// Replace the two old SSTables with the new compacted one. Their files are
+	// removed once no reader holds a view that still references them.
+	ssTables := append([]*SSTable{}, v.ssTables[:start]...)
+	ssTables = append(ssTables, compactedSSTable)
+	ssTables = append(ssTables, v.ssTables[start+2:]...)
+	if err := writeManifest(l.fs, l.dataDir, CurrentFormatVersion, ssTables, l.logSegment); err != nil {
+		l.options.Logger.Error("compaction failed", "err", err)
+		l.fs.Remove(compactedSSTable.FilePath())
+		return
 	}
-	if err := os.Remove(secondOldestSSTable.FilePath()); err != nil {
-		fmt.Printf("Error removing old SSTable file: %v\n", err)
+	l.replaceSSTables(v, ssTables, dropped)
+	l.options.Logger.Info("compaction finished", "sstable", filepath.Base(compactedSSTable.FilePath()),
+		"entries", compactedSSTable.properties.Entries,
+		"dropped", olderSSTable.properties.Entries+newerSSTable.properties.Entries-compactedSSTable.properties.Entries,
+		"duration", time.Since(began))
+}
+
+// logCorruption logs err if it reports corrupt data
+func (l *LSMTree) logCorruption(err error) {
+	var corruption *ErrCorruption
+	if errors.As(err, &corruption) {
+		l.options.Logger.Error("corruption detected", "file", corruption.File, "offset", corruption.Offset, "reason", corruption.Reason)
 	}
 }
 
-// compactSSTables merges two SSTables into a new one
-func (l *LSMTree) compactSSTables(ssTable1, ssTable2 *SSTable) (*SSTable, error) {
+// compactSSTables merges SSTables, given oldest first, into a new one, with entries
+// from the newer ones winning. It also returns the keys whose tombstones were dropped.
+func (l *LSMTree) compactSSTables(ssTables []*SSTable, dropTombstones bool) (*SSTable, []string, error) {
 	mergedEntries := make(map[string]string)
 
-	// Merge entries from both SSTables
-	for _, ssTable := range []*SSTable{ssTable1, ssTable2} {
-		entries, err := ssTable.List()
+	// Merge entries from every SSTable
+	for _, ssTable := range ssTables {
+		entries, err := ssTable.scan(false)
 		if err != nil {
-			return nil, fmt.Errorf("failed to list entries from SSTable: %w", err)
+			return nil, nil, fmt.Errorf("failed to list entries from SSTable: %w", err)
 		}
 		for key, value := range entries {
 			mergedEntries[key] = value
 		}
 	}
 
+	// Drop the versions past their retention
+	if err := l.pruneVersions(mergedEntries); err != nil {
+		return nil, nil, fmt.Errorf("failed to prune versions: %w", err)
+	}
+
 	// Create a new MemTable with the merged entries
 	mergedMemTable := NewMemTable()
+	var dropped []string
 	for key, value := range mergedEntries {
+		if value == "" && dropTombstones {
+			dropped = append(dropped, key)
+			continue
+		}
 		mergedMemTable.Set(key, value)
 	}
 
 	// Create a new SSTable from the merged MemTable
-	timestamp := time.Now().UnixNano()
-	compactedSSTablePath := filepath.Join(l.dataDir, fmt.Sprintf("sstable_compacted_%d.dat", timestamp))
-	compactedSSTable, err := NewSSTable(compactedSSTablePath, mergedMemTable)
+	compactedSSTable, err := newSSTable(l.dataDir, mergedMemTable, l.options, l.enc)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create compacted SSTable: %w", err)
+		return nil, nil, fmt.Errorf("failed to create compacted SSTable: %w", err)
 	}
+	l.attach(compactedSSTable)
 
-	return compactedSSTable, nil
+	return compactedSSTable, dropped, nil
+}
+
+// replaceSSTables makes ssTables the SSTables of a view of v, marking v's that
+// aren't among them obsolete. Cache fills of reads that began on v are discarded
+// and the keys of dropped tombstones leave the cache, so no read can bring back
+// a value the replaced SSTables shadowed. It must be called with the writer
+// mutex held.
+func (l *LSMTree) replaceSSTables(v *view, ssTables []*SSTable, dropped []string) {
+	kept := make(map[*SSTable]bool, len(ssTables))
+	for _, ssTable := range ssTables {
+		kept[ssTable] = true
+	}
+	for _, ssTable := range v.ssTables {
+		if !kept[ssTable] {
+			ssTable.markObsolete()
+		}
+	}
+	atomic.AddUint64(&l.writeSeq, 1)
+	l.installView(newView(v.memTable, v.immutable, ssTables))
+	for _, key := range dropped {
+		l.cache.Delete(key)
+	}
 }
@@ -0,0 +1,91 @@
+package lsmtree
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// manifestFileName is the name of the file listing the live SSTables
+const manifestFileName = "MANIFEST"
+
+// manifest records the format version of the data directory and which SSTable
+// files make up the tree in which order. File names alone can't be used because
+// a compacted SSTable is newer on disk than the tables it is ordered before.
+type manifest struct {
+	FormatVersion int      `json:"format_version"`
+	Tables        []string `json:"tables"` // SSTable file names relative to the data directory, oldest first
+	// LogSegment is the oldest WAL segment with writes that aren't in the listed SSTables
+	LogSegment uint64 `json:"log_segment,omitempty"`
+}
+
+// loadManifest reads the manifest from the data directory and reports whether it exists
+func loadManifest(fsys FS, dataDir string) (manifest, bool, error) {
+	var m manifest
+
+	data, err := readFile(fsys, filepath.Join(dataDir, manifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, false, nil
+		}
+		return m, false, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, false, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	// Manifests written before versioning was introduced already used block-based SSTables
+	if m.FormatVersion == 0 {
+		m.FormatVersion = formatVersionBlocks
+	}
+	return m, true, nil
+}
+
+// readManifest loads the manifest of a data directory in the current format,
+// returning an empty manifest for a fresh directory
+func readManifest(fsys FS, dataDir string) (manifest, error) {
+	version, err := detectFormatVersion(fsys, dataDir)
+	if err != nil {
+		return manifest{}, err
+	}
+	if version != CurrentFormatVersion {
+		return manifest{}, &ErrFormatVersion{Version: version}
+	}
+
+	m, _, err := loadManifest(fsys, dataDir)
+	return m, err
+}
+
+// writeManifest atomically replaces the manifest with one listing the given SSTables
+// and the oldest WAL segment still needed for recovery
+func writeManifest(fsys FS, dataDir string, formatVersion int, ssTables []*SSTable, logSegment uint64) error {
+	m := manifest{
+		FormatVersion: formatVersion,
+		Tables:        make([]string, 0, len(ssTables)),
+		LogSegment:    logSegment,
+	}
+	for _, ssTable := range ssTables {
+		m.Tables = append(m.Tables, filepath.Base(ssTable.FilePath()))
+	}
+	return saveManifest(fsys, dataDir, m)
+}
+
+// saveManifest atomically replaces the manifest
+func saveManifest(fsys FS, dataDir string, m manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a partial manifest
+	path := filepath.Join(dataDir, manifestFileName)
+	tmpPath := path + ".tmp"
+	if err := writeFile(fsys, tmpPath, data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := fsys.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to install manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package lsmtree
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS keeping its files in memory, for hermetic tests and as the base
+// of fault-injection wrappers. Unlike Options.InMemory, the tree writes its WAL,
+// SSTables and manifest as usual, so they can be reopened from the same MemFS.
+// The parent directories of a file exist implicitly, and Sync does nothing.
+type MemFS struct {
+	mutex sync.Mutex // guards the maps and the contents of every file
+	files map[string]*memData
+	dirs  map[string]bool // created with MkdirAll
+}
+
+// memData is the contents of a MemFS file, shared by its open handles
+type memData struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemFS creates an empty MemFS
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memData), dirs: make(map[string]bool)}
+}
+
+// Open opens a file for reading
+func (m *MemFS) Open(name string) (File, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	data, ok := m.files[name]
+	if !ok {
+		return nil, notFound("open", name)
+	}
+	return &memFile{fs: m, name: name, data: data}, nil
+}
+
+// Create creates a file for writing, truncating it if it exists
+func (m *MemFS) Create(name string) (File, error) {
+	return m.openWriter("create", name, true)
+}
+
+// Append opens a file for writing at its end, creating it if needed
+func (m *MemFS) Append(name string) (File, error) {
+	return m.openWriter("open", name, false)
+}
+
+// openWriter opens a file for writing, emptying it if truncate is set
+func (m *MemFS) openWriter(op, name string, truncate bool) (File, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	if m.isDir(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: errIsDir}
+	}
+	data, ok := m.files[name]
+	if !ok {
+		data = &memData{}
+		m.files[name] = data
+	}
+	if truncate {
+		data.data = nil
+	}
+	data.modTime = time.Now()
+	return &memFile{fs: m, name: name, data: data, writable: true}, nil
+}
+
+// Rename replaces newname by oldname, a file or a directory with everything under it
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	if data, ok := m.files[oldname]; ok {
+		if m.isDir(newname) {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errIsDir}
+		}
+		delete(m.files, oldname)
+		m.files[newname] = data
+		return nil
+	}
+	if !m.isDir(oldname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if _, ok := m.files[newname]; ok || len(m.children(newname)) > 0 {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errNotEmpty}
+	}
+	for name, data := range m.files {
+		if rel, ok := under(oldname, name); ok {
+			delete(m.files, name)
+			m.files[filepath.Join(newname, rel)] = data
+		}
+	}
+	for dir := range m.dirs {
+		if rel, ok := under(oldname, dir); ok {
+			delete(m.dirs, dir)
+			m.dirs[filepath.Join(newname, rel)] = true
+		}
+	}
+	if m.dirs[oldname] {
+		delete(m.dirs, oldname)
+		m.dirs[newname] = true
+	}
+	return nil
+}
+
+// Remove removes a file or an empty directory. Open handles of a removed file
+// can still read it.
+func (m *MemFS) Remove(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.isDir(name) {
+		return notFound("remove", name)
+	}
+	if len(m.children(name)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+// RemoveAll removes a path and everything under it
+func (m *MemFS) RemoveAll(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	delete(m.files, name)
+	delete(m.dirs, name)
+	for file := range m.files {
+		if _, ok := under(name, file); ok {
+			delete(m.files, file)
+		}
+	}
+	for dir := range m.dirs {
+		if _, ok := under(name, dir); ok {
+			delete(m.dirs, dir)
+		}
+	}
+	return nil
+}
+
+// List returns the entries of a directory sorted by name
+func (m *MemFS) List(dir string) ([]fs.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	dir = filepath.Clean(dir)
+	if _, ok := m.files[dir]; ok {
+		return nil, &fs.PathError{Op: "readdir", Path: dir, Err: errNotDir}
+	}
+	if !m.isDir(dir) {
+		return nil, notFound("readdir", dir)
+	}
+	children := m.children(dir)
+	infos := make([]fs.FileInfo, 0, len(children))
+	for _, name := range children {
+		infos = append(infos, m.info(filepath.Join(dir, name)))
+	}
+	return infos, nil
+}
+
+// Stat describes a file or directory
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; !ok && !m.isDir(name) {
+		return nil, notFound("stat", name)
+	}
+	return m.info(name), nil
+}
+
+// MkdirAll creates a directory and any missing parents
+func (m *MemFS) MkdirAll(dir string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	dir = filepath.Clean(dir)
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, ok := m.files[d]; ok {
+			return &fs.PathError{Op: "mkdir", Path: d, Err: errNotDir}
+		}
+		if d == filepath.Dir(d) {
+			break
+		}
+	}
+	m.dirs[dir] = true
+	return nil
+}
+
+// Truncate changes the size of a file
+func (m *MemFS) Truncate(name string, size int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	data, ok := m.files[name]
+	if !ok {
+		return notFound("truncate", name)
+	}
+	if size < int64(len(data.data)) {
+		data.data = data.data[:size]
+	} else {
+		data.data = append(data.data, make([]byte, size-int64(len(data.data)))...)
+	}
+	data.modTime = time.Now()
+	return nil
+}
+
+// The errors of MemFS operations that have no fs.Err equivalent
+var (
+	errIsDir    = errors.New("is a directory")
+	errNotDir   = errors.New("not a directory")
+	errNotEmpty = errors.New("directory not empty")
+)
+
+// notFound returns the error of an operation on a path that doesn't exist,
+// matching os.IsNotExist
+func notFound(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// isDir reports whether a directory exists at name, created with MkdirAll or
+// holding files. The mutex must be held.
+func (m *MemFS) isDir(name string) bool {
+	if m.dirs[name] {
+		return true
+	}
+	for file := range m.files {
+		if _, ok := under(name, file); ok {
+			return true
+		}
+	}
+	for dir := range m.dirs {
+		if _, ok := under(name, dir); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// children returns the names of the files and directories immediately under
+// dir, sorted. The mutex must be held.
+func (m *MemFS) children(dir string) []string {
+	found := make(map[string]bool)
+	add := func(path string) {
+		if rel, ok := under(dir, path); ok {
+			name, _, _ := strings.Cut(rel, string(filepath.Separator))
+			found[name] = true
+		}
+	}
+	for file := range m.files {
+		add(file)
+	}
+	for d := range m.dirs {
+		add(d)
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// info describes a file or directory that exists. The mutex must be held.
+func (m *MemFS) info(name string) fs.FileInfo {
+	if data, ok := m.files[name]; ok {
+		return memInfo{name: filepath.Base(name), size: int64(len(data.data)), mode: 0600, modTime: data.modTime}
+	}
+	return memInfo{name: filepath.Base(name), mode: fs.ModeDir | 0700}
+}
+
+// under returns the path of name relative to dir if it's beneath it
+func under(dir, name string) (string, bool) {
+	prefix := dir
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	if dir == "." {
+		prefix = ""
+	}
+	if !strings.HasPrefix(name, prefix) || name == dir {
+		return "", false
+	}
+	return name[len(prefix):], true
+}
+
+// memFile is an open MemFS file
+type memFile struct {
+	fs       *MemFS
+	name     string
+	data     *memData
+	offset   int64 // where Read continues
+	writable bool  // opened with Create or Append, which write at the end
+	closed   bool
+}
+
+// Read reads from the current offset
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.offset >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+// ReadAt reads from an offset, failing with io.EOF past the end of the file
+func (f *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Write appends to the file
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if f.closed {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	f.data.data = append(f.data.data, p...)
+	f.data.modTime = time.Now()
+	return len(p), nil
+}
+
+// Close closes the handle
+func (f *memFile) Close() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// Stat describes the file, even after it's been removed
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	return memInfo{name: filepath.Base(f.name), size: int64(len(f.data.data)), mode: 0600, modTime: f.data.modTime}, nil
+}
+
+// Sync does nothing, since there's no stable storage behind a MemFS
+func (f *memFile) Sync() error {
+	return nil
+}
+
+// memInfo describes a MemFS file or directory
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
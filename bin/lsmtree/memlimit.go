@@ -0,0 +1,108 @@
+package lsmtree
+
+import (
+	"math"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCacheMemoryFraction is the share of the memory limit the cache may use by default
+const defaultCacheMemoryFraction = 0.05
+
+// memoryPressureInterval is how often memory usage is checked against the limit
+const memoryPressureInterval = time.Second
+
+// Memory usage thresholds, as fractions of the limit, at which the cache budget is
+// halved or grown back towards its configured size
+const (
+	highMemoryPressure = 0.9
+	lowMemoryPressure  = 0.6
+)
+
+// cgroupMemoryLimitFiles hold the container memory limit for cgroup v2 and v1
+var cgroupMemoryLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// detectMemoryLimit returns the smaller of the Go soft memory limit (GOMEMLIMIT)
+// and the cgroup memory limit, or 0 if neither is set
+func detectMemoryLimit() int64 {
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		limit = 0
+	}
+
+	for _, path := range cgroupMemoryLimitFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		// "max" and the page-aligned MaxInt64 of cgroup v1 mean unlimited
+		if err != nil || value <= 0 || value >= math.MaxInt64/2 {
+			continue
+		}
+		if limit == 0 || value < limit {
+			limit = value
+		}
+	}
+	return limit
+}
+
+// memoryUsageSamples read the memory mapped by the Go runtime that counts towards
+// the soft memory limit
+var memoryUsageSamples = []metrics.Sample{
+	{Name: "/memory/classes/total:bytes"},
+	{Name: "/memory/classes/heap/released:bytes"},
+}
+
+// memoryUsage returns the memory currently held by the Go runtime
+func memoryUsage() int64 {
+	samples := make([]metrics.Sample, len(memoryUsageSamples))
+	copy(samples, memoryUsageSamples)
+	metrics.Read(samples)
+	for _, sample := range samples {
+		if sample.Value.Kind() != metrics.KindUint64 {
+			return 0
+		}
+	}
+	return int64(samples[0].Value.Uint64() - samples[1].Value.Uint64())
+}
+
+// cacheBudget returns the cache byte budget for the given memory usage: halved under
+// high pressure, doubled back towards target once pressure is low again
+func cacheBudget(usage, limit, current, target int64) int64 {
+	switch {
+	case float64(usage) > highMemoryPressure*float64(limit):
+		return max(current/2, target/16)
+	case float64(usage) < lowMemoryPressure*float64(limit):
+		return min(current*2, target)
+	default:
+		return current
+	}
+}
+
+// watchMemoryPressure shrinks the cache while memory usage is close to limit
+// and grows it back once usage drops, until stop is closed
+func (l *LSMTree) watchMemoryPressure(limit int64, stop <-chan struct{}) {
+	ticker := time.NewTicker(memoryPressureInterval)
+	defer ticker.Stop()
+
+	target := l.options.CacheBytes
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			current := l.cache.byteBudget()
+			if budget := cacheBudget(memoryUsage(), limit, current, target); budget != current {
+				l.cache.resize(budget)
+			}
+		}
+	}
+}
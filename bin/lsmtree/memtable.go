@@ -1,39 +1,64 @@
 package lsmtree
 
-// MemTable represents an in-memory key-value store
+// MemTable represents an in-memory, sorted key-value store backed by a skiplist.
+// It supports one writer at a time alongside any number of concurrent readers.
 type MemTable struct {
-	data map[string]string
+	list *skipList
+
+	// walSegment is the first WAL segment without writes of this MemTable, set when it's frozen for flushing
+	walSegment uint64
 }
 
 // NewMemTable creates a new MemTable
 func NewMemTable() *MemTable {
 	return &MemTable{
-		data: make(map[string]string),
+		list: newSkipList(),
 	}
 }
 
 // Set adds or updates a key-value pair in the MemTable
 func (m *MemTable) Set(key, value string) {
-	m.data[key] = value
+	m.list.Set(key, value)
 }
 
 // Get retrieves the value for a given key from the MemTable
 func (m *MemTable) Get(key string) (string, bool) {
-	value, ok := m.data[key]
-	return value, ok
+	return m.list.Get(key)
 }
 
 // Delete removes a key-value pair from the MemTable
 func (m *MemTable) Delete(key string) {
-	delete(m.data, key)
+	m.list.Delete(key)
 }
 
-// Size returns the number of entries in the MemTable
+// Size returns the approximate memory footprint of the MemTable in bytes
 func (m *MemTable) Size() int {
-	return len(m.data)
+	return m.list.Bytes()
+}
+
+// Len returns the number of entries in the MemTable, including tombstones
+func (m *MemTable) Len() int {
+	return m.list.Len()
 }
 
-// Entries returns all key-value pairs in the MemTable
+// Entries returns a copy of all key-value pairs in the MemTable
 func (m *MemTable) Entries() map[string]string {
-	return m.data
+	entries := make(map[string]string, m.list.Len())
+	m.Ascend("", func(key, value string) bool {
+		entries[key] = value
+		return true
+	})
+	return entries
+}
+
+// Ascend calls fn for every entry with a key >= start in ascending key order,
+// including tombstones, until fn returns false
+func (m *MemTable) Ascend(start string, fn func(key, value string) bool) {
+	it := m.list.newIterator()
+	it.Seek(start)
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			return
+		}
+	}
 }
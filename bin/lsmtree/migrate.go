@@ -0,0 +1,538 @@
+package lsmtree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format versions of the on-disk layout
+const (
+	// formatVersionText is the original layout: "key,value" text SSTables not tracked by a manifest
+	formatVersionText = 1
+	// formatVersionBlocks uses block-based SSTables with filters and indexes, tracked by the manifest
+	formatVersionBlocks = 2
+	// formatVersionCompressedBlocks prefixes every data block with a compression header
+	formatVersionCompressedBlocks = 3
+	// formatVersionChecksums adds CRC32C checksums to SSTable blocks and uses binary WAL records
+	formatVersionChecksums = 4
+	// formatVersionProperties adds a properties block with the key range, counts and creation time
+	formatVersionProperties = 5
+	// formatVersionWALRecordTypes tags WAL records as puts, deletes or batch boundaries
+	formatVersionWALRecordTypes = 6
+	// formatVersionWALSegments splits the WAL into numbered segments truncated on flush
+	formatVersionWALSegments = 7
+	// formatVersionPrefixKeys stores keys in data blocks relative to the previous key, with restart points
+	formatVersionPrefixKeys = 8
+	// formatVersionWALTimes dates WAL writes with time records
+	formatVersionWALTimes = 9
+	// formatVersionEncryption allows encrypting the WAL and SSTables with a master password
+	formatVersionEncryption = 10
+	// formatVersionBloomFooter sizes bloom filters per SSTable and records their parameters in the footer
+	formatVersionBloomFooter = 11
+	// formatVersionPrefixFilters adds a bloom filter of key prefixes to the filter block of SSTables
+	formatVersionPrefixFilters = 12
+	// formatVersionRibbonFilters allows ribbon filters in SSTables, see FilterPolicy
+	formatVersionRibbonFilters = 13
+	// formatVersionKeyHashers records the KeyHasher of SSTable filters, whose bloom filters use double hashing
+	formatVersionKeyHashers = 14
+
+	// CurrentFormatVersion is the format version written by this build
+	CurrentFormatVersion = formatVersionKeyHashers
+)
+
+// backupsDirName is the subdirectory holding pre-migration backups
+const backupsDirName = "backups"
+
+// legacyWALFileName is the single WAL file used before the WAL was segmented
+const legacyWALFileName = "wal.log"
+
+// migration upgrades a data directory from one format version. Steps that rewrite
+// SSTables produce the current format directly and may skip later steps.
+type migration struct {
+	from        int
+	description string
+	apply       func(dataDir string) error
+}
+
+// migrations lists every upgrade step in order
+var migrations = []migration{
+	{
+		from:        formatVersionText,
+		description: "rewrite text SSTables as block-based SSTables tracked by a manifest",
+		apply:       withTextWAL(migrateTextSSTables),
+	},
+	{
+		from:        formatVersionBlocks,
+		description: "add compression headers, checksums and properties to SSTables",
+		apply:       withTextWAL(rewriteSSTables(formatVersionBlocks)),
+	},
+	{
+		from:        formatVersionCompressedBlocks,
+		description: "add checksums to SSTable blocks and WAL records, and properties to SSTables",
+		apply:       withTextWAL(rewriteSSTables(formatVersionCompressedBlocks)),
+	},
+	{
+		from:        formatVersionChecksums,
+		description: "add properties blocks with key ranges and entry counts to SSTables, and record types to the WAL",
+		apply:       withUntypedWAL(rewriteSSTables(formatVersionChecksums)),
+	},
+	{
+		from:        formatVersionProperties,
+		description: "add record types to WAL records, split the WAL into segments and prefix-compress SSTable keys",
+		apply:       withUntypedWAL(rewriteSSTables(formatVersionProperties)),
+	},
+	{
+		from:        formatVersionWALRecordTypes,
+		description: "split the WAL into segments and prefix-compress SSTable keys",
+		apply:       withLegacyWALFile(rewriteSSTables(formatVersionWALRecordTypes)),
+	},
+	{
+		from:        formatVersionWALSegments,
+		description: "prefix-compress keys in SSTable data blocks",
+		apply:       rewriteSSTables(formatVersionWALSegments),
+	},
+	{
+		from:        formatVersionPrefixKeys,
+		description: "allow time records in the WAL, which older builds can't read",
+		apply:       setFormatVersion(formatVersionWALTimes),
+	},
+	{
+		from:        formatVersionWALTimes,
+		description: "allow encrypted WAL records and SSTable blocks, which older builds can't read",
+		apply:       setFormatVersion(formatVersionEncryption),
+	},
+	{
+		from:        formatVersionEncryption,
+		description: "allow SSTable footers with bloom filter parameters, which older builds can't read",
+		apply:       setFormatVersion(formatVersionBloomFooter),
+	},
+	{
+		from:        formatVersionBloomFooter,
+		description: "allow prefix bloom filters in SSTables, which older builds can't read",
+		apply:       setFormatVersion(formatVersionPrefixFilters),
+	},
+	{
+		from:        formatVersionPrefixFilters,
+		description: "allow ribbon filters in SSTables, which older builds can't read",
+		apply:       setFormatVersion(formatVersionRibbonFilters),
+	},
+	{
+		from:        formatVersionRibbonFilters,
+		description: "allow SSTable filters naming their key hasher, which older builds can't read",
+		apply:       setFormatVersion(formatVersionKeyHashers),
+	},
+}
+
+// MigrationStep describes a migration that was applied
+type MigrationStep struct {
+	From        int
+	To          int
+	Description string
+	BackupDir   string
+}
+
+// ErrFormatVersion reports a data directory that this build can't open as is
+type ErrFormatVersion struct {
+	Version int
+}
+
+func (e *ErrFormatVersion) Error() string {
+	if e.Version > CurrentFormatVersion {
+		return fmt.Sprintf("data directory uses format version %d, newer than the supported version %d; upgrade lockr", e.Version, CurrentFormatVersion)
+	}
+	return fmt.Sprintf("data directory uses format version %d, older than the current version %d; run `lockr migrate`", e.Version, CurrentFormatVersion)
+}
+
+// DetectFormatVersion returns the format version of the data directory.
+// An empty directory is reported as the current version.
+func DetectFormatVersion(dataDir string) (int, error) {
+	return detectFormatVersion(OSFS{}, dataDir)
+}
+
+// detectFormatVersion is DetectFormatVersion on a file system
+func detectFormatVersion(fsys FS, dataDir string) (int, error) {
+	m, exists, err := loadManifest(fsys, dataDir)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return m.FormatVersion, nil
+	}
+
+	legacy, err := glob(fsys, dataDir, "sstable_*.dat")
+	if err != nil {
+		return 0, err
+	}
+	if len(legacy) > 0 {
+		return formatVersionText, nil
+	}
+	return CurrentFormatVersion, nil
+}
+
+// Migrate upgrades the data directory step by step to the current format version.
+// Before each step the directory is backed up, and a failed step is rolled back.
+// The tree must not be open while migrating.
+func Migrate(dataDir string) ([]MigrationStep, error) {
+	var applied []MigrationStep
+
+	for {
+		version, err := DetectFormatVersion(dataDir)
+		if err != nil {
+			return applied, err
+		}
+		if version == CurrentFormatVersion {
+			return applied, nil
+		}
+		if version > CurrentFormatVersion {
+			return applied, &ErrFormatVersion{Version: version}
+		}
+
+		step, ok := findMigration(version)
+		if !ok {
+			return applied, fmt.Errorf("no migration available from format version %d", version)
+		}
+
+		backupDir := filepath.Join(dataDir, backupsDirName, fmt.Sprintf("migrate-v%d-%d", version, time.Now().UnixNano()))
+		if err := copyDataFiles(dataDir, backupDir); err != nil {
+			return applied, fmt.Errorf("failed to back up data directory: %w", err)
+		}
+
+		if err := step.apply(dataDir); err != nil {
+			if rollbackErr := Rollback(dataDir, backupDir); rollbackErr != nil {
+				return applied, fmt.Errorf("migration from version %d failed: %v; rollback also failed: %w", version, err, rollbackErr)
+			}
+			return applied, fmt.Errorf("migration from version %d failed and was rolled back: %w", version, err)
+		}
+
+		upgraded, err := DetectFormatVersion(dataDir)
+		if err != nil {
+			return applied, err
+		}
+		if upgraded <= version {
+			return applied, fmt.Errorf("migration from version %d did not upgrade the data directory", version)
+		}
+		applied = append(applied, MigrationStep{
+			From:        version,
+			To:          upgraded,
+			Description: step.description,
+			BackupDir:   backupDir,
+		})
+	}
+}
+
+// findMigration returns the migration starting at the given version
+func findMigration(version int) (migration, bool) {
+	for _, m := range migrations {
+		if m.from == version {
+			return m, true
+		}
+	}
+	return migration{}, false
+}
+
+// Rollback replaces the files of the data directory with those of a backup
+// created by Migrate or Restore. The tree must not be open while rolling back.
+func Rollback(dataDir, backupDir string) error {
+	if _, err := os.Stat(backupDir); err != nil {
+		return fmt.Errorf("backup not found: %w", err)
+	}
+	return replaceDataFiles(dataDir, backupDir)
+}
+
+// replaceDataFiles removes the files of the data directory, keeping its lock and
+// subdirectories, and copies in those of src
+func replaceDataFiles(dataDir, src string) error {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == lockFileName {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dataDir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", entry.Name(), err)
+		}
+	}
+
+	return copyDataFiles(src, dataDir)
+}
+
+// copyDataFiles copies the regular files of src into dst, skipping subdirectories
+// and the data directory lock
+func copyDataFiles(src, dst string) error {
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == lockFileName {
+			continue
+		}
+		if err := copyFile(OSFS{}, filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies a single file and syncs it to disk
+func copyFile(fsys FS, src, dst string) error {
+	in, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fsys.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// migrateTextSSTables merges the legacy text SSTables into a single block-based
+// SSTable and records it in a new manifest
+func migrateTextSSTables(dataDir string) error {
+	paths, err := filepath.Glob(filepath.Join(dataDir, "sstable_*.dat"))
+	if err != nil {
+		return err
+	}
+	// Legacy file names carry their creation time, so name order is age order
+	sort.Strings(paths)
+
+	merged := NewMemTable()
+	for _, path := range paths {
+		if err := readTextSSTable(path, merged); err != nil {
+			return err
+		}
+	}
+
+	var ssTables []*SSTable
+	if merged.Len() > 0 {
+		ssTable, err := NewSSTable(dataDir, merged)
+		if err != nil {
+			return err
+		}
+		ssTables = append(ssTables, ssTable)
+	}
+
+	if err := writeManifest(OSFS{}, dataDir, CurrentFormatVersion, ssTables, 0); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove legacy SSTable: %w", err)
+		}
+	}
+	return nil
+}
+
+// rewriteSSTables returns a migration that reads every SSTable in the manifest
+// with the given format version and writes it again in the current format
+func rewriteSSTables(from int) func(dataDir string) error {
+	return func(dataDir string) error {
+		m, _, err := loadManifest(OSFS{}, dataDir)
+		if err != nil {
+			return err
+		}
+
+		oldPaths := make([]string, 0, len(m.Tables))
+		ssTables := make([]*SSTable, 0, len(m.Tables))
+		for _, name := range m.Tables {
+			path := filepath.Join(dataDir, name)
+			old, err := openSSTable(OSFS{}, path, from, nil)
+			if err != nil {
+				return err
+			}
+			entries, err := old.scan(false)
+			if err != nil {
+				return err
+			}
+
+			memTable := NewMemTable()
+			for key, value := range entries {
+				memTable.Set(key, value)
+			}
+			ssTable, err := NewSSTable(dataDir, memTable)
+			if err != nil {
+				return err
+			}
+			oldPaths = append(oldPaths, path)
+			ssTables = append(ssTables, ssTable)
+		}
+
+		if err := writeManifest(OSFS{}, dataDir, CurrentFormatVersion, ssTables, m.LogSegment); err != nil {
+			return err
+		}
+		for _, path := range oldPaths {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove rewritten SSTable: %w", err)
+			}
+		}
+		return nil
+	}
+}
+
+// setFormatVersion returns a migration for a change that only affects data written
+// from now on, which records the new version in the manifest
+func setFormatVersion(version int) func(dataDir string) error {
+	return func(dataDir string) error {
+		m, _, err := loadManifest(OSFS{}, dataDir)
+		if err != nil {
+			return err
+		}
+		m.FormatVersion = version
+		return saveManifest(OSFS{}, dataDir, m)
+	}
+}
+
+// withTextWAL wraps a migration from a format that used a "key,value" text WAL,
+// converting the WAL to checksummed records before the SSTables are migrated
+func withTextWAL(apply func(dataDir string) error) func(dataDir string) error {
+	return func(dataDir string) error {
+		if err := convertTextWAL(dataDir); err != nil {
+			return err
+		}
+		return apply(dataDir)
+	}
+}
+
+// convertTextWAL rewrites a text WAL as checksummed binary records
+func convertTextWAL(dataDir string) error {
+	file, err := os.Open(filepath.Join(dataDir, legacyWALFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open legacy WAL: %w", err)
+	}
+	defer file.Close()
+
+	var records []byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ",", 2)
+		if len(parts) == 2 {
+			records = append(records, encodeWALOp(BatchOp{Key: parts[0], Value: parts[1], Delete: parts[1] == ""})...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read legacy WAL: %w", err)
+	}
+	return installConvertedWAL(dataDir, records)
+}
+
+// withUntypedWAL wraps a migration from a format whose WAL records had no type,
+// converting the WAL to typed records before the rest of the migration runs
+func withUntypedWAL(apply func(dataDir string) error) func(dataDir string) error {
+	return func(dataDir string) error {
+		if err := convertUntypedWAL(dataDir); err != nil {
+			return err
+		}
+		return apply(dataDir)
+	}
+}
+
+// convertUntypedWAL rewrites WAL records holding a bare key and value as put
+// records, or delete records for the empty tombstone value
+func convertUntypedWAL(dataDir string) error {
+	legacyPath := filepath.Join(dataDir, legacyWALFileName)
+	data, err := os.ReadFile(legacyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read legacy WAL: %w", err)
+	}
+
+	var records []byte
+	for offset := 0; offset < len(data); {
+		payload, size, reason := unframeWALRecord(data[offset:])
+		if reason == "" {
+			it := newBlockIterator(payload)
+			if it.Next() && it.pos == len(payload) {
+				records = append(records, encodeWALOp(BatchOp{Key: it.Key(), Value: it.Value(), Delete: it.Value() == ""})...)
+			} else {
+				reason = "malformed record payload"
+			}
+		}
+		if reason != "" {
+			return &ErrCorruption{File: legacyPath, Offset: int64(offset), Reason: reason}
+		}
+		offset += size
+	}
+	return installConvertedWAL(dataDir, records)
+}
+
+// installConvertedWAL writes the records of a converted legacy WAL as the first
+// WAL segment and removes the legacy file
+func installConvertedWAL(dataDir string, records []byte) error {
+	segmentPath := walSegmentPath(dataDir, 1)
+	tmpPath := segmentPath + ".tmp"
+	if err := os.WriteFile(tmpPath, records, 0600); err != nil {
+		return fmt.Errorf("failed to write converted WAL: %w", err)
+	}
+	if err := os.Rename(tmpPath, segmentPath); err != nil {
+		return fmt.Errorf("failed to install converted WAL: %w", err)
+	}
+	return os.Remove(filepath.Join(dataDir, legacyWALFileName))
+}
+
+// withLegacyWALFile wraps a migration from a format that kept the WAL in a single
+// file, renaming it to the first WAL segment before the rest of the migration runs
+func withLegacyWALFile(apply func(dataDir string) error) func(dataDir string) error {
+	return func(dataDir string) error {
+		legacyPath := filepath.Join(dataDir, legacyWALFileName)
+		if err := os.Rename(legacyPath, walSegmentPath(dataDir, 1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to move legacy WAL: %w", err)
+		}
+		return apply(dataDir)
+	}
+}
+
+// readTextSSTable loads the "key,value" lines of a legacy SSTable into the MemTable,
+// dropping tombstones since these tables are the oldest data in the tree
+func readTextSSTable(path string, memTable *MemTable) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open legacy SSTable: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ",", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if parts[1] == "" {
+			memTable.Delete(parts[0])
+		} else {
+			memTable.Set(parts[0], parts[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read legacy SSTable %s: %w", path, err)
+	}
+	return nil
+}
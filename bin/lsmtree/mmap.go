@@ -0,0 +1,49 @@
+package lsmtree
+
+import (
+	"fmt"
+	"io"
+)
+
+// tableReader is an open SSTable file, read either with pread or through a memory mapping
+type tableReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// mmapReader reads an SSTable from a read-only memory mapping
+type mmapReader struct {
+	data  []byte
+	unmap func([]byte) error
+}
+
+// ReadAt copies len(p) bytes at off from the mapping
+func (m *mmapReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(m.data)) {
+		return 0, fmt.Errorf("offset %d out of range", off)
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// slice returns length bytes at off without copying. The slice is only valid
+// until the reader is closed.
+func (m *mmapReader) slice(off, length uint64) ([]byte, error) {
+	if off+length < off || off+length > uint64(len(m.data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return m.data[off : off+length : off+length], nil
+}
+
+// Close unmaps the file
+func (m *mmapReader) Close() error {
+	if m.unmap == nil || m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return m.unmap(data)
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package lsmtree
+
+import (
+	"fmt"
+	"os"
+)
+
+// mmapFile falls back to regular reads on platforms without mmap support
+func mmapFile(path string) (tableReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSTable file: %w", err)
+	}
+	return file, nil
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package lsmtree
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the whole file read-only into memory
+func mmapFile(path string) (tableReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSTable file: %w", err)
+	}
+	// The mapping stays valid after the descriptor is closed
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat SSTable file: %w", err)
+	}
+	if info.Size() == 0 {
+		return &mmapReader{}, nil
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mmap SSTable file: %w", err)
+	}
+	return &mmapReader{data: data, unmap: syscall.Munmap}, nil
+}
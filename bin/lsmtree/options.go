@@ -0,0 +1,173 @@
+package lsmtree
+
+import (
+	"log/slog"
+	"time"
+)
+
+// defaultMemTableSize is the approximate MemTable size in bytes before it's flushed to disk
+const defaultMemTableSize = 4 * 1024 * 1024 // 4MB
+
+// defaultBlockSize is the target size in bytes of an SSTable data block
+const defaultBlockSize = 4 * 1024 // 4KB
+
+// defaultCacheSize is the number of entries held by the cache
+const defaultCacheSize = 1000
+
+// defaultMaxPinnedKeys is the number of keys that may be pinned in the cache
+const defaultMaxPinnedKeys = 100
+
+// Options configures an LSMTree. Zero values fall back to the defaults.
+type Options struct {
+	// MemTableSize is the approximate memory footprint in bytes at which the MemTable is flushed
+	MemTableSize int
+	// BlockSize is the target size in bytes of an SSTable data block
+	BlockSize int
+	// Compression is the codec used for SSTable data blocks
+	Compression Compression
+	// BloomBitsPerKey sizes the bloom filter of every SSTable from its entry count.
+	// The default of 10 bits gives about 1% false positives, and every 5 more
+	// divide them by about ten.
+	BloomBitsPerKey int
+	// FilterPolicy is the kind of filter built for SSTables written from now on. The
+	// SSTables already written keep theirs until they're compacted.
+	FilterPolicy FilterPolicy
+	// PrefixExtractor, if set, adds a bloom filter of key prefixes to every SSTable,
+	// so prefix scans skip the SSTables holding no key with their prefix
+	PrefixExtractor PrefixExtractor
+	// KeyHasher hashes keys for the filters of SSTables written from now on, FNVHasher
+	// by default. Filters built by another hasher are ignored unless it's built in.
+	KeyHasher KeyHasher
+	// CacheSize is the maximum number of entries held in the cache, which evicts
+	// the least recently used one when full
+	CacheSize int
+	// CacheBytes is the approximate memory budget in bytes of the cache. When unset it's
+	// CacheMemoryFraction of the GOMEMLIMIT or cgroup memory limit, if either is set.
+	// The budget shrinks while memory usage is close to the limit.
+	CacheBytes int64
+	// CacheMemoryFraction is the share of the memory limit used for the default CacheBytes
+	CacheMemoryFraction float64
+	// CachePolicy decides whether writes populate the cache and how reads are admitted
+	CachePolicy CachePolicy
+	// MaxPinnedKeys caps the keys pinned in the cache with Pin. It's at most half of CacheSize,
+	// so pinned entries never crowd out the rest of the cache.
+	MaxPinnedKeys int
+	// BlockCacheSize is the capacity in bytes of the cache of decompressed SSTable
+	// data blocks shared by point reads and scans
+	BlockCacheSize int64
+	// MaxOpenFiles is the maximum number of SSTable file handles kept open between reads
+	MaxOpenFiles int
+	// MmapReads memory-maps SSTable files instead of reading blocks with pread, saving
+	// a syscall and a copy per block read on read-heavy workloads
+	MmapReads bool
+	// WALSync decides when WAL writes are flushed to stable storage
+	WALSync SyncPolicy
+	// WALSyncInterval is how often buffered WAL writes are written out when WALSync isn't SyncAlways
+	WALSyncInterval time.Duration
+	// WALMaxUnsyncedBytes is how many bytes may be logged without an fsync when WALSync
+	// is SyncInterval before a write syncs without waiting for the interval
+	WALMaxUnsyncedBytes int64
+	// WALSegmentSize is the size in bytes at which the WAL moves on to a new segment file
+	WALSegmentSize int64
+	// WALArchiveDir, if set, is where WAL segments are moved once their writes are in
+	// SSTables instead of being deleted, for ReplayWALArchive to bring a backup
+	// forward to a point in time
+	WALArchiveDir string
+	// TrackAccess records how often and when each key is read, for StaleKeys. The
+	// statistics are kept in memory and saved to the data directory periodically.
+	TrackAccess bool
+	// Snapshots are taken automatically into the data directory's snapshots
+	// subdirectory while the tree is open, starting with Recover
+	Snapshots []SnapshotSchedule
+	// StatsHistory records snapshots of Stats while the tree is open, starting with
+	// Recover, for LSMTree.StatsHistory. By default none are recorded.
+	StatsHistory StatsHistory
+	// Versions keeps the past values of every key under its retention, returned
+	// by LSMTree.Versions. By default writes overwrite them.
+	Versions VersionRetention
+	// EncryptionKey is the data key of an encrypted data directory, returned by
+	// UnlockEncryption. It's required to recover an encrypted directory and
+	// rejected for a plaintext one.
+	EncryptionKey []byte
+	// FS is the file system of the data directory, the WAL archive and snapshots,
+	// OSFS by default. The data directory lock and MmapReads only apply to OSFS.
+	// Offline tools such as Migrate, Verify, Diagnose and Restore use OSFS.
+	FS FS
+	// InMemory keeps every entry in the MemTable, without a WAL, SSTables or any
+	// other file, so nothing outlives Close and the data directory is ignored. It's
+	// meant for hermetic tests and throwaway stores; Checkpoint, Reclaim,
+	// ReadChanges and the other operations on files return ErrInMemory.
+	InMemory bool
+	// Logger receives the engine's internal events. It defaults to slog.Default().
+	Logger Logger
+}
+
+// DefaultOptions returns the default engine options
+func DefaultOptions() Options {
+	return Options{
+		MemTableSize:        defaultMemTableSize,
+		BlockSize:           defaultBlockSize,
+		BloomBitsPerKey:     defaultBloomBitsPerKey,
+		KeyHasher:           FNVHasher(),
+		CacheSize:           defaultCacheSize,
+		CacheMemoryFraction: defaultCacheMemoryFraction,
+		MaxPinnedKeys:       defaultMaxPinnedKeys,
+		BlockCacheSize:      defaultBlockCacheSize,
+		MaxOpenFiles:        defaultMaxOpenFiles,
+		WALSyncInterval:     defaultWALSyncInterval,
+		WALMaxUnsyncedBytes: defaultWALMaxUnsyncedBytes,
+		WALSegmentSize:      defaultWALSegmentSize,
+		FS:                  OSFS{},
+	}
+}
+
+// withDefaults returns a copy of the options with unset fields filled with defaults
+func (o Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if o.MemTableSize <= 0 {
+		o.MemTableSize = defaults.MemTableSize
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = defaults.BlockSize
+	}
+	if o.BloomBitsPerKey <= 0 {
+		o.BloomBitsPerKey = defaults.BloomBitsPerKey
+	}
+	if o.KeyHasher == nil {
+		o.KeyHasher = defaults.KeyHasher
+	}
+	if o.CacheSize <= 0 {
+		o.CacheSize = defaults.CacheSize
+	}
+	if o.CacheMemoryFraction <= 0 || o.CacheMemoryFraction > 1 {
+		o.CacheMemoryFraction = defaults.CacheMemoryFraction
+	}
+	if o.MaxPinnedKeys <= 0 {
+		o.MaxPinnedKeys = defaults.MaxPinnedKeys
+	}
+	if o.MaxPinnedKeys > o.CacheSize/2 {
+		o.MaxPinnedKeys = o.CacheSize / 2
+	}
+	if o.BlockCacheSize <= 0 {
+		o.BlockCacheSize = defaults.BlockCacheSize
+	}
+	if o.MaxOpenFiles <= 0 {
+		o.MaxOpenFiles = defaults.MaxOpenFiles
+	}
+	if o.WALSyncInterval <= 0 {
+		o.WALSyncInterval = defaults.WALSyncInterval
+	}
+	if o.WALMaxUnsyncedBytes <= 0 {
+		o.WALMaxUnsyncedBytes = defaults.WALMaxUnsyncedBytes
+	}
+	if o.WALSegmentSize <= 0 {
+		o.WALSegmentSize = defaults.WALSegmentSize
+	}
+	if o.FS == nil {
+		o.FS = defaults.FS
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+	return o
+}
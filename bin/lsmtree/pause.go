@@ -0,0 +1,95 @@
+package lsmtree
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPauseTimeout is how long PauseBackground holds background work when no
+// timeout is given
+const DefaultPauseTimeout = 10 * time.Minute
+
+// pauseState tracks a PauseBackground in effect. Fields other than paused are
+// guarded by the writer mutex.
+type pauseState struct {
+	paused     atomic.Bool
+	generation uint64      // incremented on every pause, so a stale timer doesn't resume a later one
+	timer      *time.Timer // resumes when the safety timeout expires
+	compaction bool        // a compaction was requested while paused
+}
+
+// PauseBackground waits for an in-flight flush or compaction to finish and holds
+// new ones, along with scheduled snapshots and the stats history, so the files of the data directory
+// stop changing apart from the WAL. Writes still succeed; the MemTable grows past
+// its size limit until resumed. Background work resumes by itself after timeout,
+// or DefaultPauseTimeout if timeout isn't positive, in case the caller never
+// calls ResumeBackground. Pausing while paused restarts the timeout.
+func (l *LSMTree) PauseBackground(timeout time.Duration) error {
+	// Compactions and flushes run with the writer mutex held, so taking it drains them
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if timeout <= 0 {
+		timeout = DefaultPauseTimeout
+	}
+	if l.pause.timer != nil {
+		l.pause.timer.Stop()
+	}
+	l.pause.generation++
+	generation := l.pause.generation
+	l.pause.paused.Store(true)
+	l.pause.timer = time.AfterFunc(timeout, func() { l.resume(generation) })
+	return nil
+}
+
+// ResumeBackground ends a PauseBackground, catching up on the flush and compaction
+// that were held
+func (l *LSMTree) ResumeBackground() {
+	l.mutex.Lock()
+	generation := l.pause.generation
+	l.mutex.Unlock()
+	l.resume(generation)
+}
+
+// Paused reports whether background work is held by PauseBackground
+func (l *LSMTree) Paused() bool {
+	return l.pause.paused.Load()
+}
+
+// resume ends the pause of the given generation, if it's still in effect
+func (l *LSMTree) resume(generation uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.pause.paused.Load() || generation != l.pause.generation {
+		return
+	}
+	l.pause.paused.Store(false)
+	l.pause.timer.Stop()
+	l.pause.timer = nil
+	if l.closed {
+		return
+	}
+
+	if l.current.memTable.Size() >= l.options.MemTableSize && !l.options.InMemory {
+		if err := l.flushMemTable(); err != nil {
+			l.options.Logger.Error("failed to flush memtable after pause", "err", err)
+		}
+		// The flush triggers a compaction of its own
+		l.pause.compaction = false
+	}
+	if l.pause.compaction {
+		l.pause.compaction = false
+		l.runInBackground(l.triggerCompaction)
+	}
+}
+
+// flushDue reports whether the MemTable has outgrown its size limit and should be
+// flushed now, which an in-memory tree never is. It must be called with the
+// writer mutex held.
+func (l *LSMTree) flushDue() bool {
+	return l.current.memTable.Size() >= l.options.MemTableSize && !l.pause.paused.Load() && !l.options.InMemory
+}
@@ -0,0 +1,116 @@
+package lsmtree
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// pinsFileName is the file in the data directory listing the keys pinned in the cache
+const pinsFileName = "pins.json"
+
+// Pin keeps a key's value in the cache, exempt from eviction, so reading it never
+// touches the SSTables. Pins are recorded in the data directory and restored by
+// Recover. Pinning more than Options.MaxPinnedKeys keys returns ErrPinLimit.
+func (l *LSMTree) Pin(key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Writers are excluded, so the value can't change before it's cached
+	value, err := l.currentValue(key)
+	if err != nil {
+		return err
+	}
+	if err := l.cache.pin(key, value); err != nil {
+		return err
+	}
+	if err := l.recordPins(); err != nil {
+		l.cache.unpin(key)
+		return err
+	}
+	return nil
+}
+
+// Unpin lets a pinned key be evicted from the cache again
+func (l *LSMTree) Unpin(key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.cache.isPinned(key) {
+		return nil
+	}
+	l.cache.unpin(key)
+	return l.recordPins()
+}
+
+// Pinned returns the pinned keys in order
+func (l *LSMTree) Pinned() []string {
+	return l.cache.pinnedKeys()
+}
+
+// loadPins pins the keys recorded in the data directory. It must be called with
+// the writer mutex held, after the WAL is replayed.
+func (l *LSMTree) loadPins() error {
+	data, err := readFile(l.fs, filepath.Join(l.dataDir, pinsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read pinned keys: %w", err)
+	}
+	var keys []string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("failed to parse pinned keys: %w", err)
+	}
+
+	for _, key := range keys {
+		value, err := l.currentValue(key)
+		if err != nil {
+			return err
+		}
+		// A lower MaxPinnedKeys than when the keys were pinned keeps the first ones
+		if err := l.cache.pin(key, value); errors.Is(err, ErrPinLimit) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentValue reads a key from the MemTables and SSTables, bypassing the cache
+func (l *LSMTree) currentValue(key string) (string, error) {
+	v := l.acquireView()
+	defer v.release()
+
+	value, _, _, err := v.get(key)
+	return value, err
+}
+
+// recordPins saves the pinned keys, unless the tree is in memory
+func (l *LSMTree) recordPins() error {
+	if l.options.InMemory {
+		return nil
+	}
+	return savePins(l.fs, l.dataDir, l.cache.pinnedKeys())
+}
+
+// savePins records the pinned keys in the data directory
+func savePins(fsys FS, dataDir string, keys []string) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode pinned keys: %w", err)
+	}
+
+	path := filepath.Join(dataDir, pinsFileName)
+	tmpPath := path + ".tmp"
+	if err := writeFile(fsys, tmpPath, data); err != nil {
+		return fmt.Errorf("failed to write pinned keys: %w", err)
+	}
+	if err := fsys.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace pinned keys: %w", err)
+	}
+	return nil
+}
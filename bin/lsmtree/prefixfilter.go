@@ -0,0 +1,108 @@
+package lsmtree
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// PrefixExtractor maps keys to the prefixes held by the prefix bloom filter of
+// their SSTable, set with Options.PrefixExtractor. If a string has a prefix,
+// every key starting with that string must have the same prefix, so a prefix
+// scan whose prefix has one can skip the SSTables whose filter rules it out.
+type PrefixExtractor interface {
+	// Name identifies the extractor. It's recorded in every SSTable, whose
+	// prefix filter is only used while the tree is opened with the same one.
+	Name() string
+	// Prefix returns the prefix of key, reporting false if it has none
+	Prefix(key string) (string, bool)
+}
+
+// FixedPrefix returns a PrefixExtractor taking the first n bytes of keys, which
+// shorter keys have no prefix for
+func FixedPrefix(n int) PrefixExtractor {
+	return fixedPrefix(n)
+}
+
+// fixedPrefix is the PrefixExtractor returned by FixedPrefix
+type fixedPrefix int
+
+// Name returns "fixed:" and the prefix length
+func (n fixedPrefix) Name() string {
+	return fmt.Sprintf("fixed:%d", int(n))
+}
+
+// Prefix returns the first n bytes of key
+func (n fixedPrefix) Prefix(key string) (string, bool) {
+	if len(key) < int(n) {
+		return "", false
+	}
+	return key[:n], true
+}
+
+// SeparatorPrefix returns a PrefixExtractor taking keys up to and including the
+// first separator, such as the namespace of "services/api/token" for "/". Keys
+// without the separator have no prefix.
+func SeparatorPrefix(separator string) PrefixExtractor {
+	return separatorPrefix(separator)
+}
+
+// separatorPrefix is the PrefixExtractor returned by SeparatorPrefix
+type separatorPrefix string
+
+// Name returns "separator:" and the separator
+func (s separatorPrefix) Name() string {
+	return "separator:" + string(s)
+}
+
+// Prefix returns key up to and including the first separator
+func (s separatorPrefix) Prefix(key string) (string, bool) {
+	i := strings.Index(key, string(s))
+	if s == "" || i < 0 {
+		return "", false
+	}
+	return key[:i+len(s)], true
+}
+
+// prefixFilter is the filter of the prefixes of an SSTable's keys
+type prefixFilter struct {
+	extractor string // name of the PrefixExtractor that built the filter
+	filter    keyFilter
+}
+
+// newPrefixFilter builds the prefix filter of sorted keys, of the same kind as their filter
+func newPrefixFilter(extractor PrefixExtractor, keys []string, policy FilterPolicy, bitsPerKey int, hasher KeyHasher) *prefixFilter {
+	// The keys sharing a prefix are adjacent in key order
+	var prefixes []string
+	for _, key := range keys {
+		if prefix, ok := extractor.Prefix(key); ok && (len(prefixes) == 0 || prefixes[len(prefixes)-1] != prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return &prefixFilter{extractor: extractor.Name(), filter: newFilter(policy, prefixes, bitsPerKey, hasher)}
+}
+
+// mayContainPrefix reports whether the SSTable may hold keys starting with prefix.
+// Only SSTables whose prefix filter was built by extractor can be ruled out, and
+// only for a prefix that extractor gives a prefix of its own.
+func (s *SSTable) mayContainPrefix(prefix string, extractor PrefixExtractor) (bool, error) {
+	if extractor == nil {
+		return true, nil
+	}
+	extracted, ok := extractor.Prefix(prefix)
+	if !ok {
+		return true, nil
+	}
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	if s.prefixFilter == nil || s.prefixFilter.extractor != extractor.Name() {
+		return true, nil
+	}
+	atomic.AddUint64(&s.bloomStats.prefixChecks, 1)
+	if !s.prefixFilter.filter.MightContain(extracted) {
+		atomic.AddUint64(&s.bloomStats.prefixNegatives, 1)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,109 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// SSTableProperties describes the contents of an SSTable, as recorded in its properties block
+type SSTableProperties struct {
+	SmallestKey string    `json:"smallest_key"`
+	LargestKey  string    `json:"largest_key"`
+	Entries     int       `json:"entries"`
+	Tombstones  int       `json:"tombstones"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// overlaps reports whether the key ranges of two SSTables intersect
+func (p SSTableProperties) overlaps(other SSTableProperties) bool {
+	return p.SmallestKey <= other.LargestKey && other.SmallestKey <= p.LargestKey
+}
+
+// overlapsRange reports whether the key range overlaps [start, end), an empty end
+// leaving it unbounded
+func (p SSTableProperties) overlapsRange(start, end string) bool {
+	return p.LargestKey >= start && (end == "" || p.SmallestKey < end)
+}
+
+// mayContain reports whether key falls within the key range
+func (p SSTableProperties) mayContain(key string) bool {
+	return key >= p.SmallestKey && key <= p.LargestKey
+}
+
+// encodeProperties serializes the properties block
+func encodeProperties(p SSTableProperties) []byte {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(p.SmallestKey)))
+	buf = append(buf, p.SmallestKey...)
+	buf = binary.AppendUvarint(buf, uint64(len(p.LargestKey)))
+	buf = append(buf, p.LargestKey...)
+	buf = binary.AppendUvarint(buf, uint64(p.Entries))
+	buf = binary.AppendUvarint(buf, uint64(p.Tombstones))
+	buf = binary.AppendVarint(buf, p.CreatedAt.UnixNano())
+	return buf
+}
+
+// decodeProperties parses a properties block
+func decodeProperties(data []byte) (SSTableProperties, error) {
+	var p SSTableProperties
+	readString := func() (string, error) {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return "", fmt.Errorf("truncated key")
+		}
+		s := string(data[n : n+int(length)])
+		data = data[n+int(length):]
+		return s, nil
+	}
+	readUvarint := func() (uint64, error) {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, fmt.Errorf("truncated counter")
+		}
+		data = data[n:]
+		return value, nil
+	}
+
+	var err error
+	if p.SmallestKey, err = readString(); err != nil {
+		return p, err
+	}
+	if p.LargestKey, err = readString(); err != nil {
+		return p, err
+	}
+	entries, err := readUvarint()
+	if err != nil {
+		return p, err
+	}
+	tombstones, err := readUvarint()
+	if err != nil {
+		return p, err
+	}
+	createdAt, n := binary.Varint(data)
+	if n <= 0 {
+		return p, fmt.Errorf("truncated creation time")
+	}
+
+	p.Entries = int(entries)
+	p.Tombstones = int(tombstones)
+	p.CreatedAt = time.Unix(0, createdAt)
+	return p, nil
+}
+
+// DescribeSSTable reads the properties of an SSTable file without loading its
+// filter or index. The properties of an encrypted SSTable can't be read without
+// opening its tree.
+func DescribeSSTable(filePath string) (SSTableProperties, error) {
+	if encrypted, err := IsEncrypted(filepath.Dir(filePath)); err != nil {
+		return SSTableProperties{}, err
+	} else if encrypted {
+		return SSTableProperties{}, ErrEncrypted
+	}
+	ssTable, err := OpenSSTable(filePath)
+	if err != nil {
+		return SSTableProperties{}, err
+	}
+	return ssTable.properties, nil
+}
@@ -0,0 +1,111 @@
+package lsmtree
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Records are internal state that packages over the tree keep in it, such as the
+// tokens of the HTTP API server. They're stored under recordPrefix and, like
+// version records, left out of Get, List, Scan and the change feed, so they're
+// only read and written through Record, Records and SetRecord.
+const recordPrefix = "\x00record\x00"
+
+// Record returns the value of the record name, or "" if there's none
+func (l *LSMTree) Record(name string) (string, error) {
+	return l.currentValue(recordPrefix + name)
+}
+
+// Records returns the records whose name starts with prefix, by name
+func (l *LSMTree) Records(prefix string) (map[string]string, error) {
+	records, err := l.collect(context.Background(), recordPrefix+prefix, func(key string) bool { return strings.HasPrefix(key, recordPrefix+prefix) })
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]string, len(records))
+	for key, value := range records {
+		byName[strings.TrimPrefix(key, recordPrefix)] = value
+	}
+	return byName, nil
+}
+
+// SetRecord sets the record name to value, or removes it if value is empty
+func (l *LSMTree) SetRecord(name, value string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	var err error
+	if value == "" {
+		err = l.wal.LogDelete(recordPrefix + name)
+	} else {
+		err = l.wal.Log(recordPrefix+name, value)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to log record to WAL: %w", err)
+	}
+	l.apply(recordPrefix+name, value)
+
+	if l.flushDue() {
+		if err := l.flushMemTable(); err != nil {
+			return fmt.Errorf("failed to flush memtable: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetRecords sets the records by name in a single write, removing those whose
+// value is empty
+func (l *LSMTree) SetRecords(records map[string]string) error {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ops := make([]BatchOp, 0, len(names))
+	for _, name := range names {
+		ops = append(ops, BatchOp{Key: recordPrefix + name, Value: records[name], Delete: records[name] == ""})
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	if err := l.wal.LogBatch(ops); err != nil {
+		return fmt.Errorf("failed to log records to WAL: %w", err)
+	}
+	l.applyOps(ops)
+
+	if l.flushDue() {
+		if err := l.flushMemTable(); err != nil {
+			return fmt.Errorf("failed to flush memtable: %w", err)
+		}
+	}
+	return nil
+}
+
+// CheckReserved returns ErrReservedKey for the first operation on a version or
+// internal record key, which only the tree itself writes
+func CheckReserved(ops []BatchOp) error {
+	for _, op := range ops {
+		if isReservedKey(op.Key) {
+			return fmt.Errorf("%w: %q", ErrReservedKey, op.Key)
+		}
+	}
+	return nil
+}
+
+// isReservedKey reports whether a key is a version or internal record rather
+// than a key of the store
+func isReservedKey(key string) bool {
+	return isVersionKey(key) || strings.HasPrefix(key, recordPrefix)
+}
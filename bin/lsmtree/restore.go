@@ -0,0 +1,177 @@
+package lsmtree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RestoreOptions configures Restore
+type RestoreOptions struct {
+	// Merge writes the backup's live entries over the existing data instead of
+	// replacing the data directory. Keys only in the existing data are kept.
+	Merge bool
+	// WALArchive, if set, is a WAL archive (see Options.WALArchiveDir) whose writes
+	// since the backup are replayed on top of it with ReplayWALArchive, up to Until
+	// unless that's zero. It can't be combined with Merge.
+	WALArchive string
+	Until      time.Time
+	// EncryptionKey is the data key of an encrypted backup or data directory (see
+	// UnlockEncryption). Backups of a store share its data key, so one key serves
+	// both when both are encrypted.
+	EncryptionKey []byte
+	// BackupEncryptionKey is the data key of a backup taken before the store was
+	// rekeyed, if it differs from EncryptionKey
+	BackupEncryptionKey []byte
+}
+
+// backupKey returns the data key to open the backup with
+func (o RestoreOptions) backupKey() []byte {
+	if o.BackupEncryptionKey != nil {
+		return o.BackupEncryptionKey
+	}
+	return o.EncryptionKey
+}
+
+// RestoreResult describes a completed restore
+type RestoreResult struct {
+	TablesVerified int          // SSTables of the backup whose checksums were checked
+	EntriesMerged  int          // entries written over the existing data when merging
+	PreviousDir    string       // copy of the data directory taken before the restore
+	WAL            ReplayResult // archived writes replayed on top of the backup
+}
+
+// Restore installs a backup written by Checkpoint as the data directory's store.
+// The backup's manifest and the checksums of all its SSTables and WAL records are
+// verified first, and the current contents of the data directory are copied to
+// its backups subdirectory so the restore can be undone with Rollback. Restore
+// locks the data directory, so the tree must not be open.
+//
+// With a WAL archive, the archived writes since the backup are verified along with
+// it and replayed once it's installed, restoring the store as it was at a point in
+// time.
+func Restore(dataDir, backupDir string, options RestoreOptions) (RestoreResult, error) {
+	var result RestoreResult
+
+	if options.Merge && options.WALArchive != "" {
+		return result, fmt.Errorf("a WAL archive can only be replayed when replacing the data directory, not merging")
+	}
+	if _, exists, err := loadManifest(OSFS{}, backupDir); err != nil {
+		return result, fmt.Errorf("failed to read backup manifest: %w", err)
+	} else if !exists {
+		return result, fmt.Errorf("%s is not a backup: it has no manifest", backupDir)
+	}
+	backupKey, err := keyIfEncrypted(backupDir, options.backupKey())
+	if err != nil {
+		return result, err
+	}
+	report, err := VerifyDirWithKey(backupDir, backupKey)
+	if err != nil {
+		return result, fmt.Errorf("failed to verify backup: %w", err)
+	}
+	if len(report.Corruptions) > 0 {
+		return result, fmt.Errorf("backup is corrupt: %w", report.Corruptions[0])
+	}
+	result.TablesVerified = report.TablesChecked
+	if options.WALArchive != "" {
+		m, _, err := loadManifest(OSFS{}, backupDir)
+		if err != nil {
+			return result, err
+		}
+		enc, err := loadEncryptor(OSFS{}, backupDir, backupKey)
+		if err != nil {
+			return result, err
+		}
+		if _, _, err := selectArchivedSegments(options.WALArchive, m.LogSegment, options.Until, enc); err != nil {
+			return result, fmt.Errorf("failed to verify WAL archive: %w", err)
+		}
+	}
+
+	if options.Merge {
+		return result, mergeBackup(dataDir, backupDir, options.EncryptionKey, backupKey, &result)
+	}
+	if err := installBackup(dataDir, backupDir, &result); err != nil {
+		return result, err
+	}
+	if options.WALArchive == "" {
+		return result, nil
+	}
+	if result.WAL, err = ReplayWALArchive(dataDir, options.WALArchive, options.Until, backupKey); err != nil {
+		return result, fmt.Errorf("failed to replay WAL archive: %w", err)
+	}
+	return result, nil
+}
+
+// installBackup replaces the files of the data directory with those of the backup
+// under the data directory lock, saving the previous ones first
+func installBackup(dataDir, backupDir string, result *RestoreResult) error {
+	lock, err := LockDir(dataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	if result.PreviousDir, err = savePreviousData(dataDir, "restore"); err != nil {
+		return err
+	}
+	if err := replaceDataFiles(dataDir, backupDir); err != nil {
+		return fmt.Errorf("failed to install backup: %w", err)
+	}
+	return nil
+}
+
+// mergeBackup writes the live entries of the backup into the data directory's
+// tree, opening the data directory with key if it's encrypted
+func mergeBackup(dataDir, backupDir string, key, backupKey []byte, result *RestoreResult) error {
+	dataKey, err := keyIfEncrypted(dataDir, key)
+	if err != nil {
+		return err
+	}
+
+	tree := NewLSMTreeWithOptions(dataDir, Options{EncryptionKey: dataKey})
+	if err := tree.Recover(); err != nil {
+		return err
+	}
+	defer tree.Close()
+
+	if result.PreviousDir, err = savePreviousData(dataDir, "restore"); err != nil {
+		return err
+	}
+
+	backup := NewLSMTreeWithOptions(backupDir, Options{EncryptionKey: backupKey})
+	if err := backup.Recover(); err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer backup.Close()
+
+	it, err := backup.Scan("", "")
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	defer it.Close()
+
+	batch := NewWriteBatch()
+	for it.Next() {
+		batch.Set(it.Key(), it.Value())
+		result.EntriesMerged++
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	if err := tree.Batch(batch); err != nil {
+		return fmt.Errorf("failed to merge backup: %w", err)
+	}
+	return nil
+}
+
+// savePreviousData copies the data directory's files into its backups
+// subdirectory, returning the copy's path
+func savePreviousData(dataDir, operation string) (string, error) {
+	previousDir := filepath.Join(dataDir, backupsDirName, fmt.Sprintf("%s-%d", operation, time.Now().UnixNano()))
+	if err := copyDataFiles(dataDir, previousDir); err != nil {
+		os.RemoveAll(previousDir)
+		return "", fmt.Errorf("failed to save the data directory before the %s: %w", operation, err)
+	}
+	return previousDir, nil
+}
@@ -0,0 +1,241 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+)
+
+// ribbonWidth is the number of consecutive slots a key's equation spans
+const ribbonWidth = 64
+
+// ribbonMaxAttempts is how many seeds are tried before a ribbon filter grows
+const ribbonMaxAttempts = 4
+
+// RibbonFilter is a standard ribbon filter (Dillinger and Walzer, 2021): every key
+// hashes to a start slot, a 64-bit coefficient row and a fingerprint, and the
+// filter stores the solution of the linear system over GF(2) making the rows of
+// the keys yield their fingerprints. A missing key matches with a probability of
+// 2^-fingerprint bits, for about a quarter less memory than a bloom filter with
+// the same false positive rate. The solution is stored as one bitset per fingerprint
+// bit, so a lookup reads two adjacent words of each.
+type RibbonFilter struct {
+	slots       uint       // rows of the solution, at least ribbonWidth
+	resultBits  uint       // fingerprint bits
+	seed        uint64     // varied until the keys' rows are linearly independent
+	columns     [][]uint64 // bit j of every slot's solution, padded with a word
+	fingerprint uint32     // mask of the fingerprint bits
+	hasher      KeyHasher  // hashes keys once with seed 0, nil for unseeded FNV-1a before format version 14
+	hashName    string     // name of the hasher, set even if the tree isn't opened with it
+}
+
+// NewRibbonFilter builds a RibbonFilter of distinct keys with the false positive
+// rate of a bloom filter of bitsPerKey bits per key, hashing keys with FNVHasher
+func NewRibbonFilter(keys []string, bitsPerKey int) *RibbonFilter {
+	return newRibbonFilter(keys, bitsPerKey, FNVHasher())
+}
+
+// newRibbonFilter is NewRibbonFilter hashing keys with hasher
+func newRibbonFilter(keys []string, bitsPerKey int, hasher KeyHasher) *RibbonFilter {
+	if bitsPerKey <= 0 {
+		bitsPerKey = defaultBloomBitsPerKey
+	}
+	// A bloom filter with its best hash count misses about 2^-(bitsPerKey*ln2) of absent keys
+	resultBits := bloomHashCount(bitsPerKey)
+	if resultBits > 32 {
+		resultBits = 32
+	}
+	// A few percent more slots than keys are enough to solve the system most of the time
+	slots := uint(len(keys)) + uint(len(keys))/16 + ribbonWidth
+	hashes := make([]uint64, len(keys))
+	for i, key := range keys {
+		hashes[i] = hasher.Hash(key, 0)
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && attempt%ribbonMaxAttempts == 0 {
+			slots += slots / 8
+		}
+		rf := &RibbonFilter{
+			slots:       slots,
+			resultBits:  resultBits,
+			seed:        uint64(attempt),
+			fingerprint: uint32(1<<resultBits - 1),
+			hasher:      hasher,
+			hashName:    hasher.Name(),
+		}
+		if rf.solve(hashes) {
+			return rf
+		}
+	}
+}
+
+// keyHash hashes a key once, and the row of every seed is derived from it
+func (rf *RibbonFilter) keyHash(key string) uint64 {
+	if rf.hasher != nil {
+		return rf.hasher.Hash(key, 0)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// setHasher sets the hasher of the RibbonFilter
+func (rf *RibbonFilter) setHasher(name string, hasher KeyHasher) {
+	rf.hashName, rf.hasher = name, hasher
+}
+
+// row returns the start slot, coefficients and fingerprint of a key hash, the
+// coefficients having their lowest bit set
+func (rf *RibbonFilter) row(hash uint64) (uint, uint64, uint32) {
+	h1 := mix64(hash ^ (rf.seed+1)*0x9e3779b97f4a7c15)
+	h2 := mix64(h1 ^ 0xd6e8feb86659fd93)
+	start, _ := bits.Mul64(h1, uint64(rf.slots-ribbonWidth+1))
+	return uint(start), h2 | 1, uint32(h1) & rf.fingerprint
+}
+
+// solve bands the rows of the keys with Gaussian elimination and back-substitutes
+// the solution, reporting false if the rows aren't linearly independent
+func (rf *RibbonFilter) solve(hashes []uint64) bool {
+	coefficients := make([]uint64, rf.slots)
+	results := make([]uint32, rf.slots)
+	for _, hash := range hashes {
+		i, c, r := rf.row(hash)
+		for {
+			if coefficients[i] == 0 {
+				coefficients[i], results[i] = c, r
+				break
+			}
+			c ^= coefficients[i]
+			r ^= results[i]
+			if c == 0 {
+				if r != 0 {
+					return false
+				}
+				break // the same equation as a key already banded
+			}
+			shift := uint(bits.TrailingZeros64(c))
+			i += shift
+			c >>= shift
+		}
+	}
+
+	words := (rf.slots+63)/64 + 1
+	rf.columns = make([][]uint64, rf.resultBits)
+	for j := range rf.columns {
+		rf.columns[j] = make([]uint64, words)
+	}
+	for i := int(rf.slots) - 1; i >= 0; i-- {
+		c := coefficients[i]
+		if c == 0 {
+			continue // a free variable, left zero
+		}
+		for j, column := range rf.columns {
+			// The row's lowest coefficient is slot i itself, solved so its
+			// equation holds given the slots above it
+			bit := uint64(results[i]>>j&1) ^ uint64(bits.OnesCount64(c&^1&window(column, uint(i)))&1)
+			column[i/64] |= bit << (uint(i) % 64)
+		}
+	}
+	return true
+}
+
+// window returns the 64 bits of a column starting at slot i
+func window(column []uint64, i uint) uint64 {
+	word, offset := i/64, i%64
+	if offset == 0 {
+		return column[word]
+	}
+	return column[word]>>offset | column[word+1]<<(64-offset)
+}
+
+// MightContain checks if a key might be in the RibbonFilter
+func (rf *RibbonFilter) MightContain(key string) bool {
+	if rf.hasher == nil && rf.hashName != "" {
+		return true // built with a hasher the tree isn't opened with
+	}
+	start, c, r := rf.row(rf.keyHash(key))
+	var result uint32
+	for j, column := range rf.columns {
+		result |= uint32(bits.OnesCount64(c&window(column, start))&1) << j
+	}
+	return result == r
+}
+
+// Bits returns the size of the RibbonFilter in bits
+func (rf *RibbonFilter) Bits() uint {
+	return rf.slots * rf.resultBits
+}
+
+// probes returns the fingerprint bits, which set the false positive rate as a
+// bloom filter's hash count does
+func (rf *RibbonFilter) probes() uint {
+	return rf.resultBits
+}
+
+// bitsSet returns the number of bits set in the solution
+func (rf *RibbonFilter) bitsSet() uint {
+	var count uint
+	for _, column := range rf.columns {
+		for _, word := range column {
+			count += uint(bits.OnesCount64(word))
+		}
+	}
+	return count
+}
+
+// encode serializes the RibbonFilter as a zero, ribbonFilterTag, uvarint(slots)
+// uvarint(resultBits) uvarint(seed) and every column, padding word included,
+// after the name of its hasher
+func (rf *RibbonFilter) encode() []byte {
+	buf := []byte{0, ribbonFilterTag}
+	buf = binary.AppendUvarint(buf, uint64(rf.slots))
+	buf = binary.AppendUvarint(buf, uint64(rf.resultBits))
+	buf = binary.AppendUvarint(buf, rf.seed)
+	for _, column := range rf.columns {
+		for _, word := range column {
+			buf = binary.LittleEndian.AppendUint64(buf, word)
+		}
+	}
+	if rf.hashName == "" {
+		return buf
+	}
+	return encodeHasher(rf.hashName, buf)
+}
+
+// decodeRibbonFilter parses a RibbonFilter serialized by encode, after its tag,
+// at the start of data, returning the bytes that follow it
+func decodeRibbonFilter(data []byte) (*RibbonFilter, []byte, error) {
+	var fields [3]uint64
+	for i := range fields {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, nil, fmt.Errorf("invalid ribbon filter header")
+		}
+		fields[i], data = value, data[n:]
+	}
+	slots, resultBits, seed := fields[0], fields[1], fields[2]
+	if slots < ribbonWidth || resultBits == 0 || resultBits > 32 {
+		return nil, nil, fmt.Errorf("invalid ribbon filter of %d slots with %d bit fingerprints", slots, resultBits)
+	}
+	words := (slots+63)/64 + 1
+	if uint64(len(data)) < resultBits*words*8 {
+		return nil, nil, fmt.Errorf("ribbon filter has %d bytes of solution, expected %d", len(data), resultBits*words*8)
+	}
+
+	rf := &RibbonFilter{
+		slots:       uint(slots),
+		resultBits:  uint(resultBits),
+		seed:        seed,
+		columns:     make([][]uint64, resultBits),
+		fingerprint: uint32(1<<resultBits - 1),
+	}
+	for j := range rf.columns {
+		rf.columns[j] = make([]uint64, words)
+		for i := range rf.columns[j] {
+			rf.columns[j][i] = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		}
+	}
+	return rf, data, nil
+}
@@ -0,0 +1,245 @@
+package lsmtree
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ShardedStore spreads keys across several LSMTree instances by key hash
+type ShardedStore struct {
+	shards []*LSMTree
+}
+
+// shardCountFileName is the file in a ShardedStore's base directory recording its shard count
+const shardCountFileName = "SHARDS"
+
+// NewShardedStore creates a ShardedStore with the given number of shards, each in its own
+// subdirectory of baseDir. The shard count is recorded on first open, and opening
+// with another count fails, as keys would hash to the wrong shards.
+func NewShardedStore(baseDir string, shardCount int) (*ShardedStore, error) {
+	return NewShardedStoreWithOptions(baseDir, shardCount, DefaultOptions())
+}
+
+// NewShardedStoreWithOptions is like NewShardedStore, opening every shard with the
+// given options. The shard count file and directories are kept in options.FS.
+func NewShardedStoreWithOptions(baseDir string, shardCount int, options Options) (*ShardedStore, error) {
+	if shardCount < 1 {
+		return nil, fmt.Errorf("invalid shard count %d", shardCount)
+	}
+	options = options.withDefaults()
+	if !options.InMemory {
+		if err := checkShardCount(options.FS, baseDir, shardCount); err != nil {
+			return nil, err
+		}
+	}
+
+	shards := make([]*LSMTree, 0, shardCount)
+	for i := 0; i < shardCount; i++ {
+		dir := filepath.Join(baseDir, fmt.Sprintf("shard_%03d", i))
+		if !options.InMemory {
+			if err := options.FS.MkdirAll(dir); err != nil {
+				// Stop the background work of the shards already created
+				for _, shard := range shards {
+					shard.Close()
+				}
+				return nil, fmt.Errorf("failed to create shard directory: %w", err)
+			}
+		}
+		shards = append(shards, NewLSMTreeWithOptions(dir, options))
+	}
+
+	return &ShardedStore{shards: shards}, nil
+}
+
+// checkShardCount compares shardCount with the count recorded in baseDir of fsys,
+// recording it if there's none yet. A store created before counts were recorded
+// is checked against its shard directories instead.
+func checkShardCount(fsys FS, baseDir string, shardCount int) error {
+	path := filepath.Join(baseDir, shardCountFileName)
+	data, err := readFile(fsys, path)
+	if err == nil {
+		recorded, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("failed to parse shard count file: %w", err)
+		}
+		if recorded != shardCount {
+			return fmt.Errorf("store has %d shards, opened with %d", recorded, shardCount)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read shard count file: %w", err)
+	}
+
+	existing, err := fsys.List(baseDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to list shard directories: %w", err)
+	}
+	shardDirs := 0
+	for _, info := range existing {
+		if ok, _ := filepath.Match("shard_[0-9][0-9][0-9]", info.Name()); ok && info.IsDir() {
+			shardDirs++
+		}
+	}
+	if shardDirs > 0 && shardDirs != shardCount {
+		return fmt.Errorf("store has %d shards, opened with %d", shardDirs, shardCount)
+	}
+
+	if err := fsys.MkdirAll(baseDir); err != nil {
+		return fmt.Errorf("failed to create store directory: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := writeFile(fsys, tmpPath, []byte(strconv.Itoa(shardCount)+"\n")); err != nil {
+		return fmt.Errorf("failed to write shard count file: %w", err)
+	}
+	if err := fsys.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write shard count file: %w", err)
+	}
+	return nil
+}
+
+// shardFor returns the shard responsible for the given key
+func (s *ShardedStore) shardFor(key string) *LSMTree {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// Set adds or updates a key-value pair in the responsible shard
+func (s *ShardedStore) Set(key, value string) error {
+	return s.shardFor(key).Set(key, value)
+}
+
+// SetCtx is like Set, giving up with the context's error if it's done first
+func (s *ShardedStore) SetCtx(ctx context.Context, key, value string) error {
+	return s.shardFor(key).SetCtx(ctx, key, value)
+}
+
+// Get retrieves the value for a given key from the responsible shard
+func (s *ShardedStore) Get(key string) (string, error) {
+	return s.shardFor(key).Get(key)
+}
+
+// GetCtx is like Get, returning the context's error if it's already done
+func (s *ShardedStore) GetCtx(ctx context.Context, key string) (string, error) {
+	return s.shardFor(key).GetCtx(ctx, key)
+}
+
+// Delete removes a key-value pair from the responsible shard
+func (s *ShardedStore) Delete(key string) error {
+	return s.shardFor(key).Delete(key)
+}
+
+// DeleteCtx is like Delete, giving up with the context's error if it's done first
+func (s *ShardedStore) DeleteCtx(ctx context.Context, key string) error {
+	return s.shardFor(key).DeleteCtx(ctx, key)
+}
+
+// Recover rebuilds every shard from its WAL
+func (s *ShardedStore) Recover() error {
+	for i, shard := range s.shards {
+		if err := shard.Recover(); err != nil {
+			return fmt.Errorf("failed to recover shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// List returns all non-deleted key-value pairs across all shards
+func (s *ShardedStore) List() (map[string]string, error) {
+	result := make(map[string]string)
+	for i, shard := range s.shards {
+		entries, err := shard.List()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list shard %d: %w", i, err)
+		}
+		for key, value := range entries {
+			result[key] = value
+		}
+	}
+	return result, nil
+}
+
+// NewIterator returns an iterator over all shards, merged in key order
+func (s *ShardedStore) NewIterator() (Iterator, error) {
+	iters := make([]Iterator, 0, len(s.shards))
+	for i, shard := range s.shards {
+		it, err := shard.NewIterator()
+		if err != nil {
+			for _, opened := range iters {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("failed to open iterator on shard %d: %w", i, err)
+		}
+		iters = append(iters, it)
+	}
+	return newMergeIterator(iters), nil
+}
+
+// Scan returns an iterator over the live entries in [start, end) across all shards
+func (s *ShardedStore) Scan(start, end string) (Iterator, error) {
+	return s.ScanCtx(context.Background(), start, end)
+}
+
+// ScanCtx is like Scan, giving up with the context's error if it's done before
+// every shard is read
+func (s *ShardedStore) ScanCtx(ctx context.Context, start, end string) (Iterator, error) {
+	iters := make([]Iterator, 0, len(s.shards))
+	for i, shard := range s.shards {
+		it, err := shard.ScanCtx(ctx, start, end)
+		if err != nil {
+			for _, opened := range iters {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("failed to scan shard %d: %w", i, err)
+		}
+		iters = append(iters, it)
+	}
+	return newMergeIterator(iters), nil
+}
+
+// Batch splits the batch by shard and applies each part. The batch is atomic
+// within a shard but not across shards.
+func (s *ShardedStore) Batch(batch *WriteBatch) error {
+	return s.BatchCtx(context.Background(), batch)
+}
+
+// BatchCtx is like Batch, giving up with the context's error if it's done before
+// a shard's part is applied. The parts applied before stay applied.
+func (s *ShardedStore) BatchCtx(ctx context.Context, batch *WriteBatch) error {
+	parts := make(map[*LSMTree]*WriteBatch)
+	for _, op := range batch.Ops() {
+		shard := s.shardFor(op.Key)
+		part, ok := parts[shard]
+		if !ok {
+			part = NewWriteBatch()
+			parts[shard] = part
+		}
+		part.ops = append(part.ops, op)
+	}
+
+	for i, shard := range s.shards {
+		if part, ok := parts[shard]; ok {
+			if err := shard.BatchCtx(ctx, part); err != nil {
+				return fmt.Errorf("failed to apply batch to shard %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes every shard
+func (s *ShardedStore) Close() error {
+	var firstErr error
+	for i, shard := range s.shards {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close shard %d: %w", i, err)
+		}
+	}
+	return firstErr
+}
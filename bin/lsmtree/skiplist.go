@@ -0,0 +1,175 @@
+package lsmtree
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// maxSkipListHeight bounds the number of levels in a skiplist
+const maxSkipListHeight = 12
+
+// skipListBranching is the inverse probability of a node being promoted to the next level
+const skipListBranching = 4
+
+// skipListNode is a single key in the skiplist with one forward pointer per level
+type skipListNode struct {
+	key   string
+	value atomic.Pointer[string]
+	next  []atomic.Pointer[skipListNode]
+}
+
+// skipList is a sorted map that allows one writer and any number of lock-free
+// concurrent readers. Writers must be serialized by the caller.
+type skipList struct {
+	head   *skipListNode
+	height int32
+	length int64
+	bytes  int64      // approximate memory footprint of keys, values and nodes
+	rnd    *rand.Rand // only used by the writer
+}
+
+// newSkipList creates an empty skiplist
+func newSkipList() *skipList {
+	return &skipList{
+		head:   &skipListNode{next: make([]atomic.Pointer[skipListNode], maxSkipListHeight)},
+		height: 1,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// randomHeight picks the height for a new node
+func (s *skipList) randomHeight() int {
+	height := 1
+	for height < maxSkipListHeight && s.rnd.Intn(skipListBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+// findGreaterOrEqual returns the first node with a key >= key, filling prev
+// with the rightmost node before it on every level when prev is not nil
+func (s *skipList) findGreaterOrEqual(key string, prev []*skipListNode) *skipListNode {
+	x := s.head
+	level := int(atomic.LoadInt32(&s.height)) - 1
+	for {
+		next := x.next[level].Load()
+		if next != nil && next.key < key {
+			x = next
+			continue
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+		level--
+	}
+}
+
+// Set inserts or updates a key
+func (s *skipList) Set(key, value string) {
+	prev := make([]*skipListNode, maxSkipListHeight)
+	if node := s.findGreaterOrEqual(key, prev); node != nil && node.key == key {
+		old := node.value.Swap(&value)
+		atomic.AddInt64(&s.bytes, int64(len(value)-len(*old)))
+		return
+	}
+
+	height := s.randomHeight()
+	if current := int(atomic.LoadInt32(&s.height)); height > current {
+		for i := current; i < height; i++ {
+			prev[i] = s.head
+		}
+		atomic.StoreInt32(&s.height, int32(height))
+	}
+
+	// Link the node bottom-up so readers never see a partially linked level
+	node := &skipListNode{key: key, next: make([]atomic.Pointer[skipListNode], height)}
+	node.value.Store(&value)
+	for i := 0; i < height; i++ {
+		node.next[i].Store(prev[i].next[i].Load())
+		prev[i].next[i].Store(node)
+	}
+	atomic.AddInt64(&s.length, 1)
+	atomic.AddInt64(&s.bytes, nodeSize(key, value, height))
+}
+
+// Get returns the value stored for key
+func (s *skipList) Get(key string) (string, bool) {
+	node := s.findGreaterOrEqual(key, nil)
+	if node == nil || node.key != key {
+		return "", false
+	}
+	return *node.value.Load(), true
+}
+
+// Delete unlinks a key from the skiplist
+func (s *skipList) Delete(key string) {
+	prev := make([]*skipListNode, maxSkipListHeight)
+	node := s.findGreaterOrEqual(key, prev)
+	if node == nil || node.key != key {
+		return
+	}
+
+	// Unlink top-down so the node disappears from the fast levels first
+	for i := len(node.next) - 1; i >= 0; i-- {
+		prev[i].next[i].Store(node.next[i].Load())
+	}
+	atomic.AddInt64(&s.length, -1)
+	atomic.AddInt64(&s.bytes, -nodeSize(key, *node.value.Load(), len(node.next)))
+}
+
+// Len returns the number of keys in the skiplist
+func (s *skipList) Len() int {
+	return int(atomic.LoadInt64(&s.length))
+}
+
+// Bytes returns the approximate memory footprint of the skiplist
+func (s *skipList) Bytes() int {
+	return int(atomic.LoadInt64(&s.bytes))
+}
+
+// nodeSize estimates the memory used by a node: key and value bytes, the two
+// string headers, the value pointer and one forward pointer per level
+func nodeSize(key, value string, height int) int64 {
+	return int64(len(key) + len(value) + 2*16 + 8 + height*8)
+}
+
+// skipListIterator walks a skiplist in key order
+type skipListIterator struct {
+	list *skipList
+	node *skipListNode
+}
+
+// newIterator returns an iterator positioned before the first key
+func (s *skipList) newIterator() *skipListIterator {
+	return &skipListIterator{list: s, node: s.head}
+}
+
+// Seek positions the iterator just before the first key >= key
+func (it *skipListIterator) Seek(key string) {
+	prev := make([]*skipListNode, maxSkipListHeight)
+	it.list.findGreaterOrEqual(key, prev)
+	it.node = prev[0]
+}
+
+// Next advances to the next key and reports whether one exists
+func (it *skipListIterator) Next() bool {
+	if it.node == nil {
+		return false
+	}
+	it.node = it.node.next[0].Load()
+	return it.node != nil
+}
+
+// Key returns the current key
+func (it *skipListIterator) Key() string {
+	return it.node.key
+}
+
+// Value returns the current value
+func (it *skipListIterator) Value() string {
+	return *it.node.value.Load()
+}
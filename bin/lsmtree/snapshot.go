@@ -0,0 +1,170 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotsDirName is the subdirectory of the data directory holding automatic snapshots
+const snapshotsDirName = "snapshots"
+
+// snapshotTimeFormat names snapshot directories after the UTC time they were taken
+const snapshotTimeFormat = "20060102T150405.000Z"
+
+// maxSnapshotCheckInterval bounds how long a due snapshot may wait to be taken
+const maxSnapshotCheckInterval = time.Minute
+
+// SnapshotSchedule takes a checkpoint every Every and keeps the newest Keep of them
+type SnapshotSchedule struct {
+	Name  string
+	Every time.Duration
+	Keep  int
+}
+
+// SnapshotInfo describes a snapshot taken by a schedule
+type SnapshotInfo struct {
+	Name     string    `json:"name"` // directory name, e.g. "hourly-20261014T140000.000Z"
+	Schedule string    `json:"schedule"`
+	Taken    time.Time `json:"taken"`
+	Dir      string    `json:"dir"`
+}
+
+// namedSnapshotIntervals are the schedule names that imply their interval
+var namedSnapshotIntervals = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// ParseSnapshotSchedules parses schedules as accepted on the command line: a comma
+// separated list of name=keep, where the name is hourly, daily, weekly or a
+// duration such as 15m, e.g. "hourly=24,daily=7"
+func ParseSnapshotSchedules(spec string) ([]SnapshotSchedule, error) {
+	var schedules []SnapshotSchedule
+	if spec == "" {
+		return schedules, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		name, keepText, ok := strings.Cut(strings.TrimSpace(part), "=")
+		keep, err := strconv.Atoi(keepText)
+		if !ok || err != nil || keep <= 0 {
+			return nil, fmt.Errorf("invalid snapshot schedule %q: want <interval>=<count to keep>", part)
+		}
+		every, named := namedSnapshotIntervals[name]
+		if !named {
+			if every, err = time.ParseDuration(name); err != nil || every <= 0 {
+				return nil, fmt.Errorf("invalid snapshot interval %q: want hourly, daily, weekly or a duration", name)
+			}
+		}
+		schedules = append(schedules, SnapshotSchedule{Name: name, Every: every, Keep: keep})
+	}
+	return schedules, nil
+}
+
+// ListSnapshots returns the snapshots in the data directory, oldest first. The
+// tree doesn't need to be open.
+func ListSnapshots(dataDir string) ([]SnapshotInfo, error) {
+	return listSnapshots(OSFS{}, dataDir)
+}
+
+// listSnapshots returns the snapshots in a data directory of fsys, oldest first
+func listSnapshots(fsys FS, dataDir string) ([]SnapshotInfo, error) {
+	dir := filepath.Join(dataDir, snapshotsDirName)
+	entries, err := fsys.List(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshots: %w", err)
+	}
+
+	var snapshots []SnapshotInfo
+	for _, entry := range entries {
+		i := strings.LastIndex(entry.Name(), "-")
+		if !entry.IsDir() || i < 0 {
+			continue
+		}
+		taken, err := time.Parse(snapshotTimeFormat, entry.Name()[i+1:])
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, SnapshotInfo{
+			Name:     entry.Name(),
+			Schedule: entry.Name()[:i],
+			Taken:    taken,
+			Dir:      filepath.Join(dir, entry.Name()),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Taken.Before(snapshots[j].Taken) })
+	return snapshots, nil
+}
+
+// snapshotEvery takes the snapshots of Options.Snapshots as they fall due until
+// stop is closed. Snapshots missed while the tree was closed are taken right away.
+func (l *LSMTree) snapshotEvery(stop <-chan struct{}) {
+	interval := maxSnapshotCheckInterval
+	for _, schedule := range l.options.Snapshots {
+		if schedule.Every < interval {
+			interval = schedule.Every
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Due snapshots are taken on the first check after a pause ends
+		if !l.Paused() {
+			if err := l.takeDueSnapshots(time.Now()); err != nil && !errors.Is(err, ErrClosed) {
+				l.options.Logger.Error("failed to take snapshot", "err", err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// takeDueSnapshots takes a snapshot for every schedule whose newest one is at
+// least its interval old, then prunes the schedule down to its Keep newest
+func (l *LSMTree) takeDueSnapshots(now time.Time) error {
+	snapshots, err := listSnapshots(l.fs, l.dataDir)
+	if err != nil {
+		return err
+	}
+
+	for _, schedule := range l.options.Snapshots {
+		var taken []SnapshotInfo
+		for _, snapshot := range snapshots {
+			if snapshot.Schedule == schedule.Name {
+				taken = append(taken, snapshot)
+			}
+		}
+		if len(taken) > 0 && now.Sub(taken[len(taken)-1].Taken) < schedule.Every {
+			continue
+		}
+
+		name := schedule.Name + "-" + now.UTC().Format(snapshotTimeFormat)
+		dir := filepath.Join(l.dataDir, snapshotsDirName, name)
+		if err := l.Checkpoint(dir); err != nil {
+			l.fs.RemoveAll(dir)
+			return fmt.Errorf("failed to take %s snapshot: %w", schedule.Name, err)
+		}
+		taken = append(taken, SnapshotInfo{Name: name, Schedule: schedule.Name, Dir: dir})
+
+		for len(taken) > schedule.Keep {
+			if err := l.fs.RemoveAll(taken[0].Dir); err != nil {
+				return fmt.Errorf("failed to prune snapshot %s: %w", taken[0].Name, err)
+			}
+			taken = taken[1:]
+		}
+	}
+	return nil
+}
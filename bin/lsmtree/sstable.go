@@ -2,98 +2,708 @@ package lsmtree
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
-	"os"
+	"io"
 	"path/filepath"
-	"strings"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// SSTable file layout:
+//
+//	[data block 0] ... [data block N] [filter block] [index block] [properties block] [footer]
+//
+// Data blocks hold sorted entries and are cut once they reach Options.BlockSize.
+// Each data block starts with a one-byte compression header (format version 3+),
+// and every block ends with a CRC32C checksum of its contents (format version 4+).
+// The filter block holds the serialized bloom filter, the index block holds the
+// first key and location of every data block, and the fixed-size footer locates
+// the filter, index and properties blocks. The properties block (format version 5+)
+// records the key range, entry and tombstone counts and creation time. In an
+// encrypted data directory (format version 10+) the contents of every block are
+// sealed with the data key, bound to the block's offset, before the checksum.
+// Bloom filters are sized from the entry count and Options.BloomBitsPerKey, and
+// from format version 11 the footer records their size and hash count. Tables
+// written before keep their shorter footer, told apart by its magic. With
+// Options.PrefixExtractor (format version 12+) the filter block goes on with
+// the extractor's name and a bloom filter of the prefixes of the keys. From format
+// version 14 every filter is prefixed with the name of the KeyHasher of its keys.
+
+// sstableMagic identifies the footer of an SSTable file ("LOCKRSST")
+const sstableMagic = 0x4c4f434b52535354
+
+// sstableBloomMagic identifies the footer of an SSTable file recording its bloom
+// filter parameters ("LOCKRSSF")
+const sstableBloomMagic = 0x4c4f434b52535346
+
+// footerSize is the encoded size of the SSTable footer: filter, index and properties
+// offsets and lengths, bloom filter size and hash count, and magic
+const footerSize = 72
+
+// propertiesFooterSize is the footer size of format versions before bloom filter parameters
+const propertiesFooterSize = 56
+
+// legacyFooterSize is the footer size of format versions before properties blocks
+const legacyFooterSize = 40
+
 // SSTable represents a Sorted String Table, an immutable on-disk data structure
 type SSTable struct {
-	filePath    string
-	bloomFilter *BloomFilter
-	index       map[string]int64
+	id            uint64 // unique id keying the SSTable's blocks in the block cache
+	fs            FS     // file system holding the file
+	filePath      string
+	formatVersion int // on-disk format version the file was written with
+	size          int64
+	filter        blockHandle
+	indexBlock    blockHandle
+	propsBlock    blockHandle // zero for format versions without a properties block
+	bloomBits     uint        // bloom filter size recorded in the footer, zero for older footers
+	bloomHashes   uint        // bloom filter hash count recorded in the footer
+	loadOnce      sync.Once   // loads the bloom filter and index on first use
+	loadErr       error
+	loaded        int32         // set to 1 once bloomFilter and index are available
+	bloomFilter   keyFilter     // of the kind picked by Options.FilterPolicy
+	prefixFilter  *prefixFilter // nil unless built with a PrefixExtractor
+	index         []blockHandle // sparse index with the first key of every data block
+	refs          int32         // number of views referencing this SSTable
+	obsolete      int32         // set to 1 once the SSTable has been compacted away
+	bloomStats    bloomCounters
+	files         *tableCache // shared file handles, or nil to open the file on every read
+	blocks        *blockCache // shared block cache, or nil to always read blocks from the file
+	enc           *encryptor  // decrypts the blocks of an encrypted SSTable, nil for plaintext ones
+	logger        Logger      // receives the errors of removing the file, set by attach
+	hasher        KeyHasher   // Options.KeyHasher for decoding filters, set by attach
+	// properties are read when the SSTable is opened, or derived from the data
+	// blocks on load for format versions without a properties block
+	properties SSTableProperties
+	// allowedSeeks is the number of useless probes left before the SSTable is
+	// compacted to reduce read amplification
+	allowedSeeks int64
 }
 
-// NewSSTable creates a new SSTable from the given MemTable
+// seekCompactionBytes is the amount of SSTable data whose compaction costs about as much as one useless probe
+const seekCompactionBytes = 16 * 1024
+
+// minAllowedSeeks is the minimum number of useless probes an SSTable tolerates
+const minAllowedSeeks = 100
+
+// allowedSeeksFor returns the useless probe budget for an SSTable of the given size,
+// following LevelDB's heuristic of one seek per 16KB of data
+func allowedSeeksFor(fileSize int64) int64 {
+	seeks := fileSize / seekCompactionBytes
+	if seeks < minAllowedSeeks {
+		seeks = minAllowedSeeks
+	}
+	return seeks
+}
+
+// NewSSTable creates a new SSTable from the given MemTable using the default options
 func NewSSTable(dataDir string, memTable *MemTable) (*SSTable, error) {
+	return newSSTable(dataDir, memTable, DefaultOptions(), nil)
+}
+
+// newSSTable creates a new SSTable from the given MemTable, encrypted unless enc is nil
+func newSSTable(dataDir string, memTable *MemTable, options Options, enc *encryptor) (*SSTable, error) {
 	// Generate a unique filename based on the current timestamp
 	timestamp := time.Now().UnixNano()
 	filePath := filepath.Join(dataDir, fmt.Sprintf("sstable_%d.dat", timestamp))
 
 	// Create the SSTable file
-	file, err := os.Create(filePath)
+	file, err := options.FS.Create(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SSTable file: %w", err)
 	}
 	defer file.Close()
 
 	writer := bufio.NewWriter(file)
-	bloomFilter := NewBloomFilter()
-	index := make(map[string]int64)
-
-	// Write entries to the SSTable file and update the index and bloom filter
-	var offset int64
-	for key, value := range memTable.Entries() {
-		entry := fmt.Sprintf("%s,%s\n", key, value)
-		_, err := writer.WriteString(entry)
-		if err != nil {
-			return nil, fmt.Errorf("failed to write entry to SSTable: %w", err)
+	ssTable := &SSTable{
+		id:            atomic.AddUint64(&nextTableID, 1),
+		fs:            options.FS,
+		filePath:      filePath,
+		formatVersion: CurrentFormatVersion,
+		enc:           enc,
+	}
+	seal := func(data []byte, offset uint64) []byte {
+		return appendChecksum(enc.seal(data, blockAD(filepath.Base(filePath), offset)))
+	}
+
+	// Write entries to data blocks in key order and update the index and bloom filter
+	var offset uint64
+	var block blockBuilder
+	flushBlock := func() error {
+		if block.entries == 0 {
+			return nil
 		}
+		data := seal(compressBlock(block.finish(), options.Compression), offset)
+		if _, err := writer.Write(data); err != nil {
+			return fmt.Errorf("failed to write block to SSTable: %w", err)
+		}
+		ssTable.index = append(ssTable.index, blockHandle{
+			firstKey: block.firstKey,
+			offset:   offset,
+			length:   uint64(len(data)),
+		})
+		offset += uint64(len(data))
+		block.reset()
+		return nil
+	}
+
+	var writeErr error
+	keys := make([]string, 0, memTable.Len()) // for the filters, built once every key is known
+	props := &ssTable.properties
+	memTable.Ascend("", func(key, value string) bool {
+		block.add(key, value)
+		keys = append(keys, key)
+		if props.Entries == 0 {
+			props.SmallestKey = key
+		}
+		props.LargestKey = key
+		props.Entries++
+		if value == "" {
+			props.Tombstones++
+		}
+
+		if block.size() >= options.BlockSize {
+			if writeErr = flushBlock(); writeErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if writeErr == nil {
+		writeErr = flushBlock()
+	}
+	if writeErr != nil {
+		return nil, writeErr
+	}
+
+	// Write the filter, index and properties blocks followed by the footer
+	ssTable.bloomFilter = newFilter(options.FilterPolicy, keys, options.BloomBitsPerKey, options.KeyHasher)
+	if options.PrefixExtractor != nil {
+		ssTable.prefixFilter = newPrefixFilter(options.PrefixExtractor, keys, options.FilterPolicy, options.BloomBitsPerKey, options.KeyHasher)
+	}
+	filterData := seal(encodeFilterBlock(ssTable.bloomFilter, ssTable.prefixFilter), offset)
+	if _, err := writer.Write(filterData); err != nil {
+		return nil, fmt.Errorf("failed to write filter to SSTable: %w", err)
+	}
+	ssTable.filter = blockHandle{offset: offset, length: uint64(len(filterData))}
+	offset += uint64(len(filterData))
 
-		bloomFilter.Add(key)
-		index[key] = offset
-		offset += int64(len(entry))
+	indexData := seal(encodeIndex(ssTable.index), offset)
+	if _, err := writer.Write(indexData); err != nil {
+		return nil, fmt.Errorf("failed to write index to SSTable: %w", err)
+	}
+	ssTable.indexBlock = blockHandle{offset: offset, length: uint64(len(indexData))}
+	offset += uint64(len(indexData))
+
+	props.CreatedAt = time.Unix(0, timestamp)
+	propsData := seal(encodeProperties(*props), offset)
+	if _, err := writer.Write(propsData); err != nil {
+		return nil, fmt.Errorf("failed to write properties to SSTable: %w", err)
+	}
+	ssTable.propsBlock = blockHandle{offset: offset, length: uint64(len(propsData))}
+	offset += uint64(len(propsData))
+
+	ssTable.bloomBits, ssTable.bloomHashes = ssTable.bloomFilter.Bits(), ssTable.bloomFilter.probes()
+	if _, err := writer.Write(encodeFooter(ssTable.footer())); err != nil {
+		return nil, fmt.Errorf("failed to write footer to SSTable: %w", err)
 	}
 
 	if err := writer.Flush(); err != nil {
 		return nil, fmt.Errorf("failed to flush SSTable: %w", err)
 	}
+	// The manifest only lists the SSTable once it's on stable storage
+	if err := file.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync SSTable: %w", err)
+	}
+
+	ssTable.size = int64(offset) + footerSize
+	ssTable.allowedSeeks = allowedSeeksFor(ssTable.size)
+	ssTable.loadOnce.Do(func() {})
+	ssTable.loaded = 1
+
+	return ssTable, nil
+}
+
+// OpenSSTable opens an existing SSTable file. Only the footer is read up front;
+// the bloom filter and index are loaded on first use.
+func OpenSSTable(filePath string) (*SSTable, error) {
+	return openSSTable(OSFS{}, filePath, CurrentFormatVersion, nil)
+}
+
+// openSSTable opens an SSTable file of fsys written with the given format version,
+// decrypting its blocks with enc unless it's nil
+func openSSTable(fsys FS, filePath string, formatVersion int, enc *encryptor) (*SSTable, error) {
+	file, err := fsys.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSTable file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat SSTable file: %w", err)
+	}
+	size := int64(footerSize)
+	switch {
+	case formatVersion < formatVersionProperties:
+		size = legacyFooterSize
+	case formatVersion < formatVersionBloomFooter:
+		size = propertiesFooterSize
+	case info.Size() < size:
+		// Too small for a footer with bloom filter parameters, so written before them
+		size = propertiesFooterSize
+	}
+	if info.Size() < size {
+		return nil, fmt.Errorf("SSTable file %s is too small", filePath)
+	}
+
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, info.Size()-size); err != nil {
+		return nil, fmt.Errorf("failed to read SSTable footer: %w", err)
+	}
+	if size == footerSize && binary.LittleEndian.Uint64(data[size-8:]) == sstableMagic {
+		// Written before bloom filter parameters, with the shorter footer
+		size = propertiesFooterSize
+		data = data[footerSize-propertiesFooterSize:]
+	}
+	footer, err := decodeFooter(data)
+	if err != nil {
+		return nil, &ErrCorruption{File: filePath, Offset: info.Size() - size, Reason: err.Error()}
+	}
+
+	ssTable := &SSTable{
+		id:            atomic.AddUint64(&nextTableID, 1),
+		fs:            fsys,
+		filePath:      filePath,
+		formatVersion: formatVersion,
+		size:          info.Size(),
+		filter:        footer.filter,
+		indexBlock:    footer.index,
+		propsBlock:    footer.props,
+		bloomBits:     footer.bloomBits,
+		bloomHashes:   footer.bloomHashes,
+		allowedSeeks:  allowedSeeksFor(info.Size()),
+		enc:           enc,
+	}
+	if formatVersion >= formatVersionProperties {
+		// The properties are small and let lookups and compactions skip the
+		// SSTable by key range without loading the filter and index
+		data, err := ssTable.readRawBlock(file, footer.props)
+		if err != nil {
+			return nil, err
+		}
+		if ssTable.properties, err = decodeProperties(data); err != nil {
+			return nil, ssTable.corruption(footer.props, "invalid properties: "+err.Error())
+		}
+	}
+	return ssTable, nil
+}
+
+// footer locates the filter, index and properties blocks of an SSTable and
+// records the parameters of its bloom filter
+type footer struct {
+	filter      blockHandle
+	index       blockHandle
+	props       blockHandle // zero in legacy footers
+	bloomBits   uint        // zero in footers written before bloom filter parameters
+	bloomHashes uint
+}
+
+// footer returns the footer of the SSTable
+func (s *SSTable) footer() footer {
+	return footer{filter: s.filter, index: s.indexBlock, props: s.propsBlock, bloomBits: s.bloomBits, bloomHashes: s.bloomHashes}
+}
+
+// encodeFooter serializes the SSTable footer
+func encodeFooter(f footer) []byte {
+	data := make([]byte, footerSize)
+	binary.LittleEndian.PutUint64(data[0:8], f.filter.offset)
+	binary.LittleEndian.PutUint64(data[8:16], f.filter.length)
+	binary.LittleEndian.PutUint64(data[16:24], f.index.offset)
+	binary.LittleEndian.PutUint64(data[24:32], f.index.length)
+	binary.LittleEndian.PutUint64(data[32:40], f.props.offset)
+	binary.LittleEndian.PutUint64(data[40:48], f.props.length)
+	binary.LittleEndian.PutUint64(data[48:56], uint64(f.bloomBits))
+	binary.LittleEndian.PutUint64(data[56:64], uint64(f.bloomHashes))
+	binary.LittleEndian.PutUint64(data[64:72], sstableBloomMagic)
+	return data
+}
+
+// decodeFooter parses an SSTable footer of any format version, told apart by
+// its length and magic. Legacy footers have no properties handle, and neither
+// they nor properties footers have bloom filter parameters.
+func decodeFooter(data []byte) (footer, error) {
+	var f footer
+	magic := binary.LittleEndian.Uint64(data[len(data)-8:])
+	if (len(data) == footerSize && magic != sstableBloomMagic) || (len(data) != footerSize && magic != sstableMagic) {
+		return f, fmt.Errorf("bad magic number")
+	}
+	f.filter = blockHandle{
+		offset: binary.LittleEndian.Uint64(data[0:8]),
+		length: binary.LittleEndian.Uint64(data[8:16]),
+	}
+	f.index = blockHandle{
+		offset: binary.LittleEndian.Uint64(data[16:24]),
+		length: binary.LittleEndian.Uint64(data[24:32]),
+	}
+	if len(data) >= propertiesFooterSize {
+		f.props = blockHandle{
+			offset: binary.LittleEndian.Uint64(data[32:40]),
+			length: binary.LittleEndian.Uint64(data[40:48]),
+		}
+	}
+	if len(data) == footerSize {
+		f.bloomBits = uint(binary.LittleEndian.Uint64(data[48:56]))
+		f.bloomHashes = uint(binary.LittleEndian.Uint64(data[56:64]))
+	}
+	return f, nil
+}
+
+// encodeFilterBlock serializes the bloom filter of the keys, followed by
+// uvarint(len(extractor)) extractor and the bloom filter of the prefixes if the
+// SSTable has a prefix filter
+func encodeFilterBlock(filter keyFilter, prefixes *prefixFilter) []byte {
+	data := filter.encode()
+	if prefixes != nil {
+		data = binary.AppendUvarint(data, uint64(len(prefixes.extractor)))
+		data = append(data, prefixes.extractor...)
+		data = append(data, prefixes.filter.encode()...)
+	}
+	return data
+}
+
+// decodeFilterBlock parses a filter block serialized by encodeFilterBlock
+func decodeFilterBlock(data []byte, hasher KeyHasher) (keyFilter, *prefixFilter, error) {
+	filter, rest, err := decodeFilter(data, hasher)
+	if err != nil || len(rest) == 0 {
+		return filter, nil, err
+	}
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || uint64(len(rest)-size) < n {
+		return nil, nil, fmt.Errorf("invalid prefix extractor name")
+	}
+	prefixes := &prefixFilter{extractor: string(rest[size : size+int(n)])}
+	if prefixes.filter, rest, err = decodeFilter(rest[size+int(n):], hasher); err != nil {
+		return nil, nil, fmt.Errorf("invalid prefix filter: %w", err)
+	}
+	if len(rest) > 0 {
+		return nil, nil, fmt.Errorf("%d unexpected bytes after the prefix filter", len(rest))
+	}
+	return filter, prefixes, nil
+}
+
+// load reads the bloom filter and index from the file if they aren't in memory yet
+func (s *SSTable) load() error {
+	s.loadOnce.Do(func() {
+		s.loadErr = s.readMetadata()
+		if s.loadErr == nil {
+			atomic.StoreInt32(&s.loaded, 1)
+		}
+	})
+	return s.loadErr
+}
+
+// isLoaded reports whether the bloom filter and index are in memory
+func (s *SSTable) isLoaded() bool {
+	return atomic.LoadInt32(&s.loaded) == 1
+}
+
+// readMetadata reads and decodes the filter and index blocks
+func (s *SSTable) readMetadata() error {
+	file, release, err := s.openFile()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	filterData, err := s.readRawBlock(file, s.filter)
+	if err != nil {
+		return err
+	}
+	bloomFilter, prefixFilter, err := decodeFilterBlock(filterData, s.hasher)
+	if err != nil {
+		return s.corruption(s.filter, "invalid bloom filter: "+err.Error())
+	}
+	if bf, ok := bloomFilter.(*BloomFilter); ok && s.bloomBits == 0 {
+		// Older footers mean an older filter, which was built with unmixed hashes
+		bf.legacy = true
+	} else if bloomFilter.Bits() != s.bloomBits || bloomFilter.probes() != s.bloomHashes {
+		return s.corruption(s.filter, fmt.Sprintf("bloom filter has %d bits and %d probes, footer records %d and %d",
+			bloomFilter.Bits(), bloomFilter.probes(), s.bloomBits, s.bloomHashes))
+	}
+
+	indexData, err := s.readRawBlock(file, s.indexBlock)
+	if err != nil {
+		return err
+	}
+	index, err := decodeIndex(indexData)
+	if err != nil {
+		return s.corruption(s.indexBlock, "invalid index: "+err.Error())
+	}
 
-	return &SSTable{
-		filePath:    filePath,
-		bloomFilter: bloomFilter,
-		index:       index,
-	}, nil
+	s.bloomFilter = bloomFilter
+	s.prefixFilter = prefixFilter
+	s.index = index
+	if s.formatVersion < formatVersionProperties && len(index) > 0 {
+		// Older formats don't store the key range, so read the largest key from the last block
+		s.properties.SmallestKey = index[0].firstKey
+		last, err := s.readDataBlock(file, index[len(index)-1])
+		if err != nil {
+			return err
+		}
+		it := s.blockIterator(last)
+		for it.Next() {
+			s.properties.LargestKey = it.Key()
+		}
+	}
+	return nil
 }
 
 // Get retrieves the value for a given key from the SSTable
 func (s *SSTable) Get(key string) (string, error) {
+	value, _, err := s.lookup(key)
+	return value, err
+}
+
+// lookup retrieves the value for a given key and reports whether the SSTable holds
+// an entry for it, so tombstones can be told apart from missing keys
+func (s *SSTable) lookup(key string) (string, bool, error) {
+	// Skip the SSTable without loading it if the key is outside its key range
+	if s.formatVersion >= formatVersionProperties && !s.properties.mayContain(key) {
+		return "", false, nil
+	}
+
+	if err := s.load(); err != nil {
+		return "", false, err
+	}
+
 	// Check if the key might be in the SSTable using the bloom filter
+	atomic.AddUint64(&s.bloomStats.checks, 1)
 	if !s.bloomFilter.MightContain(key) {
-		return "", nil
+		atomic.AddUint64(&s.bloomStats.negatives, 1)
+		return "", false, nil
+	}
+
+	value, ok, err := s.searchBlock(key)
+	if err != nil {
+		return "", false, err
 	}
 
-	// Check if the key is in the index
-	offset, ok := s.index[key]
+	// Count a miss as a bloom filter false positive and a useless probe towards seek compaction
 	if !ok {
-		return "", nil
+		atomic.AddUint64(&s.bloomStats.falsePositives, 1)
+		atomic.AddInt64(&s.allowedSeeks, -1)
+	}
+	return value, ok, nil
+}
+
+// searchBlock reads the only data block that can contain key and searches it
+func (s *SSTable) searchBlock(key string) (string, bool, error) {
+	// Find the last block whose first key is <= key
+	i := sort.Search(len(s.index), func(i int) bool {
+		return s.index[i].firstKey > key
+	}) - 1
+	if i < 0 {
+		return "", false, nil
+	}
+
+	data, ok := s.cachedBlock(s.index[i])
+	if !ok {
+		// Open the SSTable file
+		file, release, err := s.openFile()
+		if err != nil {
+			return "", false, err
+		}
+		defer release()
+
+		if data, err = s.readDataBlock(file, s.index[i]); err != nil {
+			return "", false, err
+		}
+		s.cacheBlock(file, s.index[i], data)
+	}
+
+	it := s.blockIterator(data)
+	if it.Seek(key) && it.Key() == key {
+		return it.Value(), true, nil
+	}
+	if err := it.Err(); err != nil {
+		return "", false, s.corruption(s.index[i], err.Error())
 	}
 
-	// Open the SSTable file
-	file, err := os.Open(s.filePath)
+	return "", false, nil
+}
+
+// openFile returns a handle to the SSTable file and a function releasing it,
+// going through the table cache when one is attached
+func (s *SSTable) openFile() (tableReader, func(), error) {
+	if s.files == nil {
+		file, err := s.fs.Open(s.filePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open SSTable file: %w", err)
+		}
+		return file, func() { file.Close() }, nil
+	}
+
+	h, err := s.files.acquire(s.filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open SSTable file: %w", err)
+		return nil, nil, err
+	}
+	return h.file, func() { s.files.release(h) }, nil
+}
+
+// readBlock reads the raw contents of a block. Memory-mapped files return the
+// block without copying, so callers must be done with it before releasing the file.
+func readBlock(file io.ReaderAt, handle blockHandle) ([]byte, error) {
+	if m, ok := file.(*mmapReader); ok {
+		data, err := m.slice(handle.offset, handle.length)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read block at offset %d: %w", handle.offset, err)
+		}
+		return data, nil
+	}
+
+	data := make([]byte, handle.length)
+	if _, err := file.ReadAt(data, int64(handle.offset)); err != nil {
+		return nil, fmt.Errorf("failed to read block at offset %d: %w", handle.offset, err)
+	}
+	return data, nil
+}
+
+// readRawBlock reads a block, verifying its checksum if the format has checksums
+// and decrypting it if the SSTable is encrypted
+func (s *SSTable) readRawBlock(file io.ReaderAt, handle blockHandle) ([]byte, error) {
+	data, err := readBlock(file, handle)
+	if err != nil {
+		return nil, err
+	}
+	if s.formatVersion < formatVersionChecksums {
+		return data, nil
+	}
+	if data, err = verifyChecksum(data, s.filePath, int64(handle.offset)); err != nil {
+		return nil, err
+	}
+	if data, err = s.enc.open(data, blockAD(filepath.Base(s.filePath), handle.offset)); err != nil {
+		return nil, s.corruption(handle, "failed to decrypt block")
+	}
+	return data, nil
+}
+
+// readDataBlock reads a data block and decompresses it if the format has compression headers
+func (s *SSTable) readDataBlock(file io.ReaderAt, handle blockHandle) ([]byte, error) {
+	data, err := s.readRawBlock(file, handle)
+	if err != nil {
+		return nil, err
+	}
+	if s.formatVersion < formatVersionCompressedBlocks {
+		return data, nil
 	}
-	defer file.Close()
 
-	// Seek to the correct position in the file
-	_, err = file.Seek(offset, 0)
+	data, err = decompressBlock(data)
 	if err != nil {
-		return "", fmt.Errorf("failed to seek in SSTable file: %w", err)
+		return nil, s.corruption(handle, "failed to decompress block: "+err.Error())
+	}
+	return data, nil
+}
+
+// cachedBlock returns a data block from the block cache
+func (s *SSTable) cachedBlock(handle blockHandle) ([]byte, bool) {
+	if s.blocks == nil {
+		return nil, false
+	}
+	return s.blocks.get(blockCacheKey{table: s.id, offset: handle.offset})
+}
+
+// cacheBlock adds a data block read from file to the block cache. Blocks read
+// from a mapping are copied, since the mapping goes away with the file handle.
+func (s *SSTable) cacheBlock(file io.ReaderAt, handle blockHandle, data []byte) {
+	if s.blocks == nil {
+		return
+	}
+	if _, ok := file.(*mmapReader); ok {
+		data = bytes.Clone(data)
+	}
+	s.blocks.add(blockCacheKey{table: s.id, offset: handle.offset}, data)
+}
+
+// fetchBlock returns a data block from the block cache, or reads it and adds it
+// to the cache. A block read from a mapping is copied, as the file handle is
+// released before the block is used.
+func (s *SSTable) fetchBlock(handle blockHandle) ([]byte, error) {
+	if data, ok := s.cachedBlock(handle); ok {
+		return data, nil
+	}
+
+	file, release, err := s.openFile()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	data, err := s.readDataBlock(file, handle)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := file.(*mmapReader); ok {
+		data = bytes.Clone(data)
+	}
+	if s.blocks != nil {
+		s.blocks.add(blockCacheKey{table: s.id, offset: handle.offset}, data)
+	}
+	return data, nil
+}
+
+// corruption returns an ErrCorruption for the given block of the SSTable
+func (s *SSTable) corruption(handle blockHandle, reason string) error {
+	return &ErrCorruption{File: s.filePath, Offset: int64(handle.offset), Reason: reason}
+}
+
+// blockIterator returns an iterator over a data block in the SSTable's format
+func (s *SSTable) blockIterator(data []byte) *blockIterator {
+	if s.formatVersion < formatVersionPrefixKeys {
+		return newBlockIterator(data)
+	}
+	return newPrefixBlockIterator(data)
+}
+
+// verify reads every block of the SSTable, checking checksums and entry encoding
+func (s *SSTable) verify() error {
+	if err := s.load(); err != nil {
+		return err
 	}
 
-	// Read the entry and return the value if found
-	scanner := bufio.NewScanner(file)
-	if scanner.Scan() {
-		parts := strings.SplitN(scanner.Text(), ",", 2)
-		if len(parts) == 2 && parts[0] == key {
-			return parts[1], nil
+	file, release, err := s.openFile()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	previous, first := "", true
+	for _, handle := range s.index {
+		data, err := s.readDataBlock(file, handle)
+		if err != nil {
+			return err
+		}
+		it := s.blockIterator(data)
+		for it.Next() {
+			if !first && it.Key() <= previous {
+				return s.corruption(handle, fmt.Sprintf("key %q out of order", it.Key()))
+			}
+			previous, first = it.Key(), false
+		}
+		if err := it.Err(); err != nil {
+			return s.corruption(handle, err.Error())
 		}
 	}
+	return nil
+}
 
-	return "", nil
+// seekCompactionDue reports whether the SSTable has used up its budget of useless probes
+func (s *SSTable) seekCompactionDue() bool {
+	return atomic.LoadInt64(&s.allowedSeeks) <= 0
 }
 
 // FilePath returns the file path of the SSTable
@@ -101,31 +711,55 @@ func (s *SSTable) FilePath() string {
 	return s.filePath
 }
 
-// Add this method to the SSTable struct
-
 // List returns all non-deleted key-value pairs in the SSTable
 func (s *SSTable) List() (map[string]string, error) {
+	entries, err := s.scan(true)
+	if err != nil {
+		return nil, err
+	}
+
 	result := make(map[string]string)
+	for key, value := range entries {
+		if value != "" {
+			result[key] = value
+		}
+	}
+	return result, nil
+}
 
-	file, err := os.Open(s.filePath)
+// scan returns all entries in the SSTable, including tombstones. Blocks missing
+// from the block cache are only added if fill is set, so compactions don't evict
+// the blocks serving reads.
+func (s *SSTable) scan(fill bool) (map[string]string, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, s.properties.Entries)
+
+	file, release, err := s.openFile()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open SSTable file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
+	defer release()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		parts := strings.SplitN(scanner.Text(), ",", 2)
-		if len(parts) == 2 {
-			key, value := parts[0], parts[1]
-			if value != "" {
-				result[key] = value
+	for _, handle := range s.index {
+		data, ok := s.cachedBlock(handle)
+		if !ok {
+			if data, err = s.readDataBlock(file, handle); err != nil {
+				return nil, err
+			}
+			if fill {
+				s.cacheBlock(file, handle, data)
 			}
 		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to read SSTable: %w", err)
+		it := s.blockIterator(data)
+		for it.Next() {
+			result[it.Key()] = it.Value()
+		}
+		if err := it.Err(); err != nil {
+			return nil, s.corruption(handle, err.Error())
+		}
 	}
 
 	return result, nil
@@ -0,0 +1,196 @@
+package lsmtree
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Stats is a point-in-time snapshot of engine statistics
+type Stats struct {
+	// KeysEstimate is an upper bound of the live keys, records and past versions
+	// included: a key is counted once per MemTable or SSTable holding it, and
+	// deletions still in a MemTable are counted
+	KeysEstimate int             `json:"keys_estimate"`
+	Disk         DiskStats       `json:"disk"`
+	MemTable     MemTableStats   `json:"memtable"`
+	Compaction   CompactionStats `json:"compaction"`
+	Written      WrittenStats    `json:"written"`
+	Bloom        BloomStats      `json:"bloom"`
+	Cache        CacheStats      `json:"cache"`
+	BlockCache   BlockCacheStats `json:"block_cache"`
+	OpenFiles    int             `json:"open_files"` // SSTable handles held by the table cache
+	WAL          WALStats        `json:"wal"`
+	Recovery     RecoveryReport  `json:"recovery"` // what Recover read from the WAL
+	Paused       bool            `json:"paused"`   // background work is held by PauseBackground
+	SSTables     []SSTableStats  `json:"sstables"` // oldest first, each newer one shadowing those before it
+}
+
+// DiskStats is the disk usage in bytes of the data directory
+type DiskStats struct {
+	SSTables int64 `json:"sstables"` // the live SSTables
+	WAL      int64 `json:"wal"`      // the WAL segments not yet flushed
+	Total    int64 `json:"total"`    // every file, snapshots and backups of restores included
+}
+
+// MemTableStats describes the MemTables holding the writes not yet in SSTables
+type MemTableStats struct {
+	Entries   int `json:"entries"`   // entries of every MemTable, deletions included
+	Bytes     int `json:"bytes"`     // approximate memory footprint of the active MemTable
+	MaxBytes  int `json:"max_bytes"` // footprint at which it's flushed
+	Immutable int `json:"immutable"` // full MemTables waiting to be flushed
+}
+
+// CompactionStats describes the compactions still worth doing
+type CompactionStats struct {
+	// Pending counts the adjacent SSTables with overlapping key ranges, each a
+	// merge that drops shadowed entries
+	Pending int `json:"pending"`
+	// SeekScheduled is set when an SSTable served too many useless probes and is
+	// merged by the next compaction
+	SeekScheduled bool `json:"seek_scheduled"`
+}
+
+// WrittenStats counts the bytes the engine wrote since the tree was created, for
+// measuring write amplification
+type WrittenStats struct {
+	WAL         int64 `json:"wal"`
+	Flushes     int64 `json:"flushes"`     // SSTables written from MemTables
+	Compactions int64 `json:"compactions"` // SSTables written by merging others
+}
+
+// Total returns every byte written
+func (w WrittenStats) Total() int64 {
+	return w.WAL + w.Flushes + w.Compactions
+}
+
+// BloomStats counts how effective bloom filters are at skipping SSTable lookups
+type BloomStats struct {
+	Checks         uint64 `json:"checks"`          // lookups that consulted the filter
+	Negatives      uint64 `json:"negatives"`       // lookups the filter rejected, avoiding an index probe
+	FalsePositives uint64 `json:"false_positives"` // lookups the filter passed but the index did not contain
+	// PrefixChecks counts the prefix scans that consulted the prefix filter, and
+	// PrefixNegatives those it rejected, skipping the SSTable
+	PrefixChecks    uint64 `json:"prefix_checks"`
+	PrefixNegatives uint64 `json:"prefix_negatives"`
+}
+
+// FalsePositiveRate returns the measured fraction of absent keys the filter failed to reject
+func (b BloomStats) FalsePositiveRate() float64 {
+	absent := b.Negatives + b.FalsePositives
+	if absent == 0 {
+		return 0
+	}
+	return float64(b.FalsePositives) / float64(absent)
+}
+
+// add accumulates other into b
+func (b *BloomStats) add(other BloomStats) {
+	b.Checks += other.Checks
+	b.Negatives += other.Negatives
+	b.FalsePositives += other.FalsePositives
+	b.PrefixChecks += other.PrefixChecks
+	b.PrefixNegatives += other.PrefixNegatives
+}
+
+// SSTableStats holds statistics for a single SSTable
+type SSTableStats struct {
+	FilePath     string            `json:"file_path"`
+	Size         int64             `json:"size"` // bytes of the file
+	Properties   SSTableProperties `json:"properties"`
+	BloomBits    uint              `json:"bloom_bits"`
+	BloomHashes  uint              `json:"bloom_hashes"`
+	Bloom        BloomStats        `json:"bloom"`
+	AllowedSeeks int64             `json:"allowed_seeks"` // useless probes left before a seek compaction
+}
+
+// Stats returns statistics for the LSMTree and each of its SSTables
+func (l *LSMTree) Stats() Stats {
+	v := l.acquireView()
+	defer v.release()
+
+	stats := Stats{
+		Disk:       l.diskUsage(),
+		MemTable:   MemTableStats{Bytes: v.memTable.Size(), MaxBytes: l.options.MemTableSize, Immutable: len(v.immutable)},
+		Compaction: CompactionStats{SeekScheduled: l.seekCandidate.Load() != nil},
+		Written:    WrittenStats{WAL: l.wal.writtenBytes(), Flushes: l.flushedBytes.Load(), Compactions: l.compactedBytes.Load()},
+		Cache:      l.cache.stats(l.options.CachePolicy),
+		BlockCache: l.blocks.stats(),
+		OpenFiles:  l.tables.openFiles(),
+		WAL:        l.wal.stats(),
+		Recovery:   l.wal.lastRecovery(),
+		Paused:     l.Paused(),
+		SSTables:   make([]SSTableStats, 0, len(v.ssTables)),
+	}
+	for _, memTable := range append([]*MemTable{v.memTable}, v.immutable...) {
+		stats.MemTable.Entries += memTable.Len()
+	}
+	stats.KeysEstimate = stats.MemTable.Entries
+	for i, ssTable := range v.ssTables {
+		tableStats := ssTable.stats()
+		stats.Bloom.add(tableStats.Bloom)
+		stats.Disk.SSTables += tableStats.Size
+		stats.KeysEstimate += tableStats.Properties.Entries - tableStats.Properties.Tombstones
+		stats.SSTables = append(stats.SSTables, tableStats)
+		if i > 0 && v.ssTables[i-1].properties.overlaps(ssTable.properties) {
+			stats.Compaction.Pending++
+		}
+	}
+
+	return stats
+}
+
+// diskUsage returns the size of the WAL segments and of every file of the data
+// directory, none for an in-memory tree. Files removed while it's walked are skipped.
+func (l *LSMTree) diskUsage() DiskStats {
+	var usage DiskStats
+	if l.options.InMemory {
+		return usage
+	}
+	walkFiles(l.fs, l.dataDir, func(path string, info fs.FileInfo) {
+		usage.Total += info.Size()
+		if filepath.Dir(path) == l.dataDir && strings.HasPrefix(info.Name(), "wal-") && strings.HasSuffix(info.Name(), ".log") {
+			usage.WAL += info.Size()
+		}
+	})
+	return usage
+}
+
+// bloomCounters tracks bloom filter outcomes for an SSTable
+type bloomCounters struct {
+	checks          uint64
+	negatives       uint64
+	falsePositives  uint64
+	prefixChecks    uint64
+	prefixNegatives uint64
+}
+
+// snapshot returns the current counter values
+func (c *bloomCounters) snapshot() BloomStats {
+	return BloomStats{
+		Checks:          atomic.LoadUint64(&c.checks),
+		Negatives:       atomic.LoadUint64(&c.negatives),
+		FalsePositives:  atomic.LoadUint64(&c.falsePositives),
+		PrefixChecks:    atomic.LoadUint64(&c.prefixChecks),
+		PrefixNegatives: atomic.LoadUint64(&c.prefixNegatives),
+	}
+}
+
+// stats returns the statistics of the SSTable
+func (s *SSTable) stats() SSTableStats {
+	stats := SSTableStats{
+		FilePath:     s.filePath,
+		Size:         s.size,
+		Properties:   s.properties,
+		Bloom:        s.bloomStats.snapshot(),
+		AllowedSeeks: atomic.LoadInt64(&s.allowedSeeks),
+		BloomBits:    s.bloomBits, // from the footer, so known before the filter is loaded
+		BloomHashes:  s.bloomHashes,
+	}
+	if s.isLoaded() {
+		stats.BloomBits = s.bloomFilter.Bits()
+		stats.BloomHashes = s.bloomFilter.probes()
+	}
+	return stats
+}
@@ -0,0 +1,198 @@
+package lsmtree
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsRecordPrefix names the records of the stats history, each followed by the
+// UTC time its snapshot was taken in snapshotTimeFormat, so they sort by time
+const statsRecordPrefix = "stats/"
+
+// StatsHistory records a snapshot of Stats every Every while the tree is open,
+// keeping the newest Keep of them in its internal records, or all of them if Keep
+// isn't positive
+type StatsHistory struct {
+	Every time.Duration
+	Keep  int
+}
+
+// StatsSnapshot is the Stats of the tree at a point in time, recorded by the stats
+// history. The per-SSTable statistics are left out.
+type StatsSnapshot struct {
+	Time  time.Time `json:"time"`
+	Stats Stats     `json:"stats"`
+}
+
+// ParseStatsHistory parses a history as accepted on the command line: the interval,
+// hourly, daily, weekly or a duration such as 15m, then = and the count of
+// snapshots to keep, e.g. "15m=672"
+func ParseStatsHistory(spec string) (StatsHistory, error) {
+	if spec == "" {
+		return StatsHistory{}, nil
+	}
+	name, keepText, ok := strings.Cut(strings.TrimSpace(spec), "=")
+	keep, err := strconv.Atoi(keepText)
+	if !ok || err != nil || keep <= 0 {
+		return StatsHistory{}, fmt.Errorf("invalid stats history %q: want <interval>=<count to keep>", spec)
+	}
+	every, named := namedSnapshotIntervals[name]
+	if !named {
+		if every, err = time.ParseDuration(name); err != nil || every <= 0 {
+			return StatsHistory{}, fmt.Errorf("invalid stats interval %q: want hourly, daily, weekly or a duration", name)
+		}
+	}
+	return StatsHistory{Every: every, Keep: keep}, nil
+}
+
+// StatsHistory returns the recorded stats snapshots, oldest first
+func (l *LSMTree) StatsHistory() ([]StatsSnapshot, error) {
+	records, err := l.Records(statsRecordPrefix)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snapshots := make([]StatsSnapshot, 0, len(names))
+	for _, name := range names {
+		var snapshot StatsSnapshot
+		if err := json.Unmarshal([]byte(records[name]), &snapshot); err != nil {
+			return nil, fmt.Errorf("failed to decode stats snapshot %s: %w", name, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// ExportStatsHistory writes the recorded stats snapshots to w, one JSON line each
+// oldest first, and returns how many it wrote
+func (l *LSMTree) ExportStatsHistory(w io.Writer) (int, error) {
+	snapshots, err := l.StatsHistory()
+	if err != nil {
+		return 0, err
+	}
+	for i, snapshot := range snapshots {
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return i, fmt.Errorf("failed to encode stats snapshot: %w", err)
+		}
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return i, fmt.Errorf("failed to write stats snapshots: %w", err)
+		}
+	}
+	return len(snapshots), nil
+}
+
+// ImportStatsHistory adds the snapshots of an export read from r to the stats
+// history in a single write, and returns how many it added. Snapshots the
+// history already holds are skipped. The history's Keep applies to imported
+// snapshots too once the next one is recorded.
+func (l *LSMTree) ImportStatsHistory(r io.Reader) (int, error) {
+	existing, err := l.Records(statsRecordPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	records := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var snapshot StatsSnapshot
+		if err := json.Unmarshal(scanner.Bytes(), &snapshot); err != nil || snapshot.Time.IsZero() {
+			return 0, fmt.Errorf("failed to import stats snapshots: line %d isn't a stats snapshot", line)
+		}
+		name := statsRecordName(snapshot.Time)
+		if _, ok := existing[name]; ok {
+			continue
+		}
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode stats snapshot: %w", err)
+		}
+		records[name] = string(data)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read stats snapshots: %w", err)
+	}
+	if err := l.SetRecords(records); err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+// statsRecordName returns the name of the record of a stats snapshot taken at t
+func statsRecordName(t time.Time) string {
+	return statsRecordPrefix + t.UTC().Format(snapshotTimeFormat)
+}
+
+// recordStatsEvery records the stats snapshots of Options.StatsHistory as they
+// fall due until stop is closed. One missed while the tree was closed is
+// recorded right away.
+func (l *LSMTree) recordStatsEvery(stop <-chan struct{}) {
+	ticker := time.NewTicker(min(l.options.StatsHistory.Every, maxSnapshotCheckInterval))
+	defer ticker.Stop()
+
+	for {
+		// A due snapshot is recorded on the first check after a pause ends
+		if !l.Paused() {
+			if err := l.recordDueStats(time.Now()); err != nil && !errors.Is(err, ErrClosed) {
+				l.options.Logger.Error("failed to record stats snapshot", "err", err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordDueStats records a stats snapshot if the newest one is at least the
+// history's interval old, removing the oldest ones beyond its Keep in the same write
+func (l *LSMTree) recordDueStats(now time.Time) error {
+	records, err := l.Records(statsRecordPrefix)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		newest, err := time.Parse(snapshotTimeFormat, strings.TrimPrefix(names[len(names)-1], statsRecordPrefix))
+		if err == nil && now.Sub(newest) < l.options.StatsHistory.Every {
+			return nil
+		}
+	}
+
+	stats := l.Stats()
+	stats.SSTables = nil
+	data, err := json.Marshal(StatsSnapshot{Time: now.UTC(), Stats: stats})
+	if err != nil {
+		return fmt.Errorf("failed to encode stats snapshot: %w", err)
+	}
+	name := statsRecordName(now)
+	changes := map[string]string{name: string(data)}
+	names = append(names, name)
+	if keep := l.options.StatsHistory.Keep; keep > 0 && len(names) > keep {
+		for _, old := range names[:len(names)-keep] {
+			changes[old] = ""
+		}
+	}
+	return l.SetRecords(changes)
+}
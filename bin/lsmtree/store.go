@@ -0,0 +1,63 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrClosed is returned when writing to a store that has been closed
+var ErrClosed = errors.New("lsmtree: store is closed")
+
+// ErrReadOnly is returned when writing to a tree made read-only with SetReadOnly
+var ErrReadOnly = errors.New("lsmtree: store is read-only")
+
+// ErrInMemory is returned by the operations that need the files an in-memory
+// tree doesn't have, see Options.InMemory
+var ErrInMemory = fmt.Errorf("lsmtree: not available for an in-memory tree: %w", errors.ErrUnsupported)
+
+// ErrPinLimit is returned when pinning a key would exceed Options.MaxPinnedKeys
+var ErrPinLimit = errors.New("lsmtree: too many pinned keys")
+
+// Store is the key-value API shared by LSMTree, ShardedStore and test fakes
+type Store interface {
+	// Get retrieves the value for a key, returning an empty string if it doesn't exist
+	Get(key string) (string, error)
+	// Set adds or updates a key-value pair
+	Set(key, value string) error
+	// Delete removes a key-value pair
+	Delete(key string) error
+	// Scan returns an iterator over live keys in [start, end); an empty end is unbounded
+	Scan(start, end string) (Iterator, error)
+	// Batch applies all operations of the batch
+	Batch(batch *WriteBatch) error
+	// Close waits for background work and releases resources
+	Close() error
+}
+
+var (
+	_ Store = (*LSMTree)(nil)
+	_ Store = (*ShardedStore)(nil)
+)
+
+// inRange reports whether key falls within [start, end), where an empty end is unbounded
+func inRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
+
+// PrefixScan returns an iterator over the live keys of a store that start with prefix
+func PrefixScan(store Store, prefix string) (Iterator, error) {
+	return store.Scan(prefix, prefixEnd(prefix))
+}
+
+// prefixEnd returns the smallest key greater than every key with the given
+// prefix, or "" if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,134 @@
+package lsmtree
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// defaultMaxOpenFiles is the default number of SSTable file handles kept open
+const defaultMaxOpenFiles = 500
+
+// tableCache keeps SSTable file handles open across reads, closing the least
+// recently used handle once more than capacity files are open. Handles are
+// reference counted so an evicted file is only closed after its last reader.
+type tableCache struct {
+	mutex    sync.Mutex
+	fs       FS
+	capacity int
+	mmap     bool       // memory-map files instead of reading them with pread, OSFS only
+	lru      *list.List // of *tableHandle, most recently used first
+	handles  map[string]*list.Element
+	closed   bool
+}
+
+// tableHandle is an open SSTable file shared by concurrent readers
+type tableHandle struct {
+	path    string
+	file    tableReader
+	refs    int
+	evicted bool
+}
+
+// newTableCache creates a table cache holding at most capacity open files of
+// fsys, memory-mapping them if mmap is set
+func newTableCache(fsys FS, capacity int, mmap bool) *tableCache {
+	return &tableCache{
+		fs:       fsys,
+		capacity: capacity,
+		mmap:     mmap,
+		lru:      list.New(),
+		handles:  make(map[string]*list.Element),
+	}
+}
+
+// acquire returns an open handle for the file, opening it if necessary
+func (c *tableCache) acquire(path string) (*tableHandle, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.handles[path]; ok {
+		c.lru.MoveToFront(elem)
+		h := elem.Value.(*tableHandle)
+		h.refs++
+		return h, nil
+	}
+
+	file, err := c.open(path)
+	if err != nil {
+		return nil, err
+	}
+	h := &tableHandle{path: path, file: file, refs: 1}
+	if c.closed {
+		// Once the cache is closed, handles are no longer shared
+		h.evicted = true
+		return h, nil
+	}
+
+	c.handles[path] = c.lru.PushFront(h)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+	return h, nil
+}
+
+// open opens a file with the configured read mode
+func (c *tableCache) open(path string) (tableReader, error) {
+	if c.mmap {
+		return mmapFile(path)
+	}
+	file, err := c.fs.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSTable file: %w", err)
+	}
+	return file, nil
+}
+
+// release drops a reference to the handle, closing it if it was evicted
+func (c *tableCache) release(h *tableHandle) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	h.refs--
+	if h.refs == 0 && h.evicted {
+		h.file.Close()
+	}
+}
+
+// evict closes the cached handle of a file, e.g. before the file is deleted
+func (c *tableCache) evict(path string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.handles[path]; ok {
+		c.remove(elem)
+	}
+}
+
+// remove takes a handle out of the cache, closing it unless readers still use it
+func (c *tableCache) remove(elem *list.Element) {
+	h := c.lru.Remove(elem).(*tableHandle)
+	delete(c.handles, h.path)
+	h.evicted = true
+	if h.refs == 0 {
+		h.file.Close()
+	}
+}
+
+// openFiles returns the number of handles currently cached
+func (c *tableCache) openFiles() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+// close closes every cached handle; handles acquired afterwards aren't cached
+func (c *tableCache) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
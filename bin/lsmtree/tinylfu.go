@@ -0,0 +1,84 @@
+package lsmtree
+
+import "hash/fnv"
+
+// sketchDepth is the number of counter rows in the frequency sketch
+const sketchDepth = 4
+
+// sketchMaxCount is the value at which sketch counters saturate
+const sketchMaxCount = 15
+
+// frequencySketch is a count-min sketch estimating how often keys were accessed
+// recently. Counters are halved periodically so old popularity fades, as in TinyLFU.
+type frequencySketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// newFrequencySketch creates a sketch sized for a cache holding capacity entries
+func newFrequencySketch(capacity int) *frequencySketch {
+	width := 16
+	for width < capacity*2 {
+		width *= 2
+	}
+
+	f := &frequencySketch{
+		mask:    uint64(width - 1),
+		resetAt: width * 10,
+	}
+	for i := range f.rows {
+		f.rows[i] = make([]uint8, width)
+	}
+	return f
+}
+
+// indexes returns the counter position of key in every row using double hashing
+func (f *frequencySketch) indexes(key string) [sketchDepth]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum, (sum>>32)|1
+
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & f.mask
+	}
+	return idx
+}
+
+// increment records an access to key
+func (f *frequencySketch) increment(key string) {
+	for row, i := range f.indexes(key) {
+		if f.rows[row][i] < sketchMaxCount {
+			f.rows[row][i]++
+		}
+	}
+
+	f.additions++
+	if f.additions >= f.resetAt {
+		f.reset()
+	}
+}
+
+// estimate returns the approximate number of recent accesses to key
+func (f *frequencySketch) estimate(key string) uint8 {
+	min := uint8(sketchMaxCount)
+	for row, i := range f.indexes(key) {
+		if f.rows[row][i] < min {
+			min = f.rows[row][i]
+		}
+	}
+	return min
+}
+
+// reset halves every counter so the sketch favours recent accesses
+func (f *frequencySketch) reset() {
+	for row := range f.rows {
+		for i := range f.rows[row] {
+			f.rows[row][i] /= 2
+		}
+	}
+	f.additions /= 2
+}
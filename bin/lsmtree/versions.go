@@ -0,0 +1,260 @@
+package lsmtree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version records are stored in the tree next to the keys, under keys of their
+// own that List, Scan and the change feed leave out: versionPrefix, the key, a
+// NUL and the version number in hex, so a key's versions sort together in order.
+// The head of a key, under versionHeadPrefix, holds the number of its newest
+// version, so writes number their versions without reading the older ones.
+const (
+	versionPrefix     = "\x00version\x00"
+	versionHeadPrefix = "\x00versionhead\x00"
+)
+
+// ErrReservedKey is returned when writing a key in the space of version or internal records
+var ErrReservedKey = errors.New("lsmtree: key is reserved for internal records")
+
+// VersionRetention decides which past values of every key the tree keeps
+type VersionRetention struct {
+	// Keep is the number of versions kept of a key, its current value included.
+	// 0 keeps every version not older than MaxAge.
+	Keep int
+	// MaxAge drops versions older than this, except a key's newest. 0 keeps
+	// versions whatever their age.
+	MaxAge time.Duration
+}
+
+// enabled reports whether the tree records versions at all
+func (r VersionRetention) enabled() bool {
+	return r.Keep > 0 || r.MaxAge > 0
+}
+
+// Version is a value a key was given by a write, kept with Options.Versions
+type Version struct {
+	Number  uint64    // counts the writes of the key, from 1
+	Time    time.Time // when the write was applied
+	Value   string    // the value written, empty for a deletion
+	Deleted bool
+}
+
+// Versions returns the versions kept of a key, oldest first. The newest one is
+// its current value, or its deletion.
+func (l *LSMTree) Versions(key string) ([]Version, error) {
+	records, err := l.collect(context.Background(), versionPrefix+key+"\x00", func(record string) bool {
+		recordKey, _, ok := parseVersionKey(record)
+		return ok && recordKey == key
+	})
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, 0, len(records))
+	for record, value := range records {
+		_, number, _ := parseVersionKey(record)
+		version, err := decodeVersion(number, value)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Number < versions[j].Number })
+	return versions, nil
+}
+
+// VersionAt returns the version of versions that was current at t, reporting
+// false if the key wasn't written yet or its versions back then are gone
+func VersionAt(versions []Version, t time.Time) (Version, bool) {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !versions[i].Time.After(t) {
+			return versions[i], true
+		}
+	}
+	return Version{}, false
+}
+
+// ForgetVersions drops the versions kept of the keys starting with prefix, e.g.
+// once their values are encrypted and the plaintext ones mustn't linger
+func (l *LSMTree) ForgetVersions(prefix string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	// Version records and heads are collected apart, each under its own prefix
+	records, err := l.collect(context.Background(), versionPrefix+prefix, func(record string) bool {
+		key, _, ok := parseVersionKey(record)
+		return ok && strings.HasPrefix(key, prefix)
+	})
+	if err != nil {
+		return err
+	}
+	heads, err := l.collect(context.Background(), versionHeadPrefix+prefix, func(record string) bool {
+		return strings.HasPrefix(record, versionHeadPrefix+prefix)
+	})
+	if err != nil {
+		return err
+	}
+	ops := make([]BatchOp, 0, len(records)+len(heads))
+	for _, found := range []map[string]string{records, heads} {
+		for record := range found {
+			ops = append(ops, BatchOp{Key: record, Delete: true})
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	if err := l.wal.LogBatch(ops); err != nil {
+		return fmt.Errorf("failed to log to WAL: %w", err)
+	}
+	for _, op := range ops {
+		l.apply(op.Key, "")
+	}
+
+	if l.flushDue() {
+		if err := l.flushMemTable(); err != nil {
+			return fmt.Errorf("failed to flush memtable: %w", err)
+		}
+	}
+	return nil
+}
+
+// withVersions returns the operations of a write followed by the version records
+// and heads that Options.Versions keeps for them. It must be called with the
+// writer mutex held.
+func (l *LSMTree) withVersions(ops []BatchOp) ([]BatchOp, error) {
+	if err := CheckReserved(ops); err != nil {
+		return nil, err
+	}
+	if !l.options.Versions.enabled() {
+		return ops, nil
+	}
+
+	now := time.Now()
+	heads := make(map[string]uint64)
+	var keys []string // in order of their first write, so the log is deterministic
+	versioned := append([]BatchOp{}, ops...)
+	for _, op := range ops {
+		number, ok := heads[op.Key]
+		if !ok {
+			var err error
+			if number, err = l.versionHead(op.Key); err != nil {
+				return nil, err
+			}
+			keys = append(keys, op.Key)
+		}
+		number++
+		heads[op.Key] = number
+		versioned = append(versioned, BatchOp{Key: versionKey(op.Key, number), Value: encodeVersion(now, op)})
+	}
+	for _, key := range keys {
+		versioned = append(versioned, BatchOp{Key: versionHeadPrefix + key, Value: strconv.FormatUint(heads[key], 10)})
+	}
+	return versioned, nil
+}
+
+// versionHead returns the number of a key's newest version, 0 if none was recorded
+func (l *LSMTree) versionHead(key string) (uint64, error) {
+	value, err := l.currentValue(versionHeadPrefix + key)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	number, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed version head of %q: %w", key, err)
+	}
+	return number, nil
+}
+
+// pruneVersions drops the version records of a compaction that Options.Versions
+// no longer keeps: beyond the newest Keep of their key, or older than MaxAge. A
+// key's newest version is always kept. It must be called with the writer mutex held.
+func (l *LSMTree) pruneVersions(entries map[string]string) error {
+	retention := l.options.Versions
+	if !retention.enabled() {
+		return nil
+	}
+	now := time.Now()
+	heads := make(map[string]uint64) // read from the current view, which may hold newer versions than the compaction
+	for record, value := range entries {
+		key, number, ok := parseVersionKey(record)
+		if !ok || value == "" {
+			continue
+		}
+		head, seen := heads[key]
+		if !seen {
+			var err error
+			if head, err = l.versionHead(key); err != nil {
+				return err
+			}
+			heads[key] = head
+		}
+		version, err := decodeVersion(number, value)
+		if err != nil {
+			return err
+		}
+		tooMany := retention.Keep > 0 && number+uint64(retention.Keep) <= head
+		tooOld := retention.MaxAge > 0 && now.Sub(version.Time) > retention.MaxAge
+		if number < head && (tooMany || tooOld) {
+			delete(entries, record)
+		}
+	}
+	return nil
+}
+
+// isVersionKey reports whether a key is a version record or head rather than a key of the store
+func isVersionKey(key string) bool {
+	return strings.HasPrefix(key, versionPrefix) || strings.HasPrefix(key, versionHeadPrefix)
+}
+
+// versionKey returns the key of a version record
+func versionKey(key string, number uint64) string {
+	return fmt.Sprintf("%s%s\x00%016x", versionPrefix, key, number)
+}
+
+// parseVersionKey splits the key of a version record into the key it versions and its number
+func parseVersionKey(record string) (string, uint64, bool) {
+	rest, ok := strings.CutPrefix(record, versionPrefix)
+	i := strings.LastIndexByte(rest, 0)
+	if !ok || i < 0 || len(rest)-i-1 != 16 {
+		return "", 0, false
+	}
+	number, err := strconv.ParseUint(rest[i+1:], 16, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return rest[:i], number, true
+}
+
+// encodeVersion encodes a version record as the write's time in Unix nanoseconds
+// and s followed by the value written, or d for a deletion. It's never empty, so
+// it's never mistaken for a tombstone.
+func encodeVersion(t time.Time, op BatchOp) string {
+	if op.Delete || op.Value == "" {
+		return fmt.Sprintf("%d d", t.UnixNano())
+	}
+	return fmt.Sprintf("%d s%s", t.UnixNano(), op.Value)
+}
+
+// decodeVersion decodes a version record
+func decodeVersion(number uint64, record string) (Version, error) {
+	nanos, rest, ok := strings.Cut(record, " ")
+	unixNanos, err := strconv.ParseInt(nanos, 10, 64)
+	if !ok || err != nil || rest == "" || (rest[0] != 's' && rest[0] != 'd') {
+		return Version{}, fmt.Errorf("malformed version record %d", number)
+	}
+	return Version{
+		Number:  number,
+		Time:    time.Unix(0, unixNanos),
+		Value:   rest[1:],
+		Deleted: rest[0] == 'd',
+	}, nil
+}
@@ -0,0 +1,197 @@
+package lsmtree
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// FS is the file system a tree keeps its files in, set with Options.FS. Names
+// are paths as given to the tree, such as filepath.Join(dataDir, "MANIFEST").
+// Implementations may wrap OSFS to encrypt files or inject faults, or keep
+// everything in memory like MemFS.
+type FS interface {
+	// Open opens a file for reading
+	Open(name string) (File, error)
+	// Create creates a file for writing, truncating it if it exists
+	Create(name string) (File, error)
+	// Append opens a file for writing at its end, creating it if needed
+	Append(name string) (File, error)
+	// Rename replaces newname by oldname atomically, as rename(2) does
+	Rename(oldname, newname string) error
+	// Remove removes a file or an empty directory
+	Remove(name string) error
+	// RemoveAll removes a path and everything under it, succeeding if it doesn't exist
+	RemoveAll(name string) error
+	// List returns the entries of a directory sorted by name
+	List(dir string) ([]fs.FileInfo, error)
+	// Stat describes a file or directory
+	Stat(name string) (fs.FileInfo, error)
+	// MkdirAll creates a directory and any missing parents
+	MkdirAll(dir string) error
+	// Truncate changes the size of a file
+	Truncate(name string, size int64) error
+}
+
+// File is an open file of an FS
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	// Stat describes the file
+	Stat() (fs.FileInfo, error)
+	// Sync flushes the file's contents to stable storage
+	Sync() error
+}
+
+// linker is an FS that can hard-link files, which checkpoints use to avoid copies
+type linker interface {
+	Link(oldname, newname string) error
+}
+
+// OSFS is the operating system's file system, the default of Options.FS
+type OSFS struct{}
+
+// Open opens a file for reading
+func (OSFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+// Create creates a file for writing, truncating it if it exists
+func (OSFS) Create(name string) (File, error) {
+	return os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+}
+
+// Append opens a file for writing at its end, creating it if needed
+func (OSFS) Append(name string) (File, error) {
+	return os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+}
+
+// Rename replaces newname by oldname
+func (OSFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+// Remove removes a file or an empty directory
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// RemoveAll removes a path and everything under it
+func (OSFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+// List returns the entries of a directory sorted by name
+func (OSFS) List(dir string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// Removed since the directory was read
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Stat describes a file or directory
+func (OSFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// MkdirAll creates a directory and any missing parents
+func (OSFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0700)
+}
+
+// Truncate changes the size of a file
+func (OSFS) Truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+// Link hard-links newname to oldname
+func (OSFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+// isOSFS reports whether files are those of the operating system, which the
+// data directory lock and memory-mapped reads need
+func isOSFS(fsys FS) bool {
+	_, ok := fsys.(OSFS)
+	return ok
+}
+
+// readFile returns the contents of a file
+func readFile(fsys FS, name string) ([]byte, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// writeFile creates or truncates a file, writes data to it and syncs it, so it
+// can be renamed over the file it replaces and survive a crash
+func writeFile(fsys FS, name string, data []byte) error {
+	file, err := fsys.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// glob returns the paths of the regular files of dir whose name matches
+// pattern, sorted, and none if dir doesn't exist
+func glob(fsys FS, dir, pattern string) ([]string, error) {
+	infos, err := fsys.List(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, info := range infos {
+		if ok, err := filepath.Match(pattern, info.Name()); err != nil {
+			return nil, err
+		} else if ok && info.Mode().IsRegular() {
+			paths = append(paths, filepath.Join(dir, info.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// walkFiles calls fn for every regular file under dir, skipping what can't be listed
+func walkFiles(fsys FS, dir string, fn func(path string, info fs.FileInfo)) {
+	infos, err := fsys.List(dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if info.IsDir() {
+			walkFiles(fsys, path, fn)
+		} else if info.Mode().IsRegular() {
+			fn(path, info)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package lsmtree
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// view is an immutable snapshot of the tree structure used by readers.
+// Readers take a reference to the current view instead of locking the tree,
+// so they can proceed while writes, flushes and compactions are running.
+type view struct {
+	memTable  *MemTable   // active MemTable receiving writes
+	immutable []*MemTable // MemTables waiting to be flushed, oldest first
+	ssTables  []*SSTable  // SSTables, oldest first
+	refs      int32
+}
+
+// newView creates a view holding a reference to each of its SSTables
+func newView(memTable *MemTable, immutable []*MemTable, ssTables []*SSTable) *view {
+	for _, ssTable := range ssTables {
+		ssTable.ref()
+	}
+	return &view{
+		memTable:  memTable,
+		immutable: immutable,
+		ssTables:  ssTables,
+		refs:      1,
+	}
+}
+
+// release drops a reference to the view and its SSTables once unused
+func (v *view) release() {
+	if atomic.AddInt32(&v.refs, -1) == 0 {
+		for _, ssTable := range v.ssTables {
+			ssTable.unref()
+		}
+	}
+}
+
+// readStats records side effects of a lookup that the tree acts on afterwards
+type readStats struct {
+	seekCompaction *SSTable // SSTable whose useless probe budget ran out during the lookup
+}
+
+// get looks up a key in the view from newest to oldest data. A tombstone is
+// reported as found with an empty value.
+func (v *view) get(key string) (string, bool, readStats, error) {
+	var stats readStats
+
+	if value, ok := v.memTable.Get(key); ok {
+		return value, true, stats, nil
+	}
+
+	for i := len(v.immutable) - 1; i >= 0; i-- {
+		if value, ok := v.immutable[i].Get(key); ok {
+			return value, true, stats, nil
+		}
+	}
+
+	for i := len(v.ssTables) - 1; i >= 0; i-- {
+		ssTable := v.ssTables[i]
+		value, ok, err := ssTable.lookup(key)
+		if err != nil {
+			return "", false, stats, fmt.Errorf("failed to get value from SSTable: %w", err)
+		}
+		if ok {
+			return value, true, stats, nil
+		}
+		if stats.seekCompaction == nil && ssTable.seekCompactionDue() {
+			stats.seekCompaction = ssTable
+		}
+	}
+
+	return "", false, stats, nil
+}
+
+// acquireView returns the current view with an extra reference held for the caller
+func (l *LSMTree) acquireView() *view {
+	l.viewMutex.Lock()
+	defer l.viewMutex.Unlock()
+
+	atomic.AddInt32(&l.current.refs, 1)
+	return l.current
+}
+
+// installView makes v the current view and releases the previous one
+func (l *LSMTree) installView(v *view) {
+	l.viewMutex.Lock()
+	old := l.current
+	l.current = v
+	l.viewMutex.Unlock()
+
+	if old != nil {
+		old.release()
+	}
+}
+
+// ref adds a reference to the SSTable
+func (s *SSTable) ref() {
+	atomic.AddInt32(&s.refs, 1)
+}
+
+// unref drops a reference to the SSTable, removing its file once it is
+// obsolete and no view uses it anymore
+func (s *SSTable) unref() {
+	if atomic.AddInt32(&s.refs, -1) == 0 && atomic.LoadInt32(&s.obsolete) == 1 {
+		if s.files != nil {
+			s.files.evict(s.filePath)
+		}
+		if err := s.fs.Remove(s.filePath); err != nil && s.logger != nil {
+			s.logger.Error("failed to remove obsolete SSTable", "sstable", s.filePath, "err", err)
+		}
+	}
+}
+
+// markObsolete flags the SSTable file for removal when its last reference is dropped
+func (s *SSTable) markObsolete() {
+	atomic.StoreInt32(&s.obsolete, 1)
+}
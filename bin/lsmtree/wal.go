@@ -2,75 +2,845 @@ package lsmtree
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// WAL record layout:
+//
+//	[crc32c uint32] [length uint32] [type uint8] [payload]
+//
+// The checksum covers the length, type and payload, and the payload depends on the type:
+//
+//	put:          uvarint(len(key)) key uvarint(len(value)) value
+//	delete:       uvarint(len(key)) key
+//	batch-begin:  uvarint(number of operations)
+//	batch-commit: empty
+//	time:         uvarint(Unix milliseconds)
+//	encrypted:    nonce, then the type and payload of one of the above sealed with the data key,
+//	              bound to the segment number and offset of the record
+//
+// The operations of a batch are logged between its begin and commit records and
+// are only replayed if the commit record made it to disk. A time record precedes
+// the first write of every segment and every write logged in a later millisecond
+// than the one before, so every operation is dated by the last time record before
+// it. In an encrypted data directory every record is an encrypted one.
+
+// walHeaderSize is the size of the checksum and length preceding every record
+const walHeaderSize = 8
+
+// walRecordType identifies the operation a WAL record logs
+type walRecordType byte
+
+const (
+	walPut walRecordType = iota + 1
+	walDelete
+	walBatchBegin
+	walBatchCommit
+	walTime
+	walEncrypted
+)
+
+// walRecord is a decoded WAL record
+type walRecord struct {
+	kind  walRecordType
+	key   string
+	value string
+	count uint64    // operations in the batch, for batch-begin records
+	time  time.Time // when the following records were logged, for time records
+}
+
+// The WAL is split into numbered segment files. Writes go to the newest segment,
+// which is rotated once it reaches the segment size and whenever the MemTable is
+// flushed. The manifest records the oldest segment whose writes aren't in an
+// SSTable yet; older segments are deleted, or moved to the archive directory if
+// one is configured.
+
+// defaultWALSegmentSize is the size in bytes at which a WAL segment is rotated
+const defaultWALSegmentSize = 4 * 1024 * 1024 // 4MB
+
+// defaultWALSyncInterval is how often a WAL not using SyncAlways writes out its buffer
+const defaultWALSyncInterval = 10 * time.Millisecond
+
+// defaultWALMaxUnsyncedBytes is how many bytes a WAL using SyncInterval may hold
+// unsynced before a write syncs without waiting for the interval
+const defaultWALMaxUnsyncedBytes = 1024 * 1024 // 1MB
+
+// walBufferSize is the size of the buffer records are collected in before being written to the segment
+const walBufferSize = 64 * 1024
+
+// SyncPolicy decides when WAL writes are flushed to stable storage
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs the WAL before every write returns
+	SyncAlways SyncPolicy = iota
+	// SyncInterval buffers writes and fsyncs them in the background every
+	// WALSyncInterval, or as soon as WALMaxUnsyncedBytes are pending, so a crash
+	// loses at most one interval of writes
+	SyncInterval
+	// SyncNever buffers writes and hands them to the OS every WALSyncInterval
+	// without fsyncing; a process crash loses at most one interval of writes, a
+	// power failure whatever the OS hadn't written back
+	SyncNever
+)
+
+// String returns the policy name
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(p))
+	}
+}
+
+// ParseSyncPolicy parses a policy name as accepted on the command line
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always", "":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return SyncAlways, fmt.Errorf("unknown sync policy %q", name)
+	}
+}
+
 // WAL represents a Write-Ahead Log
 type WAL struct {
-	filePath string
+	fs          FS
+	dataDir     string
+	policy      SyncPolicy
+	segmentSize int64
+	interval    time.Duration // how often buffered writes are written out unless policy is SyncAlways
+	maxUnsynced int64         // unsynced bytes that trigger an early sync with SyncInterval
+	archiveDir  string        // where segments go once their writes are in SSTables, if set
+	logger      Logger        // receives the errors of background syncs
+	enc         *encryptor    // encrypts records in an encrypted data directory, set by the tree's recovery
+
+	mutex   sync.Mutex        // guards the open segment
+	segment uint64            // number of the segment written to, 0 until the first write or recovery
+	file    File              // the open segment, opened on the first write
+	writer  *bufio.Writer     // buffers records for the open segment
+	size    int64             // bytes in the open segment, including buffered ones
+	dirty   bool              // written since the last sync
+	logged  int64             // Unix milliseconds of the open segment's last time record
+	ops     uint64            // operations logged in the open segment, numbered as ReadChanges numbers them
+	ends    map[uint64]uint64 // operations logged in the latest rotated segments, by segment
+
+	written     int64     // bytes logged since the WAL was created
+	unsynced    int64     // bytes logged since the last fsync
+	oldestWrite time.Time // when the oldest unsynced write was logged
+	lastSync    time.Time
+	syncs       uint64
+
+	recovery RecoveryReport // what the last recover found
+
+	memory bool // set for an in-memory tree, whose writes aren't logged
+}
+
+// WALStats describes the WAL's durability exposure: the writes that a power failure
+// right now could lose
+type WALStats struct {
+	Policy           string        `json:"policy"`
+	SyncInterval     time.Duration `json:"sync_interval"`
+	MaxUnsyncedBytes int64         `json:"max_unsynced_bytes"`
+	Segment          uint64        `json:"segment"`        // segment currently written to
+	UnsyncedBytes    int64         `json:"unsynced_bytes"` // logged but not yet fsynced
+	OldestUnsynced   time.Time     `json:"oldest_unsynced,omitempty"`
+	LastSync         time.Time     `json:"last_sync,omitempty"`
+	Syncs            uint64        `json:"syncs"`
+}
+
+// RecoveryReport describes what recovery read from the WAL. A crash can leave a
+// torn tail at the end of the last segment: a partially written record and the
+// operations of a batch whose commit record never made it to disk. Recovery
+// discards the tail and truncates the segment at the last valid record.
+type RecoveryReport struct {
+	Segments       int    `json:"segments"`                  // segments replayed
+	Replayed       int    `json:"replayed"`                  // operations applied
+	Discarded      int    `json:"discarded"`                 // records dropped from a torn tail
+	Truncated      string `json:"truncated,omitempty"`       // segment cut back to its last valid record
+	TruncatedBytes int64  `json:"truncated_bytes,omitempty"` // bytes removed from it
 }
 
-// NewWAL creates a new WAL with the given data directory
+// segmentReplay is the outcome of replaying one WAL segment
+type segmentReplay struct {
+	replayed  int
+	discarded int
+	end       int64 // offset after the last record that belongs in the segment
+	size      int64
+	last      time.Time // time of the last time record replayed
+	stopped   bool      // replay stopped at a time record later than until
+}
+
+// NewWAL creates a new WAL with the given data directory that syncs every write
 func NewWAL(dataDir string) *WAL {
+	return newWAL(dataDir, DefaultOptions())
+}
+
+// newWAL creates a new WAL with the given data directory and the WAL settings of options
+func newWAL(dataDir string, options Options) *WAL {
 	return &WAL{
-		filePath: filepath.Join(dataDir, "wal.log"),
+		fs:          options.FS,
+		dataDir:     dataDir,
+		policy:      options.WALSync,
+		segmentSize: options.WALSegmentSize,
+		interval:    options.WALSyncInterval,
+		maxUnsynced: options.WALMaxUnsyncedBytes,
+		archiveDir:  options.WALArchiveDir,
+		logger:      options.Logger,
+	}
+}
+
+// walSegmentPath returns the path of a numbered WAL segment
+func walSegmentPath(dataDir string, segment uint64) string {
+	return filepath.Join(dataDir, fmt.Sprintf("wal-%06d.log", segment))
+}
+
+// listWALSegments returns the numbers of the WAL segments in a directory of fsys in order
+func listWALSegments(fsys FS, dataDir string) ([]uint64, error) {
+	paths, err := glob(fsys, dataDir, "wal-*.log")
+	if err != nil {
+		return nil, err
 	}
+	segments := make([]uint64, 0, len(paths))
+	for _, path := range paths {
+		if segment, ok := walSegmentNumber(path); ok {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// walSegmentNumber returns the number of the WAL segment at path, from its name
+func walSegmentNumber(path string) (uint64, bool) {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "wal-"), ".log")
+	segment, err := strconv.ParseUint(name, 10, 64)
+	return segment, err == nil
 }
 
 // Log appends a key-value pair to the WAL
 func (w *WAL) Log(key, value string) error {
-	file, err := os.OpenFile(w.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	return w.write([]walRecord{{kind: walPut, key: key, value: value}}, 1)
+}
+
+// LogDelete appends the deletion of a key to the WAL
+func (w *WAL) LogDelete(key string) error {
+	return w.write([]walRecord{{kind: walDelete, key: key}}, 1)
+}
+
+// LogBatch appends the operations of a batch to the WAL with a single write, so
+// the batch costs one sync and is replayed either entirely or not at all
+func (w *WAL) LogBatch(ops []BatchOp) error {
+	records := make([]walRecord, 0, len(ops)+2)
+	records = append(records, walRecord{kind: walBatchBegin, count: uint64(len(ops))})
+	for _, op := range ops {
+		records = append(records, walOpRecord(op))
+	}
+	records = append(records, walRecord{kind: walBatchCommit})
+	return w.write(records, uint64(len(ops)))
+}
+
+// write appends records holding ops operations to the WAL and syncs them
+// according to the policy
+func (w *WAL) write(records []walRecord, ops uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.memory {
+		return nil
+	}
+	now := time.Now()
+	var encoded []byte
+	for {
+		if err := w.open(); err != nil {
+			return err
+		}
+		encoded = w.encode(records, now)
+		// Records of one write never span segments, so a batch stays in one file
+		if w.size == 0 || w.size+int64(len(encoded)) <= w.segmentSize {
+			break
+		}
+		if err := w.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	w.logged = now.UnixMilli()
+
+	n, err := w.writer.Write(encoded)
+	w.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+	w.ops += ops
+	if w.unsynced == 0 {
+		w.oldestWrite = time.Now()
+	}
+	w.dirty = true
+	w.written += int64(n)
+	w.unsynced += int64(n)
+
+	if w.policy == SyncAlways || (w.policy == SyncInterval && w.unsynced >= w.maxUnsynced) {
+		return w.sync()
+	}
+	return nil
+}
+
+// encode encodes records for the end of the open segment, after a time record
+// unless one was logged in the same millisecond. Encrypted records are bound to
+// the segment and offset they're written at. The mutex must be held.
+func (w *WAL) encode(records []walRecord, now time.Time) []byte {
+	var encoded []byte
+	if now.UnixMilli() != w.logged {
+		encoded = encodeWALRecord(walRecord{kind: walTime, time: now}, w.enc, walRecordAD(w.segment, w.size))
+	}
+	for _, r := range records {
+		encoded = append(encoded, encodeWALRecord(r, w.enc, walRecordAD(w.segment, w.size+int64(len(encoded))))...)
+	}
+	return encoded
+}
+
+// open opens the current segment for appending if it isn't open yet. The mutex must be held.
+func (w *WAL) open() error {
+	if w.file != nil {
+		return nil
+	}
+	if w.segment == 0 {
+		// Without recovery, continue after the newest existing segment
+		segments, err := listWALSegments(w.fs, w.dataDir)
+		if err != nil {
+			return fmt.Errorf("failed to list WAL segments: %w", err)
+		}
+		w.segment = 1
+		if len(segments) > 0 {
+			w.segment = segments[len(segments)-1] + 1
+		}
+	}
+
+	file, err := w.fs.Append(walSegmentPath(w.dataDir, w.segment))
 	if err != nil {
 		return fmt.Errorf("failed to open WAL file: %w", err)
 	}
-	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat WAL file: %w", err)
+	}
+	w.file, w.writer, w.size = file, bufio.NewWriterSize(file, walBufferSize), info.Size()
+	return nil
+}
+
+// rotate closes the current segment and starts a new one, returning its number.
+// Every write logged before rotate returned is in a lower-numbered segment.
+func (w *WAL) rotate() (uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.open(); err != nil {
+		return 0, err
+	}
+	if err := w.rotateLocked(); err != nil {
+		return 0, err
+	}
+	return w.segment, nil
+}
+
+// rotateLocked syncs and closes the open segment and moves on to the next one.
+// The mutex must be held.
+func (w *WAL) rotateLocked() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	if w.ends == nil {
+		w.ends = make(map[uint64]uint64)
+	}
+	w.ends[w.segment] = w.ops
+	delete(w.ends, w.segment-walSegmentEnds)
+	w.segment++
+	w.ops = 0
+	return nil
+}
 
-	entry := fmt.Sprintf("%s,%s\n", key, value)
-	if _, err := file.WriteString(entry); err != nil {
+// removeBefore deletes or archives the segments numbered below segment, whose
+// writes are all in SSTables
+func (w *WAL) removeBefore(segment uint64) error {
+	segments, err := listWALSegments(w.fs, w.dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+	for _, s := range segments {
+		if s >= segment {
+			break
+		}
+		if w.archiveDir != "" {
+			if err := archiveWALSegment(w.fs, walSegmentPath(w.dataDir, s), w.archiveDir); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.fs.Remove(walSegmentPath(w.dataDir, s)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove WAL segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// Sync writes out buffered records and flushes them to stable storage, whatever the sync policy
+func (w *WAL) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.sync()
+}
+
+// flush hands buffered records to the OS. The mutex must be held.
+func (w *WAL) flush() error {
+	if w.writer == nil || w.writer.Buffered() == 0 {
+		return nil
+	}
+	if err := w.writer.Flush(); err != nil {
 		return fmt.Errorf("failed to write to WAL: %w", err)
 	}
+	return nil
+}
 
+// sync writes out buffered records and fsyncs them. The mutex must be held.
+func (w *WAL) sync() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if w.file == nil || !w.dirty {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	w.dirty = false
+	w.unsynced, w.oldestWrite = 0, time.Time{}
+	w.lastSync = time.Now()
+	w.syncs++
 	return nil
 }
 
-// Recover reads the WAL and returns all key-value pairs
+// writtenBytes returns the bytes logged since the WAL was created
+func (w *WAL) writtenBytes() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.written
+}
+
+// stats returns the WAL's current durability exposure
+func (w *WAL) stats() WALStats {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	stats := WALStats{
+		Policy:         w.policy.String(),
+		Segment:        w.segment,
+		UnsyncedBytes:  w.unsynced,
+		OldestUnsynced: w.oldestWrite,
+		LastSync:       w.lastSync,
+		Syncs:          w.syncs,
+	}
+	if w.policy != SyncAlways {
+		stats.SyncInterval = w.interval
+	}
+	if w.policy == SyncInterval {
+		stats.MaxUnsyncedBytes = w.maxUnsynced
+	}
+	return stats
+}
+
+// settle writes out buffered records as the sync policy requires when the
+// segment is closed or the background interval elapses. The mutex must be held.
+func (w *WAL) settle() error {
+	if w.policy == SyncNever {
+		return w.flush()
+	}
+	return w.sync()
+}
+
+// syncEvery writes out the buffer every interval until stop is closed, grouping
+// the writes of each interval into one write and, unless the policy is
+// SyncNever, one fsync
+func (w *WAL) syncEvery(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.mutex.Lock()
+			err := w.settle()
+			w.mutex.Unlock()
+			if err != nil {
+				w.logger.Error("failed to sync WAL", "err", err)
+			}
+		}
+	}
+}
+
+// Close writes out buffered records, syncs them unless the policy is SyncNever and closes the WAL file
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.closeFile()
+}
+
+// closeFile writes out pending records and closes the open segment. The mutex must be held.
+func (w *WAL) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.settle()
+	if closeErr := w.file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close WAL: %w", closeErr)
+	}
+	w.file, w.writer, w.size, w.dirty, w.logged = nil, nil, 0, false, 0
+	return err
+}
+
+// walOpRecord returns the put or delete record of a batch operation
+func walOpRecord(op BatchOp) walRecord {
+	if op.Delete {
+		return walRecord{kind: walDelete, key: op.Key}
+	}
+	return walRecord{kind: walPut, key: op.Key, value: op.Value}
+}
+
+// encodeWALOp encodes a batch operation as a plaintext put or delete record
+func encodeWALOp(op BatchOp) []byte {
+	return encodeWALRecord(walOpRecord(op), nil, nil)
+}
+
+// encodeWALRecord encodes a record with its checksum, as an encrypted record
+// sealed with the associated data ad unless enc is nil
+func encodeWALRecord(r walRecord, enc *encryptor, ad []byte) []byte {
+	payload := []byte{byte(r.kind)}
+	switch r.kind {
+	case walPut:
+		payload = binary.AppendUvarint(payload, uint64(len(r.key)))
+		payload = append(payload, r.key...)
+		payload = binary.AppendUvarint(payload, uint64(len(r.value)))
+		payload = append(payload, r.value...)
+	case walDelete:
+		payload = binary.AppendUvarint(payload, uint64(len(r.key)))
+		payload = append(payload, r.key...)
+	case walBatchBegin:
+		payload = binary.AppendUvarint(payload, r.count)
+	case walTime:
+		payload = binary.AppendUvarint(payload, uint64(r.time.UnixMilli()))
+	}
+	if enc != nil {
+		payload = append([]byte{byte(walEncrypted)}, enc.seal(payload, ad)...)
+	}
+	return frameWALRecord(payload)
+}
+
+// frameWALRecord prefixes a record payload with its checksum and length
+func frameWALRecord(payload []byte) []byte {
+	record := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(len(payload)))
+	record = append(record, payload...)
+	binary.LittleEndian.PutUint32(record[0:4], crc32.Checksum(record[4:], castagnoli))
+	return record
+}
+
+// Recover reads every WAL segment and returns all key-value pairs
 func (w *WAL) Recover() (map[string]string, error) {
+	return w.recover(0)
+}
+
+// recover deletes the segments below from, which are already in SSTables, and
+// returns the key-value pairs of the rest. A torn tail of the last segment is
+// truncated away; corruption anywhere else fails recovery. Later writes go to a
+// new segment.
+func (w *WAL) recover(from uint64) (map[string]string, error) {
+	if err := w.removeBefore(from); err != nil {
+		return nil, err
+	}
+	segments, err := listWALSegments(w.fs, w.dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+
 	entries := make(map[string]string)
+	var report RecoveryReport
+	for i, segment := range segments {
+		path := walSegmentPath(w.dataDir, segment)
+		last := i == len(segments)-1
+		replay, err := replayWALSegment(w.fs, path, last, time.Time{}, w.enc, func(key, value string) {
+			entries[key] = value
+		})
+		if err != nil {
+			return nil, err
+		}
+		report.Segments++
+		report.Replayed += replay.replayed
+		report.Discarded += replay.discarded
+		if replay.end < replay.size {
+			if err := w.fs.Truncate(path, replay.end); err != nil {
+				return nil, fmt.Errorf("failed to truncate torn WAL segment: %w", err)
+			}
+			report.Truncated, report.TruncatedBytes = path, replay.size-replay.end
+		}
+	}
 
-	file, err := os.Open(w.filePath)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.closeFile(); err != nil {
+		return nil, err
+	}
+	w.segment = from
+	if len(segments) > 0 {
+		w.segment = segments[len(segments)-1] + 1
+	}
+	if w.segment == 0 {
+		w.segment = 1
+	}
+	w.ops = 0
+	w.recovery = report
+	return entries, nil
+}
+
+// lastRecovery returns the report of the last recover
+func (w *WAL) lastRecovery() RecoveryReport {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.recovery
+}
+
+// replay calls fn for every operation in every WAL segment in the order they were logged
+func (w *WAL) replay(fn func(key, value string)) error {
+	segments, err := listWALSegments(w.fs, w.dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+	for _, segment := range segments {
+		if _, err := replayWALSegment(w.fs, walSegmentPath(w.dataDir, segment), false, time.Time{}, w.enc, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayWALSegment calls fn for every operation in a WAL segment of fsys in the
+// order they were logged, with an empty value for deletes. The operations of a
+// batch are passed on once its commit record is read, and a batch cut short by a
+// crash is dropped. A record that fails validation is reported as an ErrCorruption, unless
+// tail is set and the record runs to the end of the file, as the last record of a
+// write torn by a crash does; replay then stops there. Unless until is zero,
+// replay also stops at the first time record later than until. Records are
+// decrypted with enc, which must be set for the segments of an encrypted data
+// directory.
+func replayWALSegment(fsys FS, path string, tail bool, until time.Time, enc *encryptor, fn func(key, value string)) (segmentReplay, error) {
+	data, err := readFile(fsys, path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return entries, nil
+			return segmentReplay{}, nil
 		}
-		return nil, fmt.Errorf("failed to open WAL file: %w", err)
+		return segmentReplay{}, fmt.Errorf("failed to read WAL: %w", err)
 	}
-	defer file.Close()
+	return walkWALRecords(path, data, tail, until, enc, func(key, value string, _ time.Time) { fn(key, value) })
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		parts := strings.SplitN(scanner.Text(), ",", 2)
-		if len(parts) == 2 {
-			key, value := parts[0], parts[1]
-			entries[key] = value
+// walkWALRecords replays the records of the WAL segment at path, read into data,
+// like replayWALSegment, also passing fn the time each operation was logged at
+func walkWALRecords(path string, data []byte, tail bool, until time.Time, enc *encryptor, fn func(key, value string, at time.Time)) (segmentReplay, error) {
+	replay := segmentReplay{size: int64(len(data))}
+	segment, _ := walSegmentNumber(path)
+	var batch []walRecord
+	inBatch := false
+	batchSize := uint64(0)
+	batchStart := 0
+	offset := 0
+	for offset < len(data) {
+		record, size, reason := decodeWALRecord(data[offset:], enc, walRecordAD(segment, int64(offset)))
+		if reason != "" && tail && isTornWALRecord(data[offset:]) {
+			replay.discarded++
+			break
+		}
+		if reason == "" {
+			switch {
+			case record.kind == walBatchBegin && inBatch:
+				reason = "batch begins inside another batch"
+			case record.kind == walBatchCommit && !inBatch:
+				reason = "batch commit without a batch"
+			case record.kind == walBatchCommit && uint64(len(batch)) != batchSize:
+				reason = fmt.Sprintf("batch commit after %d of %d operations", len(batch), batchSize)
+			case record.kind == walTime && inBatch:
+				reason = "time record inside a batch"
+			}
+		}
+		if reason != "" {
+			return segmentReplay{}, &ErrCorruption{File: path, Offset: int64(offset), Reason: reason}
 		}
+
+		if record.kind == walTime && !until.IsZero() && record.time.After(until) {
+			replay.stopped = true
+			break
+		}
+
+		switch record.kind {
+		case walTime:
+			replay.last = record.time
+		case walBatchBegin:
+			inBatch, batchSize, batch, batchStart = true, record.count, batch[:0], offset
+		case walBatchCommit:
+			for _, op := range batch {
+				fn(op.key, op.value, replay.last)
+			}
+			replay.replayed += len(batch)
+			inBatch = false
+		default:
+			if inBatch {
+				batch = append(batch, record)
+			} else {
+				fn(record.key, record.value, replay.last)
+				replay.replayed++
+			}
+		}
+		offset += size
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to read WAL: %w", err)
+	replay.end = int64(offset)
+	if inBatch {
+		// The batch never committed, so its records don't belong in the segment
+		replay.discarded += len(batch) + 1
+		replay.end = int64(batchStart)
 	}
+	return replay, nil
+}
 
-	return entries, nil
+// isTornWALRecord reports whether an invalid record at the start of data could be
+// a write cut short by a crash: one whose header or declared length reaches the
+// end of the file. An invalid record followed by more data is corruption.
+func isTornWALRecord(data []byte) bool {
+	if len(data) < walHeaderSize {
+		return true
+	}
+	return uint64(len(data)-walHeaderSize) <= uint64(binary.LittleEndian.Uint32(data[4:8]))
 }
 
-// Clear truncates the WAL file, effectively clearing its contents
+// decodeWALRecord decodes the record at the start of data, returning its total
+// size, or a non-empty reason if the record is invalid. With enc only encrypted
+// records sealed with the associated data ad are valid, and without it only
+// plaintext ones.
+func decodeWALRecord(data []byte, enc *encryptor, ad []byte) (record walRecord, size int, reason string) {
+	payload, size, reason := unframeWALRecord(data)
+	if reason != "" {
+		return walRecord{}, 0, reason
+	}
+	if len(payload) == 0 {
+		return walRecord{}, 0, "missing record type"
+	}
+	switch encrypted := walRecordType(payload[0]) == walEncrypted; {
+	case encrypted && enc == nil:
+		return walRecord{}, 0, "encrypted record without an encryption key"
+	case !encrypted && enc != nil:
+		return walRecord{}, 0, "plaintext record in an encrypted WAL"
+	case encrypted:
+		var err error
+		if payload, err = enc.open(payload[1:], ad); err != nil || len(payload) == 0 {
+			return walRecord{}, 0, "failed to decrypt record"
+		}
+	}
+
+	record.kind = walRecordType(payload[0])
+	rest := payload[1:]
+	ok := true
+	switch record.kind {
+	case walPut:
+		record.key, rest, ok = readWALString(rest)
+		if ok {
+			record.value, rest, ok = readWALString(rest)
+		}
+	case walDelete:
+		record.key, rest, ok = readWALString(rest)
+	case walBatchBegin:
+		var n int
+		record.count, n = binary.Uvarint(rest)
+		ok = n > 0
+		if ok {
+			rest = rest[n:]
+		}
+	case walBatchCommit:
+	case walTime:
+		ms, n := binary.Uvarint(rest)
+		ok = n > 0
+		if ok {
+			record.time, rest = time.UnixMilli(int64(ms)), rest[n:]
+		}
+	default:
+		return walRecord{}, 0, fmt.Sprintf("unknown record type %d", record.kind)
+	}
+	if !ok || len(rest) != 0 {
+		return walRecord{}, 0, "malformed record payload"
+	}
+	return record, size, ""
+}
+
+// unframeWALRecord validates the checksum and length of the record at the start
+// of data and returns its payload and total size
+func unframeWALRecord(data []byte) (payload []byte, size int, reason string) {
+	if len(data) < walHeaderSize {
+		return nil, 0, "truncated record header"
+	}
+	length := binary.LittleEndian.Uint32(data[4:8])
+	if uint64(len(data)-walHeaderSize) < uint64(length) {
+		return nil, 0, "truncated record payload"
+	}
+	size = walHeaderSize + int(length)
+	if crc32.Checksum(data[4:size], castagnoli) != binary.LittleEndian.Uint32(data[0:4]) {
+		return nil, 0, "record checksum mismatch"
+	}
+	return data[walHeaderSize:size], size, ""
+}
+
+// readWALString reads a length-prefixed string from the start of data
+func readWALString(data []byte) (string, []byte, bool) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return "", nil, false
+	}
+	end := n + int(length)
+	return string(data[n:end]), data[end:], true
+}
+
+// Clear deletes every WAL segment, effectively clearing its contents
 func (w *WAL) Clear() error {
-	// Check if the file exists before attempting to truncate it
-	if _, err := os.Stat(w.filePath); os.IsNotExist(err) {
-		// File doesn't exist, so there's nothing to clear
-		return nil
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	segments, err := listWALSegments(w.fs, w.dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to list WAL segments: %w", err)
 	}
-	return os.Truncate(w.filePath, 0)
+	for _, segment := range segments {
+		if err := w.fs.Remove(walSegmentPath(w.dataDir, segment)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove WAL segment: %w", err)
+		}
+	}
+	w.segment, w.ops, w.ends = 0, 0, nil
+	return nil
 }
@@ -0,0 +1,182 @@
+package lsmtree
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ReplayResult describes the archived WAL segments applied by ReplayWALArchive
+type ReplayResult struct {
+	Segments int       // archived segments read
+	Replayed int       // operations applied
+	Last     time.Time // time record of the last write applied, zero if none was
+}
+
+// archiveWALSegment moves a WAL segment whose writes are all in SSTables into the archive directory
+func archiveWALSegment(fsys FS, path, archiveDir string) error {
+	if err := fsys.MkdirAll(archiveDir); err != nil {
+		return fmt.Errorf("failed to create WAL archive: %w", err)
+	}
+	dst := filepath.Join(archiveDir, filepath.Base(path))
+	err := fsys.Rename(path, dst)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+
+	// Renaming fails across file systems, so copy the segment over instead
+	if err := copyFile(fsys, path, dst); err != nil {
+		fsys.Remove(dst)
+		return fmt.Errorf("failed to archive WAL segment: %w", err)
+	}
+	if err := fsys.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove archived WAL segment: %w", err)
+	}
+	return nil
+}
+
+// ReplayWALArchive brings the base backup in dataDir, written by Checkpoint, forward
+// to the point in time until by applying the writes of the WAL segments archived in
+// archiveDir (see Options.WALArchiveDir) that were logged up to then. A zero until
+// applies every archived write. Replay starts at the segment the backup's manifest
+// names as the first one not in its SSTables; the segments it needs are verified
+// before anything is written, and a gap in them fails the replay. The store's own
+// writes afterwards are logged in segments numbered after the archive's, but they
+// shouldn't be archived into the same directory, whose later segments belong to
+// the replaced history. key is the data key of an encrypted backup, whose archived
+// segments are encrypted too, and nil otherwise. The tree must not be open.
+func ReplayWALArchive(dataDir, archiveDir string, until time.Time, key []byte) (ReplayResult, error) {
+	var result ReplayResult
+
+	enc, err := loadEncryptor(OSFS{}, dataDir, key)
+	if err != nil {
+		return result, err
+	}
+
+	if _, exists, err := loadManifest(OSFS{}, dataDir); err != nil {
+		return result, err
+	} else if !exists {
+		return result, fmt.Errorf("%s is not a backup: it has no manifest", dataDir)
+	}
+	m, err := readManifest(OSFS{}, dataDir)
+	if err != nil {
+		return result, err
+	}
+	if live, err := listWALSegments(OSFS{}, dataDir); err != nil {
+		return result, fmt.Errorf("failed to list WAL segments: %w", err)
+	} else if len(live) > 0 {
+		return result, fmt.Errorf("%s has WAL segments of its own; replay needs a backup written by Checkpoint", dataDir)
+	}
+	paths, newest, err := selectArchivedSegments(archiveDir, m.LogSegment, until, enc)
+	if err != nil {
+		return result, err
+	}
+
+	// Start the store's own WAL after the archive's segments, whether replayed or not
+	if newest >= m.LogSegment {
+		m.LogSegment = newest + 1
+		if err := saveManifest(OSFS{}, dataDir, m); err != nil {
+			return result, err
+		}
+	}
+
+	tree := NewLSMTreeWithOptions(dataDir, Options{EncryptionKey: key})
+	if err := tree.Recover(); err != nil {
+		return result, err
+	}
+	for _, path := range paths {
+		batch := NewWriteBatch()
+		replay, err := replayWALSegment(OSFS{}, path, false, until, enc, func(key, value string) {
+			if value == "" {
+				batch.Delete(key)
+			} else {
+				batch.Set(key, value)
+			}
+		})
+		if err == nil && batch.Len() > 0 {
+			err = tree.writeBatch(context.Background(), batch.Ops(), true)
+		}
+		if err != nil {
+			tree.Close()
+			return result, fmt.Errorf("failed to replay archived WAL segment: %w", err)
+		}
+		result.Segments++
+		result.Replayed += replay.replayed
+		if replay.replayed > 0 {
+			result.Last = replay.last
+		}
+	}
+	return result, tree.Close()
+}
+
+// selectArchivedSegments verifies and returns the paths of the archived segments
+// replayed on top of a backup whose manifest names logSegment: the contiguous run
+// from logSegment up to the one that reaches until. It also returns the number of
+// the newest archived segment.
+func selectArchivedSegments(archiveDir string, logSegment uint64, until time.Time, enc *encryptor) ([]string, uint64, error) {
+	archived, err := listWALSegments(OSFS{}, archiveDir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list archived WAL segments: %w", err)
+	}
+	if len(archived) == 0 {
+		return nil, 0, nil
+	}
+
+	var paths []string
+	next := max(logSegment, 1)
+	for _, segment := range archived {
+		if segment < logSegment {
+			continue
+		}
+		if segment != next {
+			return nil, 0, fmt.Errorf("WAL archive is missing segment %d", next)
+		}
+		path := walSegmentPath(archiveDir, segment)
+		replay, err := replayWALSegment(OSFS{}, path, false, until, enc, func(key, value string) {})
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to verify archived WAL segment: %w", err)
+		}
+		paths = append(paths, path)
+		next++
+		if replay.stopped {
+			break
+		}
+	}
+	return paths, archived[len(archived)-1], nil
+}
+
+// WALArchiveDir returns the directory the tree archives its WAL segments in, empty
+// unless Options.WALArchiveDir was set
+func (l *LSMTree) WALArchiveDir() string {
+	return l.options.WALArchiveDir
+}
+
+// ArchivedWALSegments returns the numbers of the WAL segments archived in dir in order
+func ArchivedWALSegments(dir string) ([]uint64, error) {
+	segments, err := listWALSegments(OSFS{}, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archived WAL segments: %w", err)
+	}
+	return segments, nil
+}
+
+// WALSegmentName returns the file name of a WAL segment, the same in the data
+// directory and the archive
+func WALSegmentName(segment uint64) string {
+	return filepath.Base(walSegmentPath("", segment))
+}
+
+// CheckpointLogSegment returns the first WAL segment with writes a checkpoint in dir
+// doesn't hold, where ReplayWALArchive starts replaying on top of it
+func CheckpointLogSegment(dir string) (uint64, error) {
+	m, exists, err := loadManifest(OSFS{}, dir)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, fmt.Errorf("%s is not a backup: it has no manifest", dir)
+	}
+	return m.LogSegment, nil
+}
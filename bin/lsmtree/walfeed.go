@@ -0,0 +1,214 @@
+package lsmtree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// ErrChangesGone is returned when reading changes since a sequence number whose
+// WAL segment was already deleted, so changes after it may be missing
+var ErrChangesGone = errors.New("lsmtree: changes since this sequence number are no longer in the WAL")
+
+// WALChange is a committed write read back from the WAL by ReadChanges.
+//
+// Seq is the position of the write in the WAL: the segment number in the upper
+// 32 bits and the write's number within the segment in the lower ones. Sequence
+// numbers grow with every write and survive restarts, but they aren't contiguous.
+type WALChange struct {
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Type  EventType `json:"type"`
+	Key   string    `json:"key"`
+	Value string    `json:"value,omitempty"`
+}
+
+// walSegmentEnds is how many rotated segments the WAL remembers the length of, so
+// reading changes can resume at the end of a segment that's since been deleted
+const walSegmentEnds = 64
+
+// walSeq returns the sequence number of the nth write of a segment
+func walSeq(segment uint64, n uint64) uint64 {
+	return segment<<32 | n
+}
+
+// ReadChanges calls fn, in commit order, for every write logged after the sequence
+// number since, 0 for every write still in the WAL, and returns the sequence
+// number to resume from. Writes are read from the WAL segments not yet in SSTables
+// and, with Options.WALArchiveDir, from the archived ones, so without an archive
+// only the writes since the last flush can be read; if writes after since were
+// in a deleted segment, or since is past the last write, ReadChanges returns
+// ErrChangesGone. The returned sequence number moves past the segments read to
+// their end, so resuming doesn't need them to be kept. Internal records aren't
+// reported, and the values of encryption contexts are reported as stored,
+// encrypted. An error from fn stops the read.
+func (l *LSMTree) ReadChanges(since uint64, fn func(WALChange) error) (uint64, error) {
+	if l.options.InMemory {
+		return since, ErrInMemory
+	}
+	// Buffered writes are written out first, so every committed write is read
+	if err := l.wal.Sync(); err != nil {
+		return since, err
+	}
+	l.wal.mutex.Lock()
+	open, head := l.wal.segment, walSeq(l.wal.segment, l.wal.ops)
+	l.wal.mutex.Unlock()
+	if since > head {
+		return since, fmt.Errorf("%w: %d is past the last write, %d", ErrChangesGone, since, head)
+	}
+
+	segments, err := l.walSegmentNumbers()
+	if err != nil {
+		return since, err
+	}
+	oldest := open
+	if len(segments) > 0 {
+		oldest = segments[0]
+	}
+	if since > 0 && since>>32 < oldest && !l.wal.readTo(since, oldest) {
+		return since, fmt.Errorf("%w: %d, the oldest segment is %d", ErrChangesGone, since, oldest)
+	}
+
+	last := since
+	for _, segment := range segments {
+		if segment < since>>32 {
+			continue
+		}
+		path, data, err := l.readWALSegment(segment)
+		if err != nil {
+			return last, err
+		}
+		var n uint64
+		var fnErr error
+		// The open segment may end in a write that's still being logged
+		_, err = walkWALRecords(path, data, segment >= open, time.Time{}, l.wal.enc, func(key, value string, at time.Time) {
+			n++
+			seq := walSeq(segment, n)
+			if fnErr != nil || seq <= since || isReservedKey(key) {
+				return
+			}
+			change := WALChange{Seq: seq, Time: at, Type: EventSet, Key: key, Value: value}
+			if value == "" {
+				change.Type = EventDelete
+			}
+			if fnErr = fn(change); fnErr == nil {
+				last = seq
+			}
+		})
+		if err != nil {
+			return last, err
+		}
+		if fnErr != nil {
+			return last, fnErr
+		}
+	}
+	// Every segment before the open one was read to its end
+	return max(last, walSeq(open, 0)), nil
+}
+
+// ChangesHead returns the sequence number of the last write logged, as ReadChanges
+// numbers them. Reading the changes after it from a copy of the tree taken later
+// brings the copy up to date: the writes in between are applied again, but a
+// write sets a key to its value whatever came before.
+func (l *LSMTree) ChangesHead() uint64 {
+	l.wal.mutex.Lock()
+	defer l.wal.mutex.Unlock()
+	return walSeq(l.wal.segment, l.wal.ops)
+}
+
+// ApplyChanges applies changes read from another tree's ReadChanges in one batch,
+// even to a read-only tree, so a follower can be kept in step with its leader
+func (l *LSMTree) ApplyChanges(changes []WALChange) error {
+	ops := make([]BatchOp, 0, len(changes))
+	for _, change := range changes {
+		ops = append(ops, BatchOp{Key: change.Key, Value: change.Value, Delete: change.Type == EventDelete})
+	}
+	return l.writeBatch(context.Background(), ops, false)
+}
+
+// ApplySnapshot replaces every key of the tree with entries in one batch, even in
+// a read-only tree, leaving the keys that already have their value alone
+func (l *LSMTree) ApplySnapshot(entries map[string]string) error {
+	current, err := l.List()
+	if err != nil {
+		return err
+	}
+	var ops []BatchOp
+	for key, value := range entries {
+		if old, ok := current[key]; !ok || old != value {
+			ops = append(ops, BatchOp{Key: key, Value: value})
+		}
+	}
+	for key := range current {
+		if _, ok := entries[key]; !ok {
+			ops = append(ops, BatchOp{Key: key, Delete: true})
+		}
+	}
+	// Sorted, so the versions recorded for the batch don't depend on map order
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Key < ops[j].Key })
+	return l.writeBatch(context.Background(), ops, false)
+}
+
+// readTo reports whether since is the end of a deleted segment and only empty
+// segments were deleted after it, so no write after since is missing from the
+// segments from oldest on
+func (w *WAL) readTo(since, oldest uint64) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for segment := since >> 32; segment < oldest; segment++ {
+		n, ok := w.ends[segment]
+		if !ok || (segment == since>>32 && n != since&(1<<32-1)) || (segment > since>>32 && n != 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// walSegmentNumbers returns the numbers of the WAL segments in the data directory
+// and the archive, in order
+func (l *LSMTree) walSegmentNumbers() ([]uint64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	segments, err := listWALSegments(l.fs, l.dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+	if dir := l.options.WALArchiveDir; dir != "" {
+		archived, err := listWALSegments(l.fs, dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list archived WAL segments: %w", err)
+		}
+		segments = append(segments, archived...)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return slices.Compact(segments), nil
+}
+
+// readWALSegment reads a WAL segment from the data directory or, once it's been
+// archived, from the archive. The writer mutex is held while reading, so a flush
+// doesn't remove the segment halfway. A segment found in neither was removed
+// after its writes were flushed.
+func (l *LSMTree) readWALSegment(segment uint64) (string, []byte, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	paths := []string{walSegmentPath(l.dataDir, segment)}
+	if dir := l.options.WALArchiveDir; dir != "" {
+		paths = append(paths, walSegmentPath(dir, segment))
+	}
+	for _, path := range paths {
+		data, err := readFile(l.fs, path)
+		if err == nil {
+			return path, data, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", nil, fmt.Errorf("failed to read WAL: %w", err)
+		}
+	}
+	return "", nil, fmt.Errorf("%w: segment %d was flushed while it was read", ErrChangesGone, segment)
+}
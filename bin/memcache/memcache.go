@@ -0,0 +1,308 @@
+// Package memcache serves a Lockr store over the memcached text protocol, so
+// apps speaking memcached can use it as a persistent cache.
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"Lockr/bin/content"
+	"Lockr/bin/lsmtree"
+)
+
+// Flags of the stored values holding an item's memcached flags and when it
+// expires, in Unix seconds
+const (
+	flagsFlag   = "memcached-flags"
+	expiresFlag = "memcached-expires"
+)
+
+// Protocol limits, those of memcached
+const (
+	maxKeyLength = 250
+	maxItemSize  = 1024 * 1024
+	// maxRelativeExptime is the largest exptime taken as seconds from now rather
+	// than as a Unix time
+	maxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+// version is reported by the version command
+const version = "1.6.0-lockr"
+
+// errClient is a malformed command, answered with CLIENT_ERROR
+var errClient = errors.New("bad command line format")
+
+// Server serves the memcached text protocol for a store. Items are stored under
+// a key prefix, so they stay apart from the rest of the store, with their flags
+// and expiry in the header of the stored value. Expired items are misses, and
+// are deleted when they're next read.
+type Server struct {
+	store  lsmtree.Store
+	prefix string
+	now    func() time.Time
+
+	logger lsmtree.Logger // receives the errors of serving, set by SetLogger
+}
+
+// New creates a Server keeping items in store under prefix, e.g. "memcache/"
+func New(store lsmtree.Store, prefix string) *Server {
+	return &Server{store: store, prefix: prefix, now: time.Now, logger: slog.Default()}
+}
+
+// SetLogger sets the logger receiving the errors that stop serving, slog.Default()
+// by default
+func (s *Server) SetLogger(logger lsmtree.Logger) {
+	s.logger = logger
+}
+
+// Listen starts serving on addr in the background and returns the bound listener
+func (s *Server) Listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.logger.Error("memcached server stopped", "addr", listener.Addr().String(), "error", err)
+				}
+				return
+			}
+			go s.ServeConn(conn)
+		}
+	}()
+	return listener, nil
+}
+
+// ServeConn serves the commands of a connection until it's closed or quits
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			fmt.Fprint(w, "ERROR\r\n")
+		} else if fields[0] == "quit" {
+			w.Flush()
+			return
+		} else if err := s.command(r, w, fields); err != nil {
+			if errors.Is(err, errClient) {
+				fmt.Fprintf(w, "CLIENT_ERROR %v\r\n", err)
+			} else {
+				fmt.Fprintf(w, "SERVER_ERROR %v\r\n", err)
+			}
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// command runs a command, reading its data block from r for storage commands
+func (s *Server) command(r *bufio.Reader, w *bufio.Writer, fields []string) error {
+	noreply := len(fields) > 1 && fields[len(fields)-1] == "noreply"
+	if noreply {
+		fields = fields[:len(fields)-1]
+	}
+	reply := func(line string) {
+		if !noreply {
+			fmt.Fprint(w, line+"\r\n")
+		}
+	}
+
+	switch fields[0] {
+	case "get":
+		if len(fields) < 2 {
+			return errClient
+		}
+		for _, key := range fields[1:] {
+			data, flags, ok, err := s.get(key)
+			if err != nil {
+				return err
+			}
+			if ok {
+				fmt.Fprintf(w, "VALUE %s %d %d\r\n%s\r\n", key, flags, len(data), data)
+			}
+		}
+		fmt.Fprint(w, "END\r\n")
+		return nil
+
+	case "set":
+		if len(fields) != 5 {
+			return errClient
+		}
+		flags, err1 := strconv.ParseUint(fields[2], 10, 32)
+		exptime, err2 := strconv.ParseInt(fields[3], 10, 64)
+		size, err3 := strconv.Atoi(fields[4])
+		if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+			return errClient
+		}
+		data, err := readData(r, size)
+		if err != nil {
+			return err
+		}
+		if err := checkKey(fields[1]); err != nil {
+			return err
+		}
+		if size > maxItemSize {
+			return fmt.Errorf("object too large for cache")
+		}
+		if err := s.set(fields[1], data, uint32(flags), s.expiry(exptime)); err != nil {
+			return err
+		}
+		reply("STORED")
+		return nil
+
+	case "delete":
+		if len(fields) != 2 {
+			return errClient
+		}
+		if err := checkKey(fields[1]); err != nil {
+			return err
+		}
+		_, _, ok, err := s.get(fields[1])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			reply("NOT_FOUND")
+			return nil
+		}
+		if err := s.store.Delete(s.prefix + fields[1]); err != nil {
+			return err
+		}
+		reply("DELETED")
+		return nil
+
+	case "touch":
+		if len(fields) != 3 {
+			return errClient
+		}
+		exptime, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return errClient
+		}
+		if err := checkKey(fields[1]); err != nil {
+			return err
+		}
+		data, flags, ok, err := s.get(fields[1])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			reply("NOT_FOUND")
+			return nil
+		}
+		if err := s.set(fields[1], data, flags, s.expiry(exptime)); err != nil {
+			return err
+		}
+		reply("TOUCHED")
+		return nil
+
+	case "version":
+		fmt.Fprintf(w, "VERSION %s\r\n", version)
+		return nil
+
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+		return nil
+	}
+}
+
+// get returns the data and flags of an item, reporting false if there's none or
+// it has expired
+func (s *Server) get(key string) (string, uint32, bool, error) {
+	stored, err := s.store.Get(s.prefix + key)
+	if err != nil || stored == "" {
+		return "", 0, false, err
+	}
+	if raw, ok := content.Flag(stored, expiresFlag); ok {
+		expires, err := strconv.ParseInt(raw, 10, 64)
+		if err == nil && s.now().Unix() >= expires {
+			return "", 0, false, s.store.Delete(s.prefix + key)
+		}
+	}
+	data, _ := content.Unwrap(stored)
+	raw, _ := content.Flag(stored, flagsFlag)
+	flags, _ := strconv.ParseUint(raw, 10, 32)
+	return data, uint32(flags), true, nil
+}
+
+// set stores an item expiring at expires, never if it's zero
+func (s *Server) set(key, data string, flags uint32, expires time.Time) error {
+	if !expires.IsZero() && !s.now().Before(expires) {
+		// Already expired, as for a negative exptime
+		return s.store.Delete(s.prefix + key)
+	}
+	// The data gets an explicit type, so data that looks like a header isn't read
+	// as one, and even empty data has a non-empty stored value
+	stored := content.SetFlag(content.Wrap(data, content.Sniff(data)), flagsFlag, strconv.FormatUint(uint64(flags), 10))
+	if !expires.IsZero() {
+		stored = content.SetFlag(stored, expiresFlag, strconv.FormatInt(expires.Unix(), 10))
+	}
+	return s.store.Set(s.prefix+key, stored)
+}
+
+// expiry returns when an item with a memcached exptime expires: never for 0,
+// after that many seconds up to 30 days, and at that Unix time beyond
+func (s *Server) expiry(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return s.now()
+	case exptime <= maxRelativeExptime:
+		return s.now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+// readData reads the data block of a storage command: size bytes and a CRLF
+func readData(r *bufio.Reader, size int) (string, error) {
+	if size > maxItemSize {
+		// Skip the block so the connection stays in step
+		if _, err := r.Discard(size + 2); err != nil {
+			return "", err
+		}
+		return "", nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	if string(data[size:]) != "\r\n" {
+		return "", fmt.Errorf("%w: bad data chunk", errClient)
+	}
+	return string(data[:size]), nil
+}
+
+// checkKey checks that a key is valid in the protocol: at most 250 bytes,
+// without control characters
+func checkKey(key string) error {
+	if len(key) > maxKeyLength {
+		return fmt.Errorf("%w: key too long", errClient)
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return fmt.Errorf("%w: invalid key", errClient)
+		}
+	}
+	return nil
+}
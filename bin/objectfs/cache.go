@@ -0,0 +1,99 @@
+package objectfs
+
+import (
+	"container/list"
+	"sync"
+
+	"Lockr/bin/lsmtree"
+)
+
+// defaultCacheBytes is the default capacity in bytes of the block cache
+const defaultCacheBytes = 64 * 1024 * 1024 // 64MB
+
+// defaultBlockSize is the default size in bytes of the ranges read from the bucket
+const defaultBlockSize = 256 * 1024 // 256KB
+
+// blockKey identifies a block of an object by name, ETag and position. An object
+// written again has another ETag, so its old blocks are never hit and age out.
+type blockKey struct {
+	name  string
+	etag  string
+	index int64
+}
+
+// blockEntry is a block held by the cache
+type blockEntry struct {
+	key  blockKey
+	data []byte
+}
+
+// blockCache is an LRU cache of the blocks of objects read from the bucket,
+// bounded by their total size
+type blockCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // of *blockEntry, most recently used first
+	blocks   map[blockKey]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+// newBlockCache creates a block cache holding up to capacity bytes of blocks
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   make(map[blockKey]*list.Element),
+	}
+}
+
+// get returns a cached block. The returned slice must not be modified.
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.blocks[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.hits++
+		return elem.Value.(*blockEntry).data, true
+	}
+	c.misses++
+	return nil, false
+}
+
+// add caches a block, evicting the least recently used blocks to stay within capacity
+func (c *blockCache) add(key blockKey, data []byte) {
+	size := int64(len(data))
+	if size > c.capacity {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.blocks[key]; ok {
+		return
+	}
+	c.blocks[key] = c.lru.PushFront(&blockEntry{key: key, data: data})
+	c.size += size
+	for c.size > c.capacity {
+		entry := c.lru.Remove(c.lru.Back()).(*blockEntry)
+		delete(c.blocks, entry.key)
+		c.size -= int64(len(entry.data))
+	}
+}
+
+// stats returns a snapshot of the block cache counters
+func (c *blockCache) stats() lsmtree.BlockCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return lsmtree.BlockCacheStats{
+		Blocks:   c.lru.Len(),
+		Bytes:    c.size,
+		Capacity: c.capacity,
+		Hits:     c.hits,
+		Misses:   c.misses,
+	}
+}
@@ -0,0 +1,197 @@
+package objectfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"Lockr/bin/backup"
+)
+
+// leaseObject is the object of the bucket naming the writer that holds it
+const leaseObject = "LEASE"
+
+// defaultLeaseTTL is how long a lease lasts without being renewed by default
+const defaultLeaseTTL = 30 * time.Second
+
+// ErrLeaseLost is returned by the writes of an FS that lost the bucket's lease,
+// taken over by another writer or not renewed before it ran out
+var ErrLeaseLost = errors.New("objectfs: lost the bucket's lease")
+
+// ErrLeaseHeld is returned by Open while another writer holds the bucket's lease
+type ErrLeaseHeld struct {
+	Owner   string
+	Expires time.Time
+}
+
+func (e *ErrLeaseHeld) Error() string {
+	return fmt.Sprintf("objectfs: bucket is leased to %s until %s", e.Owner, e.Expires.Format(time.RFC3339))
+}
+
+// leaseRecord is the content of the lease object
+type leaseRecord struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// lease is the hold of an FS on its bucket. It's renewed in the background with
+// conditional writes, so a writer that took it over in between is noticed.
+type lease struct {
+	bucket Bucket
+	owner  string
+	ttl    time.Duration
+
+	mutex   sync.Mutex
+	etag    string    // of the lease object as last written
+	expires time.Time // when the hold runs out unless renewed
+	lost    bool
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// defaultOwner names this process in a lease: its host name and process ID
+func defaultOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// acquireLease takes the lease of a bucket unless another owner holds it and
+// it hasn't run out yet
+func acquireLease(bucket Bucket, owner string, ttl time.Duration) (*lease, error) {
+	ctx := context.Background()
+	var etag string
+	info, err := bucket.Stat(ctx, leaseObject)
+	switch {
+	case errors.Is(err, backup.ErrNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read lease: %w", err)
+	default:
+		holder, err := readLease(ctx, bucket)
+		if err != nil {
+			return nil, err
+		}
+		if holder.Owner != owner && time.Now().Before(holder.Expires) {
+			return nil, &ErrLeaseHeld{Owner: holder.Owner, Expires: holder.Expires}
+		}
+		etag = info.ETag
+	}
+
+	l := &lease{bucket: bucket, owner: owner, ttl: ttl, stop: make(chan struct{})}
+	if err := l.write(ctx, etag); errors.Is(err, backup.ErrPreconditionFailed) {
+		// Another writer took the lease since it was read
+		holder, _ := readLease(ctx, bucket)
+		return nil, &ErrLeaseHeld{Owner: holder.Owner, Expires: holder.Expires}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to write lease: %w", err)
+	}
+	l.done.Add(1)
+	go l.renew()
+	return l, nil
+}
+
+// readLease returns the content of the lease object
+func readLease(ctx context.Context, bucket Bucket) (leaseRecord, error) {
+	body, err := bucket.Get(ctx, leaseObject, 0, -1)
+	if err != nil {
+		return leaseRecord{}, fmt.Errorf("failed to read lease: %w", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return leaseRecord{}, fmt.Errorf("failed to read lease: %w", err)
+	}
+	var record leaseRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		// A lease nobody can read holds nothing back
+		return leaseRecord{}, nil
+	}
+	return record, nil
+}
+
+// write replaces the lease object if it still has the given ETag, extending the
+// hold. The expiry is taken before the write, so the hold never outlasts it.
+func (l *lease) write(ctx context.Context, etag string) error {
+	expires := time.Now().Add(l.ttl)
+	data, err := json.Marshal(leaseRecord{Owner: l.owner, Expires: expires})
+	if err != nil {
+		return err
+	}
+	etag, err = l.bucket.PutIf(ctx, leaseObject, data, etag)
+	if err != nil {
+		return err
+	}
+	l.etag, l.expires = etag, expires
+	return nil
+}
+
+// renew extends the lease every third of its duration until released or lost.
+// Failed renewals are retried; the hold runs out if they keep failing.
+func (l *lease) renew() {
+	defer l.done.Done()
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		l.mutex.Lock()
+		if err := l.write(context.Background(), l.etag); errors.Is(err, backup.ErrPreconditionFailed) {
+			l.lost = true
+		}
+		lost := l.lost
+		l.mutex.Unlock()
+		if lost {
+			return
+		}
+	}
+}
+
+// check returns ErrLeaseLost unless the lease is still held
+func (l *lease) check() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.lost || !time.Now().Before(l.expires) {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// release stops renewing the lease and removes the lease object, unless another
+// writer took it over
+func (l *lease) release() error {
+	close(l.stop)
+	l.done.Wait()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.lost {
+		return nil
+	}
+	l.lost = true
+	ctx := context.Background()
+	info, err := l.bucket.Stat(ctx, leaseObject)
+	if errors.Is(err, backup.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to release lease: %w", err)
+	}
+	if info.ETag != l.etag {
+		return nil
+	}
+	if err := l.bucket.Delete(ctx, leaseObject); err != nil {
+		return fmt.Errorf("failed to release lease: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,572 @@
+// Package objectfs is an lsmtree.FS keeping the SSTables and the manifest of a
+// tree in an object storage bucket, and its write-ahead log and other files on
+// local disk. SSTables are only written once, whole, so they map well onto
+// objects; the log is appended to on every write and stays local.
+//
+// A lease object in the bucket lets only one FS write to it at a time.
+package objectfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"Lockr/bin/backup"
+	"Lockr/bin/lsmtree"
+)
+
+// Bucket is the object storage an FS keeps files in, such as a backup.Bucket.
+// Names are slash-separated paths relative to its root.
+type Bucket interface {
+	// Get returns length bytes of an object from offset, or the rest of it if
+	// length is negative, or backup.ErrNotFound
+	Get(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+	// Stat describes an object, or returns backup.ErrNotFound
+	Stat(ctx context.Context, name string) (backup.ObjectInfo, error)
+	// Put uploads an object and returns its ETag
+	Put(ctx context.Context, name string, data []byte) (string, error)
+	// PutIf uploads an object only if it still has the given ETag, or doesn't
+	// exist for an empty one, or returns backup.ErrPreconditionFailed
+	PutIf(ctx context.Context, name string, data []byte, etag string) (string, error)
+	// List describes the objects whose name starts with prefix, at any depth
+	List(ctx context.Context, prefix string) ([]backup.ObjectInfo, error)
+	// Delete removes an object, if there is one
+	Delete(ctx context.Context, name string) error
+}
+
+var _ Bucket = (*backup.Bucket)(nil)
+
+var _ lsmtree.FS = (*FS)(nil)
+
+// Options configures an FS
+type Options struct {
+	CacheBytes int64         // capacity of the cache of blocks read from the bucket, 64MB if 0
+	BlockSize  int64         // size of the ranges read from the bucket, 256KB if 0
+	LeaseTTL   time.Duration // how long the lease lasts unless renewed, 30s if 0
+	Owner      string        // name of this writer in the lease, host:pid if empty
+	Local      lsmtree.FS    // file system of the local files, lsmtree.OSFS if nil
+}
+
+// FS keeps the SSTables and manifest of the tree of a data directory in a
+// bucket, and everything else in the data directory itself
+type FS struct {
+	bucket    Bucket
+	root      string // data directory, which names in the bucket are relative to
+	local     lsmtree.FS
+	blockSize int64
+	cache     *blockCache
+	lease     *lease
+}
+
+// Open returns an FS for the tree of dataDir, taking the bucket's lease. It
+// fails with *ErrLeaseHeld while another writer holds it.
+func Open(bucket Bucket, dataDir string, options Options) (*FS, error) {
+	if options.CacheBytes == 0 {
+		options.CacheBytes = defaultCacheBytes
+	}
+	if options.BlockSize == 0 {
+		options.BlockSize = defaultBlockSize
+	}
+	if options.LeaseTTL == 0 {
+		options.LeaseTTL = defaultLeaseTTL
+	}
+	if options.Owner == "" {
+		options.Owner = defaultOwner()
+	}
+	if options.Local == nil {
+		options.Local = lsmtree.OSFS{}
+	}
+
+	lease, err := acquireLease(bucket, options.Owner, options.LeaseTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{
+		bucket:    bucket,
+		root:      filepath.Clean(dataDir),
+		local:     options.Local,
+		blockSize: options.BlockSize,
+		cache:     newBlockCache(options.CacheBytes),
+		lease:     lease,
+	}, nil
+}
+
+// Close releases the bucket's lease. The tree must be closed first.
+func (f *FS) Close() error {
+	return f.lease.release()
+}
+
+// CacheStats returns a snapshot of the counters of the block cache
+func (f *FS) CacheStats() lsmtree.BlockCacheStats {
+	return f.cache.stats()
+}
+
+// remote returns the object name of a file kept in the bucket: the SSTables and
+// manifest files under the data directory
+func (f *FS) remote(name string) (string, bool) {
+	rel, err := filepath.Rel(f.root, filepath.Clean(name))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), isRemote(filepath.Base(rel))
+}
+
+// isRemote reports whether a file of the given base name is kept in the bucket
+func isRemote(base string) bool {
+	if strings.HasPrefix(base, "MANIFEST") {
+		return true
+	}
+	ok, _ := filepath.Match("sstable_*.dat", base)
+	return ok
+}
+
+// Open opens a file for reading
+func (f *FS) Open(name string) (lsmtree.File, error) {
+	key, ok := f.remote(name)
+	if !ok {
+		return f.local.Open(name)
+	}
+	info, err := f.bucket.Stat(context.Background(), key)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &remoteFile{fs: f, name: name, info: info}, nil
+}
+
+// Create creates a file for writing, truncating it if it exists. A file kept in
+// the bucket is uploaded when synced or closed.
+func (f *FS) Create(name string) (lsmtree.File, error) {
+	key, ok := f.remote(name)
+	if !ok {
+		return f.local.Create(name)
+	}
+	if err := f.lease.check(); err != nil {
+		return nil, pathError("create", name, err)
+	}
+	return &writeFile{fs: f, name: name, key: key, dirty: true}, nil
+}
+
+// Append opens a file for writing at its end, creating it if needed
+func (f *FS) Append(name string) (lsmtree.File, error) {
+	key, ok := f.remote(name)
+	if !ok {
+		return f.local.Append(name)
+	}
+	if err := f.lease.check(); err != nil {
+		return nil, pathError("open", name, err)
+	}
+	data, err := f.read(key)
+	if err != nil && !errors.Is(err, backup.ErrNotFound) {
+		return nil, pathError("open", name, err)
+	}
+	file := &writeFile{fs: f, name: name, key: key, dirty: err != nil}
+	file.data.Write(data)
+	return file, nil
+}
+
+// Rename replaces newname by oldname. Objects can't be renamed, so a file kept
+// in the bucket is copied and the copy replaces newname at once.
+func (f *FS) Rename(oldname, newname string) error {
+	oldKey, oldRemote := f.remote(oldname)
+	newKey, newRemote := f.remote(newname)
+	if !oldRemote && !newRemote {
+		return f.local.Rename(oldname, newname)
+	}
+	if err := f.lease.check(); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	var data []byte
+	var err error
+	if oldRemote {
+		data, err = f.read(oldKey)
+	} else {
+		data, err = readLocal(f.local, oldname)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: notExist(err)}
+	}
+	if newRemote {
+		err = f.put(newKey, data)
+	} else {
+		err = writeLocal(f.local, newname, data)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if oldRemote {
+		err = f.bucket.Delete(context.Background(), oldKey)
+	} else {
+		err = f.local.Remove(oldname)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+// Remove removes a file or an empty directory
+func (f *FS) Remove(name string) error {
+	key, ok := f.remote(name)
+	if !ok {
+		return f.local.Remove(name)
+	}
+	if err := f.lease.check(); err != nil {
+		return pathError("remove", name, err)
+	}
+	ctx := context.Background()
+	if _, err := f.bucket.Stat(ctx, key); err != nil {
+		return pathError("remove", name, err)
+	}
+	if err := f.bucket.Delete(ctx, key); err != nil {
+		return pathError("remove", name, err)
+	}
+	return nil
+}
+
+// RemoveAll removes a path and everything under it, including the files under
+// it kept in the bucket
+func (f *FS) RemoveAll(name string) error {
+	if err := f.local.RemoveAll(name); err != nil {
+		return err
+	}
+	prefix, ok := f.prefix(name)
+	if !ok {
+		return nil
+	}
+	ctx := context.Background()
+	objects, err := f.bucket.List(ctx, prefix)
+	if err != nil {
+		return pathError("removeall", name, err)
+	}
+	for _, object := range objects {
+		if object.Name != strings.TrimSuffix(prefix, "/") && !strings.HasPrefix(object.Name, prefix) {
+			// Another file whose name starts with the same characters
+			continue
+		}
+		if !isRemote(path.Base(object.Name)) {
+			continue
+		}
+		if err := f.lease.check(); err != nil {
+			return pathError("removeall", name, err)
+		}
+		if err := f.bucket.Delete(ctx, object.Name); err != nil {
+			return pathError("removeall", name, err)
+		}
+	}
+	return nil
+}
+
+// prefix returns the prefix of the names in the bucket of files under dir
+func (f *FS) prefix(dir string) (string, bool) {
+	rel, err := filepath.Rel(f.root, filepath.Clean(dir))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	if rel == "." {
+		return "", true
+	}
+	return filepath.ToSlash(rel) + "/", true
+}
+
+// List returns the entries of a directory sorted by name, those on local disk
+// and those kept in the bucket
+func (f *FS) List(dir string) ([]fs.FileInfo, error) {
+	infos, err := f.local.List(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	localErr := err
+	prefix, ok := f.prefix(dir)
+	if !ok {
+		return infos, localErr
+	}
+	objects, err := f.bucket.List(context.Background(), prefix)
+	if err != nil {
+		return nil, pathError("readdir", dir, err)
+	}
+	for _, object := range objects {
+		base := strings.TrimPrefix(object.Name, prefix)
+		if !strings.HasPrefix(object.Name, prefix) || strings.Contains(base, "/") || !isRemote(base) {
+			continue
+		}
+		infos = append(infos, &fileInfo{name: base, size: object.Size, modified: object.Modified})
+	}
+	if len(infos) == 0 && localErr != nil {
+		return nil, localErr
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Stat describes a file or directory
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	key, ok := f.remote(name)
+	if !ok {
+		return f.local.Stat(name)
+	}
+	info, err := f.bucket.Stat(context.Background(), key)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return &fileInfo{name: path.Base(key), size: info.Size, modified: info.Modified}, nil
+}
+
+// MkdirAll creates a directory and any missing parents on local disk; the
+// bucket has no directories
+func (f *FS) MkdirAll(dir string) error {
+	return f.local.MkdirAll(dir)
+}
+
+// Truncate changes the size of a file
+func (f *FS) Truncate(name string, size int64) error {
+	key, ok := f.remote(name)
+	if !ok {
+		return f.local.Truncate(name, size)
+	}
+	if err := f.lease.check(); err != nil {
+		return pathError("truncate", name, err)
+	}
+	data, err := f.read(key)
+	if err != nil {
+		return pathError("truncate", name, err)
+	}
+	if int64(len(data)) >= size {
+		data = data[:size]
+	} else {
+		data = append(data, make([]byte, size-int64(len(data)))...)
+	}
+	if err := f.put(key, data); err != nil {
+		return pathError("truncate", name, err)
+	}
+	return nil
+}
+
+// read downloads a whole object
+func (f *FS) read(key string) ([]byte, error) {
+	body, err := f.bucket.Get(context.Background(), key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// put uploads an object if the lease is still held
+func (f *FS) put(key string, data []byte) error {
+	if err := f.lease.check(); err != nil {
+		return err
+	}
+	_, err := f.bucket.Put(context.Background(), key, data)
+	return err
+}
+
+// readBlock returns a block of an object, from the cache if it holds it
+func (f *FS) readBlock(key string, info backup.ObjectInfo, index int64) ([]byte, error) {
+	cacheKey := blockKey{name: key, etag: info.ETag, index: index}
+	if info.ETag != "" {
+		if data, ok := f.cache.get(cacheKey); ok {
+			return data, nil
+		}
+	}
+	offset := index * f.blockSize
+	length := min(f.blockSize, info.Size-offset)
+	body, err := f.bucket.Get(context.Background(), key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("read %d bytes of block %d of %s, expected %d", len(data), index, key, length)
+	}
+	if info.ETag != "" {
+		f.cache.add(cacheKey, data)
+	}
+	return data, nil
+}
+
+// remoteFile is a file kept in the bucket opened for reading. It reads the
+// object as it was when opened, in blocks going through the cache.
+type remoteFile struct {
+	fs     *FS
+	name   string
+	info   backup.ObjectInfo
+	offset int64
+}
+
+// Read reads from the current offset
+func (r *remoteFile) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads len(p) bytes from off
+func (r *remoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, pathError("read", r.name, errors.New("negative offset"))
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.info.Size {
+			return n, io.EOF
+		}
+		index := pos / r.fs.blockSize
+		block, err := r.fs.readBlock(r.info.Name, r.info, index)
+		if err != nil {
+			return n, pathError("read", r.name, err)
+		}
+		n += copy(p[n:], block[pos-index*r.fs.blockSize:])
+	}
+	return n, nil
+}
+
+// Write fails, as the file is open for reading
+func (r *remoteFile) Write([]byte) (int, error) {
+	return 0, pathError("write", r.name, errors.New("file opened for reading"))
+}
+
+// Close closes the file
+func (r *remoteFile) Close() error {
+	return nil
+}
+
+// Stat describes the file
+func (r *remoteFile) Stat() (fs.FileInfo, error) {
+	return &fileInfo{name: path.Base(r.info.Name), size: r.info.Size, modified: r.info.Modified}, nil
+}
+
+// Sync does nothing, as the file is open for reading
+func (r *remoteFile) Sync() error {
+	return nil
+}
+
+// writeFile is a file kept in the bucket opened for writing. Its contents are
+// buffered and uploaded whole when synced, or when closed after a write.
+type writeFile struct {
+	fs    *FS
+	name  string
+	key   string
+	mutex sync.Mutex
+	data  bytes.Buffer
+	dirty bool
+}
+
+// Read fails, as the file is open for writing
+func (w *writeFile) Read([]byte) (int, error) {
+	return 0, pathError("read", w.name, errors.New("file opened for writing"))
+}
+
+// ReadAt fails, as the file is open for writing
+func (w *writeFile) ReadAt([]byte, int64) (int, error) {
+	return 0, pathError("read", w.name, errors.New("file opened for writing"))
+}
+
+// Write appends to the buffered contents
+func (w *writeFile) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.dirty = true
+	return w.data.Write(p)
+}
+
+// Close uploads the contents if they changed since the last sync
+func (w *writeFile) Close() error {
+	return w.Sync()
+}
+
+// Stat describes the file as it will be uploaded
+func (w *writeFile) Stat() (fs.FileInfo, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return &fileInfo{name: path.Base(w.key), size: int64(w.data.Len()), modified: time.Now()}, nil
+}
+
+// Sync uploads the contents if they changed since the last sync
+func (w *writeFile) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+	if err := w.fs.put(w.key, w.data.Bytes()); err != nil {
+		return pathError("sync", w.name, err)
+	}
+	w.dirty = false
+	return nil
+}
+
+// fileInfo describes a file kept in the bucket
+type fileInfo struct {
+	name     string
+	size     int64
+	modified time.Time
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() fs.FileMode  { return 0600 }
+func (i *fileInfo) ModTime() time.Time { return i.modified }
+func (i *fileInfo) IsDir() bool        { return false }
+func (i *fileInfo) Sys() any           { return nil }
+
+// pathError wraps an error of a file kept in the bucket, reporting a missing
+// object as fs.ErrNotExist
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: notExist(err)}
+}
+
+// notExist converts backup.ErrNotFound to fs.ErrNotExist, which the tree checks for
+func notExist(err error) error {
+	if errors.Is(err, backup.ErrNotFound) {
+		return fs.ErrNotExist
+	}
+	return err
+}
+
+// readLocal returns the contents of a local file
+func readLocal(fsys lsmtree.FS, name string) ([]byte, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// writeLocal creates or truncates a local file, writes data to it and syncs it
+func writeLocal(fsys lsmtree.FS, name string, data []byte) error {
+	file, err := fsys.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
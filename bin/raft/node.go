@@ -0,0 +1,958 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Defaults of Options
+const (
+	defaultHeartbeatInterval = 100 * time.Millisecond
+	defaultElectionTimeout   = time.Second
+	defaultSnapshotThreshold = 4096
+)
+
+// maxAppendEntries is the most entries sent in one AppendRequest
+const maxAppendEntries = 256
+
+// role is what a node does in its term
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case leader:
+		return "leader"
+	case candidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+// Options configures a Node
+type Options struct {
+	ID           string
+	Storage      Storage
+	StateMachine StateMachine
+	Transport    Transport
+	// Bootstrap gives the members, by ID with their addresses, of the cluster a
+	// node with an empty log starts. Every founding member is started with the same
+	// members; a node without them waits for the leader of a running cluster to add it.
+	Bootstrap map[string]string
+	// HeartbeatInterval is how often the leader contacts idle followers, 100ms if 0
+	HeartbeatInterval time.Duration
+	// ElectionTimeout is how long followers wait for the leader before electing
+	// another, picked at random up to twice that, 1s if 0
+	ElectionTimeout time.Duration
+	// SnapshotThreshold is how many applied entries are kept in the log before it's
+	// compacted, 4096 if 0
+	SnapshotThreshold uint64
+}
+
+// Status describes a node
+type Status struct {
+	ID            string        `json:"id"`
+	Role          string        `json:"role"` // leader, candidate or follower
+	Term          uint64        `json:"term"`
+	Leader        string        `json:"leader,omitempty"`
+	LeaderAddress string        `json:"leader_address,omitempty"`
+	Commit        uint64        `json:"commit"`
+	Applied       uint64        `json:"applied"`
+	LastIndex     uint64        `json:"last_index"`
+	Snapshot      uint64        `json:"snapshot"` // the last compacted entry
+	Config        Configuration `json:"config"`
+	Err           string        `json:"error,omitempty"` // why the node halted
+}
+
+// Node is a member of a Raft cluster
+type Node struct {
+	opts Options
+
+	// applyMutex is held while the state machine changes, before mutex when both are
+	applyMutex sync.Mutex
+
+	mutex       sync.Mutex
+	role        role
+	term        uint64
+	vote        string
+	leader      string
+	snap        SnapshotMeta
+	log         []Entry // the entries after snap.Index
+	config      Configuration
+	configIndex uint64 // the entry that set config, snap.Index if it came with the snapshot
+	commit      uint64
+	applied     uint64
+	lastContact time.Time // when the leader was last heard from
+	deadline    time.Time // when to start an election
+	err         error     // why the node halted
+
+	// The leader's state, reset on every election won
+	next        map[string]uint64
+	match       map[string]uint64
+	acked       map[string]time.Time     // when each follower last answered
+	wake        map[string]chan struct{} // wakes each follower's replicator
+	waiters     map[uint64]chan error    // proposals waiting to be applied, by index
+	stopLeading chan struct{}            // closed when leadership ends
+
+	appliedSignal chan struct{} // closed and replaced whenever entries are applied
+	applySignal   chan struct{} // wakes the apply loop
+	stop          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// Start starts a node with the log and state of its storage
+func Start(opts Options) (*Node, error) {
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if opts.ElectionTimeout <= 0 {
+		opts.ElectionTimeout = defaultElectionTimeout
+	}
+	if opts.SnapshotThreshold == 0 {
+		opts.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	state, snap, entries, err := opts.Storage.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load raft log: %w", err)
+	}
+	if len(entries) == 0 && snap.Index == 0 && opts.Bootstrap != nil {
+		if _, ok := opts.Bootstrap[opts.ID]; !ok {
+			return nil, fmt.Errorf("raft: %s isn't one of the members it bootstraps", opts.ID)
+		}
+		config := Configuration{Members: opts.Bootstrap}
+		entries = []Entry{{Index: 1, Term: 1, Type: EntryConfig, Config: &config}}
+		state = HardState{Term: 1}
+		if err := opts.Storage.Append(entries); err != nil {
+			return nil, fmt.Errorf("failed to bootstrap raft log: %w", err)
+		}
+		if err := opts.Storage.SetState(state); err != nil {
+			return nil, fmt.Errorf("failed to bootstrap raft state: %w", err)
+		}
+	}
+	applied, err := opts.StateMachine.Applied()
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		opts:          opts,
+		term:          state.Term,
+		vote:          state.Vote,
+		snap:          snap,
+		log:           entries,
+		applied:       max(applied, snap.Index),
+		appliedSignal: make(chan struct{}),
+		applySignal:   make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+	if applied < snap.Index {
+		return nil, fmt.Errorf("raft: the state machine is at %d, behind the log's snapshot at %d", applied, snap.Index)
+	}
+	if n.applied > n.lastIndex() {
+		return nil, fmt.Errorf("raft: the state machine is at %d, past the log's last entry %d", applied, n.lastIndex())
+	}
+	n.commit = n.applied
+	n.config, n.configIndex = n.latestConfig()
+	n.resetDeadline()
+
+	n.wg.Add(2)
+	go n.tick()
+	go n.applyLoop()
+	return n, nil
+}
+
+// Stop stops the node and waits for its work to end
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	select {
+	case <-n.stop:
+		n.mutex.Unlock()
+		return
+	default:
+	}
+	n.stepDown(n.term)
+	close(n.stop)
+	n.mutex.Unlock()
+	n.wg.Wait()
+}
+
+// Status describes the node
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	status := Status{
+		ID:        n.opts.ID,
+		Role:      n.role.String(),
+		Term:      n.term,
+		Leader:    n.leader,
+		Commit:    n.commit,
+		Applied:   n.applied,
+		LastIndex: n.lastIndex(),
+		Snapshot:  n.snap.Index,
+		Config:    n.config.clone(),
+	}
+	status.LeaderAddress, _ = n.config.address(n.leader)
+	if n.err != nil {
+		status.Err = n.err.Error()
+	}
+	return status
+}
+
+// Propose appends a command to the log and returns once it's applied to the
+// state machine of this node. A follower forwards the command to its leader.
+func (n *Node) Propose(ctx context.Context, command []byte) error {
+	if command == nil {
+		command = []byte{}
+	}
+	_, err := n.propose(ctx, command, true)
+	return err
+}
+
+// Barrier returns once this node has applied every command committed before it
+// was called, so reads of the state machine after it are linearizable
+func (n *Node) Barrier(ctx context.Context) error {
+	_, err := n.propose(ctx, nil, true)
+	return err
+}
+
+// propose appends a command, nil for a noop, on the leader and waits for this
+// node to apply it. A follower forwards it to the leader if forward is set.
+func (n *Node) propose(ctx context.Context, command []byte, forward bool) (uint64, error) {
+	n.mutex.Lock()
+	if err := n.stopped(); err != nil {
+		n.mutex.Unlock()
+		return 0, err
+	}
+	if n.role != leader {
+		addr, ok := n.config.address(n.leader)
+		n.mutex.Unlock()
+		if !forward {
+			return 0, ErrNotLeader
+		}
+		if !ok {
+			return 0, ErrNoLeader
+		}
+		index, err := n.opts.Transport.Propose(ctx, addr, command)
+		if err != nil {
+			return 0, err
+		}
+		return index, n.waitApplied(ctx, index)
+	}
+
+	entry := Entry{Type: EntryCommand, Data: command}
+	if command == nil {
+		entry.Type = EntryNoop
+	}
+	index, err := n.appendLocked(entry)
+	if err != nil {
+		n.mutex.Unlock()
+		return 0, err
+	}
+	done := make(chan error, 1)
+	n.waiters[index] = done
+	n.mutex.Unlock()
+
+	select {
+	case err := <-done:
+		return index, err
+	case <-ctx.Done():
+		n.mutex.Lock()
+		delete(n.waiters, index)
+		n.mutex.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+// ChangeMembers replaces the members of the cluster by those given, by ID with
+// their addresses, and returns once the change is committed. The cluster goes
+// through the joint configuration of the old and new members, so it stays
+// available throughout if majorities of both are up. A follower forwards the
+// change to its leader; a leader that isn't one of the new members steps down
+// once the change is committed.
+func (n *Node) ChangeMembers(ctx context.Context, members map[string]string) error {
+	if len(members) == 0 {
+		return errors.New("raft: a cluster needs a member")
+	}
+	n.mutex.Lock()
+	if err := n.stopped(); err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+	if n.role != leader {
+		addr, ok := n.config.address(n.leader)
+		n.mutex.Unlock()
+		if !ok {
+			return ErrNoLeader
+		}
+		return n.opts.Transport.ChangeMembers(ctx, addr, members)
+	}
+	if n.config.Joint() || n.configIndex > n.commit {
+		n.mutex.Unlock()
+		return ErrChangeInProgress
+	}
+	joint := Configuration{Members: members, Old: n.config.Members}
+	joint = joint.clone()
+	index, err := n.appendLocked(Entry{Type: EntryConfig, Config: &joint})
+	if err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+	term := n.term
+	n.mutex.Unlock()
+
+	// The leader appends the final configuration once the joint one is committed
+	for {
+		n.mutex.Lock()
+		if n.configIndex > index && !n.config.Joint() && n.commit >= n.configIndex {
+			n.mutex.Unlock()
+			return nil
+		}
+		if n.term != term || n.role != leader {
+			n.mutex.Unlock()
+			return ErrLeadershipLost
+		}
+		signal := n.appliedSignal
+		n.mutex.Unlock()
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.stop:
+			return ErrStopped
+		}
+	}
+}
+
+// HandleVote answers a candidate's VoteRequest
+func (n *Node) HandleVote(req VoteRequest) VoteResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	// A node in touch with its leader ignores candidates, so a node removed from the
+	// cluster or cut off for a while can't disrupt it
+	if n.role == leader || (n.leader != "" && time.Since(n.lastContact) < n.opts.ElectionTimeout) {
+		return VoteResponse{Term: n.term}
+	}
+	if req.Term < n.term {
+		return VoteResponse{Term: n.term}
+	}
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	upToDate := req.LastTerm > n.lastTerm() || (req.LastTerm == n.lastTerm() && req.LastIndex >= n.lastIndex())
+	if (n.vote != "" && n.vote != req.Candidate) || !upToDate {
+		return VoteResponse{Term: n.term}
+	}
+	n.vote = req.Candidate
+	if err := n.saveState(); err != nil {
+		return VoteResponse{Term: n.term}
+	}
+	n.resetDeadline()
+	return VoteResponse{Term: n.term, Granted: true}
+}
+
+// HandleAppend stores the leader's entries following those the node has
+func (n *Node) HandleAppend(req AppendRequest) (AppendResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if err := n.stopped(); err != nil {
+		return AppendResponse{}, err
+	}
+	if req.Term < n.term {
+		return AppendResponse{Term: n.term}, nil
+	}
+	n.heardFrom(req.Term, req.Leader)
+
+	// Entries up to the snapshot are committed, so they match the leader's
+	entries := req.Entries
+	if req.PrevIndex < n.snap.Index {
+		skip := min(n.snap.Index-req.PrevIndex, uint64(len(entries)))
+		entries = entries[skip:]
+		req.PrevIndex, req.PrevTerm = n.snap.Index, n.snap.Term
+	}
+	if req.PrevIndex > n.lastIndex() {
+		return AppendResponse{Term: n.term, LastIndex: n.lastIndex()}, nil
+	}
+	if term, _ := n.termAt(req.PrevIndex); term != req.PrevTerm {
+		return AppendResponse{Term: n.term, LastIndex: req.PrevIndex - 1}, nil
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= n.lastIndex() {
+			if term, _ := n.termAt(entry.Index); term == entry.Term {
+				continue
+			}
+			if entry.Index <= n.commit {
+				return AppendResponse{}, n.fail(fmt.Errorf("raft: leader %s conflicts with committed entry %d", req.Leader, entry.Index))
+			}
+			if err := n.opts.Storage.Truncate(entry.Index); err != nil {
+				return AppendResponse{}, n.fail(fmt.Errorf("failed to truncate raft log: %w", err))
+			}
+			n.log = n.log[:entry.Index-n.snap.Index-1]
+		}
+		rest := entries[i:]
+		if err := n.opts.Storage.Append(rest); err != nil {
+			return AppendResponse{}, n.fail(fmt.Errorf("failed to append to raft log: %w", err))
+		}
+		n.log = append(n.log, rest...)
+		n.config, n.configIndex = n.latestConfig()
+		break
+	}
+
+	if last := req.PrevIndex + uint64(len(entries)); req.Commit > n.commit && last > n.commit {
+		n.commit = min(req.Commit, last)
+		n.signalApply()
+	}
+	return AppendResponse{Term: n.term, Success: true, LastIndex: n.lastIndex()}, nil
+}
+
+// HandleSnapshot replaces the state machine with the leader's snapshot
+func (n *Node) HandleSnapshot(req SnapshotRequest) (SnapshotResponse, error) {
+	n.mutex.Lock()
+	if err := n.stopped(); err != nil {
+		n.mutex.Unlock()
+		return SnapshotResponse{}, err
+	}
+	if req.Term < n.term {
+		defer n.mutex.Unlock()
+		return SnapshotResponse{Term: n.term}, nil
+	}
+	n.heardFrom(req.Term, req.Leader)
+	n.mutex.Unlock()
+
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if req.Meta.Index <= n.applied {
+		return SnapshotResponse{Term: n.term}, nil
+	}
+	n.mutex.Unlock()
+	err := n.opts.StateMachine.Restore(req.Meta.Index, req.Data)
+	n.mutex.Lock()
+	if err != nil {
+		return SnapshotResponse{}, n.fail(fmt.Errorf("failed to restore snapshot: %w", err))
+	}
+
+	// Entries after the snapshot are kept if the log agrees with it
+	if term, ok := n.termAt(req.Meta.Index); ok && term == req.Meta.Term {
+		n.log = append([]Entry(nil), n.log[req.Meta.Index-n.snap.Index:]...)
+	} else {
+		if err := n.opts.Storage.Truncate(n.snap.Index + 1); err != nil {
+			return SnapshotResponse{}, n.fail(fmt.Errorf("failed to truncate raft log: %w", err))
+		}
+		n.log = nil
+	}
+	if err := n.opts.Storage.Compact(req.Meta); err != nil {
+		return SnapshotResponse{}, n.fail(fmt.Errorf("failed to compact raft log: %w", err))
+	}
+	n.snap = req.Meta
+	n.config, n.configIndex = n.latestConfig()
+	n.applied = req.Meta.Index
+	n.commit = max(n.commit, req.Meta.Index)
+	n.signalApplied()
+	return SnapshotResponse{Term: n.term}, nil
+}
+
+// heardFrom follows the leader of a request in term, which is at least the node's
+func (n *Node) heardFrom(term uint64, leaderID string) {
+	if term > n.term || n.role != follower {
+		n.stepDown(term)
+	}
+	n.leader = leaderID
+	n.lastContact = time.Now()
+	n.resetDeadline()
+}
+
+// tick starts elections when the leader is silent, and makes a leader that lost
+// touch with its majority step down
+func (n *Node) tick() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.opts.HeartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.stop:
+			return
+		}
+		n.mutex.Lock()
+		now := time.Now()
+		switch {
+		case n.err != nil:
+		case n.role == leader:
+			if !n.config.quorum(func(id string) bool {
+				return id == n.opts.ID || now.Sub(n.acked[id]) < n.opts.ElectionTimeout
+			}) {
+				n.stepDown(n.term)
+			}
+		case now.After(n.deadline) && n.config.has(n.opts.ID):
+			n.startElection()
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// startElection asks the voters to make the node the leader of a new term
+func (n *Node) startElection() {
+	n.role = candidate
+	n.term++
+	n.vote = n.opts.ID
+	n.leader = ""
+	if err := n.saveState(); err != nil {
+		return
+	}
+	n.resetDeadline()
+
+	term, config := n.term, n.config.clone()
+	req := VoteRequest{Term: term, Candidate: n.opts.ID, LastIndex: n.lastIndex(), LastTerm: n.lastTerm()}
+	votes := map[string]bool{n.opts.ID: true}
+	if config.quorum(func(id string) bool { return votes[id] }) {
+		n.becomeLeader()
+		return
+	}
+	for _, id := range config.voters() {
+		if id == n.opts.ID {
+			continue
+		}
+		addr, _ := config.address(id)
+		go func(id, addr string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.opts.ElectionTimeout)
+			defer cancel()
+			resp, err := n.opts.Transport.RequestVote(ctx, addr, req)
+			if err != nil {
+				return
+			}
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			if n.stopped() != nil {
+				return
+			}
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.term != term || n.role != candidate || !resp.Granted {
+				return
+			}
+			votes[id] = true
+			if config.quorum(func(id string) bool { return votes[id] }) {
+				n.becomeLeader()
+			}
+		}(id, addr)
+	}
+}
+
+// becomeLeader takes the lead of the node's term, appending a noop whose commit
+// commits the entries of earlier terms
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leader = n.opts.ID
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.acked = make(map[string]time.Time)
+	n.wake = make(map[string]chan struct{})
+	n.waiters = make(map[uint64]chan error)
+	n.stopLeading = make(chan struct{})
+	n.startReplicators()
+	n.appendLocked(Entry{Type: EntryNoop})
+}
+
+// stepDown makes the node a follower of term, ending its leadership
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+		n.leader = ""
+		n.saveState()
+	}
+	if n.role == leader {
+		close(n.stopLeading)
+		for index, done := range n.waiters {
+			done <- ErrLeadershipLost
+			delete(n.waiters, index)
+		}
+		n.leader = ""
+	}
+	n.role = follower
+	n.resetDeadline()
+}
+
+// startReplicators starts replicating the log to the voters without a replicator
+func (n *Node) startReplicators() {
+	now := time.Now()
+	for _, id := range n.config.voters() {
+		if _, ok := n.wake[id]; ok || id == n.opts.ID {
+			continue
+		}
+		n.next[id] = n.lastIndex() + 1
+		n.acked[id] = now
+		n.wake[id] = make(chan struct{}, 1)
+		n.wg.Add(1)
+		go n.replicate(id, n.term, n.wake[id], n.stopLeading)
+	}
+}
+
+// appendLocked appends an entry of the leader's term and wakes the replicators
+func (n *Node) appendLocked(entry Entry) (uint64, error) {
+	entry.Index, entry.Term = n.lastIndex()+1, n.term
+	if err := n.opts.Storage.Append([]Entry{entry}); err != nil {
+		return 0, n.fail(fmt.Errorf("failed to append to raft log: %w", err))
+	}
+	n.log = append(n.log, entry)
+	if entry.Type == EntryConfig {
+		n.config, n.configIndex = *entry.Config, entry.Index
+		n.startReplicators()
+	}
+	for _, wake := range n.wake {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	n.advanceCommit()
+	return entry.Index, nil
+}
+
+// replicate sends the log to a follower for as long as the node leads term
+func (n *Node) replicate(id string, term uint64, wake <-chan struct{}, stop <-chan struct{}) {
+	defer n.wg.Done()
+	heartbeat := time.NewTicker(n.opts.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		more, ok := n.replicateOnce(id, term)
+		if !ok {
+			return
+		}
+		if more {
+			continue
+		}
+		select {
+		case <-wake:
+		case <-heartbeat.C:
+		case <-stop:
+			return
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// replicateOnce sends a follower the entries it's missing, or the state machine's
+// snapshot if they were compacted. It reports whether more are to be sent, and
+// false for ok once the node no longer leads term or the follower was removed.
+func (n *Node) replicateOnce(id string, term uint64) (more, ok bool) {
+	n.mutex.Lock()
+	addr, member := n.config.address(id)
+	if n.role != leader || n.term != term || n.err != nil || !member {
+		if n.role == leader && n.term == term && !member {
+			delete(n.wake, id)
+		}
+		n.mutex.Unlock()
+		return false, false
+	}
+	next := n.next[id]
+	if next <= n.snap.Index {
+		n.mutex.Unlock()
+		return n.sendSnapshot(id, addr, term)
+	}
+	prevTerm, _ := n.termAt(next - 1)
+	last := min(n.lastIndex(), next-1+maxAppendEntries)
+	req := AppendRequest{
+		Term:      term,
+		Leader:    n.opts.ID,
+		PrevIndex: next - 1,
+		PrevTerm:  prevTerm,
+		Entries:   append([]Entry(nil), n.log[next-n.snap.Index-1:last-n.snap.Index]...),
+		Commit:    n.commit,
+	}
+	n.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.opts.ElectionTimeout)
+	resp, err := n.opts.Transport.AppendEntries(ctx, addr, req)
+	cancel()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.role != leader || n.term != term {
+		return false, false
+	}
+	if err != nil {
+		return false, true
+	}
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return false, false
+	}
+	n.acked[id] = time.Now()
+	if !resp.Success {
+		n.next[id] = max(1, min(next-1, resp.LastIndex+1))
+		return true, true
+	}
+	n.match[id] = max(n.match[id], last)
+	n.next[id] = n.match[id] + 1
+	n.advanceCommit()
+	return n.next[id] <= n.lastIndex(), true
+}
+
+// sendSnapshot sends a follower the state machine's snapshot
+func (n *Node) sendSnapshot(id, addr string, term uint64) (more, ok bool) {
+	n.applyMutex.Lock()
+	n.mutex.Lock()
+	meta := n.metaAt(n.applied)
+	n.mutex.Unlock()
+	data, err := n.opts.StateMachine.Snapshot()
+	n.applyMutex.Unlock()
+	if err != nil {
+		return false, true
+	}
+
+	req := SnapshotRequest{Term: term, Leader: n.opts.ID, Meta: meta, Data: data}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*n.opts.ElectionTimeout)
+	resp, err := n.opts.Transport.InstallSnapshot(ctx, addr, req)
+	cancel()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.role != leader || n.term != term {
+		return false, false
+	}
+	if err != nil {
+		return false, true
+	}
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return false, false
+	}
+	n.acked[id] = time.Now()
+	n.match[id] = max(n.match[id], meta.Index)
+	n.next[id] = n.match[id] + 1
+	n.advanceCommit()
+	return n.next[id] <= n.lastIndex(), true
+}
+
+// advanceCommit commits the entries of the leader's term stored by a quorum, and
+// moves a committed membership change on
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commit; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			break
+		}
+		if n.config.quorum(func(id string) bool {
+			return (id == n.opts.ID && n.lastIndex() >= index) || n.match[id] >= index
+		}) {
+			n.commit = index
+			n.signalApply()
+			break
+		}
+	}
+	if n.configIndex > n.commit {
+		return
+	}
+	if n.config.Joint() {
+		final := Configuration{Members: n.config.Members}
+		n.appendLocked(Entry{Type: EntryConfig, Config: &final})
+	} else if !n.config.has(n.opts.ID) {
+		n.stepDown(n.term)
+	}
+}
+
+// applyLoop applies the committed entries to the state machine
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.applySignal:
+		case <-n.stop:
+			return
+		}
+		for n.applyCommitted() {
+		}
+		n.compact()
+	}
+}
+
+// applyCommitted applies a run of committed entries and reports whether more are left
+func (n *Node) applyCommitted() bool {
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+	n.mutex.Lock()
+	if n.err != nil || n.applied >= n.commit {
+		n.mutex.Unlock()
+		return false
+	}
+	first, last := n.applied+1, min(n.commit, n.applied+maxAppendEntries)
+	entries := append([]Entry(nil), n.log[first-n.snap.Index-1:last-n.snap.Index]...)
+	n.mutex.Unlock()
+
+	for _, entry := range entries {
+		if entry.Type == EntryCommand {
+			if err := n.opts.StateMachine.Apply(entry.Index, entry.Data); err != nil {
+				n.mutex.Lock()
+				n.fail(fmt.Errorf("failed to apply entry %d: %w", entry.Index, err))
+				n.mutex.Unlock()
+				return false
+			}
+		}
+		n.mutex.Lock()
+		n.applied = entry.Index
+		if done, ok := n.waiters[entry.Index]; ok {
+			done <- nil
+			delete(n.waiters, entry.Index)
+		}
+		n.signalApplied()
+		n.mutex.Unlock()
+	}
+	return true
+}
+
+// compact drops the applied entries from the log once there are enough of them,
+// up to the last one the state machine stored durably
+func (n *Node) compact() {
+	n.mutex.Lock()
+	due := n.applied-n.snap.Index >= n.opts.SnapshotThreshold
+	n.mutex.Unlock()
+	if !due {
+		return
+	}
+	applied, err := n.opts.StateMachine.Applied()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if err != nil || applied <= n.snap.Index || applied > n.applied {
+		return
+	}
+	meta := n.metaAt(applied)
+	if err := n.opts.Storage.Compact(meta); err != nil {
+		n.fail(fmt.Errorf("failed to compact raft log: %w", err))
+		return
+	}
+	n.log = append([]Entry(nil), n.log[applied-n.snap.Index:]...)
+	n.snap = meta
+}
+
+// waitApplied waits until the node has applied the entry at index
+func (n *Node) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		n.mutex.Lock()
+		if err := n.stopped(); err != nil {
+			n.mutex.Unlock()
+			return err
+		}
+		if n.applied >= index {
+			n.mutex.Unlock()
+			return nil
+		}
+		signal := n.appliedSignal
+		n.mutex.Unlock()
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// signalApply wakes the apply loop
+func (n *Node) signalApply() {
+	select {
+	case n.applySignal <- struct{}{}:
+	default:
+	}
+}
+
+// signalApplied wakes those waiting for entries to be applied
+func (n *Node) signalApplied() {
+	close(n.appliedSignal)
+	n.appliedSignal = make(chan struct{})
+}
+
+// fail halts the node on an error it can't recover from
+func (n *Node) fail(err error) error {
+	if n.err == nil {
+		n.err = err
+		n.stepDown(n.term)
+		n.signalApplied()
+	}
+	return err
+}
+
+// stopped returns why the node no longer works, if it doesn't
+func (n *Node) stopped() error {
+	if n.err != nil {
+		return n.err
+	}
+	select {
+	case <-n.stop:
+		return ErrStopped
+	default:
+		return nil
+	}
+}
+
+// saveState stores the term and vote, halting the node if that fails
+func (n *Node) saveState() error {
+	if err := n.opts.Storage.SetState(HardState{Term: n.term, Vote: n.vote}); err != nil {
+		return n.fail(fmt.Errorf("failed to save raft state: %w", err))
+	}
+	return nil
+}
+
+// resetDeadline picks when to start an election if the leader stays silent
+func (n *Node) resetDeadline() {
+	timeout := n.opts.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + time.Duration(rand.Int63n(int64(timeout))))
+}
+
+// lastIndex returns the index of the last entry of the log
+func (n *Node) lastIndex() uint64 {
+	return n.snap.Index + uint64(len(n.log))
+}
+
+// lastTerm returns the term of the last entry of the log
+func (n *Node) lastTerm() uint64 {
+	term, _ := n.termAt(n.lastIndex())
+	return term
+}
+
+// termAt returns the term of the entry at index, if it's in the log or the snapshot
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	switch {
+	case index == n.snap.Index:
+		return n.snap.Term, true
+	case index < n.snap.Index || index > n.lastIndex():
+		return 0, false
+	default:
+		return n.log[index-n.snap.Index-1].Term, true
+	}
+}
+
+// latestConfig returns the last configuration of the log, which is in effect
+// whether it's committed or not, and the index of its entry
+func (n *Node) latestConfig() (Configuration, uint64) {
+	return n.configAt(n.lastIndex())
+}
+
+// configAt returns the configuration in effect at index and the index of its entry
+func (n *Node) configAt(index uint64) (Configuration, uint64) {
+	for i := index; i > n.snap.Index; i-- {
+		if entry := n.log[i-n.snap.Index-1]; entry.Type == EntryConfig {
+			return entry.Config.clone(), i
+		}
+	}
+	return n.snap.Config.clone(), n.snap.Index
+}
+
+// metaAt describes a snapshot of the state machine taken at index
+func (n *Node) metaAt(index uint64) SnapshotMeta {
+	term, _ := n.termAt(index)
+	config, _ := n.configAt(index)
+	return SnapshotMeta{Index: index, Term: term, Config: config}
+}
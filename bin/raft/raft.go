@@ -0,0 +1,165 @@
+// Package raft replicates a log of commands over a cluster of nodes with the Raft
+// consensus algorithm: leader election, log replication, membership changes
+// through joint configurations and log compaction behind the state machine's
+// snapshots. Each node applies the committed commands, those stored by a
+// majority, to its StateMachine in log order.
+package raft
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	// ErrNotLeader is returned for the leader's work asked of another node
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrNoLeader is returned when no leader is known to forward a proposal to
+	ErrNoLeader = errors.New("raft: no leader is known")
+	// ErrLeadershipLost is returned for a proposal whose leader stepped down before
+	// committing it; the command may still be committed by the next leader
+	ErrLeadershipLost = errors.New("raft: leadership lost before the proposal was applied")
+	// ErrChangeInProgress is returned when changing the members while an earlier change isn't committed
+	ErrChangeInProgress = errors.New("raft: a membership change is in progress")
+	// ErrStopped is returned once the node is stopped
+	ErrStopped = errors.New("raft: node stopped")
+)
+
+// EntryType tells the entries of the log apart
+type EntryType uint8
+
+const (
+	// EntryCommand holds a command for the state machine
+	EntryCommand EntryType = iota
+	// EntryNoop is appended by a new leader and by read barriers, and applies nothing
+	EntryNoop
+	// EntryConfig changes the members of the cluster
+	EntryConfig
+)
+
+// Entry is an entry of the replicated log
+type Entry struct {
+	Index  uint64         `json:"index"`
+	Term   uint64         `json:"term"`
+	Type   EntryType      `json:"type"`
+	Data   []byte         `json:"data,omitempty"`   // the command of an EntryCommand
+	Config *Configuration `json:"config,omitempty"` // the members set by an EntryConfig
+}
+
+// Configuration is the membership of the cluster: the addresses of the voting
+// nodes by ID. During a change Old holds the members being replaced, and
+// elections and commits need a majority of both, the joint configuration of the
+// Raft paper, until the configuration without Old is committed.
+type Configuration struct {
+	Members map[string]string `json:"members"`
+	Old     map[string]string `json:"old,omitempty"`
+}
+
+// Joint reports whether the configuration is the joint one of a membership change
+func (c Configuration) Joint() bool {
+	return c.Old != nil
+}
+
+// has reports whether id votes in the configuration
+func (c Configuration) has(id string) bool {
+	_, inNew := c.Members[id]
+	_, inOld := c.Old[id]
+	return inNew || inOld
+}
+
+// address returns the address of a voter
+func (c Configuration) address(id string) (string, bool) {
+	if addr, ok := c.Members[id]; ok {
+		return addr, true
+	}
+	addr, ok := c.Old[id]
+	return addr, ok
+}
+
+// voters returns the IDs of the voters, sorted
+func (c Configuration) voters() []string {
+	ids := make([]string, 0, len(c.Members)+len(c.Old))
+	for id := range c.Members {
+		ids = append(ids, id)
+	}
+	for id := range c.Old {
+		if _, ok := c.Members[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// quorum reports whether the voters for which agreed returns true are a
+// majority of the members and, in a joint configuration, of the old members
+func (c Configuration) quorum(agreed func(id string) bool) bool {
+	majority := func(members map[string]string) bool {
+		n := 0
+		for id := range members {
+			if agreed(id) {
+				n++
+			}
+		}
+		return n > len(members)/2
+	}
+	return majority(c.Members) && (c.Old == nil || majority(c.Old))
+}
+
+// clone returns a copy of the configuration that shares no maps with it
+func (c Configuration) clone() Configuration {
+	copyMembers := func(members map[string]string) map[string]string {
+		if members == nil {
+			return nil
+		}
+		copied := make(map[string]string, len(members))
+		for id, addr := range members {
+			copied[id] = addr
+		}
+		return copied
+	}
+	return Configuration{Members: copyMembers(c.Members), Old: copyMembers(c.Old)}
+}
+
+// HardState is the state a node must keep across restarts besides its log
+type HardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"` // the candidate voted for in Term
+}
+
+// SnapshotMeta describes the state machine's snapshot that replaces the entries up
+// to Index once the log is compacted
+type SnapshotMeta struct {
+	Index  uint64        `json:"index"`
+	Term   uint64        `json:"term"`
+	Config Configuration `json:"config"`
+}
+
+// Storage keeps a node's log and state. Every method must have made its change
+// durable when it returns.
+type Storage interface {
+	// Load returns the state, the snapshot replacing the compacted entries and the entries after it
+	Load() (HardState, SnapshotMeta, []Entry, error)
+	// SetState replaces the state
+	SetState(state HardState) error
+	// Append stores entries following the last stored one
+	Append(entries []Entry) error
+	// Truncate removes the entries from index on
+	Truncate(index uint64) error
+	// Compact removes the entries up to meta.Index and records meta
+	Compact(meta SnapshotMeta) error
+}
+
+// StateMachine is what a node applies the committed commands to. Its state must
+// be durable, so a restarted node carries on from Applied.
+type StateMachine interface {
+	// Apply applies the command of the entry at index. An error halts the node,
+	// so commands a state machine rejects must be rejected alike by every node
+	// and not reported as errors.
+	Apply(index uint64, command []byte) error
+	// Applied returns the index of the last entry applied and durably stored
+	Applied() (uint64, error)
+	// Snapshot returns the state, for a follower too far behind to catch up from the log
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with a snapshot taken at index
+	Restore(index uint64, snapshot []byte) error
+}
@@ -0,0 +1,73 @@
+package raft
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemoryStorage keeps a node's log and state in memory, for tests and nodes
+// whose log needn't survive a restart
+type MemoryStorage struct {
+	mutex   sync.Mutex
+	state   HardState
+	snap    SnapshotMeta
+	entries []Entry
+}
+
+var _ Storage = (*MemoryStorage)(nil)
+
+// NewMemoryStorage returns an empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+// Load returns copies of the state, snapshot and entries
+func (s *MemoryStorage) Load() (HardState, SnapshotMeta, []Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state, s.snap, append([]Entry(nil), s.entries...), nil
+}
+
+// SetState replaces the state
+func (s *MemoryStorage) SetState(state HardState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = state
+	return nil
+}
+
+// Append stores entries following the last stored one
+func (s *MemoryStorage) Append(entries []Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(entries) > 0 && entries[0].Index != s.snap.Index+uint64(len(s.entries))+1 {
+		return fmt.Errorf("raft: entry %d doesn't follow entry %d", entries[0].Index, s.snap.Index+uint64(len(s.entries)))
+	}
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+// Truncate removes the entries from index on
+func (s *MemoryStorage) Truncate(index uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if index <= s.snap.Index {
+		s.entries = nil
+	} else if n := index - s.snap.Index - 1; n < uint64(len(s.entries)) {
+		s.entries = s.entries[:n]
+	}
+	return nil
+}
+
+// Compact removes the entries up to meta.Index and records meta
+func (s *MemoryStorage) Compact(meta SnapshotMeta) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n := meta.Index - s.snap.Index; meta.Index > s.snap.Index && n <= uint64(len(s.entries)) {
+		s.entries = append([]Entry(nil), s.entries[n:]...)
+	} else {
+		s.entries = nil
+	}
+	s.snap = meta
+	return nil
+}
@@ -0,0 +1,270 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// VoteRequest asks a node for its vote in an election
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+// VoteResponse answers a VoteRequest
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest carries the leader's entries following PrevIndex, none for a heartbeat
+type AppendRequest struct {
+	Term      uint64  `json:"term"`
+	Leader    string  `json:"leader"`
+	PrevIndex uint64  `json:"prev_index"`
+	PrevTerm  uint64  `json:"prev_term"`
+	Entries   []Entry `json:"entries,omitempty"`
+	Commit    uint64  `json:"commit"`
+}
+
+// AppendResponse answers an AppendRequest. When the entries don't follow on from
+// the follower's log, LastIndex tells the leader where to go back to.
+type AppendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"last_index"`
+}
+
+// SnapshotRequest carries the leader's snapshot to a follower missing entries the
+// leader compacted
+type SnapshotRequest struct {
+	Term   uint64       `json:"term"`
+	Leader string       `json:"leader"`
+	Meta   SnapshotMeta `json:"meta"`
+	Data   []byte       `json:"data"`
+}
+
+// SnapshotResponse answers a SnapshotRequest
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Transport sends a node's requests to the node at an address. Proposals and
+// membership changes made on followers are forwarded to the leader with it too.
+type Transport interface {
+	RequestVote(ctx context.Context, addr string, req VoteRequest) (VoteResponse, error)
+	AppendEntries(ctx context.Context, addr string, req AppendRequest) (AppendResponse, error)
+	InstallSnapshot(ctx context.Context, addr string, req SnapshotRequest) (SnapshotResponse, error)
+	// Propose has the leader at addr append a command, nil for a read barrier, and
+	// returns its index once the leader applied it
+	Propose(ctx context.Context, addr string, command []byte) (uint64, error)
+	ChangeMembers(ctx context.Context, addr string, members map[string]string) error
+	Status(ctx context.Context, addr string) (Status, error)
+}
+
+// HTTPTransport sends requests to the Handler of the node at an address, an
+// http or https URL, with a secret shared by the nodes as the bearer token
+type HTTPTransport struct {
+	Client *http.Client // http.DefaultClient if nil
+	Secret string
+}
+
+var _ Transport = (*HTTPTransport)(nil)
+
+// proposal is the body of a forwarded proposal and of its answer
+type proposal struct {
+	Command []byte `json:"command,omitempty"`
+	Barrier bool   `json:"barrier,omitempty"` // a read barrier rather than a command
+	Index   uint64 `json:"index,omitempty"`
+}
+
+// RequestVote sends a VoteRequest
+func (t *HTTPTransport) RequestVote(ctx context.Context, addr string, req VoteRequest) (VoteResponse, error) {
+	var resp VoteResponse
+	err := t.post(ctx, addr, "/raft/vote", req, &resp)
+	return resp, err
+}
+
+// AppendEntries sends an AppendRequest
+func (t *HTTPTransport) AppendEntries(ctx context.Context, addr string, req AppendRequest) (AppendResponse, error) {
+	var resp AppendResponse
+	err := t.post(ctx, addr, "/raft/append", req, &resp)
+	return resp, err
+}
+
+// InstallSnapshot sends a SnapshotRequest
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, addr string, req SnapshotRequest) (SnapshotResponse, error) {
+	var resp SnapshotResponse
+	err := t.post(ctx, addr, "/raft/snapshot", req, &resp)
+	return resp, err
+}
+
+// Propose forwards a proposal to the leader
+func (t *HTTPTransport) Propose(ctx context.Context, addr string, command []byte) (uint64, error) {
+	var resp proposal
+	err := t.post(ctx, addr, "/raft/propose", proposal{Command: command, Barrier: command == nil}, &resp)
+	return resp.Index, err
+}
+
+// ChangeMembers asks the node at addr to change the members
+func (t *HTTPTransport) ChangeMembers(ctx context.Context, addr string, members map[string]string) error {
+	return t.post(ctx, addr, "/raft/members", members, nil)
+}
+
+// Status returns the status of the node at addr
+func (t *HTTPTransport) Status(ctx context.Context, addr string) (Status, error) {
+	var status Status
+	err := t.do(ctx, http.MethodGet, addr, "/raft/status", nil, &status)
+	return status, err
+}
+
+func (t *HTTPTransport) post(ctx context.Context, addr, path string, body, out interface{}) error {
+	return t.do(ctx, http.MethodPost, addr, path, body, out)
+}
+
+// do sends a request with a JSON body and decodes the JSON answer into out
+func (t *HTTPTransport) do(ctx context.Context, method, addr, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(addr, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+t.Secret)
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return remoteError(resp.StatusCode, failure.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// remoteError returns the error of a failed request, the package's own error
+// when the node answered with one, so callers can tell them apart
+func remoteError(status int, message string) error {
+	for _, err := range []error{ErrNotLeader, ErrNoLeader, ErrLeadershipLost, ErrChangeInProgress, ErrStopped} {
+		if message == err.Error() {
+			return err
+		}
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	if status == http.StatusServiceUnavailable {
+		// A node that can't serve yet, like one being restarted, refused the
+		// request before acting on it, so callers retry as if it had no leader
+		return fmt.Errorf("raft: request failed with %d: %s: %w", status, message, ErrNoLeader)
+	}
+	return fmt.Errorf("raft: request failed with %d: %s", status, message)
+}
+
+// Handler returns the HTTP handler serving a node's requests from the
+// HTTPTransport of its peers, which must send secret
+func Handler(node *Node, secret string) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, serve func(r *http.Request) (interface{}, error)) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "wrong cluster secret"})
+				return
+			}
+			resp, err := serve(r)
+			if err != nil {
+				status := http.StatusInternalServerError
+				if errors.Is(err, ErrNotLeader) || errors.Is(err, ErrNoLeader) || errors.Is(err, ErrLeadershipLost) || errors.Is(err, ErrStopped) {
+					status = http.StatusServiceUnavailable
+				} else if errors.Is(err, ErrChangeInProgress) {
+					status = http.StatusConflict
+				}
+				writeJSON(w, status, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, resp)
+		})
+	}
+	decode := func(r *http.Request, v interface{}) error {
+		return json.NewDecoder(r.Body).Decode(v)
+	}
+
+	handle("POST /raft/vote", func(r *http.Request) (interface{}, error) {
+		var req VoteRequest
+		if err := decode(r, &req); err != nil {
+			return nil, err
+		}
+		return node.HandleVote(req), nil
+	})
+	handle("POST /raft/append", func(r *http.Request) (interface{}, error) {
+		var req AppendRequest
+		if err := decode(r, &req); err != nil {
+			return nil, err
+		}
+		return node.HandleAppend(req)
+	})
+	handle("POST /raft/snapshot", func(r *http.Request) (interface{}, error) {
+		var req SnapshotRequest
+		if err := decode(r, &req); err != nil {
+			return nil, err
+		}
+		return node.HandleSnapshot(req)
+	})
+	handle("POST /raft/propose", func(r *http.Request) (interface{}, error) {
+		var req proposal
+		if err := decode(r, &req); err != nil {
+			return nil, err
+		}
+		if req.Command == nil && !req.Barrier {
+			req.Command = []byte{}
+		}
+		index, err := node.propose(r.Context(), req.Command, false)
+		return proposal{Index: index}, err
+	})
+	handle("POST /raft/members", func(r *http.Request) (interface{}, error) {
+		var members map[string]string
+		if err := decode(r, &members); err != nil {
+			return nil, err
+		}
+		return struct{}{}, node.ChangeMembers(r.Context(), members)
+	})
+	handle("GET /raft/status", func(r *http.Request) (interface{}, error) {
+		return node.Status(), nil
+	})
+	return mux
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
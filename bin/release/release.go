@@ -0,0 +1,138 @@
+package release
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// publicKey is the hex-encoded ed25519 key release manifests are signed with.
+// Release builds embed it with -ldflags "-X Lockr/bin/release.publicKey=<hex>".
+var publicKey string
+
+// ErrUnsigned is returned when the binary was built without an embedded release key
+var ErrUnsigned = errors.New("binary was built without a release signing key")
+
+// ErrTampered is returned when a manifest signature or binary checksum doesn't match
+var ErrTampered = errors.New("release verification failed")
+
+// Manifest lists the SHA-256 checksums of the binaries of one release
+type Manifest struct {
+	Version   string            `json:"version"`
+	Binaries  map[string]string `json:"binaries"` // asset name to hex SHA-256
+	Signature string            `json:"signature,omitempty"`
+}
+
+// Result describes a successfully verified binary
+type Result struct {
+	Version string
+	Asset   string
+	Digest  string
+}
+
+// PublicKey returns the embedded release key
+func PublicKey() (ed25519.PublicKey, error) {
+	if publicKey == "" {
+		return nil, ErrUnsigned
+	}
+	key, err := hex.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid embedded release key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// signedPayload returns the bytes covered by the manifest signature
+func (m *Manifest) signedPayload() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = ""
+	return json.Marshal(unsigned)
+}
+
+// Sign signs the manifest with the release private key
+func (m *Manifest) Sign(key ed25519.PrivateKey) error {
+	payload, err := m.signedPayload()
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	return nil
+}
+
+// Verify checks the manifest signature and that digest belongs to one of its binaries
+func (m *Manifest) Verify(key ed25519.PublicKey, digest string) (Result, error) {
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return Result{}, fmt.Errorf("%w: malformed manifest signature", ErrTampered)
+	}
+	payload, err := m.signedPayload()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if !ed25519.Verify(key, payload, signature) {
+		return Result{}, fmt.Errorf("%w: manifest signature doesn't match the release key", ErrTampered)
+	}
+
+	for asset, expected := range m.Binaries {
+		if expected == digest {
+			return Result{Version: m.Version, Asset: asset, Digest: digest}, nil
+		}
+	}
+	return Result{}, fmt.Errorf("%w: checksum %s isn't part of release %s", ErrTampered, digest, m.Version)
+}
+
+// LoadManifest reads a release manifest from a file
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read release manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse release manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// FileDigest returns the hex SHA-256 of a file
+func FileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// VerifyExecutable checks the running executable against a release manifest
+// signed with the embedded release key
+func VerifyExecutable(manifestPath string) (Result, error) {
+	key, err := PublicKey()
+	if err != nil {
+		return Result{}, err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to locate executable: %w", err)
+	}
+	digest, err := FileDigest(executable)
+	if err != nil {
+		return Result{}, err
+	}
+	manifest, err := LoadManifest(manifestPath)
+	if err != nil {
+		return Result{}, err
+	}
+	return manifest.Verify(key, digest)
+}
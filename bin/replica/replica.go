@@ -0,0 +1,164 @@
+// Package replica keeps a follower's tree a copy of a leader's by applying the
+// writes the leader's HTTP API serves to followers. A follower is read-only, only
+// the writes it copies change it, until it's promoted to take over from its leader.
+package replica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"Lockr/bin/client"
+	"Lockr/bin/lsmtree"
+)
+
+// Records of a follower's tree: the URL of its leader, and the leader's sequence
+// number it's in step with
+const (
+	leaderRecord = "replica/leader"
+	seqRecord    = "replica/seq"
+)
+
+// Follower copies the writes of a leader into a tree
+type Follower struct {
+	tree   *lsmtree.LSMTree
+	leader *client.Client
+}
+
+// SyncResult describes what a Sync copied
+type SyncResult struct {
+	Restored bool   // the tree was replaced by a snapshot of the leader
+	Keys     int    // keys in the snapshot, when restored
+	Changes  int    // writes applied
+	Seq      uint64 // the leader's sequence number the tree is in step with
+}
+
+// Follow makes tree a read-only follower of the leader at url, reached through c.
+// A tree that followed another leader starts over from a snapshot of this one.
+func Follow(tree *lsmtree.LSMTree, url string, c *client.Client) (*Follower, error) {
+	current, err := Leader(tree)
+	if err != nil {
+		return nil, err
+	}
+	if current != url {
+		if err := tree.SetRecord(seqRecord, ""); err != nil {
+			return nil, fmt.Errorf("failed to reset the replication position: %w", err)
+		}
+		if err := tree.SetRecord(leaderRecord, url); err != nil {
+			return nil, fmt.Errorf("failed to record the leader: %w", err)
+		}
+	}
+	tree.SetReadOnly(true)
+	return &Follower{tree: tree, leader: c}, nil
+}
+
+// Leader returns the URL of the leader tree follows, or "" if it isn't a follower
+func Leader(tree *lsmtree.LSMTree) (string, error) {
+	url, err := tree.Record(leaderRecord)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the leader: %w", err)
+	}
+	return url, nil
+}
+
+// Promote stops tree following its leader and makes it writable again
+func Promote(tree *lsmtree.LSMTree) error {
+	for _, name := range []string{seqRecord, leaderRecord} {
+		if err := tree.SetRecord(name, ""); err != nil {
+			return fmt.Errorf("failed to promote: %w", err)
+		}
+	}
+	tree.SetReadOnly(false)
+	return nil
+}
+
+// Sync applies the leader's writes since the last sync, until the tree is in step
+// with the leader. The first sync, and one whose writes the leader no longer
+// has, starts from a snapshot of the leader instead.
+func (f *Follower) Sync(ctx context.Context) (SyncResult, error) {
+	var result SyncResult
+	seq, ok, err := f.position()
+	if err != nil {
+		return result, err
+	}
+	if !ok {
+		if err := f.restore(ctx, &result); err != nil {
+			return result, err
+		}
+		seq = result.Seq
+	}
+	for {
+		page, err := f.leader.GetChanges(ctx, seq, 0)
+		var apiErr *client.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusGone && !result.Restored {
+			if err := f.restore(ctx, &result); err != nil {
+				return result, err
+			}
+			seq = result.Seq
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to read changes: %w", err)
+		}
+		if len(page.Changes) > 0 {
+			if err := f.tree.ApplyChanges(page.Changes); err != nil {
+				return result, fmt.Errorf("failed to apply changes: %w", err)
+			}
+			result.Changes += len(page.Changes)
+		}
+		if page.Next != seq {
+			if err := f.setPosition(page.Next); err != nil {
+				return result, err
+			}
+			seq = page.Next
+		}
+		result.Seq = seq
+		if len(page.Changes) == 0 {
+			return result, nil
+		}
+	}
+}
+
+// restore replaces the keys of the tree with a snapshot of the leader
+func (f *Follower) restore(ctx context.Context, result *SyncResult) error {
+	snap, err := f.leader.GetSnapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	entries := make(map[string]string, len(snap.Entries))
+	for _, entry := range snap.Entries {
+		entries[entry.Key] = entry.Value
+	}
+	if err := f.tree.ApplySnapshot(entries); err != nil {
+		return fmt.Errorf("failed to apply snapshot: %w", err)
+	}
+	if err := f.setPosition(snap.Seq); err != nil {
+		return err
+	}
+	result.Restored, result.Keys, result.Seq = true, len(snap.Entries), snap.Seq
+	return nil
+}
+
+// position returns the leader's sequence number the tree is in step with, and
+// false if the tree has yet to be restored from a snapshot
+func (f *Follower) position() (uint64, bool, error) {
+	value, err := f.tree.Record(seqRecord)
+	if err != nil || value == "" {
+		return 0, false, err
+	}
+	seq, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to parse the replication position %q: %w", value, err)
+	}
+	return seq, true, nil
+}
+
+// setPosition records the leader's sequence number the tree is in step with
+func (f *Follower) setPosition(seq uint64) error {
+	if err := f.tree.SetRecord(seqRecord, strconv.FormatUint(seq, 10)); err != nil {
+		return fmt.Errorf("failed to record the replication position: %w", err)
+	}
+	return nil
+}
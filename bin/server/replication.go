@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"Lockr/bin/lsmtree"
+)
+
+// Page sizes of getChanges: the default when no limit is given and the largest allowed
+const (
+	defaultChangesLimit = 1000
+	maxChangesLimit     = 10000
+)
+
+// errNoReplication is returned by the replication endpoints of a server that doesn't serve followers
+var errNoReplication = errors.New("this server doesn't serve followers")
+
+// errPageFull stops reading changes once a page is full
+var errPageFull = errors.New("page full")
+
+// ReplicationSource is the tree followers copy, like an *lsmtree.LSMTree. Its
+// changes and snapshots hold the values as stored, so encryption contexts stay
+// encrypted on their way to followers.
+type ReplicationSource interface {
+	ReadChanges(since uint64, fn func(lsmtree.WALChange) error) (uint64, error)
+	ChangesHead() uint64
+	Scan(start, end string) (lsmtree.Iterator, error)
+}
+
+// changePage is a page of the changes read by a follower
+type changePage struct {
+	Changes []lsmtree.WALChange `json:"changes"`
+	// Next is the sequence number to pass as since for the next page
+	Next uint64 `json:"next"`
+}
+
+// snapshot holds every key of the tree, for a follower to start from
+type snapshot struct {
+	// Seq is the sequence number to read the changes after, to catch up with the
+	// writes made since the snapshot
+	Seq     uint64  `json:"seq"`
+	Entries []entry `json:"entries"`
+}
+
+// EnableReplication serves the changes and snapshots of source to followers,
+// which need an admin token
+func (s *Server) EnableReplication(source ReplicationSource) {
+	s.replication = source
+}
+
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	if s.replication == nil {
+		writeError(w, http.StatusNotFound, errNoReplication)
+		return
+	}
+	query := r.URL.Query()
+	var since uint64
+	if raw := query.Get("since"); raw != "" {
+		var err error
+		if since, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("since must be a sequence number"))
+			return
+		}
+	}
+	limit := defaultChangesLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxChangesLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxChangesLimit))
+			return
+		}
+		limit = n
+	}
+
+	page := changePage{Changes: []lsmtree.WALChange{}}
+	next, err := s.replication.ReadChanges(since, func(change lsmtree.WALChange) error {
+		if len(page.Changes) == limit {
+			return errPageFull
+		}
+		page.Changes = append(page.Changes, change)
+		return nil
+	})
+	switch {
+	case errors.Is(err, lsmtree.ErrChangesGone):
+		writeError(w, http.StatusGone, err)
+		return
+	case err != nil && !errors.Is(err, errPageFull):
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	page.Next = next
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if s.replication == nil {
+		writeError(w, http.StatusNotFound, errNoReplication)
+		return
+	}
+	// The head is taken first, so the changes after it cover every write the scan missed
+	snap := snapshot{Seq: s.replication.ChangesHead(), Entries: []entry{}}
+	it, err := s.replication.Scan("", "")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer it.Close()
+	for it.Next() {
+		snap.Entries = append(snap.Entries, entry{Key: it.Key(), Value: it.Value()})
+	}
+	if err := it.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
@@ -0,0 +1,499 @@
+// Package server exposes a Lockr store over an HTTP JSON API.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"Lockr/bin/lsmtree"
+)
+
+// openAPI is the OpenAPI 3 document describing the HTTP API
+//
+//go:embed openapi.json
+var openAPI []byte
+
+// docsPage is the Swagger UI page rendering the OpenAPI document
+//
+//go:embed docs.html
+var docsPage []byte
+
+// OpenAPI returns the OpenAPI 3 document describing the HTTP API
+func OpenAPI() []byte {
+	return openAPI
+}
+
+// Server serves the HTTP API for a store
+type Server struct {
+	store  lsmtree.Store
+	keys   lsmtree.ContextStore // store, giving up when a request's context is done
+	mux    *http.ServeMux
+	tokens *Tokens // nil unless RequireTokens was called
+
+	requestTimeout time.Duration // bounds the key operations of a request, set by SetRequestTimeout
+
+	replication ReplicationSource // nil unless EnableReplication was called
+	sync        SyncPeer          // nil unless EnableSync was called
+
+	logger lsmtree.Logger // receives the errors of serving, set by SetLogger
+}
+
+// Listing page sizes: the default when no limit is given and the largest allowed
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+// maxBatchOps is the most operations a batch request may hold
+const maxBatchOps = 10000
+
+// entry is the JSON representation of a key-value pair. Stored values are never
+// empty, so the value is only left out of listings without values.
+type entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// entryList is a page of a key listing
+type entryList struct {
+	Keys []entry `json:"keys"`
+	// NextToken is the last key of the page when more keys match, to be passed as
+	// start-after for the next page
+	NextToken string `json:"next_token,omitempty"`
+}
+
+// batchOp is an operation of a batch request: a set, or a delete of the key
+type batchOp struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// tokenList is the JSON body listing the tokens
+type tokenList struct {
+	Tokens []Token `json:"tokens"`
+}
+
+// newToken is the JSON body of an added token, holding its secret
+type newToken struct {
+	Token
+	Secret string `json:"secret"`
+}
+
+// errNoTokens is returned by the token endpoints of a server that doesn't require tokens
+var errNoTokens = errors.New("this server doesn't use tokens")
+
+// errorResponse is the JSON body returned for failed requests
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// New creates a Server for the given store
+func New(store lsmtree.Store) *Server {
+	s := &Server{
+		store:  store,
+		keys:   lsmtree.WithContext(store),
+		mux:    http.NewServeMux(),
+		logger: slog.Default(),
+	}
+	s.handle("GET /v1/keys", ScopeRead, s.handleList)
+	s.handle("GET /v1/keys/{key...}", ScopeRead, s.handleGet)
+	s.handle("PUT /v1/keys/{key...}", ScopeWrite, s.handlePut)
+	s.handle("DELETE /v1/keys/{key...}", ScopeWrite, s.handleDelete)
+	s.handle("POST /v1/batch", ScopeWrite, s.handleBatch)
+	s.handle("GET /v1/watch", ScopeRead, s.handleWatch)
+	s.handle("GET /v1/tokens", ScopeAdmin, s.handleListTokens)
+	s.handle("POST /v1/tokens", ScopeAdmin, s.handleAddToken)
+	s.handle("DELETE /v1/tokens/{name}", ScopeAdmin, s.handleRevokeToken)
+	s.handle("GET /v1/replication/changes", ScopeAdmin, s.handleChanges)
+	s.handle("GET /v1/replication/snapshot", ScopeAdmin, s.handleSnapshot)
+	s.handle("POST /v1/sync", ScopeAdmin, s.handleSync)
+	s.handle("GET /v1/stats", ScopeAdmin, s.handleStats)
+	s.handle("POST /v1/gc", ScopeAdmin, s.handleReclaim)
+	s.mux.HandleFunc("GET /v1/health", s.handleHealth)
+	s.mux.HandleFunc("GET /v1/openapi.json", s.handleOpenAPI)
+	return s
+}
+
+// RequireTokens makes requests authenticate with the bearer token of one of
+// tokens whose scope allows them. The OpenAPI document, docs and health check
+// stay public.
+func (s *Server) RequireTokens(tokens *Tokens) {
+	s.tokens = tokens
+}
+
+// Tokens returns the tokens requests authenticate with, nil unless RequireTokens
+// was called
+func (s *Server) Tokens() *Tokens {
+	return s.tokens
+}
+
+// SetLogger sets the logger receiving the errors that stop serving, slog.Default()
+// by default. The TUI passes its log pane, as printing would garble its screen.
+func (s *Server) SetLogger(logger lsmtree.Logger) {
+	s.logger = logger
+}
+
+// Logger returns the logger receiving the errors that stop serving
+func (s *Server) Logger() lsmtree.Logger {
+	return s.logger
+}
+
+// SetRequestTimeout bounds how long a request reading or writing keys may wait for
+// the store, as for the writer lock during a compaction. Requests past it fail with
+// 503 Service Unavailable. Zero, the default, only gives up when the client does.
+func (s *Server) SetRequestTimeout(timeout time.Duration) {
+	s.requestTimeout = timeout
+}
+
+// storeContext returns the context of a request's store operations, done when the
+// client gives up or the request timeout passes
+func (s *Server) storeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.requestTimeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), s.requestTimeout)
+}
+
+// handle registers a handler for pattern that, once tokens are required, only
+// serves requests with a token of at least scope
+func (s *Server) handle(pattern string, scope Scope, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if s.tokens != nil {
+			secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			token, known := s.tokens.Authenticate(strings.TrimSpace(secret))
+			if !ok || !known {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="lockr"`)
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("a valid bearer token is required"))
+				return
+			}
+			if token.Scope < scope {
+				writeError(w, http.StatusForbidden, fmt.Errorf("token %s has scope %s, this needs %s", token.Name, token.Scope, scope))
+				return
+			}
+		}
+		handler(w, r)
+	})
+}
+
+// EnableDocs serves a Swagger UI for the API at /v1/docs. The page loads the
+// Swagger UI assets from a CDN.
+func (s *Server) EnableDocs() {
+	s.mux.HandleFunc("GET /v1/docs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(docsPage)
+	})
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Listen starts serving on addr in the background and returns the bound listener,
+// so callers can use ":0" and read the chosen port from the listener address
+func (s *Server) Listen(addr string) (net.Listener, error) {
+	return s.ListenTLS(addr, nil)
+}
+
+// ListenTLS is like Listen, serving HTTPS with config unless it's nil
+func (s *Server) ListenTLS(addr string, config *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	s.serve(listener)
+	return listener, nil
+}
+
+// ListenUnix is like Listen on a unix socket at path, which only its owner may
+// connect to. Closing the listener removes the socket.
+func (s *Server) ListenUnix(path string) (net.Listener, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict %s: %w", path, err)
+	}
+	s.serve(listener)
+	return listener, nil
+}
+
+// serve serves requests from listener in the background until it's closed
+func (s *Server) serve(listener net.Listener) {
+	go func() {
+		if err := http.Serve(listener, s); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logger.Error("HTTP server stopped", "addr", listener.Addr().String(), "error", err)
+		}
+	}()
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	ctx, cancel := s.storeContext(r)
+	defer cancel()
+	value, err := s.keys.GetCtx(ctx, key)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if value == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("key %q not found", key))
+		return
+	}
+	writeJSON(w, http.StatusOK, entry{Key: key, Value: value})
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %w", err))
+		return
+	}
+	if body.Value == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("value must not be empty"))
+		return
+	}
+
+	ctx, cancel := s.storeContext(r)
+	defer cancel()
+	if err := s.keys.SetCtx(ctx, key, body.Value); err != nil {
+		writeWriteError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entry{Key: key, Value: body.Value})
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.storeContext(r)
+	defer cancel()
+	if err := s.keys.DeleteCtx(ctx, r.PathValue("key")); err != nil {
+		writeWriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBatch applies the operations of the request in order, all or none of them
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Ops []batchOp `json:"ops"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %w", err))
+		return
+	}
+	if len(body.Ops) == 0 || len(body.Ops) > maxBatchOps {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("a batch must hold between 1 and %d operations", maxBatchOps))
+		return
+	}
+
+	batch := lsmtree.NewWriteBatch()
+	for i, op := range body.Ops {
+		switch {
+		case op.Key == "":
+			writeError(w, http.StatusBadRequest, fmt.Errorf("operation %d: key must not be empty", i))
+			return
+		case op.Delete && op.Value != "":
+			writeError(w, http.StatusBadRequest, fmt.Errorf("operation %d: a delete has no value", i))
+			return
+		case op.Delete:
+			batch.Delete(op.Key)
+		case op.Value == "":
+			writeError(w, http.StatusBadRequest, fmt.Errorf("operation %d: value must not be empty", i))
+			return
+		default:
+			batch.Set(op.Key, op.Value)
+		}
+	}
+
+	ctx, cancel := s.storeContext(r)
+	defer cancel()
+	if err := s.keys.BatchCtx(ctx, batch); err != nil {
+		writeWriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	if s.tokens == nil {
+		writeError(w, http.StatusNotFound, errNoTokens)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokenList{Tokens: s.tokens.List()})
+}
+
+func (s *Server) handleAddToken(w http.ResponseWriter, r *http.Request) {
+	if s.tokens == nil {
+		writeError(w, http.StatusNotFound, errNoTokens)
+		return
+	}
+	var body struct {
+		Name  string `json:"name"`
+		Scope Scope  `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %w", err))
+		return
+	}
+	secret, err := s.tokens.Add(body.Name, body.Scope)
+	switch {
+	case errors.Is(err, ErrTokenExists):
+		writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	token, _ := s.tokens.Authenticate(secret)
+	writeJSON(w, http.StatusCreated, newToken{Token: token, Secret: secret})
+}
+
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if s.tokens == nil {
+		writeError(w, http.StatusNotFound, errNoTokens)
+		return
+	}
+	err := s.tokens.Revoke(r.PathValue("name"))
+	switch {
+	case errors.Is(err, ErrUnknownToken):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	start, end := prefix, prefixEnd(prefix)
+	// An explicit range narrows the prefix range
+	if from := query.Get("start"); from > start {
+		start = from
+	}
+	if to := query.Get("end"); to != "" && (end == "" || to < end) {
+		end = to
+	}
+	// The smallest key after start-after is start-after followed by a zero byte
+	if after := query.Get("start-after"); after != "" && after+"\x00" > start {
+		start = after + "\x00"
+	}
+	limit := defaultListLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxListLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxListLimit))
+			return
+		}
+		limit = n
+	}
+	values := true
+	if raw := query.Get("values"); raw != "" {
+		var err error
+		if values, err = strconv.ParseBool(raw); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("values must be true or false"))
+			return
+		}
+	}
+
+	ctx, cancel := s.storeContext(r)
+	defer cancel()
+	it, err := s.keys.ScanCtx(ctx, start, end)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer it.Close()
+
+	list := entryList{Keys: []entry{}}
+	for it.Next() {
+		// Reading one entry past the page tells whether there's another page
+		if len(list.Keys) == limit {
+			list.NextToken = list.Keys[limit-1].Key
+			break
+		}
+		e := entry{Key: it.Key()}
+		if values {
+			e.Value = it.Value()
+		}
+		list.Keys = append(list.Keys, e)
+	}
+	if err := it.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// prefixEnd returns the smallest key greater than every key with the given prefix,
+// or "" when the prefix is empty or has no upper bound
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeWriteError writes the error of a write, a conflict when the store is a
+// read-only follower
+func writeWriteError(w http.ResponseWriter, err error) {
+	if errors.Is(err, lsmtree.ErrReadOnly) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeStoreError(w, err)
+}
+
+// writeStoreError writes the error of a store operation, unavailable when it gave
+// up waiting for the store
+func writeStoreError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, status, err)
+}
+
+// writeError writes err as a JSON error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
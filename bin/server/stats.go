@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"Lockr/bin/lsmtree"
+)
+
+// statsSource is a store reporting engine statistics, like an *lsmtree.LSMTree
+type statsSource interface {
+	Stats() lsmtree.Stats
+}
+
+// wrappedStatsSource is a store reporting the statistics of the engine under it,
+// like the vault, failing with errors.ErrUnsupported when it has none
+type wrappedStatsSource interface {
+	Stats() (lsmtree.Stats, error)
+}
+
+// reclaimer is a store that can free the space of its deleted entries, like an
+// *lsmtree.LSMTree or the vault, the latter failing with errors.ErrUnsupported
+// when the store under it can't
+type reclaimer interface {
+	Reclaim() (lsmtree.ReclaimResult, error)
+}
+
+// health is the JSON representation of the health check
+type health struct {
+	Status string `json:"status"`
+}
+
+// handleStats writes the statistics of the store's engine
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	var stats lsmtree.Stats
+	switch store := s.store.(type) {
+	case statsSource:
+		stats = store.Stats()
+	case wrappedStatsSource:
+		var err error
+		if stats, err = store.Stats(); errors.Is(err, errors.ErrUnsupported) {
+			writeError(w, http.StatusNotImplemented, errors.New("this store doesn't report statistics"))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		writeError(w, http.StatusNotImplemented, errors.New("this store doesn't report statistics"))
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleReclaim rewrites the SSTables of the store's engine to free space
+func (s *Server) handleReclaim(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.store.(reclaimer)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("this store can't reclaim space"))
+		return
+	}
+	result, err := store.Reclaim()
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+		writeError(w, http.StatusNotImplemented, errors.New("this store can't reclaim space"))
+	case errors.Is(err, lsmtree.ErrPaused):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// handleHealth reports that the server is serving requests. It needs no token, for
+// load balancers and orchestrators to probe.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, health{Status: "ok"})
+}
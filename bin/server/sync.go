@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"Lockr/bin/devicesync"
+)
+
+// maxSyncBody is the largest changeset a sync request may send
+const maxSyncBody = 64 << 20
+
+// errNoSync is returned by the sync endpoint of a server that doesn't sync with other devices
+var errNoSync = errors.New("this server doesn't sync with other devices")
+
+// SyncPeer merges the changesets other devices send, like a *devicesync.Syncer
+type SyncPeer interface {
+	Exchange(in devicesync.Changeset) (devicesync.Changeset, devicesync.Result, error)
+}
+
+// EnableSync lets other devices sync with peer, which needs an admin token
+func (s *Server) EnableSync(peer SyncPeer) {
+	s.sync = peer
+}
+
+// handleSync merges the changeset of the request and answers with the changes the
+// other device hasn't merged yet
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
+	if s.sync == nil {
+		writeError(w, http.StatusNotFound, errNoSync)
+		return
+	}
+	var in devicesync.Changeset
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSyncBody)).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %w", err))
+		return
+	}
+	if in.Device == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("device must not be empty"))
+		return
+	}
+	out, _, err := s.sync.Exchange(in)
+	switch {
+	case errors.Is(err, devicesync.ErrSameDevice):
+		writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRecordPrefix is the prefix of the records holding the API tokens, followed by their name
+const tokenRecordPrefix = "server/token/"
+
+// tokenPrefix starts every secret of a token, so they're easy to spot in configs and logs
+const tokenPrefix = "lockr_"
+
+var (
+	// ErrTokenExists is returned when adding a token under a name already in use
+	ErrTokenExists = errors.New("server: token already exists")
+	// ErrUnknownToken is returned for a token name that doesn't exist
+	ErrUnknownToken = errors.New("server: unknown token")
+)
+
+// tokenName is the pattern of token names
+var tokenName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Scope is what a token may do. Each scope allows what the ones below it do.
+type Scope int
+
+const (
+	// ScopeRead reads and lists keys
+	ScopeRead Scope = iota + 1
+	// ScopeWrite also sets and deletes keys
+	ScopeWrite
+	// ScopeAdmin also manages the tokens
+	ScopeAdmin
+)
+
+// ParseScope parses a scope name: read, write or admin
+func ParseScope(name string) (Scope, error) {
+	switch name {
+	case "read":
+		return ScopeRead, nil
+	case "write":
+		return ScopeWrite, nil
+	case "admin":
+		return ScopeAdmin, nil
+	default:
+		return 0, fmt.Errorf("unknown scope %q: want read, write or admin", name)
+	}
+}
+
+// String returns the name of the scope
+func (s Scope) String() string {
+	switch s {
+	case ScopeRead:
+		return "read"
+	case ScopeWrite:
+		return "write"
+	case ScopeAdmin:
+		return "admin"
+	default:
+		return fmt.Sprintf("Scope(%d)", int(s))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (s Scope) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (s *Scope) UnmarshalText(text []byte) error {
+	scope, err := ParseScope(string(text))
+	if err != nil {
+		return err
+	}
+	*s = scope
+	return nil
+}
+
+// Token describes an API token. Its secret is only shown when it's added.
+type Token struct {
+	Name    string    `json:"name"`
+	Scope   Scope     `json:"scope"`
+	Created time.Time `json:"created"`
+}
+
+// tokenRecord is the stored form of a token, holding its secret hashed
+type tokenRecord struct {
+	Scope   Scope     `json:"scope"`
+	Hash    string    `json:"hash"` // hex SHA-256 of the secret
+	Created time.Time `json:"created"`
+}
+
+// TokenStore keeps the records of Tokens apart from the keys of a store, like
+// an *lsmtree.LSMTree
+type TokenStore interface {
+	Records(prefix string) (map[string]string, error)
+	SetRecord(name, value string) error
+}
+
+// Tokens are the API tokens of a store, kept with their secrets hashed in its
+// records and in memory, so requests are checked without reading the store
+type Tokens struct {
+	store  TokenStore
+	mutex  sync.RWMutex
+	tokens map[string]tokenRecord // by name
+}
+
+// LoadTokens loads the API tokens recorded in store
+func LoadTokens(store TokenStore) (*Tokens, error) {
+	records, err := store.Records(tokenRecordPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokens: %w", err)
+	}
+	t := &Tokens{store: store, tokens: make(map[string]tokenRecord, len(records))}
+	for name, value := range records {
+		var record tokenRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			return nil, fmt.Errorf("failed to parse token %s: %w", name, err)
+		}
+		t.tokens[strings.TrimPrefix(name, tokenRecordPrefix)] = record
+	}
+	return t, nil
+}
+
+// Add creates a token of scope under name and returns its secret, which isn't
+// kept and can't be shown again
+func (t *Tokens) Add(name string, scope Scope) (string, error) {
+	if !tokenName.MatchString(name) {
+		return "", fmt.Errorf("invalid token name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	if scope < ScopeRead || scope > ScopeAdmin {
+		return "", fmt.Errorf("invalid scope %v: want read, write or admin", scope)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.tokens[name]; ok {
+		return "", fmt.Errorf("%w: %s", ErrTokenExists, name)
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(random)
+	record := tokenRecord{Scope: scope, Hash: hashToken(secret), Created: time.Now().UTC().Truncate(time.Second)}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode token: %w", err)
+	}
+	if err := t.store.SetRecord(tokenRecordPrefix+name, string(data)); err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	t.tokens[name] = record
+	return secret, nil
+}
+
+// Revoke removes the token name, which is refused from then on
+func (t *Tokens) Revoke(name string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.tokens[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownToken, name)
+	}
+	if err := t.store.SetRecord(tokenRecordPrefix+name, ""); err != nil {
+		return fmt.Errorf("failed to remove token: %w", err)
+	}
+	delete(t.tokens, name)
+	return nil
+}
+
+// List returns the tokens sorted by name
+func (t *Tokens) List() []Token {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	tokens := make([]Token, 0, len(t.tokens))
+	for name, record := range t.tokens {
+		tokens = append(tokens, Token{Name: name, Scope: record.Scope, Created: record.Created})
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens
+}
+
+// Authenticate returns the token whose secret this is, comparing the hash with
+// every token's in constant time
+func (t *Tokens) Authenticate(secret string) (Token, bool) {
+	hash := []byte(hashToken(secret))
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	var match Token
+	found := false
+	for name, record := range t.tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(record.Hash)) == 1 {
+			match, found = Token{Name: name, Scope: record.Scope, Created: record.Created}, true
+		}
+	}
+	return match, found
+}
+
+// hashToken returns the hex SHA-256 of a token's secret. The secrets are random,
+// so a fast unsalted hash is enough to keep them out of the store.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"Lockr/bin/lsmtree"
+)
+
+// watchKeepAlive is how often a quiet event stream gets a comment, so proxies
+// don't close it as idle
+const watchKeepAlive = 30 * time.Second
+
+// watchable is a store reporting its writes, like an *lsmtree.LSMTree
+type watchable interface {
+	Watch(prefix string) (<-chan lsmtree.Event, func(), error)
+}
+
+// handleWatch streams the writes to keys starting with the prefix query parameter
+// as server-sent events, one per write with its sequence number as the id, until
+// the client goes away. The stream ends when the store stops the watch, because
+// the client fell behind or the store was closed.
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.store.(watchable)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("this store can't be watched"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming isn't supported"))
+		return
+	}
+	events, stop, err := store.Watch(r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
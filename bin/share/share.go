@@ -0,0 +1,262 @@
+// Package share encrypts single entries to a recipient's public key so they can
+// be handed to someone else without giving them the vault. Recipients are age
+// X25519 keys ("age1...") or ssh-ed25519 keys; the blobs are Lockr's own format.
+package share
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+)
+
+// blobPrefix starts every shared entry and names its format version
+const blobPrefix = "lockr-share-1:"
+
+// hkdfInfo separates the keys derived for shares from any other use of the keys
+const hkdfInfo = "lockr share 1"
+
+const (
+	recipientHRP = "age"
+	identityHRP  = "age-secret-key-"
+)
+
+// ErrNotRecipient is returned when a blob wasn't shared with the identity opening it
+var ErrNotRecipient = errors.New("entry wasn't shared with this identity")
+
+// Recipient is a public key entries can be shared with
+type Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// ParseRecipient parses an age recipient ("age1...") or an OpenSSH ssh-ed25519
+// public key line
+func ParseRecipient(s string) (*Recipient, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "ssh-") {
+		return parseSSHRecipient(s)
+	}
+	hrp, data, err := bech32Decode(s)
+	if err != nil || hrp != recipientHRP {
+		return nil, fmt.Errorf("invalid recipient %q: expected an age1... or ssh-ed25519 public key", s)
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", s, err)
+	}
+	return &Recipient{key: key}, nil
+}
+
+// parseSSHRecipient converts an ssh-ed25519 public key to its X25519 form
+func parseSSHRecipient(s string) (*Recipient, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH public key: %w", err)
+	}
+	crypto, ok := pub.(ssh.CryptoPublicKey)
+	if !ok || pub.Type() != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("unsupported SSH key type %s, only ssh-ed25519 keys can receive entries", pub.Type())
+	}
+	u, err := edwardsToMontgomery(crypto.CryptoPublicKey().(ed25519.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdh.X25519().NewPublicKey(u)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH public key: %w", err)
+	}
+	return &Recipient{key: key}, nil
+}
+
+// edwardsToMontgomery maps an Ed25519 public key to the X25519 public key of the
+// same secret, u = (1 + y) / (1 - y) mod 2^255 - 19
+func edwardsToMontgomery(pub ed25519.PublicKey) ([]byte, error) {
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	le := make([]byte, len(pub))
+	for i, b := range pub {
+		le[len(pub)-1-i] = b
+	}
+	le[0] &= 0x7f // drop the sign bit of x
+	y := new(big.Int).SetBytes(le)
+
+	denominator := new(big.Int).Mod(new(big.Int).Sub(big.NewInt(1), y), p)
+	if denominator.Sign() == 0 {
+		return nil, fmt.Errorf("invalid SSH public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator.ModInverse(denominator, p)).Mod(u, p)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+// String returns the recipient as an age1... key
+func (r *Recipient) String() string {
+	s, _ := bech32Encode(recipientHRP, r.key.Bytes())
+	return s
+}
+
+// Identity is a private key that opens entries shared with its recipient
+type Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// GenerateIdentity creates a new X25519 identity
+func GenerateIdentity() (*Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity: %w", err)
+	}
+	return &Identity{key: key}, nil
+}
+
+// ParseIdentity parses an age identity file (AGE-SECRET-KEY-1... lines, # comments)
+// or an OpenSSH ed25519 private key. passphrase is called for encrypted SSH keys.
+func ParseIdentity(data []byte, passphrase func() ([]byte, error)) (*Identity, error) {
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, "-----BEGIN") {
+		return parseSSHIdentity(data, passphrase)
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hrp, secret, err := bech32Decode(line)
+		if err != nil || hrp != identityHRP {
+			return nil, fmt.Errorf("invalid identity: expected an AGE-SECRET-KEY-1... line or an OpenSSH private key")
+		}
+		key, err := ecdh.X25519().NewPrivateKey(secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity: %w", err)
+		}
+		return &Identity{key: key}, nil
+	}
+	return nil, fmt.Errorf("no identity found")
+}
+
+// parseSSHIdentity converts an ed25519 SSH private key to its X25519 form
+func parseSSHIdentity(data []byte, passphrase func() ([]byte, error)) (*Identity, error) {
+	raw, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) && passphrase != nil {
+		pass, perr := passphrase()
+		if perr != nil {
+			return nil, perr
+		}
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(data, pass)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH private key: %w", err)
+	}
+	priv, ok := raw.(*ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported SSH key type %T, only ed25519 keys can receive entries", raw)
+	}
+	// The X25519 scalar of an Ed25519 key is the first half of the hashed seed
+	h := sha512.Sum512(priv.Seed())
+	key, err := ecdh.X25519().NewPrivateKey(h[:32])
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH private key: %w", err)
+	}
+	return &Identity{key: key}, nil
+}
+
+// String returns the identity as an AGE-SECRET-KEY-1... line
+func (id *Identity) String() string {
+	s, _ := bech32Encode(identityHRP, id.key.Bytes())
+	return strings.ToUpper(s)
+}
+
+// Recipient returns the public key entries are shared with to reach this identity
+func (id *Identity) Recipient() *Recipient {
+	return &Recipient{key: id.key.PublicKey()}
+}
+
+// entry is the plaintext of a blob
+type entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Seal encrypts an entry for the recipient and returns it as a single-line blob.
+// Each blob uses a fresh ephemeral key, so sealing the same entry twice gives
+// unrelated blobs.
+func Seal(r *Recipient, key, value string) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	aead, err := deriveAEAD(ephemeral, r.key, ephemeral.PublicKey(), r.key)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(entry{Key: key, Value: value})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode entry: %w", err)
+	}
+	// The key is never reused, so a zero nonce is safe
+	sealed := aead.Seal(ephemeral.PublicKey().Bytes(), make([]byte, aead.NonceSize()), plaintext, nil)
+	return blobPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a blob sealed for the identity's recipient
+func Open(id *Identity, blob string) (key, value string, err error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(blob), blobPrefix)
+	if !ok {
+		return "", "", fmt.Errorf("not a shared entry: expected a blob starting with %s", blobPrefix)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < 32+chacha20poly1305.Overhead {
+		return "", "", fmt.Errorf("malformed shared entry")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[:32])
+	if err != nil {
+		return "", "", fmt.Errorf("malformed shared entry: %w", err)
+	}
+	aead, err := deriveAEAD(id.key, ephemeral, ephemeral, id.key.PublicKey())
+	if err != nil {
+		return "", "", err
+	}
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed[32:], nil)
+	if err != nil {
+		return "", "", ErrNotRecipient
+	}
+	var e entry
+	if err := json.Unmarshal(plaintext, &e); err != nil || e.Key == "" {
+		return "", "", fmt.Errorf("malformed shared entry")
+	}
+	return e.Key, e.Value, nil
+}
+
+// deriveAEAD derives the cipher of a blob from the X25519 exchange between priv
+// and pub, binding it to the blob's ephemeral key and its recipient
+func deriveAEAD(priv *ecdh.PrivateKey, pub, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange keys: %w", err)
+	}
+	salt := append(append([]byte(nil), ephemeral.Bytes()...), recipient.Bytes()...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(hkdfInfo)), key); err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return chacha20poly1305.New(key)
+}
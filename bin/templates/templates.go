@@ -0,0 +1,224 @@
+package templates
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileName is the file in the data directory holding user-defined templates
+const fileName = "templates.json"
+
+// Field describes one field of a template
+type Field struct {
+	Name   string `json:"name"`
+	Label  string `json:"label"`
+	Secret bool   `json:"secret,omitempty"` // prompted for without echo
+}
+
+// Template describes the fields of a type of secret
+type Template struct {
+	Name   string  `json:"name"`
+	Fields []Field `json:"fields"`
+}
+
+// builtin are the templates available without configuration
+var builtin = []Template{
+	{Name: "login", Fields: []Field{
+		{Name: "username", Label: "Username"},
+		{Name: "password", Label: "Password", Secret: true},
+		{Name: "url", Label: "URL"},
+		{Name: "notes", Label: "Notes"},
+	}},
+	{Name: "card", Fields: []Field{
+		{Name: "cardholder", Label: "Cardholder"},
+		{Name: "number", Label: "Number", Secret: true},
+		{Name: "expiry", Label: "Expiry"},
+		{Name: "cvv", Label: "CVV", Secret: true},
+		{Name: "notes", Label: "Notes"},
+	}},
+	{Name: "wifi", Fields: []Field{
+		{Name: "ssid", Label: "SSID"},
+		{Name: "password", Label: "Password", Secret: true},
+		{Name: "notes", Label: "Notes"},
+	}},
+	{Name: "note", Fields: []Field{
+		{Name: "notes", Label: "Notes", Secret: true},
+	}},
+}
+
+// Builtin returns the built-in templates by name
+func Builtin() map[string]Template {
+	all := make(map[string]Template)
+	for _, t := range builtin {
+		all[t.Name] = t
+	}
+	return all
+}
+
+// Load returns the built-in templates together with those defined in the data
+// directory's templates.json, which override built-ins of the same name
+func Load(dataDir string) (map[string]Template, error) {
+	all := Builtin()
+
+	data, err := os.ReadFile(filepath.Join(dataDir, fileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return all, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates: %w", err)
+	}
+	var defined []Template
+	if err := json.Unmarshal(data, &defined); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", fileName, err)
+	}
+	for _, t := range defined {
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("invalid template in %s: %w", fileName, err)
+		}
+		for i, f := range t.Fields {
+			if f.Label == "" {
+				t.Fields[i].Label = f.Name
+			}
+		}
+		all[t.Name] = t
+	}
+	return all, nil
+}
+
+// Names returns the template names in order
+func Names(all map[string]Template) []string {
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validate checks that the template can be used to create entries
+func (t Template) validate() error {
+	if t.Name == "" || strings.ContainsAny(t.Name, "/ ") {
+		return fmt.Errorf("template name %q must be non-empty without spaces or slashes", t.Name)
+	}
+	if len(t.Fields) == 0 {
+		return fmt.Errorf("template %s has no fields", t.Name)
+	}
+	seen := make(map[string]bool)
+	for _, f := range t.Fields {
+		if f.Name == "" || seen[f.Name] {
+			return fmt.Errorf("template %s has an empty or duplicate field name %q", t.Name, f.Name)
+		}
+		seen[f.Name] = true
+	}
+	return nil
+}
+
+// Key returns the conventional key of an entry, e.g. "login/mysite"
+func (t Template) Key(name string) string {
+	return t.Name + "/" + name
+}
+
+// FieldValue is a filled-in field of an entry
+type FieldValue struct {
+	Name   string `json:"name"`
+	Label  string `json:"label"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret,omitempty"` // masked until revealed
+}
+
+// Entry is a structured secret created from a template. Fields keep their labels
+// and template order so the entry renders without the template that created it.
+type Entry struct {
+	Template string       `json:"template"`
+	Fields   []FieldValue `json:"fields"`
+}
+
+// NewEntry creates an entry from the template with values keyed by field name
+func (t Template) NewEntry(values map[string]string) Entry {
+	entry := Entry{Template: t.Name}
+	for _, f := range t.Fields {
+		entry.Fields = append(entry.Fields, FieldValue{Name: f.Name, Label: f.Label, Value: values[f.Name], Secret: f.Secret})
+	}
+	return entry
+}
+
+// Encode returns the JSON value stored for the entry
+func (e Entry) Encode() (string, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode entry: %w", err)
+	}
+	return string(data), nil
+}
+
+// Decode parses a stored value, reporting false if it isn't a template entry
+func Decode(value string) (Entry, bool) {
+	if !strings.HasPrefix(value, "{") {
+		return Entry{}, false
+	}
+	var entry Entry
+	if err := json.Unmarshal([]byte(value), &entry); err != nil || entry.Template == "" || len(entry.Fields) == 0 {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// Get returns the value of a field
+func (e Entry) Get(name string) string {
+	for _, f := range e.Fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Render formats the entry as aligned "Label: value" lines, skipping empty fields
+func (e Entry) Render() string {
+	width := 0
+	for _, f := range e.Fields {
+		if f.Value != "" && len(f.Title()) > width {
+			width = len(f.Title())
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s]", e.Template)
+	for _, f := range e.Fields {
+		if f.Value == "" {
+			continue
+		}
+		// Indent continuation lines of multi-line values under the value column
+		value := strings.ReplaceAll(f.Value, "\n", "\n"+strings.Repeat(" ", width+5))
+		fmt.Fprintf(&b, "\n  %-*s  %s", width+1, f.Title()+":", value)
+	}
+	return b.String()
+}
+
+// Summary returns the template and the values of the filled-in fields that aren't
+// secret on one line, e.g. "[login] bob, https://mysite.example"
+func (e Entry) Summary() string {
+	var values []string
+	for _, f := range e.Fields {
+		if f.Value != "" && !f.Secret {
+			values = append(values, strings.ReplaceAll(f.Value, "\n", " "))
+		}
+	}
+	if len(values) == 0 {
+		return "[" + e.Template + "]"
+	}
+	return "[" + e.Template + "] " + strings.Join(values, ", ")
+}
+
+// Title returns the field label, falling back to its name
+func (f FieldValue) Title() string {
+	if f.Label != "" {
+		return f.Label
+	}
+	return f.Name
+}
@@ -0,0 +1,50 @@
+package vault
+
+import (
+	"errors"
+
+	"Lockr/bin/lsmtree"
+)
+
+// vaultIterator decrypts the values of an underlying iterator, skipping keys of locked contexts
+type vaultIterator struct {
+	vault *Vault
+	it    lsmtree.Iterator
+	value string
+	err   error
+}
+
+func (it *vaultIterator) Next() bool {
+	for it.err == nil && it.it.Next() {
+		c, err := it.vault.contextFor(it.it.Key())
+		if errors.Is(err, ErrLocked) {
+			continue
+		}
+		if c == nil {
+			it.value = it.it.Value()
+			return true
+		}
+		it.value, it.err = c.open(it.it.Key(), it.it.Value())
+		return it.err == nil
+	}
+	return false
+}
+
+func (it *vaultIterator) Key() string {
+	return it.it.Key()
+}
+
+func (it *vaultIterator) Value() string {
+	return it.value
+}
+
+func (it *vaultIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.it.Err()
+}
+
+func (it *vaultIterator) Close() error {
+	return it.it.Close()
+}
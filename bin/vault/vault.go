@@ -0,0 +1,637 @@
+package vault
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"Lockr/bin/lsmtree"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// contextsFileName is the file in the data directory listing the encryption contexts
+const contextsFileName = "contexts.json"
+
+// encryptedPrefix marks a value as encrypted by an encryption context
+const encryptedPrefix = "enc1:"
+
+// keySize is the AES-256 key size derived for each context
+const keySize = 32
+
+// scrypt cost parameters for deriving context keys from passphrases
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	// ErrLocked is returned when accessing a key whose encryption context isn't unlocked
+	ErrLocked = errors.New("vault: encryption context is locked")
+	// ErrWrongKey is returned when unlocking a context with the wrong passphrase or key
+	ErrWrongKey = errors.New("vault: wrong passphrase or key")
+	// ErrUnknownContext is returned for a context name that doesn't exist
+	ErrUnknownContext = errors.New("vault: unknown encryption context")
+)
+
+// contextConfig is the persisted description of an encryption context
+type contextConfig struct {
+	Name     string `json:"name"`
+	Prefix   string `json:"prefix"`
+	Salt     string `json:"salt"`     // base64 scrypt salt
+	Verifier string `json:"verifier"` // encrypted known value used to check unlock attempts
+}
+
+// versionedStore is a store keeping the past values of its keys, like an
+// *lsmtree.LSMTree with Options.Versions
+type versionedStore interface {
+	Versions(key string) ([]lsmtree.Version, error)
+	ForgetVersions(prefix string) error
+}
+
+// watchableStore is a store reporting its writes, like an *lsmtree.LSMTree
+type watchableStore interface {
+	Watch(prefix string) (<-chan lsmtree.Event, func(), error)
+}
+
+// statsStore is a store reporting engine statistics, like an *lsmtree.LSMTree
+type statsStore interface {
+	Stats() lsmtree.Stats
+}
+
+// reclaimStore is a store that can rewrite its SSTables to free space, like an *lsmtree.LSMTree
+type reclaimStore interface {
+	Reclaim() (lsmtree.ReclaimResult, error)
+}
+
+// encryptionContext is an encryption context and, once unlocked, its cipher
+type encryptionContext struct {
+	config contextConfig
+	aead   cipher.AEAD
+	key    []byte
+}
+
+// ContextInfo describes an encryption context
+type ContextInfo struct {
+	Name     string
+	Prefix   string
+	Unlocked bool
+}
+
+// Vault wraps a store and encrypts the values of keys bound to encryption contexts.
+// Each context covers one key prefix and has its own key, so unlocking or exporting
+// one namespace reveals nothing about the others. Keys themselves aren't encrypted,
+// and keys outside every context are stored as is.
+type Vault struct {
+	store    lsmtree.Store
+	dataDir  string
+	mutex    sync.RWMutex
+	contexts []*encryptionContext
+}
+
+var _ lsmtree.ContextStore = (*Vault)(nil)
+
+// Open wraps store, loading the encryption contexts recorded in dataDir. All
+// contexts start locked.
+func Open(dataDir string, store lsmtree.Store) (*Vault, error) {
+	v := &Vault{store: store, dataDir: dataDir}
+
+	data, err := os.ReadFile(filepath.Join(dataDir, contextsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption contexts: %w", err)
+	}
+
+	var configs []contextConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse encryption contexts: %w", err)
+	}
+	for _, config := range configs {
+		v.contexts = append(v.contexts, &encryptionContext{config: config})
+	}
+	return v, nil
+}
+
+// Contexts returns the encryption contexts sorted by name
+func (v *Vault) Contexts() []ContextInfo {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	infos := make([]ContextInfo, 0, len(v.contexts))
+	for _, c := range v.contexts {
+		infos = append(infos, ContextInfo{Name: c.config.Name, Prefix: c.config.Prefix, Unlocked: c.aead != nil})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// AddContext creates an unlocked encryption context for prefix protected by passphrase,
+// encrypting any values already stored under the prefix
+func (v *Vault) AddContext(name, prefix, passphrase string) error {
+	if name == "" || prefix == "" {
+		return fmt.Errorf("context name and prefix must not be empty")
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	for _, c := range v.contexts {
+		if c.config.Name == name {
+			return fmt.Errorf("encryption context %q already exists", name)
+		}
+		if strings.HasPrefix(prefix, c.config.Prefix) || strings.HasPrefix(c.config.Prefix, prefix) {
+			return fmt.Errorf("prefix %q overlaps context %q with prefix %q", prefix, c.config.Name, c.config.Prefix)
+		}
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	c := &encryptionContext{config: contextConfig{Name: name, Prefix: prefix, Salt: base64.StdEncoding.EncodeToString(salt)}}
+	key, err := c.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+	if err := c.setKey(key); err != nil {
+		return err
+	}
+	verifier, err := c.seal(c.verifierKey(), c.verifierKey())
+	if err != nil {
+		return err
+	}
+	c.config.Verifier = verifier
+
+	if err := v.encryptExisting(c); err != nil {
+		return err
+	}
+	v.contexts = append(v.contexts, c)
+	if err := v.save(); err != nil {
+		v.contexts = v.contexts[:len(v.contexts)-1]
+		return err
+	}
+	return nil
+}
+
+// encryptExisting encrypts the plaintext values already stored under the context prefix
+func (v *Vault) encryptExisting(c *encryptionContext) error {
+	it, err := v.store.Scan(c.config.Prefix, prefixEnd(c.config.Prefix))
+	if err != nil {
+		return fmt.Errorf("failed to scan %q: %w", c.config.Prefix, err)
+	}
+	defer it.Close()
+
+	batch := lsmtree.NewWriteBatch()
+	for it.Next() {
+		if strings.HasPrefix(it.Value(), encryptedPrefix) {
+			continue
+		}
+		sealed, err := c.seal(it.Key(), it.Value())
+		if err != nil {
+			return err
+		}
+		batch.Set(it.Key(), sealed)
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("failed to scan %q: %w", c.config.Prefix, err)
+	}
+	// The plaintext versions kept of the values would outlive the encryption
+	if store, ok := v.store.(versionedStore); ok {
+		if err := store.ForgetVersions(c.config.Prefix); err != nil {
+			return fmt.Errorf("failed to drop plaintext versions: %w", err)
+		}
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	if err := v.store.Batch(batch); err != nil {
+		return fmt.Errorf("failed to encrypt existing values: %w", err)
+	}
+	return nil
+}
+
+// Unlock derives the key of a context from its passphrase
+func (v *Vault) Unlock(name, passphrase string) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	c, err := v.context(name)
+	if err != nil {
+		return err
+	}
+	key, err := c.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+	return c.unlock(key)
+}
+
+// UnlockWithKey unlocks a context with key material returned by ExportKey
+func (v *Vault) UnlockWithKey(name, hexKey string) error {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != keySize {
+		return ErrWrongKey
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	c, err := v.context(name)
+	if err != nil {
+		return err
+	}
+	return c.unlock(key)
+}
+
+// ExportKey returns the hex-encoded key of an unlocked context. It only unlocks
+// that context's prefix.
+func (v *Vault) ExportKey(name string) (string, error) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	c, err := v.context(name)
+	if err != nil {
+		return "", err
+	}
+	if c.aead == nil {
+		return "", fmt.Errorf("%w: %s", ErrLocked, name)
+	}
+	return hex.EncodeToString(c.key), nil
+}
+
+// Lock forgets the key of a context
+func (v *Vault) Lock(name string) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	c, err := v.context(name)
+	if err != nil {
+		return err
+	}
+	c.aead, c.key = nil, nil
+	return nil
+}
+
+// Get retrieves and decrypts the value for a key
+func (v *Vault) Get(key string) (string, error) {
+	return v.GetCtx(context.Background(), key)
+}
+
+// GetCtx is like Get, giving up when ctx is done as the store under the vault does
+func (v *Vault) GetCtx(ctx context.Context, key string) (string, error) {
+	c, err := v.contextFor(key)
+	if err != nil {
+		return "", err
+	}
+	value, err := lsmtree.WithContext(v.store).GetCtx(ctx, key)
+	if err != nil || c == nil || value == "" {
+		return value, err
+	}
+	return c.open(key, value)
+}
+
+// Set encrypts the value if the key belongs to a context and stores it
+func (v *Vault) Set(key, value string) error {
+	return v.SetCtx(context.Background(), key, value)
+}
+
+// SetCtx is like Set, giving up when ctx is done as the store under the vault does
+func (v *Vault) SetCtx(ctx context.Context, key, value string) error {
+	sealed, err := v.sealFor(key, value)
+	if err != nil {
+		return err
+	}
+	return lsmtree.WithContext(v.store).SetCtx(ctx, key, sealed)
+}
+
+// Delete removes a key-value pair. Keys of locked contexts can't be deleted.
+func (v *Vault) Delete(key string) error {
+	return v.DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx is like Delete, giving up when ctx is done as the store under the vault does
+func (v *Vault) DeleteCtx(ctx context.Context, key string) error {
+	if _, err := v.contextFor(key); err != nil {
+		return err
+	}
+	return lsmtree.WithContext(v.store).DeleteCtx(ctx, key)
+}
+
+// Batch encrypts the values of the batch and applies it
+func (v *Vault) Batch(batch *lsmtree.WriteBatch) error {
+	return v.BatchCtx(context.Background(), batch)
+}
+
+// BatchCtx is like Batch, giving up when ctx is done as the store under the vault does
+func (v *Vault) BatchCtx(ctx context.Context, batch *lsmtree.WriteBatch) error {
+	sealed := lsmtree.NewWriteBatch()
+	for _, op := range batch.Ops() {
+		if op.Delete {
+			if _, err := v.contextFor(op.Key); err != nil {
+				return err
+			}
+			sealed.Delete(op.Key)
+			continue
+		}
+		value, err := v.sealFor(op.Key, op.Value)
+		if err != nil {
+			return err
+		}
+		sealed.Set(op.Key, value)
+	}
+	return lsmtree.WithContext(v.store).BatchCtx(ctx, sealed)
+}
+
+// Versions returns the versions kept of a key with decrypted values, oldest first.
+// Without versions in the store it returns errors.ErrUnsupported.
+func (v *Vault) Versions(key string) ([]lsmtree.Version, error) {
+	store, ok := v.store.(versionedStore)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	c, err := v.contextFor(key)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := store.Versions(key)
+	if err != nil || c == nil {
+		return versions, err
+	}
+	for i := range versions {
+		if !versions[i].Deleted {
+			if versions[i].Value, err = c.open(key, versions[i].Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return versions, nil
+}
+
+// Scan returns an iterator over live keys in [start, end) with decrypted values.
+// Keys of locked contexts are skipped.
+func (v *Vault) Scan(start, end string) (lsmtree.Iterator, error) {
+	return v.ScanCtx(context.Background(), start, end)
+}
+
+// ScanCtx is like Scan, giving up when ctx is done as the store under the vault does
+func (v *Vault) ScanCtx(ctx context.Context, start, end string) (lsmtree.Iterator, error) {
+	it, err := lsmtree.WithContext(v.store).ScanCtx(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &vaultIterator{vault: v, it: it}, nil
+}
+
+// Stats returns the statistics of the engine under the vault. Without a store
+// reporting them it returns errors.ErrUnsupported.
+func (v *Vault) Stats() (lsmtree.Stats, error) {
+	store, ok := v.store.(statsStore)
+	if !ok {
+		return lsmtree.Stats{}, errors.ErrUnsupported
+	}
+	return store.Stats(), nil
+}
+
+// Reclaim frees the space of deleted and overwritten entries in the engine under
+// the vault. Without a store that can it returns errors.ErrUnsupported.
+func (v *Vault) Reclaim() (lsmtree.ReclaimResult, error) {
+	store, ok := v.store.(reclaimStore)
+	if !ok {
+		return lsmtree.ReclaimResult{}, errors.ErrUnsupported
+	}
+	return store.Reclaim()
+}
+
+// Watch returns a channel of the writes to keys starting with prefix with
+// decrypted values, and a function that stops watching, as lsmtree.LSMTree.Watch
+// does. Writes to keys of locked contexts are skipped, as Scan skips their keys.
+// Without a watchable store it returns errors.ErrUnsupported.
+func (v *Vault) Watch(prefix string) (<-chan lsmtree.Event, func(), error) {
+	store, ok := v.store.(watchableStore)
+	if !ok {
+		return nil, nil, errors.ErrUnsupported
+	}
+	events, stopStore, err := store.Watch(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := make(chan lsmtree.Event)
+	done := make(chan struct{})
+	go func() {
+		defer close(out)
+		for event := range events {
+			event, ok := v.openEvent(event)
+			if !ok {
+				continue
+			}
+			select {
+			case out <- event:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return out, func() {
+		once.Do(func() {
+			close(done)
+			stopStore()
+		})
+	}, nil
+}
+
+// openEvent decrypts the values of an event, reporting false if its key belongs
+// to a locked context or a value can't be decrypted
+func (v *Vault) openEvent(event lsmtree.Event) (lsmtree.Event, bool) {
+	c, err := v.contextFor(event.Key)
+	if err != nil {
+		return event, false
+	}
+	if c == nil {
+		return event, true
+	}
+	for _, value := range []*string{&event.OldValue, &event.NewValue} {
+		if *value == "" {
+			continue
+		}
+		if *value, err = c.open(event.Key, *value); err != nil {
+			return event, false
+		}
+	}
+	return event, true
+}
+
+// Close closes the underlying store
+func (v *Vault) Close() error {
+	return v.store.Close()
+}
+
+// context returns the context with the given name. The mutex must be held.
+func (v *Vault) context(name string) (*encryptionContext, error) {
+	for _, c := range v.contexts {
+		if c.config.Name == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownContext, name)
+}
+
+// lookup returns the context whose prefix covers key, or nil. The mutex must be held.
+func (v *Vault) lookup(key string) *encryptionContext {
+	for _, c := range v.contexts {
+		if strings.HasPrefix(key, c.config.Prefix) {
+			return c
+		}
+	}
+	return nil
+}
+
+// contextFor returns the unlocked context covering key, nil if no context covers
+// it, or ErrLocked if its context is locked
+func (v *Vault) contextFor(key string) (*encryptionContext, error) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	c := v.lookup(key)
+	if c == nil {
+		return nil, nil
+	}
+	if c.aead == nil {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, c.config.Name)
+	}
+	return c, nil
+}
+
+// sealFor encrypts value if key belongs to a context. Empty values are tombstones
+// and stay empty.
+func (v *Vault) sealFor(key, value string) (string, error) {
+	c, err := v.contextFor(key)
+	if err != nil || c == nil || value == "" {
+		return value, err
+	}
+	return c.seal(key, value)
+}
+
+// save writes the context configuration atomically. The mutex must be held.
+func (v *Vault) save() error {
+	configs := make([]contextConfig, 0, len(v.contexts))
+	for _, c := range v.contexts {
+		configs = append(configs, c.config)
+	}
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode encryption contexts: %w", err)
+	}
+
+	path := filepath.Join(v.dataDir, contextsFileName)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write encryption contexts: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace encryption contexts: %w", err)
+	}
+	return nil
+}
+
+// deriveKey derives the context key from a passphrase
+func (c *encryptionContext) deriveKey(passphrase string) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(c.config.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt for context %q: %w", c.config.Name, err)
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return key, nil
+}
+
+// setKey installs the cipher for key
+func (c *encryptionContext) setKey(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("failed to create cipher: %w", err)
+	}
+	c.aead, c.key = aead, key
+	return nil
+}
+
+// unlock installs key if it decrypts the context verifier
+func (c *encryptionContext) unlock(key []byte) error {
+	candidate := &encryptionContext{config: c.config}
+	if err := candidate.setKey(key); err != nil {
+		return err
+	}
+	verifier, err := candidate.open(candidate.verifierKey(), c.config.Verifier)
+	if err != nil || subtle.ConstantTimeCompare([]byte(verifier), []byte(candidate.verifierKey())) != 1 {
+		return ErrWrongKey
+	}
+	c.aead, c.key = candidate.aead, candidate.key
+	return nil
+}
+
+// verifierKey is the known plaintext, and associated data, of the context verifier
+func (c *encryptionContext) verifierKey() string {
+	return "lockr-context:" + c.config.Name
+}
+
+// seal encrypts value, binding it to key so ciphertexts can't be swapped between keys
+func (c *encryptionContext) seal(key, value string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), []byte(key))
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value sealed for key
+func (c *encryptionContext) open(key, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return "", fmt.Errorf("value of %q isn't encrypted by context %q", key, c.config.Name)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value for %q", key)
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value for %q: %w", key, err)
+	}
+	return string(plaintext), nil
+}
+
+// prefixEnd returns the smallest key greater than every key with the given
+// prefix, or "" if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
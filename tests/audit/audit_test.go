@@ -0,0 +1,185 @@
+package audit_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"Lockr/bin/audit"
+	"Lockr/bin/lockrtest"
+)
+
+// TestAuditStore tests that the operations of a wrapped store are recorded in a
+// hash chain that survives reopening and reveals edits of past entries
+func TestAuditStore(t *testing.T) {
+	dir := t.TempDir()
+	log, err := audit.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	store := audit.Wrap(lockrtest.NewFake(), log, audit.SourceTUI)
+	lockrtest.Populate(t, store, map[string]string{"db/password": "hunter2"})
+	lockrtest.AssertValue(t, store, "db/password", "hunter2")
+	if err := store.Delete("db/password"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatalf("Failed to close audit log: %v", err)
+	}
+
+	// Reopened, the log carries on the chain
+	log, err = audit.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log: %v", err)
+	}
+	if err := log.Record(audit.SourceCLI, audit.OpExport, "db/", "json to -"); err != nil {
+		t.Fatalf("Failed to record: %v", err)
+	}
+	log.Close()
+
+	entries, err := audit.Read(dir)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	var ops []string
+	for _, entry := range entries {
+		ops = append(ops, entry.Source+" "+entry.Op+" "+entry.Key)
+	}
+	if got, want := strings.Join(ops, ", "), "tui set db/password, tui get db/password, tui delete db/password, cli export db/"; got != want {
+		t.Errorf("Expected entries %q, got %q", want, got)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "audit.log"))
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("Expected values to stay out of the audit log")
+	}
+
+	var gets int
+	for _, entry := range entries {
+		if (audit.Filter{Key: "db/", Op: audit.OpGet}).Matches(entry) {
+			gets++
+		}
+	}
+	if gets != 1 {
+		t.Errorf("Expected the filter to match 1 get, got %d", gets)
+	}
+
+	// Rewriting an entry breaks the chain from there on
+	tampered := strings.Replace(string(data), `"op":"get"`, `"op":"set"`, 1)
+	if err := os.WriteFile(filepath.Join(dir, "audit.log"), []byte(tampered), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = audit.Read(dir)
+	if !errors.Is(err, audit.ErrTampered) {
+		t.Fatalf("Expected a tampered log to be reported, got %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected the 1 entry before the edit, got %d", len(entries))
+	}
+}
+
+// TestAuditTornEntry tests that an entry torn by a crash is dropped on open
+func TestAuditTornEntry(t *testing.T) {
+	dir := t.TempDir()
+	log, err := audit.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	if err := log.Record(audit.SourceCLI, audit.OpGet, "a", ""); err != nil {
+		t.Fatalf("Failed to record: %v", err)
+	}
+	log.Close()
+
+	file, err := os.OpenFile(filepath.Join(dir, "audit.log"), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"seq":2,"time":`)
+	file.Close()
+
+	log, err = audit.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log with a torn entry: %v", err)
+	}
+	if err := log.Record(audit.SourceCLI, audit.OpGet, "b", ""); err != nil {
+		t.Fatalf("Failed to record: %v", err)
+	}
+	log.Close()
+
+	entries, err := audit.Read(dir)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	if len(entries) != 2 || entries[1].Key != "b" || entries[1].Seq != 2 {
+		t.Errorf("Expected the torn entry to be replaced by b, got %+v", entries)
+	}
+}
+
+// TestAuditExportImport tests that an exported audit log is imported into a new
+// data directory with its chain intact, and that a tampered export or a log with
+// entries of its own is refused
+func TestAuditExportImport(t *testing.T) {
+	dir := t.TempDir()
+	log, err := audit.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := log.Record(audit.SourceCLI, audit.OpSet, key, ""); err != nil {
+			t.Fatalf("Failed to record: %v", err)
+		}
+	}
+	log.Close()
+
+	var export bytes.Buffer
+	if n, err := audit.Export(dir, &export); err != nil || n != 3 {
+		t.Fatalf("Expected 3 entries exported, got %d (%v)", n, err)
+	}
+
+	// Imported twice, the entries are only appended once and the chain carries on
+	imported := t.TempDir()
+	for i, expected := range []int{3, 0} {
+		if n, err := audit.Import(imported, bytes.NewReader(export.Bytes())); err != nil || n != expected {
+			t.Fatalf("Expected import %d to append %d entries, got %d (%v)", i+1, expected, n, err)
+		}
+	}
+	log, err = audit.Open(imported)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	if err := log.Record(audit.SourceCLI, audit.OpGet, "d", ""); err != nil {
+		t.Fatalf("Failed to record: %v", err)
+	}
+	log.Close()
+	original, _ := audit.Read(dir)
+	entries, err := audit.Read(imported)
+	if err != nil {
+		t.Fatalf("Failed to read imported audit log: %v", err)
+	}
+	if len(entries) != 4 || entries[2].Hash != original[2].Hash || entries[3].Key != "d" {
+		t.Errorf("Expected the 3 original entries followed by d, got %+v", entries)
+	}
+
+	// An edited export breaks its chain and imports nothing
+	tampered := strings.Replace(export.String(), `"key":"b"`, `"key":"x"`, 1)
+	if _, err := audit.Import(t.TempDir(), strings.NewReader(tampered)); !errors.Is(err, audit.ErrTampered) {
+		t.Errorf("Expected a tampered export to be refused, got %v", err)
+	}
+
+	// A log with entries of its own can't take another log's history
+	other := t.TempDir()
+	log, err = audit.Open(other)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	log.Record(audit.SourceTUI, audit.OpGet, "z", "")
+	log.Close()
+	if _, err := audit.Import(other, bytes.NewReader(export.Bytes())); err == nil {
+		t.Error("Expected importing into a log with other entries to fail")
+	}
+	if entries, _ := audit.Read(other); len(entries) != 1 {
+		t.Errorf("Expected the refused import to leave the log alone, got %d entries", len(entries))
+	}
+}
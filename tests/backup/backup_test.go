@@ -0,0 +1,170 @@
+package backup_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"Lockr/bin/backup"
+	"Lockr/bin/lsmtree"
+)
+
+const passphrase = "correct horse battery staple"
+
+// fakeS3 serves the part of the S3 API the target uses, from memory
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") || r.Header.Get("X-Amz-Date") == "" {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "bucket" {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		prefix := r.URL.Query().Get("prefix")
+		var keys []string
+		for name := range s.objects {
+			if rest, ok := strings.CutPrefix(name, prefix); ok && !strings.Contains(rest, "/") {
+				keys = append(keys, name)
+			}
+		}
+		sort.Strings(keys)
+		type object struct {
+			Key string `xml:"Key"`
+		}
+		result := struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []object `xml:"Contents"`
+		}{}
+		for _, key := range keys {
+			result.Contents = append(result.Contents, object{Key: key})
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		s.objects[key] = data
+	case r.Method == http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>"))
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// TestBackup tests that backups uploaded to a target restore the store with the
+// writes archived since, and that the retention policy prunes the old ones
+func TestBackup(t *testing.T) {
+	t.Run("dir", func(t *testing.T) {
+		target, err := backup.Open(filepath.Join(t.TempDir(), "backups"))
+		if err != nil {
+			t.Fatalf("Failed to open target: %v", err)
+		}
+		testTarget(t, target)
+	})
+	t.Run("s3", func(t *testing.T) {
+		ts := httptest.NewServer(&fakeS3{objects: make(map[string][]byte)})
+		defer ts.Close()
+		t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+		t.Setenv("AWS_ENDPOINT_URL", ts.URL)
+		target, err := backup.Open("s3://bucket/lockr/laptop")
+		if err != nil {
+			t.Fatalf("Failed to open target: %v", err)
+		}
+		testTarget(t, target)
+	})
+}
+
+func testTarget(t *testing.T, target backup.Target) {
+	ctx := context.Background()
+	defer target.Close()
+	if _, err := backup.Download(ctx, target, passphrase, "", t.TempDir(), ""); !errors.Is(err, backup.ErrNoBackups) {
+		t.Errorf("Expected ErrNoBackups from an empty target, got %v", err)
+	}
+
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{WALArchiveDir: t.TempDir()})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	defer tree.Close()
+	upload := func(key string, options backup.Options) backup.UploadResult {
+		t.Helper()
+		if err := tree.Set(key, "v-"+key); err != nil {
+			t.Fatalf("Failed to set: %v", err)
+		}
+		options.Passphrase = passphrase
+		result, err := backup.Upload(ctx, tree, target, options)
+		if err != nil {
+			t.Fatalf("Failed to upload: %v", err)
+		}
+		return result
+	}
+	first := upload("a", backup.Options{})
+	second := upload("b", backup.Options{})
+	if second.Segments != 0 {
+		t.Errorf("Expected the segment of a, which the first backup holds, not to be uploaded, got %+v", second)
+	}
+	third := upload("c", backup.Options{KeepLast: 2})
+	if len(third.Deleted) != 2 || !strings.Contains(third.Deleted[0], first.Checkpoint.Name) {
+		t.Errorf("Expected the first backup and the segment of b to be deleted, got %v", third.Deleted)
+	}
+	upload("d", backup.Options{KeepLast: 3})
+	checkpoints, err := backup.List(ctx, target)
+	if err != nil || len(checkpoints) != 3 || checkpoints[0].Name != second.Checkpoint.Name {
+		t.Fatalf("Expected 3 backups from the second, got %+v, %v", checkpoints, err)
+	}
+
+	// The second backup with the segments uploaded since brings back every write but the last
+	backupDir, walDir := filepath.Join(t.TempDir(), "backup"), filepath.Join(t.TempDir(), "wal")
+	result, err := backup.Download(ctx, target, passphrase, second.Checkpoint.Name, backupDir, walDir)
+	if err != nil || result.Segments != 1 {
+		t.Fatalf("Expected the second backup with the segment of c, got %+v, %v", result, err)
+	}
+	dataDir := t.TempDir()
+	if _, err := lsmtree.Restore(dataDir, backupDir, lsmtree.RestoreOptions{WALArchive: walDir}); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	restored := lsmtree.NewLSMTree(dataDir)
+	if err := restored.Recover(); err != nil {
+		t.Fatalf("Failed to open restored tree: %v", err)
+	}
+	defer restored.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if value, err := restored.Get(key); err != nil || value != "v-"+key {
+			t.Errorf("Expected %s=v-%s, got %q, %v", key, key, value, err)
+		}
+	}
+	if value, _ := restored.Get("d"); value != "" {
+		t.Errorf("Expected d not to be uploaded yet, got %q", value)
+	}
+
+	if _, err := backup.Download(ctx, target, "wrong", "", t.TempDir(), ""); !errors.Is(err, backup.ErrWrongPassphrase) {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+}
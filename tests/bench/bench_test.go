@@ -0,0 +1,52 @@
+package bench_test
+
+import (
+	"context"
+	"testing"
+
+	"Lockr/bin/bench"
+	"Lockr/bin/lsmtree"
+)
+
+// TestRun tests that a benchmark makes its writes alongside the reads and
+// measures what the engine wrote and keeps for them
+func TestRun(t *testing.T) {
+	for _, workload := range []bench.Workload{bench.Uniform, bench.Zipfian, bench.Sequential} {
+		t.Run(string(workload), func(t *testing.T) {
+			tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{MemTableSize: 16 << 10, WALSync: lsmtree.SyncNever})
+			if err := tree.Recover(); err != nil {
+				t.Fatalf("Failed to recover: %v", err)
+			}
+			defer tree.Close()
+
+			result, err := bench.Run(context.Background(), tree, bench.Options{Writes: 1000, Readers: 1, ValueSize: 64, Keys: 250, Workload: workload})
+			if err != nil {
+				t.Fatalf("Failed to run: %v", err)
+			}
+			if result.Writes.Ops != 1000 || result.Writes.Errors != 0 || result.Reads.Errors != 0 {
+				t.Errorf("Expected 1000 writes without errors, got %+v and reads %+v", result.Writes, result.Reads)
+			}
+			if w := result.Writes; w.P50 > w.P99 || w.P99 > w.Max || w.Throughput <= 0 {
+				t.Errorf("Expected ordered percentiles and a throughput, got %+v", w)
+			}
+			if result.Written.Flushes == 0 || result.Written.WAL < result.UserBytes {
+				t.Errorf("Expected flushes and every byte logged, got %+v for %d bytes", result.Written, result.UserBytes)
+			}
+			if result.WriteAmplification < 1 || result.SpaceAmplification <= 0 || result.LiveBytes > result.UserBytes {
+				t.Errorf("Expected the amplifications, got %+v", result)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+	result, err := bench.Run(ctx, tree, bench.Options{Writes: 10, ValueSize: 8})
+	if err != nil || !result.Interrupted || result.Writes.Ops != 0 {
+		t.Errorf("Expected an interrupted run without writes, got %+v, %v", result, err)
+	}
+}
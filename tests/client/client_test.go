@@ -0,0 +1,477 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"Lockr/bin/client"
+	"Lockr/bin/lockrtest"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/server"
+	"Lockr/bin/vault"
+)
+
+// TestClientRoundTrip tests the client against a server backed by a fake store
+func TestClientRoundTrip(t *testing.T) {
+	store := lockrtest.NewFake()
+	lockrtest.Populate(t, store, map[string]string{"aws/key": "a", "aws/secret": "b", "github/token": "c"})
+	ts := httptest.NewServer(server.New(store))
+	defer ts.Close()
+	c := client.New(ts.URL)
+	defer c.Close()
+
+	if err := c.Set("db/prod password", "hunter2"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if value, err := c.Get("db/prod password"); err != nil || value != "hunter2" {
+		t.Errorf("Expected 'hunter2', got '%s' (%v)", value, err)
+	}
+	if value, err := c.Get("missing"); err != nil || value != "" {
+		t.Errorf("Expected a missing key to be empty, got '%s' (%v)", value, err)
+	}
+
+	entries, err := c.ListKeys(context.Background(), client.ListOptions{Prefix: "aws/"})
+	if err != nil {
+		t.Fatalf("Failed to list keys: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Key != "aws/key" || entries[1].Key != "aws/secret" {
+		t.Errorf("Unexpected prefix listing: %v", entries)
+	}
+
+	it, err := c.Scan("aws/secret", "github/")
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if want := []string{"aws/secret", "db/prod password"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Expected scan %v, got %v", want, keys)
+	}
+
+	if err := c.Delete("aws/key"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	_, err = c.GetKey(context.Background(), "aws/key")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 API error, got %v", err)
+	}
+	if err := c.Set("empty", ""); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 API error for an empty value, got %v", err)
+	}
+}
+
+// TestClientCoversSpec tests that the served OpenAPI document parses and every operation has a client method
+func TestClientCoversSpec(t *testing.T) {
+	ts := httptest.NewServer(server.New(lockrtest.NewFake()))
+	defer ts.Close()
+
+	doc, err := client.New(ts.URL).GetOpenAPI(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to fetch OpenAPI document: %v", err)
+	}
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(doc, &spec); err != nil {
+		t.Fatalf("Failed to parse OpenAPI document: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("Expected an OpenAPI 3 document, got version %q", spec.OpenAPI)
+	}
+
+	clientType := reflect.TypeOf(&client.Client{})
+	for path, operations := range spec.Paths {
+		for method, raw := range operations {
+			var operation struct {
+				OperationID string `json:"operationId"`
+			}
+			if method == "parameters" || json.Unmarshal(raw, &operation) != nil {
+				continue
+			}
+			name := strings.ToUpper(operation.OperationID[:1]) + operation.OperationID[1:]
+			if _, ok := clientType.MethodByName(name); !ok {
+				t.Errorf("Operation %s %s (%s) has no client method %s", method, path, operation.OperationID, name)
+			}
+		}
+	}
+}
+
+// TestListPagination tests that listings page through keys with start-after tokens, limits and without values
+func TestListPagination(t *testing.T) {
+	store := lockrtest.NewFake()
+	expected := map[string]string{}
+	for i := 0; i < 25; i++ {
+		expected[fmt.Sprintf("key%02d", i)] = fmt.Sprintf("value%d", i)
+	}
+	expected["other"] = "value"
+	lockrtest.Populate(t, store, expected)
+	ts := httptest.NewServer(server.New(store))
+	defer ts.Close()
+	c := client.New(ts.URL)
+
+	opts := client.ListOptions{Prefix: "key", Limit: 10, KeysOnly: true}
+	var keys []string
+	for pages := 1; ; pages++ {
+		page, err := c.ListPage(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Failed to list page %d: %v", pages, err)
+		}
+		for _, e := range page.Keys {
+			if e.Value != "" {
+				t.Errorf("Expected no values, got %s=%q", e.Key, e.Value)
+			}
+			keys = append(keys, e.Key)
+		}
+		if page.NextToken == "" {
+			if pages != 3 {
+				t.Errorf("Expected 3 pages, got %d", pages)
+			}
+			break
+		}
+		opts.StartAfter = page.NextToken
+	}
+	if len(keys) != 25 || keys[0] != "key00" || keys[24] != "key24" {
+		t.Errorf("Expected key00 to key24 in order, got %v", keys)
+	}
+
+	entries, err := c.ListKeys(context.Background(), client.ListOptions{StartAfter: "key20", Limit: 3})
+	if err != nil || len(entries) != 3 || entries[0].Key != "key21" || entries[0].Value != "value21" {
+		t.Errorf("Expected key21 to key23 with values, got %v (%v)", entries, err)
+	}
+	all, err := c.ListKeys(context.Background(), client.ListOptions{})
+	if err != nil || len(all) != 26 {
+		t.Errorf("Expected all 26 entries, got %d (%v)", len(all), err)
+	}
+
+	var apiErr *client.Error
+	if _, err := c.ListPage(context.Background(), client.ListOptions{Limit: 20000}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 API error for a limit over the maximum, got %v", err)
+	}
+}
+
+// TestClientBatch tests that batches are applied in order, and that invalid ones apply nothing
+func TestClientBatch(t *testing.T) {
+	store := lockrtest.NewFake()
+	lockrtest.Populate(t, store, map[string]string{"old": "a"})
+	ts := httptest.NewServer(server.New(store))
+	defer ts.Close()
+	c := client.New(ts.URL)
+
+	batch := lsmtree.NewWriteBatch()
+	batch.Set("new", "b")
+	batch.Set("new", "c")
+	batch.Delete("old")
+	if err := c.Batch(batch); err != nil {
+		t.Fatalf("Failed to apply batch: %v", err)
+	}
+	if value, _ := store.Get("new"); value != "c" {
+		t.Errorf("Expected the later set to win, got %q", value)
+	}
+	if value, _ := store.Get("old"); value != "" {
+		t.Errorf("Expected old to be deleted, got %q", value)
+	}
+
+	var apiErr *client.Error
+	err := c.ApplyBatch(context.Background(), []client.BatchOp{{Key: "x", Value: "1"}, {Key: "y"}})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 API error for a set without a value, got %v", err)
+	}
+	if value, _ := store.Get("x"); value != "" {
+		t.Errorf("Expected nothing of an invalid batch to be applied, got x=%q", value)
+	}
+}
+
+// recordStore keeps the records of tokens in memory
+type recordStore map[string]string
+
+func (r recordStore) Records(prefix string) (map[string]string, error) {
+	records := map[string]string{}
+	for name, value := range r {
+		if strings.HasPrefix(name, prefix) {
+			records[name] = value
+		}
+	}
+	return records, nil
+}
+
+func (r recordStore) SetRecord(name, value string) error {
+	if value == "" {
+		delete(r, name)
+	} else {
+		r[name] = value
+	}
+	return nil
+}
+
+// TestTokens tests that a server requiring tokens refuses requests without one
+// or beyond the token's scope, and that admin tokens manage the others
+func TestTokens(t *testing.T) {
+	records := recordStore{}
+	tokens, err := server.LoadTokens(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := tokens.Add("admin", server.ScopeAdmin)
+	if err != nil {
+		t.Fatalf("Failed to add token: %v", err)
+	}
+	srv := server.New(lockrtest.NewFake())
+	srv.RequireTokens(tokens)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	c := client.New(ts.URL)
+	var apiErr *client.Error
+	if err := c.Set("key", "value"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 API error without a token, got %v", err)
+	}
+	if _, err := c.GetOpenAPI(context.Background()); err != nil {
+		t.Errorf("Expected the OpenAPI document to stay public, got %v", err)
+	}
+
+	c.SetToken(admin)
+	reader, err := c.AddToken(context.Background(), "reader", "read")
+	if err != nil || reader.Scope != "read" || !strings.HasPrefix(reader.Secret, "lockr_") {
+		t.Fatalf("Failed to add a read token: %+v, %v", reader, err)
+	}
+	if err := c.Set("key", "value"); err != nil {
+		t.Errorf("Expected the admin token to write, got %v", err)
+	}
+
+	c.SetToken(reader.Secret)
+	if value, err := c.Get("key"); err != nil || value != "value" {
+		t.Errorf("Expected the read token to read, got %q, %v", value, err)
+	}
+	if err := c.Delete("key"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a 403 API error for a write with a read token, got %v", err)
+	}
+	if _, err := c.ListTokens(context.Background()); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a 403 API error listing tokens with a read token, got %v", err)
+	}
+
+	// Tokens are stored hashed, and reloaded from the records
+	for _, value := range records {
+		if strings.Contains(value, reader.Secret) || strings.Contains(value, admin) {
+			t.Errorf("Expected no secret in the records, got %s", value)
+		}
+	}
+	reloaded, err := server.LoadTokens(records)
+	if err != nil || len(reloaded.List()) != 2 {
+		t.Errorf("Expected 2 tokens after reloading, got %v, %v", reloaded.List(), err)
+	}
+
+	c.SetToken(admin)
+	if err := c.RevokeToken(context.Background(), "reader"); err != nil {
+		t.Fatalf("Failed to revoke token: %v", err)
+	}
+	c.SetToken(reader.Secret)
+	if _, err := c.Get("key"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 API error with a revoked token, got %v", err)
+	}
+}
+
+// TestClientUnix tests the client against a server on a unix socket only its owner may use
+func TestClientUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := server.New(lockrtest.NewFake()).ListenUnix(socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the socket to be owner-only, got %v, %v", info.Mode(), err)
+	}
+
+	c := client.NewUnix(socket)
+	defer c.Close()
+	if err := c.Set("key", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if value, err := c.Get("key"); err != nil || value != "value" {
+		t.Errorf("Expected 'value', got '%s' (%v)", value, err)
+	}
+}
+
+// TestClientWatch tests that the writes to a tree behind the server reach a
+// client watching them
+func TestClientWatch(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	defer tree.Close()
+	ts := httptest.NewServer(server.New(tree))
+	defer ts.Close()
+	c := client.New(ts.URL)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := c.WatchChanges(ctx, "app/")
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	if err := c.Set("other", "x"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := c.Set("app/a", "1"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if event := <-events; event.Type != lsmtree.EventSet || event.Key != "app/a" || event.NewValue != "1" {
+		t.Errorf("Expected app/a set to 1, got %+v", event)
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+// TestRequestTimeout tests that a write waiting for the store past the server's
+// request timeout fails with 503, and that reads don't wait for writes
+func TestRequestTimeout(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+	if err := tree.Set("key", "value"); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+	srv := server.New(tree)
+	srv.SetRequestTimeout(50 * time.Millisecond)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// A subscriber blocking on the write of slow holds the writer lock
+	held, release := make(chan struct{}), make(chan struct{})
+	unsubscribe := tree.Subscribe(func(change lsmtree.Change) {
+		if change.Key == "slow" {
+			close(held)
+			<-release
+		}
+	})
+	defer unsubscribe()
+	go tree.Set("slow", "value")
+	<-held
+
+	c := client.New(ts.URL)
+	var apiErr *client.Error
+	if err := c.Set("other", "value"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 API error while the store is busy, got %v", err)
+	}
+	if value, err := c.Get("key"); err != nil || value != "value" {
+		t.Errorf("Expected reads to be served while the store is busy, got %q, %v", value, err)
+	}
+	close(release)
+	if err := c.Set("other", "value"); err != nil {
+		t.Errorf("Expected the write to succeed once the store is free, got %v", err)
+	}
+}
+
+// TestClientStats tests that the engine statistics are served through the vault
+// and that stores without them answer 501, while the health check needs no token
+func TestClientStats(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+	v, err := vault.Open(t.TempDir(), tree)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	if err := v.Set("key", "value"); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+	ts := httptest.NewServer(server.New(v))
+	defer ts.Close()
+
+	stats, err := client.New(ts.URL).Stats()
+	if err != nil || stats.KeysEstimate == 0 || stats.MemTable.MaxBytes == 0 {
+		t.Errorf("Expected the tree's statistics, got %+v, %v", stats, err)
+	}
+
+	fake := httptest.NewServer(server.New(lockrtest.NewFake()))
+	defer fake.Close()
+	var apiErr *client.Error
+	if _, err := client.New(fake.URL).Stats(); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected a 501 API error from a store without statistics, got %v", err)
+	}
+
+	tokens, err := server.LoadTokens(recordStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(v)
+	srv.RequireTokens(tokens)
+	authenticated := httptest.NewServer(srv)
+	defer authenticated.Close()
+	c := client.New(authenticated.URL)
+	if health, err := c.GetHealth(context.Background()); err != nil || health.Status != "ok" {
+		t.Errorf("Expected a public health check, got %+v, %v", health, err)
+	}
+	if _, err := c.Stats(); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 API error without a token, got %v", err)
+	}
+}
+
+// TestClientReclaim tests that gc rewrites the server's SSTables and reports the
+// space freed
+func TestClientReclaim(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+	v, err := vault.Open(t.TempDir(), tree)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	for _, key := range []string{"kept", "deleted"} {
+		if err := v.Set(key, "value"); err != nil {
+			t.Fatalf("Failed to set: %v", err)
+		}
+	}
+	if err := v.Delete("deleted"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	ts := httptest.NewServer(server.New(v))
+	defer ts.Close()
+
+	result, err := client.New(ts.URL).Reclaim()
+	if err != nil || result.TablesAfter != 1 || result.EntriesAfter != 1 {
+		t.Errorf("Expected the tombstone dropped from a single SSTable, got %+v, %v", result, err)
+	}
+	if value, err := v.Get("kept"); err != nil || value != "value" {
+		t.Errorf("Expected kept=value after gc, got %q (%v)", value, err)
+	}
+
+	fake := httptest.NewServer(server.New(lockrtest.NewFake()))
+	defer fake.Close()
+	var apiErr *client.Error
+	if _, err := client.New(fake.URL).Reclaim(); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected a 501 API error from a store that can't reclaim space, got %v", err)
+	}
+
+	if err := tree.PauseBackground(time.Minute); err != nil {
+		t.Fatalf("Failed to pause: %v", err)
+	}
+	if _, err := client.New(ts.URL).Reclaim(); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Errorf("Expected a 409 API error while paused, got %v", err)
+	}
+	tree.ResumeBackground()
+}
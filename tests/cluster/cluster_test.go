@@ -0,0 +1,160 @@
+package cluster_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"Lockr/bin/cluster"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/raft"
+)
+
+const secret = "test-secret"
+
+// node is a cluster node over a tree in a directory kept across restarts
+type node struct {
+	id    string
+	dir   string
+	addr  string
+	mutex sync.Mutex
+	tree  *lsmtree.LSMTree
+	store *cluster.Store
+}
+
+// serve serves the node's Raft requests from its peers
+func (n *node) serve(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.mutex.Lock()
+		store := n.store
+		n.mutex.Unlock()
+		if store == nil {
+			http.Error(w, "not started", http.StatusServiceUnavailable)
+			return
+		}
+		raft.Handler(store.Node(), secret).ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	n.addr = ts.URL
+}
+
+// start opens the node's tree and starts it in the cluster of peers
+func (n *node) start(t *testing.T, peers map[string]string) {
+	t.Helper()
+	tree := lsmtree.NewLSMTreeWithOptions(n.dir, lsmtree.Options{MemTableSize: 4 << 10})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	store, err := cluster.Start(tree, cluster.Options{
+		ID:                n.id,
+		Transport:         &raft.HTTPTransport{Secret: secret},
+		Peers:             peers,
+		HeartbeatInterval: 20 * time.Millisecond,
+		ElectionTimeout:   150 * time.Millisecond,
+		SnapshotThreshold: 16,
+	})
+	if err != nil {
+		tree.Close()
+		t.Fatalf("Failed to start %s: %v", n.id, err)
+	}
+	n.mutex.Lock()
+	n.tree, n.store = tree, store
+	n.mutex.Unlock()
+	t.Cleanup(n.stop)
+}
+
+// stop stops the node and closes its tree
+func (n *node) stop() {
+	n.mutex.Lock()
+	store, tree := n.store, n.tree
+	n.store, n.tree = nil, nil
+	n.mutex.Unlock()
+	if store != nil {
+		store.Close()
+		tree.Close()
+	}
+}
+
+// waitFor waits until a node's tree has value for key
+func waitFor(t *testing.T, n *node, key, value string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got, _ := n.tree.Get(key); got == value {
+			return
+		}
+	}
+	got, _ := n.tree.Get(key)
+	t.Fatalf("Expected %s to have %s=%q, got %q", n.id, key, value, got)
+}
+
+// TestCluster tests that writes made on any node reach every node, which refuse
+// writes of their own, and survive a restart
+func TestCluster(t *testing.T) {
+	nodes := make([]*node, 3)
+	peers := map[string]string{}
+	for i := range nodes {
+		nodes[i] = &node{id: fmt.Sprintf("n%d", i+1), dir: t.TempDir()}
+		nodes[i].serve(t)
+		peers[nodes[i].id] = nodes[i].addr
+	}
+	for _, n := range nodes {
+		n.start(t, peers)
+	}
+
+	if err := nodes[0].store.Set("a", "1"); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+	batch := lsmtree.NewWriteBatch()
+	batch.Set("b", "2")
+	batch.Delete("a")
+	if err := nodes[1].store.Batch(batch); err != nil {
+		t.Fatalf("Failed to apply batch: %v", err)
+	}
+	if value, err := nodes[2].store.Get("b"); err != nil || value != "2" {
+		t.Errorf("Expected a read to see b=2, got %q, %v", value, err)
+	}
+	for _, n := range nodes {
+		waitFor(t, n, "b", "2")
+		waitFor(t, n, "a", "")
+	}
+
+	if err := nodes[0].tree.Set("local", "x"); !errors.Is(err, lsmtree.ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly writing to a node's tree, got %v", err)
+	}
+	if err := nodes[0].store.Set("\x00record\x00cluster/id", "x"); !errors.Is(err, lsmtree.ErrReservedKey) {
+		t.Errorf("Expected ErrReservedKey, got %v", err)
+	}
+
+	// Enough writes to compact the log while a node is down, which catches up from a snapshot
+	nodes[2].stop()
+	for i := 0; i < 40; i++ {
+		if err := nodes[i%2].store.Set(fmt.Sprintf("k%02d", i), fmt.Sprint(i)); err != nil {
+			t.Fatalf("Failed to set with a node down: %v", err)
+		}
+	}
+	nodes[2].start(t, nil)
+	waitFor(t, nodes[2], "k39", "39")
+	waitFor(t, nodes[2], "k00", "0")
+	if status := nodes[2].store.Node().Status(); status.Snapshot == 0 {
+		t.Errorf("Expected the restarted node to have a compacted log, got %+v", status)
+	}
+	if id, err := cluster.Member(nodes[2].tree); err != nil || id != "n3" {
+		t.Errorf("Expected the tree to remember n3, got %q, %v", id, err)
+	}
+
+	nodes[2].stop()
+	if _, err := func() (*cluster.Store, error) {
+		tree := lsmtree.NewLSMTree(nodes[2].dir)
+		if err := tree.Recover(); err != nil {
+			return nil, err
+		}
+		defer tree.Close()
+		return cluster.Start(tree, cluster.Options{ID: "n4", Transport: &raft.HTTPTransport{Secret: secret}})
+	}(); err == nil {
+		t.Error("Expected a node's tree not to start as another node")
+	}
+}
@@ -0,0 +1,97 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"Lockr/bin/config"
+)
+
+// TestConfig tests that config.toml is parsed, that LOCKR_<KEY> variables override it, and how store directories are resolved and listed
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("LOCKR_DATA_DIR", "")
+	t.Setenv("LOCKR_THEME", "")
+	path := filepath.Join(dir, "config.toml")
+	file := `# Lockr settings
+data_dir = "~/vaults/main"
+cache_size = 5_000   # entries
+sync = 'interval'
+sync_interval = "50ms"
+sync_max_bytes = 2_097_152
+wal_archive = "~/archive"
+theme = "blue"
+
+[stores]
+work = "/srv/lockr/work"
+`
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	c, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if c.DataDir != filepath.Join(dir, "vaults", "main") || c.CacheSize != 5000 || c.Sync != "interval" ||
+		c.SyncInterval != 50*time.Millisecond || c.SyncMaxBytes != 2097152 || c.WALArchive != filepath.Join(dir, "archive") || c.Theme != "blue" {
+		t.Errorf("Unexpected settings %+v", c)
+	}
+
+	for _, tc := range []struct{ flag, name, expected string }{
+		{"", "", filepath.Join(dir, "vaults", "main")},
+		{"", "work", "/srv/lockr/work"},
+		{"", "personal", filepath.Join(dir, "vaults", "main-personal")},
+		{"/tmp/other", "", "/tmp/other"},
+	} {
+		storeDir, err := c.StoreDir(tc.flag, tc.name)
+		if err != nil || storeDir != tc.expected {
+			t.Errorf("Expected store %q with -data-dir %q at %s, got %s (%v)", tc.name, tc.flag, tc.expected, storeDir, err)
+		}
+	}
+	if _, err := c.StoreDir("", "../escape"); err == nil {
+		t.Error("Expected an invalid store name to be rejected")
+	}
+
+	// Stores beside the default one are found without being configured
+	if err := os.MkdirAll(filepath.Join(dir, "vaults", "main-personal"), 0700); err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	names, err := c.StoreNames("")
+	if err != nil || !slices.Equal(names, []string{config.DefaultStore, "personal", "work"}) {
+		t.Errorf("Expected stores default, personal and work, got %v (%v)", names, err)
+	}
+
+	// The environment overrides the file
+	t.Setenv("LOCKR_DATA_DIR", "/env/lockr")
+	t.Setenv("LOCKR_THEME", "mono")
+	t.Setenv("LOCKR_SYNC_MAX_BYTES", "4096")
+	if c, err = config.Load(path); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if c.DataDir != "/env/lockr" || c.Theme != "mono" || c.SyncMaxBytes != 4096 || c.CacheSize != 5000 {
+		t.Errorf("Expected the environment to override data_dir, theme and sync_max_bytes, got %+v", c)
+	}
+
+	// A missing file leaves the defaults
+	if c, err = config.Load(filepath.Join(dir, "missing.toml")); err != nil || c.Stores != nil || c.CacheSize != 0 {
+		t.Errorf("Expected a missing config file to leave the defaults, got %+v (%v)", c, err)
+	}
+	if storeDir, _ := (config.Config{}).StoreDir("", ""); storeDir != filepath.Join(dir, ".Lockr") {
+		t.Errorf("Expected the default store in ~/.Lockr, got %s", storeDir)
+	}
+
+	for _, bad := range []string{"cache_size = \"big\"", "colour = \"red\"", "sync_interval = \"soon\"", "[engine]", "theme"} {
+		if err := os.WriteFile(path, []byte(bad+"\n"), 0600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		if _, err := config.Load(path); err == nil || !strings.Contains(err.Error(), "config.toml:1") {
+			t.Errorf("Expected %q to be rejected with its line, got %v", bad, err)
+		}
+	}
+}
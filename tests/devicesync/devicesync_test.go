@@ -0,0 +1,191 @@
+package devicesync_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"Lockr/bin/devicesync"
+	"Lockr/bin/lsmtree"
+)
+
+// device is a store with its syncer
+type device struct {
+	tree   *lsmtree.LSMTree
+	syncer *devicesync.Syncer
+}
+
+func openDevice(t *testing.T) *device {
+	t.Helper()
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{MemTableSize: 1 << 20})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	t.Cleanup(func() { tree.Close() })
+	syncer, err := devicesync.Open(tree)
+	if err != nil {
+		t.Fatalf("Failed to open syncer: %v", err)
+	}
+	return &device{tree: tree, syncer: syncer}
+}
+
+// syncWith syncs d with peer as if over the HTTP API
+func (d *device) syncWith(t *testing.T, peer *device) devicesync.Result {
+	t.Helper()
+	result, err := d.syncer.Sync("peer", func(in devicesync.Changeset) (devicesync.Changeset, error) {
+		out, _, err := peer.syncer.Exchange(in)
+		return out, err
+	})
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	return result
+}
+
+// entries returns the keys of a device, conflict copies by their key alone
+func entries(t *testing.T, d *device) map[string]string {
+	t.Helper()
+	list, err := d.tree.List()
+	if err != nil {
+		t.Fatalf("Failed to list: %v", err)
+	}
+	byKey := make(map[string]string, len(list))
+	for key, value := range list {
+		if i := strings.Index(key, ".conflict-"); i >= 0 {
+			key = key[:i] + ".conflict"
+		}
+		byKey[key] = value
+	}
+	return byKey
+}
+
+func expectEntries(t *testing.T, d *device, expected map[string]string) {
+	t.Helper()
+	got := entries(t, d)
+	if len(got) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+		return
+	}
+	for key, value := range expected {
+		if got[key] != value {
+			t.Errorf("Expected %s=%q, got %q", key, value, got[key])
+		}
+	}
+}
+
+// TestSync tests that two devices exchange only what the other is missing, and keep
+// the losing value of a key changed on both under a conflict copy
+func TestSync(t *testing.T) {
+	laptop, desktop := openDevice(t), openDevice(t)
+	laptop.tree.Set("a", "1")
+	laptop.tree.Set("b", "2")
+	desktop.tree.Set("c", "3")
+
+	result := laptop.syncWith(t, desktop)
+	if result.Sent != 2 || result.Received != 1 || len(result.Conflicts) != 0 {
+		t.Errorf("Expected 2 changes sent and 1 received, got %+v", result)
+	}
+	expected := map[string]string{"a": "1", "b": "2", "c": "3"}
+	expectEntries(t, laptop, expected)
+	expectEntries(t, desktop, expected)
+	if result := laptop.syncWith(t, desktop); result.Sent != 0 || result.Received != 0 {
+		t.Errorf("Expected nothing to exchange once in step, got %+v", result)
+	}
+
+	desktop.tree.Delete("a")
+	laptop.tree.Set("x", "laptop")
+	time.Sleep(5 * time.Millisecond)
+	desktop.tree.Set("x", "desktop")
+	result = desktop.syncWith(t, laptop)
+	if len(result.Conflicts) != 1 {
+		t.Errorf("Expected a conflict, got %+v", result)
+	}
+	expected = map[string]string{"b": "2", "c": "3", "x": "desktop", "x.conflict": "laptop"}
+	expectEntries(t, laptop, expected)
+	expectEntries(t, desktop, expected)
+
+	// A key written twice on one device isn't a conflict
+	desktop.tree.Set("b", "two")
+	desktop.syncWith(t, laptop)
+	desktop.tree.Set("b", "2.0")
+	if result := laptop.syncWith(t, desktop); len(result.Conflicts) != 0 || result.Received != 1 {
+		t.Errorf("Expected the second write to be merged alone, got %+v", result)
+	}
+	if value, _ := laptop.tree.Get("b"); value != "2.0" {
+		t.Errorf("Expected b=2.0, got %q", value)
+	}
+
+	self, err := devicesync.Open(laptop.tree)
+	if err != nil {
+		t.Fatalf("Failed to open syncer: %v", err)
+	}
+	if _, err := laptop.syncer.Sync("self", func(in devicesync.Changeset) (devicesync.Changeset, error) {
+		out, _, err := self.Exchange(in)
+		return out, err
+	}); !errors.Is(err, devicesync.ErrSameDevice) {
+		t.Errorf("Expected ErrSameDevice, got %v", err)
+	}
+}
+
+// TestSyncSameMillisecond tests that of two writes to a key in the same WAL
+// millisecond, synced in between, the second wins on the peer, whether the
+// first was made on the same device or merged from the peer
+func TestSyncSameMillisecond(t *testing.T) {
+	laptop, desktop := openDevice(t), openDevice(t)
+	for _, merged := range []bool{false, true} {
+		same := false
+		for attempt := 0; attempt < 100 && !same; attempt++ {
+			key := fmt.Sprintf("k-%t-%d", merged, attempt)
+			first, peer := desktop, laptop
+			if merged {
+				first, peer = laptop, desktop
+			}
+			start := time.Now().UnixMilli()
+			first.tree.Set(key, "first")
+			first.syncWith(t, peer)
+			desktop.tree.Set(key, "second")
+			same = time.Now().UnixMilli() == start
+			laptop.syncWith(t, desktop)
+			if value, _ := laptop.tree.Get(key); same && value != "second" {
+				t.Errorf("Expected the second write to %s to win (merged first: %t), got %q", key, merged, value)
+			}
+		}
+		if !same {
+			t.Skip("Writes never fell in the same millisecond")
+		}
+	}
+}
+
+// TestSyncFolder tests that devices sharing a folder converge, whichever syncs first
+func TestSyncFolder(t *testing.T) {
+	dir := t.TempDir()
+	devices := []*device{openDevice(t), openDevice(t), openDevice(t)}
+	devices[0].tree.Set("a", "1")
+	devices[1].tree.Set("b", "2")
+	devices[2].tree.Set("c", "3")
+
+	for round := 0; round < 2; round++ {
+		for _, d := range devices {
+			if _, err := d.syncer.SyncFolder(dir, "shared passphrase"); err != nil {
+				t.Fatalf("Failed to sync folder: %v", err)
+			}
+		}
+	}
+	for _, d := range devices {
+		expectEntries(t, d, map[string]string{"a": "1", "b": "2", "c": "3"})
+	}
+
+	devices[1].tree.Delete("a")
+	devices[1].syncer.SyncFolder(dir, "shared passphrase")
+	result, err := devices[2].syncer.SyncFolder(dir, "shared passphrase")
+	if err != nil || result.Devices != 2 || result.Received != 1 {
+		t.Errorf("Expected the deletion from 2 devices' files, got %+v, %v", result, err)
+	}
+	expectEntries(t, devices[2], map[string]string{"b": "2", "c": "3"})
+
+	if _, err := openDevice(t).syncer.SyncFolder(dir, "wrong"); !errors.Is(err, devicesync.ErrWrongPassphrase) {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package grpcserver_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	lockrv1 "Lockr/bin/grpc/lockr/v1"
+	"Lockr/bin/grpcserver"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/server"
+)
+
+// TestGRPC tests the calls of the gRPC service through the generated client over
+// an in-memory connection: the unary calls, the streamed scan, change feed and
+// batch, and the tokens they need
+func TestGRPC(t *testing.T) {
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{InMemory: true})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+	tokens, err := server.LoadTokens(tree)
+	if err != nil {
+		t.Fatalf("Failed to load tokens: %v", err)
+	}
+	reader, err := tokens.Add("reader", server.ScopeRead)
+	if err != nil {
+		t.Fatalf("Failed to add token: %v", err)
+	}
+	writer, err := tokens.Add("writer", server.ScopeWrite)
+	if err != nil {
+		t.Fatalf("Failed to add token: %v", err)
+	}
+
+	srv := grpcserver.New(tree)
+	srv.RequireTokens(tokens)
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := srv.GRPCServer()
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := lockrv1.NewLockrClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	as := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+
+	if _, err := client.Get(ctx, &lockrv1.GetRequest{Key: "k"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected a call without a token to be unauthenticated, got %v", err)
+	}
+	if _, err := client.Set(as(reader), &lockrv1.SetRequest{Key: "k", Value: "v"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected a read token to be denied a write, got %v", err)
+	}
+	if _, err := client.Set(as(writer), &lockrv1.SetRequest{Key: "k"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected an empty value to be refused, got %v", err)
+	}
+
+	// The change feed sees the writes made after it started
+	watch, err := client.WatchChanges(as(reader), &lockrv1.WatchRequest{Prefix: "app/"})
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	// The headers come once the watch started
+	if _, err := watch.Header(); err != nil {
+		t.Fatalf("Failed to start watching: %v", err)
+	}
+
+	if entry, err := client.Set(as(writer), &lockrv1.SetRequest{Key: "app/a", Value: "1"}); err != nil || entry.GetValue() != "1" {
+		t.Fatalf("Failed to set: %v", err)
+	}
+	batch, err := client.BatchWrite(as(writer))
+	if err != nil {
+		t.Fatalf("Failed to start batch: %v", err)
+	}
+	for _, op := range []*lockrv1.BatchOp{{Key: "app/b", Value: "2"}, {Key: "app/c", Value: "3"}, {Key: "app/a", Delete: true}, {Key: "other", Value: "x"}} {
+		if err := batch.Send(op); err != nil {
+			t.Fatalf("Failed to stream batch: %v", err)
+		}
+	}
+	if resp, err := batch.CloseAndRecv(); err != nil || resp.GetApplied() != 4 {
+		t.Fatalf("Expected 4 operations applied, got %v (%v)", resp, err)
+	}
+	if _, err := client.Delete(as(writer), &lockrv1.DeleteRequest{Key: "app/c"}); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+
+	if entry, err := client.Get(as(reader), &lockrv1.GetRequest{Key: "app/b"}); err != nil || entry.GetValue() != "2" {
+		t.Errorf("Expected app/b=2, got %v (%v)", entry, err)
+	}
+	if _, err := client.Get(as(reader), &lockrv1.GetRequest{Key: "app/a"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected a deleted key to be not found, got %v", err)
+	}
+
+	scan, err := client.Scan(as(reader), &lockrv1.ScanRequest{Prefix: "app/"})
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	var keys []string
+	for {
+		entry, err := scan.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read scan: %v", err)
+		}
+		keys = append(keys, entry.GetKey()+"="+entry.GetValue())
+	}
+	if len(keys) != 1 || keys[0] != "app/b=2" {
+		t.Errorf("Expected the scan to stream app/b=2 alone, got %v", keys)
+	}
+
+	want := []*lockrv1.Change{
+		{Key: "app/a", Value: "1"},
+		{Key: "app/b", Value: "2"},
+		{Key: "app/c", Value: "3"},
+		{Key: "app/a", Deleted: true, OldValue: "1"},
+		{Key: "app/c", Deleted: true, OldValue: "3"},
+	}
+	var seq uint64
+	for i := range want {
+		change, err := watch.Recv()
+		if err != nil {
+			t.Fatalf("Failed to read change %d: %v", i, err)
+		}
+		if change.GetKey() != want[i].GetKey() || change.GetValue() != want[i].GetValue() || change.GetDeleted() != want[i].GetDeleted() || change.GetOldValue() != want[i].GetOldValue() || change.GetSeq() <= seq {
+			t.Errorf("Expected change %d to be %v, got %v", i, want[i], change)
+		}
+		seq = change.GetSeq()
+	}
+}
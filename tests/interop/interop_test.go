@@ -0,0 +1,173 @@
+package interop_test
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"Lockr/bin/content"
+	"Lockr/bin/interop"
+)
+
+// TestBitwarden tests that a Bitwarden export is read into entries of its
+// templates, filed in their folders, with names numbered when they clash
+func TestBitwarden(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitwarden.json")
+	export := `{"encrypted": false, "folders": [{"id": "f1", "name": "Work/Email"}], "items": [
+		{"type": 1, "name": "Git Hub", "folderId": "f1", "favorite": true,
+		 "fields": [{"name": "PIN", "value": "1234", "type": 1}],
+		 "login": {"uris": [{"uri": "https://github.com"}], "username": "bob", "password": "pw"}},
+		{"type": 1, "name": "Git Hub", "login": {"username": "alice"}},
+		{"type": 3, "name": "Visa", "card": {"number": "4111", "expMonth": "3", "expYear": "2027"}}]}`
+	if err := os.WriteFile(path, []byte(export), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := interop.Read(interop.Bitwarden, path)
+	if err != nil {
+		t.Fatalf("Failed to read export: %v", err)
+	}
+	keys := interop.Keys(items)
+	if got, want := strings.Join(keys, " "), "login/Git-Hub login/Git-Hub-2 card/Visa"; got != want {
+		t.Errorf("Expected keys %q, got %q", want, got)
+	}
+
+	value, err := items[0].Value()
+	if err != nil {
+		t.Fatalf("Failed to encode item: %v", err)
+	}
+	if folder := content.Folder(value); folder != "Work/Email" {
+		t.Errorf("Expected the folder to be kept, got %q", folder)
+	}
+	if tags := content.Tags(value); len(tags) != 1 || tags[0] != "favorite" {
+		t.Errorf("Expected the favorite to be tagged, got %v", tags)
+	}
+	entry := items[0].Entry
+	if entry.Get("username") != "bob" || entry.Get("password") != "pw" || entry.Get("url") != "https://github.com" || entry.Get("pin") != "1234" {
+		t.Errorf("Expected the login's fields, got %+v", entry.Fields)
+	}
+	if expiry := items[2].Entry.Get("expiry"); expiry != "03/2027" {
+		t.Errorf("Expected the card to expire 03/2027, got %q", expiry)
+	}
+}
+
+// TestOnePassword tests that the vaults of a .1pux export become folders
+func TestOnePassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.1pux")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(file)
+	data, _ := archive.Create("export.data")
+	data.Write([]byte(`{"accounts": [{"vaults": [{"attrs": {"name": "Personal"}, "items": [
+		{"categoryUuid": "001", "overview": {"title": "Bank", "url": "https://bank.example", "tags": ["money"]},
+		 "details": {"loginFields": [{"value": "bob", "designation": "username"}, {"value": "pw", "designation": "password"}],
+		  "sections": [{"fields": [{"title": "Security answer", "id": "x", "value": {"concealed": "blue"}}]}]}}]}]}]}`))
+	archive.Close()
+	file.Close()
+
+	items, err := interop.Read(interop.OnePassword, path)
+	if err != nil {
+		t.Fatalf("Failed to read export: %v", err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("Expected 1 item, got %d", len(items))
+	}
+	it := items[0]
+	if it.Folder != "Personal" || len(it.Tags) != 1 || it.Tags[0] != "money" {
+		t.Errorf("Expected the item in Personal tagged money, got %q %v", it.Folder, it.Tags)
+	}
+	if it.Entry.Template != "login" || it.Entry.Get("username") != "bob" || it.Entry.Get("security-answer") != "blue" {
+		t.Errorf("Expected a login with its section fields, got %+v", it.Entry)
+	}
+}
+
+// TestPass tests that the files of a pass store are read into logins filed in its directories
+func TestPass(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"work/email/gmail.gpg": "hunter2\nlogin: bob@gmail.com\nurl: https://mail.google.com\nrecovery: 1234\nsome note\n",
+		"top.gpg":              "pw\n",
+		".git/config":          "not an entry",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The files are stored in plaintext, standing in for gpg
+	items, err := interop.ReadPass(dir, os.ReadFile)
+	if err != nil {
+		t.Fatalf("Failed to read pass store: %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("Expected 2 items, got %d", len(items))
+	}
+	byName := map[string]interop.Item{}
+	for _, it := range items {
+		byName[it.Name] = it
+	}
+	gmail := byName["gmail"]
+	if gmail.Folder != "work/email" {
+		t.Errorf("Expected gmail in work/email, got %q", gmail.Folder)
+	}
+	entry := gmail.Entry
+	if entry.Get("password") != "hunter2" || entry.Get("username") != "bob@gmail.com" || entry.Get("url") != "https://mail.google.com" ||
+		entry.Get("recovery") != "1234" || entry.Get("notes") != "some note" {
+		t.Errorf("Expected the fields of gmail, got %+v", entry.Fields)
+	}
+	if top := byName["top"]; top.Folder != "" || top.Entry.Get("password") != "pw" {
+		t.Errorf("Expected top at the top level, got %+v", top)
+	}
+}
+
+// TestPassRoundTrip tests that items written as a pass store read back the same
+func TestPassRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	items := []interop.Item{
+		mustStored(t, "login/gmail", content.SetFolder(`{"template":"login","fields":[{"name":"username","value":"bob"},{"name":"password","value":"hunter2","secret":true},{"name":"notes","value":"two\nlines"}]}`, "work/email")),
+		mustStored(t, "db/password", "plain"),
+		mustStored(t, "../escape", "nope"),
+	}
+	plaintext := func(file string, data []byte, recipients []string) error { return os.WriteFile(file, data, 0600) }
+	if err := interop.WritePass(dir, []string{"ABCD1234"}, items, plaintext); err != nil {
+		t.Fatalf("Failed to write pass store: %v", err)
+	}
+	if id, _ := os.ReadFile(filepath.Join(dir, ".gpg-id")); string(id) != "ABCD1234\n" {
+		t.Errorf("Expected the recipient in .gpg-id, got %q", id)
+	}
+
+	read, err := interop.ReadPass(dir, os.ReadFile)
+	if err != nil {
+		t.Fatalf("Failed to read pass store: %v", err)
+	}
+	byName := map[string]interop.Item{}
+	for _, it := range read {
+		byName[it.Folder+"|"+it.Name] = it
+	}
+	gmail := byName["work/email|gmail"].Entry
+	if gmail.Get("username") != "bob" || gmail.Get("password") != "hunter2" || gmail.Get("notes") != "two\nlines" {
+		t.Errorf("Expected gmail to read back, got %+v", gmail.Fields)
+	}
+	if plain := byName["db|password"].Entry; plain.Get("password") != "plain" {
+		t.Errorf("Expected the plain value as a password, got %+v", plain.Fields)
+	}
+	if _, ok := byName["|escape"]; !ok || len(read) != 3 {
+		t.Errorf("Expected ../escape to stay in the store, got %v", byName)
+	}
+}
+
+// mustStored returns the item of a stored value
+func mustStored(t *testing.T, key, stored string) interop.Item {
+	it, ok := interop.FromStored(key, stored)
+	if !ok {
+		t.Fatalf("Expected an item for %s", key)
+	}
+	return it
+}
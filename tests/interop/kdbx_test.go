@@ -0,0 +1,237 @@
+package interop_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"testing"
+
+	"Lockr/bin/content"
+	"Lockr/bin/interop"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20"
+)
+
+// TestKDBX tests that a written KeePass database decrypts with its password into
+// groups for the folders and entries with their fields, following the KDBX 4 format
+func TestKDBX(t *testing.T) {
+	items := []interop.Item{
+		mustStored(t, "login/github", content.AddTag(content.SetFolder(`{"template":"login","fields":[`+
+			`{"name":"username","value":"bob"},{"name":"password","value":"hunter2","secret":true},`+
+			`{"name":"pin","label":"PIN","value":"1234","secret":true}]}`, "work/dev"), "favorite")),
+		mustStored(t, "wifi", "home-network-pass"),
+	}
+	var file bytes.Buffer
+	if err := interop.WriteKDBX(&file, items, "s3cret"); err != nil {
+		t.Fatalf("Failed to write database: %v", err)
+	}
+
+	document := decryptKDBX(t, file.Bytes(), "s3cret")
+	type value struct {
+		Protected string `xml:"Protected,attr"`
+		Text      string `xml:",chardata"`
+	}
+	type entry struct {
+		Tags    string `xml:"Tags"`
+		Strings []struct {
+			Key   string `xml:"Key"`
+			Value value  `xml:"Value"`
+		} `xml:"String"`
+	}
+	type group struct {
+		Name    string  `xml:"Name"`
+		Entries []entry `xml:"Entry"`
+		Groups  []group `xml:"Group"`
+	}
+	var parsed struct {
+		Root struct {
+			Group group `xml:"Group"`
+		} `xml:"Root"`
+	}
+	if err := xml.Unmarshal(document.xml, &parsed); err != nil {
+		t.Fatalf("Failed to parse the XML document: %v", err)
+	}
+
+	// Protected values are decrypted in document order
+	fields := func(e entry) map[string]string {
+		values := make(map[string]string)
+		for _, s := range e.Strings {
+			text := s.Value.Text
+			if s.Value.Protected == "True" {
+				data, err := base64.StdEncoding.DecodeString(text)
+				if err != nil {
+					t.Fatalf("Malformed protected value of %s: %v", s.Key, err)
+				}
+				document.stream.XORKeyStream(data, data)
+				text = string(data)
+			}
+			values[s.Key] = text
+		}
+		return values
+	}
+	root := parsed.Root.Group
+	if len(root.Entries) != 1 || len(root.Groups) != 1 || root.Groups[0].Name != "work" || len(root.Groups[0].Groups) != 1 {
+		t.Fatalf("Expected an entry at the top and work/dev below, got %+v", root)
+	}
+	if wifi := fields(root.Entries[0]); wifi["Title"] != "wifi" || wifi["Password"] != "home-network-pass" {
+		t.Errorf("Expected the plain value as a password, got %v", wifi)
+	}
+	dev := root.Groups[0].Groups[0]
+	if dev.Name != "dev" || len(dev.Entries) != 1 {
+		t.Fatalf("Expected github in dev, got %+v", dev)
+	}
+	github := fields(dev.Entries[0])
+	if github["Title"] != "github" || github["UserName"] != "bob" || github["Password"] != "hunter2" || github["PIN"] != "1234" || dev.Entries[0].Tags != "favorite" {
+		t.Errorf("Expected the fields of github, got %v tagged %q", github, dev.Entries[0].Tags)
+	}
+
+	if _, err := tryDecryptKDBX(file.Bytes(), "wrong"); err == nil {
+		t.Errorf("Expected the wrong password to fail the header HMAC")
+	}
+}
+
+// kdbxDocument is the decrypted content of a KDBX file
+type kdbxDocument struct {
+	xml    []byte
+	stream *chacha20.Cipher
+}
+
+// decryptKDBX decrypts a KDBX 4 file written with AES-256, Argon2id and gzip
+func decryptKDBX(t *testing.T, data []byte, password string) kdbxDocument {
+	document, err := tryDecryptKDBX(data, password)
+	if err != nil {
+		t.Fatalf("Failed to decrypt database: %v", err)
+	}
+	return document
+}
+
+// tryDecryptKDBX is decryptKDBX reporting failures as errors
+func tryDecryptKDBX(data []byte, password string) (kdbxDocument, error) {
+	r := bytes.NewReader(data)
+	var signature [3]uint32
+	binary.Read(r, binary.LittleEndian, &signature)
+	if signature != [3]uint32{0x9AA2D903, 0xB54BFB67, 0x00040000} {
+		return kdbxDocument{}, fmt.Errorf("bad signature %x", signature)
+	}
+	fields := map[byte][]byte{}
+	for {
+		id, _ := r.ReadByte()
+		var size uint32
+		binary.Read(r, binary.LittleEndian, &size)
+		value := make([]byte, size)
+		io.ReadFull(r, value)
+		fields[id] = value
+		if id == 0 {
+			break
+		}
+	}
+	header := data[:len(data)-r.Len()]
+	hash, mac := make([]byte, 32), make([]byte, 32)
+	io.ReadFull(r, hash)
+	io.ReadFull(r, mac)
+	if sum := sha256.Sum256(header); !bytes.Equal(sum[:], hash) {
+		return kdbxDocument{}, fmt.Errorf("header hash mismatch")
+	}
+
+	kdf := parseVariants(fields[11])
+	component := sha256.Sum256([]byte(password))
+	composite := sha256.Sum256(component[:])
+	transformed := argon2.IDKey(composite[:], kdf["S"], uint32(binary.LittleEndian.Uint64(kdf["I"])),
+		uint32(binary.LittleEndian.Uint64(kdf["M"])/1024), uint8(binary.LittleEndian.Uint32(kdf["P"])), 32)
+	seed := fields[4]
+	hmacKey := sha512.Sum512(append(append(append([]byte{}, seed...), transformed...), 1))
+	blockMAC := func(index uint64, data []byte) []byte {
+		indexBytes := binary.LittleEndian.AppendUint64(nil, index)
+		key := sha512.Sum512(append(indexBytes, hmacKey[:]...))
+		m := hmac.New(sha256.New, key[:])
+		m.Write(indexBytes)
+		m.Write(data)
+		return m.Sum(nil)
+	}
+	if !hmac.Equal(blockMAC(1<<64-1, header), mac) {
+		return kdbxDocument{}, fmt.Errorf("header HMAC mismatch")
+	}
+
+	var payload []byte
+	for index := uint64(0); ; index++ {
+		blockHMAC := make([]byte, 32)
+		io.ReadFull(r, blockHMAC)
+		var size uint32
+		binary.Read(r, binary.LittleEndian, &size)
+		block := make([]byte, size)
+		io.ReadFull(r, block)
+		if !hmac.Equal(blockMAC(index, append(binary.LittleEndian.AppendUint32(nil, size), block...)), blockHMAC) {
+			return kdbxDocument{}, fmt.Errorf("block %d HMAC mismatch", index)
+		}
+		if size == 0 {
+			break
+		}
+		payload = append(payload, block...)
+	}
+
+	encryptionKey := sha256.Sum256(append(append([]byte{}, seed...), transformed...))
+	aesCipher, _ := aes.NewCipher(encryptionKey[:])
+	cipher.NewCBCDecrypter(aesCipher, fields[7]).CryptBlocks(payload, payload)
+	payload = payload[:len(payload)-int(payload[len(payload)-1])]
+	decompressed, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return kdbxDocument{}, err
+	}
+	plain, err := io.ReadAll(decompressed)
+	if err != nil {
+		return kdbxDocument{}, err
+	}
+
+	inner := bytes.NewReader(plain)
+	innerFields := map[byte][]byte{}
+	for {
+		id, _ := inner.ReadByte()
+		var size int32
+		binary.Read(inner, binary.LittleEndian, &size)
+		value := make([]byte, size)
+		io.ReadFull(inner, value)
+		innerFields[id] = value
+		if id == 0 {
+			break
+		}
+	}
+	if binary.LittleEndian.Uint32(innerFields[1]) != 3 {
+		return kdbxDocument{}, fmt.Errorf("expected the ChaCha20 inner stream")
+	}
+	streamKey := sha512.Sum512(innerFields[2])
+	stream, err := chacha20.NewUnauthenticatedCipher(streamKey[:32], streamKey[32:44])
+	if err != nil {
+		return kdbxDocument{}, err
+	}
+	return kdbxDocument{xml: plain[len(plain)-inner.Len():], stream: stream}, nil
+}
+
+// parseVariants parses a KDBX variant dictionary into its raw values by name
+func parseVariants(data []byte) map[string][]byte {
+	r := bytes.NewReader(data[2:])
+	values := map[string][]byte{}
+	for {
+		kind, _ := r.ReadByte()
+		if kind == 0 {
+			return values
+		}
+		var size int32
+		binary.Read(r, binary.LittleEndian, &size)
+		name := make([]byte, size)
+		io.ReadFull(r, name)
+		binary.Read(r, binary.LittleEndian, &size)
+		value := make([]byte, size)
+		io.ReadFull(r, value)
+		values[string(name)] = value
+	}
+}
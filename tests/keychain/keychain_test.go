@@ -0,0 +1,39 @@
+package keychain_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"Lockr/bin/keychain"
+)
+
+func TestRoundTrip(t *testing.T) {
+	service := "lockr-test"
+	account := fmt.Sprintf("account-%d", os.Getpid())
+	if _, err := keychain.Get(service, account); errors.Is(err, keychain.ErrUnsupported) {
+		t.Skip("No OS keychain available")
+	} else if !errors.Is(err, keychain.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	defer keychain.Delete(service, account)
+
+	for _, secret := range []string{"first", `second "quoted" \ secret`} {
+		if err := keychain.Set(service, account, secret); err != nil {
+			t.Fatalf("Failed to set secret: %v", err)
+		}
+		if got, err := keychain.Get(service, account); err != nil || got != secret {
+			t.Errorf("Expected %q, got %q, %v", secret, got, err)
+		}
+	}
+	if err := keychain.Delete(service, account); err != nil {
+		t.Fatalf("Failed to delete secret: %v", err)
+	}
+	if _, err := keychain.Get(service, account); !errors.Is(err, keychain.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after deleting, got %v", err)
+	}
+	if err := keychain.Delete(service, account); err != nil {
+		t.Errorf("Expected deleting a missing secret to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package keyindex_test
+
+import (
+	"reflect"
+	"testing"
+
+	"Lockr/bin/content"
+	"Lockr/bin/keyindex"
+	"Lockr/bin/lsmtree"
+)
+
+// TestIndexFollowsChangeFeed tests that the index picks up existing keys and later writes without rescanning
+func TestIndexFollowsChangeFeed(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	defer tree.Close()
+
+	for _, key := range []string{"github/work", "gitlab"} {
+		if err := tree.Set(key, "secret"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+
+	idx, unsubscribe, err := keyindex.Watch(tree)
+	if err != nil {
+		t.Fatalf("Failed to build index: %v", err)
+	}
+	defer unsubscribe()
+
+	if err := tree.Set("github/personal", "secret"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := tree.Delete("gitlab"); err != nil {
+		t.Fatalf("Failed to delete value: %v", err)
+	}
+
+	if got, want := idx.Keys(""), []string{"github/personal", "github/work"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected keys %v, got %v", want, got)
+	}
+	if got, want := idx.Filter("work"), []string{"github/work"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected filtered keys %v, got %v", want, got)
+	}
+	if got := idx.Complete("gi"); got != "github/" {
+		t.Errorf("Expected completion 'github/', got '%s'", got)
+	}
+	if got := idx.Complete("github/p"); got != "github/personal" {
+		t.Errorf("Expected completion 'github/personal', got '%s'", got)
+	}
+
+	// Writes after unsubscribing no longer reach the index
+	unsubscribe()
+	if err := tree.Set("bitbucket", "secret"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if idx.Len() != 2 {
+		t.Errorf("Expected 2 keys after unsubscribing, got %d", idx.Len())
+	}
+}
+
+// TestIndexTagsAndFolders tests that keys are found by tag and folder as their values change
+func TestIndexTagsAndFolders(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	defer tree.Close()
+
+	if err := tree.Set("aws/prod", content.SetFolder(content.AddTag("secret", "work"), "work/aws")); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	idx, unsubscribe, err := keyindex.Watch(tree)
+	if err != nil {
+		t.Fatalf("Failed to build index: %v", err)
+	}
+	defer unsubscribe()
+
+	if err := tree.Set("github", content.SetFolder(content.AddTag("secret", "work"), "work")); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if got, want := idx.Tagged("work"), []string{"aws/prod", "github"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected tagged keys %v, got %v", want, got)
+	}
+	if got, want := idx.InFolder("work"), []string{"aws/prod", "github"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected keys in work %v, got %v", want, got)
+	}
+	if got, want := idx.InFolder("work/aws"), []string{"aws/prod"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected keys in work/aws %v, got %v", want, got)
+	}
+
+	// Rewriting a value without its tag or deleting it drops it from the index
+	if err := tree.Set("github", "secret"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := tree.Delete("aws/prod"); err != nil {
+		t.Fatalf("Failed to delete value: %v", err)
+	}
+	if got := idx.Tagged("work"); len(got) != 0 {
+		t.Errorf("Expected no tagged keys, got %v", got)
+	}
+	if tags, folders := idx.Tags(), idx.Folders(); len(tags) != 0 || len(folders) != 0 {
+		t.Errorf("Expected no tags or folders in use, got %v and %v", tags, folders)
+	}
+}
@@ -0,0 +1,80 @@
+package lockrtest_test
+
+import (
+	"fmt"
+	"testing"
+
+	"Lockr/bin/lockrtest"
+	"Lockr/bin/lsmtree"
+)
+
+// TestStoreContract runs the same operations against the fake and the real engine
+func TestStoreContract(t *testing.T) {
+	stores := map[string]func(t *testing.T) lsmtree.Store{
+		"fake":    func(t *testing.T) lsmtree.Store { return lockrtest.NewFake() },
+		"lsmtree": func(t *testing.T) lsmtree.Store { return lsmtree.NewLSMTree(t.TempDir()) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			defer store.Close()
+
+			lockrtest.Populate(t, store, map[string]string{
+				"app/db":    "postgres",
+				"app/token": "abc",
+				"other":     "x",
+			})
+
+			batch := lsmtree.NewWriteBatch()
+			batch.Delete("app/token")
+			batch.Set("app/user", "admin")
+			if err := store.Batch(batch); err != nil {
+				t.Fatalf("Failed to apply batch: %v", err)
+			}
+
+			lockrtest.AssertValue(t, store, "app/db", "postgres")
+			lockrtest.AssertValue(t, store, "app/token", "")
+
+			entries := lockrtest.Dump(t, store, "app/", "app0")
+			if len(entries) != 2 || entries["app/db"] != "postgres" || entries["app/user"] != "admin" {
+				t.Errorf("Unexpected scan result: %v", entries)
+			}
+
+			if err := store.Close(); err != nil {
+				t.Fatalf("Failed to close store: %v", err)
+			}
+			if err := store.Set("late", "write"); err != lsmtree.ErrClosed {
+				t.Errorf("Expected ErrClosed after Close, got %v", err)
+			}
+		})
+	}
+}
+
+// TestCrashConsistency tests that a tree flushing and compacting recovers a prefix of its writes from any crash
+func TestCrashConsistency(t *testing.T) {
+	var writes []*lsmtree.WriteBatch
+	for i := 0; i < 200; i++ {
+		batch := lsmtree.NewWriteBatch()
+		key := fmt.Sprintf("key-%02d", i%40)
+		switch i % 7 {
+		case 3:
+			batch.Delete(key)
+		case 5:
+			// A batch spans keys, and must be applied whole
+			batch.Set(key, fmt.Sprintf("batch-%d", i))
+			batch.Set(fmt.Sprintf("key-%02d", (i+1)%40), fmt.Sprintf("batch-%d", i))
+			batch.Delete(fmt.Sprintf("key-%02d", (i+2)%40))
+		default:
+			batch.Set(key, fmt.Sprintf("value-%d", i))
+		}
+		writes = append(writes, batch)
+	}
+
+	for _, policy := range []lsmtree.SyncPolicy{lsmtree.SyncAlways, lsmtree.SyncInterval} {
+		t.Run(policy.String(), func(t *testing.T) {
+			options := lsmtree.Options{MemTableSize: 512, WALSegmentSize: 1024, WALSync: policy}
+			lockrtest.CheckCrashConsistency(t, options, writes, 50, 1)
+		})
+	}
+}
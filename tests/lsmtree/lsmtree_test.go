@@ -1,17 +1,32 @@
 package lsmtree_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 	"Lockr/bin/lsmtree"
 )
 
 // TestLSMTreeSetGet tests the Set and Get operations of the LSMTree
 func TestLSMTreeSetGet(t *testing.T) {
 	// Create a new LSMTree with a temporary directory
-	tree := lsmtree.NewLSMTree("/tmp/lsm-test")
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	defer tree.Close()
 
 	// Set a test key-value pair
-	err := tree.Set("foo", "bar")
+	err := tree.Set("testKey", "testValue")
 	if err != nil {
 		t.Fatalf("Failed to set value: %v", err)
 	}
@@ -27,3 +42,3348 @@ func TestLSMTreeSetGet(t *testing.T) {
 		t.Errorf("Expected 'testValue', got '%s'", value)
 	}
 }
+
+// TestLSMTreeDebugState tests that the debug state reports structure without values
+func TestLSMTreeDebugState(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	defer tree.Close()
+
+	if err := tree.Set("foo", "secret"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := tree.Delete("bar"); err != nil {
+		t.Fatalf("Failed to delete value: %v", err)
+	}
+
+	state := tree.DebugState()
+	if state.MemTable.Entries != 2 || state.MemTable.Tombstones != 1 {
+		t.Errorf("Expected 2 entries and 1 tombstone, got %+v", state.MemTable)
+	}
+	// The deleted key is dropped from the cache rather than cached as a tombstone
+	if len(state.Cache.Keys) != 1 || state.Cache.Keys[0] != "foo" {
+		t.Errorf("Expected cache keys [foo], got %v", state.Cache.Keys)
+	}
+}
+
+// TestShardedStoreIterator tests that iteration over a ShardedStore is globally ordered
+func TestShardedStoreIterator(t *testing.T) {
+	store, err := lsmtree.NewShardedStore(t.TempDir(), 4)
+	if err != nil {
+		t.Fatalf("Failed to create sharded store: %v", err)
+	}
+
+	keys := []string{"e", "a", "d", "c", "b", "f"}
+	for _, key := range keys {
+		if err := store.Set(key, "v-"+key); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+
+	it, err := store.NewIterator()
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	defer it.Close()
+
+	var got []string
+	for it.Next() {
+		if it.Value() != "v-"+it.Key() {
+			t.Errorf("Unexpected value %q for key %q", it.Value(), it.Key())
+		}
+		got = append(got, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iterator failed: %v", err)
+	}
+
+	expected := []string{"a", "b", "c", "d", "e", "f"}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+	}
+}
+
+// TestShardedStoreShardCount tests that a ShardedStore can't be reopened with
+// another shard count, which would hash keys to the wrong shards
+func TestShardedStoreShardCount(t *testing.T) {
+	dir := t.TempDir()
+	store, err := lsmtree.NewShardedStore(dir, 4)
+	if err != nil {
+		t.Fatalf("Failed to create sharded store: %v", err)
+	}
+	if err := store.Recover(); err != nil {
+		t.Fatalf("Failed to recover sharded store: %v", err)
+	}
+	if err := store.Set("key", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	store.Close()
+
+	for _, count := range []int{2, 8} {
+		if _, err := lsmtree.NewShardedStore(dir, count); err == nil || !strings.Contains(err.Error(), "store has 4 shards") {
+			t.Errorf("Expected reopening with %d shards to fail, got %v", count, err)
+		}
+	}
+
+	store, err = lsmtree.NewShardedStore(dir, 4)
+	if err != nil {
+		t.Fatalf("Failed to reopen sharded store: %v", err)
+	}
+	if err := store.Recover(); err != nil {
+		t.Fatalf("Failed to recover sharded store: %v", err)
+	}
+	defer store.Close()
+	if value, err := store.Get("key"); err != nil || value != "value" {
+		t.Errorf("Expected key=value after reopening, got %q (%v)", value, err)
+	}
+
+	// A shard directory that can't be created fails the open
+	broken := t.TempDir()
+	if err := os.WriteFile(filepath.Join(broken, "SHARDS"), []byte("2\n"), 0600); err != nil {
+		t.Fatalf("Failed to write shard count: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(broken, "shard_001"), nil, 0600); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if _, err := lsmtree.NewShardedStore(broken, 2); err == nil {
+		t.Error("Expected a shard directory blocked by a file to fail the open")
+	}
+
+	// The shard count and the shards are kept in the options' file system
+	fsys := lsmtree.NewMemFS()
+	memDir := filepath.Join(t.TempDir(), "memfs")
+	options := lsmtree.Options{FS: fsys}
+	inMemFS, err := lsmtree.NewShardedStoreWithOptions(memDir, 4, options)
+	if err != nil {
+		t.Fatalf("Failed to create sharded store: %v", err)
+	}
+	if err := inMemFS.Recover(); err != nil {
+		t.Fatalf("Failed to recover sharded store: %v", err)
+	}
+	inMemFS.Set("key", "value")
+	inMemFS.Close()
+	if _, err := os.Stat(memDir); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing written to disk, got %v", err)
+	}
+	if _, err := lsmtree.NewShardedStoreWithOptions(memDir, 2, options); err == nil || !strings.Contains(err.Error(), "store has 4 shards") {
+		t.Errorf("Expected reopening with 2 shards to fail, got %v", err)
+	}
+}
+
+// TestLSMTreeConcurrentReads tests that reads running alongside writes always see the latest value
+func TestLSMTreeConcurrentReads(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	defer tree.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if _, err := tree.Get(fmt.Sprintf("key-%d", j)); err != nil {
+					t.Errorf("Failed to get value: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for j := 0; j < 200; j++ {
+		if err := tree.Set(fmt.Sprintf("key-%d", j), fmt.Sprintf("value-%d", j)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	wg.Wait()
+
+	for j := 0; j < 200; j++ {
+		value, err := tree.Get(fmt.Sprintf("key-%d", j))
+		if err != nil {
+			t.Fatalf("Failed to get value: %v", err)
+		}
+		if value != fmt.Sprintf("value-%d", j) {
+			t.Errorf("Expected 'value-%d', got '%s'", j, value)
+		}
+	}
+}
+
+// TestMemTableOrdering tests that MemTable entries are visited in key order
+func TestMemTableOrdering(t *testing.T) {
+	memTable := lsmtree.NewMemTable()
+	for _, key := range []string{"pear", "apple", "fig", "banana", "cherry"} {
+		memTable.Set(key, key)
+	}
+	memTable.Set("fig", "")
+	memTable.Delete("pear")
+
+	var got []string
+	memTable.Ascend("banana", func(key, value string) bool {
+		got = append(got, key+"="+value)
+		return true
+	})
+
+	expected := []string{"banana=banana", "cherry=cherry", "fig="}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if memTable.Len() != 4 {
+		t.Errorf("Expected 4 entries, got %d", memTable.Len())
+	}
+}
+
+// TestLSMTreeFlushByBytes tests that the MemTable is flushed once its byte size exceeds the threshold
+func TestLSMTreeFlushByBytes(t *testing.T) {
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{MemTableSize: 4096})
+	defer tree.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("%0100d", i)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+
+	if len(tree.Stats().SSTables) == 0 {
+		t.Fatalf("Expected the MemTable to be flushed to at least one SSTable")
+	}
+
+	for i := 0; i < 100; i++ {
+		value, err := tree.Get(fmt.Sprintf("key-%03d", i))
+		if err != nil {
+			t.Fatalf("Failed to get value: %v", err)
+		}
+		if value != fmt.Sprintf("%0100d", i) {
+			t.Errorf("Unexpected value for key-%03d: %q", i, value)
+		}
+	}
+}
+
+// TestLSMTreeDeleteShadowsFlushedValue tests that a flushed tombstone hides older flushed values
+func TestLSMTreeDeleteShadowsFlushedValue(t *testing.T) {
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{MemTableSize: 1})
+	defer tree.Close()
+
+	if err := tree.Set("foo", "bar"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := tree.Delete("foo"); err != nil {
+		t.Fatalf("Failed to delete value: %v", err)
+	}
+	if err := tree.Set("other", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+
+	value, err := tree.Get("foo")
+	if err != nil {
+		t.Fatalf("Failed to get value: %v", err)
+	}
+	if value != "" {
+		t.Errorf("Expected deleted key to be empty, got '%s'", value)
+	}
+
+	entries, err := tree.List()
+	if err != nil {
+		t.Fatalf("Failed to list entries: %v", err)
+	}
+	if _, ok := entries["foo"]; ok {
+		t.Errorf("Expected deleted key to be absent from List, got %v", entries)
+	}
+}
+
+// TestSSTableBlockLookup tests point lookups and listing across multiple SSTable data blocks
+func TestSSTableBlockLookup(t *testing.T) {
+	memTable := lsmtree.NewMemTable()
+	for i := 0; i < 1000; i++ {
+		memTable.Set(fmt.Sprintf("key-%04d", i), fmt.Sprintf("value-%d", i))
+	}
+	memTable.Set("key-0500", "")
+
+	ssTable, err := lsmtree.NewSSTable(t.TempDir(), memTable)
+	if err != nil {
+		t.Fatalf("Failed to create SSTable: %v", err)
+	}
+
+	for _, i := range []int{0, 1, 499, 501, 998, 999} {
+		value, err := ssTable.Get(fmt.Sprintf("key-%04d", i))
+		if err != nil {
+			t.Fatalf("Failed to get value: %v", err)
+		}
+		if value != fmt.Sprintf("value-%d", i) {
+			t.Errorf("Expected 'value-%d', got '%s'", i, value)
+		}
+	}
+
+	for _, key := range []string{"a", "key-0500", "key-10000", "zzz"} {
+		value, err := ssTable.Get(key)
+		if err != nil {
+			t.Fatalf("Failed to get value: %v", err)
+		}
+		if value != "" {
+			t.Errorf("Expected no value for %q, got '%s'", key, value)
+		}
+	}
+
+	entries, err := ssTable.List()
+	if err != nil {
+		t.Fatalf("Failed to list SSTable: %v", err)
+	}
+	if len(entries) != 999 {
+		t.Errorf("Expected 999 live entries, got %d", len(entries))
+	}
+}
+
+// TestLSMTreeReopen tests that flushed SSTables are found again after reopening the tree
+func TestLSMTreeReopen(t *testing.T) {
+	for _, compression := range []lsmtree.Compression{lsmtree.NoCompression, lsmtree.SnappyCompression, lsmtree.ZstdCompression} {
+		t.Run(compression.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			options := lsmtree.Options{MemTableSize: 2048, Compression: compression}
+
+			tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+			for i := 0; i < 200; i++ {
+				if err := tree.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+					t.Fatalf("Failed to set value: %v", err)
+				}
+			}
+			if err := tree.Close(); err != nil {
+				t.Fatalf("Failed to close tree: %v", err)
+			}
+
+			reopened := lsmtree.NewLSMTreeWithOptions(dir, options)
+			if err := reopened.Recover(); err != nil {
+				t.Fatalf("Failed to recover tree: %v", err)
+			}
+			defer reopened.Close()
+
+			if len(reopened.Stats().SSTables) == 0 {
+				t.Fatalf("Expected SSTables to be reopened from the manifest")
+			}
+
+			entries, err := reopened.List()
+			if err != nil {
+				t.Fatalf("Failed to list entries: %v", err)
+			}
+			for i := 0; i < 200; i++ {
+				if value := entries[fmt.Sprintf("key-%03d", i)]; value != fmt.Sprintf("value-%d", i) {
+					t.Errorf("Expected 'value-%d', got '%s'", i, value)
+				}
+			}
+		})
+	}
+}
+
+// TestMigrateTextSSTables tests upgrading a legacy text SSTable layout to the current format
+func TestMigrateTextSSTables(t *testing.T) {
+	dir := t.TempDir()
+	legacy := map[string]string{
+		"sstable_100.dat": "foo,old\nbar,kept\n",
+		"sstable_200.dat": "foo,new\nbar,\nbaz,added\n",
+	}
+	for name, content := range legacy {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write legacy SSTable: %v", err)
+		}
+	}
+
+	tree := lsmtree.NewLSMTree(dir)
+	var versionErr *lsmtree.ErrFormatVersion
+	if err := tree.Recover(); !errors.As(err, &versionErr) {
+		t.Fatalf("Expected a format version error before migrating, got %v", err)
+	}
+
+	steps, err := lsmtree.Migrate(dir)
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if len(steps) != 1 || steps[0].To != lsmtree.CurrentFormatVersion {
+		t.Fatalf("Unexpected migration steps: %+v", steps)
+	}
+
+	tree = lsmtree.NewLSMTree(dir)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover migrated tree: %v", err)
+	}
+	entries, err := tree.List()
+	if err != nil {
+		t.Fatalf("Failed to list entries: %v", err)
+	}
+	if len(entries) != 2 || entries["foo"] != "new" || entries["baz"] != "added" {
+		t.Errorf("Unexpected entries after migration: %v", entries)
+	}
+
+	if err := lsmtree.Rollback(dir, steps[0].BackupDir); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if version, _ := lsmtree.DetectFormatVersion(dir); version != 1 {
+		t.Errorf("Expected format version 1 after rollback, got %d", version)
+	}
+}
+
+// TestLSMTreeCachePolicies tests which operations populate the cache under each policy
+func TestLSMTreeCachePolicies(t *testing.T) {
+	tests := []struct {
+		policy        lsmtree.CachePolicy
+		entriesAfter  int
+		hitsAfterRead uint64
+	}{
+		{policy: lsmtree.WriteThrough, entriesAfter: 1, hitsAfterRead: 2},
+		{policy: lsmtree.WriteAround, entriesAfter: 0, hitsAfterRead: 1},
+		{policy: lsmtree.TinyLFU, entriesAfter: 0, hitsAfterRead: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{CachePolicy: tt.policy})
+			defer tree.Close()
+
+			if err := tree.Set("foo", "bar"); err != nil {
+				t.Fatalf("Failed to set value: %v", err)
+			}
+			if entries := tree.Stats().Cache.Entries; entries != tt.entriesAfter {
+				t.Errorf("Expected %d cached entries after write, got %d", tt.entriesAfter, entries)
+			}
+
+			for i := 0; i < 2; i++ {
+				if value, err := tree.Get("foo"); err != nil || value != "bar" {
+					t.Fatalf("Expected 'bar', got '%s' (%v)", value, err)
+				}
+			}
+			if hits := tree.Stats().Cache.Hits; hits != tt.hitsAfterRead {
+				t.Errorf("Expected %d cache hits, got %d", tt.hitsAfterRead, hits)
+			}
+		})
+	}
+}
+
+// TestVerifyDetectsCorruption tests that flipped bytes in an SSTable are reported with file and offset
+func TestVerifyDetectsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{MemTableSize: 1024})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	tree.Close()
+
+	report, err := lsmtree.VerifyDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to verify: %v", err)
+	}
+	if report.TablesChecked == 0 || len(report.Corruptions) != 0 {
+		t.Fatalf("Expected a clean report with SSTables, got %+v", report)
+	}
+
+	path := tree.Stats().SSTables[0].FilePath
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read SSTable: %v", err)
+	}
+	data[5] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+
+	report, err = lsmtree.VerifyDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to verify: %v", err)
+	}
+	if len(report.Corruptions) != 1 || report.Corruptions[0].File != path || report.Corruptions[0].Offset != 0 {
+		t.Errorf("Expected one corruption in the first block of %s, got %+v", path, report.Corruptions)
+	}
+}
+
+// TestDoctor tests that Diagnose reports corruption, leftover files and garbage,
+// and that Repair salvages the readable records
+func TestDoctor(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{MemTableSize: 1024, BlockSize: 256})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i%40), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if err := tree.Delete("key-039"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	tree.Close()
+
+	report, err := lsmtree.Diagnose(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to diagnose: %v", err)
+	}
+	if !report.Healthy() || report.TablesChecked == 0 || report.Garbage.Shadowed == 0 || report.Garbage.Bytes == 0 {
+		t.Fatalf("Expected a healthy report with SSTables and overwritten entries, got %+v", report)
+	}
+
+	tables := tree.Stats().SSTables
+	path := tables[0].FilePath
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read SSTable: %v", err)
+	}
+	data[5] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+	orphan := filepath.Join(dir, "sstable_1.dat")
+	if err := os.WriteFile(orphan, []byte("left by a crash"), 0600); err != nil {
+		t.Fatalf("Failed to write orphan: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "MANIFEST.tmp"), nil, 0600); err != nil {
+		t.Fatalf("Failed to write temporary file: %v", err)
+	}
+
+	report, err = lsmtree.Diagnose(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to diagnose: %v", err)
+	}
+	if report.Healthy() || len(report.Corruptions) != 1 || report.Corruptions[0].File != path {
+		t.Errorf("Expected one corruption in %s, got %+v", path, report.Corruptions)
+	}
+	if len(report.OrphanedTables) != 1 || report.OrphanedTables[0] != "sstable_1.dat" {
+		t.Errorf("Expected the orphaned SSTable, got %v", report.OrphanedTables)
+	}
+	if len(report.TempFiles) != 1 || report.TempFiles[0] != "MANIFEST.tmp" {
+		t.Errorf("Expected the temporary file, got %v", report.TempFiles)
+	}
+
+	result, err := lsmtree.Repair(dir, lsmtree.Options{})
+	if err != nil {
+		t.Fatalf("Failed to repair: %v", err)
+	}
+	if result.LostBlocks != 1 || result.TablesRead != len(tables) || result.Keys == 0 || result.PreviousDir == "" {
+		t.Errorf("Unexpected repair result: %+v", result)
+	}
+	report, err = lsmtree.Diagnose(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to diagnose the repaired store: %v", err)
+	}
+	if !report.Healthy() || len(report.OrphanedTables) != 0 || len(report.TempFiles) != 0 || report.Garbage.Shadowed != 0 {
+		t.Errorf("Expected a clean repaired store, got %+v", report)
+	}
+
+	repaired := lsmtree.NewLSMTree(dir)
+	if err := repaired.Recover(); err != nil {
+		t.Fatalf("Failed to open the repaired store: %v", err)
+	}
+	for key, want := range map[string]string{"key-019": "value-99", "key-038": "value-78", "key-039": ""} {
+		if value, err := repaired.Get(key); err != nil || value != want {
+			t.Errorf("Expected %s=%q, got %q (%v)", key, want, value, err)
+		}
+	}
+	repaired.Close()
+
+	if err := lsmtree.Rollback(dir, result.PreviousDir); err != nil {
+		t.Fatalf("Failed to roll the repair back: %v", err)
+	}
+	if report, err = lsmtree.Diagnose(dir, nil); err != nil || len(report.Corruptions) != 1 {
+		t.Errorf("Expected the damaged store back, got %+v (%v)", report, err)
+	}
+}
+
+// TestLSMTreeTableCacheLimit tests that reads keep at most MaxOpenFiles SSTable handles open
+func TestLSMTreeTableCacheLimit(t *testing.T) {
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{
+		MemTableSize: 1,
+		MaxOpenFiles: 2,
+		CachePolicy:  lsmtree.WriteAround,
+	})
+	defer tree.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		value, err := tree.Get(fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatalf("Failed to get value: %v", err)
+		}
+		if value != fmt.Sprintf("value-%d", i) {
+			t.Errorf("Unexpected value for key-%d: %q", i, value)
+		}
+	}
+
+	if open := tree.Stats().OpenFiles; open == 0 || open > 2 {
+		t.Errorf("Expected between 1 and 2 open SSTable files, got %d", open)
+	}
+}
+
+// TestLSMTreeMmapReads tests point lookups and listing through memory-mapped SSTables
+func TestLSMTreeMmapReads(t *testing.T) {
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{
+		MemTableSize: 2048,
+		MmapReads:    true,
+		CachePolicy:  lsmtree.WriteAround,
+	})
+	defer tree.Close()
+
+	for i := 0; i < 200; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if len(tree.Stats().SSTables) == 0 {
+		t.Fatalf("Expected the MemTable to be flushed to at least one SSTable")
+	}
+
+	for i := 0; i < 200; i++ {
+		value, err := tree.Get(fmt.Sprintf("key-%03d", i))
+		if err != nil {
+			t.Fatalf("Failed to get value: %v", err)
+		}
+		if value != fmt.Sprintf("value-%d", i) {
+			t.Errorf("Unexpected value for key-%03d: %q", i, value)
+		}
+	}
+
+	entries, err := tree.List()
+	if err != nil {
+		t.Fatalf("Failed to list entries: %v", err)
+	}
+	if len(entries) != 200 {
+		t.Errorf("Expected 200 entries, got %d", len(entries))
+	}
+}
+
+// TestLSMTreeCacheByteBudget tests that the cache evicts entries to stay within CacheBytes
+func TestLSMTreeCacheByteBudget(t *testing.T) {
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{CacheBytes: 2000})
+	defer tree.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("%0100d", i)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+
+	stats := tree.Stats().Cache
+	if stats.MaxBytes != 2000 {
+		t.Errorf("Expected a 2000 byte budget, got %d", stats.MaxBytes)
+	}
+	if stats.Bytes > 2000 || stats.Entries == 0 || stats.Entries == 100 {
+		t.Errorf("Expected a partially filled cache within budget, got %d entries using %d bytes", stats.Entries, stats.Bytes)
+	}
+
+	value, err := tree.Get("key-000")
+	if err != nil || value != fmt.Sprintf("%0100d", 0) {
+		t.Errorf("Expected evicted key to be read from the tree, got %q (%v)", value, err)
+	}
+}
+
+// TestCacheLRU tests that the cache evicts the least recently used entry and drops deleted keys
+func TestCacheLRU(t *testing.T) {
+	cache := lsmtree.NewCache(3)
+	cache.Set("a", "1")
+	cache.Set("b", "2")
+	cache.Set("c", "3")
+	for _, key := range []string{"b", "c", "a"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Fatalf("Expected %s to be cached", key)
+		}
+	}
+	cache.Set("d", "4")
+	if _, ok := cache.Get("b"); ok {
+		t.Error("Expected the least recently used key b to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("Expected %s to stay cached", key)
+		}
+	}
+
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{CacheSize: 2})
+	defer tree.Close()
+	for _, key := range []string{"pinned", "x", "y", "z"} {
+		if err := tree.Set(key, "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+		if key == "pinned" {
+			if err := tree.Pin(key); err != nil {
+				t.Fatalf("Failed to pin: %v", err)
+			}
+		}
+	}
+	if keys := tree.DebugState().Cache.Keys; !reflect.DeepEqual(keys, []string{"pinned", "z"}) {
+		t.Errorf("Expected the pinned key and the newest write cached, got %v", keys)
+	}
+	if err := tree.Delete("z"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if stats := tree.Stats().Cache; stats.Entries != 1 {
+		t.Errorf("Expected the deleted key to leave the cache, got %d entries", stats.Entries)
+	}
+	if value, err := tree.Get("z"); err != nil || value != "" {
+		t.Errorf("Expected the deleted key to be gone, got %q (%v)", value, err)
+	}
+}
+
+// TestCacheInvalidation tests that deleted keys leave the cache and stay gone
+// once their tombstones are flushed and compacted away
+func TestCacheInvalidation(t *testing.T) {
+	cache := lsmtree.NewCache(2)
+	cache.Set("a", "1")
+	cache.Delete("a")
+	cache.Delete("missing")
+	if _, ok := cache.Get("a"); ok {
+		t.Error("Expected the deleted key to miss")
+	}
+
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{MemTableSize: 256, CachePolicy: lsmtree.WriteAround})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	defer tree.Close()
+	for i := 0; i < 50; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%02d", i), "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if value, err := tree.Get("key-07"); err != nil || value != "value" {
+		t.Fatalf("Expected key-07 to be readable, got %q (%v)", value, err)
+	}
+	if err := tree.Delete("key-07"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	// A read of the tombstone doesn't cache it
+	if value, err := tree.Get("key-07"); err != nil || value != "" {
+		t.Errorf("Expected the deleted key to be gone, got %q (%v)", value, err)
+	}
+	if keys := tree.DebugState().Cache.Keys; len(keys) != 0 {
+		t.Errorf("Expected nothing cached, got %v", keys)
+	}
+
+	if _, err := tree.Reclaim(); err != nil {
+		t.Fatalf("Failed to reclaim: %v", err)
+	}
+	if value, err := tree.Get("key-07"); err != nil || value != "" {
+		t.Errorf("Expected the deleted key to stay gone after compaction, got %q (%v)", value, err)
+	}
+	if value, err := tree.Get("key-08"); err != nil || value != "value" {
+		t.Errorf("Expected key-08 to survive compaction, got %q (%v)", value, err)
+	}
+}
+
+// TestBloomFilterSizing tests that bloom filters are sized by BloomBitsPerKey and
+// that their parameters are read back from the footer
+func TestBloomFilterSizing(t *testing.T) {
+	filter := lsmtree.NewBloomFilter(1000, 10)
+	for i := 0; i < 1000; i++ {
+		filter.Add(fmt.Sprintf("key-%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !filter.MightContain(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("Expected key-%d to be in the filter", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.MightContain(fmt.Sprintf("missing-%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("Expected about 1%% false positives at 10 bits per key, got %d in 10000", falsePositives)
+	}
+
+	dir := t.TempDir()
+	options := lsmtree.Options{BloomBitsPerKey: 16}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i), "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if _, err := tree.Reclaim(); err != nil {
+		t.Fatalf("Failed to reclaim: %v", err)
+	}
+	tree.Close()
+
+	tree = lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	defer tree.Close()
+	// The footer records the parameters, so they're known before the filter is loaded
+	stats := tree.Stats()
+	if len(stats.SSTables) != 1 {
+		t.Fatalf("Expected one SSTable, got %d", len(stats.SSTables))
+	}
+	if table := stats.SSTables[0]; table.BloomBits != 1600 || table.BloomHashes != 11 {
+		t.Errorf("Expected a 1600 bit filter with 11 hashes, got %d bits and %d hashes", table.BloomBits, table.BloomHashes)
+	}
+	if tree.DebugState().SSTables[0].Loaded {
+		t.Error("Expected the filter to be loaded on first read")
+	}
+	if value, err := tree.Get("key-042"); err != nil || value != "value" {
+		t.Errorf("Expected key-042=value, got %q (%v)", value, err)
+	}
+	if summary := tree.DebugState().SSTables[0]; summary.BloomBits != 1600 || summary.BloomBitsSet == 0 {
+		t.Errorf("Expected the loaded filter to match the footer, got %+v", summary)
+	}
+}
+
+// TestBloomStats tests the bloom filter counters of each SSTable and their sum,
+// which `debug sstable` prints, over present keys, absent keys the filter rejects
+// and absent keys it passes, forcing an index miss
+func TestBloomStats(t *testing.T) {
+	dir := t.TempDir()
+	options := lsmtree.Options{MemTableSize: 512}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i), "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	tree.Close()
+
+	// Reopen so the counters start at zero
+	tree = lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	defer tree.Close()
+	tables := tree.Stats().SSTables
+	if len(tables) < 2 {
+		t.Fatalf("Expected several SSTables, got %d", len(tables))
+	}
+
+	var expectedTotal lsmtree.BloomStats
+	expected := make([]lsmtree.BloomStats, len(tables))
+	for n, table := range tables {
+		// Keys were written in order, so each SSTable holds every key of its range
+		var keys []string
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			if key >= table.Properties.SmallestKey && key <= table.Properties.LargestKey {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) != table.Properties.Entries {
+			t.Fatalf("Expected %s to hold %d keys, got %d", table.FilePath, len(keys), table.Properties.Entries)
+		}
+		for _, key := range keys {
+			if value, err := tree.Get(key); err != nil || value != "value" {
+				t.Fatalf("Expected %s=value, got %q (%v)", key, value, err)
+			}
+		}
+		expected[n].Checks += uint64(len(keys))
+
+		// The same keys and parameters rebuild the SSTable's filter, telling which
+		// absent keys inside its range it rejects and which it passes
+		filter := lsmtree.NewFilter(lsmtree.BloomFilterPolicy, keys, 10, nil)
+		var negative, falsePositive string
+		for j := 0; j < 100000 && (negative == "" || falsePositive == ""); j++ {
+			key := fmt.Sprintf("%s-%d", keys[j%(len(keys)-1)], j)
+			if filter.MightContain(key) {
+				if falsePositive == "" {
+					falsePositive = key
+				}
+			} else if negative == "" {
+				negative = key
+			}
+		}
+		if negative == "" || falsePositive == "" {
+			t.Fatalf("Expected absent keys both rejected and passed by the filter of %s", table.FilePath)
+		}
+		for _, key := range []string{negative, falsePositive} {
+			if value, err := tree.Get(key); err != nil || value != "" {
+				t.Fatalf("Expected %s to be missing, got %q (%v)", key, value, err)
+			}
+		}
+		expected[n].Checks += 2
+		expected[n].Negatives++
+		expected[n].FalsePositives++
+		expectedTotal.Checks += expected[n].Checks
+		expectedTotal.Negatives += expected[n].Negatives
+		expectedTotal.FalsePositives += expected[n].FalsePositives
+	}
+
+	// Keys outside every SSTable's range are skipped without consulting a filter
+	if value, err := tree.Get("zzz"); err != nil || value != "" {
+		t.Fatalf("Expected zzz to be missing, got %q (%v)", value, err)
+	}
+
+	stats := tree.Stats()
+	for n, table := range stats.SSTables {
+		if table.Bloom != expected[n] {
+			t.Errorf("Expected %s to count %+v, got %+v", table.FilePath, expected[n], table.Bloom)
+		}
+	}
+	if stats.Bloom != expectedTotal {
+		t.Errorf("Expected the SSTables to count %+v in total, got %+v", expectedTotal, stats.Bloom)
+	}
+}
+
+// TestPrefixFilter tests that prefix scans skip the SSTables whose prefix filter
+// rules their prefix out, and that filters of another extractor are ignored
+func TestPrefixFilter(t *testing.T) {
+	if prefix, ok := lsmtree.SeparatorPrefix("/").Prefix("services/api/token"); !ok || prefix != "services/" {
+		t.Errorf("Expected the prefix services/, got %q (%v)", prefix, ok)
+	}
+	if _, ok := lsmtree.FixedPrefix(4).Prefix("abc"); ok {
+		t.Error("Expected a key shorter than a fixed prefix to have none")
+	}
+
+	dir := t.TempDir()
+	options := lsmtree.Options{MemTableSize: 512, PrefixExtractor: lsmtree.SeparatorPrefix("/")}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	for _, namespace := range []string{"alpha", "beta"} {
+		for i := 0; i < 50; i++ {
+			if err := tree.Set(fmt.Sprintf("%s/key-%02d", namespace, i), "value"); err != nil {
+				t.Fatalf("Failed to set value: %v", err)
+			}
+		}
+	}
+	tree.Close()
+
+	count := func(tree *lsmtree.LSMTree, prefix string) int {
+		it, err := lsmtree.PrefixScan(tree, prefix)
+		if err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		defer it.Close()
+		n := 0
+		for it.Next() {
+			n++
+		}
+		return n
+	}
+
+	// Reopened, so no compaction rewrites the SSTables while they're counted
+	tree = lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	tables := len(tree.Stats().SSTables)
+	if tables < 2 {
+		t.Fatalf("Expected several SSTables, got %d", tables)
+	}
+	if n := count(tree, "gamma/"); n != 0 {
+		t.Errorf("Expected no gamma keys, got %d", n)
+	}
+	if bloom := tree.Stats().Bloom; bloom.PrefixChecks != uint64(tables) || bloom.PrefixNegatives == 0 {
+		t.Errorf("Expected every SSTable checked and some skipped, got %+v", bloom)
+	}
+	if n := count(tree, "beta/"); n != 50 {
+		t.Errorf("Expected 50 beta keys, got %d", n)
+	}
+	if n := count(tree, "beta/key-1"); n != 10 {
+		t.Errorf("Expected 10 keys under beta/key-1, got %d", n)
+	}
+	tree.Close()
+
+	// SSTables built by another extractor are scanned as usual
+	tree = lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{PrefixExtractor: lsmtree.FixedPrefix(2)})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	defer tree.Close()
+	if n := count(tree, "alpha/"); n != 50 {
+		t.Errorf("Expected 50 alpha keys, got %d", n)
+	}
+	if bloom := tree.Stats().Bloom; bloom.PrefixChecks != 0 {
+		t.Errorf("Expected the filters of another extractor to be ignored, got %+v", bloom)
+	}
+}
+
+// TestRibbonFilter tests that ribbon filters hold their keys with the false
+// positive rate of a bloom filter in less memory, and that SSTables use them
+func TestRibbonFilter(t *testing.T) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	bloom := lsmtree.NewFilter(lsmtree.BloomFilterPolicy, keys, 10, nil)
+	ribbon := lsmtree.NewFilter(lsmtree.RibbonFilterPolicy, keys, 10, nil)
+	for _, key := range keys {
+		if !ribbon.MightContain(key) {
+			t.Fatalf("Expected %s to be in the filter", key)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if ribbon.MightContain(fmt.Sprintf("missing-%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 150 {
+		t.Errorf("Expected about 0.8%% false positives, got %d in 10000", falsePositives)
+	}
+	if ribbon.Bits() > bloom.Bits()*4/5 {
+		t.Errorf("Expected the ribbon filter to be smaller than the bloom filter's %d bits, got %d", bloom.Bits(), ribbon.Bits())
+	}
+
+	dir := t.TempDir()
+	options := lsmtree.Options{FilterPolicy: lsmtree.RibbonFilterPolicy, PrefixExtractor: lsmtree.SeparatorPrefix("/")}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := tree.Set(fmt.Sprintf("ns/key-%03d", i), "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if _, err := tree.Reclaim(); err != nil {
+		t.Fatalf("Failed to reclaim: %v", err)
+	}
+	tree.Close()
+
+	tree = lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	defer tree.Close()
+	for i := 0; i < 500; i++ {
+		if value, err := tree.Get(fmt.Sprintf("ns/key-%03d", i)); err != nil || value != "value" {
+			t.Fatalf("Expected ns/key-%03d=value, got %q (%v)", i, value, err)
+		}
+		if value, err := tree.Get(fmt.Sprintf("ns/key-%03da", i)); err != nil || value != "" {
+			t.Fatalf("Expected ns/key-%03da to be missing, got %q (%v)", i, value, err)
+		}
+	}
+	if it, err := lsmtree.PrefixScan(tree, "other/"); err != nil || it.Next() {
+		t.Errorf("Expected no keys under other/ (%v)", err)
+	}
+	if stats := tree.Stats(); stats.Bloom.Negatives == 0 || stats.Bloom.PrefixNegatives != 1 {
+		t.Errorf("Expected the ribbon filters to reject missing keys and prefixes, got %+v", stats.Bloom)
+	}
+	report, err := lsmtree.VerifyDir(dir)
+	if err != nil || len(report.Corruptions) > 0 {
+		t.Errorf("Expected the SSTable to verify, got %v (%v)", report.Corruptions, err)
+	}
+}
+
+// saltedHasher is a KeyHasher other than the built-in one
+type saltedHasher struct{}
+
+func (saltedHasher) Name() string { return "salted" }
+
+func (saltedHasher) Hash(key string, seed uint64) uint64 {
+	return lsmtree.FNVHasher().Hash("salt:"+key, seed)
+}
+
+// TestKeyHasher tests that bloom filters combining two hashes get the false
+// positive rate they're sized for, and that filters built by a hasher the tree
+// isn't opened with are ignored
+func TestKeyHasher(t *testing.T) {
+	for _, n := range []int{100, 10000} {
+		keys := make([]string, n)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("key-%d", i)
+		}
+		filter := lsmtree.NewFilter(lsmtree.BloomFilterPolicy, keys, 10, saltedHasher{})
+		for _, key := range keys {
+			if !filter.MightContain(key) {
+				t.Fatalf("Expected %s to be in the filter", key)
+			}
+		}
+		falsePositives := 0
+		for i := 0; i < 10000; i++ {
+			if filter.MightContain(fmt.Sprintf("missing-%d", i)) {
+				falsePositives++
+			}
+		}
+		if falsePositives > 150 {
+			t.Errorf("Expected about 0.8%% false positives in a filter of %d keys, got %d in 10000", n, falsePositives)
+		}
+	}
+
+	dir := t.TempDir()
+	options := lsmtree.Options{KeyHasher: saltedHasher{}}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i), "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if _, err := tree.Reclaim(); err != nil {
+		t.Fatalf("Failed to reclaim: %v", err)
+	}
+	tree.Close()
+
+	for _, options := range []lsmtree.Options{{KeyHasher: saltedHasher{}}, {}} {
+		tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+		if err := tree.Recover(); err != nil {
+			t.Fatalf("Failed to recover tree: %v", err)
+		}
+		for i := 0; i < 100; i++ {
+			if value, err := tree.Get(fmt.Sprintf("key-%03d", i)); err != nil || value != "value" {
+				t.Fatalf("Expected key-%03d=value, got %q (%v)", i, value, err)
+			}
+			if value, err := tree.Get(fmt.Sprintf("key-%03da", i)); err != nil || value != "" {
+				t.Fatalf("Expected key-%03da to be missing, got %q (%v)", i, value, err)
+			}
+		}
+		negatives := tree.Stats().Bloom.Negatives
+		tree.Close()
+		if options.KeyHasher != nil && negatives == 0 {
+			t.Errorf("Expected the filter to reject missing keys")
+		} else if options.KeyHasher == nil && negatives != 0 {
+			t.Errorf("Expected the filter of another hasher to be ignored, got %d negatives", negatives)
+		}
+	}
+	report, err := lsmtree.VerifyDir(dir)
+	if err != nil || len(report.Corruptions) > 0 {
+		t.Errorf("Expected the SSTable to verify, got %v (%v)", report.Corruptions, err)
+	}
+}
+
+// BenchmarkFilters compares building and querying bloom and ribbon filters of
+// 10 bits per key, reporting their size and false positive rate
+func BenchmarkFilters(b *testing.B) {
+	keys := make([]string, 100000)
+	missing := make([]string, len(keys))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("services/production/key-%06d", i)
+		missing[i] = fmt.Sprintf("services/staging/key-%06d", i)
+	}
+	for _, policy := range []lsmtree.FilterPolicy{lsmtree.BloomFilterPolicy, lsmtree.RibbonFilterPolicy} {
+		b.Run(policy.String()+"/build", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				lsmtree.NewFilter(policy, keys, 10, nil)
+			}
+		})
+		filter := lsmtree.NewFilter(policy, keys, 10, nil)
+		b.Run(policy.String()+"/lookup", func(b *testing.B) {
+			falsePositives := 0
+			for i := 0; i < b.N; i++ {
+				if filter.MightContain(missing[i%len(missing)]) {
+					falsePositives++
+				}
+			}
+			b.ReportMetric(float64(filter.Bits())/float64(len(keys)), "bits/key")
+			b.ReportMetric(100*float64(falsePositives)/float64(b.N), "%fp")
+		})
+	}
+}
+
+// TestSSTableProperties tests that SSTables record their key range, counts and creation time
+func TestSSTableProperties(t *testing.T) {
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{MemTableSize: 1})
+	defer tree.Close()
+
+	// A single batch is flushed to a single SSTable
+	start := time.Now()
+	batch := lsmtree.NewWriteBatch()
+	batch.Set("b", "value")
+	batch.Set("c", "value")
+	batch.Set("d", "value")
+	batch.Delete("a")
+	if err := tree.Batch(batch); err != nil {
+		t.Fatalf("Failed to apply batch: %v", err)
+	}
+
+	tables := tree.Stats().SSTables
+	if len(tables) != 1 {
+		t.Fatalf("Expected one SSTable, got %d", len(tables))
+	}
+	props := tables[0].Properties
+	if props.SmallestKey != "a" || props.LargestKey != "d" || props.Entries != 4 || props.Tombstones != 1 {
+		t.Errorf("Unexpected properties: %+v", props)
+	}
+	if props.CreatedAt.Before(start.Add(-time.Second)) || props.CreatedAt.After(time.Now()) {
+		t.Errorf("Unexpected creation time %v", props.CreatedAt)
+	}
+
+	described, err := lsmtree.DescribeSSTable(tables[0].FilePath)
+	if err != nil {
+		t.Fatalf("Failed to describe SSTable: %v", err)
+	}
+	if described != props {
+		t.Errorf("Expected described properties %+v, got %+v", props, described)
+	}
+}
+
+// TestLSMTreeBlockCache tests that scans and point reads share the byte-bounded block cache
+func TestLSMTreeBlockCache(t *testing.T) {
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{
+		MemTableSize:   1,
+		BlockSize:      512,
+		CacheSize:      1,
+		CachePolicy:    lsmtree.WriteAround,
+		BlockCacheSize: 4096,
+	})
+	defer tree.Close()
+
+	// A single batch is flushed to a single SSTable with several blocks
+	batch := lsmtree.NewWriteBatch()
+	for i := 0; i < 200; i++ {
+		batch.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i))
+	}
+	if err := tree.Batch(batch); err != nil {
+		t.Fatalf("Failed to apply batch: %v", err)
+	}
+
+	if _, err := tree.List(); err != nil {
+		t.Fatalf("Failed to list entries: %v", err)
+	}
+	for i := 199; i >= 190; i-- {
+		if value, err := tree.Get(fmt.Sprintf("key-%03d", i)); err != nil || value != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("Expected 'value-%d', got '%s' (%v)", i, value, err)
+		}
+	}
+
+	stats := tree.Stats().BlockCache
+	if stats.Hits == 0 {
+		t.Errorf("Expected point reads to hit blocks cached by the scan, got %+v", stats)
+	}
+	if stats.Bytes > stats.Capacity || stats.Capacity != 4096 {
+		t.Errorf("Expected the block cache to stay within 4096 bytes, got %+v", stats)
+	}
+}
+
+// TestLockDir tests that a live lock blocks other users while a dead owner's lock is taken over
+func TestLockDir(t *testing.T) {
+	dir := t.TempDir()
+
+	lock, err := lsmtree.LockDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to lock data directory: %v", err)
+	}
+	var locked *lsmtree.ErrLocked
+	if _, err := lsmtree.LockDir(dir); !errors.As(err, &locked) || locked.Owner.PID != os.Getpid() {
+		t.Fatalf("Expected the second lock to fail with the owner, got %v", err)
+	}
+	if _, err := lsmtree.UnlockDir(dir, false); !errors.As(err, &locked) {
+		t.Errorf("Expected unlock-dir without force to keep a live lock, got %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Failed to release lock: %v", err)
+	}
+
+	// Locks of dead processes and of hosts that stopped their heartbeat are stale
+	hostname, _ := os.Hostname()
+	for name, owner := range map[string]string{
+		"dead process": fmt.Sprintf(`{"pid": 999999999, "hostname": %q, "heartbeat": %q}`, hostname, time.Now().Format(time.RFC3339)),
+		"silent host":  fmt.Sprintf(`{"pid": 1, "hostname": "elsewhere", "heartbeat": %q}`, time.Now().Add(-time.Hour).Format(time.RFC3339)),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, "LOCK"), []byte(owner), 0600); err != nil {
+			t.Fatalf("Failed to write lock file: %v", err)
+		}
+		lock, err := lsmtree.LockDir(dir)
+		if err != nil {
+			t.Fatalf("Expected the lock of a %s to be taken over, got %v", name, err)
+		}
+		lock.Release()
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "LOCK"), []byte(`{"pid": 1, "hostname": "elsewhere", "heartbeat": "2100-01-01T00:00:00Z"}`), 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	if _, err := lsmtree.LockDir(dir); !errors.As(err, &locked) {
+		t.Fatalf("Expected a live remote lock to block, got %v", err)
+	}
+	if _, err := lsmtree.UnlockDir(dir, true); err != nil {
+		t.Fatalf("Failed to force unlock: %v", err)
+	}
+	if _, err := lsmtree.ReadLock(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the lock to be removed, got %v", err)
+	}
+}
+
+// TestWALSyncPolicies tests that writes are recovered from the WAL under every sync policy
+func TestWALSyncPolicies(t *testing.T) {
+	for _, name := range []string{"always", "interval", "never"} {
+		t.Run(name, func(t *testing.T) {
+			policy, err := lsmtree.ParseSyncPolicy(name)
+			if err != nil {
+				t.Fatalf("Failed to parse sync policy: %v", err)
+			}
+			if policy.String() != name {
+				t.Errorf("Expected policy %s, got %s", name, policy)
+			}
+
+			dir := t.TempDir()
+			options := lsmtree.Options{WALSync: policy, WALSyncInterval: time.Millisecond}
+			tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+			batch := lsmtree.NewWriteBatch()
+			batch.Set("batched", "value")
+			batch.Delete("key")
+			if err := tree.Set("key", "value"); err != nil {
+				t.Fatalf("Failed to set value: %v", err)
+			}
+			if err := tree.Batch(batch); err != nil {
+				t.Fatalf("Failed to apply batch: %v", err)
+			}
+			if err := tree.Set("other", "value"); err != nil {
+				t.Fatalf("Failed to set value: %v", err)
+			}
+			if err := tree.Close(); err != nil {
+				t.Fatalf("Failed to close tree: %v", err)
+			}
+
+			reopened := lsmtree.NewLSMTreeWithOptions(dir, options)
+			defer reopened.Close()
+			if err := reopened.Recover(); err != nil {
+				t.Fatalf("Failed to recover: %v", err)
+			}
+			for key, expected := range map[string]string{"key": "", "batched": "value", "other": "value"} {
+				if value, err := reopened.Get(key); err != nil || value != expected {
+					t.Errorf("Expected %s=%q, got %q (%v)", key, expected, value, err)
+				}
+			}
+		})
+	}
+
+	if _, err := lsmtree.ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("Expected an error for an unknown sync policy")
+	}
+}
+
+// TestWALTornBatch tests that a batch whose commit record never reached the WAL is dropped on recovery
+func TestWALTornBatch(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTree(dir)
+	if err := tree.Set("before", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	batch := lsmtree.NewWriteBatch()
+	batch.Set("a", "1")
+	batch.Set("b", "2")
+	if err := tree.Batch(batch); err != nil {
+		t.Fatalf("Failed to apply batch: %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+
+	// Cut off the 9-byte commit record as if the process died mid-write
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(segments) != 1 {
+		t.Fatalf("Expected one WAL segment, got %v", segments)
+	}
+	walPath := segments[0]
+	info, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatalf("Failed to stat WAL: %v", err)
+	}
+	if err := os.Truncate(walPath, info.Size()-9); err != nil {
+		t.Fatalf("Failed to truncate WAL: %v", err)
+	}
+
+	reopened := lsmtree.NewLSMTree(dir)
+	defer reopened.Close()
+	if err := reopened.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	for key, expected := range map[string]string{"before": "value", "a": "", "b": ""} {
+		if value, err := reopened.Get(key); err != nil || value != expected {
+			t.Errorf("Expected %s=%q, got %q (%v)", key, expected, value, err)
+		}
+	}
+}
+
+// TestMigrateUntypedWAL tests upgrading a WAL whose records carry no record type
+func TestMigrateUntypedWAL(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "MANIFEST"), []byte(`{"format_version": 5, "tables": []}`), 0600); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	var wal []byte
+	for _, kv := range [][2]string{{"kept", "value"}, {"gone", "value"}, {"gone", ""}} {
+		var payload []byte
+		payload = binary.AppendUvarint(payload, uint64(len(kv[0])))
+		payload = append(payload, kv[0]...)
+		payload = binary.AppendUvarint(payload, uint64(len(kv[1])))
+		payload = append(payload, kv[1]...)
+		record := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+		record = append(record, payload...)
+		checksum := crc32.Checksum(record, crc32.MakeTable(crc32.Castagnoli))
+		wal = append(binary.LittleEndian.AppendUint32(wal, checksum), record...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "wal.log"), wal, 0600); err != nil {
+		t.Fatalf("Failed to write WAL: %v", err)
+	}
+
+	steps, err := lsmtree.Migrate(dir)
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if len(steps) != 1 || steps[0].From != 5 || steps[0].To != lsmtree.CurrentFormatVersion {
+		t.Fatalf("Unexpected migration steps: %+v", steps)
+	}
+
+	tree := lsmtree.NewLSMTree(dir)
+	defer tree.Close()
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover migrated tree: %v", err)
+	}
+	entries, err := tree.List()
+	if err != nil {
+		t.Fatalf("Failed to list entries: %v", err)
+	}
+	if len(entries) != 1 || entries["kept"] != "value" {
+		t.Errorf("Unexpected entries after migration: %v", entries)
+	}
+}
+
+// TestWALSegments tests that the WAL rotates at its segment size and drops segments once they are flushed
+func TestWALSegments(t *testing.T) {
+	dir := t.TempDir()
+	options := lsmtree.Options{MemTableSize: 1 << 20, WALSegmentSize: 256}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := tree.Set(fmt.Sprintf("key%02d", i), "some value to fill the segment"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(segments) < 5 {
+		t.Errorf("Expected the WAL to rotate into several segments, got %d", len(segments))
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+
+	// Recovering twice must not lose writes that were never flushed
+	for round := 0; round < 2; round++ {
+		reopened := lsmtree.NewLSMTreeWithOptions(dir, options)
+		if err := reopened.Recover(); err != nil {
+			t.Fatalf("Failed to recover: %v", err)
+		}
+		if value, err := reopened.Get("key49"); err != nil || value != "some value to fill the segment" {
+			t.Errorf("Round %d: expected key49 to survive recovery, got %q (%v)", round, value, err)
+		}
+		if err := reopened.Close(); err != nil {
+			t.Fatalf("Failed to close tree: %v", err)
+		}
+	}
+
+	// Flushing moves everything into an SSTable, so only the new, empty segment is kept
+	flushing := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{MemTableSize: 1, WALSegmentSize: 256})
+	defer flushing.Close()
+	if err := flushing.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if err := flushing.Set("last", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	segments, _ = filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(segments) > 1 {
+		t.Errorf("Expected flushed WAL segments to be removed, got %v", segments)
+	}
+	if value, err := flushing.Get("key00"); err != nil || value == "" {
+		t.Errorf("Expected key00 to be in an SSTable, got %q (%v)", value, err)
+	}
+}
+
+// TestPrefixCompressedKeys tests that keys sharing long prefixes are stored compactly and still found across restart points
+func TestPrefixCompressedKeys(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{MemTableSize: 1})
+	defer tree.Close()
+
+	batch := lsmtree.NewWriteBatch()
+	rawSize := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("services/production/eu-west-1/database/replica-%04d", i)
+		batch.Set(key, "v")
+		rawSize += len(key) + 1
+	}
+	if err := tree.Batch(batch); err != nil {
+		t.Fatalf("Failed to apply batch: %v", err)
+	}
+
+	for _, i := range []int{0, 1, 15, 16, 17, 500, 999} {
+		key := fmt.Sprintf("services/production/eu-west-1/database/replica-%04d", i)
+		if value, err := tree.Get(key); err != nil || value != "v" {
+			t.Errorf("Expected %s=v, got %q (%v)", key, value, err)
+		}
+	}
+	for _, key := range []string{"services/production/eu-west-1/database/replica-0500a", "services/", "zzz"} {
+		if value, err := tree.Get(key); err != nil || value != "" {
+			t.Errorf("Expected %s to be missing, got %q (%v)", key, value, err)
+		}
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "sstable_*.dat"))
+	if len(paths) != 1 {
+		t.Fatalf("Expected one SSTable, got %d", len(paths))
+	}
+	info, err := os.Stat(paths[0])
+	if err != nil {
+		t.Fatalf("Failed to stat SSTable: %v", err)
+	}
+	// The bloom filter isn't prefix-compressed, so leave it out
+	stats := tree.Stats()
+	if len(stats.SSTables) != 1 {
+		t.Fatalf("Expected stats for one SSTable, got %d", len(stats.SSTables))
+	}
+	size := info.Size() - int64(stats.SSTables[0].BloomBits/8)
+	if size > int64(rawSize)/2 {
+		t.Errorf("Expected prefix compression to at least halve %d bytes of keys, got %d bytes of blocks", rawSize, size)
+	}
+
+	report, err := lsmtree.VerifyDir(dir)
+	if err != nil || len(report.Corruptions) > 0 {
+		t.Errorf("Expected the SSTable to verify, got %v (%v)", report.Corruptions, err)
+	}
+}
+
+// TestWALBufferedWrites tests that buffered WAL writes only reach the segment file at an explicit sync point
+func TestWALBufferedWrites(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{WALSync: lsmtree.SyncNever, WALSyncInterval: time.Hour})
+	defer tree.Close()
+
+	if err := tree.Set("key", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	segmentSize := func() int64 {
+		segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+		if len(segments) != 1 {
+			t.Fatalf("Expected one WAL segment, got %v", segments)
+		}
+		info, err := os.Stat(segments[0])
+		if err != nil {
+			t.Fatalf("Failed to stat WAL segment: %v", err)
+		}
+		return info.Size()
+	}
+	if size := segmentSize(); size != 0 {
+		t.Errorf("Expected the write to be buffered, got a %d byte segment", size)
+	}
+
+	if err := tree.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if size := segmentSize(); size == 0 {
+		t.Error("Expected Sync to write out the buffered record")
+	}
+}
+
+// TestWALUnsyncedBacklog tests that Stats reports unsynced WAL bytes and that the byte limit forces an early sync
+func TestWALUnsyncedBacklog(t *testing.T) {
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{
+		WALSync:             lsmtree.SyncInterval,
+		WALSyncInterval:     time.Hour,
+		WALMaxUnsyncedBytes: 100,
+	})
+	defer tree.Close()
+
+	if err := tree.Set("key", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	wal := tree.Stats().WAL
+	if wal.Policy != "interval" || wal.SyncInterval != time.Hour || wal.MaxUnsyncedBytes != 100 {
+		t.Errorf("Unexpected WAL settings in stats: %+v", wal)
+	}
+	if wal.UnsyncedBytes == 0 || wal.OldestUnsynced.IsZero() || wal.Syncs != 0 {
+		t.Errorf("Expected an unsynced write, got %+v", wal)
+	}
+
+	if err := tree.Set("big", strings.Repeat("x", 100)); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	wal = tree.Stats().WAL
+	if wal.UnsyncedBytes != 0 || wal.Syncs != 1 {
+		t.Errorf("Expected the byte limit to force a sync, got %+v", wal)
+	}
+}
+
+// TestWALTornRecord tests that recovery truncates a partially written last record and reports it
+func TestWALTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTree(dir)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := tree.Set(key, "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+
+	// Cut the last record in half as if the process died mid-write
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(segments) != 1 {
+		t.Fatalf("Expected one WAL segment, got %v", segments)
+	}
+	info, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatalf("Failed to stat WAL: %v", err)
+	}
+	if err := os.Truncate(segments[0], info.Size()-5); err != nil {
+		t.Fatalf("Failed to truncate WAL: %v", err)
+	}
+
+	reopened := lsmtree.NewLSMTree(dir)
+	if err := reopened.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	for key, expected := range map[string]string{"a": "value", "b": "value", "c": ""} {
+		if value, err := reopened.Get(key); err != nil || value != expected {
+			t.Errorf("Expected %s=%q, got %q (%v)", key, expected, value, err)
+		}
+	}
+	report := reopened.Stats().Recovery
+	if report.Segments != 1 || report.Replayed != 2 || report.Discarded != 1 || report.Truncated != segments[0] {
+		t.Errorf("Unexpected recovery report: %+v", report)
+	}
+	if err := reopened.Set("d", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+
+	// The torn bytes are gone, so the segment is no longer the last one but still replays cleanly
+	again := lsmtree.NewLSMTree(dir)
+	defer again.Close()
+	if err := again.Recover(); err != nil {
+		t.Fatalf("Failed to recover again: %v", err)
+	}
+	if value, _ := again.Get("d"); value != "value" {
+		t.Errorf("Expected d=value, got %q", value)
+	}
+	if report := again.Stats().Recovery; report.Replayed != 3 || report.Discarded != 0 {
+		t.Errorf("Unexpected recovery report: %+v", report)
+	}
+}
+
+// TestWALCorruptRecord tests that a damaged record followed by valid ones fails recovery
+func TestWALCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTree(dir)
+	for _, key := range []string{"a", "b"} {
+		if err := tree.Set(key, "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	data, err := os.ReadFile(segments[0])
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+	data[10] ^= 0xff // inside the first record's payload
+	if err := os.WriteFile(segments[0], data, 0600); err != nil {
+		t.Fatalf("Failed to write WAL: %v", err)
+	}
+
+	reopened := lsmtree.NewLSMTree(dir)
+	defer reopened.Close()
+	var corruption *lsmtree.ErrCorruption
+	if err := reopened.Recover(); !errors.As(err, &corruption) {
+		t.Fatalf("Expected a corruption error, got %v", err)
+	}
+}
+
+// TestRecoverKeepsWAL tests that recovered writes stay in the WAL until they're flushed, so a
+// crash right after recovery doesn't lose them
+func TestRecoverKeepsWAL(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTree(dir)
+	if err := tree.Set("kept", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := tree.Set("gone", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := tree.Delete("gone"); err != nil {
+		t.Fatalf("Failed to delete value: %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+
+	recovered := lsmtree.NewLSMTree(dir)
+	if err := recovered.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(segments) == 0 {
+		t.Fatalf("Expected recovery to keep the WAL until a flush")
+	}
+	// Closing doesn't flush the MemTable, so this leaves the directory as a crash would
+	if err := recovered.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+	reopened := lsmtree.NewLSMTree(dir)
+	defer reopened.Close()
+	if err := reopened.Recover(); err != nil {
+		t.Fatalf("Failed to recover again: %v", err)
+	}
+	for key, expected := range map[string]string{"kept": "value", "gone": ""} {
+		if value, err := reopened.Get(key); err != nil || value != expected {
+			t.Errorf("Expected %s=%q after a second recovery, got %q (%v)", key, expected, value, err)
+		}
+	}
+}
+
+// TestRecoverLocksDir tests that an open tree holds the data directory lock until it's closed
+func TestRecoverLocksDir(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTree(dir)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+
+	var locked *lsmtree.ErrLocked
+	second := lsmtree.NewLSMTree(dir)
+	if err := second.Recover(); !errors.As(err, &locked) || locked.Owner.PID != os.Getpid() {
+		t.Fatalf("Expected a second tree to find the directory in use, got %v", err)
+	}
+	if _, err := lsmtree.LockDir(dir); !errors.As(err, &locked) {
+		t.Fatalf("Expected the directory lock to be held, got %v", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+	if _, err := lsmtree.ReadLock(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected Close to release the lock, got %v", err)
+	}
+	if err := second.Recover(); err != nil {
+		t.Fatalf("Expected the directory to be free after Close, got %v", err)
+	}
+	second.Close()
+}
+
+// TestCachePinning tests that pinned keys survive eviction, stay current on writes and are restored by Recover
+func TestCachePinning(t *testing.T) {
+	dir := t.TempDir()
+	options := lsmtree.Options{CacheSize: 4, CachePolicy: lsmtree.WriteAround}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if err := tree.Set("hot", "v1"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := tree.Pin("hot"); err != nil {
+		t.Fatalf("Failed to pin key: %v", err)
+	}
+	if err := tree.Pin("warm"); err != nil {
+		t.Fatalf("Failed to pin key: %v", err)
+	}
+	if err := tree.Pin("third"); !errors.Is(err, lsmtree.ErrPinLimit) {
+		t.Errorf("Expected pinning beyond half the cache to fail, got %v", err)
+	}
+
+	// Writes around the cache update a pinned key in place instead of invalidating it
+	if err := tree.Set("hot", "v2"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("cold%02d", i)
+		if err := tree.Set(key, "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+		tree.Get(key)
+	}
+	before := tree.Stats().Cache
+	if value, err := tree.Get("hot"); err != nil || value != "v2" {
+		t.Errorf("Expected hot=v2, got %q (%v)", value, err)
+	}
+	after := tree.Stats().Cache
+	if after.Hits != before.Hits+1 || after.Pinned != 2 || after.MaxPinned != 2 || after.Entries > 4 {
+		t.Errorf("Expected a cache hit for the pinned key, got %+v", after)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+
+	reopened := lsmtree.NewLSMTreeWithOptions(dir, options)
+	defer reopened.Close()
+	if err := reopened.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if pinned := reopened.Pinned(); len(pinned) != 2 || pinned[0] != "hot" || pinned[1] != "warm" {
+		t.Errorf("Expected pins to be restored, got %v", pinned)
+	}
+	if value, _ := reopened.Get("hot"); value != "v2" || reopened.Stats().Cache.Hits != 1 {
+		t.Errorf("Expected hot=v2 from the cache, got %q (%+v)", value, reopened.Stats().Cache)
+	}
+	if err := reopened.Unpin("warm"); err != nil {
+		t.Fatalf("Failed to unpin key: %v", err)
+	}
+	if pinned := reopened.Pinned(); len(pinned) != 1 {
+		t.Errorf("Expected one pinned key, got %v", pinned)
+	}
+}
+
+// TestCheckpoint tests that a checkpoint holds the tree's contents at the time it's taken
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{MemTableSize: 512})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+	for i := 0; i < 50; i++ {
+		if err := tree.Set(fmt.Sprintf("key%02d", i), "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if err := tree.Delete("key00"); err != nil {
+		t.Fatalf("Failed to delete value: %v", err)
+	}
+	if err := tree.Pin("key01"); err != nil {
+		t.Fatalf("Failed to pin key: %v", err)
+	}
+
+	backup := filepath.Join(t.TempDir(), "backup")
+	if err := tree.Checkpoint(backup); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	if err := tree.Checkpoint(backup); err == nil {
+		t.Errorf("Expected a checkpoint into a non-empty directory to fail")
+	}
+	// Later writes don't reach the checkpoint
+	if err := tree.Set("later", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if segments, _ := filepath.Glob(filepath.Join(backup, "wal-*.log")); len(segments) != 0 {
+		t.Errorf("Expected no WAL in the checkpoint, got %v", segments)
+	}
+
+	restored := lsmtree.NewLSMTree(backup)
+	defer restored.Close()
+	if err := restored.Recover(); err != nil {
+		t.Fatalf("Failed to open checkpoint: %v", err)
+	}
+	for key, expected := range map[string]string{"key00": "", "key01": "value", "key49": "value", "later": ""} {
+		if value, err := restored.Get(key); err != nil || value != expected {
+			t.Errorf("Expected %s=%q in the checkpoint, got %q (%v)", key, expected, value, err)
+		}
+	}
+	if pinned := restored.Pinned(); len(pinned) != 1 || pinned[0] != "key01" {
+		t.Errorf("Expected the pins to be checkpointed, got %v", pinned)
+	}
+}
+
+// TestRestore tests installing a checkpoint by replacing or merging, and refusing a corrupt one
+func TestRestore(t *testing.T) {
+	source := t.TempDir()
+	tree := lsmtree.NewLSMTree(source)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	for key, value := range map[string]string{"shared": "from backup", "backup-only": "value"} {
+		if err := tree.Set(key, value); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	backup := filepath.Join(t.TempDir(), "backup")
+	if err := tree.Checkpoint(backup); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	tree.Close()
+
+	// populate returns a data directory holding keys the backup doesn't have
+	populate := func() string {
+		dir := t.TempDir()
+		existing := lsmtree.NewLSMTree(dir)
+		if err := existing.Recover(); err != nil {
+			t.Fatalf("Failed to recover: %v", err)
+		}
+		existing.Set("shared", "existing")
+		existing.Set("existing-only", "value")
+		existing.Close()
+		return dir
+	}
+	check := func(dir string, expected map[string]string) {
+		t.Helper()
+		restored := lsmtree.NewLSMTree(dir)
+		defer restored.Close()
+		if err := restored.Recover(); err != nil {
+			t.Fatalf("Failed to open restored store: %v", err)
+		}
+		for key, want := range expected {
+			if value, err := restored.Get(key); err != nil || value != want {
+				t.Errorf("Expected %s=%q, got %q (%v)", key, want, value, err)
+			}
+		}
+	}
+
+	dir := populate()
+	result, err := lsmtree.Restore(dir, backup, lsmtree.RestoreOptions{})
+	if err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	if result.TablesVerified != 1 || result.PreviousDir == "" {
+		t.Errorf("Unexpected restore result: %+v", result)
+	}
+	check(dir, map[string]string{"shared": "from backup", "backup-only": "value", "existing-only": ""})
+	if err := lsmtree.Rollback(dir, result.PreviousDir); err != nil {
+		t.Fatalf("Failed to roll the restore back: %v", err)
+	}
+	check(dir, map[string]string{"shared": "existing", "backup-only": "", "existing-only": "value"})
+
+	dir = populate()
+	result, err = lsmtree.Restore(dir, backup, lsmtree.RestoreOptions{Merge: true})
+	if err != nil {
+		t.Fatalf("Failed to merge: %v", err)
+	}
+	if result.EntriesMerged != 2 {
+		t.Errorf("Expected 2 merged entries, got %+v", result)
+	}
+	check(dir, map[string]string{"shared": "from backup", "backup-only": "value", "existing-only": "value"})
+
+	// Copy the backup with a byte of its SSTable flipped
+	corrupt := t.TempDir()
+	files, _ := filepath.Glob(filepath.Join(backup, "*"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read backup: %v", err)
+		}
+		if strings.HasPrefix(filepath.Base(file), "sstable_") {
+			data[0] ^= 0xff
+		}
+		if err := os.WriteFile(filepath.Join(corrupt, filepath.Base(file)), data, 0600); err != nil {
+			t.Fatalf("Failed to write backup: %v", err)
+		}
+	}
+	dir = populate()
+	if _, err := lsmtree.Restore(dir, corrupt, lsmtree.RestoreOptions{}); err == nil {
+		t.Fatalf("Expected a corrupt backup to be refused")
+	}
+	check(dir, map[string]string{"shared": "existing", "existing-only": "value"})
+}
+
+// TestSnapshotSchedules tests that scheduled snapshots are taken while the tree is open and pruned to their retention
+func TestSnapshotSchedules(t *testing.T) {
+	schedules, err := lsmtree.ParseSnapshotSchedules("hourly=24, daily=7,15m=4")
+	if err != nil || len(schedules) != 3 || schedules[1].Every != 24*time.Hour || schedules[2].Every != 15*time.Minute || schedules[2].Keep != 4 {
+		t.Errorf("Unexpected schedules: %+v (%v)", schedules, err)
+	}
+	for _, spec := range []string{"hourly", "hourly=0", "sometimes=3"} {
+		if _, err := lsmtree.ParseSnapshotSchedules(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{
+		Snapshots: []lsmtree.SnapshotSchedule{{Name: "fast", Every: 10 * time.Millisecond, Keep: 2}},
+	})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if err := tree.Set("key", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		snapshots, err := lsmtree.ListSnapshots(dir)
+		if err != nil {
+			t.Fatalf("Failed to list snapshots: %v", err)
+		}
+		if len(snapshots) >= 2 && snapshots[len(snapshots)-1].Taken.After(time.Now().Add(-time.Second)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected snapshots to be taken, got %v", snapshots)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+
+	snapshots, err := lsmtree.ListSnapshots(dir)
+	if err != nil || len(snapshots) != 2 {
+		t.Fatalf("Expected the snapshots to be pruned to 2, got %v (%v)", snapshots, err)
+	}
+	newest := snapshots[1]
+	if newest.Schedule != "fast" || !snapshots[0].Taken.Before(newest.Taken) {
+		t.Errorf("Unexpected snapshots: %+v", snapshots)
+	}
+	snapshot := lsmtree.NewLSMTree(newest.Dir)
+	defer snapshot.Close()
+	if err := snapshot.Recover(); err != nil {
+		t.Fatalf("Failed to open snapshot: %v", err)
+	}
+	if value, _ := snapshot.Get("key"); value != "value" {
+		t.Errorf("Expected the snapshot to hold key=value, got %q", value)
+	}
+}
+
+// TestPauseBackground tests that a paused tree holds flushes until resumed or the pause times out
+func TestPauseBackground(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{MemTableSize: 1})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+
+	if err := tree.PauseBackground(time.Minute); err != nil {
+		t.Fatalf("Failed to pause: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := tree.Set(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if stats := tree.Stats(); !stats.Paused || len(stats.SSTables) != 0 {
+		t.Fatalf("Expected no flushes while paused, got paused=%v with %d SSTables", stats.Paused, len(stats.SSTables))
+	}
+	if value, err := tree.Get("key3"); err != nil || value != "value" {
+		t.Errorf("Expected writes to be readable while paused, got %q (%v)", value, err)
+	}
+
+	tree.ResumeBackground()
+	if stats := tree.Stats(); stats.Paused || len(stats.SSTables) == 0 {
+		t.Fatalf("Expected the memtable to be flushed on resume, got paused=%v with %d SSTables", stats.Paused, len(stats.SSTables))
+	}
+
+	if err := tree.PauseBackground(20 * time.Millisecond); err != nil {
+		t.Fatalf("Failed to pause: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); tree.Paused(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the pause to time out")
+		}
+	}
+}
+
+// TestStatsHistory tests that stats snapshots are recorded while the tree is open,
+// pruned to the newest ones kept, and carried into another tree by an export
+func TestStatsHistory(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{StatsHistory: lsmtree.StatsHistory{Every: 10 * time.Millisecond, Keep: 3}})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	tree.Set("key", "value")
+	// Wait for more snapshots than are kept to have been recorded
+	time.Sleep(100 * time.Millisecond)
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// The history outlives the tree, and stops growing without StatsHistory
+	tree = lsmtree.NewLSMTree(dir)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+	history, err := tree.StatsHistory()
+	if err != nil {
+		t.Fatalf("Failed to read stats history: %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("Expected the newest 3 stats snapshots, got %d", len(history))
+	}
+	for i, snapshot := range history {
+		if i > 0 && !snapshot.Time.After(history[i-1].Time) {
+			t.Errorf("Expected snapshots oldest first, got %v after %v", snapshot.Time, history[i-1].Time)
+		}
+		if snapshot.Stats.KeysEstimate == 0 || snapshot.Stats.SSTables != nil {
+			t.Errorf("Expected a snapshot of the stats without SSTables, got %+v", snapshot.Stats)
+		}
+	}
+
+	var export bytes.Buffer
+	count, err := tree.ExportStatsHistory(&export)
+	if err != nil || count != 3 || bytes.Count(export.Bytes(), []byte("\n")) != count {
+		t.Fatalf("Expected 3 exported snapshots, got %d (%v)", count, err)
+	}
+
+	other := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{})
+	if err := other.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer other.Close()
+	if imported, err := other.ImportStatsHistory(bytes.NewReader(export.Bytes())); err != nil || imported != count {
+		t.Fatalf("Expected %d imported snapshots, got %d (%v)", count, imported, err)
+	}
+	if imported, err := other.ImportStatsHistory(bytes.NewReader(export.Bytes())); err != nil || imported != 0 {
+		t.Errorf("Expected a second import to skip every snapshot, got %d (%v)", imported, err)
+	}
+	if imported, _ := other.StatsHistory(); len(imported) != count || !imported[0].Time.Equal(history[0].Time) {
+		t.Errorf("Expected the imported history to start at %v, got %v", history[0].Time, imported)
+	}
+	if entries, _ := other.List(); len(entries) != 0 {
+		t.Errorf("Expected the history to stay out of the entries, got %v", entries)
+	}
+}
+
+// TestStatsLayout tests that Stats reports the key estimate, disk usage, MemTables
+// and pending compactions consistently with its SSTables
+func TestStatsLayout(t *testing.T) {
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{MemTableSize: 1})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+
+	// While paused every write stays in the MemTable
+	if err := tree.PauseBackground(time.Minute); err != nil {
+		t.Fatalf("Failed to pause: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := tree.Set(key, "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if err := tree.Delete("d"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	stats := tree.Stats()
+	if stats.MemTable.Entries != 4 || stats.KeysEstimate != 4 || len(stats.SSTables) != 0 || stats.Disk.SSTables != 0 {
+		t.Errorf("Expected 4 MemTable entries and no SSTables, got %+v with %d SSTables", stats.MemTable, len(stats.SSTables))
+	}
+	if stats.Disk.WAL == 0 || stats.Disk.Total < stats.Disk.WAL {
+		t.Errorf("Expected the WAL to take disk space, got %+v", stats.Disk)
+	}
+
+	// Once flushed and held again, the figures add up over the SSTables
+	tree.ResumeBackground()
+	for i := 0; i < 5; i++ {
+		if err := tree.Set(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if err := tree.PauseBackground(time.Minute); err != nil {
+		t.Fatalf("Failed to pause: %v", err)
+	}
+	stats = tree.Stats()
+	if len(stats.SSTables) == 0 {
+		t.Fatal("Expected SSTables after resuming")
+	}
+	keys, size, pending := stats.MemTable.Entries, int64(0), 0
+	for i, table := range stats.SSTables {
+		if table.Size <= 0 {
+			t.Errorf("Expected the size of %s, got %d", table.FilePath, table.Size)
+		}
+		keys += table.Properties.Entries - table.Properties.Tombstones
+		size += table.Size
+		if i > 0 {
+			previous := stats.SSTables[i-1].Properties
+			if previous.SmallestKey <= table.Properties.LargestKey && table.Properties.SmallestKey <= previous.LargestKey {
+				pending++
+			}
+		}
+	}
+	if stats.KeysEstimate != keys || stats.KeysEstimate < 8 {
+		t.Errorf("Expected a key estimate of %d, at least the 8 keys set, got %d", keys, stats.KeysEstimate)
+	}
+	if stats.Disk.SSTables != size || stats.Disk.Total < stats.Disk.SSTables+stats.Disk.WAL {
+		t.Errorf("Expected %d bytes of SSTables within the total, got %+v", size, stats.Disk)
+	}
+	if stats.Compaction.Pending != pending {
+		t.Errorf("Expected %d pending compactions, got %d", pending, stats.Compaction.Pending)
+	}
+}
+
+// recordingLogger keeps the messages logged by the engine
+type recordingLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (r *recordingLogger) Debug(msg string, args ...any) { r.record(msg) }
+func (r *recordingLogger) Info(msg string, args ...any)  { r.record(msg) }
+func (r *recordingLogger) Warn(msg string, args ...any)  { r.record(msg) }
+func (r *recordingLogger) Error(msg string, args ...any) { r.record(msg) }
+
+func (r *recordingLogger) record(msg string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.messages = append(r.messages, msg)
+}
+
+func (r *recordingLogger) logged(msg string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, message := range r.messages {
+		if message == msg {
+			return true
+		}
+	}
+	return false
+}
+
+// TestLogger tests that flushes, compactions and recovery are reported to the
+// logger of the options
+func TestLogger(t *testing.T) {
+	dataDir := t.TempDir()
+	logger := &recordingLogger{}
+	tree := lsmtree.NewLSMTreeWithOptions(dataDir, lsmtree.Options{MemTableSize: 1, Logger: logger})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if !logger.logged("recovered") {
+		t.Errorf("Expected recovery to be logged, got %v", logger.messages)
+	}
+	// Overwriting the same keys makes every SSTable overlap the previous one
+	for i := 0; i < 5; i++ {
+		for _, key := range []string{"a", "b"} {
+			if err := tree.Set(key, fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatalf("Failed to set value: %v", err)
+			}
+		}
+	}
+	defer tree.Close()
+	// Compactions run in the background after the flushes
+	for deadline := time.Now().Add(5 * time.Second); !logger.logged("compaction finished") && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	for _, msg := range []string{"flushed memtable", "compaction started", "compaction finished"} {
+		if !logger.logged(msg) {
+			t.Errorf("Expected %q to be logged, got %v", msg, logger.messages)
+		}
+	}
+}
+
+// holdWriterLock makes the next write of key hold the tree's writer lock until
+// the returned function is called
+func holdWriterLock(t *testing.T, tree *lsmtree.LSMTree, key string) func() {
+	held, release := make(chan struct{}), make(chan struct{})
+	unsubscribe := tree.Subscribe(func(change lsmtree.Change) {
+		if change.Key == key {
+			close(held)
+			<-release
+		}
+	})
+	go tree.Set(key, "value")
+	<-held
+	return func() {
+		close(release)
+		unsubscribe()
+	}
+}
+
+// TestContext tests that writes waiting for the writer lock give up when their
+// context is done, while reads don't wait for it
+func TestContext(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+	if err := tree.Set("a", "1"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+
+	release := holdWriterLock(t, tree, "slow")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := tree.SetCtx(ctx, "b", "2"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected SetCtx to time out while the lock is held, got %v", err)
+	}
+	batch := lsmtree.NewWriteBatch()
+	batch.Delete("a")
+	if err := tree.BatchCtx(ctx, batch); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected BatchCtx to time out while the lock is held, got %v", err)
+	}
+	if value, err := tree.GetCtx(context.Background(), "a"); err != nil || value != "1" {
+		t.Errorf("Expected reads not to wait for the lock, got %q, %v", value, err)
+	}
+	release()
+
+	if err := tree.SetCtx(context.Background(), "b", "2"); err != nil {
+		t.Fatalf("Expected SetCtx to succeed once the lock is released, got %v", err)
+	}
+	if value, _ := tree.Get("b"); value != "2" {
+		t.Errorf("Expected b=2, got %q", value)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tree.ScanCtx(cancelled, "", ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected ScanCtx to fail with a cancelled context, got %v", err)
+	}
+	if err := tree.DeleteCtx(cancelled, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected DeleteCtx to fail with a cancelled context, got %v", err)
+	}
+	if value, _ := tree.Get("a"); value != "1" {
+		t.Errorf("Expected a to be kept by the writes given up on, got %q", value)
+	}
+}
+
+// TestWALArchive tests that archived WAL segments bring a backup forward to a point in time
+func TestWALArchive(t *testing.T) {
+	dir, archive := t.TempDir(), t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{MemTableSize: 1, WALArchiveDir: archive})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if err := tree.Set("a", "1"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	backup := filepath.Join(t.TempDir(), "backup")
+	if err := tree.Checkpoint(backup); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	if err := tree.Set("b", "2"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	until := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	if err := tree.Set("c", "3"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := tree.Delete("a"); err != nil {
+		t.Fatalf("Failed to delete value: %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+
+	check := func(until time.Time, expected map[string]string) {
+		t.Helper()
+		restored := t.TempDir()
+		result, err := lsmtree.Restore(restored, backup, lsmtree.RestoreOptions{WALArchive: archive, Until: until})
+		if err != nil {
+			t.Fatalf("Failed to restore: %v", err)
+		}
+		if result.WAL.Replayed == 0 {
+			t.Errorf("Expected archived writes to be replayed, got %+v", result.WAL)
+		}
+		tree := lsmtree.NewLSMTree(restored)
+		if err := tree.Recover(); err != nil {
+			t.Fatalf("Failed to recover: %v", err)
+		}
+		defer tree.Close()
+		for key, want := range expected {
+			if value, err := tree.Get(key); err != nil || value != want {
+				t.Errorf("Expected %s=%q, got %q (%v)", key, want, value, err)
+			}
+		}
+	}
+	check(until, map[string]string{"a": "1", "b": "2", "c": ""})
+	check(time.Time{}, map[string]string{"a": "", "b": "2", "c": "3"})
+
+	// A missing segment in the middle of the archive fails the replay
+	segments, err := filepath.Glob(filepath.Join(archive, "wal-*.log"))
+	if err != nil || len(segments) < 3 {
+		t.Fatalf("Expected archived WAL segments, got %v (%v)", segments, err)
+	}
+	if err := os.Remove(segments[len(segments)-2]); err != nil {
+		t.Fatalf("Failed to remove segment: %v", err)
+	}
+	if _, err := lsmtree.Restore(t.TempDir(), backup, lsmtree.RestoreOptions{WALArchive: archive}); err == nil || !strings.Contains(err.Error(), "missing segment") {
+		t.Errorf("Expected a missing segment error, got %v", err)
+	}
+}
+
+// TestExport tests that every export format round-trips the live entries under a prefix
+func TestExport(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+
+	expected := map[string]string{"app/a": "plain", "app/b": "with, comma and \"quotes\"", "app/c": "multi\nline"}
+	for key, value := range expected {
+		if err := tree.Set(key, value); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	tree.Set("app/deleted", "value")
+	tree.Delete("app/deleted")
+	tree.Set("other", "value")
+
+	export := func(format lsmtree.ExportFormat) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		count, err := lsmtree.ExportStore(tree, &buf, format, "app/")
+		if err != nil || count != len(expected) {
+			t.Fatalf("Expected %d entries exported as %s, got %d (%v)", len(expected), format, count, err)
+		}
+		return buf.Bytes()
+	}
+	check := func(format lsmtree.ExportFormat, entries []map[string]string) {
+		t.Helper()
+		got := make(map[string]string)
+		for _, e := range entries {
+			got[e["key"]] = e["value"]
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("Expected %v exported as %s, got %v", expected, format, got)
+		}
+	}
+
+	var entries []map[string]string
+	if err := json.Unmarshal(export(lsmtree.ExportJSON), &entries); err != nil {
+		t.Fatalf("Failed to parse JSON export: %v", err)
+	}
+	check(lsmtree.ExportJSON, entries)
+
+	entries = nil
+	for _, line := range strings.Split(strings.TrimSuffix(string(export(lsmtree.ExportNDJSON)), "\n"), "\n") {
+		var e map[string]string
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Failed to parse NDJSON line %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	check(lsmtree.ExportNDJSON, entries)
+
+	rows, err := csv.NewReader(bytes.NewReader(export(lsmtree.ExportCSV))).ReadAll()
+	if err != nil || len(rows) == 0 || rows[0][0] != "key" || rows[0][1] != "value" {
+		t.Fatalf("Expected a CSV export with a header, got %v (%v)", rows, err)
+	}
+	entries = nil
+	for _, row := range rows[1:] {
+		entries = append(entries, map[string]string{"key": row[0], "value": row[1]})
+	}
+	check(lsmtree.ExportCSV, entries)
+
+	var buf bytes.Buffer
+	if _, err := lsmtree.ExportStore(tree, &buf, lsmtree.ExportJSON, "missing/"); err != nil || buf.String() != "[]\n" {
+		t.Errorf("Expected an empty JSON array, got %q (%v)", buf.String(), err)
+	}
+	if _, err := lsmtree.ParseExportFormat("xml"); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+}
+
+// batchCounter counts the batches written to a store
+type batchCounter struct {
+	lsmtree.Store
+	batches int
+}
+
+func (b *batchCounter) Batch(batch *lsmtree.WriteBatch) error {
+	b.batches++
+	return b.Store.Batch(batch)
+}
+
+// TestImport tests that exports import in batches under each conflict policy and that a failed import resumes
+func TestImport(t *testing.T) {
+	source := lsmtree.NewLSMTree(t.TempDir())
+	if err := source.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer source.Close()
+	for i := 0; i < 5; i++ {
+		source.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value, %d", i))
+	}
+
+	for _, format := range []lsmtree.ExportFormat{lsmtree.ExportJSON, lsmtree.ExportCSV, lsmtree.ExportNDJSON} {
+		var buf bytes.Buffer
+		if err := source.Export(&buf, format); err != nil {
+			t.Fatalf("Failed to export %s: %v", format, err)
+		}
+		tree := lsmtree.NewLSMTree(t.TempDir())
+		if err := tree.Recover(); err != nil {
+			t.Fatalf("Failed to recover: %v", err)
+		}
+		store := &batchCounter{Store: tree}
+		result, err := lsmtree.Import(store, bytes.NewReader(buf.Bytes()), lsmtree.ImportOptions{Format: format, BatchSize: 2})
+		if err != nil || result.Written != 5 || result.Committed != 5 || store.batches != 3 {
+			t.Errorf("Expected 5 entries imported from %s in 3 batches, got %+v in %d batches (%v)", format, result, store.batches, err)
+		}
+		if value, _ := tree.Get("key3"); value != "value, 3" {
+			t.Errorf("Expected key3 imported from %s, got %q", format, value)
+		}
+		tree.Close()
+	}
+
+	var buf bytes.Buffer
+	if err := source.Export(&buf, lsmtree.ExportNDJSON); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	input := buf.Bytes()
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+	tree.Set("key3", "existing")
+
+	options := lsmtree.ImportOptions{Format: lsmtree.ExportNDJSON, OnConflict: lsmtree.ConflictFail, BatchSize: 2}
+	result, err := lsmtree.Import(tree, bytes.NewReader(input), options)
+	if !errors.Is(err, lsmtree.ErrImportConflict) || result.Committed != 2 || result.Written != 2 {
+		t.Fatalf("Expected a conflict after the first batch, got %+v (%v)", result, err)
+	}
+	if value, _ := tree.Get("key2"); value != "" {
+		t.Errorf("Expected the batch with the conflict not to be written, got key2=%q", value)
+	}
+
+	options.OnConflict, options.ResumeFrom = lsmtree.ConflictSkip, result.Committed
+	result, err = lsmtree.Import(tree, bytes.NewReader(input), options)
+	if err != nil || result.Written != 2 || result.Skipped != 1 {
+		t.Fatalf("Expected the resumed import to write 2 entries and skip 1, got %+v (%v)", result, err)
+	}
+	if value, _ := tree.Get("key3"); value != "existing" {
+		t.Errorf("Expected the existing value to be kept, got %q", value)
+	}
+
+	options.OnConflict, options.ResumeFrom = lsmtree.ConflictOverwrite, 0
+	if _, err := lsmtree.Import(tree, bytes.NewReader(input), options); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if value, _ := tree.Get("key3"); value != "value, 3" {
+		t.Errorf("Expected the existing value to be overwritten, got %q", value)
+	}
+}
+
+// TestAccessTracking tests that reads are counted, saved on close and used to find stale keys
+func TestAccessTracking(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{TrackAccess: true})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	for _, key := range []string{"used", "unused", "deleted"} {
+		tree.Set(key, "value")
+	}
+	tree.Get("used")
+	tree.Get("used")
+	tree.Get("deleted")
+	tree.Delete("deleted")
+	if stats, ok := tree.AccessStats("used"); !ok || stats.Reads != 2 || time.Since(stats.LastRead) > time.Minute {
+		t.Errorf("Expected 2 recent reads of used, got %+v", stats)
+	}
+	if _, ok := tree.AccessStats("deleted"); ok {
+		t.Error("Expected the statistics of a deleted key to be dropped")
+	}
+	if stale, since, err := tree.StaleKeys(time.Hour); err != nil || len(stale) != 0 || since.IsZero() {
+		t.Errorf("Expected no stale keys right after tracking started, got %v since %v (%v)", stale, since, err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close tree: %v", err)
+	}
+
+	// Pretend tracking started two days ago
+	path := filepath.Join(dir, "access.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected the statistics to be saved on close: %v", err)
+	}
+	var file map[string]json.RawMessage
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("Failed to parse statistics: %v", err)
+	}
+	file["since"], _ = json.Marshal(time.Now().Add(-48 * time.Hour))
+	data, _ = json.Marshal(file)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write statistics: %v", err)
+	}
+
+	// Statistics are loaded even with tracking off
+	tree = lsmtree.NewLSMTree(dir)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+	stale, _, err := tree.StaleKeys(24 * time.Hour)
+	if err != nil || len(stale) != 1 || stale[0].Key != "unused" || stale[0].Reads != 0 {
+		t.Errorf("Expected only unused to be stale, got %+v (%v)", stale, err)
+	}
+	tree.Get("unused")
+	if _, ok := tree.AccessStats("unused"); ok {
+		t.Error("Expected reads not to be recorded with tracking off")
+	}
+}
+
+// TestPrefixScan tests that prefix scans return exactly the keys with the prefix
+func TestPrefixScan(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+
+	for _, key := range []string{"db", "db/a", "db/b", "db0", "dc", "\xff\xff", "\xff\xffa"} {
+		if err := tree.Set(key, "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	for prefix, expected := range map[string][]string{
+		"db/":      {"db/a", "db/b"},
+		"db":       {"db", "db/a", "db/b", "db0"},
+		"\xff\xff": {"\xff\xff", "\xff\xffa"},
+		"x":        nil,
+	} {
+		it, err := lsmtree.PrefixScan(tree, prefix)
+		if err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		it.Close()
+		if strings.Join(keys, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected %q for prefix %q, got %q", expected, prefix, keys)
+		}
+	}
+}
+
+// TestScanReadsBounded tests that a scan reads the SSTable blocks from its start
+// only as far as it's advanced, so reading one page of a listing costs the same
+// wherever the page is
+func TestScanReadsBounded(t *testing.T) {
+	dir := t.TempDir()
+	options := lsmtree.Options{BlockSize: 256}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%04d", i), "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if _, err := tree.Reclaim(); err != nil {
+		t.Fatalf("Failed to reclaim: %v", err)
+	}
+	// A tombstone in the MemTable shadows the flushed entry
+	if err := tree.Delete("key-1502"); err != nil {
+		t.Fatalf("Failed to delete key: %v", err)
+	}
+	tree.Close()
+
+	tree = lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover tree: %v", err)
+	}
+	defer tree.Close()
+	blockReads := func() uint64 {
+		stats := tree.Stats().BlockCache
+		return stats.Hits + stats.Misses
+	}
+
+	// Read one page of 10 entries and one past it, as a listing does
+	for _, start := range []string{"key-0000", "key-1500", "key-1995"} {
+		before := blockReads()
+		it, err := tree.Scan(start, "")
+		if err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		var keys []string
+		for len(keys) < 11 && it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("Failed to scan: %v", err)
+		}
+		it.Close()
+		if reads := blockReads() - before; reads > 3 {
+			t.Errorf("Expected a page from %s to read at most 3 blocks, got %d", start, reads)
+		}
+		if start == "key-1500" && strings.Join(keys[:4], ",") != "key-1500,key-1501,key-1503,key-1504" {
+			t.Errorf("Expected the page to skip the deleted key, got %v", keys)
+		}
+		if start == "key-1995" && len(keys) != 5 {
+			t.Errorf("Expected the last 5 keys, got %v", keys)
+		}
+	}
+
+	before := blockReads()
+	entries, err := tree.List()
+	if err != nil {
+		t.Fatalf("Failed to list entries: %v", err)
+	}
+	if len(entries) != 1999 {
+		t.Errorf("Expected 1999 entries, got %d", len(entries))
+	}
+	if reads := blockReads() - before; reads < 50 {
+		t.Errorf("Expected listing everything to read every block, got %d", reads)
+	}
+}
+
+// TestEncryption tests that an encrypted data directory keeps no plaintext on disk and opens only with its master password
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{MemTableSize: 256})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := tree.Set(fmt.Sprintf("flushed-%02d", i), "hunter2-flushed"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	tree.Set("logged", "hunter2-logged")
+	tree.Delete("flushed-00")
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	if err := lsmtree.EnableEncryption(dir, "correct horse"); err != nil {
+		t.Fatalf("Failed to enable encryption: %v", err)
+	}
+	files, _ := os.ReadDir(dir)
+	for _, file := range files {
+		data, _ := os.ReadFile(filepath.Join(dir, file.Name()))
+		if bytes.Contains(data, []byte("hunter2")) || bytes.Contains(data, []byte("flushed-")) {
+			t.Errorf("Expected no plaintext in %s", file.Name())
+		}
+	}
+
+	if err := lsmtree.NewLSMTree(dir).Recover(); !errors.Is(err, lsmtree.ErrEncrypted) {
+		t.Fatalf("Expected ErrEncrypted without a key, got %v", err)
+	}
+	if _, err := lsmtree.UnlockEncryption(dir, "wrong"); !errors.Is(err, lsmtree.ErrWrongPassword) {
+		t.Fatalf("Expected ErrWrongPassword, got %v", err)
+	}
+	key, err := lsmtree.UnlockEncryption(dir, "correct horse")
+	if err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+
+	tree = lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{EncryptionKey: key})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover encrypted tree: %v", err)
+	}
+	if err := tree.Set("after", "hunter2-after"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	tree.Close()
+
+	if err := lsmtree.ChangeEncryptionPassword(dir, "correct horse", "battery staple"); err != nil {
+		t.Fatalf("Failed to change password: %v", err)
+	}
+	if _, err := lsmtree.UnlockEncryption(dir, "correct horse"); !errors.Is(err, lsmtree.ErrWrongPassword) {
+		t.Errorf("Expected the old password to be rejected, got %v", err)
+	}
+	if key, err = lsmtree.UnlockEncryption(dir, "battery staple"); err != nil {
+		t.Fatalf("Failed to unlock with the new password: %v", err)
+	}
+
+	tree = lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{EncryptionKey: key})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover encrypted tree: %v", err)
+	}
+	defer tree.Close()
+	entries, err := tree.List()
+	if err != nil {
+		t.Fatalf("Failed to list entries: %v", err)
+	}
+	if len(entries) != 21 || entries["logged"] != "hunter2-logged" || entries["after"] != "hunter2-after" || entries["flushed-00"] != "" {
+		t.Errorf("Unexpected entries after encrypting: %v", entries)
+	}
+	if report, err := lsmtree.VerifyDirWithKey(dir, key); err != nil || len(report.Corruptions) > 0 {
+		t.Errorf("Expected the encrypted directory to verify, got %v, %v", report.Corruptions, err)
+	}
+}
+
+func TestEncryptionBindsPositions(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTree(dir)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	tree.Close()
+	if err := lsmtree.EnableEncryption(dir, "correct horse"); err != nil {
+		t.Fatalf("Failed to enable encryption: %v", err)
+	}
+	key, err := lsmtree.UnlockEncryption(dir, "correct horse")
+	if err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+
+	options := lsmtree.Options{MemTableSize: 256, EncryptionKey: key}
+	tree = lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover encrypted tree: %v", err)
+	}
+	for i := 0; i < 40; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%02d", i), "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	// With room in the MemTable, the last writes stay in the WAL
+	options.MemTableSize = 0
+	tree = lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover encrypted tree: %v", err)
+	}
+	tree.Set("logged-a", "1")
+	tree.Set("logged-b", "2")
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// Records copied into another segment don't decrypt there
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(segments) == 0 {
+		t.Fatal("Expected a WAL segment")
+	}
+	data, _ := os.ReadFile(segments[len(segments)-1])
+	copied := filepath.Join(dir, "wal-999999.log")
+	os.WriteFile(copied, data, 0644)
+	var corruption *lsmtree.ErrCorruption
+	if err := lsmtree.NewLSMTreeWithOptions(dir, options).Recover(); !errors.As(err, &corruption) || corruption.File != copied {
+		t.Fatalf("Expected the copied segment to be corrupt, got %v", err)
+	}
+	os.Remove(copied)
+
+	// Neither do blocks copied into another SSTable
+	tables, _ := filepath.Glob(filepath.Join(dir, "sstable_*.dat"))
+	if len(tables) < 2 {
+		t.Fatalf("Expected at least 2 SSTables, got %d", len(tables))
+	}
+	data, _ = os.ReadFile(tables[0])
+	os.WriteFile(tables[1], data, 0644)
+	if report, err := lsmtree.VerifyDirWithKey(dir, key); err == nil && len(report.Corruptions) == 0 {
+		t.Error("Expected the copied SSTable to be corrupt")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{MemTableSize: 256})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		tree.Set(fmt.Sprintf("key-%02d", i), "value")
+	}
+	tree.Close()
+	if err := lsmtree.EnableEncryption(dir, "old"); err != nil {
+		t.Fatalf("Failed to enable encryption: %v", err)
+	}
+	oldKey, _ := lsmtree.UnlockEncryption(dir, "old")
+
+	tree = lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{EncryptionKey: oldKey})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover encrypted tree: %v", err)
+	}
+	backup := filepath.Join(t.TempDir(), "backup")
+	if err := tree.Checkpoint(backup); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	tree.Set("logged", "before")
+	if err := tree.Rekey("wrong", "new"); !errors.Is(err, lsmtree.ErrWrongPassword) {
+		t.Fatalf("Expected ErrWrongPassword, got %v", err)
+	}
+	if err := tree.Rekey("old", "new"); err != nil {
+		t.Fatalf("Failed to rekey: %v", err)
+	}
+	if err := tree.Set("after", "rekeyed"); err != nil {
+		t.Fatalf("Failed to set value after rekeying: %v", err)
+	}
+	if value, _ := tree.Get("key-03"); value != "value" {
+		t.Errorf("Expected key-03 to read back after rekeying, got %q", value)
+	}
+	tree.Close()
+
+	newKey, err := lsmtree.UnlockEncryption(dir, "new")
+	if err != nil {
+		t.Fatalf("Failed to unlock with the new password: %v", err)
+	}
+	if bytes.Equal(newKey, oldKey) {
+		t.Fatal("Expected a new data key")
+	}
+	if err := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{EncryptionKey: oldKey}).Recover(); err == nil {
+		t.Error("Expected the old key to be rejected")
+	}
+	if report, err := lsmtree.VerifyDirWithKey(dir, newKey); err != nil || len(report.Corruptions) > 0 {
+		t.Errorf("Expected the rekeyed directory to verify, got %v, %v", report.Corruptions, err)
+	}
+
+	tree = lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{EncryptionKey: newKey})
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover rekeyed tree: %v", err)
+	}
+	entries, err := tree.List()
+	tree.Close()
+	if err != nil || len(entries) != 22 || entries["logged"] != "before" || entries["after"] != "rekeyed" {
+		t.Errorf("Unexpected entries after rekeying: %v, %v", entries, err)
+	}
+
+	// A backup taken before keeps the old key
+	result, err := lsmtree.Restore(dir, backup, lsmtree.RestoreOptions{Merge: true, EncryptionKey: newKey, BackupEncryptionKey: oldKey})
+	if err != nil || result.EntriesMerged != 20 {
+		t.Errorf("Expected the old backup to merge with its own key, got %d entries, %v", result.EntriesMerged, err)
+	}
+}
+
+// TestVersions tests that past values are kept out of listings, found by number and time, and pruned by compaction
+func TestVersions(t *testing.T) {
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{MemTableSize: 1, Versions: lsmtree.VersionRetention{Keep: 2}})
+	defer tree.Close()
+
+	var changes []string
+	unsubscribe := tree.Subscribe(func(change lsmtree.Change) { changes = append(changes, change.Key) })
+	defer unsubscribe()
+	for _, value := range []string{"v1", "v2", "", "v4", "v5"} {
+		var err error
+		if value == "" {
+			err = tree.Delete("key")
+		} else {
+			err = tree.Set("key", value)
+		}
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if len(changes) != 5 {
+		t.Errorf("Expected the change feed to carry the 5 writes alone, got %q", changes)
+	}
+	if entries, err := tree.List(); err != nil || len(entries) != 1 || entries["key"] != "v5" {
+		t.Errorf("Expected List to show the current value alone, got %v, %v", entries, err)
+	}
+	if err := tree.Set("\x00version\x00key\x000000000000000001", "x"); !errors.Is(err, lsmtree.ErrReservedKey) {
+		t.Errorf("Expected ErrReservedKey, got %v", err)
+	}
+
+	// Every flush triggers a compaction; once they're done the versions past the newest 2 are gone
+	for deadline := time.Now().Add(5 * time.Second); len(tree.Stats().SSTables) > 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected compactions to merge the SSTables, got %d", len(tree.Stats().SSTables))
+		}
+	}
+	versions, err := tree.Versions("key")
+	if err != nil {
+		t.Fatalf("Failed to read versions: %v", err)
+	}
+	if len(versions) != 2 || versions[0].Number != 4 || versions[0].Value != "v4" || versions[1].Value != "v5" {
+		t.Fatalf("Expected versions 4 and 5 to be kept, got %+v", versions)
+	}
+	if version, ok := lsmtree.VersionAt(versions, versions[0].Time); !ok || version.Number != 4 {
+		t.Errorf("Expected version 4 at its own time, got %+v", version)
+	}
+	if _, ok := lsmtree.VersionAt(versions, versions[0].Time.Add(-time.Second)); ok {
+		t.Error("Expected no version before the oldest kept")
+	}
+
+	if err := tree.Delete("key"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if versions, _ := tree.Versions("key"); len(versions) != 3 || !versions[2].Deleted || versions[2].Number != 6 {
+		t.Errorf("Expected the deletion as version 6, got %+v", versions)
+	}
+	if err := tree.ForgetVersions("k"); err != nil {
+		t.Fatalf("Failed to forget versions: %v", err)
+	}
+	if versions, _ := tree.Versions("key"); len(versions) != 0 {
+		t.Errorf("Expected no versions after forgetting them, got %+v", versions)
+	}
+}
+
+// TestReclaim tests that Reclaim rewrites the SSTables without the deleted keys
+// and the versions past retention
+func TestReclaim(t *testing.T) {
+	dir := t.TempDir()
+	options := lsmtree.Options{MemTableSize: 2048, Versions: lsmtree.VersionRetention{Keep: 2}}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	defer tree.Close()
+	for i := 0; i < 200; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	for i := 0; i < 150; i++ {
+		if err := tree.Delete(fmt.Sprintf("key-%03d", i)); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+	}
+	for _, value := range []string{"v1", "v2", "v3"} {
+		if err := tree.Set("key-199", value); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+
+	result, err := tree.Reclaim()
+	if err != nil {
+		t.Fatalf("Failed to reclaim: %v", err)
+	}
+	if result.TablesAfter != 1 || result.Reclaimed() <= 0 || result.EntriesAfter >= result.EntriesBefore {
+		t.Errorf("Expected the SSTables rewritten into a smaller one, got %+v", result)
+	}
+	if stats := tree.Stats(); len(stats.SSTables) != 1 || stats.SSTables[0].Properties.Tombstones != 0 || stats.MemTable.Entries != 0 {
+		t.Errorf("Expected a single SSTable without tombstones, got %+v", stats.SSTables)
+	}
+	entries, err := tree.List()
+	if err != nil || len(entries) != 50 || entries["key-199"] != "v3" || entries["key-150"] != "value-150" {
+		t.Errorf("Expected the 50 keys left, got %d, %v", len(entries), err)
+	}
+	if versions, err := tree.Versions("key-199"); err != nil || len(versions) != 2 || versions[0].Value != "v2" {
+		t.Errorf("Expected the 2 newest versions kept, got %+v, %v", versions, err)
+	}
+
+	if err := tree.PauseBackground(time.Minute); err != nil {
+		t.Fatalf("Failed to pause: %v", err)
+	}
+	if _, err := tree.Reclaim(); !errors.Is(err, lsmtree.ErrPaused) {
+		t.Errorf("Expected ErrPaused while paused, got %v", err)
+	}
+	tree.ResumeBackground()
+	tree.Close()
+
+	reopened := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := reopened.Recover(); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer reopened.Close()
+	if value, err := reopened.Get("key-149"); err != nil || value != "" {
+		t.Errorf("Expected key-149 to stay deleted, got %q (%v)", value, err)
+	}
+	if value, err := reopened.Get("key-199"); err != nil || value != "v3" {
+		t.Errorf("Expected key-199=v3 after reopening, got %q (%v)", value, err)
+	}
+}
+
+// TestInMemory tests that an in-memory tree works past its MemTable size without writing a file, and keeps nothing after Close
+func TestInMemory(t *testing.T) {
+	dir := t.TempDir()
+	options := lsmtree.Options{MemTableSize: 1024, InMemory: true, Versions: lsmtree.VersionRetention{Keep: 2}}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if err := tree.Delete("key-000"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if err := tree.Set("key-001", "changed"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := tree.Pin("key-002"); err != nil {
+		t.Fatalf("Failed to pin: %v", err)
+	}
+
+	entries, err := tree.List()
+	if err != nil || len(entries) != 499 || entries["key-001"] != "changed" || entries["key-499"] != "value-499" {
+		t.Errorf("Expected 499 entries, got %d (%v)", len(entries), err)
+	}
+	if versions, err := tree.Versions("key-001"); err != nil || len(versions) != 2 || versions[0].Value != "value-1" {
+		t.Errorf("Expected the versions of key-001 kept, got %+v (%v)", versions, err)
+	}
+	if stats := tree.Stats(); len(stats.SSTables) != 0 || stats.Disk.Total != 0 {
+		t.Errorf("Expected no SSTables nor disk usage, got %+v", stats)
+	}
+	if err := tree.Checkpoint(filepath.Join(dir, "checkpoint")); !errors.Is(err, lsmtree.ErrInMemory) || !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Expected Checkpoint to be unsupported, got %v", err)
+	}
+	if _, err := tree.Reclaim(); !errors.Is(err, lsmtree.ErrInMemory) {
+		t.Errorf("Expected Reclaim to be unsupported, got %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected no files in the data directory, got %v", files)
+	}
+
+	reopened := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := reopened.Recover(); err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer reopened.Close()
+	if value, err := reopened.Get("key-499"); err != nil || value != "" {
+		t.Errorf("Expected a new in-memory tree to be empty, got %q (%v)", value, err)
+	}
+}
+
+// TestMemFS tests that a tree on a MemFS flushes, reopens and checkpoints without touching the disk
+func TestMemFS(t *testing.T) {
+	dir := t.TempDir()
+	fsys := lsmtree.NewMemFS()
+	options := lsmtree.Options{MemTableSize: 1024, FS: fsys}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if err := tree.Delete("key-000"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if err := tree.Pin("key-002"); err != nil {
+		t.Fatalf("Failed to pin: %v", err)
+	}
+	if stats := tree.Stats(); len(stats.SSTables) == 0 || stats.Disk.Total == 0 {
+		t.Errorf("Expected SSTables on the MemFS, got %+v", stats)
+	}
+	if err := tree.Checkpoint(filepath.Join(dir, "checkpoint")); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected no files in the OS data directory, got %v", files)
+	}
+	if _, err := fsys.Stat(filepath.Join(dir, "MANIFEST")); err != nil {
+		t.Errorf("Expected a manifest on the MemFS: %v", err)
+	}
+
+	for _, reopenDir := range []string{dir, filepath.Join(dir, "checkpoint")} {
+		reopened := lsmtree.NewLSMTreeWithOptions(reopenDir, options)
+		if err := reopened.Recover(); err != nil {
+			t.Fatalf("Failed to reopen %s: %v", reopenDir, err)
+		}
+		entries, err := reopened.List()
+		if err != nil || len(entries) != 499 || entries["key-499"] != "value-499" || entries["key-000"] != "" {
+			t.Errorf("Expected 499 entries in %s, got %d (%v)", reopenDir, len(entries), err)
+		}
+		if err := reopened.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+	}
+}
+
+// TestRecords tests that internal records are kept apart from the keys and survive a restart
+func TestRecords(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTree(dir)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	if err := tree.SetRecord("app/a", "1"); err != nil {
+		t.Fatalf("Failed to set record: %v", err)
+	}
+	if err := tree.SetRecord("app/b", "2"); err != nil {
+		t.Fatalf("Failed to set record: %v", err)
+	}
+	if err := tree.SetRecord("app/b", ""); err != nil {
+		t.Fatalf("Failed to remove record: %v", err)
+	}
+	if err := tree.Set("key", "value"); err != nil {
+		t.Fatalf("Failed to set key: %v", err)
+	}
+	if entries, err := tree.List(); err != nil || len(entries) != 1 {
+		t.Errorf("Expected List to leave records out, got %v, %v", entries, err)
+	}
+	if value, err := tree.Get("\x00record\x00app/a"); err != nil || value != "" {
+		t.Errorf("Expected Get to leave records out, got %q, %v", value, err)
+	}
+	if err := tree.Set("\x00record\x00app/a", "x"); !errors.Is(err, lsmtree.ErrReservedKey) {
+		t.Errorf("Expected ErrReservedKey, got %v", err)
+	}
+	tree.Close()
+
+	tree = lsmtree.NewLSMTree(dir)
+	defer tree.Close()
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to reopen tree: %v", err)
+	}
+	records, err := tree.Records("app/")
+	if err != nil || len(records) != 1 || records["app/a"] != "1" {
+		t.Errorf("Expected app/a alone after a restart, got %v, %v", records, err)
+	}
+	if value, _ := tree.Record("app/a"); value != "1" {
+		t.Errorf("Expected app/a to be 1, got %q", value)
+	}
+}
+
+// TestWatch tests that a watch reports the writes to its prefix with their old
+// values in order, and that its channel is closed when the tree is
+func TestWatch(t *testing.T) {
+	tree := lsmtree.NewLSMTree(t.TempDir())
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	if err := tree.Set("app/a", "1"); err != nil {
+		t.Fatalf("Failed to set key: %v", err)
+	}
+	events, stop, err := tree.Watch("app/")
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer stop()
+
+	batch := lsmtree.NewWriteBatch()
+	batch.Set("app/a", "2")
+	batch.Set("other", "x")
+	batch.Delete("app/a")
+	if err := tree.Batch(batch); err != nil {
+		t.Fatalf("Failed to apply batch: %v", err)
+	}
+	if err := tree.SetRecord("app/record", "r"); err != nil {
+		t.Fatalf("Failed to set record: %v", err)
+	}
+	set, deleted := <-events, <-events
+	if set.Type != lsmtree.EventSet || set.Key != "app/a" || set.OldValue != "1" || set.NewValue != "2" {
+		t.Errorf("Expected app/a set from 1 to 2, got %+v", set)
+	}
+	if deleted.Type != lsmtree.EventDelete || deleted.OldValue != "2" || deleted.NewValue != "" || deleted.Seq <= set.Seq {
+		t.Errorf("Expected app/a deleted after the set, got %+v", deleted)
+	}
+
+	tree.Close()
+	if event, ok := <-events; ok {
+		t.Errorf("Expected the channel to close with the tree, got %+v", event)
+	}
+	if _, _, err := tree.Watch(""); !errors.Is(err, lsmtree.ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+// TestReadChanges tests that the changes read from the WAL keep their sequence
+// numbers across restarts, resume after one, and come from the archive once flushed
+func TestReadChanges(t *testing.T) {
+	dir := t.TempDir()
+	options := lsmtree.Options{MemTableSize: 1 << 20, WALSegmentSize: 256}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := tree.Set(fmt.Sprintf("key%d", i), strings.Repeat("v", 50)); err != nil {
+			t.Fatalf("Failed to set key: %v", err)
+		}
+	}
+	if err := tree.Delete("key3"); err != nil {
+		t.Fatalf("Failed to delete key: %v", err)
+	}
+	read := func(tree *lsmtree.LSMTree, since uint64) ([]lsmtree.WALChange, uint64, error) {
+		var changes []lsmtree.WALChange
+		next, err := tree.ReadChanges(since, func(change lsmtree.WALChange) error {
+			changes = append(changes, change)
+			return nil
+		})
+		return changes, next, err
+	}
+	changes, _, err := read(tree, 0)
+	if err != nil || len(changes) != 11 {
+		t.Fatalf("Expected 11 changes, got %d, %v", len(changes), err)
+	}
+	for i := 1; i < len(changes); i++ {
+		if changes[i].Seq <= changes[i-1].Seq {
+			t.Fatalf("Expected growing sequence numbers, got %d after %d", changes[i].Seq, changes[i-1].Seq)
+		}
+	}
+	if last := changes[10]; last.Type != lsmtree.EventDelete || last.Key != "key3" || last.Time.IsZero() {
+		t.Errorf("Expected the dated delete of key3 last, got %+v", last)
+	}
+	rest, _, err := read(tree, changes[7].Seq)
+	if err != nil || len(rest) != 3 || rest[0].Seq != changes[8].Seq {
+		t.Errorf("Expected the 3 changes after the 8th, got %+v, %v", rest, err)
+	}
+	tree.Close()
+
+	tree = lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to reopen tree: %v", err)
+	}
+	if reread, _, err := read(tree, 0); err != nil || !reflect.DeepEqual(reread, changes) {
+		t.Errorf("Expected the same changes after a restart, got %+v, %v", reread, err)
+	}
+	tree.Close()
+
+	// Without an archive, flushed changes are gone; with one, they're read from it
+	archive := filepath.Join(t.TempDir(), "archive")
+	for _, archiveDir := range []string{"", archive} {
+		tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{MemTableSize: 1, WALArchiveDir: archiveDir})
+		if err := tree.Recover(); err != nil {
+			t.Fatalf("Failed to open tree: %v", err)
+		}
+		if err := tree.Set("a", "1"); err != nil {
+			t.Fatalf("Failed to set key: %v", err)
+		}
+		_, next, err := read(tree, 0)
+		if err != nil {
+			t.Fatalf("Failed to read changes: %v", err)
+		}
+		tree.Set("b", "2")
+		tree.Set("c", "3")
+		changes, _, err := read(tree, next)
+		if archiveDir == "" && !errors.Is(err, lsmtree.ErrChangesGone) {
+			t.Errorf("Expected ErrChangesGone without an archive, got %+v, %v", changes, err)
+		}
+		if archiveDir != "" && (err != nil || len(changes) != 2 || changes[0].Key != "b") {
+			t.Errorf("Expected b and c from the archive, got %+v, %v", changes, err)
+		}
+		tree.Close()
+	}
+}
+
+// TestApplyChanges tests that a read-only tree refuses writes but takes the
+// changes of another tree, and that a caught-up reader survives a flush
+func TestApplyChanges(t *testing.T) {
+	leader := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{MemTableSize: 1 << 20})
+	if err := leader.Recover(); err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	defer leader.Close()
+	follower := lsmtree.NewLSMTreeWithOptions(t.TempDir(), lsmtree.Options{MemTableSize: 1 << 20})
+	if err := follower.Recover(); err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	defer follower.Close()
+
+	leader.Set("a", "1")
+	leader.Set("b", "2")
+	leader.Delete("a")
+	var changes []lsmtree.WALChange
+	next, err := leader.ReadChanges(0, func(change lsmtree.WALChange) error {
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil || next != leader.ChangesHead() {
+		t.Fatalf("Expected to read up to the head %d, got %d, %v", leader.ChangesHead(), next, err)
+	}
+
+	follower.SetReadOnly(true)
+	if err := follower.Set("c", "3"); !errors.Is(err, lsmtree.ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly for a set, got %v", err)
+	}
+	batch := lsmtree.NewWriteBatch()
+	batch.Delete("b")
+	if err := follower.Batch(batch); !errors.Is(err, lsmtree.ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly for a batch, got %v", err)
+	}
+	if err := follower.ApplyChanges(changes); err != nil {
+		t.Fatalf("Failed to apply changes: %v", err)
+	}
+	if entries, _ := follower.List(); len(entries) != 1 || entries["b"] != "2" {
+		t.Errorf("Expected b alone after applying the changes, got %v", entries)
+	}
+	if err := follower.SetRecord("position", "1"); err != nil {
+		t.Errorf("Expected records to be written to a read-only tree, got %v", err)
+	}
+
+	// A flush with no write since the last read leaves nothing to miss
+	if err := leader.Checkpoint(filepath.Join(t.TempDir(), "checkpoint")); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	if next, err = leader.ReadChanges(next, func(lsmtree.WALChange) error { return nil }); err != nil {
+		t.Errorf("Expected to resume after the flush, got %v", err)
+	}
+	leader.Set("c", "3")
+	if err := leader.Checkpoint(filepath.Join(t.TempDir(), "checkpoint")); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	if _, err := leader.ReadChanges(next, func(lsmtree.WALChange) error { return nil }); !errors.Is(err, lsmtree.ErrChangesGone) {
+		t.Errorf("Expected ErrChangesGone once a write was flushed unread, got %v", err)
+	}
+	if _, err := leader.ReadChanges(leader.ChangesHead()+1, func(lsmtree.WALChange) error { return nil }); !errors.Is(err, lsmtree.ErrChangesGone) {
+		t.Errorf("Expected ErrChangesGone past the head, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package memcache_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"Lockr/bin/lockrtest"
+	"Lockr/bin/memcache"
+)
+
+// TestMemcache tests set, get, touch and delete over the text protocol, with
+// items kept under the prefix
+func TestMemcache(t *testing.T) {
+	store := lockrtest.NewFake()
+	listener, err := memcache.New(store, "mc/").Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// send writes a command and returns the reply up to its last line
+	send := func(command, last string) string {
+		t.Helper()
+		fmt.Fprint(conn, command)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var reply strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read reply to %q: %v", command, err)
+			}
+			reply.WriteString(line)
+			if strings.TrimSpace(line) == last || strings.HasSuffix(strings.TrimSpace(line), "ERROR") || strings.HasPrefix(line, "CLIENT_ERROR") {
+				return reply.String()
+			}
+		}
+	}
+
+	if reply := send("set greeting 42 0 5\r\nhello\r\n", "STORED"); reply != "STORED\r\n" {
+		t.Errorf("Expected STORED, got %q", reply)
+	}
+	if reply := send("set empty 0 0 0\r\n\r\n", "STORED"); reply != "STORED\r\n" {
+		t.Errorf("Expected STORED for empty data, got %q", reply)
+	}
+	if value, _ := store.Get("greeting"); value != "" {
+		t.Errorf("Expected items to stay under the prefix, got greeting=%q", value)
+	}
+	want := "VALUE greeting 42 5\r\nhello\r\nVALUE empty 0 0\r\n\r\nEND\r\n"
+	if reply := send("get greeting missing empty\r\n", "END"); reply != want {
+		t.Errorf("Expected %q, got %q", want, reply)
+	}
+
+	if reply := send("touch greeting -1\r\n", "TOUCHED"); reply != "TOUCHED\r\n" {
+		t.Errorf("Expected TOUCHED, got %q", reply)
+	}
+	if reply := send("get greeting\r\n", "END"); reply != "END\r\n" {
+		t.Errorf("Expected the touched item to have expired, got %q", reply)
+	}
+	if reply := send("set old 0 1000000000 1\r\nx\r\nget old\r\n", "END"); reply != "STORED\r\nEND\r\n" {
+		t.Errorf("Expected an item expiring in the past to be a miss, got %q", reply)
+	}
+
+	if reply := send("delete empty\r\n", "DELETED"); reply != "DELETED\r\n" {
+		t.Errorf("Expected DELETED, got %q", reply)
+	}
+	if reply := send("delete empty\r\n", "NOT_FOUND"); reply != "NOT_FOUND\r\n" {
+		t.Errorf("Expected NOT_FOUND, got %q", reply)
+	}
+	if reply := send("set bad\r\n", ""); !strings.HasPrefix(reply, "CLIENT_ERROR") {
+		t.Errorf("Expected CLIENT_ERROR for a malformed set, got %q", reply)
+	}
+	if reply := send("set quiet 0 0 1 noreply\r\nq\r\nget quiet\r\n", "END"); reply != "VALUE quiet 0 1\r\nq\r\nEND\r\n" {
+		t.Errorf("Expected noreply to skip STORED, got %q", reply)
+	}
+}
@@ -0,0 +1,264 @@
+package objectfs_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"Lockr/bin/backup"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/objectfs"
+)
+
+// fakeS3 serves the part of the S3 API a Bucket uses, from memory: ranged and
+// conditional requests included
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	gets    int // ranged or whole reads of objects
+}
+
+// etag returns the ETag of an object's contents
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "bucket" {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	data, exists := s.objects[key]
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		prefix := r.URL.Query().Get("prefix")
+		var keys []string
+		for name := range s.objects {
+			if strings.HasPrefix(name, prefix) {
+				keys = append(keys, name)
+			}
+		}
+		sort.Strings(keys)
+		type object struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			ETag         string    `xml:"ETag"`
+			LastModified time.Time `xml:"LastModified"`
+		}
+		result := struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []object `xml:"Contents"`
+		}{}
+		for _, key := range keys {
+			result.Contents = append(result.Contents, object{Key: key, Size: int64(len(s.objects[key])), ETag: etag(s.objects[key]), LastModified: time.Now().UTC()})
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodPut:
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != etag(data)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		s.objects[key] = data
+		w.Header().Set("ETag", etag(data))
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && !exists:
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method == http.MethodGet {
+			w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>"))
+		}
+	case r.Method == http.MethodHead:
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	case r.Method == http.MethodGet:
+		s.gets++
+		w.Header().Set("ETag", etag(data))
+		if first, last, ok := strings.Cut(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-"); ok {
+			start, _ := strconv.Atoi(first)
+			end := len(data) - 1
+			if last != "" {
+				end, _ = strconv.Atoi(last)
+			}
+			data = data[start:min(end+1, len(data))]
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// openBucket serves a fake S3 bucket and returns it with a Bucket of it
+func openBucket(t *testing.T) (*fakeS3, *backup.Bucket) {
+	server := &fakeS3{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	t.Setenv("AWS_ENDPOINT_URL", ts.URL)
+	bucket, err := backup.OpenBucket("s3://bucket/lockr")
+	if err != nil {
+		t.Fatalf("Failed to open bucket: %v", err)
+	}
+	return server, bucket
+}
+
+// TestObjectFS tests that a tree on an FS keeps its SSTables and manifest in the
+// bucket and its log on disk, reopens from the bucket alone, and that the lease
+// keeps a second writer out
+func TestObjectFS(t *testing.T) {
+	server, bucket := openBucket(t)
+	dir := t.TempDir()
+	fsys, err := objectfs.Open(bucket, dir, objectfs.Options{BlockSize: 1024, Owner: "first"})
+	if err != nil {
+		t.Fatalf("Failed to open FS: %v", err)
+	}
+	var held *objectfs.ErrLeaseHeld
+	if _, err := objectfs.Open(bucket, t.TempDir(), objectfs.Options{Owner: "second"}); !errors.As(err, &held) || held.Owner != "first" {
+		t.Errorf("Expected the lease to be held by the first FS, got %v", err)
+	}
+
+	options := lsmtree.Options{MemTableSize: 1024, BlockSize: 256, FS: fsys}
+	tree := lsmtree.NewLSMTreeWithOptions(dir, options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := tree.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if logs, _ := filepath.Glob(filepath.Join(dir, "wal-*.log")); len(logs) == 0 {
+		t.Errorf("Expected the log on disk")
+	}
+	if _, err := tree.Reclaim(); err != nil {
+		t.Fatalf("Failed to reclaim: %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if err := fsys.Close(); err != nil {
+		t.Fatalf("Failed to close FS: %v", err)
+	}
+
+	server.mutex.Lock()
+	var tables int
+	for name := range server.objects {
+		if strings.HasPrefix(name, "lockr/sstable_") {
+			tables++
+		} else if name != "lockr/MANIFEST" {
+			t.Errorf("Expected only SSTables and the manifest in the bucket, got %s", name)
+		}
+	}
+	server.mutex.Unlock()
+	if tables == 0 {
+		t.Errorf("Expected SSTables in the bucket")
+	}
+	if local, _ := filepath.Glob(filepath.Join(dir, "sstable_*.dat")); len(local) != 0 {
+		t.Errorf("Expected no SSTables on disk, got %v", local)
+	}
+
+	// Another machine, with none of the local files, takes over once released
+	other := t.TempDir()
+	fsys, err = objectfs.Open(bucket, other, objectfs.Options{BlockSize: 1024, Owner: "second"})
+	if err != nil {
+		t.Fatalf("Failed to open FS after release: %v", err)
+	}
+	defer fsys.Close()
+	var gets int
+	for round := 0; round < 2; round++ {
+		reopened := lsmtree.NewLSMTreeWithOptions(other, lsmtree.Options{FS: fsys})
+		if err := reopened.Recover(); err != nil {
+			t.Fatalf("Failed to reopen: %v", err)
+		}
+		entries, err := reopened.List()
+		if err != nil || len(entries) != 500 || entries["key-499"] != "value-499" {
+			t.Errorf("Expected 500 entries from the bucket, got %d (%v)", len(entries), err)
+		}
+		if err := reopened.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+		server.mutex.Lock()
+		if round == 1 && server.gets != gets {
+			t.Errorf("Expected a second read to come from the block cache, got %d more reads", server.gets-gets)
+		}
+		gets = server.gets
+		server.mutex.Unlock()
+	}
+	if stats := fsys.CacheStats(); stats.Hits == 0 || stats.Blocks == 0 {
+		t.Errorf("Expected block cache hits, got %+v", stats)
+	}
+}
+
+// TestObjectFSLease tests that an expired lease is taken over, and that an FS
+// whose lease was taken over stops writing to the bucket
+func TestObjectFSLease(t *testing.T) {
+	server, bucket := openBucket(t)
+	server.objects["lockr/LEASE"] = []byte(fmt.Sprintf(`{"owner":"crashed","expires":%q}`, time.Now().Add(-time.Second).Format(time.RFC3339Nano)))
+
+	dir := t.TempDir()
+	fsys, err := objectfs.Open(bucket, dir, objectfs.Options{LeaseTTL: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Expected an expired lease to be taken over, got %v", err)
+	}
+	table := filepath.Join(dir, "sstable_1.dat")
+	file, err := fsys.Create(table)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if _, err := file.Write([]byte("data")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+
+	server.mutex.Lock()
+	server.objects["lockr/LEASE"] = []byte(fmt.Sprintf(`{"owner":"thief","expires":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339Nano)))
+	server.mutex.Unlock()
+	time.Sleep(500 * time.Millisecond)
+	if _, err := fsys.Create(filepath.Join(dir, "MANIFEST")); !errors.Is(err, objectfs.ErrLeaseLost) {
+		t.Errorf("Expected writes to fail once the lease is lost, got %v", err)
+	}
+	if err := fsys.Remove(table); !errors.Is(err, objectfs.ErrLeaseLost) {
+		t.Errorf("Expected removes to fail once the lease is lost, got %v", err)
+	}
+	if err := fsys.Close(); err != nil {
+		t.Fatalf("Failed to close FS: %v", err)
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if !strings.Contains(string(server.objects["lockr/LEASE"]), "thief") {
+		t.Errorf("Expected the lease taken over to be left alone, got %s", server.objects["lockr/LEASE"])
+	}
+	if _, err := os.Stat(table); !os.IsNotExist(err) {
+		t.Errorf("Expected the SSTable in the bucket only, got %v", err)
+	}
+}
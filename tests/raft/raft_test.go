@@ -0,0 +1,417 @@
+package raft_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"Lockr/bin/raft"
+)
+
+const secret = "test-secret"
+
+// memoryMachine is a state machine of key=value commands
+type memoryMachine struct {
+	mutex   sync.Mutex
+	values  map[string]string
+	applied uint64
+}
+
+func (m *memoryMachine) Apply(index uint64, command []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key, value, _ := strings.Cut(string(command), "=")
+	m.values[key] = value
+	m.applied = index
+	return nil
+}
+
+func (m *memoryMachine) Applied() (uint64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.applied, nil
+}
+
+func (m *memoryMachine) Snapshot() ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return json.Marshal(m.values)
+}
+
+func (m *memoryMachine) Restore(index uint64, snapshot []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values = map[string]string{}
+	m.applied = index
+	return json.Unmarshal(snapshot, &m.values)
+}
+
+func (m *memoryMachine) get(key string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.values[key]
+}
+
+// partitionable sends requests over HTTP unless the sender or the receiver is cut off
+type partitionable struct {
+	raft.HTTPTransport
+	cluster *cluster
+	from    string
+}
+
+func (t *partitionable) cut(addr string) error {
+	if t.cluster.isCut(t.from) || t.cluster.isCut(t.cluster.ids[addr]) {
+		return errors.New("partitioned")
+	}
+	return nil
+}
+
+func (t *partitionable) RequestVote(ctx context.Context, addr string, req raft.VoteRequest) (raft.VoteResponse, error) {
+	if err := t.cut(addr); err != nil {
+		return raft.VoteResponse{}, err
+	}
+	return t.HTTPTransport.RequestVote(ctx, addr, req)
+}
+
+func (t *partitionable) AppendEntries(ctx context.Context, addr string, req raft.AppendRequest) (raft.AppendResponse, error) {
+	if err := t.cut(addr); err != nil {
+		return raft.AppendResponse{}, err
+	}
+	return t.HTTPTransport.AppendEntries(ctx, addr, req)
+}
+
+func (t *partitionable) InstallSnapshot(ctx context.Context, addr string, req raft.SnapshotRequest) (raft.SnapshotResponse, error) {
+	if err := t.cut(addr); err != nil {
+		return raft.SnapshotResponse{}, err
+	}
+	return t.HTTPTransport.InstallSnapshot(ctx, addr, req)
+}
+
+func (t *partitionable) Propose(ctx context.Context, addr string, command []byte) (uint64, error) {
+	if err := t.cut(addr); err != nil {
+		return 0, err
+	}
+	return t.HTTPTransport.Propose(ctx, addr, command)
+}
+
+// member is a node of a test cluster, kept across restarts
+type member struct {
+	id      string
+	addr    string
+	storage *raft.MemoryStorage
+	machine *memoryMachine
+	node    *raft.Node
+}
+
+// cluster runs nodes on HTTP test servers
+type cluster struct {
+	t       *testing.T
+	options raft.Options
+	mutex   sync.Mutex
+	members map[string]*member
+	ids     map[string]string // IDs by address
+	cut     map[string]bool
+}
+
+func newCluster(t *testing.T, options raft.Options) *cluster {
+	return &cluster{t: t, options: options, members: map[string]*member{}, ids: map[string]string{}, cut: map[string]bool{}}
+}
+
+// add serves a new node, not yet started
+func (c *cluster) add(id string) *member {
+	m := &member{id: id, storage: raft.NewMemoryStorage(), machine: &memoryMachine{values: map[string]string{}}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mutex.Lock()
+		node := m.node
+		c.mutex.Unlock()
+		if node == nil {
+			http.Error(w, "not started", http.StatusServiceUnavailable)
+			return
+		}
+		raft.Handler(node, secret).ServeHTTP(w, r)
+	}))
+	c.t.Cleanup(server.Close)
+	m.addr = server.URL
+	c.mutex.Lock()
+	c.members[id], c.ids[m.addr] = m, id
+	c.mutex.Unlock()
+	return m
+}
+
+// start starts a member's node, bootstrapping the cluster with bootstrap if set
+func (c *cluster) start(m *member, bootstrap map[string]string) {
+	options := c.options
+	options.ID, options.Storage, options.StateMachine, options.Bootstrap = m.id, m.storage, m.machine, bootstrap
+	options.Transport = &partitionable{HTTPTransport: raft.HTTPTransport{Secret: secret}, cluster: c, from: m.id}
+	node, err := raft.Start(options)
+	if err != nil {
+		c.t.Fatalf("Failed to start %s: %v", m.id, err)
+	}
+	c.mutex.Lock()
+	m.node = node
+	c.mutex.Unlock()
+	c.t.Cleanup(node.Stop)
+}
+
+// bootstrap starts a cluster of n nodes
+func (c *cluster) bootstrap(n int) []*member {
+	var members []*member
+	addrs := map[string]string{}
+	for i := 1; i <= n; i++ {
+		m := c.add(fmt.Sprintf("n%d", i))
+		members = append(members, m)
+		addrs[m.id] = m.addr
+	}
+	for _, m := range members {
+		c.start(m, addrs)
+	}
+	return members
+}
+
+func (c *cluster) isCut(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.cut[id]
+}
+
+func (c *cluster) partition(id string, cut bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cut[id] = cut
+}
+
+// leader waits for one of members other than the cut ones to lead
+func (c *cluster) leader(members []*member) *member {
+	c.t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, m := range members {
+			if !c.isCut(m.id) && m.node.Status().Role == "leader" {
+				return m
+			}
+		}
+	}
+	c.t.Fatal("Expected a leader to be elected")
+	return nil
+}
+
+// waitFor waits until every member got value for key
+func waitFor(t *testing.T, members []*member, key, value string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		done := true
+		for _, m := range members {
+			done = done && m.machine.get(key) == value
+		}
+		if done {
+			return
+		}
+	}
+	for _, m := range members {
+		t.Errorf("%s has %s=%q, expected %q: %+v", m.id, key, m.machine.get(key), value, m.node.Status())
+	}
+	t.FailNow()
+}
+
+func propose(t *testing.T, m *member, command string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.node.Propose(ctx, []byte(command)); err != nil {
+		t.Fatalf("Failed to propose %s on %s: %v", command, m.id, err)
+	}
+}
+
+var fast = raft.Options{HeartbeatInterval: 20 * time.Millisecond, ElectionTimeout: 150 * time.Millisecond}
+
+// TestReplication tests that commands proposed on any node are applied by every
+// node, and reads after a barrier see them
+func TestReplication(t *testing.T) {
+	c := newCluster(t, fast)
+	members := c.bootstrap(3)
+	leader := c.leader(members)
+	var follower *member
+	for _, m := range members {
+		if m != leader {
+			follower = m
+		}
+	}
+	propose(t, leader, "a=1")
+	propose(t, follower, "b=2")
+	if got := follower.machine.get("b"); got != "2" {
+		t.Errorf("Expected a forwarded proposal to be applied on return, got %q", got)
+	}
+	waitFor(t, members, "a", "1")
+	waitFor(t, members, "b", "2")
+
+	if err := follower.node.Barrier(context.Background()); err != nil || follower.machine.get("a") != "1" {
+		t.Errorf("Expected a barrier to see a=1, got %q, %v", follower.machine.get("a"), err)
+	}
+	status := follower.node.Status()
+	if status.Leader != leader.id || status.LeaderAddress != leader.addr || status.Commit != status.Applied {
+		t.Errorf("Expected the follower to know %s and have applied every commit, got %+v", leader.id, status)
+	}
+}
+
+// TestFailover tests that a new leader takes over from one cut off, keeping the
+// committed commands, and that the old one catches up once back
+func TestFailover(t *testing.T) {
+	c := newCluster(t, fast)
+	members := c.bootstrap(3)
+	old := c.leader(members)
+	propose(t, old, "a=1")
+	waitFor(t, members, "a", "1")
+
+	c.partition(old.id, true)
+	leader := c.leader(members)
+	if leader == old {
+		t.Fatal("Expected another leader")
+	}
+	propose(t, leader, "b=2")
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := old.node.Propose(ctx, []byte("c=3")); err == nil {
+		t.Error("Expected a leader cut off from its majority to commit nothing")
+	}
+
+	c.partition(old.id, false)
+	waitFor(t, members, "b", "2")
+	if old.machine.get("c") != "" {
+		t.Error("Expected the cut off leader's uncommitted command to be dropped")
+	}
+	if c.leader(members).node.Status().Term <= 1 {
+		t.Error("Expected a later term after the failover")
+	}
+}
+
+// TestMembershipChange tests replacing a member through a joint configuration
+func TestMembershipChange(t *testing.T) {
+	c := newCluster(t, fast)
+	members := c.bootstrap(3)
+	leader := c.leader(members)
+	propose(t, leader, "a=1")
+
+	joining := c.add("n4")
+	c.start(joining, nil)
+	var removed *member
+	config := map[string]string{joining.id: joining.addr}
+	for _, m := range members {
+		if m != leader && removed == nil {
+			removed = m
+			continue
+		}
+		config[m.id] = m.addr
+	}
+	if err := members[0].node.ChangeMembers(context.Background(), config); err != nil {
+		t.Fatalf("Failed to change members: %v", err)
+	}
+	waitFor(t, []*member{joining}, "a", "1")
+
+	remaining := []*member{joining}
+	for _, m := range members {
+		if m != removed {
+			remaining = append(remaining, m)
+		}
+	}
+	propose(t, joining, "b=2")
+	waitFor(t, remaining, "b", "2")
+	status := c.leader(remaining).node.Status()
+	if status.Config.Joint() || len(status.Config.Members) != 3 || status.Config.Members[removed.id] != "" {
+		t.Errorf("Expected the new members alone, got %+v", status.Config)
+	}
+
+	// The new members carry on without the removed node and one more
+	c.partition(removed.id, true)
+	c.partition(leader.id, true)
+	remaining = remaining[:0]
+	for _, m := range append(members, joining) {
+		if m != removed && m != leader {
+			remaining = append(remaining, m)
+		}
+	}
+	propose(t, c.leader(remaining), "c=3")
+	waitFor(t, remaining, "c", "3")
+}
+
+// TestSnapshotCatchUp tests that a follower missing compacted entries catches up
+// from the leader's snapshot, and that a restarted node keeps its log
+func TestSnapshotCatchUp(t *testing.T) {
+	options := fast
+	options.SnapshotThreshold = 5
+	c := newCluster(t, options)
+	members := c.bootstrap(3)
+	leader := c.leader(members)
+	var behind *member
+	for _, m := range members {
+		if m != leader {
+			behind = m
+		}
+	}
+	c.partition(behind.id, true)
+	for i := 0; i < 20; i++ {
+		propose(t, leader, fmt.Sprintf("k%d=%d", i, i))
+	}
+	if status := leader.node.Status(); status.Snapshot == 0 {
+		t.Fatalf("Expected the leader to compact its log, got %+v", status)
+	}
+	c.partition(behind.id, false)
+	waitFor(t, members, "k19", "19")
+	if got := behind.machine.get("k0"); got != "0" {
+		t.Errorf("Expected the snapshot to hold k0, got %q", got)
+	}
+
+	behind.node.Stop()
+	c.start(behind, nil)
+	propose(t, c.leader(members), "after=restart")
+	waitFor(t, members, "after", "restart")
+}
+
+// TestTransportUnavailable tests that a node answering 503 with an error of its
+// own, like one being restarted, fails proposals with ErrNoLeader so callers
+// retry them, while other failures aren't retried
+func TestTransportUnavailable(t *testing.T) {
+	var mutex sync.Mutex
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		calls++
+		n := calls
+		mutex.Unlock()
+		if n <= 2 {
+			http.Error(w, "not started", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"index":7}`))
+	}))
+	defer server.Close()
+	transport := &raft.HTTPTransport{Secret: secret}
+
+	attempts := 0
+	var index uint64
+	var err error
+	for attempts < 5 {
+		attempts++
+		if index, err = transport.Propose(context.Background(), server.URL, []byte("a=1")); !errors.Is(err, raft.ErrNoLeader) {
+			break
+		}
+	}
+	if err != nil || index != 7 || attempts != 3 {
+		t.Errorf("Expected the proposal to be retried past two 503s and applied at 7, got %d after %d attempts (%v)", index, attempts, err)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "disk full", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	_, err = transport.Propose(context.Background(), failing.URL, []byte("a=1"))
+	if err == nil || errors.Is(err, raft.ErrNoLeader) {
+		t.Errorf("Expected a 500 not to be retried, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package release_test
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+
+	"Lockr/bin/release"
+)
+
+// TestManifestVerify tests that signed manifests accept their binaries and reject tampering
+func TestManifestVerify(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	manifest := &release.Manifest{
+		Version:  "v1.0.0",
+		Binaries: map[string]string{"lockr-linux-amd64": "aaaa", "lockr-darwin-arm64": "bbbb"},
+	}
+	if err := manifest.Sign(privateKey); err != nil {
+		t.Fatalf("Failed to sign manifest: %v", err)
+	}
+
+	result, err := manifest.Verify(publicKey, "bbbb")
+	if err != nil {
+		t.Fatalf("Failed to verify manifest: %v", err)
+	}
+	if result.Asset != "lockr-darwin-arm64" || result.Version != "v1.0.0" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	if _, err := manifest.Verify(publicKey, "cccc"); !errors.Is(err, release.ErrTampered) {
+		t.Errorf("Expected unknown checksum to be rejected, got %v", err)
+	}
+
+	manifest.Binaries["lockr-linux-amd64"] = "cccc"
+	if _, err := manifest.Verify(publicKey, "cccc"); !errors.Is(err, release.ErrTampered) {
+		t.Errorf("Expected modified manifest to be rejected, got %v", err)
+	}
+
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+	if _, err := manifest.Verify(otherKey, "bbbb"); !errors.Is(err, release.ErrTampered) {
+		t.Errorf("Expected manifest signed with another key to be rejected, got %v", err)
+	}
+}
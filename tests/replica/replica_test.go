@@ -0,0 +1,117 @@
+package replica_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"Lockr/bin/client"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/replica"
+	"Lockr/bin/server"
+)
+
+// openTree opens a tree in a temporary directory, closed when the test ends
+func openTree(t *testing.T, options lsmtree.Options) *lsmtree.LSMTree {
+	t.Helper()
+	tree := lsmtree.NewLSMTreeWithOptions(t.TempDir(), options)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	t.Cleanup(func() { tree.Close() })
+	return tree
+}
+
+// serveLeader serves a tree to followers over HTTP
+func serveLeader(t *testing.T, tree *lsmtree.LSMTree) string {
+	t.Helper()
+	srv := server.New(tree)
+	srv.EnableReplication(tree)
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+// sync syncs a follower, failing the test on an error
+func sync(t *testing.T, follower *replica.Follower) replica.SyncResult {
+	t.Helper()
+	result, err := follower.Sync(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	return result
+}
+
+// TestFollow tests that a follower starts from a snapshot, applies the leader's
+// later writes, refuses its own until promoted and starts over when it can't catch up
+func TestFollow(t *testing.T) {
+	leader := openTree(t, lsmtree.Options{MemTableSize: 1 << 20})
+	url := serveLeader(t, leader)
+	leader.Set("a", "1")
+	leader.Set("b", "2")
+
+	tree := openTree(t, lsmtree.Options{MemTableSize: 1 << 20})
+	tree.Set("local", "x")
+	c := client.New(url)
+	defer c.Close()
+	follower, err := replica.Follow(tree, url, c)
+	if err != nil {
+		t.Fatalf("Failed to follow: %v", err)
+	}
+	if result := sync(t, follower); !result.Restored || result.Keys != 2 {
+		t.Errorf("Expected a snapshot of 2 keys, got %+v", result)
+	}
+	want := map[string]string{"a": "1", "b": "2"}
+	if entries, _ := tree.List(); !reflect.DeepEqual(entries, want) {
+		t.Errorf("Expected the leader's keys alone, got %v", entries)
+	}
+	if err := tree.Set("c", "3"); !errors.Is(err, lsmtree.ErrReadOnly) {
+		t.Errorf("Expected a follower to be read-only, got %v", err)
+	}
+
+	leader.Set("c", "3")
+	leader.Delete("a")
+	if result := sync(t, follower); result.Restored || result.Changes != 2 || result.Seq != leader.ChangesHead() {
+		t.Errorf("Expected 2 changes up to the head %d, got %+v", leader.ChangesHead(), result)
+	}
+	want = map[string]string{"b": "2", "c": "3"}
+	if entries, _ := tree.List(); !reflect.DeepEqual(entries, want) {
+		t.Errorf("Expected the leader's writes to be applied, got %v", entries)
+	}
+	if result := sync(t, follower); result.Changes != 0 {
+		t.Errorf("Expected nothing to apply once caught up, got %+v", result)
+	}
+
+	// Without an archive, writes flushed before the follower read them are gone
+	flushing := openTree(t, lsmtree.Options{MemTableSize: 1})
+	flushingURL := serveLeader(t, flushing)
+	flushing.Set("d", "4")
+	c = client.New(flushingURL)
+	defer c.Close()
+	if follower, err = replica.Follow(tree, flushingURL, c); err != nil {
+		t.Fatalf("Failed to follow: %v", err)
+	}
+	if result := sync(t, follower); !result.Restored {
+		t.Errorf("Expected a new leader to start from a snapshot, got %+v", result)
+	}
+	flushing.Set("e", "5")
+	if result := sync(t, follower); !result.Restored || result.Keys != 2 {
+		t.Errorf("Expected a snapshot once the writes were flushed, got %+v", result)
+	}
+	want = map[string]string{"d": "4", "e": "5"}
+	if entries, _ := tree.List(); !reflect.DeepEqual(entries, want) {
+		t.Errorf("Expected the new leader's keys alone, got %v", entries)
+	}
+
+	if err := replica.Promote(tree); err != nil {
+		t.Fatalf("Failed to promote: %v", err)
+	}
+	if leader, _ := replica.Leader(tree); leader != "" {
+		t.Errorf("Expected no leader after promotion, got %q", leader)
+	}
+	if err := tree.Set("f", "6"); err != nil {
+		t.Errorf("Expected a promoted follower to be writable, got %v", err)
+	}
+}
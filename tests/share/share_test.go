@@ -0,0 +1,130 @@
+package share_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+
+	"Lockr/bin/share"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TestAgeKeys tests that age identities and recipients parse and encode as age does
+func TestAgeKeys(t *testing.T) {
+	// The identity and recipient of age's test key, a secret of 32 0x42 bytes
+	identity, err := share.ParseIdentity([]byte("# created: 2026-10-14\nAGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX\n"), nil)
+	if err != nil {
+		t.Fatalf("Failed to parse identity: %v", err)
+	}
+	const recipient = "age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj"
+	if got := identity.Recipient().String(); got != recipient {
+		t.Errorf("Expected recipient %s, got %s", recipient, got)
+	}
+	if got := identity.String(); got != "AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX" {
+		t.Errorf("Identity encoded as %s", got)
+	}
+
+	r, err := share.ParseRecipient(recipient)
+	if err != nil {
+		t.Fatalf("Failed to parse recipient: %v", err)
+	}
+	blob, err := share.Seal(r, "db/password", "hunter2")
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	key, value, err := share.Open(identity, blob)
+	if err != nil || key != "db/password" || value != "hunter2" {
+		t.Errorf("Expected db/password=hunter2, got %q=%q (%v)", key, value, err)
+	}
+
+	for _, invalid := range []string{"", "age1", recipient[:len(recipient)-1] + "q", strings.ToUpper(recipient[:10]) + recipient[10:]} {
+		if _, err := share.ParseRecipient(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+// TestSSHKeys tests sharing with an ssh-ed25519 key and receiving with its private key
+func TestSSHKeys(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := share.ParseRecipient(string(ssh.MarshalAuthorizedKey(sshPub)))
+	if err != nil {
+		t.Fatalf("Failed to parse SSH recipient: %v", err)
+	}
+
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	asked := false
+	identity, err := share.ParseIdentity(pem.EncodeToMemory(block), func() ([]byte, error) {
+		asked = true
+		return []byte("secret"), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse SSH identity: %v", err)
+	}
+	if !asked {
+		t.Error("Expected the passphrase to be asked for")
+	}
+	if identity.Recipient().String() != recipient.String() {
+		t.Errorf("Identity and public key give different recipients: %s and %s", identity.Recipient(), recipient)
+	}
+
+	blob, err := share.Seal(recipient, "api/token", "line one\nline two")
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	key, value, err := share.Open(identity, blob)
+	if err != nil || key != "api/token" || value != "line one\nline two" {
+		t.Errorf("Expected api/token, got %q=%q (%v)", key, value, err)
+	}
+}
+
+// TestOpenRejects tests that blobs only open for their recipient and unmodified
+func TestOpenRejects(t *testing.T) {
+	alice, err := share.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := share.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := share.Seal(alice.Recipient(), "key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := share.Seal(alice.Recipient(), "key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob == other {
+		t.Error("Expected sealing twice to give different blobs")
+	}
+
+	if _, _, err := share.Open(bob, blob); !errors.Is(err, share.ErrNotRecipient) {
+		t.Errorf("Expected ErrNotRecipient for another identity, got %v", err)
+	}
+	tampered := blob[:len(blob)-2] + "AA"
+	if tampered == blob {
+		tampered = blob[:len(blob)-2] + "BB"
+	}
+	if _, _, err := share.Open(alice, tampered); err == nil {
+		t.Error("Expected a tampered blob to be rejected")
+	}
+	if _, _, err := share.Open(alice, "not a blob"); err == nil {
+		t.Error("Expected a malformed blob to be rejected")
+	}
+}
@@ -0,0 +1,73 @@
+package templates_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"Lockr/bin/templates"
+)
+
+// TestTemplateEntries tests that entries created from built-in and user-defined templates round-trip through their stored value
+func TestTemplateEntries(t *testing.T) {
+	dir := t.TempDir()
+	defined := `[{"name": "server", "fields": [{"name": "host"}, {"name": "password", "label": "Root password", "secret": true}]}]`
+	if err := os.WriteFile(filepath.Join(dir, "templates.json"), []byte(defined), 0600); err != nil {
+		t.Fatalf("Failed to write templates: %v", err)
+	}
+
+	all, err := templates.Load(dir)
+	if err != nil {
+		t.Fatalf("Failed to load templates: %v", err)
+	}
+	if _, ok := all["login"]; !ok {
+		t.Fatal("Expected the built-in login template")
+	}
+	server, ok := all["server"]
+	if !ok {
+		t.Fatal("Expected the user-defined server template")
+	}
+	if server.Key("db1") != "server/db1" {
+		t.Errorf("Expected key 'server/db1', got '%s'", server.Key("db1"))
+	}
+
+	value, err := server.NewEntry(map[string]string{"host": "db1.internal", "password": "hunter2"}).Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode entry: %v", err)
+	}
+	entry, ok := templates.Decode(value)
+	if !ok {
+		t.Fatalf("Failed to decode entry %s", value)
+	}
+	if entry.Get("password") != "hunter2" {
+		t.Errorf("Expected password 'hunter2', got '%s'", entry.Get("password"))
+	}
+
+	if !entry.Fields[1].Secret || entry.Fields[0].Secret {
+		t.Errorf("Expected only the password field to be marked secret, got %+v", entry.Fields)
+	}
+	if summary := entry.Summary(); summary != "[server] db1.internal" {
+		t.Errorf("Expected the summary to leave out secret fields, got %q", summary)
+	}
+
+	expected := "[server]\n  host:           db1.internal\n  Root password:  hunter2"
+	if rendered := entry.Render(); rendered != expected {
+		t.Errorf("Expected rendering\n%s\ngot\n%s", expected, rendered)
+	}
+
+	if _, ok := templates.Decode("plain secret"); ok {
+		t.Error("Expected a plain value not to decode as an entry")
+	}
+}
+
+// TestInvalidTemplates tests that malformed user-defined templates are rejected
+func TestInvalidTemplates(t *testing.T) {
+	dir := t.TempDir()
+	defined := `[{"name": "bad/name", "fields": [{"name": "x"}]}]`
+	if err := os.WriteFile(filepath.Join(dir, "templates.json"), []byte(defined), 0600); err != nil {
+		t.Fatalf("Failed to write templates: %v", err)
+	}
+	if _, err := templates.Load(dir); err == nil {
+		t.Error("Expected an error for a template name with a slash")
+	}
+}
@@ -0,0 +1,135 @@
+package vault_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"Lockr/bin/lockrtest"
+	"Lockr/bin/lsmtree"
+	"Lockr/bin/vault"
+)
+
+// TestVaultContexts tests that each prefix is encrypted under its own independently unlockable key
+func TestVaultContexts(t *testing.T) {
+	dir := t.TempDir()
+	store := lockrtest.NewFake()
+	lockrtest.Populate(t, store, map[string]string{"work/existing": "old", "public": "plain"})
+
+	v, err := vault.Open(dir, store)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	if err := v.AddContext("work", "work/", "work-pass"); err != nil {
+		t.Fatalf("Failed to add context: %v", err)
+	}
+	if err := v.AddContext("personal", "personal/", "personal-pass"); err != nil {
+		t.Fatalf("Failed to add context: %v", err)
+	}
+	lockrtest.Populate(t, v, map[string]string{"work/token": "w", "personal/pin": "p"})
+
+	for _, key := range []string{"work/existing", "work/token", "personal/pin"} {
+		if raw, _ := store.Get(key); !strings.HasPrefix(raw, "enc1:") {
+			t.Errorf("Expected %s to be stored encrypted, got %q", key, raw)
+		}
+	}
+	lockrtest.AssertValue(t, store, "public", "plain")
+
+	// Reopen with every context locked and unlock only one of them
+	reopened, err := vault.Open(dir, store)
+	if err != nil {
+		t.Fatalf("Failed to reopen vault: %v", err)
+	}
+	if err := reopened.Unlock("work", "personal-pass"); !errors.Is(err, vault.ErrWrongKey) {
+		t.Errorf("Expected wrong passphrase to be rejected, got %v", err)
+	}
+	if err := reopened.Unlock("work", "work-pass"); err != nil {
+		t.Fatalf("Failed to unlock context: %v", err)
+	}
+	lockrtest.AssertValue(t, reopened, "work/existing", "old")
+	lockrtest.AssertValue(t, reopened, "work/token", "w")
+	if _, err := reopened.Get("personal/pin"); !errors.Is(err, vault.ErrLocked) {
+		t.Errorf("Expected locked context to refuse reads, got %v", err)
+	}
+
+	entries := lockrtest.Dump(t, reopened, "", "")
+	if len(entries) != 3 || entries["work/token"] != "w" || entries["public"] != "plain" {
+		t.Errorf("Expected scan to decrypt unlocked values and skip locked ones, got %v", entries)
+	}
+
+	// Exported key material only unlocks its own context
+	key, err := reopened.ExportKey("work")
+	if err != nil {
+		t.Fatalf("Failed to export key: %v", err)
+	}
+	if err := reopened.UnlockWithKey("personal", key); !errors.Is(err, vault.ErrWrongKey) {
+		t.Errorf("Expected work key to be rejected for personal, got %v", err)
+	}
+}
+
+// TestVaultVersions tests that versions are decrypted and that encrypting a prefix drops its plaintext versions
+func TestVaultVersions(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTreeWithOptions(dir, lsmtree.Options{Versions: lsmtree.VersionRetention{Keep: 10}})
+	defer tree.Close()
+	lockrtest.Populate(t, tree, map[string]string{"work/token": "plain"})
+
+	v, err := vault.Open(dir, tree)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	if err := v.AddContext("work", "work/", "work-pass"); err != nil {
+		t.Fatalf("Failed to add context: %v", err)
+	}
+	lockrtest.Populate(t, v, map[string]string{"work/token": "secret"})
+
+	versions, err := v.Versions("work/token")
+	if err != nil || len(versions) != 2 || versions[0].Value != "plain" || versions[1].Value != "secret" {
+		t.Fatalf("Expected the encrypted versions to read back, got %+v, %v", versions, err)
+	}
+	raw, _ := tree.Versions("work/token")
+	for _, version := range raw {
+		if !strings.HasPrefix(version.Value, "enc1:") {
+			t.Errorf("Expected version %d to be stored encrypted, got %q", version.Number, version.Value)
+		}
+	}
+}
+
+// TestVaultWatch tests that a watch reports decrypted values and skips the keys
+// of locked contexts
+func TestVaultWatch(t *testing.T) {
+	dir := t.TempDir()
+	tree := lsmtree.NewLSMTree(dir)
+	if err := tree.Recover(); err != nil {
+		t.Fatalf("Failed to open tree: %v", err)
+	}
+	defer tree.Close()
+	v, err := vault.Open(dir, tree)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	for _, name := range []string{"work", "home"} {
+		if err := v.AddContext(name, name+"/", name+"-pass"); err != nil {
+			t.Fatalf("Failed to add context: %v", err)
+		}
+	}
+	lockrtest.Populate(t, v, map[string]string{"work/token": "old", "home/pin": "1"})
+	events, stop, err := v.Watch("")
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer stop()
+
+	if err := v.Lock("home"); err != nil {
+		t.Fatalf("Failed to lock context: %v", err)
+	}
+	if err := tree.Set("home/pin", "sealed elsewhere"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := v.Set("work/token", "new"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if event := <-events; event.Key != "work/token" || event.OldValue != "old" || event.NewValue != "new" {
+		t.Errorf("Expected work/token set from old to new, got %+v", event)
+	}
+}